@@ -10,13 +10,13 @@ import (
 	"time"
 
 	"github.com/jinzhu/gorm"
-	"github.com/sebest/xff"
 
 	"github.com/pborman/uuid"
 	"github.com/rs/cors"
 	"github.com/sirupsen/logrus"
 
 	"github.com/go-chi/chi"
+	"github.com/netlify/gocommerce/claims"
 	"github.com/netlify/gocommerce/conf"
 	gcontext "github.com/netlify/gocommerce/context"
 )
@@ -33,6 +33,7 @@ var (
 type API struct {
 	handler    http.Handler
 	db         *gorm.DB
+	readDB     *gorm.DB
 	config     *conf.GlobalConfiguration
 	httpClient *http.Client
 	version    string
@@ -79,31 +80,49 @@ func NewAPI(globalConfig *conf.GlobalConfiguration, log logrus.FieldLogger, db *
 
 // NewAPIWithVersion instantiates a new REST API.
 func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfiguration, log logrus.FieldLogger, db *gorm.DB, version string) *API {
+	return NewAPIWithReadDB(ctx, globalConfig, log, db, nil, version)
+}
+
+// NewAPIWithReadDB instantiates a new REST API that runs list and view
+// queries against a read replica. A nil readDB falls back to the primary.
+func NewAPIWithReadDB(ctx context.Context, globalConfig *conf.GlobalConfiguration, log logrus.FieldLogger, db *gorm.DB, readDB *gorm.DB, version string) *API {
 	api := &API{
 		config:     globalConfig,
 		db:         db,
+		readDB:     readDB,
 		httpClient: &http.Client{},
 		version:    version,
 	}
 
-	xffmw, _ := xff.Default()
 	logger := newStructuredLogger(log)
 
 	r := newRouter()
-	r.UseBypass(xffmw.Handler)
+	proxies, err := globalConfig.TrustedProxyNetworks()
+	if err != nil {
+		log.WithError(err).Fatal("Invalid trusted proxies")
+	}
+	if len(proxies) > 0 {
+		r.UseBypass(withTrustedProxies(proxies))
+	}
 	r.Use(withRequestID)
 	r.Use(recoverer)
+	r.Use(api.limitBody)
 
 	r.Get("/health", api.HealthCheck)
 
+	paymentTimeout := api.withTimeout(globalConfig.API.PaymentTimeout)
+
 	r.Route("/", func(r *router) {
 		r.UseBypass(logger)
+		r.UseBypass(api.withTimeout(globalConfig.API.RequestTimeout))
 		r.Use(api.loggingDB)
 		if globalConfig.MultiInstanceMode {
 			r.Use(api.loadInstanceConfig)
 		}
 		r.Use(api.withToken)
+		r.Use(api.withSite)
 
+		r.Get("/", api.Index)
 		r.Route("/orders", api.orderRoutes)
 		r.Route("/users", api.userRoutes)
 
@@ -112,35 +131,70 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 			r.Get("/{download_id}", api.DownloadURL)
 		})
 
+		r.Get("/products/*", api.ProductView)
+
 		r.Route("/vatnumbers", func(r *router) {
 			r.Get("/{vat_number}", api.VatNumberLookup)
 		})
 
 		r.Route("/payments", func(r *router) {
-			r.With(adminRequired).Get("/", api.PaymentList)
+			r.With(requirePermission(claims.PaymentsRead)).Get("/", api.PaymentList)
+			r.WithBypass(paymentTimeout).With(requirePermission(claims.PaymentsWrite)).Post("/sync", api.PaymentSyncPending)
+			r.With(requirePermission(claims.PaymentsRead)).Get("/export", api.PaymentExport)
 			r.Route("/{payment_id}", func(r *router) {
-				r.With(adminRequired).Get("/", api.PaymentView)
-				r.With(adminRequired).With(addGetBody).Post("/refund", api.PaymentRefund)
-				r.Post("/confirm", api.PaymentConfirm)
+				r.With(requirePermission(claims.PaymentsRead)).Get("/", api.PaymentView)
+				r.WithBypass(paymentTimeout).With(requirePermission(claims.RefundsWrite)).With(rejectImpersonation).With(addGetBody).Post("/refund", api.PaymentRefund)
+				r.WithBypass(paymentTimeout).With(requirePermission(claims.PaymentsWrite)).Post("/sync", api.PaymentSync)
+				r.With(requirePermission(claims.PaymentsRead)).Get("/disputes", api.PaymentDisputeList)
+				r.WithBypass(paymentTimeout).With(rejectImpersonation).Post("/confirm", api.PaymentConfirm)
 			})
 		})
 
+		r.Route("/stripe", func(r *router) {
+			r.Post("/webhook", api.StripeWebhook)
+		})
+
 		r.Route("/paypal", func(r *router) {
-			r.With(addGetBody).Post("/", api.PreauthorizePayment)
+			r.WithBypass(paymentTimeout).With(rejectImpersonation).With(addGetBody).Post("/", api.PreauthorizePayment)
+			r.Post("/webhook", api.PayPalWebhook)
 		})
 
 		r.Route("/reports", func(r *router) {
-			r.Use(adminRequired)
+			r.Use(requirePermission(claims.ReportsRead))
 
 			r.Get("/sales", api.SalesReport)
 			r.Get("/products", api.ProductsReport)
+			r.Get("/settlement", api.SettlementReport)
+		})
+
+		r.Route("/inventory", func(r *router) {
+			r.With(requirePermission(claims.InventoryRead)).Get("/", api.StockList)
+			r.With(requirePermission(claims.InventoryWrite)).Put("/{sku}", api.StockUpdate)
 		})
 
 		r.Route("/coupons", func(r *router) {
-			r.With(adminRequired).Get("/", api.CouponList)
+			r.With(requirePermission(claims.CouponsRead)).Get("/", api.CouponList)
 			r.Get("/{coupon_code}", api.CouponView)
 		})
 
+		r.Route("/gift_cards", func(r *router) {
+			r.With(requirePermission(claims.GiftCardsRead)).Get("/", api.GiftCardList)
+			r.With(requirePermission(claims.GiftCardsWrite)).Post("/", api.GiftCardCreate)
+			r.Get("/{gift_card_code}", api.GiftCardView)
+		})
+
+		r.Route("/webhooks", func(r *router) {
+			r.With(requirePermission(claims.WebhooksRead)).Get("/", api.WebhookSubscriptionList)
+			r.With(requirePermission(claims.WebhooksWrite)).Post("/", api.WebhookSubscriptionCreate)
+			r.With(requirePermission(claims.WebhooksRead)).Get("/failed", api.FailedWebhookList)
+			r.With(requirePermission(claims.WebhooksWrite)).Post("/{hook_id}/retry", api.FailedWebhookRetry)
+			r.With(requirePermission(claims.WebhooksWrite)).Put("/{subscription_id}", api.WebhookSubscriptionUpdate)
+			r.With(requirePermission(claims.WebhooksWrite)).Delete("/{subscription_id}", api.WebhookSubscriptionDelete)
+		})
+
+		r.With(requirePermission(claims.AuditRead)).Get("/audit", api.AuditLogList)
+		r.With(requirePermission(claims.JobsRead)).Get("/jobs", api.JobList)
+
 		r.Get("/settings", api.ViewSettings)
 
 		r.With(authRequired).Post("/claim", api.ClaimOrders)
@@ -166,10 +220,11 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 	}
 
 	corsHandler := cors.New(cors.Options{
-		AllowedMethods:   []string{"GET", "POST", "PATCH", "PUT", "DELETE"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type"},
-		ExposedHeaders:   []string{"Link", "X-Total-Count"},
-		AllowCredentials: true,
+		AllowOriginRequestFunc: corsOriginFunc(ctx),
+		AllowedMethods:         []string{"GET", "POST", "PATCH", "PUT", "DELETE"},
+		AllowedHeaders:         []string{"Accept", "Authorization", "Content-Type"},
+		ExposedHeaders:         []string{"Link", "X-Total-Count"},
+		AllowCredentials:       true,
 	})
 
 	api.handler = corsHandler.Handler(chi.ServerBaseContext(ctx, r))
@@ -179,49 +234,89 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 func (a *API) orderRoutes(r *router) {
 	r.With(authRequired).Get("/", a.OrderList)
 	r.Post("/", a.OrderCreate)
+	r.Post("/preview", a.OrderPreview)
+	r.With(requirePermission(claims.OrdersWrite)).Post("/fulfillment/bulk", a.OrderBulkFulfillment)
+	r.Get("/by-number/{number}", a.OrderByNumber)
 
 	r.Route("/{order_id}", func(r *router) {
 		r.Use(a.withOrderID)
 		r.Get("/", a.OrderView)
-		r.With(adminRequired).Put("/", a.OrderUpdate)
+		r.With(requirePermission(claims.OrdersWrite)).Put("/", a.OrderUpdate)
+		r.With(requirePermission(claims.OrdersWrite)).Patch("/", a.OrderPatch)
+		r.Get("/transitions", a.OrderTransitions)
+		r.Get("/items/{item_id}", a.LineItemView)
+		r.Get("/shipping_estimate", a.ShippingEstimate)
+		r.With(requirePermission(claims.OrdersWrite)).Put("/shipments/{shipment_id}", a.ShipmentUpdate)
+		r.With(authRequired).Post("/claim", a.ClaimOrder)
+		r.Post("/cancel", a.OrderCancel)
+
+		r.Route("/returns", func(r *router) {
+			r.Get("/", a.ReturnList)
+			r.Post("/", a.ReturnCreate)
+			r.With(requirePermission(claims.OrdersWrite)).Put("/{return_id}", a.ReturnUpdate)
+		})
+
+		r.Route("/notes", func(r *router) {
+			r.Get("/", a.OrderNoteList)
+			r.With(requirePermission(claims.OrdersWrite)).Post("/", a.OrderNoteCreate)
+		})
 
 		r.Route("/payments", func(r *router) {
+			paymentTimeout := a.withTimeout(a.config.API.PaymentTimeout)
 			r.With(authRequired).Get("/", a.PaymentListForOrder)
-			r.With(addGetBody).Post("/", a.PaymentCreate)
+			r.WithBypass(paymentTimeout).With(rejectImpersonation).With(addGetBody).Post("/", a.PaymentCreate)
+			r.WithBypass(paymentTimeout).With(requirePermission(claims.PaymentsWrite)).Post("/{payment_id}/capture", a.PaymentCapture)
 		})
 
 		r.Route("/downloads", func(r *router) {
 			r.Get("/", a.DownloadList)
 			r.Post("/refresh", a.DownloadRefresh)
 		})
+		r.With(requirePermission(claims.OrdersRead)).Get("/packing_slip", a.PackingSlip)
 		r.Get("/receipt", a.ReceiptView)
 		r.Post("/receipt", a.ResendOrderReceipt)
+		r.Post("/resend_confirmation", a.ResendConfirmation)
 	})
 }
 
 func (a *API) userRoutes(r *router) {
 	r.Use(authRequired)
-	r.With(adminRequired).Get("/", a.UserList)
-	r.With(adminRequired).Delete("/", a.UserBulkDelete)
+	r.With(requirePermission(claims.UsersRead)).Get("/", a.UserList)
+	r.With(requirePermission(claims.UsersDelete)).Delete("/", a.UserBulkDelete)
 
 	r.Route("/{user_id}", func(r *router) {
 		r.Use(a.withUser)
 		r.Use(ensureUserAccess)
 
 		r.Get("/", a.UserView)
-		r.With(adminRequired).Delete("/", a.UserDelete)
+		r.Post("/", a.UserUpdate)
+		r.With(requirePermission(claims.UsersDelete)).With(rejectImpersonation).Delete("/", a.UserDelete)
+		r.With(requirePermission(claims.UsersImpersonate)).Post("/impersonate", a.UserImpersonate)
+		r.With(rejectImpersonation).Get("/export", a.UserExport)
 
 		r.Get("/payments", a.PaymentListForUser)
+		r.Route("/payment_methods", func(r *router) {
+			r.Use(rejectImpersonation)
+
+			r.Get("/", a.PaymentMethodList)
+			r.Post("/", a.PaymentMethodCreate)
+		})
 		r.Get("/orders", a.OrderList)
 
 		r.Route("/addresses", func(r *router) {
 			r.Get("/", a.AddressList)
-			r.With(adminRequired).Post("/", a.CreateNewAddress)
+			r.With(requirePermission(claims.UsersWrite)).With(rejectImpersonation).Post("/", a.CreateNewAddress)
 			r.Route("/{addr_id}", func(r *router) {
 				r.Get("/", a.AddressView)
-				r.With(adminRequired).Delete("/", a.AddressDelete)
+				r.With(requirePermission(claims.UsersWrite)).With(rejectImpersonation).Delete("/", a.AddressDelete)
 			})
 		})
+
+		r.Route("/tax_exemptions", func(r *router) {
+			r.Get("/", a.TaxExemptionList)
+			r.With(requirePermission(claims.UsersWrite)).Post("/", a.TaxExemptionCreate)
+			r.With(requirePermission(claims.UsersWrite)).Delete("/{exemption_id}", a.TaxExemptionRevoke)
+		})
 	})
 }
 
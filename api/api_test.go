@@ -2,6 +2,7 @@ package api
 
 import (
 	"context"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -12,6 +13,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
 )
 
 func TestTraceWrapper(t *testing.T) {
@@ -57,3 +59,59 @@ func TestTraceWrapper(t *testing.T) {
 		}
 	}
 }
+
+func TestReadReplica(t *testing.T) {
+	test := NewRouteTest(t)
+
+	f, err := ioutil.TempFile("", "test-replica-db")
+	require.NoError(t, err)
+	dbFiles = append(dbFiles, f.Name())
+	replicaConfig, _ := testConfig()
+	replicaConfig.DB.Driver = "sqlite3"
+	replicaConfig.DB.ReadURL = f.Name()
+	replica, err := models.ConnectRead(replicaConfig, logrus.StandardLogger())
+	require.NoError(t, err)
+	require.NoError(t, models.AutoMigrate(replica))
+
+	ctx, err := WithInstanceConfig(context.Background(), test.GlobalConfig.SMTP, test.Config, "")
+	require.NoError(t, err)
+	api := NewAPIWithReadDB(ctx, test.GlobalConfig, logrus.StandardLogger(), test.DB, replica, "")
+
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, baseURL+test.Data.urlWithUserID, nil)
+	require.NoError(t, signHTTPRequest(req, test.Data.testUserToken, test.Config.JWT.Secret))
+	api.handler.ServeHTTP(recorder, req)
+
+	// the replica is empty so the list must not include the primary's orders
+	orders := []models.Order{}
+	extractPayload(t, http.StatusOK, recorder, &orders)
+	assert.Len(t, orders, 0)
+}
+
+func TestIndex(t *testing.T) {
+	test := NewRouteTest(t)
+	test.Config.Payment.Stripe.Enabled = true
+	test.Config.Coupons.URL = "https://example.com/coupons.json"
+	test.Config.Settlement.Currency = "usd"
+	test.Config.Settlement.Rates = map[string]float64{"JPY": 0.0067, "EUR": 1.1}
+
+	recorder := test.TestEndpoint(http.MethodGet, "/", nil, nil)
+
+	capabilities := apiCapabilities{}
+	extractPayload(t, http.StatusOK, recorder, &capabilities)
+	assert.Equal(t, "GoCommerce", capabilities.Name)
+	assert.True(t, capabilities.PaymentProcessors.Stripe)
+	assert.False(t, capabilities.PaymentProcessors.PayPal)
+	assert.Equal(t, []string{"USD", "EUR", "JPY"}, capabilities.Currencies)
+	assert.Empty(t, capabilities.ProcessorCurrencies)
+	assert.True(t, capabilities.Features.Coupons)
+	assert.False(t, capabilities.Features.CouponStacking)
+	assert.False(t, capabilities.Features.OrderExpiry)
+
+	test.Config.Payment.Stripe.Currencies = []string{"usd", "eur"}
+	test.Config.Payment.PayPal.Currencies = []string{"USD"}
+	recorder = test.TestEndpoint(http.MethodGet, "/", nil, nil)
+	capabilities = apiCapabilities{}
+	extractPayload(t, http.StatusOK, recorder, &capabilities)
+	assert.Equal(t, map[string][]string{"stripe": {"USD", "EUR"}}, capabilities.ProcessorCurrencies)
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"net/http"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// AuditLogList lists the changes made by admins, newest first. The list can
+// be filtered with "?actor_id=", "?target_id=" and "?action=". It is only
+// available to admins.
+func (a *API) AuditLogList(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+
+	query := a.ReadDB(r).Where("instance_id = ?", instanceID)
+	params := r.URL.Query()
+	for _, field := range []string{"actor_id", "target_id", "action"} {
+		if value := params.Get(field); value != "" {
+			query = query.Where(field+" = ?", value)
+		}
+	}
+
+	offset, limit, err := paginate(w, r, query.Model(&models.AuditLog{}))
+	if err != nil {
+		return badRequestError("Bad Pagination Parameters: %v", err)
+	}
+
+	entries := []models.AuditLog{}
+	if rsp := query.Order("created_at desc, id desc").Offset(offset).Limit(limit).Find(&entries); rsp.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, entries)
+}
+
+// audit records an admin action in the audit log. The entry is written on its
+// own once the action is done, never as part of the transaction of the action.
+// Failures are logged since the action can't be undone anymore.
+func (a *API) audit(r *http.Request, action, targetID string, before, after interface{}) {
+	ctx := r.Context()
+	log := getLogEntry(r).WithField("audit_action", action)
+
+	actorID, actorEmail := "", ""
+	if claims := gcontext.GetClaims(ctx); claims != nil {
+		actorID = claims.Subject
+		actorEmail = claims.Email
+	}
+
+	entry, err := models.NewAuditLog(gcontext.GetInstanceID(ctx), actorID, actorEmail, r.RemoteAddr, action, targetID, before, after)
+	if err != nil {
+		log.WithError(err).Error("Failed to create audit log entry")
+		return
+	}
+	if rsp := a.DB(r).Create(entry); rsp.Error != nil {
+		log.WithError(rsp.Error).Error("Failed to save audit log entry")
+	}
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestAuditLog(t *testing.T) {
+	t.Run("OrderUpdate", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+		body := strings.NewReader(`{"email": "mrfreeze@dc.com"}`)
+		recorder := test.TestEndpoint(http.MethodPut, "/orders/first-order", body, token)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/audit?actor_id=admin-yo", nil, token)
+		entries := []models.AuditLog{}
+		extractPayload(t, http.StatusOK, recorder, &entries)
+		require.Len(t, entries, 1)
+		entry := entries[0]
+		assert.Equal(t, models.AuditOrderUpdate, entry.Action)
+		assert.Equal(t, "first-order", entry.TargetID)
+		assert.Equal(t, "admin@wayneindustries.com", entry.ActorEmail)
+		assert.Equal(t, test.Data.firstOrder.Email, entry.Before["email"])
+		assert.Equal(t, "mrfreeze@dc.com", entry.After["email"])
+		assert.NotContains(t, entry.After, "currency")
+	})
+
+	t.Run("UserDelete", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+		recorder := test.TestEndpoint(http.MethodDelete, "/users/"+test.Data.testUser.ID+"?force=true", nil, token)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/audit?target_id="+test.Data.testUser.ID, nil, token)
+		entries := []models.AuditLog{}
+		extractPayload(t, http.StatusOK, recorder, &entries)
+		require.Len(t, entries, 1)
+		assert.Equal(t, models.AuditUserDelete, entries[0].Action)
+		assert.Equal(t, test.Data.testUser.Email, entries[0].Before["email"])
+		assert.Nil(t, entries[0].After)
+	})
+
+	t.Run("Filter", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+		body := strings.NewReader(`{"email": "mrfreeze@dc.com"}`)
+		recorder := test.TestEndpoint(http.MethodPut, "/orders/first-order", body, token)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/audit?actor_id=someone-else", nil, token)
+		entries := []models.AuditLog{}
+		extractPayload(t, http.StatusOK, recorder, &entries)
+		assert.Empty(t, entries)
+	})
+
+	t.Run("NonAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/audit", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
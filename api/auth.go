@@ -2,10 +2,17 @@ package api
 
 import (
 	"context"
+	"crypto/subtle"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/jinzhu/gorm"
 	"github.com/netlify/gocommerce/claims"
+	"github.com/netlify/gocommerce/conf"
 	gcontext "github.com/netlify/gocommerce/context"
 	"github.com/netlify/gocommerce/models"
 	"github.com/sirupsen/logrus"
@@ -44,39 +51,91 @@ func (a *API) withToken(w http.ResponseWriter, r *http.Request) (context.Context
 	}
 
 	claims := claims.JWTClaims{}
-	p := jwt.Parser{ValidMethods: []string{jwt.SigningMethodHS256.Name}}
-	token, err := p.ParseWithClaims(bearerToken, &claims, func(token *jwt.Token) (interface{}, error) {
-		return []byte(config.JWT.Secret), nil
-	})
+	methods, keyFunc := jwtKeyFunc(&config.JWT, a.httpClient)
+	p := jwt.Parser{ValidMethods: methods}
+	token, err := p.ParseWithClaims(bearerToken, &graceClaims{&claims, config.JWT.GracePeriod}, keyFunc)
 	if err != nil {
 		return nil, unauthorizedError("Invalid token").WithInternalError(err)
 	}
+	token.Claims = &claims
+	if config.JWT.Issuer != "" && !claims.VerifyIssuer(config.JWT.Issuer, true) {
+		return nil, unauthorizedError("Invalid token").WithInternalMessage("Unexpected issuer: %s", claims.Issuer)
+	}
+	if config.JWT.Audience != "" && !claims.VerifyAudience(config.JWT.Audience, true) {
+		return nil, unauthorizedError("Invalid token").WithInternalMessage("Unexpected audience: %s", claims.Audience)
+	}
 
 	isAdmin := false
+	roleNames := []string{}
 	roles, ok := claims.AppMetaData["roles"]
 	if ok {
 		roleStrings, _ := roles.([]interface{})
 		for _, data := range roleStrings {
 			role, _ := data.(string)
-			if role == config.JWT.AdminGroupName {
+			if config.JWT.IsAdminGroup(role) {
 				isAdmin = true
-				break
 			}
+			roleNames = append(roleNames, role)
 		}
 	}
+	permissions := rolePermissions(&config.JWT, roleNames)
+
+	if claims.Impersonated() {
+		logEntrySetField(r, "impersonator_id", claims.ImpersonatorID)
+	}
 
 	log.WithFields(logrus.Fields{
 		"claims_sub":   claims.Subject,
 		"claims_email": claims.Email,
 		"roles":        roles,
 		"is_admin":     isAdmin,
+		"permissions":  permissions,
 	}).Debug("successfully parsed claims")
 
 	ctx = gcontext.WithAdminFlag(ctx, isAdmin)
+	ctx = gcontext.WithPermissions(ctx, permissions)
 	ctx = gcontext.WithToken(ctx, token)
 	return ctx, nil
 }
 
+// rolePermissions collects the permissions the roles of a token grant. Staff
+// groups grant the StaffPermissions, other roles what's configured for them.
+func rolePermissions(config *conf.JWTConfiguration, roles []string) []string {
+	permissions := []string{}
+	for _, role := range roles {
+		if config.IsStaffGroup(role) {
+			permissions = append(permissions, claims.StaffPermissions...)
+		}
+		for _, p := range config.Permissions[role] {
+			if claims.IsPermission(p) {
+				permissions = append(permissions, p)
+			}
+		}
+	}
+	return permissions
+}
+
+// graceClaims validates the exp, nbf and iat claims tolerating a clock skew
+// of grace seconds between the token issuer and us.
+type graceClaims struct {
+	*claims.JWTClaims
+	grace int64
+}
+
+func (c *graceClaims) Valid() error {
+	now := time.Now().Unix()
+	if !c.VerifyExpiresAt(now-c.grace, false) {
+		return fmt.Errorf("Token expired at %d", c.ExpiresAt)
+	}
+	if !c.VerifyNotBefore(now+c.grace, false) {
+		return fmt.Errorf("Token not valid before %d", c.NotBefore)
+	}
+	if !c.VerifyIssuedAt(now+c.grace, false) {
+		return fmt.Errorf("Token issued in the future at %d", c.IssuedAt)
+	}
+	return nil
+}
+
 func authRequired(w http.ResponseWriter, r *http.Request) (context.Context, error) {
 	ctx := r.Context()
 	claims := gcontext.GetClaims(ctx)
@@ -87,45 +146,171 @@ func authRequired(w http.ResponseWriter, r *http.Request) (context.Context, erro
 	return ctx, nil
 }
 
-func adminRequired(w http.ResponseWriter, r *http.Request) (context.Context, error) {
+// rejectImpersonation refuses requests made with impersonation tokens, so
+// support agents can't pay, manage payment methods or addresses, or export
+// the data of the users they act as.
+func rejectImpersonation(w http.ResponseWriter, r *http.Request) (context.Context, error) {
 	ctx := r.Context()
-	claims := gcontext.GetClaims(ctx)
-	isAdmin := gcontext.IsAdmin(ctx)
-
-	if claims == nil || !isAdmin {
-		return nil, unauthorizedError("Admin permissions required")
+	if c := gcontext.GetClaims(ctx); c != nil && c.Impersonated() {
+		return nil, unauthorizedError("This action isn't available while impersonating the user")
 	}
-
-	logEntrySetField(r, "admin_id", claims.Subject)
 	return ctx, nil
 }
 
-func ensureUserAccess(w http.ResponseWriter, r *http.Request) (context.Context, error) {
-	ctx := r.Context()
+// requirePermission only lets tokens with the permission through. Admins
+// have all permissions.
+func requirePermission(permission string) middlewareHandler {
+	return func(w http.ResponseWriter, r *http.Request) (context.Context, error) {
+		ctx := r.Context()
+		c := gcontext.GetClaims(ctx)
 
-	// ensure userID matches authenticated user OR is admin
-	claims := gcontext.GetClaims(ctx)
-	if gcontext.IsAdmin(ctx) {
-		logEntrySetField(r, "admin_id", claims.Subject)
+		if c == nil || !gcontext.HasPermission(ctx, permission) {
+			return nil, unauthorizedError("Permission %s required", permission)
+		}
+
+		logActor(r, c)
 		return ctx, nil
 	}
+}
 
+// ensureUserAccess lets users access themselves. Accessing other users takes
+// the users:read permission, or users:write to change them, and the orders
+// of all users take orders:read.
+func ensureUserAccess(w http.ResponseWriter, r *http.Request) (context.Context, error) {
+	ctx := r.Context()
+	c := gcontext.GetClaims(ctx)
 	userID := gcontext.GetUserID(ctx)
-	if claims.Subject != userID {
-		return nil, unauthorizedError("Can't access a different user unless you're an admin")
+	if c.Subject == userID {
+		return ctx, nil
 	}
 
+	permission := claims.UsersWrite
+	if userID == "all" {
+		permission = claims.OrdersRead
+	} else if r.Method == http.MethodGet {
+		permission = claims.UsersRead
+	}
+	if !gcontext.HasPermission(ctx, permission) {
+		return nil, unauthorizedError("Can't access a different user unless you're an admin")
+	}
+	logActor(r, c)
 	return ctx, nil
 }
 
-func hasOrderAccess(ctx context.Context, order *models.Order) bool {
-	if order.UserID == "" {
-		return true
+// logActor records the admin or staff member making the request.
+func logActor(r *http.Request, c *claims.JWTClaims) {
+	if gcontext.IsAdmin(r.Context()) {
+		logEntrySetField(r, "admin_id", c.Subject)
+	} else {
+		logEntrySetField(r, "staff_id", c.Subject)
 	}
+}
+
+// hasOrderAccess reports whether the token is the owner of the order or an
+// admin. Anonymous orders are checked with canAccessOrder.
+func hasOrderAccess(ctx context.Context, order *models.Order) bool {
 	if gcontext.IsAdmin(ctx) {
 		return true
 	}
 
 	claims := gcontext.GetClaims(ctx)
-	return claims != nil && order.UserID == claims.Subject
+	return claims != nil && order.UserID != "" && order.UserID == claims.Subject
+}
+
+// canReadOrders reports whether the token grants access to all orders.
+func canReadOrders(ctx context.Context) bool {
+	return gcontext.HasPermission(ctx, claims.OrdersRead)
+}
+
+// canWriteOrders reports whether the token grants changing any order.
+func canWriteOrders(ctx context.Context) bool {
+	return gcontext.HasPermission(ctx, claims.OrdersWrite)
+}
+
+// canReadPayments reports whether the token grants access to all payments.
+func canReadPayments(ctx context.Context) bool {
+	return gcontext.HasPermission(ctx, claims.PaymentsRead)
+}
+
+// hasOrderToken checks the token of a magic link mailed to a guest, which
+// grants access to a single order without logging in until it's used to
+// claim the order.
+func hasOrderToken(r *http.Request, db *gorm.DB, order *models.Order) bool {
+	_, ok := orderToken(r, db, order)
+	return ok
+}
+
+// orderToken checks the token of a magic link like hasOrderToken and returns
+// its ID.
+func orderToken(r *http.Request, db *gorm.DB, order *models.Order) (string, bool) {
+	config := gcontext.GetConfig(r.Context())
+	if !config.Mailer.MagicLink.Enabled {
+		return "", false
+	}
+	id, ok := claims.ParseOrderToken(r.URL.Query().Get("token"), order.ID, config.JWT.Secret)
+	if !ok || id == "" {
+		return id, ok
+	}
+	used, err := models.OrderTokenUsed(db, id)
+	if err != nil {
+		getLogEntry(r).WithError(err).Error("Error while querying for used order tokens")
+		return "", false
+	}
+	return id, !used
+}
+
+// canAccessOrder checks that the request has access to the order, as its
+// owner, an admin, with the token of a magic link or, for anonymous orders,
+// with an "?email=" that matches the order. Anonymous orders without a
+// matching email aren't found, so their IDs can't be probed.
+func (a *API) canAccessOrder(w http.ResponseWriter, r *http.Request, db *gorm.DB, order *models.Order) *HTTPError {
+	if hasOrderAccess(r.Context(), order) || hasOrderToken(r, db, order) {
+		return nil
+	}
+	if order.UserID != "" {
+		return unauthorizedError("You don't have access to this order")
+	}
+	matches, httpErr := a.hasOrderEmail(w, r, order)
+	if httpErr != nil {
+		return httpErr
+	}
+	if !matches {
+		return notFoundError("Order not found")
+	}
+	return nil
+}
+
+// maxFailedEmailLookups is how many lookups of orders with a wrong email an
+// IP can make within emailLookupInterval before its lookups are refused.
+const maxFailedEmailLookups = 5
+const emailLookupInterval = 15 * time.Minute
+
+// hasOrderEmail checks the email a guest looks up an anonymous order with,
+// given as "?email=". Emails are compared in constant time and failed
+// lookups are counted per IP, which is refused further lookups once it
+// failed too often, so emails can't be guessed.
+func (a *API) hasOrderEmail(w http.ResponseWriter, r *http.Request, order *models.Order) (bool, *HTTPError) {
+	email := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("email")))
+	if email == "" {
+		return false, nil
+	}
+
+	db := a.DB(r)
+	ip := clientIP(r)
+	var failed int64
+	since := time.Now().Add(-emailLookupInterval)
+	if err := db.Model(&models.Event{}).Where("ip = ? AND type = ? AND created_at > ?", ip, models.EventEmailLookupFailed, since).Count(&failed).Error; err != nil {
+		return false, internalServerError("Error during database query").WithInternalError(err)
+	}
+	if failed >= maxFailedEmailLookups {
+		w.Header().Set("Retry-After", strconv.Itoa(int(emailLookupInterval.Seconds())))
+		return false, tooManyRequestsError("Too many failed order lookups, please try again later")
+	}
+
+	orderEmail := strings.ToLower(order.Email)
+	if order.UserID == "" && subtle.ConstantTimeCompare([]byte(email), []byte(orderEmail)) == 1 {
+		return true, nil
+	}
+	models.LogEvent(db, ip, "", order.ID, models.EventEmailLookupFailed, nil)
+	return false, nil
 }
@@ -0,0 +1,325 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/netlify/gocommerce/claims"
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func issuedToken(issuer, audience string) *jwt.Token {
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, &claims.JWTClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:  "i-am-batman",
+			Issuer:   issuer,
+			Audience: audience,
+		},
+		Email: "bruce@wayneindustries.com",
+	})
+}
+
+func TestTokenIssuerAndAudience(t *testing.T) {
+	tests := map[string]struct {
+		Issuer   string
+		Audience string
+		Status   int
+	}{
+		"Valid":           {"https://identity.example.com", "gocommerce", http.StatusOK},
+		"WrongIssuer":     {"https://evil.example.com", "gocommerce", http.StatusUnauthorized},
+		"WrongAudience":   {"https://identity.example.com", "other-service", http.StatusUnauthorized},
+		"MissingIssuer":   {"", "gocommerce", http.StatusUnauthorized},
+		"MissingAudience": {"https://identity.example.com", "", http.StatusUnauthorized},
+		"MissingBoth":     {"", "", http.StatusUnauthorized},
+	}
+
+	for name, params := range tests {
+		t.Run(name, func(t *testing.T) {
+			test := NewRouteTest(t)
+			test.Config.JWT.Issuer = "https://identity.example.com"
+			test.Config.JWT.Audience = "gocommerce"
+
+			recorder := test.TestEndpoint(http.MethodGet, "/orders/first-order", nil, issuedToken(params.Issuer, params.Audience))
+			if params.Status == http.StatusOK {
+				extractPayload(t, http.StatusOK, recorder, &models.Order{})
+			} else {
+				validateError(t, params.Status, recorder, "Invalid token")
+			}
+		})
+	}
+
+	t.Run("NotConfigured", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/first-order", nil, issuedToken("https://anyone.example.com", ""))
+		extractPayload(t, http.StatusOK, recorder, &models.Order{})
+	})
+}
+
+func rsaTokenString(t *testing.T, key *rsa.PrivateKey, kid string) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, &claims.JWTClaims{
+		StandardClaims: jwt.StandardClaims{Subject: "i-am-batman"},
+		Email:          "bruce@wayneindustries.com",
+	})
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	require.NoError(t, err)
+	return "Bearer " + signed
+}
+
+func startJWKSServer(keys map[string]*rsa.PrivateKey, fetches *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*fetches++
+		set := map[string][]map[string]string{"keys": {}}
+		for kid, key := range keys {
+			set["keys"] = append(set["keys"], map[string]string{
+				"kid": kid,
+				"kty": "RSA",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(set)
+	}))
+}
+
+func TestRS256Tokens(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	t.Run("PublicKey", func(t *testing.T) {
+		test := NewRouteTest(t)
+		der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		require.NoError(t, err)
+		test.Config.JWT.Method = "RS256"
+		test.Config.JWT.PublicKey = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+		headers := map[string]string{"Authorization": rsaTokenString(t, key, "")}
+		recorder := test.TestEndpointWithHeaders(http.MethodGet, "/orders/first-order", nil, nil, headers)
+		extractPayload(t, http.StatusOK, recorder, &models.Order{})
+
+		otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		headers = map[string]string{"Authorization": rsaTokenString(t, otherKey, "")}
+		recorder = test.TestEndpointWithHeaders(http.MethodGet, "/orders/first-order", nil, nil, headers)
+		validateError(t, http.StatusUnauthorized, recorder, "Invalid token")
+	})
+
+	t.Run("RejectsHS256", func(t *testing.T) {
+		test := NewRouteTest(t)
+		der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		require.NoError(t, err)
+		test.Config.JWT.Method = "RS256"
+		test.Config.JWT.PublicKey = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/first-order", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder, "Invalid token")
+	})
+
+	t.Run("JWKSRotation", func(t *testing.T) {
+		test := NewRouteTest(t)
+		fetches := 0
+		keys := map[string]*rsa.PrivateKey{"first": key}
+		server := startJWKSServer(keys, &fetches)
+		defer server.Close()
+		test.Config.JWT.Method = "RS256"
+		test.Config.JWT.JWKSURL = server.URL
+
+		for i := 0; i < 2; i++ {
+			headers := map[string]string{"Authorization": rsaTokenString(t, key, "first")}
+			recorder := test.TestEndpointWithHeaders(http.MethodGet, "/orders/first-order", nil, nil, headers)
+			extractPayload(t, http.StatusOK, recorder, &models.Order{})
+		}
+		assert.Equal(t, 1, fetches)
+
+		rotated, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		keys["second"] = rotated
+		getJWKSCache(server.URL).fetchedAt = time.Now().Add(-jwksMinRefresh)
+
+		headers := map[string]string{"Authorization": rsaTokenString(t, rotated, "second")}
+		recorder := test.TestEndpointWithHeaders(http.MethodGet, "/orders/first-order", nil, nil, headers)
+		extractPayload(t, http.StatusOK, recorder, &models.Order{})
+		assert.Equal(t, 2, fetches)
+
+		headers = map[string]string{"Authorization": rsaTokenString(t, rotated, "unknown")}
+		recorder = test.TestEndpointWithHeaders(http.MethodGet, "/orders/first-order", nil, nil, headers)
+		validateError(t, http.StatusUnauthorized, recorder, "Invalid token")
+		assert.Equal(t, 2, fetches)
+	})
+
+	t.Run("JWKSSlowEndpoint", func(t *testing.T) {
+		test := NewRouteTest(t)
+		fetches := 0
+		keys := map[string]*rsa.PrivateKey{"first": key}
+		jwks := startJWKSServer(keys, &fetches)
+		defer jwks.Close()
+		release := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if fetches > 0 {
+				<-release
+			}
+			jwks.Config.Handler.ServeHTTP(w, r)
+		}))
+		defer server.Close()
+		defer close(release)
+		test.Config.JWT.Method = "RS256"
+		test.Config.JWT.JWKSURL = server.URL
+
+		headers := map[string]string{"Authorization": rsaTokenString(t, key, "first")}
+		recorder := test.TestEndpointWithHeaders(http.MethodGet, "/orders/first-order", nil, nil, headers)
+		extractPayload(t, http.StatusOK, recorder, &models.Order{})
+
+		// the expired key is used while the keys are fetched again
+		getJWKSCache(server.URL).fetchedAt = time.Now().Add(-jwksMaxAge)
+		for i := 0; i < 2; i++ {
+			recorder = test.TestEndpointWithHeaders(http.MethodGet, "/orders/first-order", nil, nil, headers)
+			extractPayload(t, http.StatusOK, recorder, &models.Order{})
+		}
+	})
+}
+
+func TestTokenGracePeriod(t *testing.T) {
+	now := time.Now().Unix()
+	tests := map[string]struct {
+		ExpiresAt int64
+		NotBefore int64
+		Grace     int64
+		Status    int
+	}{
+		"ExpiredWithinGrace":   {now - 10, 0, 30, http.StatusOK},
+		"ExpiredOutsideGrace":  {now - 60, 0, 30, http.StatusUnauthorized},
+		"ExpiredWithoutGrace":  {now - 10, 0, 0, http.StatusUnauthorized},
+		"NotBeforeWithinGrace": {0, now + 10, 30, http.StatusOK},
+		"NotBeforeInFuture":    {0, now + 60, 30, http.StatusUnauthorized},
+	}
+
+	for name, params := range tests {
+		t.Run(name, func(t *testing.T) {
+			test := NewRouteTest(t)
+			test.Config.JWT.GracePeriod = params.Grace
+			token := jwt.NewWithClaims(jwt.SigningMethodHS256, &claims.JWTClaims{
+				StandardClaims: jwt.StandardClaims{
+					Subject:   "i-am-batman",
+					ExpiresAt: params.ExpiresAt,
+					NotBefore: params.NotBefore,
+				},
+				Email: "bruce@wayneindustries.com",
+			})
+
+			recorder := test.TestEndpoint(http.MethodGet, "/orders/first-order", nil, token)
+			if params.Status == http.StatusOK {
+				order := &models.Order{}
+				extractPayload(t, http.StatusOK, recorder, order)
+				assert.Equal(t, "i-am-batman", order.UserID)
+			} else {
+				validateError(t, params.Status, recorder, "Invalid token")
+			}
+		})
+	}
+}
+
+func roleToken(id string, roles ...interface{}) *jwt.Token {
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, &claims.JWTClaims{
+		StandardClaims: jwt.StandardClaims{Subject: id},
+		Email:          id + "@wayneindustries.com",
+		AppMetaData:    map[string]interface{}{"roles": roles},
+	})
+}
+
+func TestAdminAndStaffGroups(t *testing.T) {
+	tests := map[string]struct {
+		Roles      []interface{}
+		ReadStatus int
+		EditStatus int
+	}{
+		"AdminGroupName": {[]interface{}{"admin"}, http.StatusOK, http.StatusOK},
+		"AdminGroups":    {[]interface{}{"ops"}, http.StatusOK, http.StatusOK},
+		"StaffGroups":    {[]interface{}{"support", "other"}, http.StatusOK, http.StatusUnauthorized},
+		"NoGroup":        {[]interface{}{"other"}, http.StatusUnauthorized, http.StatusUnauthorized},
+	}
+
+	for name, params := range tests {
+		t.Run(name, func(t *testing.T) {
+			test := NewRouteTest(t)
+			test.Config.JWT.AdminGroups = []string{"finance", "ops"}
+			test.Config.JWT.StaffGroups = []string{"support"}
+			token := roleToken("alfred", params.Roles...)
+
+			recorder := test.TestEndpoint(http.MethodGet, "/users", nil, token)
+			assert.Equal(t, params.ReadStatus, recorder.Code, recorder.Body.String())
+			recorder = test.TestEndpoint(http.MethodGet, "/users/"+test.Data.testUser.ID, nil, token)
+			assert.Equal(t, params.ReadStatus, recorder.Code, recorder.Body.String())
+			recorder = test.TestEndpoint(http.MethodGet, test.Data.urlForFirstOrder, nil, token)
+			assert.Equal(t, params.ReadStatus, recorder.Code, recorder.Body.String())
+
+			url := "/users/" + test.Data.testUser.ID
+			recorder = test.TestEndpoint(http.MethodPost, url, strings.NewReader(`{"name": "Bruce"}`), token)
+			assert.Equal(t, params.EditStatus, recorder.Code, recorder.Body.String())
+			recorder = test.TestEndpoint(http.MethodGet, "/audit", nil, token)
+			assert.Equal(t, params.EditStatus, recorder.Code, recorder.Body.String())
+		})
+	}
+}
+
+func TestRolePermissions(t *testing.T) {
+	support := func(test *RouteTest) *jwt.Token {
+		test.Config.JWT.Permissions = conf.RolePermissions{
+			"support": {claims.OrdersRead, claims.RefundsWrite, "nonsense:write"},
+		}
+		return roleToken("alfred", "support")
+	}
+
+	t.Run("Granted", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := support(test)
+
+		recorder := test.TestEndpoint(http.MethodGet, test.Data.urlForFirstOrder, nil, token)
+		extractPayload(t, http.StatusOK, recorder, &models.Order{})
+
+		// the refund gets past the permission check to the validation
+		url := "/payments/" + test.Data.firstTransaction.ID + "/refund"
+		body := strings.NewReader(`{"amount": 1, "currency": "EUR"}`)
+		recorder = test.TestEndpoint(http.MethodPost, url, body, token)
+		validateError(t, http.StatusBadRequest, recorder, "Currencies do not match")
+	})
+
+	t.Run("Denied", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := support(test)
+
+		recorder := test.TestEndpoint(http.MethodDelete, "/users/"+test.Data.testUser.ID, nil, token)
+		validateError(t, http.StatusUnauthorized, recorder)
+		recorder = test.TestEndpoint(http.MethodPut, test.Data.urlForFirstOrder, strings.NewReader(`{}`), token)
+		validateError(t, http.StatusUnauthorized, recorder, claims.OrdersWrite)
+		recorder = test.TestEndpoint(http.MethodGet, "/users/"+test.Data.testUser.ID, nil, token)
+		validateError(t, http.StatusUnauthorized, recorder)
+
+		// the user wasn't deleted
+		user := &models.User{}
+		require.NoError(t, test.DB.First(user, "id = ?", test.Data.testUser.ID).Error)
+	})
+
+	t.Run("AdminHasAll", func(t *testing.T) {
+		test := NewRouteTest(t)
+		support(test)
+
+		recorder := test.TestEndpoint(http.MethodPut, test.Data.urlForFirstOrder, strings.NewReader(`{}`), testAdminToken("admin-yo", "admin@wayneindustries.com"))
+		extractPayload(t, http.StatusOK, recorder, &models.Order{})
+	})
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// withTrustedProxies sets the remote address of requests forwarded by the
+// trusted proxies to the address of the client. That's the last address in
+// the X-Forwarded-For header that isn't a trusted proxy, since proxies append
+// the address they got the request from, so clients can't spoof it.
+func withTrustedProxies(proxies []*net.IPNet) func(http.Handler) http.Handler {
+	trusted := func(addr string) bool {
+		ip := net.ParseIP(strings.TrimSpace(addr))
+		if ip == nil {
+			return false
+		}
+		for _, proxy := range proxies {
+			if proxy.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host, port, err := net.SplitHostPort(r.RemoteAddr)
+			forwarded := r.Header.Get("X-Forwarded-For")
+			if err == nil && forwarded != "" && trusted(host) {
+				addrs := strings.Split(forwarded, ",")
+				for i := len(addrs) - 1; i >= 0; i-- {
+					addr := strings.TrimSpace(addrs[i])
+					if net.ParseIP(addr) == nil {
+						break
+					}
+					host = addr
+					if !trusted(addr) {
+						break
+					}
+				}
+				r.RemoteAddr = net.JoinHostPort(host, port)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// clientIP returns the IP address of the client making the request.
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/netlify/gocommerce/conf"
+	gcontext "github.com/netlify/gocommerce/context"
+)
+
+// corsOriginFunc returns a function that only allows cross-origin requests
+// from the origins configured for the instance the API serves. Without an
+// instance config, e.g. in multi-instance mode, no origin is allowed.
+func corsOriginFunc(ctx context.Context) func(r *http.Request, origin string) bool {
+	return func(r *http.Request, origin string) bool {
+		config := gcontext.GetConfig(ctx)
+		if config == nil {
+			return false
+		}
+		return isAllowedOrigin(config, origin)
+	}
+}
+
+// isAllowedOrigin checks an origin against the CORS allowlist of the
+// configuration, which defaults to the origin of the site URL.
+func isAllowedOrigin(config *conf.Configuration, origin string) bool {
+	allowed := config.CORS.AllowedOrigins
+	if len(allowed) == 0 {
+		allowed = []string{config.SiteURL}
+	}
+
+	origin = normalizeOrigin(origin)
+	for _, o := range allowed {
+		if o == "*" || (origin != "" && normalizeOrigin(o) == origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeOrigin(origin string) string {
+	u, err := url.Parse(strings.TrimSpace(origin))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return ""
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host)
+}
@@ -0,0 +1,48 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCORS(t *testing.T) {
+	t.Run("DefaultsToSiteURL", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = "https://example.com/"
+		recorder := test.TestEndpointWithHeaders(http.MethodGet, "/", nil, nil, map[string]string{"Origin": "https://example.com"})
+		assert.Equal(t, "https://example.com", recorder.Header().Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "true", recorder.Header().Get("Access-Control-Allow-Credentials"))
+	})
+
+	t.Run("AllowedOrigin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.CORS.AllowedOrigins = []string{"https://shop.example.com"}
+		recorder := test.TestEndpointWithHeaders(http.MethodGet, "/", nil, nil, map[string]string{"Origin": "https://Shop.example.com"})
+		assert.Equal(t, "https://Shop.example.com", recorder.Header().Get("Access-Control-Allow-Origin"))
+	})
+
+	t.Run("DisallowedOrigin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.CORS.AllowedOrigins = []string{"https://shop.example.com"}
+		recorder := test.TestEndpointWithHeaders(http.MethodGet, "/", nil, nil, map[string]string{"Origin": "https://evil.example.com"})
+		assert.Empty(t, recorder.Header().Get("Access-Control-Allow-Origin"))
+		assert.Empty(t, recorder.Header().Get("Access-Control-Allow-Credentials"))
+	})
+
+	t.Run("Preflight", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.CORS.AllowedOrigins = []string{"https://shop.example.com"}
+		headers := map[string]string{
+			"Origin":                        "https://shop.example.com",
+			"Access-Control-Request-Method": http.MethodPost,
+		}
+		recorder := test.TestEndpointWithHeaders(http.MethodOptions, "/orders", nil, nil, headers)
+		assert.Equal(t, "https://shop.example.com", recorder.Header().Get("Access-Control-Allow-Origin"))
+
+		headers["Origin"] = "https://evil.example.com"
+		recorder = test.TestEndpointWithHeaders(http.MethodOptions, "/orders", nil, nil, headers)
+		assert.Empty(t, recorder.Header().Get("Access-Control-Allow-Origin"))
+	})
+}
@@ -30,6 +30,48 @@ func (a *API) lookupCoupon(ctx context.Context, w http.ResponseWriter, code stri
 	return coupon, nil
 }
 
+// applyCoupons looks up coupon codes and applies them to the order on top of
+// the coupons already applied. Without coupon stacking each code replaces the
+// coupon applied before it.
+func (a *API) applyCoupons(ctx context.Context, w http.ResponseWriter, order *models.Order, codes []string) error {
+	config := gcontext.GetConfig(ctx)
+	coupons := order.Coupons
+
+	for _, code := range codes {
+		coupon, err := a.lookupCoupon(ctx, w, code)
+		if err != nil {
+			return err
+		}
+		if !coupon.Valid() {
+			return badRequestError("This coupon is not valid at this time").WithErrorCode("coupon_invalid")
+		}
+
+		if !config.Coupons.Stacking {
+			coupons = []*models.Coupon{coupon}
+			continue
+		}
+
+		for _, applied := range coupons {
+			if applied.Code == coupon.Code {
+				return badRequestError("The coupon %v has already been applied", coupon.Code).WithErrorCode("coupon_already_applied")
+			}
+			if applied.Exclusive {
+				return badRequestError("The coupon %v can't be combined with other coupons", applied.Code).WithErrorCode("coupon_not_stackable")
+			}
+			if coupon.Exclusive {
+				return badRequestError("The coupon %v can't be combined with other coupons", coupon.Code).WithErrorCode("coupon_not_stackable")
+			}
+			if applied.FreeShipping() && coupon.FreeShipping() {
+				return badRequestError("Only one free shipping coupon can be applied").WithErrorCode("coupon_conflict")
+			}
+		}
+		coupons = append(coupons, coupon)
+	}
+
+	order.SetCoupons(coupons)
+	return nil
+}
+
 // CouponView returns information about a single coupon code.
 func (a *API) CouponView(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
@@ -7,18 +7,37 @@ import (
 	"github.com/jinzhu/gorm"
 	gcontext "github.com/netlify/gocommerce/context"
 	"github.com/netlify/gocommerce/models"
+	"github.com/sirupsen/logrus"
 )
 
 func (a *API) loggingDB(w http.ResponseWriter, r *http.Request) (context.Context, error) {
 	if a.db == nil {
 		return r.Context(), nil
 	}
+	return a.withRequestDB(r.Context(), getLogEntry(r)), nil
+}
 
-	log := getLogEntry(r)
-	db := a.db.New()
+// withRequestDB adds the databases configured for request logging to ctx.
+// Their queries outside of transactions fail once the deadline of ctx passes.
+func (a *API) withRequestDB(ctx context.Context, log logrus.FieldLogger) context.Context {
+	db := a.requestDB(ctx, a.db)
 	db.SetLogger(models.NewDBLogger(log))
+	ctx = gcontext.WithDB(ctx, db)
+
+	if a.readDB != nil {
+		readDB := a.requestDB(ctx, a.readDB)
+		readDB.SetLogger(models.NewDBLogger(log.WithField("replica", true)))
+		ctx = gcontext.WithReadDB(ctx, readDB)
+	}
 
-	return gcontext.WithDB(r.Context(), db), nil
+	return ctx
+}
+
+func (a *API) requestDB(ctx context.Context, db *gorm.DB) *gorm.DB {
+	if _, ok := ctx.Deadline(); !ok {
+		return db.New()
+	}
+	return models.WithContext(ctx, db)
 }
 
 // DB provides callers with a database instance configured for request logging
@@ -26,3 +45,13 @@ func (a *API) DB(r *http.Request) *gorm.DB {
 	ctx := r.Context()
 	return gcontext.GetDB(ctx)
 }
+
+// ReadDB provides callers with the read replica configured for request logging.
+// It falls back to the primary database when no replica is configured.
+func (a *API) ReadDB(r *http.Request) *gorm.DB {
+	ctx := r.Context()
+	if db := gcontext.GetReadDB(ctx); db != nil {
+		return db
+	}
+	return gcontext.GetDB(ctx)
+}
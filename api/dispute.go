@@ -0,0 +1,67 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+	"github.com/pborman/uuid"
+)
+
+// PaymentDisputeList lists the disputes opened against a transaction. It is
+// only available to admins.
+func (a *API) PaymentDisputeList(w http.ResponseWriter, r *http.Request) error {
+	db := siteScope(r.Context(), a.ReadDB(r), "")
+	payID := chi.URLParam(r, "payment_id")
+	trans, httpErr := getTransaction(db, payID)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	disputes := []models.Dispute{}
+	if rsp := db.Where("transaction_id = ?", trans.ID).Order("created_at desc").Find(&disputes); rsp.Error != nil {
+		return internalServerError("Error while querying for disputes").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, disputes)
+}
+
+// disputeCreated records a dispute against a charge and marks its order as
+// disputed. Repeated deliveries of the same dispute update the existing record.
+func disputeCreated(r *http.Request, tx *gorm.DB, trans *models.Transaction, order *models.Order, event *payments.DisputeEvent) *HTTPError {
+	dispute := &models.Dispute{}
+	rsp := tx.Where("processor_id = ? AND transaction_id = ?", event.ID, trans.ID).First(dispute)
+	if rsp.Error != nil && !rsp.RecordNotFound() {
+		return internalServerError("Error while querying for disputes").WithInternalError(rsp.Error)
+	}
+	isNew := rsp.RecordNotFound()
+	if isNew {
+		dispute = &models.Dispute{
+			InstanceID:    order.InstanceID,
+			SiteID:        order.SiteID,
+			ID:            uuid.NewRandom().String(),
+			ProcessorID:   event.ID,
+			TransactionID: trans.ID,
+			OrderID:       order.ID,
+		}
+	}
+	dispute.Reason = event.Reason
+	dispute.Amount = event.Amount
+	dispute.Currency = event.Currency
+	dispute.Status = event.Status
+	dispute.DueBy = event.DueBy
+	if rsp := tx.Save(dispute); rsp.Error != nil {
+		return internalServerError("Failed to save dispute").WithInternalError(rsp.Error)
+	}
+	if !isNew {
+		return nil
+	}
+
+	order.PaymentState = models.DisputedState
+	if rsp := tx.Save(order); rsp.Error != nil {
+		return internalServerError("Failed to update order").WithInternalError(rsp.Error)
+	}
+	logTimeline(r, tx, order, models.DisputedTimelineEvent, "Payment of %d %s disputed: %s", dispute.Amount, dispute.Currency, dispute.Reason)
+	return nil
+}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestPaymentDisputeList(t *testing.T) {
+	t.Run("AsAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		dispute := &models.Dispute{
+			ID:            "first-dispute",
+			ProcessorID:   "dp_1",
+			TransactionID: test.Data.firstTransaction.ID,
+			OrderID:       test.Data.firstOrder.ID,
+			Reason:        "fraudulent",
+			Amount:        24,
+			Currency:      "USD",
+			Status:        "needs_response",
+		}
+		require.NoError(t, test.DB.Create(dispute).Error)
+
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodGet, "/payments/"+test.Data.firstTransaction.ID+"/disputes", nil, token)
+		disputes := []models.Dispute{}
+		extractPayload(t, http.StatusOK, recorder, &disputes)
+		require.Len(t, disputes, 1)
+		assert.Equal(t, "first-dispute", disputes[0].ID)
+		assert.Equal(t, "fraudulent", disputes[0].Reason)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/payments/"+test.Data.secondTransaction.ID+"/disputes", nil, token)
+		extractPayload(t, http.StatusOK, recorder, &disputes)
+		assert.Len(t, disputes, 0)
+	})
+
+	t.Run("NotAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/payments/"+test.Data.firstTransaction.ID+"/disputes", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+
+	t.Run("UnknownPayment", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodGet, "/payments/nope/disputes", nil, token)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+}
@@ -30,15 +30,15 @@ func (a *API) DownloadURL(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	order := &models.Order{}
-	if result := db.Where("id = ?", download.OrderID).First(order); result.Error != nil {
+	if result := siteScope(ctx, db, "").Where("id = ?", download.OrderID).First(order); result.Error != nil {
 		if result.RecordNotFound() {
 			return notFoundError("Download order not found")
 		}
 		return internalServerError("Error during database query").WithInternalError(result.Error)
 	}
 
-	if !hasOrderAccess(ctx, order) {
-		return unauthorizedError("Not Authorized to access this download")
+	if httpErr := a.canAccessOrder(w, r, db, order); httpErr != nil {
+		return httpErr
 	}
 
 	if order.PaymentState != models.PaidState {
@@ -88,7 +88,7 @@ func (a *API) DownloadList(w http.ResponseWriter, r *http.Request) error {
 
 	order := &models.Order{}
 	if orderID != "" {
-		if result := db.Where("id = ?", orderID).First(order); result.Error != nil {
+		if result := siteScope(ctx, db, "").Where("id = ?", orderID).First(order); result.Error != nil {
 			if result.RecordNotFound() {
 				return notFoundError("Download order not found")
 			}
@@ -99,8 +99,8 @@ func (a *API) DownloadList(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	if order != nil {
-		if !hasOrderAccess(ctx, order) {
-			return unauthorizedError("You don't have permission to access this order")
+		if httpErr := a.canAccessOrder(w, r, db, order); httpErr != nil {
+			return httpErr
 		}
 
 		if order.PaymentState != models.PaidState {
@@ -145,7 +145,7 @@ func (a *API) DownloadRefresh(w http.ResponseWriter, r *http.Request) error {
 		return badRequestError("Order id missing")
 	}
 
-	query := a.db.Where("id = ?", orderID).
+	query := siteScope(ctx, a.db, "").Where("id = ?", orderID).
 		Preload("LineItems").
 		Preload("Downloads")
 	if result := query.First(order); result.Error != nil {
@@ -155,8 +155,8 @@ func (a *API) DownloadRefresh(w http.ResponseWriter, r *http.Request) error {
 		return internalServerError("Error during database query").WithInternalError(result.Error)
 	}
 
-	if !hasOrderAccess(ctx, order) {
-		return unauthorizedError("You don't have permission to access this order")
+	if httpErr := a.canAccessOrder(w, r, a.db, order); httpErr != nil {
+		return httpErr
 	}
 
 	if order.PaymentState != models.PaidState {
@@ -22,10 +22,30 @@ func notFoundError(fmtString string, args ...interface{}) *HTTPError {
 	return httpError(http.StatusNotFound, fmtString, args...)
 }
 
+func paymentRequiredError(fmtString string, args ...interface{}) *HTTPError {
+	return httpError(http.StatusPaymentRequired, fmtString, args...)
+}
+
+func conflictError(fmtString string, args ...interface{}) *HTTPError {
+	return httpError(http.StatusConflict, fmtString, args...)
+}
+
 func unauthorizedError(fmtString string, args ...interface{}) *HTTPError {
 	return httpError(http.StatusUnauthorized, fmtString, args...)
 }
 
+func tooManyRequestsError(fmtString string, args ...interface{}) *HTTPError {
+	return httpError(http.StatusTooManyRequests, fmtString, args...)
+}
+
+func serviceUnavailableError(fmtString string, args ...interface{}) *HTTPError {
+	return httpError(http.StatusServiceUnavailable, fmtString, args...)
+}
+
+func gatewayTimeoutError(fmtString string, args ...interface{}) *HTTPError {
+	return httpError(http.StatusGatewayTimeout, fmtString, args...)
+}
+
 // HTTPError is an error with a message and an HTTP status code.
 type HTTPError struct {
 	Code            int    `json:"code"`
@@ -33,6 +53,7 @@ type HTTPError struct {
 	InternalError   error  `json:"-"`
 	InternalMessage string `json:"-"`
 	ErrorID         string `json:"error_id,omitempty"`
+	ErrorCode       string `json:"error_code,omitempty"`
 }
 
 func (e *HTTPError) Error() string {
@@ -56,6 +77,12 @@ func (e *HTTPError) WithInternalError(err error) *HTTPError {
 	return e
 }
 
+// WithErrorCode adds a machine readable code explaining the error
+func (e *HTTPError) WithErrorCode(code string) *HTTPError {
+	e.ErrorCode = code
+	return e
+}
+
 // WithInternalMessage adds internal message information to the error
 func (e *HTTPError) WithInternalMessage(fmtString string, args ...interface{}) *HTTPError {
 	e.InternalMessage = fmt.Sprintf(fmtString, args...)
@@ -98,6 +125,9 @@ func recoverer(w http.ResponseWriter, r *http.Request) (context.Context, error)
 func handleError(err error, w http.ResponseWriter, r *http.Request) {
 	log := getLogEntry(r)
 	errorID := gcontext.GetRequestID(r.Context())
+	if r.Context().Err() == context.DeadlineExceeded {
+		err = gatewayTimeoutError("The request timed out").WithInternalError(err)
+	}
 	switch e := err.(type) {
 	case *HTTPError:
 		if e.Code >= http.StatusInternalServerError {
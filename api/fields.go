@@ -0,0 +1,126 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/models"
+)
+
+// orderAssociations are the heavy associations of orders, with the preloads
+// loading them. Shaped responses only include them when they're expanded.
+var orderAssociations = map[string][]string{
+	"line_items":       {"LineItems"},
+	"downloads":        {"Downloads"},
+	"transactions":     {"Transactions"},
+	"shipments":        {"Shipments", "Shipments.ShippingAddress"},
+	"shipping_address": {"ShippingAddress"},
+	"billing_address":  {"BillingAddress"},
+}
+
+var orderFields = jsonFieldNames(reflect.TypeOf(models.Order{}))
+
+// responseShape holds the fields a client asked for with ?fields= and the
+// associations it asked for with ?expand=.
+type responseShape struct {
+	fields map[string]bool
+	expand map[string]bool
+}
+
+// parseOrderShape parses the fields and expand parameters of order lists. It
+// returns nil when neither is given, so the full orders are returned.
+func parseOrderShape(params url.Values) (*responseShape, error) {
+	if params.Get("fields") == "" && params.Get("expand") == "" {
+		return nil, nil
+	}
+
+	shape := &responseShape{fields: map[string]bool{}, expand: map[string]bool{}}
+	for _, name := range splitParam(params.Get("fields")) {
+		if !orderFields[name] {
+			return nil, fmt.Errorf("Unknown field '%s'", name)
+		}
+		shape.fields[name] = true
+		if _, ok := orderAssociations[name]; ok {
+			shape.expand[name] = true
+		}
+	}
+	for _, name := range splitParam(params.Get("expand")) {
+		if _, ok := orderAssociations[name]; !ok {
+			return nil, fmt.Errorf("Unknown association '%s'", name)
+		}
+		shape.expand[name] = true
+	}
+	return shape, nil
+}
+
+// preload loads the expanded associations of the orders.
+func (s *responseShape) preload(query *gorm.DB) *gorm.DB {
+	for name := range s.expand {
+		for _, preload := range orderAssociations[name] {
+			query = query.Preload(preload)
+		}
+	}
+	return query
+}
+
+// apply returns the requested fields and the expanded associations of v,
+// which is serialized as a JSON object.
+func (s *responseShape) apply(v interface{}) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	all := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+
+	shaped := map[string]json.RawMessage{}
+	for name, value := range all {
+		_, association := orderAssociations[name]
+		switch {
+		case s.expand[name]:
+		case association:
+			continue
+		case len(s.fields) > 0 && !s.fields[name]:
+			continue
+		}
+		shaped[name] = value
+	}
+	return shaped, nil
+}
+
+// jsonFieldNames returns the names of the fields of a struct type as they're
+// serialized to JSON.
+func jsonFieldNames(t reflect.Type) map[string]bool {
+	names := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		names[name] = true
+	}
+	return names
+}
+
+func splitParam(value string) []string {
+	names := []string{}
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
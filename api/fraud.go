@@ -0,0 +1,71 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/jinzhu/gorm"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/fraud"
+	"github.com/netlify/gocommerce/models"
+)
+
+// checkFraud assesses the risk of a payment before it's charged. Payments are
+// charged without a check if the risk service fails, so an outage of the
+// service doesn't stop the shop from taking payments.
+func checkFraud(r *http.Request, order *models.Order, providerName string, amount uint64, currency string) *fraud.Result {
+	checker := gcontext.GetFraudChecker(r.Context())
+	if checker == nil || order.RiskApproved {
+		return nil
+	}
+
+	result, err := checker.Check(r.Context(), &fraud.Request{
+		Order:          order,
+		BillingAddress: &order.BillingAddress,
+		Amount:         amount,
+		Currency:       currency,
+		Provider:       providerName,
+		IP:             clientIP(r),
+		UserAgent:      r.UserAgent(),
+	})
+	if err != nil {
+		getLogEntry(r).WithError(err).WithField("fraud_provider", checker.Name()).Warn("Fraud check failed, charging the payment without it")
+		return nil
+	}
+	return result
+}
+
+// setRisk records the outcome of the fraud check on a transaction.
+func setRisk(tr *models.Transaction, result *fraud.Result) {
+	if result == nil {
+		return
+	}
+	score := result.Score
+	tr.RiskScore = &score
+	tr.RiskReason = result.Reason
+}
+
+// finishReview closes the payments of an order that were held for review.
+// Approved orders go back to pending so the customer can pay again without
+// another fraud check, declined orders fail.
+func finishReview(r *http.Request, tx *gorm.DB, order *models.Order, approved bool) {
+	description := "Declined after manual review"
+	if approved {
+		description = "Approved after manual review, the payment has to be made again"
+		order.PaymentState = models.PendingState
+		order.RiskApproved = true
+		logTimeline(r, tx, order, models.ReviewedTimelineEvent, "Payment approved after review")
+	} else {
+		order.PaymentState = models.FailedState
+		logTimeline(r, tx, order, models.ReviewedTimelineEvent, "Payment declined after review")
+	}
+
+	for _, trans := range order.Transactions {
+		if trans.Type == models.ChargeTransactionType && trans.Status == models.ReviewState {
+			trans.Status = models.FailedState
+			trans.FailureCode = models.ReviewState
+			trans.FailureDescription = description
+			tx.Save(trans)
+		}
+	}
+}
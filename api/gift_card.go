@@ -0,0 +1,149 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+type giftCardParams struct {
+	Code     string `json:"code"`
+	Balance  uint64 `json:"balance"`
+	Currency string `json:"currency"`
+	UserID   string `json:"user_id"`
+}
+
+// GiftCardList lists the issued gift cards, optionally only the ones of a
+// user with "?user_id=". It is only available to admins.
+func (a *API) GiftCardList(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+
+	query := siteScope(r.Context(), a.ReadDB(r).Where("instance_id = ?", instanceID), "")
+	if userID := r.URL.Query().Get("user_id"); userID != "" {
+		query = query.Where("user_id = ?", userID)
+	}
+
+	offset, limit, err := paginate(w, r, query.Model(&models.GiftCard{}))
+	if err != nil {
+		return badRequestError("Bad Pagination Parameters: %v", err)
+	}
+
+	cards := []models.GiftCard{}
+	if rsp := query.Order("created_at desc").Offset(offset).Limit(limit).Find(&cards); rsp.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, cards)
+}
+
+// GiftCardView returns the balance of a gift card to anyone who knows its code
+func (a *API) GiftCardView(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+	code := chi.URLParam(r, "gift_card_code")
+
+	card, err := models.FindGiftCard(siteScope(r.Context(), a.ReadDB(r), ""), instanceID, code)
+	if err != nil {
+		return internalServerError("Error during database query").WithInternalError(err)
+	}
+	if card == nil {
+		return notFoundError("Gift card not found")
+	}
+	return sendJSON(w, http.StatusOK, card)
+}
+
+// GiftCardCreate issues a gift card with a balance. A random code is generated
+// unless one is given. It is only available to admins.
+func (a *API) GiftCardCreate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	instanceID := gcontext.GetInstanceID(ctx)
+
+	params := new(giftCardParams)
+	if err := decodeJSON(r, params); err != nil {
+		return badRequestError("Failed to parse json body: %v", err)
+	}
+	if params.Balance == 0 {
+		return badRequestError("A gift card requires a balance")
+	}
+	currency, httpErr := normalizeCurrency(gcontext.GetConfig(ctx), params.Currency)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	db := a.DB(r)
+	if params.Code != "" {
+		existing, err := models.FindGiftCard(db, instanceID, params.Code)
+		if err != nil {
+			return internalServerError("Error during database query").WithInternalError(err)
+		}
+		if existing != nil {
+			return conflictError("A gift card with the code %v already exists", params.Code)
+		}
+	}
+
+	card := models.NewGiftCard(instanceID, params.Code, params.Balance, currency, params.UserID)
+	card.SiteID = gcontext.GetSiteID(ctx)
+	if rsp := db.Create(card); rsp.Error != nil {
+		return internalServerError("Failed to save gift card").WithInternalError(rsp.Error)
+	}
+
+	getLogEntry(r).WithField("gift_card_id", card.ID).Infof("Issued gift card of %d %s", card.Balance, card.Currency)
+	return sendJSON(w, http.StatusCreated, card)
+}
+
+// redeemGiftCard pays as much as possible of an amount with a gift card. It
+// returns the transaction of the paid part, which is created within tx so the
+// deduction is rolled back with it.
+func redeemGiftCard(tx *gorm.DB, order *models.Order, code string, amount uint64, currency string) (*models.GiftCard, *models.Transaction, *HTTPError) {
+	card, err := models.FindGiftCard(tx, order.InstanceID, code)
+	if err != nil {
+		return nil, nil, internalServerError("Error during database query").WithInternalError(err)
+	}
+	if card == nil || (card.SiteID != "" && card.SiteID != order.SiteID) {
+		return nil, nil, badRequestError("Gift card not found")
+	}
+	if card.UserID != "" && card.UserID != order.UserID {
+		return nil, nil, badRequestError("This gift card belongs to another user")
+	}
+	if !strings.EqualFold(card.Currency, currency) {
+		return nil, nil, badRequestError("The gift card is in %v, but the payment is in %v", card.Currency, currency)
+	}
+	if card.Balance == 0 {
+		return nil, nil, badRequestError("The gift card has no balance left")
+	}
+
+	credit := amount
+	if card.Balance < credit {
+		credit = card.Balance
+	}
+	if err := models.RedeemGiftCard(tx, card, credit); err != nil {
+		if err == models.ErrInsufficientBalance {
+			return nil, nil, conflictError("%v", err)
+		}
+		return nil, nil, internalServerError("Failed to redeem gift card").WithInternalError(err)
+	}
+
+	tr := models.NewTransaction(order)
+	tr.Amount = credit
+	tr.Currency = currency
+	tr.GiftCardID = card.ID
+	tr.InvoiceNumber = order.InvoiceNumber
+	return card, tr, nil
+}
+
+// refundToStoreCredit returns a refund to the gift card a transaction was
+// paid with, or else to a new gift card for the customer.
+func refundToStoreCredit(tx *gorm.DB, order *models.Order, trans *models.Transaction, amount uint64, currency string) (*models.GiftCard, error) {
+	if trans.GiftCardID != "" {
+		card := &models.GiftCard{}
+		if rsp := tx.First(card, "id = ?", trans.GiftCardID); rsp.Error != nil {
+			return nil, rsp.Error
+		}
+		return card, models.CreditGiftCard(tx, card, amount)
+	}
+
+	card := models.NewGiftCard(order.InstanceID, "", amount, currency, order.UserID)
+	return card, tx.Create(card).Error
+}
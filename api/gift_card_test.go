@@ -0,0 +1,231 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	stripe "github.com/stripe/stripe-go"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func issueGiftCard(t *testing.T, test *RouteTest, body string) *models.GiftCard {
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+	recorder := test.TestEndpoint(http.MethodPost, "/gift_cards", strings.NewReader(body), token)
+	card := &models.GiftCard{}
+	extractPayload(t, http.StatusCreated, recorder, card)
+	return card
+}
+
+func giftCardBalance(t *testing.T, test *RouteTest, card *models.GiftCard) uint64 {
+	saved := &models.GiftCard{}
+	require.NoError(t, test.DB.First(saved, "id = ?", card.ID).Error)
+	return saved.Balance
+}
+
+func payWithGiftCard(t *testing.T, test *RouteTest, body string, intentAmount *int64, chargeErr error) (*models.Transaction, int) {
+	test.Data.firstOrder.PaymentState = models.PendingState
+	require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+	stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+		if chargeErr != nil {
+			return chargeErr
+		}
+		if intentParams, ok := params.(*stripe.PaymentIntentParams); ok && intentAmount != nil {
+			*intentAmount = *intentParams.Amount
+		}
+		intent := v.(*stripe.PaymentIntent)
+		intent.ID = stripePaymentIntentID
+		intent.Status = stripe.PaymentIntentStatusSucceeded
+		return nil
+	}))
+	defer stripe.SetBackend(stripe.APIBackend, nil)
+
+	recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", strings.NewReader(body), test.Data.testUserToken)
+	if recorder.Code != http.StatusOK {
+		return nil, recorder.Code
+	}
+	tr := &models.Transaction{}
+	extractPayload(t, http.StatusOK, recorder, tr)
+	return tr, recorder.Code
+}
+
+func TestGiftCardCreate(t *testing.T) {
+	test := NewRouteTest(t)
+	card := issueGiftCard(t, test, `{"balance": 1000, "currency": "usd"}`)
+	assert.NotEmpty(t, card.Code)
+	assert.EqualValues(t, 1000, card.Balance)
+	assert.Equal(t, "USD", card.Currency)
+
+	named := issueGiftCard(t, test, `{"code": "HAPPY-BIRTHDAY", "balance": 500, "user_id": "i-am-batman"}`)
+	assert.Equal(t, "HAPPY-BIRTHDAY", named.Code)
+	assert.Equal(t, "i-am-batman", named.UserID)
+
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+	recorder := test.TestEndpoint(http.MethodPost, "/gift_cards", strings.NewReader(`{"code": "HAPPY-BIRTHDAY", "balance": 500}`), token)
+	validateError(t, http.StatusConflict, recorder)
+
+	recorder = test.TestEndpoint(http.MethodPost, "/gift_cards", strings.NewReader(`{"balance": 0}`), token)
+	validateError(t, http.StatusBadRequest, recorder, "balance")
+
+	recorder = test.TestEndpoint(http.MethodPost, "/gift_cards", strings.NewReader(`{"balance": 500}`), test.Data.testUserToken)
+	validateError(t, http.StatusUnauthorized, recorder)
+
+	recorder = test.TestEndpoint(http.MethodGet, "/gift_cards?user_id=i-am-batman", nil, token)
+	cards := []models.GiftCard{}
+	extractPayload(t, http.StatusOK, recorder, &cards)
+	require.Len(t, cards, 1)
+	assert.Equal(t, named.ID, cards[0].ID)
+
+	recorder = test.TestEndpoint(http.MethodGet, "/gift_cards/HAPPY-BIRTHDAY", nil, nil)
+	viewed := &models.GiftCard{}
+	extractPayload(t, http.StatusOK, recorder, viewed)
+	assert.EqualValues(t, 500, viewed.Balance)
+
+	recorder = test.TestEndpoint(http.MethodGet, "/gift_cards/NOPE", nil, nil)
+	validateError(t, http.StatusNotFound, recorder)
+}
+
+func TestGiftCardPayment(t *testing.T) {
+	t.Run("FullPayment", func(t *testing.T) {
+		test := NewRouteTest(t)
+		card := issueGiftCard(t, test, `{"balance": 50, "currency": "USD"}`)
+
+		tr, code := payWithGiftCard(t, test, `{"gift_card_code": "`+card.Code+`", "amount": 24, "currency": "USD"}`, nil, nil)
+		require.Equal(t, http.StatusOK, code)
+		assert.EqualValues(t, 24, tr.Amount)
+		assert.Equal(t, card.ID, tr.GiftCardID)
+		assert.Equal(t, models.PaidState, tr.Status)
+		assert.EqualValues(t, 26, giftCardBalance(t, test, card))
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", "first-order").Error)
+		assert.Equal(t, models.PaidState, order.PaymentState)
+		assert.Equal(t, models.GiftCardProcessor, order.PaymentProcessor)
+	})
+
+	t.Run("SplitPayment", func(t *testing.T) {
+		test := NewRouteTest(t)
+		card := issueGiftCard(t, test, `{"balance": 10, "currency": "USD"}`)
+
+		var charged int64
+		tr, code := payWithGiftCard(t, test, `{"gift_card_code": "`+card.Code+`", "provider": "stripe", "amount": 24, "currency": "USD", "stripe_payment_method_id": "pm_card"}`, &charged, nil)
+		require.Equal(t, http.StatusOK, code)
+		assert.EqualValues(t, 14, charged)
+		assert.EqualValues(t, 14, tr.Amount)
+		assert.Empty(t, tr.GiftCardID)
+		assert.EqualValues(t, 0, giftCardBalance(t, test, card))
+
+		credit := &models.Transaction{}
+		require.NoError(t, test.DB.First(credit, "gift_card_id = ?", card.ID).Error)
+		assert.EqualValues(t, 10, credit.Amount)
+		assert.Equal(t, models.PaidState, credit.Status)
+	})
+
+	t.Run("SplitPaymentWithoutProvider", func(t *testing.T) {
+		test := NewRouteTest(t)
+		card := issueGiftCard(t, test, `{"balance": 10, "currency": "USD"}`)
+
+		_, code := payWithGiftCard(t, test, `{"gift_card_code": "`+card.Code+`", "amount": 24, "currency": "USD"}`, nil, nil)
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.EqualValues(t, 10, giftCardBalance(t, test, card))
+	})
+
+	t.Run("FailedCharge", func(t *testing.T) {
+		test := NewRouteTest(t)
+		card := issueGiftCard(t, test, `{"balance": 10, "currency": "USD"}`)
+
+		_, code := payWithGiftCard(t, test, `{"gift_card_code": "`+card.Code+`", "provider": "stripe", "amount": 24, "currency": "USD", "stripe_payment_method_id": "pm_card"}`, nil, errors.New("card declined"))
+		assert.Equal(t, http.StatusInternalServerError, code)
+		assert.EqualValues(t, 10, giftCardBalance(t, test, card))
+	})
+
+	t.Run("PendingCharge", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.firstOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+		card := issueGiftCard(t, test, `{"balance": 10, "currency": "USD"}`)
+
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+			intent := v.(*stripe.PaymentIntent)
+			intent.ID = stripePaymentIntentID
+			intent.Status = stripe.PaymentIntentStatusRequiresAction
+			if strings.HasSuffix(path, "/confirm") {
+				intent.Status = stripe.PaymentIntentStatusRequiresPaymentMethod
+			}
+			return nil
+		}))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		body := `{"gift_card_code": "` + card.Code + `", "provider": "stripe", "amount": 24, "currency": "USD", "stripe_payment_method_id": "pm_card"}`
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", strings.NewReader(body), test.Data.testUserToken)
+		tr := &models.Transaction{}
+		extractPayload(t, http.StatusOK, recorder, tr)
+		assert.Equal(t, models.PendingState, tr.Status)
+		assert.EqualValues(t, 0, giftCardBalance(t, test, card))
+
+		credit := &models.Transaction{}
+		require.NoError(t, test.DB.First(credit, "gift_card_id = ?", card.ID).Error)
+		assert.Equal(t, models.PendingState, credit.Status)
+
+		recorder = test.TestEndpoint(http.MethodPost, "/payments/"+tr.ID+"/confirm", nil, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "failed")
+		assert.EqualValues(t, 10, giftCardBalance(t, test, card))
+		require.NoError(t, test.DB.First(credit, "id = ?", credit.ID).Error)
+		assert.Equal(t, models.FailedState, credit.Status)
+		require.NoError(t, test.DB.First(tr, "id = ?", tr.ID).Error)
+		assert.Equal(t, models.FailedState, tr.Status)
+	})
+
+	t.Run("OtherOwner", func(t *testing.T) {
+		test := NewRouteTest(t)
+		card := issueGiftCard(t, test, `{"balance": 50, "currency": "USD", "user_id": "joker"}`)
+
+		_, code := payWithGiftCard(t, test, `{"gift_card_code": "`+card.Code+`", "amount": 24, "currency": "USD"}`, nil, nil)
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.EqualValues(t, 50, giftCardBalance(t, test, card))
+	})
+
+	t.Run("OtherCurrency", func(t *testing.T) {
+		test := NewRouteTest(t)
+		card := issueGiftCard(t, test, `{"balance": 50, "currency": "EUR"}`)
+
+		_, code := payWithGiftCard(t, test, `{"gift_card_code": "`+card.Code+`", "amount": 24, "currency": "USD"}`, nil, nil)
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+}
+
+func TestGiftCardRefund(t *testing.T) {
+	t.Run("ToStoreCredit", func(t *testing.T) {
+		test := NewRouteTest(t)
+		url := "/payments/" + test.Data.firstTransaction.ID + "/refund"
+		w := runPaymentRefund(test, url, &PaymentParams{Amount: 10, Currency: "USD", StoreCredit: true})
+		refund := &models.Transaction{}
+		extractPayload(t, http.StatusOK, w, refund)
+		assert.Equal(t, models.PaidState, refund.Status)
+		require.NotEmpty(t, refund.GiftCardID)
+
+		card := &models.GiftCard{}
+		require.NoError(t, test.DB.First(card, "id = ?", refund.GiftCardID).Error)
+		assert.EqualValues(t, 10, card.Balance)
+		assert.Equal(t, "USD", card.Currency)
+		assert.Equal(t, test.Data.testUser.ID, card.UserID)
+	})
+
+	t.Run("GiftCardPayment", func(t *testing.T) {
+		test := NewRouteTest(t)
+		card := issueGiftCard(t, test, `{"balance": 50, "currency": "USD"}`)
+		tr, code := payWithGiftCard(t, test, `{"gift_card_code": "`+card.Code+`", "amount": 24, "currency": "USD"}`, nil, nil)
+		require.Equal(t, http.StatusOK, code)
+
+		w := runPaymentRefund(test, "/payments/"+tr.ID+"/refund", &PaymentParams{Amount: 4, Currency: "USD"})
+		refund := &models.Transaction{}
+		extractPayload(t, http.StatusOK, w, refund)
+		assert.Equal(t, card.ID, refund.GiftCardID)
+		assert.EqualValues(t, 30, giftCardBalance(t, test, card))
+	})
+}
@@ -4,10 +4,19 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/pkg/errors"
 )
 
+// decodeJSON decodes the request body into params, rejecting fields that
+// params doesn't know about.
+func decodeJSON(r *http.Request, params interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(params)
+}
+
 func sendJSON(w http.ResponseWriter, status int, obj interface{}) error {
 	w.Header().Set("Content-Type", "application/json")
 	b, err := json.Marshal(obj)
@@ -18,3 +27,23 @@ func sendJSON(w http.ResponseWriter, status int, obj interface{}) error {
 	_, err = w.Write(b)
 	return err
 }
+
+// notModified sets the ETag of the response and reports whether it matches
+// the If-None-Match header of the request, in which case the handler should
+// answer with 304 Not Modified instead of the body.
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// sendNotModified answers a conditional request whose resource hasn't changed.
+func sendNotModified(w http.ResponseWriter) error {
+	w.WriteHeader(http.StatusNotModified)
+	return nil
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// FailedWebhookList lists the webhooks that failed permanently, newest first,
+// with the error and response of their last try. It is only available to admins.
+func (a *API) FailedWebhookList(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+
+	query := a.ReadDB(r).Where("instance_id = ? AND failed = ?", instanceID, true)
+	if hookType := r.URL.Query().Get("type"); hookType != "" {
+		query = query.Where("type = ?", hookType)
+	}
+
+	offset, limit, err := paginate(w, r, query.Model(&models.Hook{}))
+	if err != nil {
+		return badRequestError("Bad Pagination Parameters: %v", err)
+	}
+
+	hooks := []models.Hook{}
+	if rsp := query.Order("created_at desc, id desc").Offset(offset).Limit(limit).Find(&hooks); rsp.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, hooks)
+}
+
+// FailedWebhookRetry requeues a webhook that failed permanently, which is
+// then tried as often as a new one. It is only available to admins.
+func (a *API) FailedWebhookRetry(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+	hookID := chi.URLParam(r, "hook_id")
+
+	tx := a.DB(r).Begin()
+	hook := &models.Hook{}
+	if rsp := tx.First(hook, "id = ? AND instance_id = ?", hookID, instanceID); rsp.Error != nil {
+		tx.Rollback()
+		if rsp.RecordNotFound() {
+			return notFoundError("Webhook not found")
+		}
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	if !hook.Failed {
+		tx.Rollback()
+		return conflictError("Only failed webhooks can be retried")
+	}
+	if err := hook.Retry(tx); err != nil {
+		tx.Rollback()
+		return internalServerError("Failed to requeue webhook").WithInternalError(err)
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Failed to requeue webhook").WithInternalError(rsp.Error)
+	}
+
+	getLogEntry(r).WithField("hook_id", hook.ID).Infof("Requeued failed %s webhook to %s", hook.Type, hook.URL)
+	return sendJSON(w, http.StatusOK, hook)
+}
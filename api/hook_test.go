@@ -0,0 +1,187 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestWebhookLimits(t *testing.T) {
+	t.Run("PayloadTooLarge", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Webhooks.Payment = "https://example.com/payment"
+		test.Config.Webhooks.MaxPayloadSize = 64
+
+		payFirstOrder(t, test)
+
+		hooks := []models.Hook{}
+		require.NoError(t, test.DB.Where("type = ?", "payment").Find(&hooks).Error)
+		assert.Empty(t, hooks)
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Webhooks.Timeout = 1
+
+		release := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+		defer server.Close()
+		defer close(release)
+
+		hook, err := models.NewHook("order", test.Config, server.URL, "", test.Data.firstOrder)
+		require.NoError(t, err)
+		assert.EqualValues(t, 1, hook.Timeout)
+		require.NoError(t, test.DB.Create(hook).Error)
+
+		err = hook.Deliver(test.DB, &http.Client{}, logrus.NewEntry(logrus.StandardLogger()))
+		require.Error(t, err)
+
+		saved := &models.Hook{}
+		require.NoError(t, test.DB.First(saved, hook.ID).Error)
+		assert.False(t, saved.Done)
+		assert.Equal(t, 1, saved.Tries)
+		assert.NotNil(t, saved.RunAfter)
+		assert.NotNil(t, saved.ErrorMessage)
+	})
+}
+
+func TestWebhookSchemaVersions(t *testing.T) {
+	deliver := func(t *testing.T, test *RouteTest) (map[string]interface{}, jwt.MapClaims) {
+		var body []byte
+		var signature string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ = ioutil.ReadAll(r.Body)
+			signature = r.Header.Get("X-Commerce-Signature")
+		}))
+		defer server.Close()
+
+		hook, err := models.NewHook("order", test.Config, server.URL, "", test.Data.firstOrder)
+		require.NoError(t, err)
+		require.NoError(t, test.DB.Create(hook).Error)
+		require.NoError(t, hook.Deliver(test.DB, &http.Client{}, logrus.NewEntry(logrus.StandardLogger())))
+
+		payload := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(body, &payload))
+		claims := jwt.MapClaims{}
+		_, err = jwt.ParseWithClaims(signature, claims, func(token *jwt.Token) (interface{}, error) {
+			return []byte(test.Config.Webhooks.Secret), nil
+		})
+		require.NoError(t, err)
+		return payload, claims
+	}
+
+	t.Run("Default", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Webhooks.Secret = "hook-secret"
+
+		payload, claims := deliver(t, test)
+		assert.Equal(t, test.Data.firstOrder.ID, payload["id"])
+		assert.NotContains(t, payload, "schema_version")
+		assert.EqualValues(t, models.HookSchemaV1, claims["schema_version"])
+		assert.Equal(t, "order", claims["event_type"])
+	})
+
+	t.Run("Pinned", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Webhooks.Secret = "hook-secret"
+		test.Config.Webhooks.Versions = map[string]int{"order": models.HookSchemaV2}
+
+		payload, claims := deliver(t, test)
+		assert.EqualValues(t, models.HookSchemaV2, payload["schema_version"])
+		assert.Equal(t, "order", payload["event_type"])
+		data, ok := payload["data"].(map[string]interface{})
+		require.True(t, ok)
+		assert.Equal(t, test.Data.firstOrder.ID, data["id"])
+		assert.EqualValues(t, models.HookSchemaV2, claims["schema_version"])
+	})
+
+	t.Run("Unsupported", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Webhooks.Versions = map[string]int{"order": 99}
+
+		_, err := models.NewHook("order", test.Config, "https://example.com/order", "", test.Data.firstOrder)
+		assert.Error(t, err)
+	})
+}
+
+func TestFailedWebhooks(t *testing.T) {
+	createHooks := func(t *testing.T, test *RouteTest) (*models.Hook, *models.Hook) {
+		failed, err := models.NewHook("order", test.Config, "https://example.com/order", "", test.Data.firstOrder)
+		require.NoError(t, err)
+		require.NoError(t, test.DB.Create(failed).Error)
+		errString := "connection refused"
+		failed.Done = true
+		failed.Failed = true
+		failed.Tries = 5
+		failed.ErrorMessage = &errString
+		require.NoError(t, test.DB.Save(failed).Error)
+
+		delivered, err := models.NewHook("payment", test.Config, "https://example.com/payment", "", test.Data.firstOrder)
+		require.NoError(t, err)
+		require.NoError(t, test.DB.Create(delivered).Error)
+		delivered.Done = true
+		require.NoError(t, test.DB.Save(delivered).Error)
+		return failed, delivered
+	}
+
+	t.Run("List", func(t *testing.T) {
+		test := NewRouteTest(t)
+		failed, _ := createHooks(t, test)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/webhooks/failed", nil, testAdminToken("magical-unicorn", ""))
+		hooks := []models.Hook{}
+		extractPayload(t, http.StatusOK, recorder, &hooks)
+		require.Len(t, hooks, 1)
+		assert.Equal(t, failed.ID, hooks[0].ID)
+		assert.Equal(t, 5, hooks[0].Tries)
+		require.NotNil(t, hooks[0].ErrorMessage)
+		assert.Equal(t, "connection refused", *hooks[0].ErrorMessage)
+	})
+	t.Run("ListAsUser", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/webhooks/failed", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+	t.Run("Retry", func(t *testing.T) {
+		test := NewRouteTest(t)
+		failed, _ := createHooks(t, test)
+		countJobs := func() int {
+			var jobs int
+			require.NoError(t, test.DB.Model(&models.Job{}).Where("type = ? AND payload = ?", models.WebhookJob, fmt.Sprintf(`{"hook_id":%d}`, failed.ID)).Count(&jobs).Error)
+			return jobs
+		}
+		before := countJobs()
+
+		recorder := test.TestEndpoint(http.MethodPost, fmt.Sprintf("/webhooks/%d/retry", failed.ID), nil, testAdminToken("magical-unicorn", ""))
+		hook := &models.Hook{}
+		extractPayload(t, http.StatusOK, recorder, hook)
+		assert.False(t, hook.Done)
+		assert.False(t, hook.Failed)
+		assert.Equal(t, 0, hook.Tries)
+		assert.Equal(t, before+1, countJobs())
+	})
+	t.Run("RetryDelivered", func(t *testing.T) {
+		test := NewRouteTest(t)
+		_, delivered := createHooks(t, test)
+
+		recorder := test.TestEndpoint(http.MethodPost, fmt.Sprintf("/webhooks/%d/retry", delivered.ID), nil, testAdminToken("magical-unicorn", ""))
+		validateError(t, http.StatusConflict, recorder)
+	})
+	t.Run("RetryUnknown", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodPost, "/webhooks/12345/retry", nil, testAdminToken("magical-unicorn", ""))
+		validateError(t, http.StatusNotFound, recorder)
+	})
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/netlify/gocommerce/conf"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/payments"
+)
+
+// apiCapabilities describes what this instance of the API supports, so
+// frontends can adapt without hardcoding it.
+type apiCapabilities struct {
+	Name              string            `json:"name"`
+	Version           string            `json:"version"`
+	PaymentProcessors paymentProcessors `json:"payment_processors"`
+	Currencies        []string          `json:"currencies"`
+	// ProcessorCurrencies lists the currencies of the enabled payment
+	// processors that only support some, others support any currency
+	ProcessorCurrencies map[string][]string `json:"processor_currencies,omitempty"`
+	Features            capabilityFeatures  `json:"features"`
+}
+
+type paymentProcessors struct {
+	Stripe bool `json:"stripe"`
+	PayPal bool `json:"paypal"`
+}
+
+type capabilityFeatures struct {
+	Coupons           bool `json:"coupons"`
+	CouponStacking    bool `json:"coupon_stacking"`
+	Inventory         bool `json:"inventory"`
+	Downloads         bool `json:"downloads"`
+	MagicLinks        bool `json:"magic_links"`
+	MultiSite         bool `json:"multi_site"`
+	OrderExpiry       bool `json:"order_expiry"`
+	CaptureOnShipment bool `json:"capture_on_shipment"`
+}
+
+// Index describes the version and capabilities of the API
+func (a *API) Index(w http.ResponseWriter, r *http.Request) error {
+	config := gcontext.GetConfig(r.Context())
+
+	return sendJSON(w, http.StatusOK, &apiCapabilities{
+		Name:    "GoCommerce",
+		Version: a.version,
+		PaymentProcessors: paymentProcessors{
+			Stripe: config.Payment.Stripe.Enabled,
+			PayPal: config.Payment.PayPal.Enabled,
+		},
+		Currencies:          supportedCurrencies(config),
+		ProcessorCurrencies: restrictedProcessorCurrencies(config),
+		Features: capabilityFeatures{
+			Coupons:           config.Coupons.URL != "",
+			CouponStacking:    config.Coupons.URL != "" && config.Coupons.Stacking,
+			Inventory:         true,
+			Downloads:         config.Downloads.Provider != "",
+			MagicLinks:        config.Mailer.MagicLink.Enabled,
+			MultiSite:         config.MultiSite,
+			OrderExpiry:       config.Expiry.TTL > 0,
+			CaptureOnShipment: config.Payment.CaptureOnShipment,
+		},
+	})
+}
+
+// supportedCurrencies lists the currencies orders can be placed in. It is
+// empty when orders aren't converted to a settlement currency and any
+// currency is accepted.
+func supportedCurrencies(config *conf.Configuration) []string {
+	currencies := []string{}
+	settlement := config.Settlement
+	if settlement.Currency == "" {
+		return currencies
+	}
+
+	currencies = append(currencies, strings.ToUpper(settlement.Currency))
+	for currency, rate := range settlement.Rates {
+		if rate > 0 && !strings.EqualFold(currency, settlement.Currency) {
+			currencies = append(currencies, strings.ToUpper(currency))
+		}
+	}
+	sort.Strings(currencies[1:])
+	return currencies
+}
+
+// restrictedProcessorCurrencies maps the enabled payment processors that
+// are configured for some currencies to them.
+func restrictedProcessorCurrencies(config *conf.Configuration) map[string][]string {
+	enabled := map[string]bool{
+		payments.StripeProvider: config.Payment.Stripe.Enabled,
+		payments.PayPalProvider: config.Payment.PayPal.Enabled,
+	}
+	restricted := map[string][]string{}
+	for processor, ok := range enabled {
+		if !ok {
+			continue
+		}
+		currencies := []string{}
+		for _, currency := range processorCurrencies(config, processor) {
+			currencies = append(currencies, strings.ToUpper(currency))
+		}
+		if len(currencies) > 0 {
+			restricted[processor] = currencies
+		}
+	}
+	return restricted
+}
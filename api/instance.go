@@ -50,6 +50,7 @@ func (a *API) CreateInstance(w http.ResponseWriter, r *http.Request) error {
 	db := a.DB(r)
 
 	params := InstanceRequestParams{}
+	// the operator may send fields we don't use
 	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
 		return badRequestError("Error decoding params: %v", err)
 	}
@@ -89,6 +90,7 @@ func (a *API) UpdateInstance(w http.ResponseWriter, r *http.Request) error {
 	i := gcontext.GetInstance(r.Context())
 
 	params := InstanceRequestParams{}
+	// the operator may send fields we don't use
 	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
 		return badRequestError("Error decoding params: %v", err)
 	}
@@ -27,6 +27,7 @@ type InstanceTestSuite struct {
 func (ts *InstanceTestSuite) SetupTest() {
 	globalConfig, log, err := conf.LoadGlobal("test.env")
 	require.NoError(ts.T(), err)
+	globalConfig.DB.URL = testDBFile()
 	globalConfig.OperatorToken = operatorToken
 	globalConfig.MultiInstanceMode = true
 	db, err := models.Connect(globalConfig, log)
@@ -0,0 +1,238 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+type stockParams struct {
+	Quantity    *int64     `json:"quantity"`
+	Preorder    *bool      `json:"preorder"`
+	AvailableAt *time.Time `json:"available_at"`
+}
+
+type lowStockPayload struct {
+	Sku       string `json:"sku"`
+	Remaining int64  `json:"remaining"`
+	Threshold int64  `json:"threshold"`
+}
+
+type restockedPayload struct {
+	Sku      string   `json:"sku"`
+	Quantity int64    `json:"quantity"`
+	OrderIDs []string `json:"order_ids"`
+}
+
+// StockList lists the tracked SKUs and their remaining quantity. It is only available to admins.
+func (a *API) StockList(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+
+	stock := []models.Stock{}
+	if rsp := a.ReadDB(r).Where("instance_id = ?", instanceID).Order("sku asc").Find(&stock); rsp.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, stock)
+}
+
+// StockUpdate sets the remaining quantity of a SKU and starts tracking it. It
+// is only available to admins.
+func (a *API) StockUpdate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := gcontext.GetConfig(ctx)
+	instanceID := gcontext.GetInstanceID(ctx)
+	sku := chi.URLParam(r, "sku")
+	log := getLogEntry(r)
+
+	params := new(stockParams)
+	if err := decodeJSON(r, params); err != nil {
+		return badRequestError("Failed to parse json body: %v", err)
+	}
+	if params.Quantity == nil {
+		return badRequestError("A quantity is required")
+	}
+
+	tx := a.DB(r).Begin()
+	stock := &models.Stock{}
+	if rsp := tx.Where(models.Stock{InstanceID: instanceID, Sku: sku}).FirstOrInit(stock); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	restocked := stock.Preorder && stock.Quantity <= 0 && *params.Quantity > 0
+
+	stock.InstanceID = instanceID
+	stock.Sku = sku
+	stock.Quantity = *params.Quantity
+	if params.Preorder != nil {
+		stock.Preorder = *params.Preorder
+	}
+	if params.AvailableAt != nil {
+		stock.AvailableAt = params.AvailableAt
+	}
+	if rsp := tx.Save(stock); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Failed to save stock").WithInternalError(rsp.Error)
+	}
+
+	if restocked {
+		orderIDs, err := backorderedOrderIDs(tx, instanceID, sku)
+		if err != nil {
+			tx.Rollback()
+			return internalServerError("Error during database query").WithInternalError(err)
+		}
+		log.WithField("sku", sku).Infof("Preorder SKU is back in stock for %d backordered orders", len(orderIDs))
+		payload := &restockedPayload{Sku: sku, Quantity: stock.Quantity, OrderIDs: orderIDs}
+		if err := models.RunHooks(tx, config, instanceID, "restocked", config.Webhooks.Restocked, "", payload); err != nil {
+			tx.Rollback()
+			return internalServerError("Failed to process webhook").WithInternalError(err)
+		}
+	}
+	tx.Commit()
+
+	return sendJSON(w, http.StatusOK, stock)
+}
+
+// backorderedOrderIDs lists the backordered orders waiting for a SKU
+func backorderedOrderIDs(db *gorm.DB, instanceID, sku string) ([]string, error) {
+	orderTable := db.NewScope(models.Order{}).QuotedTableName()
+	lineItemTable := db.NewScope(models.LineItem{}).QuotedTableName()
+
+	orderIDs := []string{}
+	err := db.Model(&models.Order{}).
+		Joins("JOIN "+lineItemTable+" as line_item on line_item.order_id = "+orderTable+".id AND line_item.sku = ? AND line_item.backordered = ?", sku, true).
+		Where(orderTable+".instance_id = ? AND "+orderTable+".fulfillment_state = ?", instanceID, models.BackorderedState).
+		Order(orderTable+".created_at asc").
+		Pluck(orderTable+".id", &orderIDs).Error
+	return orderIDs, err
+}
+
+// checkStock makes sure there is enough stock for the tracked line items of an
+// order. Preorder SKUs that are out of stock are backordered instead.
+func checkStock(tx *gorm.DB, order *models.Order) *HTTPError {
+	for _, item := range order.LineItems {
+		stock, err := models.FindStock(tx, order.InstanceID, item.Sku)
+		if err != nil {
+			return internalServerError("Error during database query").WithInternalError(err)
+		}
+		if stock == nil || stock.Quantity >= int64(item.Quantity) {
+			continue
+		}
+		if !stock.Preorder {
+			return badRequestError("Not enough stock for %v", item.Sku)
+		}
+		item.Backordered = true
+		item.AvailableAt = stock.AvailableAt
+		order.FulfillmentState = models.BackorderedState
+	}
+	return nil
+}
+
+// reserveStock takes the tracked line items of a new order from the stock
+// for the configured reservation time. Preorder SKUs that ran out in the
+// meantime are backordered instead.
+func reserveStock(r *http.Request, tx *gorm.DB, order *models.Order) *HTTPError {
+	config := gcontext.GetConfig(r.Context())
+	if config.Inventory.ReservationTTL <= 0 {
+		return nil
+	}
+	expiresAt := time.Now().Add(time.Duration(config.Inventory.ReservationTTL) * time.Minute)
+
+	// line items of the same SKU are reserved together, so they either all
+	// get the stock or none
+	quantities := map[string]uint64{}
+	skus := []string{}
+	for _, item := range order.LineItems {
+		if item.Backordered {
+			continue
+		}
+		if _, ok := quantities[item.Sku]; !ok {
+			skus = append(skus, item.Sku)
+		}
+		quantities[item.Sku] += item.Quantity
+	}
+
+	for _, sku := range skus {
+		ok, err := models.ReserveStock(tx, order.InstanceID, order.ID, sku, quantities[sku], expiresAt)
+		if err != nil {
+			return internalServerError("Error reserving stock").WithInternalError(err)
+		}
+		if ok {
+			continue
+		}
+		stock, err := models.FindStock(tx, order.InstanceID, sku)
+		if err != nil {
+			return internalServerError("Error during database query").WithInternalError(err)
+		}
+		if stock == nil {
+			continue
+		}
+		if !stock.Preorder {
+			return badRequestError("Not enough stock for %v", sku)
+		}
+		for _, item := range order.LineItems {
+			if item.Sku == sku {
+				item.Backordered = true
+				item.AvailableAt = stock.AvailableAt
+			}
+		}
+		order.FulfillmentState = models.BackorderedState
+	}
+	return nil
+}
+
+// decrementStock removes the purchased line items from the stock and sends the
+// low stock webhook for SKUs that drop to the threshold. Reserved items were
+// taken from the stock already.
+func decrementStock(r *http.Request, tx *gorm.DB, order *models.Order) {
+	config := gcontext.GetConfig(r.Context())
+	log := getLogEntry(r)
+
+	reserved, err := models.ConvertReservations(tx, order.ID)
+	if err != nil {
+		log.WithError(err).Error("Failed to convert stock reservations")
+		reserved = map[string]uint64{}
+	}
+
+	order.StockHeld = true
+	for _, item := range order.LineItems {
+		quantity := item.Quantity
+		if reserved[item.Sku] > 0 {
+			fromReservation := reserved[item.Sku]
+			if fromReservation > quantity {
+				fromReservation = quantity
+			}
+			reserved[item.Sku] -= fromReservation
+			quantity -= fromReservation
+		}
+
+		var after *models.Stock
+		if quantity > 0 {
+			_, after, err = models.DecrementStock(tx, order.InstanceID, item.Sku, quantity)
+		} else {
+			after, err = models.FindStock(tx, order.InstanceID, item.Sku)
+		}
+		if err != nil {
+			log.WithError(err).WithField("sku", item.Sku).Error("Failed to decrement stock")
+			continue
+		}
+		if after == nil {
+			continue
+		}
+
+		// the stock before the purchase, reserved or not
+		before := after.Quantity + int64(item.Quantity)
+		threshold := config.Inventory.LowStockThreshold
+		if before <= threshold || after.Quantity > threshold {
+			continue
+		}
+		log.WithField("sku", item.Sku).Infof("Stock is low, %d remaining", after.Quantity)
+		payload := &lowStockPayload{Sku: item.Sku, Remaining: after.Quantity, Threshold: threshold}
+		if err := models.RunHooks(tx, config, order.InstanceID, "low_stock", config.Webhooks.LowStock, order.UserID, payload); err != nil {
+			log.WithError(err).Error("Failed to process webhook")
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	stripe "github.com/stripe/stripe-go"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func payFirstOrder(t *testing.T, test *RouteTest) {
+	test.Data.firstOrder.PaymentState = models.PendingState
+	require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+	payOrder(t, test, "first-order", 24)
+}
+
+func payOrder(t *testing.T, test *RouteTest, orderID string, amount uint64) {
+	stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+		intent := v.(*stripe.PaymentIntent)
+		intent.ID = stripePaymentIntentID
+		intent.Status = stripe.PaymentIntentStatusSucceeded
+		return nil
+	}))
+	defer stripe.SetBackend(stripe.APIBackend, nil)
+
+	body := strings.NewReader(fmt.Sprintf(`{"provider": "stripe", "amount": %d, "currency": "USD", "stripe_payment_method_id": "pm_card"}`, amount))
+	recorder := test.TestEndpoint(http.MethodPost, "/orders/"+orderID+"/payments", body, test.Data.testUserToken)
+	extractPayload(t, http.StatusOK, recorder, &models.Transaction{})
+}
+
+func TestStockUpdate(t *testing.T) {
+	test := NewRouteTest(t)
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	recorder := test.TestEndpoint(http.MethodPut, "/inventory/123-i-can-fly-456", strings.NewReader(`{"quantity": 5}`), token)
+	stock := &models.Stock{}
+	extractPayload(t, http.StatusOK, recorder, stock)
+	assert.EqualValues(t, 5, stock.Quantity)
+
+	recorder = test.TestEndpoint(http.MethodGet, "/inventory", nil, token)
+	list := []models.Stock{}
+	extractPayload(t, http.StatusOK, recorder, &list)
+	require.Len(t, list, 1)
+	assert.Equal(t, "123-i-can-fly-456", list[0].Sku)
+
+	recorder = test.TestEndpoint(http.MethodPut, "/inventory/123-i-can-fly-456", strings.NewReader(`{}`), token)
+	validateError(t, http.StatusBadRequest, recorder, "quantity")
+
+	recorder = test.TestEndpoint(http.MethodGet, "/inventory", nil, test.Data.testUserToken)
+	validateError(t, http.StatusUnauthorized, recorder)
+}
+
+func TestLowStockWebhook(t *testing.T) {
+	t.Run("CrossesThreshold", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Webhooks.LowStock = "https://example.com/low-stock"
+		test.Config.Inventory.LowStockThreshold = 3
+		require.NoError(t, test.DB.Save(&models.Stock{Sku: "123-i-can-fly-456", Quantity: 4}).Error)
+
+		payFirstOrder(t, test)
+
+		stock := &models.Stock{}
+		require.NoError(t, test.DB.First(stock, "sku = ?", "123-i-can-fly-456").Error)
+		assert.EqualValues(t, 2, stock.Quantity)
+
+		hooks := []models.Hook{}
+		require.NoError(t, test.DB.Where("type = ?", "low_stock").Find(&hooks).Error)
+		require.Len(t, hooks, 1)
+		assert.Equal(t, "https://example.com/low-stock", hooks[0].URL)
+
+		payload := &lowStockPayload{}
+		require.NoError(t, json.Unmarshal([]byte(hooks[0].Payload), payload))
+		assert.Equal(t, "123-i-can-fly-456", payload.Sku)
+		assert.EqualValues(t, 2, payload.Remaining)
+	})
+
+	t.Run("AboveThreshold", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Webhooks.LowStock = "https://example.com/low-stock"
+		test.Config.Inventory.LowStockThreshold = 3
+		require.NoError(t, test.DB.Save(&models.Stock{Sku: "123-i-can-fly-456", Quantity: 10}).Error)
+
+		payFirstOrder(t, test)
+
+		hooks := []models.Hook{}
+		require.NoError(t, test.DB.Where("type = ?", "low_stock").Find(&hooks).Error)
+		assert.Empty(t, hooks)
+	})
+
+	t.Run("AlreadyLow", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Webhooks.LowStock = "https://example.com/low-stock"
+		test.Config.Inventory.LowStockThreshold = 3
+		require.NoError(t, test.DB.Save(&models.Stock{Sku: "123-i-can-fly-456", Quantity: 3}).Error)
+
+		payFirstOrder(t, test)
+
+		hooks := []models.Hook{}
+		require.NoError(t, test.DB.Where("type = ?", "low_stock").Find(&hooks).Error)
+		assert.Empty(t, hooks)
+	})
+
+	t.Run("Untracked", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Webhooks.LowStock = "https://example.com/low-stock"
+		payFirstOrder(t, test)
+
+		count := 0
+		require.NoError(t, test.DB.Model(&models.Stock{}).Count(&count).Error)
+		assert.Zero(t, count)
+	})
+}
+
+func TestPreorder(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+
+	t.Run("OutOfStock", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		require.NoError(t, test.DB.Save(&models.Stock{Sku: "product-1", Quantity: 0}).Error)
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(defaultPayload), test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "Not enough stock")
+	})
+
+	t.Run("Backordered", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.Webhooks.Restocked = "https://example.com/restocked"
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+		recorder := test.TestEndpoint(http.MethodPut, "/inventory/product-1", strings.NewReader(`{"quantity": 0, "preorder": true, "available_at": "2030-01-02T00:00:00Z"}`), token)
+		stock := &models.Stock{}
+		extractPayload(t, http.StatusOK, recorder, stock)
+		assert.True(t, stock.Preorder)
+		require.NotNil(t, stock.AvailableAt)
+
+		recorder = test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(defaultPayload), test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Equal(t, models.BackorderedState, order.FulfillmentState)
+		require.Len(t, order.LineItems, 1)
+		assert.True(t, order.LineItems[0].Backordered)
+		require.NotNil(t, order.LineItems[0].AvailableAt)
+		assert.Equal(t, 2030, order.LineItems[0].AvailableAt.Year())
+
+		recorder = test.TestEndpoint(http.MethodPut, "/inventory/product-1", strings.NewReader(`{"quantity": 10}`), token)
+		extractPayload(t, http.StatusOK, recorder, stock)
+		assert.True(t, stock.Preorder)
+
+		hooks := []models.Hook{}
+		require.NoError(t, test.DB.Where("type = ?", "restocked").Find(&hooks).Error)
+		require.Len(t, hooks, 1)
+		payload := &restockedPayload{}
+		require.NoError(t, json.Unmarshal([]byte(hooks[0].Payload), payload))
+		assert.Equal(t, "product-1", payload.Sku)
+		assert.EqualValues(t, 10, payload.Quantity)
+		assert.Equal(t, []string{order.ID}, payload.OrderIDs)
+
+		// restocking again doesn't fire the webhook
+		recorder = test.TestEndpoint(http.MethodPut, "/inventory/product-1", strings.NewReader(`{"quantity": 20}`), token)
+		extractPayload(t, http.StatusOK, recorder, stock)
+		require.NoError(t, test.DB.Where("type = ?", "restocked").Find(&hooks).Error)
+		assert.Len(t, hooks, 1)
+	})
+}
+
+func TestStockReservation(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+
+	setup := func(t *testing.T, quantity int64) *RouteTest {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.Inventory.ReservationTTL = 15
+		require.NoError(t, test.DB.Save(&models.Stock{Sku: "product-1", Quantity: quantity}).Error)
+		return test
+	}
+	createOrder := func(t *testing.T, test *RouteTest) *models.Order {
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(defaultPayload), test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		return order
+	}
+	stockOf := func(t *testing.T, test *RouteTest) int64 {
+		stock := &models.Stock{}
+		require.NoError(t, test.DB.First(stock, "sku = ?", "product-1").Error)
+		return stock.Quantity
+	}
+	reservationsOf := func(t *testing.T, test *RouteTest, orderID string) []models.Reservation {
+		reservations := []models.Reservation{}
+		require.NoError(t, test.DB.Where("order_id = ?", orderID).Find(&reservations).Error)
+		return reservations
+	}
+
+	t.Run("Reserved", func(t *testing.T) {
+		test := setup(t, 1)
+		order := createOrder(t, test)
+		assert.EqualValues(t, 0, stockOf(t, test))
+
+		reservations := reservationsOf(t, test, order.ID)
+		require.Len(t, reservations, 1)
+		assert.Equal(t, "product-1", reservations[0].Sku)
+		assert.EqualValues(t, 1, reservations[0].Quantity)
+		assert.WithinDuration(t, time.Now().Add(15*time.Minute), reservations[0].ExpiresAt, time.Minute)
+
+		// the reserved item can't be bought by anyone else
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(defaultPayload), test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "Not enough stock")
+	})
+
+	t.Run("Paid", func(t *testing.T) {
+		test := setup(t, 5)
+		order := createOrder(t, test)
+		payOrder(t, test, order.ID, order.Total)
+
+		assert.EqualValues(t, 4, stockOf(t, test))
+		assert.Empty(t, reservationsOf(t, test, order.ID))
+		stored := &models.Order{}
+		require.NoError(t, test.DB.First(stored, "id = ?", order.ID).Error)
+		assert.True(t, stored.StockHeld)
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		test := setup(t, 5)
+		order := createOrder(t, test)
+		require.NoError(t, test.DB.Model(&models.Reservation{}).Where("order_id = ?", order.ID).
+			UpdateColumn("expires_at", time.Now().Add(-time.Minute)).Error)
+
+		released, err := models.ExpireReservations(test.DB, "", logrus.StandardLogger())
+		require.NoError(t, err)
+		assert.Equal(t, 1, released)
+		assert.EqualValues(t, 5, stockOf(t, test))
+
+		// the order can still be paid, taking the stock at payment
+		payOrder(t, test, order.ID, order.Total)
+		assert.EqualValues(t, 4, stockOf(t, test))
+	})
+
+	t.Run("ExpiredWhileBeingPaid", func(t *testing.T) {
+		test := setup(t, 5)
+		authorized := createOrder(t, test)
+		require.NoError(t, test.DB.Model(&models.Order{}).Where("id = ?", authorized.ID).
+			UpdateColumn("payment_state", models.AuthorizedState).Error)
+		pending := createOrder(t, test)
+		pendingCharge := &models.Transaction{
+			ID:      "pending-charge",
+			OrderID: pending.ID,
+			Type:    models.ChargeTransactionType,
+			Status:  models.PendingState,
+		}
+		require.NoError(t, test.DB.Create(pendingCharge).Error)
+		require.NoError(t, test.DB.Model(&models.Reservation{}).Where("order_id IN (?)", []string{authorized.ID, pending.ID}).
+			UpdateColumn("expires_at", time.Now().Add(-time.Minute)).Error)
+
+		released, err := models.ExpireReservations(test.DB, "", logrus.StandardLogger())
+		require.NoError(t, err)
+		assert.Equal(t, 0, released)
+		assert.EqualValues(t, 3, stockOf(t, test))
+		assert.Len(t, reservationsOf(t, test, authorized.ID), 1)
+		assert.Len(t, reservationsOf(t, test, pending.ID), 1)
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		test := setup(t, 5)
+		order := createOrder(t, test)
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/"+order.ID+"/cancel", nil, test.Data.testUserToken)
+		extractPayload(t, http.StatusOK, recorder, &models.Order{})
+		assert.EqualValues(t, 5, stockOf(t, test))
+		assert.Empty(t, reservationsOf(t, test, order.ID))
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		test := setup(t, 5)
+		test.Config.Inventory.ReservationTTL = 0
+		order := createOrder(t, test)
+		assert.EqualValues(t, 5, stockOf(t, test))
+		assert.Empty(t, reservationsOf(t, test, order.ID))
+	})
+}
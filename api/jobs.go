@@ -0,0 +1,115 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/conf"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/mailer"
+	"github.com/netlify/gocommerce/models"
+	"github.com/sirupsen/logrus"
+)
+
+type mailJobPayload struct {
+	TransactionID string `json:"transaction_id"`
+}
+
+// enqueueMails enqueues jobs sending mails about the transaction. Failures are
+// logged, since they shouldn't undo the payment the mails are about.
+func enqueueMails(tx *gorm.DB, log logrus.FieldLogger, tr *models.Transaction, jobTypes ...string) {
+	for _, jobType := range jobTypes {
+		job, err := models.NewJob(jobType, tr.InstanceID, &mailJobPayload{TransactionID: tr.ID})
+		if err == nil {
+			err = models.Queue.Enqueue(tx, job)
+		}
+		if err != nil {
+			log.WithError(err).Errorf("Error enqueueing %s job", jobType)
+		}
+	}
+}
+
+// enqueueOrderConfirmation enqueues the mails confirming the order to the
+// customer and notifying the shop about it.
+func enqueueOrderConfirmation(tx *gorm.DB, log logrus.FieldLogger, tr *models.Transaction) {
+	enqueueMails(tx, log, tr, models.OrderConfirmationMailJob, models.OrderReceivedMailJob)
+}
+
+// JobHandlers returns the handlers of the jobs the API enqueues. Mails are
+// sent with the given configuration, or with the configuration of the job's
+// instance if it's nil.
+func (a *API) JobHandlers(config *conf.Configuration) map[string]models.JobHandler {
+	sendMail := func(send func(mailer.Mailer, *models.Transaction) error) models.JobHandler {
+		return func(db *gorm.DB, job *models.Job, log *logrus.Entry) error {
+			payload := &mailJobPayload{}
+			if err := job.Decode(payload); err != nil {
+				return err
+			}
+
+			instanceConfig := config
+			if instanceConfig == nil {
+				instance, err := models.GetInstance(db, job.InstanceID)
+				if err != nil {
+					return err
+				}
+				if instanceConfig, err = instance.Config(); err != nil {
+					return err
+				}
+			}
+
+			tr := &models.Transaction{}
+			if rsp := db.First(tr, "id = ?", payload.TransactionID); rsp.Error != nil {
+				return rsp.Error
+			}
+			order := &models.Order{}
+			if rsp := orderQuery(db).First(order, "id = ?", tr.OrderID); rsp.Error != nil {
+				return rsp.Error
+			}
+			tr.Order = order
+			m, err := mailer.NewMailer(a.config.SMTP, instanceConfig)
+			if err != nil {
+				return err
+			}
+			return send(m, tr)
+		}
+	}
+
+	return map[string]models.JobHandler{
+		models.OrderConfirmationMailJob: sendMail(mailer.Mailer.OrderConfirmationMail),
+		models.OrderReceivedMailJob:     sendMail(mailer.Mailer.OrderReceivedMail),
+	}
+}
+
+// JobList lists the background jobs, newest first. They can be filtered by
+// type and by status, which is one of pending, done and failed.
+func (a *API) JobList(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+
+	query := a.ReadDB(r).Where("instance_id = ?", instanceID)
+	params := r.URL.Query()
+	if jobType := params.Get("type"); jobType != "" {
+		query = query.Where("type = ?", jobType)
+	}
+	switch status := params.Get("status"); status {
+	case "":
+	case "pending":
+		query = query.Where("done = ?", false)
+	case "done":
+		query = query.Where("done = ? AND failed = ?", true, false)
+	case "failed":
+		query = query.Where("failed = ?", true)
+	default:
+		return badRequestError("Unknown job status '%s', choose from pending, done or failed", status)
+	}
+
+	offset, limit, err := paginate(w, r, query.Model(&models.Job{}))
+	if err != nil {
+		return badRequestError("Bad Pagination Parameters: %v", err)
+	}
+
+	jobs := []models.Job{}
+	if rsp := query.Order("created_at desc, id desc").Offset(offset).Limit(limit).Find(&jobs); rsp.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, jobs)
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestJobs(t *testing.T) {
+	log := logrus.NewEntry(logrus.StandardLogger())
+
+	t.Run("ConfirmationMail", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/resend_confirmation", nil, test.Data.testUserToken)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/jobs?status=pending&type="+models.OrderConfirmationMailJob, nil, token)
+		jobs := []models.Job{}
+		extractPayload(t, http.StatusOK, recorder, &jobs)
+		require.Len(t, jobs, 1)
+
+		job := &jobs[0]
+		handlers := NewAPI(test.GlobalConfig, logrus.StandardLogger(), test.DB).JobHandlers(test.Config)
+		require.NoError(t, job.Run(test.DB, handlers, log))
+
+		saved := &models.Job{}
+		require.NoError(t, test.DB.First(saved, job.ID).Error)
+		assert.True(t, saved.Done)
+		assert.False(t, saved.Failed)
+		assert.Equal(t, 1, saved.Attempts)
+		assert.NotNil(t, saved.CompletedAt)
+	})
+
+	t.Run("Retry", func(t *testing.T) {
+		test := NewRouteTest(t)
+		job, err := models.NewJob("flaky", "", map[string]string{})
+		require.NoError(t, err)
+		require.NoError(t, test.DB.Create(job).Error)
+
+		handlers := map[string]models.JobHandler{
+			"flaky": func(db *gorm.DB, job *models.Job, log *logrus.Entry) error {
+				return errors.New("not yet")
+			},
+		}
+		require.Error(t, job.Run(test.DB, handlers, log))
+		assert.False(t, job.Done)
+		require.NotNil(t, job.RunAfter)
+		require.NotNil(t, job.LastError)
+		assert.Equal(t, "not yet", *job.LastError)
+
+		job.Attempts = job.MaxAttempts - 1
+		require.Error(t, job.Run(test.DB, handlers, log))
+
+		recorder := test.TestEndpoint(http.MethodGet, "/jobs?status=failed", nil, testAdminToken("admin-yo", "admin@wayneindustries.com"))
+		jobs := []models.Job{}
+		extractPayload(t, http.StatusOK, recorder, &jobs)
+		require.Len(t, jobs, 1)
+		assert.Equal(t, job.ID, jobs[0].ID)
+		assert.True(t, jobs[0].Done)
+	})
+
+	t.Run("Webhook", func(t *testing.T) {
+		test := NewRouteTest(t)
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+		}))
+		defer server.Close()
+
+		hook, err := models.NewHook("order", test.Config, server.URL, "", test.Data.firstOrder)
+		require.NoError(t, err)
+		require.NoError(t, test.DB.Create(hook).Error)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/jobs?type="+models.WebhookJob, nil, testAdminToken("admin-yo", "admin@wayneindustries.com"))
+		jobs := []models.Job{}
+		extractPayload(t, http.StatusOK, recorder, &jobs)
+		require.Len(t, jobs, 1)
+
+		other, err := models.NewHook("order", test.Config, server.URL, "", test.Data.firstOrder)
+		require.NoError(t, err)
+		other.InstanceID = "other-instance"
+		require.NoError(t, test.DB.Create(other).Error)
+		otherJob := &models.Job{}
+		require.NoError(t, test.DB.Where("type = ? AND instance_id = ?", models.WebhookJob, "other-instance").First(otherJob).Error)
+		require.NoError(t, test.DB.Delete(other).Error)
+		require.NoError(t, test.DB.Delete(otherJob).Error)
+
+		job := &models.Job{}
+		require.NoError(t, test.DB.Where("type = ?", models.WebhookJob).First(job).Error)
+		handlers := map[string]models.JobHandler{models.WebhookJob: models.DeliverHookJob(&http.Client{})}
+		require.NoError(t, job.Run(test.DB, handlers, log))
+		assert.Equal(t, 1, calls)
+
+		saved := &models.Hook{}
+		require.NoError(t, test.DB.First(saved, hook.ID).Error)
+		assert.True(t, saved.Done)
+
+		// delivered hooks aren't sent again
+		require.NoError(t, models.EnqueuePendingHooks(test.DB))
+		var pending int64
+		require.NoError(t, test.DB.Model(&models.Job{}).Where("done = ?", false).Count(&pending).Error)
+		assert.EqualValues(t, 0, pending)
+	})
+
+	t.Run("UnknownStatus", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/jobs?status=stuck", nil, testAdminToken("admin-yo", "admin@wayneindustries.com"))
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+}
@@ -0,0 +1,228 @@
+package api
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/netlify/gocommerce/conf"
+	"github.com/pkg/errors"
+)
+
+const (
+	// jwksMaxAge is how long fetched keys are used before fetching them again
+	jwksMaxAge = 10 * time.Minute
+	// jwksMinRefresh limits how often tokens with unknown key IDs can trigger a fetch
+	jwksMinRefresh = 30 * time.Second
+	// jwksFetchTimeout bounds how long requests wait for the JWKS endpoint
+	jwksFetchTimeout = 10 * time.Second
+)
+
+var jwksCaches = struct {
+	sync.Mutex
+	sets map[string]*jwksCache
+}{sets: make(map[string]*jwksCache)}
+
+// pemKeys holds the parsed public keys by their PEM encoding, so a configured
+// key is only parsed once.
+var pemKeys = struct {
+	sync.Mutex
+	keys map[string]*pemKey
+}{keys: make(map[string]*pemKey)}
+
+type pemKey struct {
+	key *rsa.PublicKey
+	err error
+}
+
+type jwksCache struct {
+	sync.Mutex
+	url       string
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+	inflight  *jwksFetch
+}
+
+// jwksFetch is a fetch of the keys in progress, which concurrent requests
+// wait for instead of fetching the keys themselves.
+type jwksFetch struct {
+	done chan struct{}
+	err  error
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// jwtKeyFunc returns the signing methods and key lookup used to verify tokens
+// for the configured JWT method.
+func jwtKeyFunc(config *conf.JWTConfiguration, client *http.Client) ([]string, jwt.Keyfunc) {
+	if config.Method != jwt.SigningMethodRS256.Name {
+		return []string{jwt.SigningMethodHS256.Name}, func(token *jwt.Token) (interface{}, error) {
+			return []byte(config.Secret), nil
+		}
+	}
+
+	if config.JWKSURL != "" {
+		cache := getJWKSCache(config.JWKSURL)
+		return []string{jwt.SigningMethodRS256.Name}, func(token *jwt.Token) (interface{}, error) {
+			kid, _ := token.Header["kid"].(string)
+			return cache.key(client, kid)
+		}
+	}
+
+	return []string{jwt.SigningMethodRS256.Name}, func(token *jwt.Token) (interface{}, error) {
+		return parsePEMKey(config.PublicKey)
+	}
+}
+
+func parsePEMKey(data string) (*rsa.PublicKey, error) {
+	pemKeys.Lock()
+	defer pemKeys.Unlock()
+
+	parsed, ok := pemKeys.keys[data]
+	if !ok {
+		key, err := jwt.ParseRSAPublicKeyFromPEM([]byte(data))
+		parsed = &pemKey{key: key, err: err}
+		pemKeys.keys[data] = parsed
+	}
+	return parsed.key, parsed.err
+}
+
+func getJWKSCache(url string) *jwksCache {
+	jwksCaches.Lock()
+	defer jwksCaches.Unlock()
+
+	cache, ok := jwksCaches.sets[url]
+	if !ok {
+		cache = &jwksCache{url: url}
+		jwksCaches.sets[url] = cache
+	}
+	return cache
+}
+
+// key looks up a key by its ID. Keys are fetched again once they expire, or
+// when an unknown key ID shows up because the keys have been rotated. Expired
+// keys are still used while they are fetched again in the background, so a
+// slow or unavailable JWKS endpoint only delays tokens with unknown key IDs.
+func (c *jwksCache) key(client *http.Client, kid string) (*rsa.PublicKey, error) {
+	c.Lock()
+	key, ok := c.keys[kid]
+	fetched := c.keys != nil
+	age := time.Since(c.fetchedAt)
+	c.Unlock()
+
+	if ok {
+		if age >= jwksMaxAge {
+			go c.refresh(client, false)
+		}
+		return key, nil
+	}
+	if !fetched || age >= jwksMinRefresh {
+		if err := c.refresh(client, true); err != nil {
+			return nil, err
+		}
+		c.Lock()
+		key, ok = c.keys[kid]
+		c.Unlock()
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("Unknown key ID: %s", kid)
+	}
+	return key, nil
+}
+
+// refresh fetches the keys without holding the lock, so a slow JWKS endpoint
+// doesn't block requests with cached keys. Only one fetch runs at a time, and
+// with wait other callers wait for its result instead of returning right away.
+func (c *jwksCache) refresh(client *http.Client, wait bool) error {
+	c.Lock()
+	if f := c.inflight; f != nil {
+		c.Unlock()
+		if !wait {
+			return nil
+		}
+		<-f.done
+		return f.err
+	}
+	f := &jwksFetch{done: make(chan struct{})}
+	c.inflight = f
+	c.Unlock()
+
+	keys, err := fetchJWKS(client, c.url)
+
+	c.Lock()
+	if err == nil {
+		c.keys = keys
+		c.fetchedAt = time.Now()
+	}
+	c.inflight = nil
+	c.Unlock()
+
+	f.err = err
+	close(f.done)
+	return err
+}
+
+func fetchJWKS(client *http.Client, url string) (map[string]*rsa.PublicKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), jwksFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to fetch JWKS")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to fetch JWKS")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to fetch JWKS: status %d", resp.StatusCode)
+	}
+
+	set := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, errors.Wrap(err, "Failed to parse JWKS")
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Kty != "RSA" {
+			continue
+		}
+		key, err := jwk.rsaPublicKey()
+		if err != nil {
+			return nil, err
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+func (k *jsonWebKey) rsaPublicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid modulus for key %s", k.Kid)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid exponent for key %s", k.Kid)
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
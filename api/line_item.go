@@ -0,0 +1,71 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// lineItemView is a line item together with the state of its fulfillment,
+// the refunds made for it and the returns it's part of.
+type lineItemView struct {
+	*models.LineItem
+	FulfillmentState string                `json:"fulfillment_state"`
+	Refunds          []*models.Transaction `json:"refunds"`
+	Returns          []*models.Return      `json:"returns"`
+}
+
+// LineItemView returns a single line item of an order. The fulfillment state
+// is the one of the item's shipment, or the order's if it isn't shipped
+// separately.
+func (a *API) LineItemView(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	id := gcontext.GetOrderID(ctx)
+
+	itemID, err := strconv.ParseInt(chi.URLParam(r, "item_id"), 10, 64)
+	if err != nil {
+		return notFoundError("Line item not found")
+	}
+
+	order := &models.Order{}
+	if result := siteScope(ctx, orderQuery(a.ReadDB(r)), "").First(order, "id = ?", id); result.Error != nil {
+		if result.RecordNotFound() {
+			return notFoundError("Order not found")
+		}
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	if !canReadOrders(ctx) {
+		if httpErr := a.canAccessOrder(w, r, a.ReadDB(r), order); httpErr != nil {
+			return httpErr
+		}
+	}
+
+	item := order.LineItem(itemID)
+	if item == nil {
+		return notFoundError("Line item not found")
+	}
+
+	view := &lineItemView{LineItem: item, FulfillmentState: order.FulfillmentState, Refunds: []*models.Transaction{}}
+	for _, shipment := range order.Shipments {
+		if shipment.ID == item.ShipmentID {
+			view.FulfillmentState = shipment.FulfillmentState
+		}
+	}
+	for _, t := range order.Transactions {
+		if t.Type == models.RefundTransactionType && t.RefundComponent == models.LineItemRefundComponent && t.LineItemID == item.ID {
+			view.Refunds = append(view.Refunds, t)
+		}
+	}
+
+	returns := []*models.Return{}
+	query := a.ReadDB(r).Preload("Items").
+		Where("order_id = ? AND id IN (?)", order.ID, a.ReadDB(r).Table(models.ReturnItem{}.TableName()).Select("return_id").Where("line_item_id = ?", item.ID).QueryExpr())
+	if rsp := query.Order("created_at desc").Find(&returns); rsp.Error != nil {
+		return internalServerError("Error while querying for returns").WithInternalError(rsp.Error)
+	}
+	view.Returns = returns
+	return sendJSON(w, http.StatusOK, view)
+}
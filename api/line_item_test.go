@@ -0,0 +1,75 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestLineItemView(t *testing.T) {
+	itemURL := func(order *models.Order, itemID int64) string {
+		return fmt.Sprintf("/orders/%s/items/%d", order.ID, itemID)
+	}
+
+	t.Run("AsTheUser", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testToken(test.Data.testUser.ID, "marp@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodGet, itemURL(test.Data.firstOrder, test.Data.firstLineItem.ID), nil, token)
+
+		item := &lineItemView{}
+		extractPayload(t, http.StatusOK, recorder, item)
+		assert.Equal(t, test.Data.firstLineItem.ID, item.ID)
+		assert.Equal(t, test.Data.firstLineItem.Sku, item.Sku)
+		assert.Equal(t, test.Data.firstOrder.FulfillmentState, item.FulfillmentState)
+		assert.Empty(t, item.Refunds)
+	})
+
+	t.Run("WithRefund", func(t *testing.T) {
+		test := NewRouteTest(t)
+		refund := models.NewTransaction(test.Data.firstOrder)
+		refund.Type = models.RefundTransactionType
+		refund.RefundComponent = models.LineItemRefundComponent
+		refund.LineItemID = test.Data.firstLineItem.ID
+		refund.Amount = 12
+		refund.Status = models.PaidState
+		require.NoError(t, test.DB.Create(refund).Error)
+
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodGet, itemURL(test.Data.firstOrder, test.Data.firstLineItem.ID), nil, token)
+
+		item := &lineItemView{}
+		extractPayload(t, http.StatusOK, recorder, item)
+		require.Len(t, item.Refunds, 1)
+		assert.Equal(t, refund.ID, item.Refunds[0].ID)
+	})
+
+	t.Run("WithReturn", func(t *testing.T) {
+		test := NewRouteTest(t)
+		createReturn(test, models.ReturnRequestedState)
+		recorder := test.TestEndpoint(http.MethodGet, itemURL(test.Data.firstOrder, test.Data.firstLineItem.ID), nil, test.Data.testUserToken)
+
+		item := &lineItemView{}
+		extractPayload(t, http.StatusOK, recorder, item)
+		require.Len(t, item.Returns, 1)
+		assert.Equal(t, models.ReturnRequestedState, item.Returns[0].Status)
+	})
+
+	t.Run("AsAStranger", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testToken("stranger", "stranger-danger@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodGet, itemURL(test.Data.firstOrder, test.Data.firstLineItem.ID), nil, token)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+
+	t.Run("ItemOfOtherOrder", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodGet, itemURL(test.Data.firstOrder, test.Data.secondLineItem1.ID), nil, token)
+		validateError(t, http.StatusNotFound, recorder, "Line item not found")
+	})
+}
@@ -6,11 +6,13 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/netlify/gocommerce/assetstores"
 	"github.com/netlify/gocommerce/conf"
 	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/fraud"
 	"github.com/netlify/gocommerce/mailer"
 	"github.com/netlify/gocommerce/models"
 	"github.com/pkg/errors"
@@ -18,6 +20,7 @@ import (
 
 const (
 	jwsSignatureHeaderName = "x-nf-sign"
+	defaultMaxBodySize     = 1 << 20
 )
 
 type NetlifyMicroserviceClaims struct {
@@ -34,6 +37,9 @@ func addGetBody(w http.ResponseWriter, req *http.Request) (context.Context, erro
 
 	buf, err := ioutil.ReadAll(req.Body)
 	if err != nil {
+		if isBodyTooLarge(err) {
+			return nil, badRequestError("Request body too large")
+		}
 		return nil, internalServerError("Error reading body").WithInternalError(err)
 	}
 	req.GetBody = func() (io.ReadCloser, error) {
@@ -43,6 +49,65 @@ func addGetBody(w http.ResponseWriter, req *http.Request) (context.Context, erro
 	return req.Context(), nil
 }
 
+// limitBody caps the size of request bodies at the configured maximum.
+func (api *API) limitBody(w http.ResponseWriter, req *http.Request) (context.Context, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+
+	max := api.config.API.MaxBodySize
+	if max <= 0 {
+		max = defaultMaxBodySize
+	}
+	if req.ContentLength > max {
+		return nil, badRequestError("Request body too large")
+	}
+	req.Body = http.MaxBytesReader(w, req.Body, max)
+	return nil, nil
+}
+
+func isBodyTooLarge(err error) bool {
+	return err != nil && err.Error() == "http: request body too large"
+}
+
+// withTimeout gives the handlers until timeout to answer. Queries outside of
+// transactions fail once it passes and the request fails with a 504. Calls to
+// the payment providers and transactions aren't bound to the deadline, and
+// clients going away don't cancel the request, so payments that went through
+// are always recorded. A timeout of 0 disables the deadline.
+func (api *API) withTimeout(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if timeout <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(detachedContext{r.Context()}, timeout)
+			defer cancel()
+			if api.db != nil && gcontext.GetDB(ctx) != nil {
+				// routes overriding the timeout rebind the request databases
+				ctx = api.withRequestDB(ctx, getLogEntry(r))
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// detachedContext keeps the values of a request context, but isn't cancelled
+// when the client goes away.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
+
 func (api *API) verifyOperatorRequest(w http.ResponseWriter, req *http.Request) (context.Context, error) {
 	c, _, err := api.extractOperatorRequest(w, req)
 	return c, err
@@ -116,7 +181,10 @@ func WithInstanceConfig(ctx context.Context, smtp conf.SMTPConfiguration, config
 		return nil, err
 	}
 
-	mailer := mailer.NewMailer(smtp, config)
+	mailer, err := mailer.NewMailer(smtp, config)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error initializing mailer")
+	}
 	ctx = gcontext.WithMailer(ctx, mailer)
 
 	store, err := assetstores.NewStore(config)
@@ -133,6 +201,13 @@ func WithInstanceConfig(ctx context.Context, smtp conf.SMTPConfiguration, config
 		return nil, errors.New("No payment providers enabled")
 	}
 	ctx = gcontext.WithPaymentProviders(ctx, provs)
+	ctx = gcontext.WithCarriers(ctx, createCarriers(config))
+
+	checker, err := fraud.NewChecker(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error initializing fraud checker")
+	}
+	ctx = gcontext.WithFraudChecker(ctx, checker)
 
 	return ctx, nil
 }
@@ -1,10 +1,14 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/netlify/gocommerce/calculator"
 	"github.com/netlify/gocommerce/conf"
@@ -23,6 +27,7 @@ type MiddlewareTestSuite struct {
 func (ts *MiddlewareTestSuite) SetupTest() {
 	globalConfig, log, err := conf.LoadGlobal("test.env")
 	require.NoError(ts.T(), err)
+	globalConfig.DB.URL = testDBFile()
 	globalConfig.MultiInstanceMode = true
 	db, err := models.Connect(globalConfig, log)
 	require.NoError(ts.T(), err)
@@ -107,3 +112,78 @@ func (ts *MiddlewareTestSuite) TestWithInstanceConfig_NoPaymentProviders() {
 func TestMiddleware(t *testing.T) {
 	suite.Run(t, new(MiddlewareTestSuite))
 }
+
+func TestRequestBodyLimits(t *testing.T) {
+	t.Run("UnknownField", func(t *testing.T) {
+		test := NewRouteTest(t)
+		body := strings.NewReader(`{"email": "info@example.com", "surprise": true}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "unknown field")
+	})
+
+	t.Run("TooLarge", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.GlobalConfig.API.MaxBodySize = 32
+		body := strings.NewReader(`{"email": "info@example.com", "currency": "USD", "line_items": []}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "too large")
+	})
+
+	t.Run("TooLargeWithoutLength", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.GlobalConfig.API.MaxBodySize = 32
+		body := ioutil.NopCloser(strings.NewReader(`{"email": "info@example.com", "currency": "USD", "line_items": []}`))
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "too large")
+	})
+}
+
+func TestRequestTimeout(t *testing.T) {
+	t.Run("Exceeded", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.GlobalConfig.API.RequestTimeout = time.Nanosecond
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodGet, "/orders", nil, token)
+		validateError(t, http.StatusGatewayTimeout, recorder, "timed out")
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.GlobalConfig.API.RequestTimeout = 0
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodGet, "/orders", nil, token)
+		require.Equal(t, http.StatusOK, recorder.Code)
+	})
+
+	t.Run("Override", func(t *testing.T) {
+		api := &API{}
+		var deadline time.Time
+		var err error
+		handler := api.withTimeout(time.Nanosecond)(api.withTimeout(time.Minute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			deadline, _ = r.Context().Deadline()
+			err = r.Context().Err()
+		})))
+
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/payments/1/refund", nil))
+		require.NoError(t, err)
+		require.True(t, time.Until(deadline) > 30*time.Second)
+	})
+
+	t.Run("Transactions", func(t *testing.T) {
+		test := NewRouteTest(t)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+		defer cancel()
+		<-ctx.Done()
+		db := models.WithContext(ctx, test.DB)
+
+		require.Error(t, db.First(&models.Order{}, "id = ?", "first-order").Error)
+
+		// work that started in a transaction is committed after the deadline
+		tx := db.Begin()
+		require.NoError(t, tx.Model(test.Data.firstOrder).UpdateColumn("email", "late@example.com").Error)
+		require.NoError(t, tx.Commit().Error)
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", "first-order").Error)
+		require.Equal(t, "late@example.com", order.Email)
+	})
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestMigrations(t *testing.T) {
+	test := NewRouteTest(t)
+	log := logrus.StandardLogger()
+
+	statuses, err := models.MigrationStatuses(test.DB)
+	require.NoError(t, err)
+	require.NotEmpty(t, statuses)
+	for _, status := range statuses {
+		assert.NotNil(t, status.AppliedAt, "migration %d is pending", status.Version)
+	}
+
+	// applied migrations aren't run again
+	require.NoError(t, models.Migrate(test.DB, log))
+
+	hook, err := models.NewHook("order", test.Config, "https://example.com/order", "", test.Data.firstOrder)
+	require.NoError(t, err)
+	require.NoError(t, test.DB.Create(hook).Error)
+	require.NoError(t, test.DB.Model(hook).UpdateColumn("schema_version", 0).Error)
+	// migration 3 pins the schema version of hooks
+	require.NoError(t, test.DB.Delete(&models.SchemaMigration{}, "version = ?", 3).Error)
+
+	require.NoError(t, models.Migrate(test.DB, log))
+	saved := &models.Hook{}
+	require.NoError(t, test.DB.First(saved, hook.ID).Error)
+	assert.Equal(t, models.HookSchemaV1, saved.SchemaVersion)
+
+	statuses, err = models.MigrationStatuses(test.DB)
+	require.NoError(t, err)
+	assert.NotNil(t, statuses[2].AppliedAt)
+
+	// migration 6 indexes the metadata of existing orders
+	order := test.Data.secondOrder
+	order.MetaData = map[string]interface{}{"gift": true, "channel": "phone", "items": []interface{}{"a"}}
+	require.NoError(t, test.DB.Save(order).Error)
+	require.NoError(t, test.DB.Delete(&models.SchemaMigration{}, "version = ?", 6).Error)
+
+	require.NoError(t, models.Migrate(test.DB, log))
+	data := []models.Data{}
+	require.NoError(t, test.DB.Where("order_id = ?", order.ID).Order("data_key").Find(&data).Error)
+	require.Len(t, data, 2)
+	assert.Equal(t, "channel", data[0].Key)
+	assert.Equal(t, "phone", data[0].StringValue)
+	assert.Equal(t, "gift", data[1].Key)
+	assert.True(t, data[1].BoolValue)
+}
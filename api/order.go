@@ -1,18 +1,28 @@
 package api
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/jinzhu/gorm"
 	"github.com/mattes/vat"
 	"github.com/netlify/gocommerce/calculator"
 	"github.com/netlify/gocommerce/claims"
+	"github.com/netlify/gocommerce/conf"
 	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/mailer"
 	"github.com/netlify/gocommerce/models"
 	"github.com/pborman/uuid"
 	"github.com/sirupsen/logrus"
@@ -21,18 +31,35 @@ import (
 // MaxConcurrentLookups controls the number of simultaneous HTTP Order lookups
 const MaxConcurrentLookups = 10
 
+// orderSourceHeader tells the source of new orders that don't set it
+const orderSourceHeader = "X-Order-Source"
+
+const maxGiftMessageLength = 500
+
+var orderSourceRegexp = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
 type orderLineItem struct {
 	Sku      string                 `json:"sku"`
 	Path     string                 `json:"path"`
 	Quantity uint64                 `json:"quantity"`
 	Addons   []orderAddon           `json:"addons"`
 	MetaData map[string]interface{} `json:"meta"`
+
+	// ShippingAddress ships the item to another address than the rest of the order
+	ShippingAddressID string          `json:"shipping_address_id"`
+	ShippingAddress   *models.Address `json:"shipping_address"`
 }
 
 type orderAddon struct {
 	Sku string `json:"sku"`
 }
 
+type lineItemDiscount struct {
+	LineItemID int64  `json:"line_item_id"`
+	Amount     uint64 `json:"amount"`
+	Reason     string `json:"reason"`
+}
+
 type orderRequestParams struct {
 	SessionID string `json:"session_id"`
 
@@ -40,6 +67,10 @@ type orderRequestParams struct {
 
 	IP string `json:"ip"`
 
+	// Source is the channel the order is placed through, e.g. "mobile" or
+	// "pos". It falls back to the X-Order-Source header and then to "web".
+	Source string `json:"source"`
+
 	ShippingAddressID string          `json:"shipping_address_id"`
 	ShippingAddress   *models.Address `json:"shipping_address"`
 
@@ -48,15 +79,57 @@ type orderRequestParams struct {
 
 	VATNumber string `json:"vatnumber"`
 
+	// Locale of the customer, e.g. "fr" or "fr-CA". Confirmation mails use
+	// the localized template and subject for it if there is one.
+	Locale string `json:"locale"`
+
 	MetaData map[string]interface{} `json:"meta"`
 
 	LineItems []*orderLineItem `json:"line_items"`
 
 	Currency string `json:"currency"`
 
+	// Tip is added to the total of the order. It can only be changed until the order is paid.
+	Tip *uint64 `json:"tip"`
+
+	// GiftMessage is printed on the packing slip until the order ships.
+	// GiftWrap adds the gift wrap fee and can only be changed until the
+	// order is paid.
+	GiftMessage *string `json:"gift_message"`
+	GiftWrap    *bool   `json:"gift_wrap"`
+
+	// TaxExempt can only be changed by admins until the order is paid
+	TaxExempt       *bool  `json:"tax_exempt"`
+	TaxExemptReason string `json:"tax_exempt_reason"`
+
+	// ManualDiscount is taken off the order besides any coupons, and
+	// LineItemDiscounts off single line items. They can only be changed by
+	// admins until the order is paid.
+	ManualDiscount       *uint64             `json:"manual_discount"`
+	ManualDiscountReason string              `json:"manual_discount_reason"`
+	LineItemDiscounts    []*lineItemDiscount `json:"line_item_discounts"`
+
 	FulfillmentState string `json:"fulfillment_state"`
 
-	CouponCode string `json:"coupon"`
+	// PaymentState can only be used to reopen an abandoned order, and to
+	// approve (pending) or decline (failed) a payment held for review
+	PaymentState string `json:"payment_state"`
+
+	CouponCode string   `json:"coupon"`
+	Coupons    []string `json:"coupons"`
+
+	// Version is the version of the order the update is based on. It can
+	// also be provided with the If-Match header.
+	Version *uint64 `json:"version"`
+}
+
+// couponCodes returns all coupon codes requested, the single coupon first.
+func (p *orderRequestParams) couponCodes() []string {
+	codes := []string{}
+	if p.CouponCode != "" {
+		codes = append(codes, p.CouponCode)
+	}
+	return append(codes, p.Coupons...)
 }
 
 type receiptParams struct {
@@ -110,6 +183,7 @@ func (a *API) ClaimOrders(w http.ResponseWriter, r *http.Request) error {
 		UserID:     "",
 		Email:      claims.Email,
 	})
+	query = siteScope(ctx, query, "")
 
 	orders := []models.Order{}
 	if res := query.Find(&orders); res.Error != nil {
@@ -124,7 +198,7 @@ func (a *API) ClaimOrders(w http.ResponseWriter, r *http.Request) error {
 		ID:         claims.Subject,
 		Email:      claims.Email,
 	}
-	if res := tx.FirstOrCreate(&user); res.Error != nil {
+	if res := tx.Attrs(models.User{SiteID: gcontext.GetSiteID(ctx)}).FirstOrCreate(&user); res.Error != nil {
 		tx.Rollback()
 		return internalServerError("Failed to create user with ID %s", claims.Subject).WithInternalError(res.Error).WithInternalMessage("Failed to create new user: %+v", user)
 	}
@@ -149,6 +223,142 @@ func (a *API) ClaimOrders(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+// ClaimOrder associates a single anonymous order with the authenticated user
+// if the order was placed with the email in the token
+func (a *API) ClaimOrder(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	db := a.DB(r)
+	log := getLogEntry(r)
+	instanceID := gcontext.GetInstanceID(ctx)
+	id := gcontext.GetOrderID(ctx)
+
+	claims := gcontext.GetClaims(ctx)
+	if claims.Email == "" {
+		return badRequestError("Must provide an email in the token to claim an order")
+	}
+	if claims.Subject == "" {
+		return badRequestError("Must provide a ID in the token to claim an order")
+	}
+
+	log = log.WithFields(logrus.Fields{
+		"user_id":    claims.Subject,
+		"user_email": claims.Email,
+	})
+
+	order := &models.Order{}
+	if rsp := siteScope(ctx, orderQuery(db), "").Where("instance_id = ?", instanceID).First(order, "id = ?", id); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return notFoundError("Order not found")
+		}
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+
+	if order.UserID == claims.Subject {
+		return sendJSON(w, http.StatusOK, order)
+	}
+	if order.UserID != "" {
+		return conflictError("Order already belongs to another user")
+	}
+	// the magic link proves access to the order email
+	tokenID, hasToken := orderToken(r, db, order)
+	if !strings.EqualFold(order.Email, claims.Email) && !hasToken {
+		return unauthorizedError("The order email doesn't match the email in the token")
+	}
+
+	tx := db.Begin()
+
+	user := models.User{
+		InstanceID: instanceID,
+		ID:         claims.Subject,
+		Email:      claims.Email,
+	}
+	if rsp := tx.Attrs(models.User{SiteID: gcontext.GetSiteID(ctx)}).FirstOrCreate(&user); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Failed to create user with ID %s", claims.Subject).WithInternalError(rsp.Error).WithInternalMessage("Failed to create new user: %+v", user)
+	}
+
+	// only claim the order if nobody else did since we loaded it
+	rsp := tx.Model(order).Where("user_id = ? OR user_id IS NULL", "").UpdateColumn("user_id", user.ID)
+	if rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Failed to update the order with user ID %s", user.ID).WithInternalError(rsp.Error)
+	}
+	if rsp.RowsAffected == 0 {
+		tx.Rollback()
+		return conflictError("Order already belongs to another user")
+	}
+	if hasToken && tokenID != "" {
+		if rsp := tx.Create(&models.UsedOrderToken{ID: tokenID, OrderID: order.ID}); rsp.Error != nil {
+			tx.Rollback()
+			return internalServerError("Failed to mark the magic link as used").WithInternalError(rsp.Error)
+		}
+	}
+
+	for _, addressID := range []string{order.BillingAddressID, order.ShippingAddressID} {
+		if addressID == "" {
+			continue
+		}
+		if rsp := tx.Model(&models.Address{}).Where("id = ? AND user_id = ?", addressID, "").UpdateColumn("user_id", user.ID); rsp.Error != nil {
+			tx.Rollback()
+			return internalServerError("Failed to update the order addresses with user ID %s", user.ID).WithInternalError(rsp.Error)
+		}
+	}
+
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Failed to claim the order").WithInternalError(rsp.Error)
+	}
+
+	order.BillingAddress.UserID = user.ID
+	order.ShippingAddress.UserID = user.ID
+	log.Infof("Claimed order %s", order.ID)
+	return sendJSON(w, http.StatusOK, order)
+}
+
+// mergeSessionOrders claims the anonymous orders that were placed in the same
+// session as the order for its user. Like ClaimOrders it only claims orders
+// placed with the email of the user, since anybody can send the session ID.
+// Orders that were paid or belong to another user are left alone.
+func mergeSessionOrders(r *http.Request, tx *gorm.DB, order *models.Order) error {
+	claims := gcontext.GetClaims(r.Context())
+	if order.UserID == "" || order.SessionID == "" || claims == nil || claims.Email == "" {
+		return nil
+	}
+
+	query := tx.Where("instance_id = ? AND session_id = ? AND id <> ?", order.InstanceID, order.SessionID, order.ID).
+		Where("email = ?", claims.Email).
+		Where("user_id = ? OR user_id IS NULL", "").
+		Where("payment_state IN (?)", []string{models.PendingState, models.FailedState, models.AbandonedState})
+	query = siteScope(r.Context(), query, "")
+
+	orders := []models.Order{}
+	if rsp := query.Find(&orders); rsp.Error != nil {
+		return rsp.Error
+	}
+
+	log := getLogEntry(r)
+	for _, o := range orders {
+		// only claim the order if nobody else did since we loaded it
+		rsp := tx.Model(&o).Where("user_id = ? OR user_id IS NULL", "").UpdateColumn("user_id", order.UserID)
+		if rsp.Error != nil {
+			return rsp.Error
+		}
+		if rsp.RowsAffected == 0 {
+			continue
+		}
+
+		for _, addressID := range []string{o.BillingAddressID, o.ShippingAddressID} {
+			if addressID == "" {
+				continue
+			}
+			if rsp := tx.Model(&models.Address{}).Where("id = ? AND user_id = ?", addressID, "").UpdateColumn("user_id", order.UserID); rsp.Error != nil {
+				return rsp.Error
+			}
+		}
+		log.WithField("merged_order_id", o.ID).Info("Merged order of the session")
+	}
+	return nil
+}
+
 // ReceiptView renders an HTML receipt for an order
 func (a *API) ReceiptView(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
@@ -156,15 +366,17 @@ func (a *API) ReceiptView(w http.ResponseWriter, r *http.Request) error {
 	logEntrySetField(r, "order_id", id)
 
 	order := &models.Order{}
-	if result := orderQuery(a.DB(r)).Preload("Transactions").First(order, "id = ?", id); result.Error != nil {
+	if result := siteScope(ctx, orderQuery(a.DB(r)), "").Preload("Transactions").First(order, "id = ?", id); result.Error != nil {
 		if result.RecordNotFound() {
 			return notFoundError("Order not found")
 		}
 		return internalServerError("Error during database query").WithInternalError(result.Error)
 	}
 
-	if !hasOrderAccess(ctx, order) {
-		return unauthorizedError("Order History Requires Authentication")
+	if !canReadOrders(ctx) {
+		if httpErr := a.canAccessOrder(w, r, a.DB(r), order); httpErr != nil {
+			return httpErr
+		}
 	}
 	template := r.URL.Query().Get("template")
 
@@ -186,29 +398,32 @@ func (a *API) ReceiptView(w http.ResponseWriter, r *http.Request) error {
 	return notFoundError("Receipt not found")
 }
 
-// ResendOrderReceipt resends the email receipt for an order
+// ResendOrderReceipt resends the email receipt for an order. It's limited
+// like ResendConfirmation.
 func (a *API) ResendOrderReceipt(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	id := gcontext.GetOrderID(ctx)
 	log := getLogEntry(r)
 
 	params := &receiptParams{}
-	jsonDecoder := json.NewDecoder(r.Body)
-	err := jsonDecoder.Decode(params)
+	err := decodeJSON(r, params)
 	if err != nil {
 		return badRequestError("Could not read receipt params: %v", err)
 	}
 
 	order := &models.Order{}
-	if result := orderQuery(a.DB(r)).Preload("Transactions").First(order, "id = ?", id); result.Error != nil {
+	if result := siteScope(ctx, orderQuery(a.DB(r)), "").Preload("Transactions").First(order, "id = ?", id); result.Error != nil {
 		if result.RecordNotFound() {
 			return notFoundError("Order not found")
 		}
 		return internalServerError("Error during database query").WithInternalError(result.Error)
 	}
 
-	if !hasOrderAccess(ctx, order) {
-		return unauthorizedError("Order History Requires Authentication")
+	if httpErr := a.canAccessOrder(w, r, a.DB(r), order); httpErr != nil {
+		return httpErr
+	}
+	if httpErr := claimConfirmationResend(w, r, a.DB(r), order); httpErr != nil {
+		return httpErr
 	}
 
 	if params.Email != "" {
@@ -228,6 +443,77 @@ func (a *API) ResendOrderReceipt(w http.ResponseWriter, r *http.Request) error {
 	return sendJSON(w, http.StatusOK, map[string]string{})
 }
 
+// resendConfirmationInterval is how long to wait before the confirmation of
+// an order can be sent again.
+const resendConfirmationInterval = 10 * time.Minute
+
+// claimConfirmationResend records that the confirmation of an order is sent
+// again, unless it was within resendConfirmationInterval. The update is
+// conditional, so only one of concurrent requests can send it.
+func claimConfirmationResend(w http.ResponseWriter, r *http.Request, db *gorm.DB, order *models.Order) *HTTPError {
+	now := time.Now()
+	since := now.Add(-resendConfirmationInterval)
+	rsp := db.Model(&models.Order{}).
+		Where("id = ? AND (confirmation_resent_at IS NULL OR confirmation_resent_at <= ?)", order.ID, since).
+		UpdateColumn("confirmation_resent_at", now)
+	if rsp.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	if rsp.RowsAffected == 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(resendConfirmationInterval.Seconds())))
+		return tooManyRequestsError("The confirmation of this order was sent recently, please try again later")
+	}
+	order.ConfirmationResentAt = &now
+
+	claims := gcontext.GetClaims(r.Context())
+	userID := ""
+	if claims != nil {
+		userID = claims.Subject
+	}
+	models.LogEvent(db, r.RemoteAddr, userID, order.ID, models.EventConfirmationResent, nil)
+	return nil
+}
+
+// ResendConfirmation sends the confirmation mail for the latest successful
+// payment of the order again. It can only be used once per order every
+// resendConfirmationInterval, shared with ResendOrderReceipt.
+func (a *API) ResendConfirmation(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	id := gcontext.GetOrderID(ctx)
+	log := getLogEntry(r)
+	db := a.DB(r)
+
+	order := &models.Order{}
+	if result := siteScope(ctx, orderQuery(db), "").First(order, "id = ?", id); result.Error != nil {
+		if result.RecordNotFound() {
+			return notFoundError("Order not found")
+		}
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	if httpErr := a.canAccessOrder(w, r, db, order); httpErr != nil {
+		return httpErr
+	}
+
+	var transaction *models.Transaction
+	for _, tr := range order.Transactions {
+		if tr.Type == models.ChargeTransactionType && tr.Status == models.PaidState &&
+			(transaction == nil || tr.CreatedAt.After(transaction.CreatedAt)) {
+			transaction = tr
+		}
+	}
+	if transaction == nil {
+		return badRequestError("This order has no successful payment to confirm")
+	}
+
+	if httpErr := claimConfirmationResend(w, r, db, order); httpErr != nil {
+		return httpErr
+	}
+
+	enqueueMails(db, log, transaction, models.OrderConfirmationMailJob)
+
+	return sendJSON(w, http.StatusOK, map[string]string{})
+}
+
 // OrderList can query based on
 //  - orders since        &from=iso8601      - default = 0
 //  - orders before       &to=iso8601        - default = now
@@ -238,6 +524,12 @@ func (a *API) ResendOrderReceipt(w http.ResponseWriter, r *http.Request) error {
 //  - type=book  - filter on product type
 //  - email
 //  - items
+//  - sku=ABC123,DEF456 - orders containing any of the SKUs, admins only
+//  - source=pos - orders placed through the channel
+// And you can shape the response with
+//  - fields=id,total   - only return these fields
+//  - expand=line_items - include these associations, which are left out
+//                        when fields or expand are given
 
 // OrderList lists orders selected by the query parameters provided.
 func (a *API) OrderList(w http.ResponseWriter, r *http.Request) error {
@@ -248,19 +540,38 @@ func (a *API) OrderList(w http.ResponseWriter, r *http.Request) error {
 
 	var err error
 	params := r.URL.Query()
-	query := orderQuery(a.DB(r))
+	if (params.Get("email") != "" || params.Get("name") != "") && !canReadOrders(ctx) {
+		return unauthorizedError("Searching orders by customer requires admin or staff access")
+	}
+	if params.Get("sku") != "" && !canReadOrders(ctx) {
+		return unauthorizedError("Searching orders by SKU requires admin or staff access")
+	}
+
+	shape, err := parseOrderShape(params)
+	if err != nil {
+		return badRequestError("Bad parameters in query: %v", err)
+	}
+	query := orderQuery(a.ReadDB(r))
+	if shape != nil {
+		query = shape.preload(a.ReadDB(r))
+	}
 	query, err = parseOrderParams(query, params)
 	if err != nil {
 		return badRequestError("Bad parameters in query: %v", err)
 	}
-	query = query.Where("instance_id = ?", instanceID)
+	orderTable := query.NewScope(models.Order{}).QuotedTableName()
+	query, err = addDataFilters(query, orderTable, params, gcontext.GetConfig(ctx).SearchableMeta)
+	if err != nil {
+		return badRequestError("Bad parameters in query: %v", err)
+	}
+	query = query.Where(orderTable+".instance_id = ?", instanceID)
+	query = siteScope(ctx, query, orderTable)
 
 	userID := gcontext.GetUserID(ctx)
 	if userID == "" {
 		userID = claims.Subject
 	}
 	if userID != "all" {
-		orderTable := query.NewScope(models.Order{}).QuotedTableName()
 		query = query.Where(orderTable+".user_id = ?", userID)
 	}
 	log.WithField("query_user_id", userID).Debug("URL parsed and query perpared")
@@ -277,59 +588,246 @@ func (a *API) OrderList(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	log.WithField("order_count", len(orders)).Debugf("Successfully retrieved %d orders", len(orders))
+	if shape != nil {
+		shaped := make([]map[string]json.RawMessage, len(orders))
+		for i := range orders {
+			if shaped[i], err = shape.apply(&orders[i]); err != nil {
+				return internalServerError("Error shaping orders").WithInternalError(err)
+			}
+		}
+		return sendJSON(w, http.StatusOK, shaped)
+	}
 	return sendJSON(w, http.StatusOK, orders)
 }
 
 // OrderView will request a specific order using the 'id' parameter.
-// Only the owner of the order, an admin, or an anon order are allowed to be seen
+// Only the owner of the order or an admin are allowed to see it. Anon orders
+// are returned with the token of a magic link, or when looked up with an
+// "?email=" that matches the order.
 func (a *API) OrderView(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	id := gcontext.GetOrderID(ctx)
 	log := getLogEntry(r)
 
 	order := &models.Order{}
-	if result := orderQuery(a.DB(r)).First(order, "id = ?", id); result.Error != nil {
+	if result := siteScope(ctx, orderQuery(a.ReadDB(r)), "").First(order, "id = ?", id); result.Error != nil {
 		if result.RecordNotFound() {
 			return notFoundError("Order not found")
 		}
 		return internalServerError("Error during database query").WithInternalError(result.Error)
 	}
 
-	if !hasOrderAccess(ctx, order) {
-		return unauthorizedError("You don't have access to this order")
+	if !canReadOrders(ctx) {
+		if httpErr := a.canAccessOrder(w, r, a.ReadDB(r), order); httpErr != nil {
+			return httpErr
+		}
 	}
 
 	log.Debugf("Successfully got order %s", order.ID)
+	if notModified(w, r, orderETag(order)) {
+		return sendNotModified(w)
+	}
 	return sendJSON(w, http.StatusOK, order)
 }
 
-// OrderCreate endpoint
-func (a *API) OrderCreate(w http.ResponseWriter, r *http.Request) error {
+// orderETag identifies the response body of an order. It starts with the
+// version of the order, which updates take in If-Match, and includes a hash of
+// the serialized order since payments, shipments and notes change the response
+// without a new version.
+func orderETag(order *models.Order) string {
+	body, err := json.Marshal(order)
+	if err != nil {
+		// the response fails to encode as well
+		return fmt.Sprintf(`"%d"`, order.Version)
+	}
+	sum := sha256.Sum256(body)
+	return fmt.Sprintf(`"%d-%s"`, order.Version, hex.EncodeToString(sum[:16]))
+}
+
+// OrderByNumber returns the order with a number, like OrderView. Order
+// numbers are sequential, so anonymous orders are only returned to admins,
+// with the token of a magic link or with the email of the order, and orders
+// without access are reported as not found.
+func (a *API) OrderByNumber(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
-	config := gcontext.GetConfig(ctx)
+	number := chi.URLParam(r, "number")
 	instanceID := gcontext.GetInstanceID(ctx)
 
-	params := &orderRequestParams{Currency: "USD"}
-	jsonDecoder := json.NewDecoder(r.Body)
-	err := jsonDecoder.Decode(params)
+	order := &models.Order{}
+	query := siteScope(ctx, orderQuery(a.ReadDB(r)), "").Where("instance_id = ?", instanceID)
+	if result := query.First(order, "number = ?", number); result.Error != nil {
+		if result.RecordNotFound() {
+			return notFoundError("Order not found")
+		}
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+
+	if !canReadOrders(ctx) {
+		if httpErr := a.canAccessOrder(w, r, a.ReadDB(r), order); httpErr != nil {
+			if httpErr.Code == http.StatusUnauthorized {
+				return notFoundError("Order not found")
+			}
+			return httpErr
+		}
+	}
+
+	logEntrySetField(r, "order_id", order.ID)
+	return sendJSON(w, http.StatusOK, order)
+}
+
+// OrderCreate endpoint
+func (a *API) OrderCreate(w http.ResponseWriter, r *http.Request) error {
+	config := gcontext.GetConfig(r.Context())
+
+	params := &orderRequestParams{}
+	err := decodeJSON(r, params)
 	if err != nil {
 		return badRequestError("Could not read Order params: %v", err)
 	}
 
-	claims := gcontext.GetClaims(ctx)
-	order := models.NewOrder(instanceID, params.SessionID, params.Email, params.Currency)
+	tx := a.DB(r).Begin()
+	order, err := a.prepareOrder(w, r, tx, params, false)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if httpErr := reserveStock(r, tx, order); httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	log := getLogEntry(r)
+
+	if err := order.AssignNumber(tx, config); err != nil {
+		tx.Rollback()
+		return internalServerError("Error generating order number").WithInternalError(err)
+	}
+	tx.Create(order)
+	if err := order.SyncData(tx, config.SearchableMeta); err != nil {
+		tx.Rollback()
+		return internalServerError("Error indexing order metadata").WithInternalError(err)
+	}
+	if config.Orders.MergeSessions {
+		if err := mergeSessionOrders(r, tx, order); err != nil {
+			tx.Rollback()
+			return internalServerError("Error merging the orders of the session").WithInternalError(err)
+		}
+	}
+	models.LogEvent(tx, r.RemoteAddr, order.UserID, order.ID, models.EventCreated, nil)
+	if err := models.RunHooks(tx, config, order.InstanceID, "order", config.Webhooks.Order, order.UserID, order); err != nil {
+		log.WithError(err).Error("Failed to process webhook")
+	}
+	tx.Commit()
+
+	log.Infof("Successfully created order %s", order.ID)
+	return sendJSON(w, http.StatusCreated, order)
+}
+
+// orderPreview is the price breakdown of an order that isn't created.
+type orderPreview struct {
+	Currency           string               `json:"currency"`
+	LineItems          []*models.LineItem   `json:"line_items"`
+	Coupons            []*models.Coupon     `json:"coupons,omitempty"`
+	SubTotal           uint64               `json:"subtotal"`
+	Discount           uint64               `json:"discount"`
+	NetTotal           uint64               `json:"net_total"`
+	Taxes              uint64               `json:"taxes"`
+	TaxLines           []calculator.TaxLine `json:"tax_lines,omitempty"`
+	Shipping           uint64               `json:"shipping"`
+	Tip                uint64               `json:"tip"`
+	GiftWrapFee        uint64               `json:"gift_wrap_fee,omitempty"`
+	Total              uint64               `json:"total"`
+	PricesIncludeTaxes bool                 `json:"prices_include_taxes"`
+	TaxExempt          bool                 `json:"tax_exempt"`
+	TaxExemptReason    string               `json:"tax_exempt_reason,omitempty"`
+	SettlementCurrency string               `json:"settlement_currency,omitempty"`
+	SettlementTotal    uint64               `json:"settlement_total,omitempty"`
+}
+
+// OrderPreview calculates the total of an order like OrderCreate does,
+// without creating it. It takes the same parameters and returns the price
+// breakdown, so storefronts can show the final total before checkout. Nothing
+// is written, not even within a transaction that's rolled back.
+func (a *API) OrderPreview(w http.ResponseWriter, r *http.Request) error {
+	params := &orderRequestParams{}
+	if err := decodeJSON(r, params); err != nil {
+		return badRequestError("Could not read Order params: %v", err)
+	}
+
+	order, err := a.prepareOrder(w, r, a.DB(r), params, true)
+	if err != nil {
+		return err
+	}
+
+	return sendJSON(w, http.StatusOK, &orderPreview{
+		Currency:           order.Currency,
+		LineItems:          order.LineItems,
+		Coupons:            order.Coupons,
+		SubTotal:           order.SubTotal,
+		Discount:           order.Discount,
+		NetTotal:           order.NetTotal,
+		Taxes:              order.Taxes,
+		TaxLines:           order.TaxLines,
+		Shipping:           order.Shipping,
+		Tip:                order.Tip,
+		GiftWrapFee:        order.GiftWrapFee,
+		Total:              order.Total,
+		PricesIncludeTaxes: order.PricesIncludeTaxes,
+		TaxExempt:          order.TaxExempt,
+		TaxExemptReason:    order.TaxExemptReason,
+		SettlementCurrency: order.SettlementCurrency,
+		SettlementTotal:    order.SettlementTotal,
+	})
+}
+
+// prepareOrder builds a new order from the parameters within tx, with its
+// addresses, line items and totals, and checks it can be placed. The order
+// itself isn't saved. A preview doesn't write anything: new addresses, line
+// items and shipments aren't saved, the user isn't created or updated and
+// VAT numbers aren't verified, which is left to creating the order.
+func (a *API) prepareOrder(w http.ResponseWriter, r *http.Request, tx *gorm.DB, params *orderRequestParams, preview bool) (*models.Order, error) {
+	ctx := r.Context()
+	config := gcontext.GetConfig(ctx)
+	instanceID := gcontext.GetInstanceID(ctx)
 
-	if params.CouponCode != "" {
-		coupon, err := a.lookupCoupon(ctx, w, params.CouponCode)
+	currency, httpErr := normalizeCurrency(config, params.Currency)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	params.Currency = currency
+	if params.Locale != "" {
+		locale, err := mailer.NormalizeLocale(params.Locale)
 		if err != nil {
-			return err
+			return nil, badRequestError("%v", err)
 		}
-		if !coupon.Valid() {
-			return badRequestError("This coupon is not valid at this time")
+		params.Locale = locale
+	}
+	source, httpErr := normalizeOrderSource(params.Source, r.Header.Get(orderSourceHeader))
+	if httpErr != nil {
+		return nil, httpErr
+	}
+
+	claims := gcontext.GetClaims(ctx)
+	order := models.NewOrder(instanceID, params.SessionID, params.Email, params.Currency)
+	order.SiteID = gcontext.GetSiteID(ctx)
+	order.Locale = params.Locale
+	order.Source = source
+	order.Manual = canWriteOrders(ctx)
+	if params.Tip != nil {
+		order.Tip = *params.Tip
+	}
+	if params.GiftMessage != nil {
+		if httpErr := setGiftMessage(order, *params.GiftMessage); httpErr != nil {
+			return nil, httpErr
 		}
+	}
+	if params.GiftWrap != nil {
+		setGiftWrap(config, order, *params.GiftWrap)
+	}
 
-		order.CouponCode = coupon.Code
-		order.Coupon = coupon
+	if codes := params.couponCodes(); len(codes) > 0 {
+		if err := a.applyCoupons(ctx, w, order, codes); err != nil {
+			return nil, err
+		}
 	}
 
 	log := logEntrySetFields(r, logrus.Fields{
@@ -340,35 +838,46 @@ func (a *API) OrderCreate(w http.ResponseWriter, r *http.Request) error {
 		"email":    params.Email,
 		"currency": params.Currency,
 	}).Debug("Created order, starting to process request")
-	tx := a.DB(r).Begin()
 
-	order.IP = r.RemoteAddr
+	order.IP = clientIP(r)
+	order.UserAgent = r.UserAgent()
 	order.MetaData = params.MetaData
-	httpError := setOrderEmail(tx, order, claims, log)
+	httpError := setOrderEmail(tx, order, claims, log, preview)
 	if httpError != nil {
 		log.WithError(httpError).Info("Failed to set the order email from the token")
-		tx.Rollback()
-		return httpError
+		return nil, httpError
 	}
 
 	log.WithField("order_user_id", order.UserID).Debug("Successfully set the order's ID")
 
-	shipping, httpError := a.processAddress(tx, order, "Shipping Address", params.ShippingAddress, params.ShippingAddressID)
+	if order.UserID != "" {
+		user, err := models.GetUser(tx, order.UserID)
+		if err != nil {
+			return nil, internalServerError("Error loading the user of the order").WithInternalError(err)
+		}
+		if user != nil {
+			if params.ShippingAddress == nil && params.ShippingAddressID == "" {
+				params.ShippingAddressID = user.DefaultShippingAddressID
+			}
+			if params.BillingAddress == nil && params.BillingAddressID == "" {
+				params.BillingAddressID = user.DefaultBillingAddressID
+			}
+		}
+	}
+
+	shipping, httpError := a.processAddress(tx, order, "Shipping Address", params.ShippingAddress, params.ShippingAddressID, preview)
 	if httpError != nil {
-		tx.Rollback()
-		return httpError
+		return nil, httpError
 	}
 	if shipping == nil {
-		tx.Rollback()
-		return badRequestError("Shipping Address Required")
+		return nil, badRequestError("Shipping Address Required")
 	}
 	order.ShippingAddress = *shipping
 	order.ShippingAddressID = shipping.ID
 
-	billing, httpError := a.processAddress(tx, order, "Billing Address", params.BillingAddress, params.BillingAddressID)
+	billing, httpError := a.processAddress(tx, order, "Billing Address", params.BillingAddress, params.BillingAddressID, preview)
 	if httpError != nil {
-		tx.Rollback()
-		return httpError
+		return nil, httpError
 	}
 	if billing != nil {
 		order.BillingAddress = *billing
@@ -378,54 +887,126 @@ func (a *API) OrderCreate(w http.ResponseWriter, r *http.Request) error {
 		order.BillingAddressID = shipping.ID
 	}
 
-	if httpError := persistUserName(tx, order, claims); httpError != nil {
-		tx.Rollback()
-		return httpError
+	if !preview {
+		if httpError := persistUserName(tx, order, claims); httpError != nil {
+			return nil, httpError
+		}
 	}
 
-	if params.VATNumber != "" {
+	exemption, err := models.ActiveTaxExemption(tx, order.UserID, order.ShippingAddress.Country, time.Now())
+	if err != nil {
+		return nil, internalServerError("Error looking up tax exemptions").WithInternalError(err)
+	}
+	if exemption != nil {
+		log.WithField("exemption_id", exemption.ID).Debug("Order is tax exempt")
+		order.TaxExemptionID = exemption.ID
+	}
+
+	if params.VATNumber != "" && !preview {
 		valid, err := vat.IsValidVAT(params.VATNumber)
 		if err != nil {
-			tx.Rollback()
-			return internalServerError("Error verifying VAT number").WithInternalError(err)
+			return nil, internalServerError("Error verifying VAT number").WithInternalError(err)
 		}
 		if !valid {
-			tx.Rollback()
-			return badRequestError("Vat number %v is not valid", order.VATNumber)
+			return nil, badRequestError("Vat number %v is not valid", order.VATNumber)
 		}
+	}
+	if params.VATNumber != "" {
 		order.VATNumber = params.VATNumber
+		order.TaxExempt = true
+		order.TaxExemptReason = models.ReverseChargeReason
 	}
 
-	if httpError := a.createLineItems(ctx, tx, order, params.LineItems, log); httpError != nil {
+	if httpError := a.createLineItems(ctx, tx, order, params.LineItems, log, preview); httpError != nil {
 		log.WithError(httpError).Error("Failed to create order line items")
-		tx.Rollback()
-		return httpError
+		return nil, httpError
 	}
 
 	log.WithField("subtotal", order.SubTotal).Debug("Successfully processed all the line items")
 
-	tx.Create(order)
-	models.LogEvent(tx, r.RemoteAddr, order.UserID, order.ID, models.EventCreated, nil)
-	if config.Webhooks.Order != "" {
-		hook, err := models.NewHook("order", config.SiteURL, config.Webhooks.Order, order.UserID, config.Webhooks.Secret, order)
-		if err != nil {
-			log.WithError(err).Error("Failed to process webhook")
+	if httpError := checkStock(tx, order); httpError != nil {
+		return nil, httpError
+	}
+
+	if !preview {
+		if err := order.SyncShipments(tx); err != nil {
+			return nil, internalServerError("Error creating shipments").WithInternalError(err)
 		}
-		tx.Save(hook)
 	}
-	tx.Commit()
 
-	log.Infof("Successfully created order %s", order.ID)
-	return sendJSON(w, http.StatusCreated, order)
-}
+	if httpError := applySettlement(config, order); httpError != nil {
+		return nil, httpError
+	}
 
-// OrderUpdate will allow an ADMIN only to update the details of a record
+	if httpError := checkOrderLimits(config, order); httpError != nil {
+		return nil, httpError
+	}
+
+	return order, nil
+}
+
+// OrderUpdate will allow an ADMIN only to update the details of a record
 // it is also important to note that it will not let modification of an order if the
 // order is no longer pending.
 // Addresses can be made by posting a new one directly, OR by referencing one by ID. If
 // both are provided, the one that is made by ID will win out and the other will be ignored.
-// There are also blocks to changing certain fields after the state has been locked
+// There are also blocks to changing certain fields after the state has been locked,
+// e.g. line items can only be added, removed or changed until the order is paid.
 func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
+	orderParams := new(orderRequestParams)
+	err := decodeJSON(r, orderParams)
+	if err != nil {
+		return badRequestError("Could not read Order Parameters: %v", err)
+	}
+
+	return a.updateOrder(w, r, orderParams, nil)
+}
+
+// clearableOrderFields are the fields a PATCH can remove by setting them to null.
+var clearableOrderFields = map[string]bool{
+	"session_id": true,
+	"vatnumber":  true,
+	"locale":     true,
+	"meta":       true,
+	"tip":        true,
+	"version":    true,
+}
+
+// OrderPatch will allow an ADMIN only to update an order with a JSON Merge
+// Patch (RFC 7386). Unlike OrderUpdate, optional fields set to null are
+// cleared and the meta data is merged key by key instead of being replaced.
+func (a *API) OrderPatch(w http.ResponseWriter, r *http.Request) error {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return badRequestError("Could not read Order Parameters: %v", err)
+	}
+
+	patch := map[string]json.RawMessage{}
+	if err := json.Unmarshal(body, &patch); err != nil {
+		return badRequestError("Could not read Order Parameters: %v", err)
+	}
+	orderParams := new(orderRequestParams)
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(orderParams); err != nil {
+		return badRequestError("Could not read Order Parameters: %v", err)
+	}
+
+	for field, value := range patch {
+		if isJSONNull(value) && !clearableOrderFields[field] {
+			return badRequestError("The field '%s' can't be cleared", field)
+		}
+	}
+	if isJSONNull(patch["tip"]) {
+		orderParams.Tip = new(uint64)
+	}
+
+	return a.updateOrder(w, r, orderParams, patch)
+}
+
+// updateOrder applies the update parameters to an order. If the update is a
+// JSON Merge Patch, patch holds its raw fields, otherwise it is nil.
+func (a *API) updateOrder(w http.ResponseWriter, r *http.Request, orderParams *orderRequestParams, patch map[string]json.RawMessage) error {
 	ctx := r.Context()
 	db := a.DB(r)
 	orderID := gcontext.GetOrderID(ctx)
@@ -434,24 +1015,32 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 	config := gcontext.GetConfig(ctx)
 	changes := []string{}
 
-	orderParams := new(orderRequestParams)
-	err := json.NewDecoder(r.Body).Decode(orderParams)
-	if err != nil {
-		return badRequestError("Could not read Order Parameters: %v", err)
-	}
-
 	// verify that the order exists
 	existingOrder := new(models.Order)
 
-	rsp := orderQuery(db).First(existingOrder, "id = ?", orderID)
+	rsp := siteScope(ctx, orderQuery(db), "").First(existingOrder, "id = ?", orderID)
 	if rsp.RecordNotFound() {
 		return notFoundError("Failed to find order with id '%s'", orderID)
 	}
 	if rsp.Error != nil {
 		return internalServerError("Error while querying for order").WithInternalError(rsp.Error)
 	}
+	before, err := models.AuditSnapshot(existingOrder)
+	if err != nil {
+		return internalServerError("Error while reading order").WithInternalError(err)
+	}
 
-	alreadyPaid := existingOrder.PaymentState == models.PaidState
+	expectedVersion, httpErr := orderUpdateVersion(r, orderParams)
+	if httpErr != nil {
+		return httpErr
+	}
+	if expectedVersion != nil && *expectedVersion != existingOrder.Version {
+		return conflictError("The order has been modified, its current version is %d", existingOrder.Version)
+	}
+
+	// authorized, captured, disputed or held payments lock the order contents
+	// just like completed ones
+	alreadyPaid := existingOrder.PaymentState != models.PendingState && existingOrder.PaymentState != models.FailedState
 
 	//
 	// handle the simple fields
@@ -467,7 +1056,33 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 		changes = append(changes, "email")
 	}
 
-	if orderParams.MetaData != nil {
+	if orderParams.Locale != "" {
+		locale, err := mailer.NormalizeLocale(orderParams.Locale)
+		if err != nil {
+			return badRequestError("%v", err)
+		}
+		log.Debugf("Updating locale from '%s' to '%s'", existingOrder.Locale, locale)
+		existingOrder.Locale = locale
+		changes = append(changes, "locale")
+	} else if isJSONNull(patch["locale"]) && existingOrder.Locale != "" {
+		log.Debugf("Clearing locale '%s'", existingOrder.Locale)
+		existingOrder.Locale = ""
+		changes = append(changes, "locale")
+	}
+
+	if isJSONNull(patch["session_id"]) && existingOrder.SessionID != "" {
+		log.Debugf("Clearing session id '%s'", existingOrder.SessionID)
+		existingOrder.SessionID = ""
+		changes = append(changes, "session_id")
+	}
+
+	switch {
+	case isJSONNull(patch["meta"]):
+		existingOrder.MetaData = nil
+		existingOrder.RawMetaData = ""
+	case orderParams.MetaData != nil && patch != nil:
+		existingOrder.MetaData = mergePatch(existingOrder.MetaData, orderParams.MetaData)
+	case orderParams.MetaData != nil:
 		existingOrder.MetaData = orderParams.MetaData
 	}
 
@@ -475,18 +1090,85 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 		if alreadyPaid {
 			return badRequestError("Can't update the currency after payment has been processed")
 		}
-		log.Debugf("Updating currency from '%v' to '%v'", existingOrder.Currency, orderParams.Currency)
-		existingOrder.Currency = orderParams.Currency
+		currency, httpError := normalizeCurrency(config, orderParams.Currency)
+		if httpError != nil {
+			return httpError
+		}
+		log.Debugf("Updating currency from '%v' to '%v'", existingOrder.Currency, currency)
+		existingOrder.Currency = currency
+		if httpError := applySettlement(config, existingOrder); httpError != nil {
+			return httpError
+		}
 		changes = append(changes, "currency")
 	}
+	wasTaxExempt := existingOrder.TaxExempt
 	if orderParams.VATNumber != "" {
 		if alreadyPaid {
 			return badRequestError("Can't update the VAT number after payment has been processed")
 		}
 
+		valid, err := vat.IsValidVAT(orderParams.VATNumber)
+		if err != nil {
+			return internalServerError("Error verifying VAT number").WithInternalError(err)
+		}
+		if !valid {
+			return badRequestError("Vat number %v is not valid", orderParams.VATNumber)
+		}
+
 		log.Debugf("Updating vat number from '%v' to '%v'", existingOrder.VATNumber, orderParams.VATNumber)
 		existingOrder.VATNumber = orderParams.VATNumber
 		changes = append(changes, "vatnumber")
+		if !existingOrder.TaxExempt {
+			existingOrder.TaxExempt = true
+			existingOrder.TaxExemptReason = models.ReverseChargeReason
+			changes = append(changes, "tax_exempt")
+		}
+	} else if isJSONNull(patch["vatnumber"]) && existingOrder.VATNumber != "" {
+		if alreadyPaid {
+			return badRequestError("Can't update the VAT number after payment has been processed")
+		}
+
+		log.Debugf("Clearing vat number '%v'", existingOrder.VATNumber)
+		existingOrder.VATNumber = ""
+		changes = append(changes, "vatnumber")
+		if existingOrder.TaxExemptReason == models.ReverseChargeReason {
+			existingOrder.TaxExempt = false
+			existingOrder.TaxExemptReason = ""
+			changes = append(changes, "tax_exempt")
+		}
+	}
+
+	if orderParams.TaxExempt != nil && (*orderParams.TaxExempt != existingOrder.TaxExempt || orderParams.TaxExemptReason != "") {
+		if alreadyPaid {
+			return badRequestError("Can't change the tax exemption after payment has been processed")
+		}
+		if *orderParams.TaxExempt && orderParams.TaxExemptReason == "" {
+			return badRequestError("A tax exemption requires a reason")
+		}
+
+		log.Debugf("Updating tax exemption from '%v' to '%v'", existingOrder.TaxExempt, *orderParams.TaxExempt)
+		existingOrder.TaxExempt = *orderParams.TaxExempt
+		existingOrder.TaxExemptReason = ""
+		if existingOrder.TaxExempt {
+			existingOrder.TaxExemptReason = orderParams.TaxExemptReason
+		}
+		changes = append(changes, "tax_exempt")
+	}
+	taxChanged := existingOrder.TaxExempt != wasTaxExempt
+
+	if len(orderParams.LineItems) > 0 && alreadyPaid {
+		return badRequestError("Can't update the line items after payment has been processed")
+	}
+
+	couponCodes := orderParams.couponCodes()
+	if len(couponCodes) > 0 {
+		if alreadyPaid {
+			return badRequestError("Can't apply coupons after payment has been processed")
+		}
+		if err := a.applyCoupons(ctx, w, existingOrder, couponCodes); err != nil {
+			return err
+		}
+		changes = append(changes, "coupons")
 	}
 
 	tx := db.Begin()
@@ -497,7 +1179,7 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 	if orderParams.BillingAddress != nil || orderParams.BillingAddressID != "" {
 		log.Debugf("Updating order's billing address")
 
-		addr, httpErr := a.processAddress(tx, existingOrder, "Billing Address", orderParams.BillingAddress, orderParams.BillingAddressID)
+		addr, httpErr := a.processAddress(tx, existingOrder, "Billing Address", orderParams.BillingAddress, orderParams.BillingAddressID, false)
 		if httpErr != nil {
 			log.WithError(httpErr).Warn("Failed to update the billing address")
 			tx.Rollback()
@@ -512,10 +1194,11 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 		changes = append(changes, "billing_address")
 	}
 
+	shippingChanged := false
 	if orderParams.ShippingAddress != nil || orderParams.ShippingAddressID != "" {
 		log.Debugf("Updating order's shipping address")
 
-		addr, httpErr := a.processAddress(tx, existingOrder, "Shipping Address", orderParams.ShippingAddress, orderParams.ShippingAddressID)
+		addr, httpErr := a.processAddress(tx, existingOrder, "Shipping Address", orderParams.ShippingAddress, orderParams.ShippingAddressID, false)
 		if httpErr != nil {
 			log.WithError(httpErr).Warn("Failed to update the shipping address")
 			tx.Rollback()
@@ -529,43 +1212,178 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 			"old_address_id": old,
 		}).Debugf("Updated the shipping address id to %s", addr.ID)
 		changes = append(changes, "shipping_address")
+		shippingChanged = true
 	}
 
-	if orderParams.FulfillmentState != "" {
-		ok := false
-		for _, state := range models.FulfillmentStates {
-			if state == orderParams.FulfillmentState {
-				ok = true
-				break
+	if orderParams.PaymentState != "" {
+		// authorized payments are captured when the order ships, not by updating the order
+		reopen := existingOrder.PaymentState == models.AbandonedState && orderParams.PaymentState == models.PendingState
+		if !reopen && existingOrder.PaymentState != models.ReviewState {
+			tx.Rollback()
+			return badRequestError("Only abandoned orders can be reopened by setting the payment state to '%s', and payments held for review approved or declined", models.PendingState)
+		}
+		if httpErr := checkTransition(models.PaymentStateMachine, "payment state", existingOrder.PaymentState, orderParams.PaymentState, models.ActorAdmin); httpErr != nil {
+			tx.Rollback()
+			return httpErr
+		}
+		if reopen {
+			existingOrder.PaymentState = models.PendingState
+			for _, trans := range existingOrder.Transactions {
+				// the order was paid after it had been abandoned
+				if trans.Type == models.ChargeTransactionType && trans.Status == models.PaidState {
+					existingOrder.PaymentState = models.PaidState
+					decrementStock(r, tx, existingOrder)
+					break
+				}
 			}
+			logTimeline(r, tx, existingOrder, models.ReopenedTimelineEvent, "Order reopened")
+		} else {
+			finishReview(r, tx, existingOrder, orderParams.PaymentState == models.PendingState)
 		}
-		if !ok {
+		changes = append(changes, "payment_state")
+	}
+
+	if orderParams.FulfillmentState != "" {
+		fulfillmentChanges, httpErr := updateFulfillmentState(r, tx, existingOrder, orderParams.FulfillmentState)
+		if httpErr != nil {
+			tx.Rollback()
+			return httpErr
+		}
+		changes = append(changes, fulfillmentChanges...)
+	}
+
+	tipChanged := false
+	if orderParams.Tip != nil && *orderParams.Tip != existingOrder.Tip {
+		if alreadyPaid {
+			tx.Rollback()
+			return badRequestError("Can't change the tip after payment has been processed")
+		}
+		existingOrder.Tip = *orderParams.Tip
+		tipChanged = true
+		changes = append(changes, "tip")
+	}
+
+	if orderParams.GiftMessage != nil && *orderParams.GiftMessage != existingOrder.GiftMessage {
+		if existingOrder.FulfillmentState == models.ShippedState {
+			tx.Rollback()
+			return badRequestError("Can't change the gift message after the order shipped")
+		}
+		if httpErr := setGiftMessage(existingOrder, *orderParams.GiftMessage); httpErr != nil {
+			tx.Rollback()
+			return httpErr
+		}
+		changes = append(changes, "gift_message")
+	}
+	giftWrapChanged := false
+	if orderParams.GiftWrap != nil && *orderParams.GiftWrap != existingOrder.GiftWrap {
+		if alreadyPaid {
+			tx.Rollback()
+			return badRequestError("Can't change the gift wrapping after payment has been processed")
+		}
+		setGiftWrap(config, existingOrder, *orderParams.GiftWrap)
+		giftWrapChanged = true
+		changes = append(changes, "gift_wrap")
+	}
+
+	discountChanged := false
+	if orderParams.ManualDiscount != nil && (*orderParams.ManualDiscount != existingOrder.ManualDiscount || orderParams.ManualDiscountReason != existingOrder.ManualDiscountReason) {
+		if alreadyPaid {
 			tx.Rollback()
-			return badRequestError("Bad fulfillment state: " + orderParams.FulfillmentState)
+			return badRequestError("Can't change the discount after payment has been processed")
+		}
+		existingOrder.ManualDiscount = *orderParams.ManualDiscount
+		existingOrder.ManualDiscountReason = ""
+		if existingOrder.ManualDiscount > 0 {
+			existingOrder.ManualDiscountReason = orderParams.ManualDiscountReason
+		}
+		discountChanged = true
+		changes = append(changes, "manual_discount")
+	}
+	if len(orderParams.LineItemDiscounts) > 0 {
+		if alreadyPaid {
+			tx.Rollback()
+			return badRequestError("Can't change the discount after payment has been processed")
+		}
+		if len(orderParams.LineItems) > 0 {
+			tx.Rollback()
+			return badRequestError("Line item discounts can't be changed together with the line items")
+		}
+		for _, discount := range orderParams.LineItemDiscounts {
+			var item *models.LineItem
+			for _, lineItem := range existingOrder.LineItems {
+				if lineItem.ID == discount.LineItemID {
+					item = lineItem
+				}
+			}
+			if item == nil {
+				tx.Rollback()
+				return badRequestError("The order has no line item with id %d", discount.LineItemID)
+			}
+			item.ManualDiscount = discount.Amount
+			item.ManualDiscountReason = ""
+			if item.ManualDiscount > 0 {
+				item.ManualDiscountReason = discount.Reason
+			}
 		}
-		existingOrder.FulfillmentState = orderParams.FulfillmentState
-		changes = append(changes, "fulfillment_state")
+		discountChanged = true
+		changes = append(changes, "line_item_discounts")
 	}
 
 	//
 	// handle the line items
 	//
-	updatedItems := make(map[string]*orderLineItem)
-	for _, item := range orderParams.LineItems {
-		updatedItems[item.Sku] = item
+	if len(orderParams.LineItems) > 0 {
+		if httpErr := a.updateLineItems(ctx, tx, existingOrder, orderParams.LineItems, log); httpErr != nil {
+			log.WithError(httpErr).Warn("Failed to update the line items")
+			tx.Rollback()
+			return httpErr
+		}
+		if httpErr := applySettlement(config, existingOrder); httpErr != nil {
+			tx.Rollback()
+			return httpErr
+		}
+		if !existingOrder.StockHeld {
+			// reserve the stock for the new line items instead of the old ones
+			if err := models.ReleaseReservations(tx, existingOrder.ID); err != nil {
+				tx.Rollback()
+				return internalServerError("Error releasing stock reservations").WithInternalError(err)
+			}
+			if httpErr := reserveStock(r, tx, existingOrder); httpErr != nil {
+				tx.Rollback()
+				return httpErr
+			}
+		}
+		changes = append(changes, "line_items")
+	} else if len(couponCodes) > 0 || (shippingChanged && !alreadyPaid) || taxChanged || tipChanged || giftWrapChanged || discountChanged {
+		settings, err := a.loadSettings(ctx)
+		if err != nil {
+			tx.Rollback()
+			return internalServerError("%v", err).WithInternalError(err)
+		}
+		existingOrder.Recalculate(settings, pricingClaims(ctx, existingOrder), log)
+		if httpErr := applySettlement(config, existingOrder); httpErr != nil {
+			tx.Rollback()
+			return httpErr
+		}
 	}
 
-	for _, item := range existingOrder.LineItems {
-		if update, exists := updatedItems[item.Sku]; exists {
-			item.Quantity = update.Quantity
-			if update.Path != "" {
-				item.Path = update.Path
-			}
+	if len(orderParams.LineItems) > 0 || shippingChanged {
+		if err := existingOrder.SyncShipments(tx); err != nil {
+			tx.Rollback()
+			return internalServerError("Error updating shipments").WithInternalError(err)
 		}
 	}
 
-	if len(updatedItems) > 0 {
-		changes = append(changes, "line_items")
+	// only bump the version if nobody else did since we loaded the order,
+	// gorm assigns the new version to existingOrder as well
+	rsp = tx.Model(existingOrder).Where("version = ?", existingOrder.Version).UpdateColumn("version", existingOrder.Version+1)
+	if rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error saving order updates").WithInternalError(rsp.Error)
+	}
+	if rsp.RowsAffected == 0 {
+		tx.Rollback()
+		return conflictError("The order has been modified by another request, please reload it and try again")
 	}
 
 	log.Info("Saving order updates")
@@ -573,22 +1391,273 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 		tx.Rollback()
 		return internalServerError("Error saving order updates").WithInternalError(rsp.Error)
 	}
+	if orderParams.MetaData != nil || isJSONNull(patch["meta"]) {
+		if err := existingOrder.SyncData(tx, config.SearchableMeta); err != nil {
+			tx.Rollback()
+			return internalServerError("Error indexing order metadata").WithInternalError(err)
+		}
+	}
 
 	models.LogEvent(tx, r.RemoteAddr, claims.Subject, existingOrder.ID, models.EventUpdated, changes)
-	if config.Webhooks.Update != "" {
-		// TODO should this be claims.Subject or existingOrder.UserID ?
-		hook, err := models.NewHook("update", config.SiteURL, config.Webhooks.Update, claims.Subject, config.Webhooks.Secret, existingOrder)
-		if err != nil {
-			log.WithError(err).Error("Failed to process web hook")
-		}
-		tx.Save(hook)
+	// TODO should this be claims.Subject or existingOrder.UserID ?
+	if err := models.RunHooks(tx, config, existingOrder.InstanceID, "update", config.Webhooks.Update, claims.Subject, existingOrder); err != nil {
+		log.WithError(err).Error("Failed to process web hook")
 	}
 	if rsp := tx.Commit(); rsp.Error != nil {
 		tx.Rollback()
 		return internalServerError("Error committing order updates").WithInternalError(rsp.Error)
 	}
 
-	return sendJSON(w, http.StatusOK, existingOrder)
+	// reload so the response contains exactly what was stored, including the
+	// updated line items and meta data
+	updatedOrder := new(models.Order)
+	if rsp := orderQuery(db).First(updatedOrder, "id = ?", orderID); rsp.Error != nil {
+		return internalServerError("Error while querying for updated order").WithInternalError(rsp.Error)
+	}
+	a.audit(r, models.AuditOrderUpdate, orderID, before, updatedOrder)
+
+	w.Header().Set("ETag", orderETag(updatedOrder))
+	return sendJSON(w, http.StatusOK, updatedOrder)
+}
+
+// updateFulfillmentState moves the order to a new fulfillment state, capturing
+// authorized payments on shipment if configured. It returns the changed fields.
+func updateFulfillmentState(r *http.Request, tx *gorm.DB, order *models.Order, state string) ([]string, *HTTPError) {
+	config := gcontext.GetConfig(r.Context())
+	if !validFulfillmentState(state) {
+		return nil, badRequestError("Bad fulfillment state: " + state)
+	}
+	if httpErr := checkTransition(models.FulfillmentStateMachine, "fulfillment state", order.FulfillmentState, state, models.ActorAdmin); httpErr != nil {
+		return nil, httpErr
+	}
+	if state == models.ShippedState && order.FulfillmentState != models.ShippedState {
+		logTimeline(r, tx, order, models.ShippedTimelineEvent, "Order shipped")
+	}
+	order.FulfillmentState = state
+	if state == models.ShippedState {
+		// the whole order shipped, so did all of its shipments
+		for _, shipment := range order.Shipments {
+			shipment.FulfillmentState = models.ShippedState
+		}
+	}
+	changes := []string{"fulfillment_state"}
+
+	if state == models.ShippedState && config.Payment.CaptureOnShipment && authorizedPayment(order) != nil {
+		// captures what's left after the shipments that shipped before
+		if httpErr := captureShipment(r, tx, order, order.Total, true); httpErr != nil {
+			getLogEntry(r).WithError(httpErr).Warn("Failed to capture payment on shipment")
+			return nil, httpErr
+		}
+		changes = append(changes, "payment_state")
+	}
+	return changes, nil
+}
+
+// checkTransition verifies that the actor may change a state of an order
+// according to its state machine.
+func checkTransition(machine *models.StateMachine, name, from, to string, actor models.StateActor) *HTTPError {
+	if from == "" {
+		from = models.PendingState
+	}
+	if !machine.Allowed(from, to, actor) {
+		return badRequestError("Can't change the %s from '%s' to '%s'", name, from, to)
+	}
+	return nil
+}
+
+type orderTransitions struct {
+	PaymentState     string   `json:"payment_state"`
+	FulfillmentState string   `json:"fulfillment_state"`
+	Payment          []string `json:"payment"`
+	Fulfillment      []string `json:"fulfillment"`
+}
+
+// OrderTransitions lists the payment and fulfillment states the caller can
+// move the order to. Admins see the changes they can make with OrderUpdate,
+// customers the ones they can make by paying.
+func (a *API) OrderTransitions(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	id := gcontext.GetOrderID(ctx)
+
+	order := &models.Order{}
+	if result := siteScope(ctx, a.ReadDB(r), "").First(order, "id = ?", id); result.Error != nil {
+		if result.RecordNotFound() {
+			return notFoundError("Order not found")
+		}
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	if !canReadOrders(ctx) {
+		if httpErr := a.canAccessOrder(w, r, a.ReadDB(r), order); httpErr != nil {
+			return httpErr
+		}
+	}
+
+	actor := models.ActorCustomer
+	if canWriteOrders(ctx) {
+		actor = models.ActorAdmin
+	}
+	paymentState, fulfillmentState := order.PaymentState, order.FulfillmentState
+	if fulfillmentState == "" {
+		fulfillmentState = models.PendingState
+	}
+	return sendJSON(w, http.StatusOK, &orderTransitions{
+		PaymentState:     paymentState,
+		FulfillmentState: fulfillmentState,
+		Payment:          models.PaymentStateMachine.Next(paymentState, actor),
+		Fulfillment:      models.FulfillmentStateMachine.Next(fulfillmentState, actor),
+	})
+}
+
+func validFulfillmentState(state string) bool {
+	for _, s := range models.FulfillmentStates {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+// orderUpdateVersion returns the order version an update expects, either from
+// the If-Match header or the request body.
+func orderUpdateVersion(r *http.Request, params *orderRequestParams) (*uint64, *HTTPError) {
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	if ifMatch == "" || ifMatch == "*" {
+		return params.Version, nil
+	}
+
+	// the ETag of an order starts with its version
+	tag := strings.Trim(strings.TrimPrefix(ifMatch, "W/"), `"`)
+	if i := strings.Index(tag, "-"); i >= 0 {
+		tag = tag[:i]
+	}
+	version, err := strconv.ParseUint(tag, 10, 64)
+	if err != nil {
+		return nil, badRequestError("Invalid If-Match header: %v", ifMatch)
+	}
+	if params.Version != nil && *params.Version != version {
+		return nil, badRequestError("If-Match header and version parameter don't match")
+	}
+	return &version, nil
+}
+
+// isJSONNull reports whether a raw JSON value is an explicit null.
+func isJSONNull(value json.RawMessage) bool {
+	return bytes.Equal(bytes.TrimSpace(value), []byte("null"))
+}
+
+// mergePatch applies a JSON Merge Patch (RFC 7386) to target. Null values
+// remove keys, objects are merged recursively and any other value replaces
+// the existing one.
+func mergePatch(target, patch map[string]interface{}) map[string]interface{} {
+	if target == nil {
+		target = map[string]interface{}{}
+	}
+	for key, value := range patch {
+		switch value := value.(type) {
+		case nil:
+			delete(target, key)
+		case map[string]interface{}:
+			existing, _ := target[key].(map[string]interface{})
+			target[key] = mergePatch(existing, value)
+		default:
+			target[key] = value
+		}
+	}
+	return target
+}
+
+// normalizeCurrency uppercases and validates a currency code, falling back
+// to the default currency of the instance if none is given.
+func normalizeCurrency(config *conf.Configuration, currency string) (string, *HTTPError) {
+	if currency == "" {
+		currency = config.DefaultCurrency
+		if currency == "" {
+			currency = "USD"
+		}
+	}
+	code, err := calculator.NormalizeCurrency(currency)
+	if err != nil {
+		return "", badRequestError("%v", err)
+	}
+	return code, nil
+}
+
+// normalizeOrderSource lowercases and validates the source of an order, taken
+// from the parameters or else the header, and falls back to the default
+// source if neither is given.
+func normalizeOrderSource(param, header string) (string, *HTTPError) {
+	source := strings.ToLower(strings.TrimSpace(param))
+	if source == "" {
+		source = strings.ToLower(strings.TrimSpace(header))
+	}
+	if source == "" {
+		return models.DefaultOrderSource, nil
+	}
+	if !orderSourceRegexp.MatchString(source) {
+		return "", badRequestError("Invalid order source '%s', must be up to 32 letters, digits, dashes or underscores", source)
+	}
+	return source, nil
+}
+
+// setGiftMessage trims and validates the gift message of an order.
+func setGiftMessage(order *models.Order, message string) *HTTPError {
+	message = strings.TrimSpace(message)
+	if len([]rune(message)) > maxGiftMessageLength {
+		return badRequestError("The gift message can't be longer than %d characters", maxGiftMessageLength)
+	}
+	order.GiftMessage = message
+	return nil
+}
+
+// setGiftWrap charges the gift wrap fee configured for the currency of the
+// order when it's gift wrapped. The total has to be recalculated afterwards.
+func setGiftWrap(config *conf.Configuration, order *models.Order, wrap bool) {
+	order.GiftWrap = wrap
+	order.GiftWrapFee = 0
+	if wrap {
+		order.GiftWrapFee, _ = currencyLimit(config.Orders.GiftWrapFee, order.Currency)
+	}
+}
+
+// checkOrderLimits enforces the minimum and maximum order totals configured
+// for the currency of the order. Manual orders aren't limited.
+func checkOrderLimits(config *conf.Configuration, order *models.Order) *HTTPError {
+	if order.Manual {
+		return nil
+	}
+	if min, ok := currencyLimit(config.Orders.MinTotal, order.Currency); ok && order.Total < min {
+		return badRequestError("The order total must be at least %s %s", calculator.FormatAmount(min, order.Currency), order.Currency)
+	}
+	if max, ok := currencyLimit(config.Orders.MaxTotal, order.Currency); ok && order.Total > max {
+		return badRequestError("The order total can't be more than %s %s", calculator.FormatAmount(max, order.Currency), order.Currency)
+	}
+	return nil
+}
+
+func currencyLimit(limits map[string]uint64, currency string) (uint64, bool) {
+	for code, limit := range limits {
+		if strings.EqualFold(code, currency) {
+			return limit, true
+		}
+	}
+	return 0, false
+}
+
+// applySettlement converts the order total into the configured settlement
+// currency. Orders already in the settlement currency are charged as is.
+func applySettlement(config *conf.Configuration, order *models.Order) *HTTPError {
+	settlement := config.Settlement
+	if settlement.Currency == "" || strings.EqualFold(settlement.Currency, order.Currency) {
+		order.SetSettlement("", 0)
+		return nil
+	}
+
+	rate, ok := settlement.Rates[strings.ToUpper(order.Currency)]
+	if !ok || rate <= 0 {
+		return badRequestError("No exchange rate configured from %v to %v", order.Currency, settlement.Currency)
+	}
+	order.SetSettlement(settlement.Currency, rate)
+	return nil
 }
 
 // An order's email is determined by a few things. The rules guiding it are:
@@ -598,7 +1667,8 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 //     if the user doesn't have an email, the one from the order is used
 // 4 - if the order doesn't have an email, but the user does, we will use that one
 //
-func setOrderEmail(tx *gorm.DB, order *models.Order, claims *claims.JWTClaims, log logrus.FieldLogger) *HTTPError {
+// A preview doesn't create or update the user.
+func setOrderEmail(tx *gorm.DB, order *models.Order, claims *claims.JWTClaims, log logrus.FieldLogger, preview bool) *HTTPError {
 	if claims == nil {
 		log.Debug("No claims provided, proceeding as an anon request")
 	} else {
@@ -615,7 +1685,11 @@ func setOrderEmail(tx *gorm.DB, order *models.Order, claims *claims.JWTClaims, l
 			log.Debugf("Didn't find a user for id %s ~ going to create one", claims.Subject)
 			user.ID = claims.Subject
 			user.Email = claims.Email
-			tx.Create(user)
+			user.SiteID = order.SiteID
+			user.Locale = order.Locale
+			if !preview {
+				tx.Create(user)
+			}
 		} else if result.Error != nil {
 			return internalServerError("Token had an invalid ID").WithInternalError(result.Error)
 		}
@@ -623,6 +1697,12 @@ func setOrderEmail(tx *gorm.DB, order *models.Order, claims *claims.JWTClaims, l
 		if order.Email == "" {
 			order.Email = user.Email
 		}
+		if order.Locale == "" {
+			order.Locale = user.Locale
+		} else if user.Locale == "" && !preview {
+			user.Locale = order.Locale
+			tx.Model(user).UpdateColumn("locale", user.Locale)
+		}
 	}
 
 	if order.Email == "" {
@@ -631,7 +1711,9 @@ func setOrderEmail(tx *gorm.DB, order *models.Order, claims *claims.JWTClaims, l
 	return nil
 }
 
-func (a *API) createLineItems(ctx context.Context, tx *gorm.DB, order *models.Order, items []*orderLineItem, log logrus.FieldLogger) *HTTPError {
+func (a *API) createLineItems(ctx context.Context, tx *gorm.DB, order *models.Order, items []*orderLineItem, log logrus.FieldLogger, preview bool) *HTTPError {
+	existingDownloads := len(order.Downloads)
+	claims := pricingClaims(ctx, order)
 	sem := make(chan int, MaxConcurrentLookups)
 	var wg sync.WaitGroup
 	sharedErr := verificationError{}
@@ -650,6 +1732,14 @@ func (a *API) createLineItems(ctx context.Context, tx *gorm.DB, order *models.Or
 			})
 		}
 
+		addr, httpErr := a.processAddress(tx, order, "Shipping Address", orderItem.ShippingAddress, orderItem.ShippingAddressID, preview)
+		if httpErr != nil {
+			return httpErr
+		}
+		if addr != nil {
+			lineItem.ShippingAddressID = addr.ID
+		}
+
 		order.LineItems = append(order.LineItems, lineItem)
 		sem <- 1
 		wg.Add(1)
@@ -663,7 +1753,7 @@ func (a *API) createLineItems(ctx context.Context, tx *gorm.DB, order *models.Or
 				return
 			}
 
-			if err := a.processLineItem(ctx, order, item); err != nil {
+			if err := a.processLineItem(ctx, order, item, claims); err != nil {
 				sharedErr.setError(err)
 			}
 		}(lineItem, orderItem)
@@ -674,28 +1764,105 @@ func (a *API) createLineItems(ctx context.Context, tx *gorm.DB, order *models.Or
 		return internalServerError("Error processing line item").WithInternalError(sharedErr.err)
 	}
 
-	for _, item := range order.LineItems {
-		order.SubTotal = order.SubTotal + (item.Price+item.AddonPrice)*item.Quantity
-		if err := tx.Save(item).Error; err != nil {
-			return internalServerError("Error creating line item").WithInternalError(err)
+	if !preview {
+		for _, item := range order.LineItems {
+			if err := tx.Save(item).Error; err != nil {
+				return internalServerError("Error creating line item").WithInternalError(err)
+			}
 		}
-	}
 
-	for _, download := range order.Downloads {
-		if err := tx.Create(&download).Error; err != nil {
-			return internalServerError("Error creating download item").WithInternalError(err)
+		for _, download := range order.Downloads[existingDownloads:] {
+			if err := tx.Create(&download).Error; err != nil {
+				return internalServerError("Error creating download item").WithInternalError(err)
+			}
 		}
 	}
 
 	settings, err := a.loadSettings(ctx)
 	if err != nil {
-		return internalServerError(err.Error()).WithInternalError(err)
+		return internalServerError("%v", err).WithInternalError(err)
 	}
 
-	order.CalculateTotal(settings, gcontext.GetClaimsAsMap(ctx), log)
+	order.Recalculate(settings, claims, log)
 	return nil
 }
 
+// updateLineItems changes the line items of an unpaid order. Items are matched
+// by SKU, a quantity of 0 removes an item and items with an unknown SKU are
+// added from their path. The order totals are recalculated afterwards.
+func (a *API) updateLineItems(ctx context.Context, tx *gorm.DB, order *models.Order, items []*orderLineItem, log logrus.FieldLogger) *HTTPError {
+	existing := make(map[string]bool)
+	for _, item := range order.LineItems {
+		existing[item.Sku] = true
+	}
+
+	updates := make(map[string]*orderLineItem)
+	added := []*orderLineItem{}
+	for _, update := range items {
+		if existing[update.Sku] {
+			updates[update.Sku] = update
+			continue
+		}
+		if update.Path == "" {
+			return badRequestError("Unknown line item '%s', new line items require a path", update.Sku)
+		}
+		if update.Quantity == 0 {
+			return badRequestError("New line item '%s' requires a quantity", update.Path)
+		}
+		added = append(added, update)
+	}
+
+	kept := []*models.LineItem{}
+	removedSkus := make(map[string]bool)
+	for _, item := range order.LineItems {
+		update, ok := updates[item.Sku]
+		if !ok {
+			kept = append(kept, item)
+			continue
+		}
+
+		if update.Quantity == 0 {
+			log.Debugf("Removing line item %s", item.Sku)
+			if err := tx.Delete(item).Error; err != nil {
+				return internalServerError("Error removing line item").WithInternalError(err)
+			}
+			if err := tx.Where("order_id = ? AND sku = ?", order.ID, item.Sku).Delete(&models.Download{}).Error; err != nil {
+				return internalServerError("Error removing downloads").WithInternalError(err)
+			}
+			removedSkus[item.Sku] = true
+			continue
+		}
+
+		log.Debugf("Updating quantity of line item %s from %d to %d", item.Sku, item.Quantity, update.Quantity)
+		item.Quantity = update.Quantity
+		if update.Path != "" {
+			item.Path = update.Path
+		}
+		if update.MetaData != nil {
+			item.MetaData = update.MetaData
+		}
+		addr, httpErr := a.processAddress(tx, order, "Shipping Address", update.ShippingAddress, update.ShippingAddressID, false)
+		if httpErr != nil {
+			return httpErr
+		}
+		if addr != nil {
+			item.ShippingAddressID = addr.ID
+		}
+		kept = append(kept, item)
+	}
+	order.LineItems = kept
+
+	downloads := []models.Download{}
+	for _, download := range order.Downloads {
+		if !removedSkus[download.Sku] {
+			downloads = append(downloads, download)
+		}
+	}
+	order.Downloads = downloads
+
+	return a.createLineItems(ctx, tx, order, added, log, false)
+}
+
 func (a *API) loadSettings(ctx context.Context) (*calculator.Settings, error) {
 	config := gcontext.GetConfig(ctx)
 
@@ -711,11 +1878,22 @@ func (a *API) loadSettings(ctx context.Context) (*calculator.Settings, error) {
 			return nil, fmt.Errorf("Error parsing site settings: %v", err)
 		}
 	}
+	if config.PricesIncludeTax {
+		settings.PricesIncludeTaxes = true
+	}
+	if config.Rounding != "" {
+		settings.Rounding = calculator.Rounding(config.Rounding)
+	}
+	if !settings.Rounding.Valid() {
+		return nil, fmt.Errorf("Unknown rounding strategy '%s', choose from half_up, half_even or floor", settings.Rounding)
+	}
 
 	return settings, nil
 }
 
-func (a *API) processAddress(tx *gorm.DB, order *models.Order, name string, address *models.Address, id string) (*models.Address, *HTTPError) {
+// processAddress loads an address of the user of an order by its ID, or
+// validates and creates a new one. Previews don't create the address.
+func (a *API) processAddress(tx *gorm.DB, order *models.Order, name string, address *models.Address, id string, preview bool) (*models.Address, *HTTPError) {
 	if address == nil && id == "" {
 		return nil, nil
 	}
@@ -740,22 +1918,40 @@ func (a *API) processAddress(tx *gorm.DB, order *models.Order, name string, addr
 
 	// is a valid id that doesn't already belong to a user
 	address.ID = uuid.NewRandom().String()
-	tx.Create(address)
+	if !preview {
+		tx.Create(address)
+	}
 	return address, nil
 }
 
-func (a *API) processLineItem(ctx context.Context, order *models.Order, item *models.LineItem) error {
+func (a *API) processLineItem(ctx context.Context, order *models.Order, item *models.LineItem, claims map[string]interface{}) error {
 	config := gcontext.GetConfig(ctx)
-	jwtClaims := gcontext.GetClaimsAsMap(ctx)
 
-	return item.Process(config, jwtClaims, order)
+	return item.Process(config, claims, order)
+}
+
+// pricingClaims returns the claims of the order user that member prices and
+// discounts of the order are calculated with. They're taken from the token
+// when the user places or changes the order themselves and kept on the order,
+// so an admin changing it doesn't price it with their own membership.
+func pricingClaims(ctx context.Context, order *models.Order) map[string]interface{} {
+	claims := gcontext.GetClaims(ctx)
+	if claims != nil && order.UserID != "" && claims.Subject == order.UserID && !claims.Impersonated() {
+		order.PricingClaims = gcontext.GetClaimsAsMap(ctx)
+	}
+	return order.PricingClaims
 }
 
+// orderQuery loads orders with their associations. Each association is
+// preloaded with a single IN query for all the orders found, so listing
+// orders takes the same number of queries no matter how many are listed.
 func orderQuery(db *gorm.DB) *gorm.DB {
 	return db.
 		Preload("LineItems").
 		Preload("Downloads").
 		Preload("ShippingAddress").
 		Preload("BillingAddress").
+		Preload("Shipments").
+		Preload("Shipments.ShippingAddress").
 		Preload("Transactions")
 }
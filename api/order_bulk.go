@@ -0,0 +1,111 @@
+package api
+
+import (
+	"net/http"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// MaxBulkFulfillmentOrders limits how many orders can be updated by a single request
+const MaxBulkFulfillmentOrders = 500
+
+type bulkFulfillmentParams struct {
+	OrderIDs         []string `json:"order_ids"`
+	FulfillmentState string   `json:"fulfillment_state"`
+}
+
+type bulkFulfillmentResult struct {
+	Success          bool   `json:"success"`
+	FulfillmentState string `json:"fulfillment_state,omitempty"`
+	Error            string `json:"error,omitempty"`
+}
+
+// OrderBulkFulfillment moves several orders to the same fulfillment state.
+// Each order is updated in its own transaction, so one failing order doesn't
+// affect the others. It is only available to admins.
+func (a *API) OrderBulkFulfillment(w http.ResponseWriter, r *http.Request) error {
+	params := new(bulkFulfillmentParams)
+	if err := decodeJSON(r, params); err != nil {
+		return badRequestError("Could not read bulk fulfillment parameters: %v", err)
+	}
+	if len(params.OrderIDs) == 0 {
+		return badRequestError("At least one order ID is required")
+	}
+	if len(params.OrderIDs) > MaxBulkFulfillmentOrders {
+		return badRequestError("At most %d orders can be updated at once", MaxBulkFulfillmentOrders)
+	}
+	if !validFulfillmentState(params.FulfillmentState) {
+		return badRequestError("Bad fulfillment state: " + params.FulfillmentState)
+	}
+
+	results := make(map[string]*bulkFulfillmentResult, len(params.OrderIDs))
+	for _, id := range params.OrderIDs {
+		if _, ok := results[id]; ok {
+			continue
+		}
+		result := &bulkFulfillmentResult{Success: true, FulfillmentState: params.FulfillmentState}
+		if httpErr := a.fulfillOrder(r, id, params.FulfillmentState); httpErr != nil {
+			result = &bulkFulfillmentResult{Error: httpErr.Message}
+		}
+		results[id] = result
+	}
+
+	return sendJSON(w, http.StatusOK, results)
+}
+
+func (a *API) fulfillOrder(r *http.Request, id string, state string) *HTTPError {
+	ctx := r.Context()
+	config := gcontext.GetConfig(ctx)
+	claims := gcontext.GetClaims(ctx)
+	log := getLogEntry(r).WithField("order_id", id)
+
+	tx := a.DB(r).Begin()
+	order := &models.Order{}
+	query := siteScope(ctx, orderQuery(tx), "").Where("instance_id = ?", gcontext.GetInstanceID(ctx))
+	if rsp := query.First(order, "id = ?", id); rsp.Error != nil {
+		tx.Rollback()
+		if rsp.RecordNotFound() {
+			return notFoundError("Order not found")
+		}
+		return internalServerError("Error while querying for order").WithInternalError(rsp.Error)
+	}
+	before, err := models.AuditSnapshot(order)
+	if err != nil {
+		tx.Rollback()
+		return internalServerError("Error while reading order").WithInternalError(err)
+	}
+
+	changes, httpErr := updateFulfillmentState(r, tx, order, state)
+	if httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+
+	rsp := tx.Model(order).Where("version = ?", order.Version).UpdateColumn("version", order.Version+1)
+	if rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error saving order updates").WithInternalError(rsp.Error)
+	}
+	if rsp.RowsAffected == 0 {
+		tx.Rollback()
+		return conflictError("The order has been modified by another request")
+	}
+	if rsp := tx.Save(order); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error saving order updates").WithInternalError(rsp.Error)
+	}
+
+	models.LogEvent(tx, r.RemoteAddr, claims.Subject, order.ID, models.EventUpdated, changes)
+	if err := models.RunHooks(tx, config, order.InstanceID, "update", config.Webhooks.Update, claims.Subject, order); err != nil {
+		log.WithError(err).Error("Failed to process web hook")
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error committing order updates").WithInternalError(rsp.Error)
+	}
+
+	a.audit(r, models.AuditOrderUpdate, order.ID, before, order)
+
+	log.Infof("Updated fulfillment state to %s", state)
+	return nil
+}
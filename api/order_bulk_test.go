@@ -0,0 +1,68 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestOrderBulkFulfillment(t *testing.T) {
+	t.Run("Simple", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		body := `{"order_ids": ["first-order", "missing-order", "` + test.Data.secondOrder.ID + `"], "fulfillment_state": "shipped"}`
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/fulfillment/bulk", strings.NewReader(body), token)
+
+		results := map[string]bulkFulfillmentResult{}
+		extractPayload(t, http.StatusOK, recorder, &results)
+		require.Len(t, results, 3)
+		assert.True(t, results["first-order"].Success)
+		assert.True(t, results[test.Data.secondOrder.ID].Success)
+		assert.False(t, results["missing-order"].Success)
+		assert.Equal(t, "Order not found", results["missing-order"].Error)
+
+		for _, id := range []string{"first-order", test.Data.secondOrder.ID} {
+			order := &models.Order{}
+			require.NoError(t, test.DB.First(order, "id = ?", id).Error)
+			assert.Equal(t, models.ShippedState, order.FulfillmentState)
+			assert.EqualValues(t, 1, order.Version)
+		}
+
+		notes := []models.OrderNote{}
+		require.NoError(t, test.DB.Where("order_id = ?", "first-order").Find(&notes).Error)
+		require.Len(t, notes, 1)
+		assert.Equal(t, models.ShippedTimelineEvent, notes[0].Event)
+	})
+
+	t.Run("BadState", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		body := `{"order_ids": ["first-order"], "fulfillment_state": "sunken"}`
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/fulfillment/bulk", strings.NewReader(body), token)
+		validateError(t, http.StatusBadRequest, recorder, "Bad fulfillment state")
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", "first-order").Error)
+		assert.Equal(t, models.PendingState, order.FulfillmentState)
+	})
+
+	t.Run("NoOrders", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		body := `{"order_ids": [], "fulfillment_state": "shipped"}`
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/fulfillment/bulk", strings.NewReader(body), token)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+
+	t.Run("NotAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		body := `{"order_ids": ["first-order"], "fulfillment_state": "shipped"}`
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/fulfillment/bulk", strings.NewReader(body), test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"net/http"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// OrderCancel cancels an unpaid order for its owner or an admin. Guests
+// cancel their anonymous orders with the token of a magic link or the email
+// of the order. The stock held by the order is released and the cancelled
+// webhook is called.
+func (a *API) OrderCancel(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	id := gcontext.GetOrderID(ctx)
+	config := gcontext.GetConfig(ctx)
+	log := getLogEntry(r).WithField("order_id", id)
+
+	tx := a.DB(r).Begin()
+	order := &models.Order{}
+	query := siteScope(ctx, orderQuery(tx), "").Where("instance_id = ?", gcontext.GetInstanceID(ctx))
+	if rsp := query.First(order, "id = ?", id); rsp.Error != nil {
+		tx.Rollback()
+		if rsp.RecordNotFound() {
+			return notFoundError("Order not found")
+		}
+		return internalServerError("Error while querying for order").WithInternalError(rsp.Error)
+	}
+	if !canWriteOrders(ctx) {
+		if httpErr := a.canAccessOrder(w, r, tx, order); httpErr != nil {
+			tx.Rollback()
+			return httpErr
+		}
+	}
+	actor := models.ActorCustomer
+	if canWriteOrders(ctx) {
+		actor = models.ActorAdmin
+	}
+	if httpErr := checkCancellable(order, actor); httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	before, err := models.AuditSnapshot(order)
+	if err != nil {
+		tx.Rollback()
+		return internalServerError("Error while reading order").WithInternalError(err)
+	}
+
+	rsp := tx.Model(&models.Order{}).Where("id = ? AND version = ?", order.ID, order.Version).
+		UpdateColumns(map[string]interface{}{
+			"payment_state": models.CancelledState,
+			"version":       order.Version + 1,
+		})
+	if rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error cancelling the order").WithInternalError(rsp.Error)
+	}
+	if rsp.RowsAffected == 0 {
+		tx.Rollback()
+		return conflictError("The order has been modified by another request, please reload it and try again")
+	}
+	order.PaymentState = models.CancelledState
+	order.Version++
+
+	if err := models.ReleaseReservations(tx, order.ID); err != nil {
+		tx.Rollback()
+		return internalServerError("Error releasing stock reservations").WithInternalError(err)
+	}
+	if err := models.ReleaseStock(tx, order); err != nil {
+		tx.Rollback()
+		return internalServerError("Error returning the items of the order to the stock").WithInternalError(err)
+	}
+	logTimeline(r, tx, order, models.CancelledTimelineEvent, "Order cancelled")
+
+	userID := ""
+	if claims := gcontext.GetClaims(ctx); claims != nil {
+		userID = claims.Subject
+	}
+	models.LogEvent(tx, r.RemoteAddr, userID, order.ID, models.EventUpdated, []string{"payment_state"})
+	if err := models.RunHooks(tx, config, order.InstanceID, "cancelled", config.Webhooks.Cancelled, order.UserID, order); err != nil {
+		log.WithError(err).Error("Failed to process web hook")
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error committing the cancellation").WithInternalError(rsp.Error)
+	}
+
+	cancelled := &models.Order{}
+	if rsp := orderQuery(a.DB(r)).First(cancelled, "id = ?", order.ID); rsp.Error != nil {
+		return internalServerError("Error while querying for cancelled order").WithInternalError(rsp.Error)
+	}
+	if canWriteOrders(ctx) && userID != order.UserID {
+		a.audit(r, models.AuditOrderCancel, order.ID, before, cancelled)
+	}
+
+	log.Info("Cancelled order")
+	w.Header().Set("ETag", orderETag(cancelled))
+	return sendJSON(w, http.StatusOK, cancelled)
+}
+
+// checkCancellable makes sure nothing has been paid for or shipped with the
+// order, which has to be refunded or returned rather than cancelled, and that
+// no payment is still being made, e.g. waiting for 3D Secure.
+func checkCancellable(order *models.Order, actor models.StateActor) *HTTPError {
+	switch order.PaymentState {
+	case models.CancelledState:
+		return badRequestError("This order has already been cancelled")
+	case models.PaidState, models.DisputedState:
+		return badRequestError("Paid orders can't be cancelled, refund the payment with POST /payments/:id/refund instead")
+	}
+	if httpErr := checkTransition(models.PaymentStateMachine, "payment state", order.PaymentState, models.CancelledState, actor); httpErr != nil {
+		return httpErr
+	}
+	for _, tr := range order.Transactions {
+		if tr.Type != models.ChargeTransactionType {
+			continue
+		}
+		switch tr.Status {
+		case models.PaidState:
+			return badRequestError("This order has been paid, refund the payment with POST /payments/%s/refund instead", tr.ID)
+		case models.PendingState:
+			return badRequestError("The payment %s of this order is still pending, it has to complete or fail before the order can be cancelled", tr.ID)
+		}
+	}
+	if order.FulfillmentState == models.ShippingState || order.FulfillmentState == models.ShippedState {
+		return badRequestError("Orders that are being shipped can't be cancelled")
+	}
+	return nil
+}
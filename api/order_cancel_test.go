@@ -0,0 +1,137 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func unpayFirstOrder(t *testing.T, test *RouteTest) {
+	test.Data.firstOrder.PaymentState = models.PendingState
+	test.Data.firstOrder.StockHeld = true
+	require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+	require.NoError(t, test.DB.Model(test.Data.firstTransaction).UpdateColumn("status", models.FailedState).Error)
+	require.NoError(t, test.DB.Save(&models.Stock{Sku: "123-i-can-fly-456", Quantity: 5}).Error)
+}
+
+func TestOrderCancel(t *testing.T) {
+	t.Run("Owner", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Webhooks.Cancelled = "https://example.com/cancelled"
+		unpayFirstOrder(t, test)
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/cancel", nil, test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Equal(t, models.CancelledState, order.PaymentState)
+		assert.Equal(t, orderETag(order), recorder.Header().Get("ETag"))
+
+		stored := &models.Order{}
+		require.NoError(t, test.DB.First(stored, "id = ?", "first-order").Error)
+		assert.Equal(t, models.CancelledState, stored.PaymentState)
+		assert.False(t, stored.StockHeld)
+
+		stock := &models.Stock{}
+		require.NoError(t, test.DB.First(stock, "sku = ?", "123-i-can-fly-456").Error)
+		assert.EqualValues(t, 7, stock.Quantity)
+
+		notes := []models.OrderNote{}
+		require.NoError(t, test.DB.Where("order_id = ? AND event = ?", "first-order", models.CancelledTimelineEvent).Find(&notes).Error)
+		assert.Len(t, notes, 1)
+
+		hooks := []models.Hook{}
+		require.NoError(t, test.DB.Where("type = ?", "cancelled").Find(&hooks).Error)
+		require.Len(t, hooks, 1)
+		assert.Equal(t, "https://example.com/cancelled", hooks[0].URL)
+
+		var audited int
+		require.NoError(t, test.DB.Model(&models.AuditLog{}).Where("action = ?", models.AuditOrderCancel).Count(&audited).Error)
+		assert.Equal(t, 0, audited)
+
+		recorder = test.TestEndpoint(http.MethodPost, "/orders/first-order/cancel", nil, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "already been cancelled")
+
+		body := strings.NewReader(`{"provider": "stripe", "amount": 24, "currency": "USD", "stripe_payment_method_id": "pm_card"}`)
+		recorder = test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", body, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "cancelled")
+	})
+
+	t.Run("Admin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		unpayFirstOrder(t, test)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/cancel", nil, token)
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Equal(t, models.CancelledState, order.PaymentState)
+
+		entry := &models.AuditLog{}
+		require.NoError(t, test.DB.First(entry, "action = ?", models.AuditOrderCancel).Error)
+		assert.Equal(t, "first-order", entry.TargetID)
+	})
+
+	t.Run("Paid", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/cancel", nil, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "refund")
+	})
+
+	t.Run("PaidAfterAbandoned", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.firstOrder.PaymentState = models.AbandonedState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/cancel", nil, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "/payments/first-trans/refund")
+	})
+
+	t.Run("Guest", func(t *testing.T) {
+		test := NewRouteTest(t)
+		unpayFirstOrder(t, test)
+		require.NoError(t, test.DB.Model(test.Data.firstOrder).UpdateColumn("user_id", "").Error)
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/cancel", nil, nil)
+		validateError(t, http.StatusNotFound, recorder)
+		recorder = test.TestEndpoint(http.MethodPost, "/orders/first-order/cancel?email=guess@example.com", nil, nil)
+		validateError(t, http.StatusNotFound, recorder)
+
+		recorder = test.TestEndpoint(http.MethodPost, "/orders/first-order/cancel?email="+url.QueryEscape(test.Data.firstOrder.Email), nil, nil)
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Equal(t, models.CancelledState, order.PaymentState)
+	})
+
+	t.Run("PendingPayment", func(t *testing.T) {
+		test := NewRouteTest(t)
+		unpayFirstOrder(t, test)
+		require.NoError(t, test.DB.Model(test.Data.firstTransaction).UpdateColumn("status", models.PendingState).Error)
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/cancel", nil, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "still pending")
+	})
+
+	t.Run("Authorized", func(t *testing.T) {
+		test := NewRouteTest(t)
+		unpayFirstOrder(t, test)
+		require.NoError(t, test.DB.Model(test.Data.firstOrder).UpdateColumn("payment_state", models.AuthorizedState).Error)
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/cancel", nil, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "from 'authorized' to 'cancelled'")
+	})
+
+	t.Run("NoAccess", func(t *testing.T) {
+		test := NewRouteTest(t)
+		unpayFirstOrder(t, test)
+		token := testToken("stranger", "stranger@example.com")
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/cancel", nil, token)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
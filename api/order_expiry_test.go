@@ -0,0 +1,151 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func abandonFirstOrder(t *testing.T, test *RouteTest) {
+	test.Config.Expiry.TTL = 60
+	test.Data.firstOrder.PaymentState = models.PendingState
+	require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+	require.NoError(t, test.DB.Model(test.Data.firstOrder).UpdateColumn("created_at", time.Now().Add(-2*time.Hour)).Error)
+
+	expired, err := models.ExpireOrders(test.DB, "", test.Config, logrus.StandardLogger())
+	require.NoError(t, err)
+	require.Equal(t, 1, expired)
+}
+
+func TestOrderExpiry(t *testing.T) {
+	t.Run("Abandoned", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Webhooks.Abandoned = "https://example.com/abandoned"
+		abandonFirstOrder(t, test)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", "first-order").Error)
+		assert.Equal(t, models.AbandonedState, order.PaymentState)
+
+		notes := []models.OrderNote{}
+		require.NoError(t, test.DB.Where("order_id = ? AND event = ?", "first-order", models.AbandonedTimelineEvent).Find(&notes).Error)
+		assert.Len(t, notes, 1)
+
+		hooks := []models.Hook{}
+		require.NoError(t, test.DB.Where("type = ?", "abandoned").Find(&hooks).Error)
+		require.Len(t, hooks, 1)
+		assert.Equal(t, "https://example.com/abandoned", hooks[0].URL)
+
+		expired, err := models.ExpireOrders(test.DB, "", test.Config, logrus.StandardLogger())
+		require.NoError(t, err)
+		assert.Equal(t, 0, expired)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		test := NewRouteTest(t)
+		require.NoError(t, test.DB.Model(test.Data.secondOrder).UpdateColumn("created_at", time.Now().Add(-2*time.Hour)).Error)
+
+		expired, err := models.ExpireOrders(test.DB, "", test.Config, logrus.StandardLogger())
+		require.NoError(t, err)
+		assert.Equal(t, 0, expired)
+	})
+
+	t.Run("Restock", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Expiry.Restock = true
+		test.Data.firstOrder.StockHeld = true
+		require.NoError(t, test.DB.Save(&models.Stock{Sku: "123-i-can-fly-456", Quantity: 5}).Error)
+		abandonFirstOrder(t, test)
+
+		stock := &models.Stock{}
+		require.NoError(t, test.DB.First(stock, "sku = ?", "123-i-can-fly-456").Error)
+		assert.EqualValues(t, 7, stock.Quantity)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", "first-order").Error)
+		assert.False(t, order.StockHeld)
+	})
+
+	t.Run("GiftCardHeld", func(t *testing.T) {
+		test := NewRouteTest(t)
+		card := models.NewGiftCard("", "", 0, "USD", "")
+		require.NoError(t, test.DB.Create(card).Error)
+		credit := models.NewTransaction(test.Data.firstOrder)
+		credit.Amount = 10
+		credit.Currency = "USD"
+		credit.GiftCardID = card.ID
+		credit.Status = models.PendingState
+		require.NoError(t, test.DB.Create(credit).Error)
+		abandonFirstOrder(t, test)
+
+		require.NoError(t, test.DB.First(card, "id = ?", card.ID).Error)
+		assert.EqualValues(t, 10, card.Balance)
+		require.NoError(t, test.DB.First(credit, "id = ?", credit.ID).Error)
+		assert.Equal(t, models.FailedState, credit.Status)
+	})
+
+	t.Run("PaymentRejected", func(t *testing.T) {
+		test := NewRouteTest(t)
+		abandonFirstOrder(t, test)
+
+		body := strings.NewReader(`{"provider": "stripe", "amount": 24, "currency": "USD", "stripe_payment_method_id": "pm_card"}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", body, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "abandoned")
+	})
+
+	t.Run("LatePayment", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Payment.Stripe.WebhookSecret = testStripeWebhookSecret
+		setupPendingTransaction(t, test)
+		abandonFirstOrder(t, test)
+
+		recorder := sendStripeWebhook(test, "charge.succeeded", `{"id": "ch_1", "object": "charge", "captured": true, "payment_intent": "`+stripePaymentIntentID+`"}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		trans := &models.Transaction{}
+		require.NoError(t, test.DB.First(trans, "id = ?", test.Data.firstTransaction.ID).Error)
+		assert.Equal(t, models.PaidState, trans.Status)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", "first-order").Error)
+		assert.Equal(t, models.AbandonedState, order.PaymentState)
+	})
+}
+
+func TestOrderReopen(t *testing.T) {
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	t.Run("Unpaid", func(t *testing.T) {
+		test := NewRouteTest(t)
+		require.NoError(t, test.DB.Model(test.Data.firstTransaction).UpdateColumn("status", models.PendingState).Error)
+		abandonFirstOrder(t, test)
+
+		recorder := runOrderUpdate(test, test.Data.firstOrder, &orderRequestParams{PaymentState: models.PendingState}, token)
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Equal(t, models.PendingState, order.PaymentState)
+	})
+
+	t.Run("PaidWhileAbandoned", func(t *testing.T) {
+		test := NewRouteTest(t)
+		abandonFirstOrder(t, test)
+
+		recorder := runOrderUpdate(test, test.Data.firstOrder, &orderRequestParams{PaymentState: models.PendingState}, token)
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Equal(t, models.PaidState, order.PaymentState)
+	})
+
+	t.Run("NotAbandoned", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := runOrderUpdate(test, test.Data.firstOrder, &orderRequestParams{PaymentState: models.PendingState}, token)
+		validateError(t, http.StatusBadRequest, recorder, "abandoned")
+	})
+}
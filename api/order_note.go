@@ -0,0 +1,99 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/jinzhu/gorm"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+type orderNoteParams struct {
+	Text     string `json:"text"`
+	Internal bool   `json:"internal"`
+}
+
+// OrderNoteList lists the notes and timeline of an order. Customers only see
+// the notes that aren't internal.
+func (a *API) OrderNoteList(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	id := gcontext.GetOrderID(ctx)
+	db := a.ReadDB(r)
+
+	order := &models.Order{}
+	if rsp := siteScope(ctx, db, "").Where("instance_id = ?", gcontext.GetInstanceID(ctx)).First(order, "id = ?", id); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return notFoundError("Order not found")
+		}
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	if !canReadOrders(ctx) {
+		if httpErr := a.canAccessOrder(w, r, db, order); httpErr != nil {
+			return httpErr
+		}
+	}
+
+	query := db.Where("order_id = ?", order.ID)
+	if !canReadOrders(ctx) {
+		query = query.Where("internal = ?", false)
+	}
+
+	notes := []*models.OrderNote{}
+	if rsp := query.Order("created_at asc, id asc").Find(&notes); rsp.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+
+	return sendJSON(w, http.StatusOK, notes)
+}
+
+// OrderNoteCreate adds a note to an order. It requires admin access
+func (a *API) OrderNoteCreate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	id := gcontext.GetOrderID(ctx)
+	db := a.DB(r)
+
+	params := new(orderNoteParams)
+	if err := decodeJSON(r, params); err != nil {
+		return badRequestError("Failed to parse json body: %v", err)
+	}
+	if params.Text == "" {
+		return badRequestError("An order note requires a text")
+	}
+
+	order := &models.Order{}
+	if rsp := siteScope(ctx, db, "").Where("instance_id = ?", gcontext.GetInstanceID(ctx)).First(order, "id = ?", id); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return notFoundError("Order not found")
+		}
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+
+	claims := gcontext.GetClaims(ctx)
+	note := &models.OrderNote{
+		OrderID:  order.ID,
+		UserID:   claims.Subject,
+		Author:   claims.Email,
+		Text:     params.Text,
+		Internal: params.Internal,
+	}
+	if rsp := db.Create(note); rsp.Error != nil {
+		return internalServerError("failed to save order note").WithInternalError(rsp.Error)
+	}
+
+	getLogEntry(r).WithField("note_id", note.ID).Info("created order note")
+	return sendJSON(w, http.StatusCreated, note)
+}
+
+// logTimeline records an order state transition, attributed to the user
+// making the request if there is one.
+func logTimeline(r *http.Request, tx *gorm.DB, order *models.Order, event string, text string, args ...interface{}) {
+	var userID, author string
+	if claims := gcontext.GetClaims(r.Context()); claims != nil {
+		userID = claims.Subject
+		author = claims.Email
+	}
+	if err := models.LogTimeline(tx, order.ID, userID, author, event, fmt.Sprintf(text, args...)); err != nil {
+		getLogEntry(r).WithError(err).Error("Failed to record order timeline")
+	}
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	stripe "github.com/stripe/stripe-go"
+
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+)
+
+func TestOrderNotes(t *testing.T) {
+	t.Run("Visibility", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/notes", strings.NewReader(`{"text": "Suspicious address", "internal": true}`), token)
+		note := &models.OrderNote{}
+		extractPayload(t, http.StatusCreated, recorder, note)
+		assert.Equal(t, "admin-yo", note.UserID)
+		assert.Equal(t, "admin@wayneindustries.com", note.Author)
+		assert.True(t, note.Internal)
+
+		recorder = test.TestEndpoint(http.MethodPost, "/orders/first-order/notes", strings.NewReader(`{"text": "Your order is delayed"}`), token)
+		extractPayload(t, http.StatusCreated, recorder, &models.OrderNote{})
+
+		recorder = test.TestEndpoint(http.MethodGet, "/orders/first-order/notes", nil, test.Data.testUserToken)
+		notes := []models.OrderNote{}
+		extractPayload(t, http.StatusOK, recorder, &notes)
+		require.Len(t, notes, 1)
+		assert.Equal(t, "Your order is delayed", notes[0].Text)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/orders/first-order/notes", nil, token)
+		notes = []models.OrderNote{}
+		extractPayload(t, http.StatusOK, recorder, &notes)
+		require.Len(t, notes, 2)
+		assert.Equal(t, "Suspicious address", notes[0].Text)
+	})
+
+	t.Run("NotAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/notes", strings.NewReader(`{"text": "Hello"}`), test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+
+	t.Run("OtherUser", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/first-order/notes", nil, testToken("joker", "joker@example.com"))
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+
+	t.Run("MissingText", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/notes", strings.NewReader(`{"internal": true}`), token)
+		validateError(t, http.StatusBadRequest, recorder, "text")
+	})
+
+	t.Run("ShippedTimeline", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := runOrderUpdate(test, test.Data.firstOrder, &orderRequestParams{FulfillmentState: models.ShippedState}, token)
+		extractPayload(t, http.StatusOK, recorder, &models.Order{})
+
+		recorder = test.TestEndpoint(http.MethodGet, "/orders/first-order/notes", nil, test.Data.testUserToken)
+		notes := []models.OrderNote{}
+		extractPayload(t, http.StatusOK, recorder, &notes)
+		require.Len(t, notes, 1)
+		assert.Equal(t, models.ShippedTimelineEvent, notes[0].Event)
+		assert.Equal(t, "admin@wayneindustries.com", notes[0].Author)
+	})
+
+	t.Run("PaidTimeline", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.firstOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+			intent := v.(*stripe.PaymentIntent)
+			intent.ID = stripePaymentIntentID
+			intent.Status = stripe.PaymentIntentStatusSucceeded
+			return nil
+		}))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		body := strings.NewReader(`{"provider": "stripe", "amount": 24, "currency": "USD", "stripe_payment_method_id": "pm_card"}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", body, test.Data.testUserToken)
+		extractPayload(t, http.StatusOK, recorder, &models.Transaction{})
+
+		notes := []models.OrderNote{}
+		require.NoError(t, test.DB.Where("order_id = ?", "first-order").Find(&notes).Error)
+		require.Len(t, notes, 1)
+		assert.Equal(t, models.PaidTimelineEvent, notes[0].Event)
+		assert.Equal(t, "Payment of 24 USD received", notes[0].Text)
+		assert.Equal(t, test.Data.testUser.ID, notes[0].UserID)
+	})
+
+	t.Run("RefundedTimeline", func(t *testing.T) {
+		test := NewRouteTest(t)
+		provider := &memProvider{name: payments.StripeProvider}
+		recorder := runProviderRefund(test, provider, test.Data.firstTransaction.ID, &PaymentParams{Amount: 10, Currency: "USD"})
+		extractPayload(t, http.StatusOK, recorder, &models.Transaction{})
+
+		notes := []models.OrderNote{}
+		require.NoError(t, test.DB.Where("order_id = ?", "first-order").Find(&notes).Error)
+		require.Len(t, notes, 1)
+		assert.Equal(t, models.RefundedTimelineEvent, notes[0].Event)
+		assert.Equal(t, "Refunded 10 USD", notes[0].Text)
+		assert.False(t, notes[0].Internal)
+	})
+}
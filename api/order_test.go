@@ -2,6 +2,7 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -13,12 +14,15 @@ import (
 
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/netlify/gocommerce/calculator"
 	"github.com/netlify/gocommerce/claims"
 	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
 	"github.com/stretchr/testify/require"
+	stripe "github.com/stripe/stripe-go"
 )
 
 func createOrder(test *RouteTest, email, currency string) *models.Order {
@@ -54,6 +58,30 @@ func createOrder(test *RouteTest, email, currency string) *models.Order {
 // CREATE
 // ------------------------------------------------------------------------------------------------
 
+const couponOrderPayload = `{
+	"email": "info@example.com",
+	"shipping_address": {
+		"name": "Test User",
+		"address1": "610 22nd Street",
+		"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+	},
+	"line_items": [{"path": "/simple-product", "quantity": 1}],
+	"coupons": COUPONS
+}`
+
+func startStackableCouponList() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{
+			"coupons": {
+				"TEN": {"percentage": 10},
+				"FIVE": {"percentage": 5},
+				"SOLO": {"percentage": 20, "exclusive": true},
+				"SHIP": {"type": "free_shipping"}
+			}
+		}`)
+	}))
+}
+
 const defaultPayload = `{
 	"email": "info@example.com",
 	"shipping_address": {
@@ -95,6 +123,101 @@ func TestOrderCreate(t *testing.T) {
 		assert.Equal(t, stored.UserID, order.UserID)
 	})
 
+	t.Run("Currency", func(t *testing.T) {
+		createWithCurrency := func(test *RouteTest, currency interface{}) *httptest.ResponseRecorder {
+			payload := map[string]interface{}{}
+			require.NoError(t, json.Unmarshal([]byte(defaultPayload), &payload))
+			if currency != nil {
+				payload["currency"] = currency
+			}
+			body, err := json.Marshal(payload)
+			require.NoError(t, err)
+			return test.TestEndpoint(http.MethodPost, "/orders", bytes.NewReader(body), test.Data.testUserToken)
+		}
+
+		t.Run("Normalized", func(t *testing.T) {
+			test := NewRouteTest(t)
+			test.Config.SiteURL = server.URL
+			order := &models.Order{}
+			extractPayload(t, http.StatusCreated, createWithCurrency(test, "usd"), order)
+			assert.Equal(t, "USD", order.Currency)
+		})
+		t.Run("Default", func(t *testing.T) {
+			test := NewRouteTest(t)
+			test.Config.SiteURL = server.URL
+			test.Config.DefaultCurrency = "usd"
+			order := &models.Order{}
+			extractPayload(t, http.StatusCreated, createWithCurrency(test, nil), order)
+			assert.Equal(t, "USD", order.Currency)
+		})
+		t.Run("Unknown", func(t *testing.T) {
+			test := NewRouteTest(t)
+			test.Config.SiteURL = server.URL
+			validateError(t, http.StatusBadRequest, createWithCurrency(test, "monopoly-dollars"), "Unknown currency")
+		})
+	})
+
+	t.Run("Tip", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		payload := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal([]byte(defaultPayload), &payload))
+		payload["tip"] = 100
+		body, err := json.Marshal(payload)
+		require.NoError(t, err)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", bytes.NewReader(body), test.Data.testUserToken)
+
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.EqualValues(t, 100, order.Tip)
+		assert.EqualValues(t, 1099, order.Total)
+		assert.Equal(t, order.Total, order.NetTotal+order.Taxes+order.Shipping+order.Tip)
+	})
+
+	t.Run("SettlementCurrency", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.Settlement.Currency = "USD"
+		test.Config.Settlement.Rates = map[string]float64{"EUR": 1.2}
+		body := strings.NewReader(`{
+			"email": "info@example.com",
+			"currency": "EUR",
+			"shipping_address": {
+				"name": "Test User",
+				"address1": "610 22nd Street",
+				"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+			},
+			"line_items": [{"path": "/multi-currency-product", "quantity": 1}]
+		}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Equal(t, "EUR", order.Currency)
+		assert.Equal(t, uint64(899), order.Total)
+		assert.Equal(t, "USD", order.SettlementCurrency)
+		assert.Equal(t, uint64(1079), order.SettlementTotal)
+		assert.Equal(t, 1.2, order.ExchangeRate)
+	})
+
+	t.Run("SettlementCurrencyWithoutRate", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.Settlement.Currency = "USD"
+		body := strings.NewReader(`{
+			"email": "info@example.com",
+			"currency": "EUR",
+			"shipping_address": {
+				"name": "Test User",
+				"address1": "610 22nd Street",
+				"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+			},
+			"line_items": [{"path": "/multi-currency-product", "quantity": 1}]
+		}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+
 	t.Run("NameBackwardsCompatible", func(t *testing.T) {
 		test := NewRouteTest(t)
 		test.Config.SiteURL = server.URL
@@ -208,6 +331,123 @@ func TestOrderCreate(t *testing.T) {
 		assert.Equal(t, uint64(0), discountItem.Fixed)
 	})
 
+	t.Run("StackedCoupons", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		couponServer := startStackableCouponList()
+		defer couponServer.Close()
+		test.Config.Coupons.URL = couponServer.URL
+		test.Config.Coupons.Stacking = true
+
+		body := strings.Replace(couponOrderPayload, "COUPONS", `["TEN", "FIVE"]`, 1)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(body), test.Data.testUserToken)
+
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Equal(t, []string{"TEN", "FIVE"}, order.CouponCodes)
+		assert.Equal(t, "TEN", order.CouponCode)
+		assert.Equal(t, uint64(150), order.Discount)
+		assert.Equal(t, uint64(849), order.Total)
+		assert.Len(t, order.LineItems[0].CalculationDetail.DiscountItems, 2)
+
+		saved := &models.Order{}
+		require.NoError(t, orderQuery(test.DB).First(saved, "id = ?", order.ID).Error)
+		assert.Equal(t, []string{"TEN", "FIVE"}, saved.CouponCodes)
+	})
+
+	t.Run("CouponReplacedWithoutStacking", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		couponServer := startStackableCouponList()
+		defer couponServer.Close()
+		test.Config.Coupons.URL = couponServer.URL
+
+		body := strings.Replace(couponOrderPayload, "COUPONS", `["TEN", "FIVE"]`, 1)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(body), test.Data.testUserToken)
+
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Equal(t, []string{"FIVE"}, order.CouponCodes)
+		assert.Equal(t, uint64(50), order.Discount)
+		assert.Equal(t, uint64(949), order.Total)
+	})
+
+	t.Run("ExclusiveCoupon", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		couponServer := startStackableCouponList()
+		defer couponServer.Close()
+		test.Config.Coupons.URL = couponServer.URL
+		test.Config.Coupons.Stacking = true
+
+		body := strings.Replace(couponOrderPayload, "COUPONS", `["TEN", "SOLO"]`, 1)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(body), test.Data.testUserToken)
+
+		httpErr := &HTTPError{}
+		extractPayload(t, http.StatusBadRequest, recorder, httpErr)
+		assert.Equal(t, "coupon_not_stackable", httpErr.ErrorCode)
+	})
+
+	t.Run("DuplicateCoupon", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		couponServer := startStackableCouponList()
+		defer couponServer.Close()
+		test.Config.Coupons.URL = couponServer.URL
+		test.Config.Coupons.Stacking = true
+
+		body := strings.Replace(couponOrderPayload, "COUPONS", `["TEN", "TEN"]`, 1)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(body), test.Data.testUserToken)
+
+		httpErr := &HTTPError{}
+		extractPayload(t, http.StatusBadRequest, recorder, httpErr)
+		assert.Equal(t, "coupon_already_applied", httpErr.ErrorCode)
+	})
+
+	t.Run("FreeShippingCoupon", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		couponServer := startStackableCouponList()
+		defer couponServer.Close()
+		test.Config.Coupons.URL = couponServer.URL
+		test.Config.Coupons.Stacking = true
+
+		body := strings.Replace(couponOrderPayload, "COUPONS", `["SHIP", "TEN"]`, 1)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(body), test.Data.testUserToken)
+
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.True(t, order.FreeShipping())
+		assert.Equal(t, uint64(0), order.Shipping)
+		assert.Equal(t, uint64(100), order.Discount)
+		assert.Equal(t, uint64(899), order.Total)
+	})
+
+	t.Run("WithShipping", func(t *testing.T) {
+		test := NewRouteTest(t)
+		settings := calculator.Settings{Shipping: &calculator.ShippingSettings{Rates: []*calculator.ShippingRate{{
+			Type:      calculator.WeightShipping,
+			Countries: []string{"USA"},
+			Tiers: []*calculator.ShippingTier{
+				{MaxWeight: 500, Prices: []*calculator.ShippingPrice{{Amount: "5.00", Currency: "USD"}}},
+				{Prices: []*calculator.ShippingPrice{{Amount: "8.00", Currency: "USD"}}},
+			},
+		}}}}
+		site := startTestSiteWithSettings(settings)
+		defer site.Close()
+		test.Config.SiteURL = site.URL
+
+		body := strings.Replace(couponOrderPayload, `"coupons": COUPONS`, `"coupons": []`, 1)
+		body = strings.Replace(body, `"quantity": 1`, `"quantity": 2`, 1)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(body), test.Data.testUserToken)
+
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Equal(t, uint64(500), order.LineItems[0].Weight)
+		assert.Equal(t, uint64(800), order.Shipping)
+		assert.Equal(t, uint64(2*999+800), order.Total)
+	})
+
 	t.Run("WithMemberDiscount", func(t *testing.T) {
 		test := NewRouteTest(t)
 
@@ -389,6 +629,99 @@ func TestOrderCreateNewUser(t *testing.T) {
 	})
 }
 
+func TestOrderCreateMergeSessions(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+
+	payload := `{
+		"email": "villian@wayneindustries.com",
+		"session_id": "session1",
+		"shipping_address": {
+			"name": "Test User",
+			"address1": "610 22nd Street",
+			"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+		},
+		"line_items": [{"path": "/simple-product", "quantity": 1}]
+	}`
+
+	// the first order is an unpaid guest order of the session, the second a
+	// paid one, the third belongs to somebody else and the fourth is a guest
+	// order placed with another email
+	setupSession := func(test *RouteTest) (*models.Order, *models.Order) {
+		test.Data.firstOrder.UserID = ""
+		test.Data.firstOrder.User = nil
+		test.Data.firstOrder.Email = "villian@wayneindustries.com"
+		test.Data.firstOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+		test.Data.secondOrder.UserID = ""
+		test.Data.secondOrder.User = nil
+		test.Data.secondOrder.SessionID = "session1"
+		require.NoError(t, test.DB.Save(test.Data.secondOrder).Error)
+		require.NoError(t, test.DB.Model(&models.Address{}).Where("id = ?", test.Data.testAddress.ID).UpdateColumn("user_id", "").Error)
+
+		other := models.NewOrder("", "session1", "joker@example.com", "USD")
+		other.UserID = "joker"
+		require.NoError(t, test.DB.Create(other).Error)
+
+		guest := models.NewOrder("", "session1", "joker@example.com", "USD")
+		require.NoError(t, test.DB.Create(guest).Error)
+		return other, guest
+	}
+
+	userOf := func(test *RouteTest, id string) string {
+		stored := &models.Order{}
+		require.NoError(t, test.DB.First(stored, "id = ?", id).Error)
+		return stored.UserID
+	}
+
+	t.Run("Enabled", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.Orders.MergeSessions = true
+		other, guest := setupSession(test)
+
+		token := testToken("villian", "villian@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(payload), token)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Equal(t, "villian", order.UserID)
+
+		assert.Equal(t, "villian", userOf(test, test.Data.firstOrder.ID))
+		assert.Equal(t, "", userOf(test, test.Data.secondOrder.ID))
+		assert.Equal(t, "joker", userOf(test, other.ID))
+		assert.Equal(t, "", userOf(test, guest.ID))
+
+		address := &models.Address{ID: test.Data.testAddress.ID}
+		require.NoError(t, test.DB.First(address).Error)
+		assert.Equal(t, "villian", address.UserID)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		setupSession(test)
+
+		token := testToken("villian", "villian@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(payload), token)
+		extractPayload(t, http.StatusCreated, recorder, &models.Order{})
+
+		assert.Equal(t, "", userOf(test, test.Data.firstOrder.ID))
+	})
+
+	t.Run("Anonymous", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.Orders.MergeSessions = true
+		setupSession(test)
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(payload), nil)
+		extractPayload(t, http.StatusCreated, recorder, &models.Order{})
+
+		assert.Equal(t, "", userOf(test, test.Data.firstOrder.ID))
+	})
+}
+
 // ------------------------------------------------------------------------------------------------
 // LIST
 // ------------------------------------------------------------------------------------------------
@@ -424,15 +757,48 @@ func TestOrdersList(t *testing.T) {
 			test := NewRouteTest(t)
 			token := test.Data.testUserToken
 			recorder := test.TestEndpoint(http.MethodGet, "/orders?email=bruce", nil, token)
+			validateError(t, http.StatusUnauthorized, recorder, "admin")
+		})
+		t.Run("NameFilterAsTheUser", func(t *testing.T) {
+			test := NewRouteTest(t)
+			token := test.Data.testUserToken
+			recorder := test.TestEndpoint(http.MethodGet, "/orders?name=wayne", nil, token)
+			validateError(t, http.StatusUnauthorized, recorder, "admin")
+		})
+		t.Run("EmailFilterAsAdmin", func(t *testing.T) {
+			test := NewRouteTest(t)
+			token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+			recorder := test.TestEndpoint(http.MethodGet, "/users/all/orders?email=BRUCE@Wayne", nil, token)
 
 			orders := []models.Order{}
 			extractPayload(t, http.StatusOK, recorder, &orders)
 			assert.Len(t, orders, 2)
 		})
-		t.Run("EmailFilterAsTheUserEmptyResponse", func(t *testing.T) {
+		t.Run("EmailFilterAsAdminEmptyResponse", func(t *testing.T) {
 			test := NewRouteTest(t)
-			token := test.Data.testUserToken
-			recorder := test.TestEndpoint(http.MethodGet, "/orders?email=gmail.com", nil, token)
+			token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+			recorder := test.TestEndpoint(http.MethodGet, "/users/all/orders?email=gmail.com", nil, token)
+
+			orders := []models.Order{}
+			extractPayload(t, http.StatusOK, recorder, &orders)
+			assert.Len(t, orders, 0)
+		})
+		t.Run("NameFilterAsAdmin", func(t *testing.T) {
+			test := NewRouteTest(t)
+			token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+			recorder := test.TestEndpoint(http.MethodGet, "/users/all/orders?name=WAY&per_page=1", nil, token)
+
+			orders := []models.Order{}
+			extractPayload(t, http.StatusOK, recorder, &orders)
+			require.Len(t, orders, 1)
+			assert.Contains(t, []string{test.Data.firstOrder.ID, test.Data.secondOrder.ID}, orders[0].ID)
+			assert.Equal(t, test.Data.firstOrder.Email, orders[0].Email)
+			assert.Equal(t, "2", recorder.Header().Get("X-Total-Count"))
+		})
+		t.Run("NameFilterAsAdminEmptyResponse", func(t *testing.T) {
+			test := NewRouteTest(t)
+			token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+			recorder := test.TestEndpoint(http.MethodGet, "/users/all/orders?name=parker", nil, token)
 
 			orders := []models.Order{}
 			extractPayload(t, http.StatusOK, recorder, &orders)
@@ -447,6 +813,36 @@ func TestOrdersList(t *testing.T) {
 			extractPayload(t, http.StatusOK, recorder, &orders)
 			assert.Len(t, orders, 1)
 		})
+		t.Run("SkuFilterAsTheUser", func(t *testing.T) {
+			test := NewRouteTest(t)
+			recorder := test.TestEndpoint(http.MethodGet, "/orders?sku=123-i-can-fly-456", nil, test.Data.testUserToken)
+			validateError(t, http.StatusUnauthorized, recorder, "admin")
+		})
+		t.Run("SkuFilterAsAdmin", func(t *testing.T) {
+			test := NewRouteTest(t)
+			token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+			// a second line item with the same SKU doesn't list the order twice
+			item := &models.LineItem{OrderID: test.Data.firstOrder.ID, Sku: test.Data.firstLineItem.Sku, Title: "Extra", Price: 12, Quantity: 1}
+			require.NoError(t, test.DB.Create(item).Error)
+
+			recorder := test.TestEndpoint(http.MethodGet, "/users/all/orders?sku="+test.Data.firstLineItem.Sku, nil, token)
+			orders := []models.Order{}
+			extractPayload(t, http.StatusOK, recorder, &orders)
+			require.Len(t, orders, 1)
+			assert.Equal(t, test.Data.firstOrder.ID, orders[0].ID)
+			assert.Equal(t, "1", recorder.Header().Get("X-Total-Count"))
+
+			skus := test.Data.firstLineItem.Sku + "," + test.Data.secondLineItem2.Sku
+			recorder = test.TestEndpoint(http.MethodGet, "/users/all/orders?sku="+skus, nil, token)
+			extractPayload(t, http.StatusOK, recorder, &orders)
+			assert.Len(t, orders, 2)
+
+			url := fmt.Sprintf("/users/all/orders?sku=%s&from=%d", skus, time.Now().Add(time.Hour).Unix())
+			recorder = test.TestEndpoint(http.MethodGet, url, nil, token)
+			extractPayload(t, http.StatusOK, recorder, &orders)
+			assert.Len(t, orders, 0)
+		})
 		t.Run("BillingNameFilterAsTheUser", func(t *testing.T) {
 			test := NewRouteTest(t)
 			token := test.Data.testUserToken
@@ -728,14 +1124,49 @@ func TestOrderView(t *testing.T) {
 		test.Data.firstOrder.UserID = ""
 		rsp := test.DB.Save(test.Data.firstOrder)
 		require.NoError(t, rsp.Error, "Failed to update order")
+
+		// guests need the email of the order
 		recorder := test.TestEndpoint(http.MethodGet, test.Data.urlForFirstOrder, nil, nil)
+		validateError(t, http.StatusNotFound, recorder)
+		recorder = test.TestEndpoint(http.MethodGet, test.Data.urlForFirstOrder, nil, test.Data.testUserToken)
+		validateError(t, http.StatusNotFound, recorder)
 
+		recorder = test.TestEndpoint(http.MethodGet, test.Data.urlForFirstOrder+"?email="+url.QueryEscape(test.Data.firstOrder.Email), nil, nil)
 		order := new(models.Order)
 		extractPayload(t, http.StatusOK, recorder, order)
 		validateOrder(t, test.Data.firstOrder, order)
 		validateAddress(t, test.Data.firstOrder.BillingAddress, order.BillingAddress)
 		validateAddress(t, test.Data.firstOrder.ShippingAddress, order.ShippingAddress)
 	})
+	t.Run("NotModified", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testToken(test.Data.testUser.ID, "marp@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodGet, test.Data.urlForFirstOrder, nil, token)
+		extractPayload(t, http.StatusOK, recorder, new(models.Order))
+		etag := recorder.Header().Get("ETag")
+		require.NotEmpty(t, etag)
+
+		recorder = test.TestEndpointWithHeaders(http.MethodGet, test.Data.urlForFirstOrder, nil, token, map[string]string{"If-None-Match": etag})
+		assert.Equal(t, http.StatusNotModified, recorder.Code)
+		assert.Empty(t, recorder.Body.String())
+		assert.Equal(t, etag, recorder.Header().Get("ETag"))
+
+		// payments change the order without a new version
+		test.Data.firstOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+		recorder = test.TestEndpointWithHeaders(http.MethodGet, test.Data.urlForFirstOrder, nil, token, map[string]string{"If-None-Match": etag})
+		order := new(models.Order)
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Equal(t, models.PendingState, order.PaymentState)
+		assert.NotEqual(t, etag, recorder.Header().Get("ETag"))
+
+		// so do changes to its line items that leave the order itself untouched
+		etag = recorder.Header().Get("ETag")
+		require.NoError(t, test.DB.Model(test.Data.firstLineItem).UpdateColumn("title", "batwing v2").Error)
+		recorder = test.TestEndpointWithHeaders(http.MethodGet, test.Data.urlForFirstOrder, nil, token, map[string]string{"If-None-Match": etag})
+		extractPayload(t, http.StatusOK, recorder, new(models.Order))
+		assert.NotEqual(t, etag, recorder.Header().Get("ETag"))
+	})
 }
 
 // --------------------------------------------------------------------------------------------------------------------
@@ -744,12 +1175,12 @@ func TestOrderView(t *testing.T) {
 func TestOrderSetUserIDLogic(t *testing.T) {
 	t.Run("AnonymousUser", func(t *testing.T) {
 		simpleOrder := models.NewOrder("", "session", "params@email.com", "USD")
-		require.Nil(t, setOrderEmail(nil, simpleOrder, nil, testLogger))
+		require.Nil(t, setOrderEmail(nil, simpleOrder, nil, testLogger, false))
 		assert.Equal(t, "params@email.com", simpleOrder.Email)
 	})
 	t.Run("AnonymousUserNoEmail", func(t *testing.T) {
 		simpleOrder := models.NewOrder("", "session", "", "USD")
-		err := setOrderEmail(nil, simpleOrder, nil, testLogger)
+		err := setOrderEmail(nil, simpleOrder, nil, testLogger, false)
 		require.Error(t, err)
 		assert.Equal(t, http.StatusBadRequest, err.Code)
 	})
@@ -784,7 +1215,7 @@ func TestOrderSetUserIDLogic(t *testing.T) {
 		db, _, _, _ := db(t)
 		simpleOrder := models.NewOrder("", "session", "", "USD")
 		claims := testToken("alfred", "").Claims.(*claims.JWTClaims)
-		err := setOrderEmail(db, simpleOrder, claims, testLogger)
+		err := setOrderEmail(db, simpleOrder, claims, testLogger, false)
 		require.NotNil(t, err)
 		assert.Equal(t, http.StatusBadRequest, err.Code)
 	})
@@ -843,7 +1274,7 @@ func TestOrderUpdate(t *testing.T) {
 
 		op := &orderRequestParams{
 			Email:            "mrfreeze@dc.com",
-			Currency:         "monopoly-dollars",
+			Currency:         "eur",
 			FulfillmentState: "shipping",
 		}
 		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
@@ -858,12 +1289,12 @@ func TestOrderUpdate(t *testing.T) {
 		require.False(t, rsp.RecordNotFound())
 
 		assert.Equal("mrfreeze@dc.com", rspOrder.Email)
-		assert.Equal("monopoly-dollars", rspOrder.Currency)
+		assert.Equal("EUR", rspOrder.Currency)
 		assert.Equal("shipping", rspOrder.FulfillmentState)
 
 		// did it get persisted to the db
 		assert.Equal("mrfreeze@dc.com", saved.Email)
-		assert.Equal("monopoly-dollars", saved.Currency)
+		assert.Equal("EUR", saved.Currency)
 		assert.Equal("shipping", saved.FulfillmentState)
 		validateOrder(t, saved, rspOrder)
 
@@ -931,11 +1362,22 @@ func TestOrderUpdate(t *testing.T) {
 		validateAddress(t, *paramsAddress, *savedAddr)
 	})
 
+	t.Run("UnknownCurrency", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.firstOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+		op := &orderRequestParams{Currency: "monopoly-dollars"}
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := runOrderUpdate(test, test.Data.firstOrder, op, token)
+		validateError(t, http.StatusBadRequest, recorder, "Unknown currency")
+	})
+
 	t.Run("NonAdmin", func(t *testing.T) {
 		test := NewRouteTest(t)
 		op := &orderRequestParams{
 			Email:    "mrfreeze@dc.com",
-			Currency: "monopoly-dollars",
+			Currency: "EUR",
 		}
 		token := testToken("villian", "villian@wayneindustries.com")
 		recorder := runOrderUpdate(test, test.Data.firstOrder, op, token)
@@ -946,7 +1388,7 @@ func TestOrderUpdate(t *testing.T) {
 		test := NewRouteTest(t)
 		op := &orderRequestParams{
 			Email:    "mrfreeze@dc.com",
-			Currency: "monopoly-dollars",
+			Currency: "EUR",
 		}
 		recorder := runOrderUpdate(test, test.Data.firstOrder, op, nil)
 		validateError(t, http.StatusUnauthorized, recorder)
@@ -970,176 +1412,1702 @@ func TestOrderUpdate(t *testing.T) {
 		assert.Equal(t, op.MetaData, order.MetaData, "Order metadata should have been updated")
 	})
 
-	t.Run("InvalidFulfilmentState", func(t *testing.T) {
+	t.Run("CaptureOnShipment", func(t *testing.T) {
 		test := NewRouteTest(t)
-		op := &orderRequestParams{
-			FulfillmentState: "cancelled",
-		}
+		test.Config.Payment.CaptureOnShipment = true
+		authorizeFirstOrder(t, test)
+
+		provider := &memProvider{name: payments.StripeProvider}
+		body, err := json.Marshal(&orderRequestParams{FulfillmentState: models.ShippedState})
+		require.NoError(t, err)
 		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
-		recorder := runOrderUpdate(test, test.Data.firstOrder, op, token)
-		validateError(t, http.StatusBadRequest, recorder)
-	})
-}
+		recorder := testEndpointWithProvider(test, provider, http.MethodPut, "/orders/"+test.Data.firstOrder.ID, bytes.NewBuffer(body), token)
 
-// -------------------------------------------------------------------------------------------------------------------
-// CLAIMS
-// -------------------------------------------------------------------------------------------------------------------
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Equal(t, models.ShippedState, order.FulfillmentState)
+		assert.Equal(t, models.PaidState, order.PaymentState)
+
+		require.Len(t, provider.captureCalls, 1)
+		assert.Equal(t, test.Data.firstTransaction.ProcessorID, provider.captureCalls[0].id)
+		assert.Equal(t, test.Data.firstOrder.Total, provider.captureCalls[0].amount)
+		assert.Equal(t, "USD", provider.captureCalls[0].currency)
+
+		trans := &models.Transaction{}
+		require.NoError(t, test.DB.First(trans, "id = ?", test.Data.firstTransaction.ID).Error)
+		assert.Equal(t, models.PaidState, trans.Status)
+		assert.Equal(t, test.Data.firstOrder.Total, trans.Amount)
+	})
 
-func TestClaim(t *testing.T) {
-	t.Run("Simple", func(t *testing.T) {
+	t.Run("ShipmentWithoutCapture", func(t *testing.T) {
 		test := NewRouteTest(t)
-		test.Data.firstOrder.Email = "villian@wayneindustries.com"
-		test.Data.firstOrder.UserID = ""
-		rsp := test.DB.Save(test.Data.firstOrder)
-		require.NoError(t, rsp.Error, "Failed to update email")
-
-		token := testToken("villian", "villian@wayneindustries.com")
-		recorder := test.TestEndpoint(http.MethodPost, "/claim", nil, token)
-		require.Equal(t, http.StatusNoContent, recorder.Code)
-
-		// validate the DB
-		dbOrders := []models.Order{}
-		rsp = test.DB.Where("email = ?", "villian@wayneindustries.com").Find(&dbOrders)
-		require.NoError(t, rsp.Error, "Failed to query DB")
+		authorizeFirstOrder(t, test)
 
-		assert.Len(t, dbOrders, 1)
-		assert.Equal(t, "villian@wayneindustries.com", dbOrders[0].Email)
-		assert.Equal(t, "villian", dbOrders[0].UserID)
+		provider := &memProvider{name: payments.StripeProvider}
+		body, err := json.Marshal(&orderRequestParams{FulfillmentState: models.ShippedState})
+		require.NoError(t, err)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := testEndpointWithProvider(test, provider, http.MethodPut, "/orders/"+test.Data.firstOrder.ID, bytes.NewBuffer(body), token)
 
-		stored := &models.Address{ID: dbOrders[0].BillingAddressID}
-		require.NoError(t, test.DB.First(stored).Error)
-		assert.Equal(t, stored.UserID, dbOrders[0].UserID)
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Equal(t, models.AuthorizedState, order.PaymentState)
+		assert.Empty(t, provider.captureCalls)
 	})
 
-	t.Run("NoEmail", func(t *testing.T) {
+	t.Run("LineItemsAndData", func(t *testing.T) {
 		test := NewRouteTest(t)
-		token := testToken("villian", "")
-		recorder := test.TestEndpoint(http.MethodPost, "/claim", nil, token)
-		require.Equal(t, http.StatusBadRequest, recorder.Code)
-	})
+		server := startTestSite()
+		defer server.Close()
+		test.Config.SiteURL = server.URL
+
+		test.Data.firstOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+		item := test.Data.firstOrder.LineItems[0]
+		op := &orderRequestParams{
+			MetaData: map[string]interface{}{
+				"count":  7,
+				"color":  "black",
+				"secret": true,
+			},
+			LineItems: []*orderLineItem{{Sku: item.Sku, Quantity: 3}},
+		}
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := runOrderUpdate(test, test.Data.firstOrder, op, token)
+
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		require.Len(t, order.LineItems, 1)
+		assert.Equal(t, item.Sku, order.LineItems[0].Sku)
+		assert.Equal(t, uint64(3), order.LineItems[0].Quantity)
+		assert.Equal(t, uint64(36), order.SubTotal)
+		assert.Equal(t, uint64(36), order.Total)
+
+		assert.Equal(t, float64(7), order.MetaData["count"])
+		assert.Equal(t, "black", order.MetaData["color"])
+		assert.Equal(t, true, order.MetaData["secret"])
+
+		saved := &models.Order{}
+		require.NoError(t, orderQuery(test.DB).First(saved, "id = ?", order.ID).Error)
+		assert.Equal(t, uint64(3), saved.LineItems[0].Quantity)
+		assert.Equal(t, order.MetaData, saved.MetaData)
+	})
+
+	t.Run("AddAndRemoveLineItems", func(t *testing.T) {
+		test := NewRouteTest(t)
+		server := startTestSite()
+		defer server.Close()
+		test.Config.SiteURL = server.URL
+
+		test.Data.secondOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.secondOrder).Error)
+
+		op := &orderRequestParams{
+			LineItems: []*orderLineItem{
+				{Sku: test.Data.secondLineItem1.Sku, Quantity: 0},
+				{Sku: test.Data.secondLineItem2.Sku, Quantity: 2},
+				{Path: "/simple-product", Quantity: 1},
+			},
+		}
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := runOrderUpdate(test, test.Data.secondOrder, op, token)
+
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		require.Len(t, order.LineItems, 2)
+		assert.Equal(t, test.Data.secondLineItem2.Sku, order.LineItems[0].Sku)
+		assert.Equal(t, uint64(2), order.LineItems[0].Quantity)
+		assert.Equal(t, "/simple-product", order.LineItems[1].Path)
+		assert.Equal(t, uint64(999), order.LineItems[1].Price)
+		assert.Equal(t, uint64(45*2+999), order.SubTotal)
+		assert.Equal(t, uint64(45*2+999), order.Total)
+
+		saved := &models.Order{}
+		require.NoError(t, orderQuery(test.DB).First(saved, "id = ?", order.ID).Error)
+		assert.Len(t, saved.LineItems, 2)
+		assert.Equal(t, order.Total, saved.Total)
+	})
+
+	t.Run("Tip", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.firstOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+		tip := uint64(6)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := runOrderUpdate(test, test.Data.firstOrder, &orderRequestParams{Tip: &tip}, token)
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.EqualValues(t, 6, order.Tip)
+		assert.EqualValues(t, 30, order.Total)
+
+		tip = 0
+		recorder = runOrderUpdate(test, test.Data.firstOrder, &orderRequestParams{Tip: &tip}, token)
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.EqualValues(t, 0, order.Tip)
+		assert.EqualValues(t, 24, order.Total)
+	})
+
+	t.Run("TipAfterPayment", func(t *testing.T) {
+		test := NewRouteTest(t)
+		tip := uint64(6)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := runOrderUpdate(test, test.Data.firstOrder, &orderRequestParams{Tip: &tip}, token)
+		validateError(t, http.StatusBadRequest, recorder, "after payment")
+	})
+
+	t.Run("ManualDiscount", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.firstOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+		discount := uint64(4)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		op := &orderRequestParams{ManualDiscount: &discount, ManualDiscountReason: "Late delivery"}
+		recorder := runOrderUpdate(test, test.Data.firstOrder, op, token)
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.EqualValues(t, 4, order.ManualDiscount)
+		assert.Equal(t, "Late delivery", order.ManualDiscountReason)
+		assert.EqualValues(t, 4, order.Discount)
+		assert.EqualValues(t, 20, order.Total)
+
+		op = &orderRequestParams{LineItemDiscounts: []*lineItemDiscount{
+			{LineItemID: test.Data.firstLineItem.ID, Amount: 6, Reason: "Scratched"},
+		}}
+		recorder = runOrderUpdate(test, test.Data.firstOrder, op, token)
+		extractPayload(t, http.StatusOK, recorder, order)
+		require.Len(t, order.LineItems, 1)
+		assert.EqualValues(t, 6, order.LineItems[0].ManualDiscount)
+		assert.Equal(t, "Scratched", order.LineItems[0].ManualDiscountReason)
+		assert.EqualValues(t, 10, order.Discount)
+		assert.EqualValues(t, 14, order.Total)
+		assert.EqualValues(t, 0, order.CouponDiscount())
+
+		op = &orderRequestParams{LineItemDiscounts: []*lineItemDiscount{{LineItemID: 4242, Amount: 1}}}
+		recorder = runOrderUpdate(test, test.Data.firstOrder, op, token)
+		validateError(t, http.StatusBadRequest, recorder, "no line item")
+	})
+
+	t.Run("ManualDiscountShared", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.secondOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.secondOrder).Error)
+
+		discount := uint64(11)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := runOrderUpdate(test, test.Data.secondOrder, &orderRequestParams{ManualDiscount: &discount}, token)
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.EqualValues(t, 11, order.Discount)
+		assert.EqualValues(t, 44, order.Total)
+		require.Len(t, order.LineItems, 2)
+		assert.EqualValues(t, 8, order.LineItems[0].CalculationDetail.NetTotal*order.LineItems[0].Quantity)
+	})
+
+	t.Run("ManualDiscountRemainder", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.secondOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.secondOrder).Error)
+		item := &models.LineItem{
+			OrderID:        test.Data.secondOrder.ID,
+			Title:          "batarang",
+			Sku:            "789-boomerang",
+			Type:           "tank",
+			Price:          3,
+			Quantity:       1,
+			Path:           "/i/always/come/back",
+			ManualDiscount: 3,
+		}
+		require.NoError(t, test.DB.Create(item).Error)
+
+		discount := uint64(12)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := runOrderUpdate(test, test.Data.secondOrder, &orderRequestParams{ManualDiscount: &discount}, token)
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.EqualValues(t, 15, order.Discount)
+		assert.EqualValues(t, 43, order.Total)
+	})
+
+	t.Run("ManualDiscountAfterPayment", func(t *testing.T) {
+		test := NewRouteTest(t)
+		discount := uint64(4)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := runOrderUpdate(test, test.Data.firstOrder, &orderRequestParams{ManualDiscount: &discount}, token)
+		validateError(t, http.StatusBadRequest, recorder, "after payment")
+	})
+
+	t.Run("LineItemsOfMember", func(t *testing.T) {
+		test := NewRouteTest(t)
+		settings := calculator.Settings{
+			MemberDiscounts: []*calculator.MemberDiscount{
+				{Claims: map[string]string{"email": test.Data.testUser.Email}, Percentage: 15, ProductTypes: []string{"Book"}},
+				{Claims: map[string]string{"email": "admin@wayneindustries.com"}, Percentage: 50, ProductTypes: []string{"Book"}},
+			},
+		}
+		server := startTestSiteWithSettings(settings)
+		defer server.Close()
+		test.Config.SiteURL = server.URL
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(defaultPayload), test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		require.Len(t, order.LineItems, 1)
+		assert.Equal(t, uint64(150), order.Discount)
+
+		// the admin's membership doesn't apply to the order of the user
+		op := &orderRequestParams{
+			LineItems: []*orderLineItem{{Sku: order.LineItems[0].Sku, Quantity: 2}},
+		}
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder = runOrderUpdate(test, order, op, token)
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Equal(t, uint64(300), order.Discount)
+		assert.Equal(t, uint64(2*999-300), order.Total)
+	})
+
+	t.Run("LineItemsAfterPayment", func(t *testing.T) {
+		test := NewRouteTest(t)
+		item := test.Data.firstOrder.LineItems[0]
+		op := &orderRequestParams{
+			LineItems: []*orderLineItem{{Sku: item.Sku, Quantity: 3}},
+		}
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := runOrderUpdate(test, test.Data.firstOrder, op, token)
+		validateError(t, http.StatusBadRequest, recorder, "after payment")
+
+		saved := &models.Order{}
+		require.NoError(t, test.DB.Preload("LineItems").First(saved, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, uint64(2), saved.LineItems[0].Quantity)
+		assert.Equal(t, test.Data.firstOrder.Total, saved.Total)
+	})
+
+	t.Run("LineItemsAfterAuthorization", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.firstOrder.PaymentState = models.AuthorizedState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+		item := test.Data.firstOrder.LineItems[0]
+		op := &orderRequestParams{
+			LineItems: []*orderLineItem{{Sku: item.Sku, Quantity: 3}},
+		}
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := runOrderUpdate(test, test.Data.firstOrder, op, token)
+		validateError(t, http.StatusBadRequest, recorder, "after payment")
+	})
+
+	t.Run("UnknownLineItem", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.firstOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+		op := &orderRequestParams{
+			LineItems: []*orderLineItem{{Sku: "not-in-the-order", Quantity: 1}},
+		}
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := runOrderUpdate(test, test.Data.firstOrder, op, token)
+		validateError(t, http.StatusBadRequest, recorder, "not-in-the-order")
+	})
+
+	t.Run("ApplyCoupon", func(t *testing.T) {
+		test := NewRouteTest(t)
+		server := startTestSite()
+		defer server.Close()
+		test.Config.SiteURL = server.URL
+		couponServer := startStackableCouponList()
+		defer couponServer.Close()
+		test.Config.Coupons.URL = couponServer.URL
+
+		test.Data.secondOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.secondOrder).Error)
+
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := runOrderUpdate(test, test.Data.secondOrder, &orderRequestParams{CouponCode: "TEN"}, token)
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Equal(t, []string{"TEN"}, order.CouponCodes)
+		assert.Equal(t, uint64(6), order.Discount)
+		assert.Equal(t, uint64(49), order.Total)
+
+		// without stacking a second coupon replaces the first
+		recorder = runOrderUpdate(test, test.Data.secondOrder, &orderRequestParams{CouponCode: "FIVE"}, token)
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Equal(t, []string{"FIVE"}, order.CouponCodes)
+		assert.Equal(t, uint64(3), order.Discount)
+		assert.Equal(t, uint64(52), order.Total)
+	})
+
+	t.Run("ApplyCouponAfterPayment", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := runOrderUpdate(test, test.Data.firstOrder, &orderRequestParams{CouponCode: "TEN"}, token)
+		validateError(t, http.StatusBadRequest, recorder, "after payment")
+	})
+
+	t.Run("Version", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		url := "/orders/" + test.Data.firstOrder.ID
+
+		recorder := test.TestEndpointWithHeaders(http.MethodPut, url, strings.NewReader(`{"email": "robin@wayneindustries.com"}`), token, map[string]string{"If-Match": `"0"`})
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Equal(t, uint64(1), order.Version)
+		etag := recorder.Header().Get("ETag")
+		assert.True(t, strings.HasPrefix(etag, `"1-`), etag)
+
+		// a second update based on the original version is stale
+		recorder = test.TestEndpointWithHeaders(http.MethodPut, url, strings.NewReader(`{"email": "joker@example.com"}`), token, map[string]string{"If-Match": `"0"`})
+		validateError(t, http.StatusConflict, recorder, "current version is 1")
+
+		recorder = test.TestEndpoint(http.MethodPut, url, strings.NewReader(`{"email": "joker@example.com", "version": 0}`), token)
+		validateError(t, http.StatusConflict, recorder)
+
+		saved := &models.Order{}
+		require.NoError(t, test.DB.First(saved, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, "robin@wayneindustries.com", saved.Email)
+		assert.Equal(t, uint64(1), saved.Version)
+
+		recorder = test.TestEndpoint(http.MethodPut, url, strings.NewReader(`{"email": "alfred@wayneindustries.com", "version": 1}`), token)
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Equal(t, uint64(2), order.Version)
+
+		// the ETag of the order works as If-Match
+		etag = recorder.Header().Get("ETag")
+		recorder = test.TestEndpointWithHeaders(http.MethodPut, url, strings.NewReader(`{"email": "robin@wayneindustries.com"}`), token, map[string]string{"If-Match": etag})
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Equal(t, uint64(3), order.Version)
+	})
+
+	t.Run("InvalidIfMatch", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := test.TestEndpointWithHeaders(http.MethodPut, "/orders/"+test.Data.firstOrder.ID, strings.NewReader(`{}`), token, map[string]string{"If-Match": "nope"})
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+
+	t.Run("InvalidFulfilmentState", func(t *testing.T) {
+		test := NewRouteTest(t)
+		op := &orderRequestParams{
+			FulfillmentState: "cancelled",
+		}
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := runOrderUpdate(test, test.Data.firstOrder, op, token)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+}
+
+func TestOrderPatch(t *testing.T) {
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	t.Run("ClearFields", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.firstOrder.PaymentState = models.PendingState
+		test.Data.firstOrder.SessionID = "session"
+		test.Data.firstOrder.VATNumber = "DE123"
+		test.Data.firstOrder.MetaData = map[string]interface{}{"gift": true}
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+		body := strings.NewReader(`{"session_id": null, "vatnumber": null, "meta": null}`)
+		recorder := test.TestEndpoint(http.MethodPatch, "/orders/first-order", body, token)
+		order := new(models.Order)
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Empty(t, order.SessionID)
+		assert.Empty(t, order.VATNumber)
+		assert.Empty(t, order.MetaData)
+		assert.Equal(t, test.Data.firstOrder.Email, order.Email)
+
+		saved := new(models.Order)
+		require.NoError(t, test.DB.First(saved, "id = ?", "first-order").Error)
+		assert.Empty(t, saved.SessionID)
+		assert.Empty(t, saved.VATNumber)
+		assert.Empty(t, saved.MetaData)
+	})
+
+	t.Run("MergeMetaData", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.firstOrder.MetaData = map[string]interface{}{
+			"gift":    true,
+			"comment": "leave at the door",
+			"wrap":    map[string]interface{}{"color": "red", "ribbon": true},
+		}
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+		body := strings.NewReader(`{"meta": {"comment": null, "wrap": {"ribbon": null}, "rush": true}}`)
+		recorder := test.TestEndpoint(http.MethodPatch, "/orders/first-order", body, token)
+		order := new(models.Order)
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Equal(t, map[string]interface{}{
+			"gift": true,
+			"rush": true,
+			"wrap": map[string]interface{}{"color": "red"},
+		}, order.MetaData)
+	})
+
+	t.Run("ClearTip", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.firstOrder.PaymentState = models.PendingState
+		test.Data.firstOrder.Tip = 5
+		test.Data.firstOrder.Total = 29
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+		recorder := test.TestEndpoint(http.MethodPatch, "/orders/first-order", strings.NewReader(`{"tip": null}`), token)
+		order := new(models.Order)
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.EqualValues(t, 0, order.Tip)
+		assert.EqualValues(t, 24, order.Total)
+	})
+
+	t.Run("RequiredField", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodPatch, "/orders/first-order", strings.NewReader(`{"email": null}`), token)
+		validateError(t, http.StatusBadRequest, recorder, "email")
+	})
+
+	t.Run("PutIgnoresNull", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.firstOrder.VATNumber = "DE123"
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+		recorder := test.TestEndpoint(http.MethodPut, "/orders/first-order", strings.NewReader(`{"vatnumber": null}`), token)
+		order := new(models.Order)
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Equal(t, "DE123", order.VATNumber)
+	})
+
+	t.Run("NonAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodPatch, "/orders/first-order", strings.NewReader(`{"meta": null}`), test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
+
+func TestOrderTransitions(t *testing.T) {
+	t.Run("Admin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.firstOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/first-order/transitions", nil, token)
+		transitions := &orderTransitions{}
+		extractPayload(t, http.StatusOK, recorder, transitions)
+		assert.Equal(t, models.PendingState, transitions.PaymentState)
+		assert.Equal(t, []string{models.CancelledState}, transitions.Payment)
+		assert.Equal(t, []string{models.BackorderedState, models.ShippingState, models.ShippedState}, transitions.Fulfillment)
+	})
+
+	t.Run("Customer", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.firstOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/first-order/transitions", nil, test.Data.testUserToken)
+		transitions := &orderTransitions{}
+		extractPayload(t, http.StatusOK, recorder, transitions)
+		assert.Equal(t, []string{models.AuthorizedState, models.PaidState, models.CancelledState}, transitions.Payment)
+		assert.Empty(t, transitions.Fulfillment)
+	})
+
+	t.Run("NoAccess", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testToken("stranger", "stranger@example.com")
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/first-order/transitions", nil, token)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+
+	t.Run("ShippedIsFinal", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.firstOrder.FulfillmentState = models.ShippedState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+		recorder := runOrderUpdate(test, test.Data.firstOrder, &orderRequestParams{FulfillmentState: models.PendingState}, token)
+		validateError(t, http.StatusBadRequest, recorder, "from 'shipped' to 'pending'")
+	})
+
+	t.Run("PayAuthorizedOrder", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.firstOrder.PaymentState = models.AuthorizedState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+		body := strings.NewReader(`{"provider": "stripe", "amount": 24, "currency": "USD", "stripe_payment_method_id": "pm_card"}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", body, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "authorized")
+	})
+}
+
+func TestOrderTaxExempt(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	createGermanOrder := func(test *RouteTest) *models.Order {
+		test.Config.SiteURL = server.URL
+		body := strings.Replace(defaultPayload, `"USA"`, `"Germany"`, 1)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(body), test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		require.EqualValues(t, 70, order.Taxes)
+		return order
+	}
+
+	t.Run("Exempt", func(t *testing.T) {
+		test := NewRouteTest(t)
+		order := createGermanOrder(test)
+
+		body := strings.NewReader(`{"tax_exempt": true, "tax_exempt_reason": "Non-profit"}`)
+		recorder := test.TestEndpoint(http.MethodPut, "/orders/"+order.ID, body, token)
+		updated := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, updated)
+		assert.True(t, updated.TaxExempt)
+		assert.Equal(t, "Non-profit", updated.TaxExemptReason)
+		assert.EqualValues(t, 0, updated.Taxes)
+		assert.EqualValues(t, 999, updated.Total)
+
+		recorder = test.TestEndpoint(http.MethodPut, "/orders/"+order.ID, strings.NewReader(`{"tax_exempt": false}`), token)
+		updated = &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, updated)
+		assert.False(t, updated.TaxExempt)
+		assert.Empty(t, updated.TaxExemptReason)
+		assert.EqualValues(t, 70, updated.Taxes)
+	})
+
+	t.Run("RequiresReason", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.firstOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+		recorder := test.TestEndpoint(http.MethodPut, "/orders/first-order", strings.NewReader(`{"tax_exempt": true}`), token)
+		validateError(t, http.StatusBadRequest, recorder, "reason")
+	})
+
+	t.Run("AlreadyPaid", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.firstOrder.PaymentState = models.PaidState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+		body := strings.NewReader(`{"tax_exempt": true, "tax_exempt_reason": "Non-profit"}`)
+		recorder := test.TestEndpoint(http.MethodPut, "/orders/first-order", body, token)
+		validateError(t, http.StatusBadRequest, recorder, "after payment")
+	})
+}
+
+func authorizeFirstOrder(t *testing.T, test *RouteTest) {
+	test.Data.firstOrder.PaymentState = models.AuthorizedState
+	require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+	test.Data.firstTransaction.Status = models.AuthorizedState
+	require.NoError(t, test.DB.Save(test.Data.firstTransaction).Error)
+}
+
+// -------------------------------------------------------------------------------------------------------------------
+// CLAIMS
+// -------------------------------------------------------------------------------------------------------------------
+
+func TestClaim(t *testing.T) {
+	t.Run("Simple", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.firstOrder.Email = "villian@wayneindustries.com"
+		test.Data.firstOrder.UserID = ""
+		rsp := test.DB.Save(test.Data.firstOrder)
+		require.NoError(t, rsp.Error, "Failed to update email")
+
+		token := testToken("villian", "villian@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodPost, "/claim", nil, token)
+		require.Equal(t, http.StatusNoContent, recorder.Code)
+
+		// validate the DB
+		dbOrders := []models.Order{}
+		rsp = test.DB.Where("email = ?", "villian@wayneindustries.com").Find(&dbOrders)
+		require.NoError(t, rsp.Error, "Failed to query DB")
+
+		assert.Len(t, dbOrders, 1)
+		assert.Equal(t, "villian@wayneindustries.com", dbOrders[0].Email)
+		assert.Equal(t, "villian", dbOrders[0].UserID)
+
+		stored := &models.Address{ID: dbOrders[0].BillingAddressID}
+		require.NoError(t, test.DB.First(stored).Error)
+		assert.Equal(t, stored.UserID, dbOrders[0].UserID)
+	})
+
+	t.Run("NoEmail", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testToken("villian", "")
+		recorder := test.TestEndpoint(http.MethodPost, "/claim", nil, token)
+		require.Equal(t, http.StatusBadRequest, recorder.Code)
+	})
 
 	t.Run("NoID", func(t *testing.T) {
 		test := NewRouteTest(t)
-		token := testToken("", "villian@wayneindustries.com")
-		recorder := test.TestEndpoint(http.MethodPost, "/claim", nil, token)
-		require.Equal(t, http.StatusBadRequest, recorder.Code)
+		token := testToken("", "villian@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodPost, "/claim", nil, token)
+		require.Equal(t, http.StatusBadRequest, recorder.Code)
+	})
+
+	t.Run("MultipleTimes", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.firstOrder.Email = "villian@wayneindustries.com"
+		test.Data.firstOrder.UserID = ""
+		rsp := test.DB.Save(test.Data.firstOrder)
+		require.NoError(t, rsp.Error, "Failed to update email")
+
+		token := testToken("villian", "villian@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodPost, "/claim", nil, token)
+		require.Equal(t, http.StatusNoContent, recorder.Code)
+
+		recorder = test.TestEndpoint(http.MethodPost, "/claim", nil, token)
+		require.Equal(t, http.StatusNoContent, recorder.Code)
+	})
+}
+
+func TestClaimOrder(t *testing.T) {
+	makeGuestOrder := func(test *RouteTest) {
+		test.Data.firstOrder.Email = "villian@wayneindustries.com"
+		test.Data.firstOrder.UserID = ""
+		test.Data.firstOrder.User = nil
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+		require.NoError(t, test.DB.Model(&models.Address{}).Where("id = ?", test.Data.testAddress.ID).UpdateColumn("user_id", "").Error)
+	}
+
+	t.Run("Simple", func(t *testing.T) {
+		test := NewRouteTest(t)
+		makeGuestOrder(test)
+
+		token := testToken("villian", "villian@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/"+test.Data.firstOrder.ID+"/claim", nil, token)
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Equal(t, "villian", order.UserID)
+
+		stored := &models.Order{}
+		require.NoError(t, test.DB.First(stored, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, "villian", stored.UserID)
+
+		address := &models.Address{ID: stored.BillingAddressID}
+		require.NoError(t, test.DB.First(address).Error)
+		assert.Equal(t, "villian", address.UserID)
+
+		// the second order still belongs to its owner
+		other := &models.Order{}
+		require.NoError(t, test.DB.First(other, "id = ?", test.Data.secondOrder.ID).Error)
+		assert.Equal(t, test.Data.testUser.ID, other.UserID)
+
+		// claiming again is a no-op
+		recorder = test.TestEndpoint(http.MethodPost, "/orders/"+test.Data.firstOrder.ID+"/claim", nil, token)
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Equal(t, "villian", order.UserID)
+	})
+
+	t.Run("EmailMismatch", func(t *testing.T) {
+		test := NewRouteTest(t)
+		makeGuestOrder(test)
+
+		token := testToken("joker", "joker@example.com")
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/"+test.Data.firstOrder.ID+"/claim", nil, token)
+		validateError(t, http.StatusUnauthorized, recorder)
+
+		stored := &models.Order{}
+		require.NoError(t, test.DB.First(stored, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, "", stored.UserID)
+	})
+
+	t.Run("AlreadyClaimed", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testToken("villian", test.Data.firstOrder.Email)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/"+test.Data.firstOrder.ID+"/claim", nil, token)
+		validateError(t, http.StatusConflict, recorder)
+
+		stored := &models.Order{}
+		require.NoError(t, test.DB.First(stored, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, test.Data.testUser.ID, stored.UserID)
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testToken("villian", "villian@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/nope/claim", nil, token)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+
+	t.Run("NoToken", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/"+test.Data.firstOrder.ID+"/claim", nil, nil)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+
+	t.Run("MagicLink", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Mailer.MagicLink.Enabled = true
+		makeGuestOrder(test)
+		orderToken, err := claims.NewOrderToken(test.Data.firstOrder.ID, test.Config.JWT.Secret, time.Hour)
+		require.NoError(t, err)
+
+		token := testToken("joker", "joker@example.com")
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/"+test.Data.firstOrder.ID+"/claim?token="+orderToken, nil, token)
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Equal(t, "joker", order.UserID)
+
+		// the magic link is used up by claiming the order
+		tokenID, ok := claims.ParseOrderToken(orderToken, test.Data.firstOrder.ID, test.Config.JWT.Secret)
+		require.True(t, ok)
+		used, err := models.OrderTokenUsed(test.DB, tokenID)
+		require.NoError(t, err)
+		assert.True(t, used)
+		recorder = test.TestEndpoint(http.MethodGet, "/orders/"+test.Data.firstOrder.ID+"?token="+orderToken, nil, nil)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+
+	t.Run("MagicLinkDisabled", func(t *testing.T) {
+		test := NewRouteTest(t)
+		makeGuestOrder(test)
+		orderToken, err := claims.NewOrderToken(test.Data.firstOrder.ID, test.Config.JWT.Secret, time.Hour)
+		require.NoError(t, err)
+
+		token := testToken("joker", "joker@example.com")
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/"+test.Data.firstOrder.ID+"/claim?token="+orderToken, nil, token)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
+
+func TestOrderViewMagicLink(t *testing.T) {
+	t.Run("ValidToken", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Mailer.MagicLink.Enabled = true
+		orderToken, err := claims.NewOrderToken(test.Data.firstOrder.ID, test.Config.JWT.Secret, time.Hour)
+		require.NoError(t, err)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/"+test.Data.firstOrder.ID+"?token="+orderToken, nil, nil)
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Equal(t, test.Data.firstOrder.ID, order.ID)
+	})
+
+	t.Run("OtherOrder", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Mailer.MagicLink.Enabled = true
+		orderToken, err := claims.NewOrderToken(test.Data.secondOrder.ID, test.Config.JWT.Secret, time.Hour)
+		require.NoError(t, err)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/"+test.Data.firstOrder.ID+"?token="+orderToken, nil, nil)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Mailer.MagicLink.Enabled = true
+		orderToken, err := claims.NewOrderToken(test.Data.firstOrder.ID, test.Config.JWT.Secret, -time.Hour)
+		require.NoError(t, err)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/"+test.Data.firstOrder.ID+"?token="+orderToken, nil, nil)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
+
+func TestAnonymousOrderAccess(t *testing.T) {
+	setup := func(t *testing.T) *RouteTest {
+		test := NewRouteTest(t)
+		test.Data.firstOrder.User = nil
+		test.Data.firstOrder.UserID = ""
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+		return test
+	}
+	endpoints := map[string]struct {
+		Method string
+		Path   string
+		Body   string
+	}{
+		"ReceiptView":        {http.MethodGet, "/receipt", ""},
+		"ResendOrderReceipt": {http.MethodPost, "/receipt", "{}"},
+		"ResendConfirmation": {http.MethodPost, "/resend_confirmation", ""},
+		"OrderTransitions":   {http.MethodGet, "/transitions", ""},
+		"LineItemView":       {http.MethodGet, "/items/11", ""},
+		"ShippingEstimate":   {http.MethodGet, "/shipping_estimate", ""},
+		"ReturnList":         {http.MethodGet, "/returns", ""},
+		"ReturnCreate":       {http.MethodPost, "/returns", `{"items": [{"line_item_id": 11}]}`},
+		"OrderNoteList":      {http.MethodGet, "/notes", ""},
+		"DownloadList":       {http.MethodGet, "/downloads", ""},
+	}
+
+	for name, params := range endpoints {
+		t.Run(name, func(t *testing.T) {
+			test := setup(t)
+			path := test.Data.urlForFirstOrder + params.Path
+			recorder := test.TestEndpoint(params.Method, path, strings.NewReader(params.Body), nil)
+			validateError(t, http.StatusNotFound, recorder)
+			recorder = test.TestEndpoint(params.Method, path, strings.NewReader(params.Body), test.Data.testUserToken)
+			validateError(t, http.StatusNotFound, recorder)
+		})
+	}
+
+	t.Run("WithEmail", func(t *testing.T) {
+		test := setup(t)
+		email := "?email=" + url.QueryEscape(test.Data.firstOrder.Email)
+		recorder := test.TestEndpoint(http.MethodGet, test.Data.urlForFirstOrder+"/notes"+email, nil, nil)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		recorder = test.TestEndpoint(http.MethodGet, test.Data.urlForFirstOrder+"/items/11"+email, nil, nil)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+	})
+}
+
+// -------------------------------------------------------------------------------------------------------------------
+// HELPERS
+// -------------------------------------------------------------------------------------------------------------------
+
+func runOrderUpdate(test *RouteTest, order *models.Order, params *orderRequestParams, token *jwt.Token) *httptest.ResponseRecorder {
+	updateBody, err := json.Marshal(params)
+	require.NoError(test.T, err, "Failed to marshal data for update")
+	recorder := test.TestEndpoint(http.MethodPut, fmt.Sprintf("/orders/%s", order.ID), bytes.NewReader(updateBody), token)
+	return recorder
+}
+
+// -------------------------------------------------------------------------------------------------------------------
+// VALIDATORS
+// -------------------------------------------------------------------------------------------------------------------
+
+func validateOrder(t *testing.T, expected, actual *models.Order) {
+	assert := assert.New(t)
+
+	// all the stock fields
+	assert.Equal(expected.ID, actual.ID)
+	assert.Equal(expected.UserID, actual.UserID)
+	assert.Equal(expected.Email, actual.Email)
+	assert.Equal(expected.Currency, actual.Currency)
+	assert.Equal(expected.Taxes, actual.Taxes)
+	assert.Equal(expected.Shipping, actual.Shipping)
+	assert.Equal(expected.SubTotal, actual.SubTotal)
+	assert.Equal(expected.NetTotal, actual.NetTotal)
+	assert.Equal(expected.Total, actual.Total)
+	assert.Equal(expected.PaymentState, actual.PaymentState)
+	assert.Equal(expected.FulfillmentState, actual.FulfillmentState)
+	assert.Equal(expected.State, actual.State)
+	assert.Equal(expected.ShippingAddressID, actual.ShippingAddressID)
+	assert.Equal(expected.BillingAddressID, actual.BillingAddressID)
+	assert.WithinDuration(expected.CreatedAt, actual.CreatedAt, time.Duration(1)*time.Second)
+	assert.WithinDuration(expected.UpdatedAt, actual.UpdatedAt, time.Duration(1)*time.Second)
+	assert.Equal(expected.VATNumber, actual.VATNumber)
+
+	// we don't return the actual user
+	assert.Nil(actual.User)
+
+	for _, exp := range expected.LineItems {
+		found := false
+		for _, act := range actual.LineItems {
+			if act.ID == exp.ID {
+				found = true
+				// We must JSON compare here because we sometimes validate
+				// using values returned from an HTTP endpoint, which omits
+				// certain fields
+				expJSON, err := json.Marshal(exp)
+				require.NoError(t, err)
+				actJSON, err := json.Marshal(act)
+				require.NoError(t, err)
+				assert.JSONEq(string(expJSON), string(actJSON))
+			}
+		}
+		assert.True(found, "Failed to find line item: %d %+v", exp.ID, actual.LineItems)
+	}
+}
+
+func validateAllOrders(t *testing.T, actual []models.Order, expected *TestData) {
+	for _, o := range actual {
+		switch o.ID {
+		case expected.firstOrder.ID:
+			validateOrder(t, expected.firstOrder, &o)
+			validateAddress(t, expected.firstOrder.BillingAddress, o.BillingAddress)
+			validateAddress(t, expected.firstOrder.ShippingAddress, o.ShippingAddress)
+		case expected.secondOrder.ID:
+			validateOrder(t, expected.secondOrder, &o)
+			validateAddress(t, expected.secondOrder.BillingAddress, o.BillingAddress)
+			validateAddress(t, expected.secondOrder.ShippingAddress, o.ShippingAddress)
+		default:
+			assert.Fail(t, fmt.Sprintf("unexpected order: %+v\n", o))
+		}
+	}
+}
+
+func validateNewUserEmail(t *testing.T, order *models.Order, claims *claims.JWTClaims, expectedUserEmail, expectedOrderEmail string) {
+	db, _, _, _ := db(t)
+	result := db.First(new(models.User), "id = ?", claims.Subject)
+	require.True(t, result.RecordNotFound(), "Unclean test env -- user exists with ID "+claims.Subject)
+
+	err := setOrderEmail(db, order, claims, testLogger, false)
+	require.Nil(t, err)
+
+	user := new(models.User)
+	result = db.First(user, "id = ?", claims.Subject)
+	require.False(t, result.RecordNotFound())
+	assert := assert.New(t)
+	assert.Equal(claims.Subject, user.ID)
+	assert.Equal(claims.Subject, order.UserID)
+	assert.Equal(expectedOrderEmail, order.Email)
+	assert.Equal(expectedUserEmail, user.Email)
+
+	db.Unscoped().Delete(user)
+	//t.Logf("Deleted user %s", claims.Subject)
+}
+
+func validateExistingUserEmail(t *testing.T, db *gorm.DB, order *models.Order, claims *claims.JWTClaims, expectedOrderEmail string) {
+	require.Nil(t, setOrderEmail(db, order, claims, testLogger, false))
+	assert.Equal(t, claims.Subject, order.UserID)
+	assert.Equal(t, expectedOrderEmail, order.Email)
+}
+
+func TestOrderLocale(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+	withLocale := func(locale string) *strings.Reader {
+		return strings.NewReader(strings.Replace(defaultPayload, `"email": "info@example.com",`, `"email": "info@example.com", "locale": "`+locale+`",`, 1))
+	}
+
+	t.Run("Create", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		token := testToken("harley-quinn", "harley@joker.org")
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", withLocale("fr_ca"), token)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Equal(t, "fr-CA", order.Locale)
+
+		user := &models.User{}
+		require.NoError(t, test.DB.First(user, "id = ?", "harley-quinn").Error)
+		assert.Equal(t, "fr-CA", user.Locale)
+
+		recorder = test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(defaultPayload), token)
+		order = &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Equal(t, "fr-CA", order.Locale)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", withLocale("not a locale"), nil)
+		validateError(t, http.StatusBadRequest, recorder, "Invalid locale")
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+		recorder := test.TestEndpoint(http.MethodPatch, "/orders/first-order", strings.NewReader(`{"locale": "DE"}`), token)
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Equal(t, "de", order.Locale)
+
+		recorder = test.TestEndpoint(http.MethodPatch, "/orders/first-order", strings.NewReader(`{"locale": null}`), token)
+		order = &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Empty(t, order.Locale)
+	})
+}
+
+func TestOrderListData(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+	withMeta := func(meta string) *strings.Reader {
+		return strings.NewReader(strings.Replace(defaultPayload, `"email": "info@example.com",`, `"email": "info@example.com", "meta": `+meta+`,`, 1))
+	}
+	listOrders := func(t *testing.T, test *RouteTest, query string) []models.Order {
+		recorder := test.TestEndpoint(http.MethodGet, "/users/all/orders?"+query, nil, token)
+		orders := []models.Order{}
+		extractPayload(t, http.StatusOK, recorder, &orders)
+		return orders
+	}
+
+	test := NewRouteTest(t)
+	test.Config.SiteURL = server.URL
+	test.Config.SearchableMeta = []string{"gift", "source", "count"}
+
+	gift := &models.Order{}
+	recorder := test.TestEndpoint(http.MethodPost, "/orders", withMeta(`{"gift": true, "source": "instagram", "count": 3}`), nil)
+	extractPayload(t, http.StatusCreated, recorder, gift)
+	other := &models.Order{}
+	recorder = test.TestEndpoint(http.MethodPost, "/orders", withMeta(`{"gift": "true", "source": "newsletter", "count": 4}`), nil)
+	extractPayload(t, http.StatusCreated, recorder, other)
+
+	orders := listOrders(t, test, "data.gift=true")
+	assert.Len(t, orders, 2)
+
+	orders = listOrders(t, test, "data.gift=true&data.source=instagram")
+	require.Len(t, orders, 1)
+	assert.Equal(t, gift.ID, orders[0].ID)
+
+	orders = listOrders(t, test, "data.count=4.0")
+	require.Len(t, orders, 1)
+	assert.Equal(t, other.ID, orders[0].ID)
+
+	recorder = test.TestEndpoint(http.MethodPatch, "/orders/"+gift.ID, strings.NewReader(`{"meta": {"source": "newsletter"}}`), token)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	assert.Len(t, listOrders(t, test, "data.source=newsletter"), 2)
+	assert.Empty(t, listOrders(t, test, "data.source=instagram"))
+
+	recorder = test.TestEndpoint(http.MethodGet, "/users/all/orders?data.secret=1", nil, token)
+	validateError(t, http.StatusBadRequest, recorder, "not searchable")
+}
+
+func TestResendConfirmation(t *testing.T) {
+	t.Run("RateLimited", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/resend_confirmation", nil, test.Data.testUserToken)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		events := []models.Event{}
+		require.NoError(t, test.DB.Where("order_id = ? AND type = ?", "first-order", models.EventConfirmationResent).Find(&events).Error)
+		assert.Len(t, events, 1)
+
+		recorder = test.TestEndpoint(http.MethodPost, "/orders/first-order/resend_confirmation", nil, test.Data.testUserToken)
+		validateError(t, http.StatusTooManyRequests, recorder)
+		assert.NotEmpty(t, recorder.Header().Get("Retry-After"))
+	})
+
+	t.Run("ReceiptSharesLimit", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/receipt", strings.NewReader(`{}`), test.Data.testUserToken)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		recorder = test.TestEndpoint(http.MethodPost, "/orders/first-order/receipt", strings.NewReader(`{}`), test.Data.testUserToken)
+		validateError(t, http.StatusTooManyRequests, recorder)
+		recorder = test.TestEndpoint(http.MethodPost, "/orders/first-order/resend_confirmation", nil, test.Data.testUserToken)
+		validateError(t, http.StatusTooManyRequests, recorder)
+
+		// the limit expires after the interval
+		expired := time.Now().Add(-resendConfirmationInterval - time.Minute)
+		require.NoError(t, test.DB.Model(test.Data.firstOrder).UpdateColumn("confirmation_resent_at", expired).Error)
+		recorder = test.TestEndpoint(http.MethodPost, "/orders/first-order/resend_confirmation", nil, test.Data.testUserToken)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+	})
+
+	t.Run("NotPaid", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.firstTransaction.Status = models.FailedState
+		require.NoError(t, test.DB.Save(test.Data.firstTransaction).Error)
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/resend_confirmation", nil, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+
+	t.Run("OtherUser", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/resend_confirmation", nil, testToken("villian", "villian@wayneindustries.com"))
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
+
+func TestOrderLimits(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+
+	t.Run("Minimum", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.Orders.MinTotal = map[string]uint64{"usd": 1000}
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(defaultPayload), test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "at least 10.00 USD")
+
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder = test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(defaultPayload), token)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.True(t, order.Manual)
+	})
+
+	t.Run("Maximum", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.Orders.MaxTotal = map[string]uint64{"USD": 500}
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(defaultPayload), test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "more than 5.00 USD")
+	})
+
+	t.Run("Payment", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Orders.MinTotal = map[string]uint64{"USD": 100}
+		test.Data.firstOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+		body := strings.NewReader(`{"provider": "stripe", "amount": 24, "currency": "USD", "stripe_payment_method_id": "pm_card"}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", body, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "at least 1.00 USD")
+	})
+}
+
+func TestOrderNumber(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+
+	createOrder := func(test *RouteTest) *models.Order {
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(defaultPayload), test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		require.NotNil(t, order.Number)
+		return order
+	}
+
+	t.Run("Sequential", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.Orders.NumberPrefix = "ORD-"
+		test.Config.Orders.NumberYear = true
+
+		year := time.Now().Year()
+		assert.Equal(t, fmt.Sprintf("ORD-%d-000001", year), *createOrder(test).Number)
+		assert.Equal(t, fmt.Sprintf("ORD-%d-000002", year), *createOrder(test).Number)
+	})
+
+	t.Run("Digits", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.Orders.NumberDigits = 3
+		assert.Equal(t, "001", *createOrder(test).Number)
+	})
+
+	t.Run("ByNumber", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		created := createOrder(test)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/by-number/"+*created.Number, nil, test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Equal(t, created.ID, order.ID)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/orders/by-number/"+*created.Number, nil, testToken("stranger", "stranger-danger@wayneindustries.com"))
+		validateError(t, http.StatusNotFound, recorder)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/orders/by-number/does-not-exist", nil, testAdminToken("admin-yo", "admin@wayneindustries.com"))
+		validateError(t, http.StatusNotFound, recorder)
 	})
 
-	t.Run("MultipleTimes", func(t *testing.T) {
+	t.Run("AnonymousByNumber", func(t *testing.T) {
 		test := NewRouteTest(t)
-		test.Data.firstOrder.Email = "villian@wayneindustries.com"
+		number := "000042"
+		test.Data.firstOrder.Number = &number
 		test.Data.firstOrder.UserID = ""
-		rsp := test.DB.Save(test.Data.firstOrder)
-		require.NoError(t, rsp.Error, "Failed to update email")
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
 
-		token := testToken("villian", "villian@wayneindustries.com")
-		recorder := test.TestEndpoint(http.MethodPost, "/claim", nil, token)
-		require.Equal(t, http.StatusNoContent, recorder.Code)
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/by-number/"+number, nil, nil)
+		validateError(t, http.StatusNotFound, recorder)
 
-		recorder = test.TestEndpoint(http.MethodPost, "/claim", nil, token)
-		require.Equal(t, http.StatusNoContent, recorder.Code)
+		recorder = test.TestEndpoint(http.MethodGet, "/orders/by-number/"+number, nil, testAdminToken("admin-yo", "admin@wayneindustries.com"))
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Equal(t, test.Data.firstOrder.ID, order.ID)
 	})
 }
 
-// -------------------------------------------------------------------------------------------------------------------
-// HELPERS
-// -------------------------------------------------------------------------------------------------------------------
+func TestOrderLookupByEmail(t *testing.T) {
+	anonymousOrder := func(test *RouteTest) *models.Order {
+		number := "000042"
+		test.Data.firstOrder.Number = &number
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+		require.NoError(t, test.DB.Model(test.Data.firstOrder).UpdateColumn("user_id", "").Error)
+		test.Data.firstOrder.UserID = ""
+		return test.Data.firstOrder
+	}
 
-func runOrderUpdate(test *RouteTest, order *models.Order, params *orderRequestParams, token *jwt.Token) *httptest.ResponseRecorder {
-	updateBody, err := json.Marshal(params)
-	require.NoError(test.T, err, "Failed to marshal data for update")
-	recorder := test.TestEndpoint(http.MethodPut, fmt.Sprintf("/orders/%s", order.ID), bytes.NewReader(updateBody), token)
-	return recorder
-}
+	t.Run("ByID", func(t *testing.T) {
+		test := NewRouteTest(t)
+		order := anonymousOrder(test)
 
-// -------------------------------------------------------------------------------------------------------------------
-// VALIDATORS
-// -------------------------------------------------------------------------------------------------------------------
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/"+order.ID+"?email="+url.QueryEscape(strings.ToUpper(order.Email)), nil, nil)
+		found := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, found)
+		assert.Equal(t, order.ID, found.ID)
 
-func validateOrder(t *testing.T, expected, actual *models.Order) {
-	assert := assert.New(t)
+		recorder = test.TestEndpoint(http.MethodGet, "/orders/"+order.ID+"?email=guess@example.com", nil, nil)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+	t.Run("ByNumber", func(t *testing.T) {
+		test := NewRouteTest(t)
+		order := anonymousOrder(test)
 
-	// all the stock fields
-	assert.Equal(expected.ID, actual.ID)
-	assert.Equal(expected.UserID, actual.UserID)
-	assert.Equal(expected.Email, actual.Email)
-	assert.Equal(expected.Currency, actual.Currency)
-	assert.Equal(expected.Taxes, actual.Taxes)
-	assert.Equal(expected.Shipping, actual.Shipping)
-	assert.Equal(expected.SubTotal, actual.SubTotal)
-	assert.Equal(expected.NetTotal, actual.NetTotal)
-	assert.Equal(expected.Total, actual.Total)
-	assert.Equal(expected.PaymentState, actual.PaymentState)
-	assert.Equal(expected.FulfillmentState, actual.FulfillmentState)
-	assert.Equal(expected.State, actual.State)
-	assert.Equal(expected.ShippingAddressID, actual.ShippingAddressID)
-	assert.Equal(expected.BillingAddressID, actual.BillingAddressID)
-	assert.WithinDuration(expected.CreatedAt, actual.CreatedAt, time.Duration(1)*time.Second)
-	assert.WithinDuration(expected.UpdatedAt, actual.UpdatedAt, time.Duration(1)*time.Second)
-	assert.Equal(expected.VATNumber, actual.VATNumber)
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/by-number/000042?email="+url.QueryEscape(order.Email), nil, nil)
+		found := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, found)
+		assert.Equal(t, order.ID, found.ID)
 
-	// we don't return the actual user
-	assert.Nil(actual.User)
+		recorder = test.TestEndpoint(http.MethodGet, "/orders/by-number/000042?email=guess@example.com", nil, nil)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+	t.Run("NotAnonymous", func(t *testing.T) {
+		test := NewRouteTest(t)
+		number := "000042"
+		test.Data.firstOrder.Number = &number
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
 
-	for _, exp := range expected.LineItems {
-		found := false
-		for _, act := range actual.LineItems {
-			if act.ID == exp.ID {
-				found = true
-				// We must JSON compare here because we sometimes validate
-				// using values returned from an HTTP endpoint, which omits
-				// certain fields
-				expJSON, err := json.Marshal(exp)
-				require.NoError(t, err)
-				actJSON, err := json.Marshal(act)
-				require.NoError(t, err)
-				assert.JSONEq(string(expJSON), string(actJSON))
-			}
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/by-number/000042?email="+url.QueryEscape(test.Data.firstOrder.Email), nil, nil)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+	t.Run("RateLimited", func(t *testing.T) {
+		test := NewRouteTest(t)
+		order := anonymousOrder(test)
+
+		for i := 0; i < maxFailedEmailLookups; i++ {
+			recorder := test.TestEndpoint(http.MethodGet, "/orders/by-number/000042?email=guess@example.com", nil, nil)
+			validateError(t, http.StatusNotFound, recorder)
 		}
-		assert.True(found, "Failed to find line item: %d %+v", exp.ID, actual.LineItems)
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/by-number/000042?email="+url.QueryEscape(order.Email), nil, nil)
+		validateError(t, http.StatusTooManyRequests, recorder)
+		assert.NotEmpty(t, recorder.Header().Get("Retry-After"))
+
+		recorder = test.TestEndpoint(http.MethodGet, "/orders/"+order.ID+"?email=guess@example.com", nil, nil)
+		validateError(t, http.StatusTooManyRequests, recorder)
+	})
+}
+
+func TestOrderPricesIncludeTax(t *testing.T) {
+	server := startTestSiteWithSettings(&calculator.Settings{
+		Taxes: []*calculator.Tax{{Percentage: 7, ProductTypes: []string{"Book"}, Countries: []string{"USA"}}},
+	})
+	defer server.Close()
+
+	createOrder := func(test *RouteTest) *models.Order {
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(defaultPayload), test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		return order
 	}
+
+	t.Run("Inclusive", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.PricesIncludeTax = true
+
+		order := createOrder(test)
+		assert.True(t, order.PricesIncludeTaxes)
+		assert.EqualValues(t, 999, order.Total)
+		assert.EqualValues(t, 65, order.Taxes)
+		assert.EqualValues(t, 934, order.NetTotal)
+
+		ctx, err := WithInstanceConfig(context.Background(), test.GlobalConfig.SMTP, test.Config, "")
+		require.NoError(t, err)
+		api := NewAPIWithVersion(ctx, test.GlobalConfig, logrus.StandardLogger(), test.DB, defaultVersion)
+		r := httptest.NewRequest(http.MethodPost, "/orders/"+order.ID+"/payments", nil).WithContext(ctx)
+		assert.Nil(t, api.verifyAmount(r, order, 999))
+
+		// the total is out of date once the prices don't include taxes anymore
+		test.Config.PricesIncludeTax = false
+		ctx, err = WithInstanceConfig(context.Background(), test.GlobalConfig.SMTP, test.Config, "")
+		require.NoError(t, err)
+		httpErr := api.verifyAmount(r.WithContext(ctx), order, 999)
+		require.NotNil(t, httpErr)
+		assert.Equal(t, http.StatusConflict, httpErr.Code)
+	})
+
+	t.Run("Exclusive", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+
+		order := createOrder(test)
+		assert.False(t, order.PricesIncludeTaxes)
+		assert.EqualValues(t, 1069, order.Total)
+		assert.EqualValues(t, 70, order.Taxes)
+		assert.EqualValues(t, 999, order.NetTotal)
+	})
 }
 
-func validateAllOrders(t *testing.T, actual []models.Order, expected *TestData) {
-	for _, o := range actual {
-		switch o.ID {
-		case expected.firstOrder.ID:
-			validateOrder(t, expected.firstOrder, &o)
-			validateAddress(t, expected.firstOrder.BillingAddress, o.BillingAddress)
-			validateAddress(t, expected.firstOrder.ShippingAddress, o.ShippingAddress)
-		case expected.secondOrder.ID:
-			validateOrder(t, expected.secondOrder, &o)
-			validateAddress(t, expected.secondOrder.BillingAddress, o.BillingAddress)
-			validateAddress(t, expected.secondOrder.ShippingAddress, o.ShippingAddress)
-		default:
-			assert.Fail(t, fmt.Sprintf("unexpected order: %+v\n", o))
-		}
+func TestOrderTaxLines(t *testing.T) {
+	server := startTestSiteWithSettings(&calculator.Settings{
+		Taxes: []*calculator.Tax{
+			{Name: "State", Percentage: 6, Countries: []string{"USA"}},
+			{Name: "City", Percentage: 2, ProductTypes: []string{"Book"}, Countries: []string{"USA"}},
+		},
+	})
+	defer server.Close()
+
+	test := NewRouteTest(t)
+	test.Config.SiteURL = server.URL
+
+	recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(defaultPayload), test.Data.testUserToken)
+	order := &models.Order{}
+	extractPayload(t, http.StatusCreated, recorder, order)
+	assert.EqualValues(t, 80, order.Taxes)
+	assert.EqualValues(t, 1079, order.Total)
+	expected := []calculator.TaxLine{
+		{Name: "State", Percentage: 6, Amount: 60},
+		{Name: "City", Percentage: 2, Amount: 20},
 	}
+	assert.Equal(t, expected, order.TaxLines)
+
+	saved := &models.Order{}
+	require.NoError(t, orderQuery(test.DB).First(saved, "id = ?", order.ID).Error)
+	assert.Equal(t, expected, saved.TaxLines)
+	require.Len(t, saved.LineItems, 1)
+	assert.EqualValues(t, 80, saved.LineItems[0].LineTaxes)
+	assert.Equal(t, expected, saved.LineItems[0].TaxLines)
+
+	ctx, err := WithInstanceConfig(context.Background(), test.GlobalConfig.SMTP, test.Config, "")
+	require.NoError(t, err)
+	api := NewAPIWithVersion(ctx, test.GlobalConfig, logrus.StandardLogger(), test.DB, defaultVersion)
+	r := httptest.NewRequest(http.MethodPost, "/orders/"+order.ID+"/payments", nil).WithContext(ctx)
+	assert.Nil(t, api.verifyAmount(r, saved, 1079))
+
+	saved.TaxLines[1].Amount = 19
+	assert.NotNil(t, api.verifyAmount(r, saved, 1079))
 }
 
-func validateNewUserEmail(t *testing.T, order *models.Order, claims *claims.JWTClaims, expectedUserEmail, expectedOrderEmail string) {
-	db, _, _, _ := db(t)
-	result := db.First(new(models.User), "id = ?", claims.Subject)
-	require.True(t, result.RecordNotFound(), "Unclean test env -- user exists with ID "+claims.Subject)
+func TestOrderClientInfo(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
 
-	err := setOrderEmail(db, order, claims, testLogger)
-	require.Nil(t, err)
+	create := func(t *testing.T, test *RouteTest, forwardedFor string) *models.Order {
+		test.Config.SiteURL = server.URL
+		headers := map[string]string{"User-Agent": "Batcomputer/1.0", "X-Forwarded-For": forwardedFor}
+		recorder := test.TestEndpointWithHeaders(http.MethodPost, "/orders", strings.NewReader(defaultPayload), test.Data.testUserToken, headers)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Equal(t, "Batcomputer/1.0", order.UserAgent)
+		return order
+	}
 
-	user := new(models.User)
-	result = db.First(user, "id = ?", claims.Subject)
-	require.False(t, result.RecordNotFound())
-	assert := assert.New(t)
-	assert.Equal(claims.Subject, user.ID)
-	assert.Equal(claims.Subject, order.UserID)
-	assert.Equal(expectedOrderEmail, order.Email)
-	assert.Equal(expectedUserEmail, user.Email)
+	t.Run("TrustedProxies", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.GlobalConfig.API.TrustedProxies = []string{"192.0.2.0/24", "10.0.0.0/8"}
 
-	db.Unscoped().Delete(user)
-	//t.Logf("Deleted user %s", claims.Subject)
+		// the client can prepend any address, but not the ones the proxies append
+		order := create(t, test, "6.6.6.6, 203.0.113.7, 10.1.2.3")
+		assert.Equal(t, "203.0.113.7", order.IP)
+
+		test.GlobalConfig.API.TrustedProxies = []string{"10.0.0.0/8"}
+		order = create(t, test, "6.6.6.6")
+		assert.Equal(t, "192.0.2.1", order.IP)
+	})
+
+	t.Run("NoTrustedProxies", func(t *testing.T) {
+		test := NewRouteTest(t)
+		order := create(t, test, "6.6.6.6")
+		assert.Equal(t, "192.0.2.1", order.IP)
+	})
+
+	t.Run("Payment", func(t *testing.T) {
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+			intent := v.(*stripe.PaymentIntent)
+			intent.ID = stripePaymentIntentID
+			intent.Status = stripe.PaymentIntentStatusSucceeded
+			return nil
+		}))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		test := NewRouteTest(t)
+		test.Data.firstOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+		body := `{"provider": "stripe", "amount": 24, "currency": "USD", "stripe_payment_method_id": "pm_card"}`
+		headers := map[string]string{"User-Agent": "Batcomputer/1.0"}
+		recorder := test.TestEndpointWithHeaders(http.MethodPost, "/orders/first-order/payments", strings.NewReader(body), test.Data.testUserToken, headers)
+		tr := &models.Transaction{}
+		extractPayload(t, http.StatusOK, recorder, tr)
+		assert.Equal(t, "192.0.2.1", tr.IP)
+		assert.Equal(t, "Batcomputer/1.0", tr.UserAgent)
+	})
 }
 
-func validateExistingUserEmail(t *testing.T, db *gorm.DB, order *models.Order, claims *claims.JWTClaims, expectedOrderEmail string) {
-	require.Nil(t, setOrderEmail(db, order, claims, testLogger))
-	assert.Equal(t, claims.Subject, order.UserID)
-	assert.Equal(t, expectedOrderEmail, order.Email)
+func TestOrderSource(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+
+	create := func(t *testing.T, test *RouteTest, payload string, headers map[string]string) *httptest.ResponseRecorder {
+		test.Config.SiteURL = server.URL
+		return test.TestEndpointWithHeaders(http.MethodPost, "/orders", strings.NewReader(payload), test.Data.testUserToken, headers)
+	}
+	withSource := strings.Replace(defaultPayload, `"email"`, `"source": "POS", "email"`, 1)
+
+	t.Run("Default", func(t *testing.T) {
+		test := NewRouteTest(t)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, create(t, test, defaultPayload, nil), order)
+		assert.Equal(t, models.DefaultOrderSource, order.Source)
+	})
+
+	t.Run("Params", func(t *testing.T) {
+		test := NewRouteTest(t)
+		order := &models.Order{}
+		headers := map[string]string{orderSourceHeader: "mobile"}
+		extractPayload(t, http.StatusCreated, create(t, test, withSource, headers), order)
+		assert.Equal(t, "pos", order.Source)
+
+		stored := &models.Order{}
+		require.NoError(t, test.DB.First(stored, "id = ?", order.ID).Error)
+		assert.Equal(t, "pos", stored.Source)
+	})
+
+	t.Run("Header", func(t *testing.T) {
+		test := NewRouteTest(t)
+		order := &models.Order{}
+		headers := map[string]string{orderSourceHeader: "mobile"}
+		extractPayload(t, http.StatusCreated, create(t, test, defaultPayload, headers), order)
+		assert.Equal(t, "mobile", order.Source)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		test := NewRouteTest(t)
+		headers := map[string]string{orderSourceHeader: "point of sale"}
+		validateError(t, http.StatusBadRequest, create(t, test, defaultPayload, headers), "Invalid order source")
+	})
+
+	t.Run("ListFilter", func(t *testing.T) {
+		test := NewRouteTest(t)
+		require.NoError(t, test.DB.Model(test.Data.secondOrder).UpdateColumn("source", "pos").Error)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+		recorder := test.TestEndpoint(http.MethodGet, "/users/all/orders?source=pos", nil, token)
+		orders := []models.Order{}
+		extractPayload(t, http.StatusOK, recorder, &orders)
+		require.Len(t, orders, 1)
+		assert.Equal(t, test.Data.secondOrder.ID, orders[0].ID)
+	})
+}
+
+func TestOrderGiftOptions(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+
+	withGift := func(message string, wrap bool) string {
+		return strings.Replace(defaultPayload, `"email"`, fmt.Sprintf(`"gift_message": %q, "gift_wrap": %t, "email"`, message, wrap), 1)
+	}
+	preview := func(t *testing.T, test *RouteTest, payload string) *orderPreview {
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/preview", strings.NewReader(payload), test.Data.testUserToken)
+		result := &orderPreview{}
+		extractPayload(t, http.StatusOK, recorder, result)
+		return result
+	}
+
+	t.Run("Create", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.Orders.GiftWrapFee = map[string]uint64{"usd": 500}
+
+		plain := preview(t, test, defaultPayload)
+		wrapped := preview(t, test, withGift("Happy birthday!", true))
+		assert.EqualValues(t, 500, wrapped.GiftWrapFee)
+		assert.Equal(t, plain.Total+500, wrapped.Total)
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(withGift("  Happy birthday!  ", true)), test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Equal(t, "Happy birthday!", order.GiftMessage)
+		assert.True(t, order.GiftWrap)
+		assert.EqualValues(t, 500, order.GiftWrapFee)
+		assert.Equal(t, wrapped.Total, order.Total)
+	})
+
+	t.Run("MessageTooLong", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(withGift(strings.Repeat("x", 501), false)), test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "gift message")
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Orders.GiftWrapFee = map[string]uint64{"USD": 500}
+		test.Data.firstOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+		total := test.Data.firstOrder.Total
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+		wrap, message := true, "For Alfred"
+		recorder := runOrderUpdate(test, test.Data.firstOrder, &orderRequestParams{GiftWrap: &wrap, GiftMessage: &message}, token)
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Equal(t, "For Alfred", order.GiftMessage)
+		assert.EqualValues(t, 500, order.GiftWrapFee)
+		assert.Equal(t, total+500, order.Total)
+
+		require.NoError(t, test.DB.Model(order).UpdateColumn("payment_state", models.PaidState).Error)
+		wrap = false
+		recorder = runOrderUpdate(test, order, &orderRequestParams{GiftWrap: &wrap}, token)
+		validateError(t, http.StatusBadRequest, recorder, "gift wrapping")
+	})
+}
+
+func TestOrdersListShape(t *testing.T) {
+	t.Run("Fields", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/orders?fields=id,total,payment_state", nil, test.Data.testUserToken)
+
+		orders := []map[string]interface{}{}
+		extractPayload(t, http.StatusOK, recorder, &orders)
+		require.Len(t, orders, 2)
+		for _, order := range orders {
+			assert.Len(t, order, 3)
+			assert.Contains(t, order, "id")
+			assert.Contains(t, order, "total")
+			assert.Contains(t, order, "payment_state")
+		}
+	})
+	t.Run("Expand", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/orders?fields=id&expand=line_items", nil, test.Data.testUserToken)
+
+		orders := []models.Order{}
+		extractPayload(t, http.StatusOK, recorder, &orders)
+		require.Len(t, orders, 2)
+		for _, order := range orders {
+			assert.NotEmpty(t, order.LineItems)
+			assert.Empty(t, order.Transactions)
+			assert.Empty(t, order.Email)
+		}
+	})
+	t.Run("ExpandOnly", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/orders?expand=transactions", nil, test.Data.testUserToken)
+
+		orders := []map[string]interface{}{}
+		extractPayload(t, http.StatusOK, recorder, &orders)
+		require.Len(t, orders, 2)
+		for _, order := range orders {
+			assert.Contains(t, order, "email")
+			assert.Contains(t, order, "transactions")
+			assert.NotContains(t, order, "line_items")
+			assert.NotContains(t, order, "billing_address")
+		}
+	})
+	t.Run("UnknownField", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/orders?fields=id,password", nil, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "Unknown field 'password'")
+
+		recorder = test.TestEndpoint(http.MethodGet, "/orders?expand=email", nil, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "Unknown association 'email'")
+	})
+}
+
+func TestOrderPreview(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+
+	t.Run("Simple", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		count := func(model interface{}) int {
+			var n int
+			require.NoError(t, test.DB.Model(model).Count(&n).Error)
+			return n
+		}
+		orders, addresses, items := count(&models.Order{}), count(&models.Address{}), count(&models.LineItem{})
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/preview", strings.NewReader(defaultPayload), test.Data.testUserToken)
+		preview := &orderPreview{}
+		extractPayload(t, http.StatusOK, recorder, preview)
+		assert.Equal(t, "USD", preview.Currency)
+		assert.EqualValues(t, 999, preview.Total)
+		assert.EqualValues(t, 999, preview.SubTotal)
+		require.Len(t, preview.LineItems, 1)
+		assert.EqualValues(t, 999, preview.LineItems[0].CalculationDetail.Total)
+
+		assert.Equal(t, orders, count(&models.Order{}))
+		assert.Equal(t, addresses, count(&models.Address{}))
+		assert.Equal(t, items, count(&models.LineItem{}))
+		assert.Zero(t, count(&models.Hook{}))
+	})
+	t.Run("NoWrites", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		writes := 0
+		count := func(*gorm.Scope) { writes++ }
+		test.DB.Callback().Create().Before("gorm:create").Register("test:count_writes", count)
+		test.DB.Callback().Update().Before("gorm:update").Register("test:count_writes", count)
+		test.DB.Callback().Delete().Before("gorm:delete").Register("test:count_writes", count)
+		defer func() {
+			test.DB.Callback().Create().Remove("test:count_writes")
+			test.DB.Callback().Update().Remove("test:count_writes")
+			test.DB.Callback().Delete().Remove("test:count_writes")
+		}()
+
+		// the user of the token doesn't exist yet and the VAT number isn't verified
+		body := strings.Replace(defaultPayload, `"line_items"`, `"vatnumber": "DE123456789", "line_items"`, 1)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/preview", strings.NewReader(body), testToken("robin", "robin@wayneindustries.com"))
+		preview := &orderPreview{}
+		extractPayload(t, http.StatusOK, recorder, preview)
+		assert.True(t, preview.TaxExempt)
+		assert.Zero(t, writes)
+		assert.True(t, test.DB.First(&models.User{}, "id = ?", "robin").RecordNotFound())
+	})
+	t.Run("MatchesCreatedOrder", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/preview", strings.NewReader(defaultPayload), test.Data.testUserToken)
+		preview := &orderPreview{}
+		extractPayload(t, http.StatusOK, recorder, preview)
+
+		recorder = test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(defaultPayload), test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Equal(t, order.Total, preview.Total)
+		assert.Equal(t, order.Taxes, preview.Taxes)
+		assert.Equal(t, order.Shipping, preview.Shipping)
+	})
+	t.Run("MissingShippingAddress", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		body := strings.NewReader(`{"email": "info@example.com", "line_items": [{"path": "/simple-product", "quantity": 1}]}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/preview", body, nil)
+		validateError(t, http.StatusBadRequest, recorder, "Shipping Address Required")
+	})
+}
+
+// BenchmarkOrderList lists a few hundred orders, once with the associations
+// preloaded as OrderList does and once loading them order by order.
+func BenchmarkOrderList(b *testing.B) {
+	db, globalConfig, config, data := db(b)
+	for i := 0; i < 300; i++ {
+		order := models.NewOrder("", "session", data.testUser.Email, "USD")
+		order.UserID = data.testUser.ID
+		order.LineItems = []*models.LineItem{
+			{Title: "batwing", Sku: "123-i-can-fly-456", Price: 12, Quantity: 2},
+			{Title: "tumbler", Sku: "456-i-rollover-all-things", Price: 5, Quantity: 1},
+		}
+		order.BillingAddress = data.testAddress
+		order.ShippingAddress = data.testAddress
+		require.NoError(b, db.Create(order).Error)
+		require.NoError(b, db.Create(models.NewTransaction(order)).Error)
+	}
+
+	queries := 0
+	db.Callback().Query().After("gorm:query").Register("test:count_queries", func(*gorm.Scope) {
+		queries++
+	})
+	defer db.Callback().Query().Remove("test:count_queries")
+
+	b.Run("Preload", func(b *testing.B) {
+		ctx, err := WithInstanceConfig(context.Background(), globalConfig.SMTP, config, "")
+		require.NoError(b, err)
+		handler := NewAPIWithVersion(ctx, globalConfig, logrus.StandardLogger(), db, "").handler
+
+		queries = 0
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			recorder := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, baseURL+"/orders?per_page=500", nil)
+			require.NoError(b, signHTTPRequest(req, data.testUserToken, config.JWT.Secret))
+			handler.ServeHTTP(recorder, req)
+			require.Equal(b, http.StatusOK, recorder.Code)
+		}
+		b.ReportMetric(float64(queries)/float64(b.N), "queries/op")
+	})
+	b.Run("PerOrder", func(b *testing.B) {
+		queries = 0
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			var orders []models.Order
+			require.NoError(b, db.Where("user_id = ?", data.testUser.ID).Find(&orders).Error)
+			for j := range orders {
+				order := &orders[j]
+				require.NoError(b, db.Model(order).Related(&order.LineItems).Error)
+				require.NoError(b, db.Model(order).Related(&order.Downloads).Error)
+				require.NoError(b, db.Model(order).Related(&order.Transactions).Error)
+				require.NoError(b, db.Model(order).Related(&order.Shipments).Error)
+				require.NoError(b, db.Model(order).Related(&order.ShippingAddress, "ShippingAddressID").Error)
+				require.NoError(b, db.Model(order).Related(&order.BillingAddress, "BillingAddressID").Error)
+			}
+		}
+		b.ReportMetric(float64(queries)/float64(b.N), "queries/op")
+	})
 }
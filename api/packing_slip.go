@@ -0,0 +1,92 @@
+package api
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// packingSlipParcel is the part of an order that ships to one address.
+type packingSlipParcel struct {
+	Address models.Address
+	Items   []*models.LineItem
+}
+
+// packingSlipTemplate lists what's in the parcels of an order for the
+// warehouse. Unlike the receipt it has no prices, so it can be put in the
+// parcel of a gift.
+var packingSlipTemplate = template.Must(template.New("packing_slip").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Packing slip {{ with .Order.Number }}{{ . }}{{ else }}{{ .Order.ID }}{{ end }}</title></head>
+<body>
+<h2>Packing slip</h2>
+<p>Order {{ with .Order.Number }}<strong>{{ . }}</strong>{{ else }}<strong>{{ .Order.ID }}</strong>{{ end }} placed {{ .Order.CreatedAt.Format "January 2, 2006" }}</p>
+{{ range .Parcels }}
+<h3>Ship to</h3>
+<address>
+{{ .Address.Name }}<br>
+{{ with .Address.Company }}{{ . }}<br>{{ end }}
+{{ .Address.Address1 }}<br>
+{{ with .Address.Address2 }}{{ . }}<br>{{ end }}
+{{ .Address.Zip }} {{ .Address.City }}{{ with .Address.State }}, {{ . }}{{ end }}<br>
+{{ .Address.Country }}
+</address>
+<table>
+<tr><th>Item</th><th>SKU</th><th>Quantity</th></tr>
+{{ range .Items }}
+<tr><td>{{ .Title }}{{ if .Backordered }} <em>(pre-order)</em>{{ end }}</td><td>{{ .Sku }}</td><td>{{ .Quantity }}</td></tr>
+{{ end }}
+</table>
+{{ end }}
+{{ if .Order.GiftWrap }}
+<p><strong>Gift wrap this order</strong></p>
+{{ end }}
+{{ with .Order.GiftMessage }}
+<h3>Gift message</h3>
+<blockquote>{{ . }}</blockquote>
+{{ end }}
+</body>
+</html>
+`))
+
+// PackingSlip renders the packing slip of an order as HTML, with a section
+// for each address the order ships to.
+func (a *API) PackingSlip(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	id := gcontext.GetOrderID(ctx)
+	logEntrySetField(r, "order_id", id)
+
+	order := &models.Order{}
+	query := siteScope(ctx, orderQuery(a.ReadDB(r)), "").Where("instance_id = ?", gcontext.GetInstanceID(ctx))
+	if rsp := query.First(order, "id = ?", id); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return notFoundError("Order not found")
+		}
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+
+	parcels := []packingSlipParcel{}
+	for _, shipment := range order.Shipments {
+		parcels = append(parcels, packingSlipParcel{Address: shipment.ShippingAddress, Items: order.ShipmentItems(shipment)})
+	}
+	if len(parcels) == 0 {
+		parcels = append(parcels, packingSlipParcel{Address: order.ShippingAddress, Items: order.LineItems})
+	}
+
+	body := &bytes.Buffer{}
+	err := packingSlipTemplate.Execute(body, map[string]interface{}{
+		"Order":   order,
+		"Parcels": parcels,
+	})
+	if err != nil {
+		return internalServerError("Error rendering the packing slip").WithInternalError(err)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(body.Bytes())
+	return err
+}
@@ -0,0 +1,44 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPackingSlip(t *testing.T) {
+	t.Run("Admin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.firstOrder.GiftMessage = "Happy birthday <Bruce>"
+		test.Data.firstOrder.GiftWrap = true
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/first-order/packing_slip", nil, token)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		assert.Contains(t, recorder.Header().Get("Content-Type"), "text/html")
+
+		body := recorder.Body.String()
+		assert.Contains(t, body, "batwing")
+		assert.Contains(t, body, "123-i-can-fly-456")
+		assert.Contains(t, body, test.Data.testAddress.Address1)
+		assert.Contains(t, body, "Gift wrap this order")
+		assert.Contains(t, body, "Happy birthday &lt;Bruce&gt;")
+		assert.NotContains(t, body, "Total")
+	})
+
+	t.Run("Customer", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/first-order/packing_slip", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/unknown/packing_slip", nil, token)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+}
@@ -37,8 +37,15 @@ func addPaginationHeaders(w http.ResponseWriter, r *http.Request, page, perPage,
 	w.Header().Add("X-Total-Count", fmt.Sprintf("%v", total))
 }
 
+// paginate counts the results of the query and returns the offset and limit
+// of the requested page. Pages are selected with page and per_page, or with
+// limit and offset, which only set the X-Total-Count header.
 func paginate(w http.ResponseWriter, r *http.Request, query *gorm.DB) (offset int, limit int, err error) {
 	params := r.URL.Query()
+	if params.Get("limit") != "" || params.Get("offset") != "" {
+		return paginateOffset(w, params, query)
+	}
+
 	queryPage := params.Get("page")
 	queryPerPage := params.Get("per_page")
 	var page uint64 = 1
@@ -68,3 +75,29 @@ func paginate(w http.ResponseWriter, r *http.Request, query *gorm.DB) (offset in
 
 	return
 }
+
+func paginateOffset(w http.ResponseWriter, params url.Values, query *gorm.DB) (offset int, limit int, err error) {
+	var queryOffset uint64
+	var queryLimit uint64 = defaultPerPage
+	if value := params.Get("offset"); value != "" {
+		queryOffset, err = strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return
+		}
+	}
+	if value := params.Get("limit"); value != "" {
+		queryLimit, err = strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return
+		}
+	}
+
+	var total uint64
+	if result := query.Count(&total); result.Error != nil {
+		err = result.Error
+		return
+	}
+
+	w.Header().Add("X-Total-Count", fmt.Sprintf("%v", total))
+	return int(queryOffset), int(queryLimit), nil
+}
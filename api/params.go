@@ -26,6 +26,15 @@ var sortFields = map[string]string{
 	"total":      "total",
 }
 
+var paymentSortFields = map[string]string{
+	"created_at": "created_at",
+	"updated_at": "updated_at",
+	"amount":     "amount",
+	"currency":   "currency",
+	"status":     "status",
+	"type":       "type",
+}
+
 func parsePaymentQueryParams(query *gorm.DB, params url.Values) (*gorm.DB, error) {
 	transactionTable := query.NewScope(models.Transaction{}).QuotedTableName()
 	query = addFilters(query, transactionTable, params, []string{
@@ -46,7 +55,17 @@ func parsePaymentQueryParams(query *gorm.DB, params url.Values) (*gorm.DB, error
 		query = query.Where(transactionTable+".amount <= ?", values[0])
 	}
 
-	query, err := parseLimitQueryParam(query, params)
+	if processor := params.Get("processor"); processor != "" {
+		orderTable := query.NewScope(models.Order{}).QuotedTableName()
+		query = query.Where(transactionTable+".order_id IN (SELECT id FROM "+orderTable+" WHERE payment_processor IN (?))", strings.Split(processor, ","))
+	}
+
+	query, err := parseSortParams(query, transactionTable, params, paymentSortFields)
+	if err != nil {
+		return nil, err
+	}
+
+	query, err = parseLimitQueryParam(query, params)
 	if err != nil {
 		return nil, err
 	}
@@ -75,15 +94,82 @@ func parseUserQueryParams(query *gorm.DB, params url.Values) (*gorm.DB, error) {
 		"email",
 	})
 
-	query, err := parseLimitQueryParam(query, params)
+	query, err := parseTimeQueryParams(query, userTable, params)
 	if err != nil {
 		return nil, err
 	}
-	return parseTimeQueryParams(query, userTable, params)
+
+	createdFrom, err := getTimeParam(params, "created_from")
+	if err != nil {
+		return nil, err
+	}
+	if createdFrom != nil {
+		query = query.Where(userTable+".created_at >= ?", createdFrom)
+	}
+	createdTo, err := getTimeParam(params, "created_to")
+	if err != nil {
+		return nil, err
+	}
+	if createdTo != nil {
+		query = query.Where(userTable+".created_at <= ?", createdTo)
+	}
+	return query, nil
 }
 
-func sortField(value string) string {
-	return sortFields[value]
+// parseSortParams orders the query by the sort parameters, which are a field
+// optionally followed by a direction, e.g. `sort=created_at desc`. The `order`
+// parameter sets the direction of fields that don't have one. Only the fields
+// in the allowed map can be used, so the column name can't be injected.
+func parseSortParams(query *gorm.DB, table string, params url.Values, allowed map[string]string) (*gorm.DB, error) {
+	defaultDir := descending
+	if order := params.Get("order"); order != "" {
+		dir, err := parseSortDirection(order)
+		if err != nil {
+			return nil, err
+		}
+		defaultDir = dir
+	}
+
+	prefix := ""
+	if table != "" {
+		prefix = table + "."
+	}
+
+	values, exists := params["sort"]
+	if !exists {
+		return query.Order(prefix + "created_at " + string(defaultDir)), nil
+	}
+
+	for _, value := range values {
+		parts := strings.Split(value, " ")
+		field, ok := allowed[parts[0]]
+		if !ok {
+			return nil, fmt.Errorf("bad field for sort '%v'", parts[0])
+		}
+		dir := ascending
+		if _, ok := params["order"]; ok {
+			dir = defaultDir
+		}
+		if len(parts) == 2 {
+			var err error
+			if dir, err = parseSortDirection(parts[1]); err != nil {
+				return nil, err
+			}
+		}
+		query = query.Order(prefix + field + " " + string(dir))
+	}
+	return query, nil
+}
+
+func parseSortDirection(value string) (sortDirection, error) {
+	switch strings.ToLower(value) {
+	case string(ascending):
+		return ascending, nil
+	case string(descending):
+		return descending, nil
+	default:
+		return "", fmt.Errorf("bad direction for sort '%v', only 'asc' and 'desc' allowed", value)
+	}
 }
 
 func addAddressFilter(query *gorm.DB, params url.Values, queryField string, dbField string) *gorm.DB {
@@ -123,6 +209,26 @@ func addNegativeAddressFilter(query *gorm.DB, params url.Values, queryField stri
 	return query
 }
 
+// addCustomerSearch matches the email of orders and the names of their billing
+// and shipping addresses case-insensitively with "?email=" and "?name="
+func addCustomerSearch(query *gorm.DB, params url.Values) *gorm.DB {
+	orderTable := query.NewScope(models.Order{}).QuotedTableName()
+
+	if email := params.Get("email"); email != "" {
+		query = query.Where("LOWER("+orderTable+".email) LIKE ?", "%"+strings.ToLower(email)+"%")
+	}
+
+	if name := params.Get("name"); name != "" {
+		addressTable := query.NewScope(models.Address{}).QuotedTableName()
+		query = query.
+			Joins("LEFT JOIN " + addressTable + " as search_billing on search_billing.id = " + orderTable + ".billing_address_id").
+			Joins("LEFT JOIN " + addressTable + " as search_shipping on search_shipping.id = " + orderTable + ".shipping_address_id")
+		pattern := "%" + strings.ToLower(name) + "%"
+		query = query.Where("LOWER(search_billing.name) LIKE ? OR LOWER(search_shipping.name) LIKE ?", pattern, pattern)
+	}
+	return query
+}
+
 func parseOrderParams(query *gorm.DB, params url.Values) (*gorm.DB, error) {
 	orderTable := query.NewScope(models.Order{}).QuotedTableName()
 
@@ -138,28 +244,9 @@ func parseOrderParams(query *gorm.DB, params url.Values) (*gorm.DB, error) {
 	query = addNegativeAddressFilter(query, params, "countries", "country")
 	query = addAddressFilter(query, params, "name", "name")
 
-	if values, exists := params["sort"]; exists {
-		for _, value := range values {
-			parts := strings.Split(value, " ")
-			field := sortField(parts[0])
-			if field == "" {
-				return nil, fmt.Errorf("bad field for sort '%v'", field)
-			}
-			dir := ascending
-			if len(parts) == 2 {
-				switch strings.ToLower(parts[1]) {
-				case string(ascending):
-					dir = ascending
-				case string(descending):
-					dir = descending
-				default:
-					return nil, fmt.Errorf("bad direction for sort '%v', only 'asc' and 'desc' allowed", parts[1])
-				}
-			}
-			query = query.Order(field + " " + string(dir))
-		}
-	} else {
-		query = query.Order("created_at desc")
+	query, err := parseSortParams(query, "", params, sortFields)
+	if err != nil {
+		return nil, err
 	}
 
 	if items := params.Get("items"); items != "" {
@@ -176,7 +263,16 @@ func parseOrderParams(query *gorm.DB, params url.Values) (*gorm.DB, error) {
 		query = query.Joins(statement, "%"+itemType+"%")
 	}
 
-	query, err := addFilterChoices(query, orderTable, params, "payment_state", models.PaymentStates)
+	if skus := params.Get("sku"); skus != "" {
+		// a subquery rather than a join, so orders with several matching
+		// line items are listed and counted once
+		lineItemTable := query.NewScope(models.LineItem{}).QuotedTableName()
+		statement := "EXISTS (SELECT 1 FROM " + lineItemTable + " WHERE " + lineItemTable + ".order_id = " + orderTable + ".id AND " +
+			lineItemTable + ".sku IN (?) AND " + lineItemTable + ".deleted_at IS NULL)"
+		query = query.Where(statement, strings.Split(skus, ","))
+	}
+
+	query, err = addFilterChoices(query, orderTable, params, "payment_state", models.PaymentStates)
 	if err != nil {
 		return nil, err
 	}
@@ -187,12 +283,13 @@ func parseOrderParams(query *gorm.DB, params url.Values) (*gorm.DB, error) {
 
 	query = addFilters(query, orderTable, params, []string{
 		"invoice_number",
+		"source",
 	})
 
 	query = addLikeFilters(query, orderTable, params, []string{
-		"email",
 		"coupon_code",
 	})
+	query = addCustomerSearch(query, params)
 
 	return parseTimeQueryParams(query, orderTable, params)
 }
@@ -210,24 +307,26 @@ func parseLimitQueryParam(query *gorm.DB, params url.Values) (*gorm.DB, error) {
 }
 
 func getTimeQueryParams(params url.Values) (from *time.Time, to *time.Time, err error) {
-	if value := params.Get("from"); value != "" {
-		ts, err := strconv.ParseInt(value, 10, 64)
-		if err != nil {
-			return from, to, fmt.Errorf("bad value for 'from' parameter: %s", err)
-		}
-		t := time.Unix(ts, 0)
-		from = &t
+	if from, err = getTimeParam(params, "from"); err != nil {
+		return
 	}
+	to, err = getTimeParam(params, "to")
+	return
+}
 
-	if value := params.Get("to"); value != "" {
-		ts, err := strconv.ParseInt(value, 10, 64)
-		if err != nil {
-			return from, to, fmt.Errorf("bad value for 'to' parameter: %s", err)
-		}
-		t := time.Unix(ts, 0)
-		to = &t
+// getTimeParam parses the query param as a Unix timestamp, it returns nil if
+// the param isn't set.
+func getTimeParam(params url.Values, name string) (*time.Time, error) {
+	value := params.Get(name)
+	if value == "" {
+		return nil, nil
 	}
-	return
+	ts, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad value for '%s' parameter: %s", name, err)
+	}
+	t := time.Unix(ts, 0)
+	return &t, nil
 }
 
 func parseTimeQueryParams(query *gorm.DB, tableName string, params url.Values) (*gorm.DB, error) {
@@ -244,6 +343,54 @@ func parseTimeQueryParams(query *gorm.DB, tableName string, params url.Values) (
 	return query, nil
 }
 
+// maxDataFilters limits the number of metadata filters in a query, since
+// each of them joins the data table.
+const maxDataFilters = 5
+
+// addDataFilters filters orders by their indexed metadata with query params
+// like data.gift=true. Only the searchable keys can be used. Values match
+// metadata of any type they can be parsed as, so "true" matches both the
+// boolean and the string.
+func addDataFilters(query *gorm.DB, orderTable string, params url.Values, searchable []string) (*gorm.DB, error) {
+	allowed := map[string]bool{}
+	for _, key := range searchable {
+		allowed[key] = true
+	}
+
+	filters := 0
+	dataTable := query.NewScope(models.Data{}).QuotedTableName()
+	for param, values := range params {
+		if !strings.HasPrefix(param, "data.") {
+			continue
+		}
+		key := strings.TrimPrefix(param, "data.")
+		if !allowed[key] {
+			return nil, fmt.Errorf("metadata key '%s' is not searchable", key)
+		}
+		filters++
+		if filters > maxDataFilters {
+			return nil, fmt.Errorf("can't filter by more than %d metadata keys", maxDataFilters)
+		}
+
+		value := values[0]
+		alias := fmt.Sprintf("data_%d", filters)
+		conditions := []string{alias + ".type = ? AND " + alias + ".string_value = ?"}
+		args := []interface{}{key, models.StringDataType, value}
+		if number, err := strconv.ParseFloat(value, 64); err == nil {
+			conditions = append(conditions, alias+".type = ? AND "+alias+".numeric_value = ?")
+			args = append(args, models.NumberDataType, number)
+		}
+		if b, err := strconv.ParseBool(value); err == nil {
+			conditions = append(conditions, alias+".type = ? AND "+alias+".bool_value = ?")
+			args = append(args, models.BoolDataType, b)
+		}
+		statement := "JOIN " + dataTable + " as " + alias + " on " + alias + ".order_id = " + orderTable + ".id AND " +
+			alias + ".data_key = ? AND ((" + strings.Join(conditions, ") OR (") + "))"
+		query = query.Joins(statement, args...)
+	}
+	return query, nil
+}
+
 func addFilters(query *gorm.DB, table string, params url.Values, availableFilters []string) *gorm.DB {
 	for _, filter := range availableFilters {
 		if values, exists := params[filter]; exists {
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+var paymentExportHeader = []string{
+	"created_at", "transaction_id", "order_id", "order_number", "invoice_number",
+	"processor", "processor_id", "gross", "refunded", "net", "currency", "status",
+}
+
+type paymentExportOrder struct {
+	ID               string
+	Number           *string
+	PaymentProcessor string
+}
+
+type paymentExportRefunds struct {
+	ChargeID string
+	OrderID  string
+	Currency string
+	Amount   uint64
+}
+
+// PaymentExport streams the charges made in a period as CSV for reconciling
+// them with the payouts of the payment providers. The refunds made in the
+// period are summed up per charge, so the net amount is what the shop kept.
+// Refunds recorded before refunds were linked to their charge count against
+// the first charge of their order. It is only available to admins.
+func (a *API) PaymentExport(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	params := r.URL.Query()
+	if format := params.Get("format"); format != "" && format != "csv" {
+		return badRequestError("Unknown export format '%s', only csv is supported", format)
+	}
+
+	db := a.ReadDB(r)
+	instanceID := gcontext.GetInstanceID(ctx)
+	transactionTable := db.NewScope(models.Transaction{}).QuotedTableName()
+	query := db.Where(transactionTable+".instance_id = ? AND type = ?", instanceID, models.ChargeTransactionType)
+	query = siteScope(ctx, query, transactionTable)
+	query, err := parseTimeQueryParams(query, transactionTable, params)
+	if err != nil {
+		return badRequestError("Malformed request: %v", err)
+	}
+	query = query.Order(transactionTable + ".created_at asc, " + transactionTable + ".id asc")
+
+	refundQuery := db.Model(&models.Transaction{}).
+		Select("COALESCE(charge_id, '') AS charge_id, order_id, currency, sum(amount) AS amount").
+		Where(transactionTable+".instance_id = ? AND type = ? AND status = ?", instanceID, models.RefundTransactionType, models.PaidState)
+	refundQuery = siteScope(ctx, refundQuery, transactionTable)
+	refundQuery, err = parseTimeQueryParams(refundQuery, transactionTable, params)
+	if err != nil {
+		return badRequestError("Malformed request: %v", err)
+	}
+	refunds := []paymentExportRefunds{}
+	if rsp := refundQuery.Group("charge_id, order_id, currency").Scan(&refunds); rsp.Error != nil {
+		return internalServerError("Error while querying for refunds").WithInternalError(rsp.Error)
+	}
+	refundedCharges := map[string]uint64{}
+	refundedOrders := map[string]uint64{}
+	for _, refund := range refunds {
+		if refund.ChargeID != "" {
+			refundedCharges[refund.ChargeID] += refund.Amount
+		} else {
+			refundedOrders[refund.OrderID+"/"+refund.Currency] += refund.Amount
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="payments-%s.csv"`, time.Now().Format("2006-01-02")))
+	w.WriteHeader(http.StatusOK)
+
+	log := getLogEntry(r)
+	out := csv.NewWriter(w)
+	out.Write(paymentExportHeader)
+	rows := 0
+	for offset := 0; ; offset += exportBatchSize {
+		charges := []*models.Transaction{}
+		if rsp := query.Offset(offset).Limit(exportBatchSize).Find(&charges); rsp.Error != nil {
+			// the response has already started, so the export ends early
+			log.WithError(rsp.Error).Error("Failed to export payments")
+			break
+		}
+		if len(charges) == 0 {
+			break
+		}
+
+		orderIDs := make([]string, len(charges))
+		for i, charge := range charges {
+			orderIDs[i] = charge.OrderID
+		}
+		orders := []paymentExportOrder{}
+		if rsp := db.Model(&models.Order{}).Select("id, number, payment_processor").Where("id IN (?)", orderIDs).Scan(&orders); rsp.Error != nil {
+			log.WithError(rsp.Error).Error("Failed to export payments")
+			break
+		}
+		ordersByID := map[string]paymentExportOrder{}
+		for _, order := range orders {
+			ordersByID[order.ID] = order
+		}
+
+		for _, charge := range charges {
+			order := ordersByID[charge.OrderID]
+			processor := order.PaymentProcessor
+			if charge.GiftCardID != "" {
+				processor = "gift_card"
+			}
+			var number string
+			if order.Number != nil {
+				number = *order.Number
+			}
+			var gross, refund uint64
+			if charge.Status == models.PaidState {
+				gross = charge.Amount
+				refund = refundedCharges[charge.ID] + refundedOrders[charge.OrderID+"/"+charge.Currency]
+				// refunds without a charge are only counted against the first
+				// charge of an order
+				delete(refundedOrders, charge.OrderID+"/"+charge.Currency)
+			}
+			out.Write([]string{
+				charge.CreatedAt.UTC().Format(time.RFC3339),
+				charge.ID,
+				charge.OrderID,
+				number,
+				strconv.FormatInt(charge.InvoiceNumber, 10),
+				processor,
+				charge.ProcessorID,
+				strconv.FormatUint(gross, 10),
+				strconv.FormatUint(refund, 10),
+				strconv.FormatInt(int64(gross)-int64(refund), 10),
+				charge.Currency,
+				charge.Status,
+			})
+			rows++
+		}
+		out.Flush()
+		if err := out.Error(); err != nil {
+			log.WithError(err).Error("Failed to export payments")
+			return nil
+		}
+		if len(charges) < exportBatchSize {
+			break
+		}
+	}
+	out.Flush()
+
+	log.Infof("Exported %d payments", rows)
+	return nil
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/payments"
+)
+
+type paymentMethodParams struct {
+	PaymentMethodID string `json:"payment_method_id"`
+}
+
+// PaymentMethodList will return the payment methods a user saved with Stripe
+func (a *API) PaymentMethodList(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	userID := gcontext.GetUserID(ctx)
+	user := gcontext.GetUser(ctx)
+	if user == nil {
+		return notFoundError("Couldn't find a record for " + userID)
+	}
+
+	methods := []*payments.PaymentMethod{}
+	if user.StripeCustomerID == "" {
+		return sendJSON(w, http.StatusOK, methods)
+	}
+
+	store, httpErr := paymentMethodStore(ctx)
+	if httpErr != nil {
+		return httpErr
+	}
+	methods, err := store.ListPaymentMethods(user.StripeCustomerID)
+	if err != nil {
+		return internalServerError("Error listing payment methods").WithInternalError(err)
+	}
+
+	return sendJSON(w, http.StatusOK, methods)
+}
+
+// PaymentMethodCreate will save a Stripe payment method for a user, creating
+// a Stripe customer for the user on first use
+func (a *API) PaymentMethodCreate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	userID := gcontext.GetUserID(ctx)
+	user := gcontext.GetUser(ctx)
+	if user == nil {
+		return notFoundError("Couldn't find a record for " + userID)
+	}
+
+	params := new(paymentMethodParams)
+	if err := decodeJSON(r, params); err != nil {
+		return badRequestError("Failed to parse json body: %v", err)
+	}
+	if params.PaymentMethodID == "" {
+		return badRequestError("Saving a payment method requires a payment_method_id")
+	}
+
+	store, httpErr := paymentMethodStore(ctx)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	customerID, method, err := store.SavePaymentMethod(user.StripeCustomerID, user.Email, params.PaymentMethodID)
+	if customerID != "" && customerID != user.StripeCustomerID {
+		user.StripeCustomerID = customerID
+		if rsp := a.DB(r).Model(user).UpdateColumn("stripe_customer_id", customerID); rsp.Error != nil {
+			return internalServerError("Failed to save the customer ID").WithInternalError(rsp.Error)
+		}
+	}
+	if err != nil {
+		return badRequestError("Error saving payment method: %v", err)
+	}
+
+	getLogEntry(r).WithField("payment_method_id", method.ID).Info("saved payment method")
+	return sendJSON(w, http.StatusCreated, method)
+}
+
+func paymentMethodStore(ctx context.Context) (payments.PaymentMethodStore, *HTTPError) {
+	provider := gcontext.GetPaymentProviders(ctx)[payments.StripeProvider]
+	if provider == nil {
+		return nil, badRequestError("Payment provider '%s' not configured", payments.StripeProvider)
+	}
+	store, ok := provider.(payments.PaymentMethodStore)
+	if !ok {
+		return nil, badRequestError("Payment provider '%s' can't save payment methods", provider.Name())
+	}
+	return store, nil
+}
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	stripe "github.com/stripe/stripe-go"
+
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+)
+
+func stripePaymentMethodBackend(t *testing.T, calls *[]string) stripe.Backend {
+	return NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+		*calls = append(*calls, method+" "+path)
+		switch path {
+		case "/v1/customers":
+			v.(*stripe.Customer).ID = "cus_batman"
+		case "/v1/payment_methods/pm_card/attach":
+			assert.Equal(t, "cus_batman", *params.(*stripe.PaymentMethodAttachParams).Customer)
+			pm := v.(*stripe.PaymentMethod)
+			pm.ID = "pm_card"
+			pm.Card = &stripe.PaymentMethodCard{Brand: "visa", Last4: "4242", ExpMonth: 12, ExpYear: 2030}
+		case "/v1/payment_methods":
+			v.(*stripe.PaymentMethodList).Data = []*stripe.PaymentMethod{
+				{ID: "pm_card", Card: &stripe.PaymentMethodCard{Brand: "visa", Last4: "4242", ExpMonth: 12, ExpYear: 2030}},
+			}
+		case "/v1/payment_intents":
+			intentParams := params.(*stripe.PaymentIntentParams)
+			assert.Equal(t, "cus_batman", *intentParams.Customer)
+			assert.Equal(t, "pm_card", *intentParams.PaymentMethod)
+			intent := v.(*stripe.PaymentIntent)
+			intent.ID = stripePaymentIntentID
+			intent.Status = stripe.PaymentIntentStatusSucceeded
+		default:
+			t.Fatalf("unknown Stripe API call to %s", path)
+		}
+		return nil
+	})
+}
+
+func TestPaymentMethodCreate(t *testing.T) {
+	t.Run("NewCustomer", func(t *testing.T) {
+		test := NewRouteTest(t)
+		calls := []string{}
+		stripe.SetBackend(stripe.APIBackend, stripePaymentMethodBackend(t, &calls))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		url := "/users/" + test.Data.testUser.ID + "/payment_methods"
+		recorder := test.TestEndpoint(http.MethodPost, url, strings.NewReader(`{"payment_method_id": "pm_card"}`), test.Data.testUserToken)
+		method := &payments.PaymentMethod{}
+		extractPayload(t, http.StatusCreated, recorder, method)
+		assert.Equal(t, "pm_card", method.ID)
+		assert.Equal(t, "visa", method.Brand)
+		assert.Equal(t, "4242", method.Last4)
+		assert.Equal(t, []string{"POST /v1/customers", "POST /v1/payment_methods/pm_card/attach"}, calls)
+
+		user := &models.User{}
+		require.NoError(t, test.DB.First(user, "id = ?", test.Data.testUser.ID).Error)
+		assert.Equal(t, "cus_batman", user.StripeCustomerID)
+	})
+
+	t.Run("ExistingCustomer", func(t *testing.T) {
+		test := NewRouteTest(t)
+		require.NoError(t, test.DB.Model(test.Data.testUser).UpdateColumn("stripe_customer_id", "cus_batman").Error)
+		calls := []string{}
+		stripe.SetBackend(stripe.APIBackend, stripePaymentMethodBackend(t, &calls))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		url := "/users/" + test.Data.testUser.ID + "/payment_methods"
+		recorder := test.TestEndpoint(http.MethodPost, url, strings.NewReader(`{"payment_method_id": "pm_card"}`), test.Data.testUserToken)
+		extractPayload(t, http.StatusCreated, recorder, &payments.PaymentMethod{})
+		assert.Equal(t, []string{"POST /v1/payment_methods/pm_card/attach"}, calls)
+	})
+
+	t.Run("MissingID", func(t *testing.T) {
+		test := NewRouteTest(t)
+		url := "/users/" + test.Data.testUser.ID + "/payment_methods"
+		recorder := test.TestEndpoint(http.MethodPost, url, strings.NewReader(`{}`), test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+
+	t.Run("OtherUser", func(t *testing.T) {
+		test := NewRouteTest(t)
+		url := "/users/" + test.Data.testUser.ID + "/payment_methods"
+		token := testToken("joker", "joker@example.com")
+		recorder := test.TestEndpoint(http.MethodPost, url, strings.NewReader(`{"payment_method_id": "pm_card"}`), token)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
+
+func TestPaymentMethodList(t *testing.T) {
+	t.Run("NoCustomer", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/users/"+test.Data.testUser.ID+"/payment_methods", nil, test.Data.testUserToken)
+		methods := []payments.PaymentMethod{}
+		extractPayload(t, http.StatusOK, recorder, &methods)
+		assert.Empty(t, methods)
+	})
+
+	t.Run("AsAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		require.NoError(t, test.DB.Model(test.Data.testUser).UpdateColumn("stripe_customer_id", "cus_batman").Error)
+		calls := []string{}
+		stripe.SetBackend(stripe.APIBackend, stripePaymentMethodBackend(t, &calls))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodGet, "/users/"+test.Data.testUser.ID+"/payment_methods", nil, token)
+		methods := []payments.PaymentMethod{}
+		extractPayload(t, http.StatusOK, recorder, &methods)
+		require.Len(t, methods, 1)
+		assert.Equal(t, "pm_card", methods[0].ID)
+		assert.Equal(t, uint64(2030), methods[0].ExpYear)
+	})
+}
+
+func TestPaymentCreateWithSavedMethod(t *testing.T) {
+	t.Run("Simple", func(t *testing.T) {
+		test := NewRouteTest(t)
+		require.NoError(t, test.DB.Model(test.Data.testUser).UpdateColumn("stripe_customer_id", "cus_batman").Error)
+		test.Data.firstOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+		calls := []string{}
+		stripe.SetBackend(stripe.APIBackend, stripePaymentMethodBackend(t, &calls))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		body := `{"provider": "stripe", "amount": 24, "currency": "USD", "payment_method_id": "pm_card"}`
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", strings.NewReader(body), test.Data.testUserToken)
+		trans := &models.Transaction{}
+		extractPayload(t, http.StatusOK, recorder, trans)
+		assert.Equal(t, models.PaidState, trans.Status)
+		assert.Equal(t, stripePaymentIntentID, trans.ProcessorID)
+		assert.Equal(t, []string{"POST /v1/payment_intents"}, calls)
+	})
+
+	t.Run("NoSavedMethods", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.firstOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+		body := `{"provider": "stripe", "amount": 24, "currency": "USD", "payment_method_id": "pm_card"}`
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", strings.NewReader(body), test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "saved payment methods")
+	})
+
+	t.Run("Anonymous", func(t *testing.T) {
+		test := NewRouteTest(t)
+		body := `{"provider": "stripe", "amount": 24, "currency": "USD", "payment_method_id": "pm_card"}`
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", strings.NewReader(body), nil)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
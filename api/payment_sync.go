@@ -0,0 +1,161 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultSyncAge is how old pending transactions must be, in minutes, before
+// a batch sync looks them up with the payment provider.
+const DefaultSyncAge = 10
+
+type paymentSyncParams struct {
+	OlderThan int `json:"older_than"`
+}
+
+type paymentSyncResult struct {
+	Success bool   `json:"success"`
+	Status  string `json:"status,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// PaymentSync updates the status of a transaction to match the status at the
+// payment provider. It is only available to admins.
+func (a *API) PaymentSync(w http.ResponseWriter, r *http.Request) error {
+	db := a.DB(r)
+	payID := chi.URLParam(r, "payment_id")
+	trans, httpErr := getTransaction(db, payID)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	if httpErr := a.syncTransaction(r, db, trans); httpErr != nil {
+		return httpErr
+	}
+	return sendJSON(w, http.StatusOK, trans)
+}
+
+// PaymentSyncPending syncs all pending transactions older than the given
+// number of minutes. Each transaction is synced independently. It is only
+// available to admins.
+func (a *API) PaymentSyncPending(w http.ResponseWriter, r *http.Request) error {
+	db := a.DB(r)
+	instanceID := gcontext.GetInstanceID(r.Context())
+
+	params := &paymentSyncParams{OlderThan: DefaultSyncAge}
+	if r.ContentLength != 0 {
+		if err := decodeJSON(r, params); err != nil {
+			return badRequestError("Could not read sync parameters: %v", err)
+		}
+	}
+	if params.OlderThan < 0 {
+		return badRequestError("older_than must not be negative")
+	}
+
+	cutoff := time.Now().Add(-time.Duration(params.OlderThan) * time.Minute)
+	pending := []*models.Transaction{}
+	query := siteScope(r.Context(), db, "").Where("instance_id = ? AND status = ? AND created_at <= ?", instanceID, models.PendingState, cutoff)
+	if rsp := query.Find(&pending); rsp.Error != nil {
+		return internalServerError("Error while querying for transactions").WithInternalError(rsp.Error)
+	}
+
+	results := make(map[string]*paymentSyncResult, len(pending))
+	for _, trans := range pending {
+		if trans.GiftCardID != "" {
+			// gift card charges follow the payment of the rest of the order
+			continue
+		}
+		if httpErr := a.syncTransaction(r, db, trans); httpErr != nil {
+			results[trans.ID] = &paymentSyncResult{Error: httpErr.Message}
+			continue
+		}
+		results[trans.ID] = &paymentSyncResult{Success: true, Status: trans.Status}
+	}
+	return sendJSON(w, http.StatusOK, results)
+}
+
+// syncTransaction looks up the status of a transaction with the payment
+// provider and updates the transaction and its order if they differ.
+func (a *API) syncTransaction(r *http.Request, db *gorm.DB, trans *models.Transaction) *HTTPError {
+	ctx := r.Context()
+	claims := gcontext.GetClaims(ctx)
+
+	order := &models.Order{}
+	if rsp := orderQuery(db).First(order, "id = ?", trans.OrderID); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return notFoundError("Order not found")
+		}
+		return internalServerError("Error while querying for order").WithInternalError(rsp.Error)
+	}
+	attachTransaction(order, trans)
+
+	provider := gcontext.GetPaymentProviders(ctx)[order.PaymentProcessor]
+	if provider == nil {
+		return badRequestError("Payment provider '%s' not configured", order.PaymentProcessor)
+	}
+	checker, ok := provider.(payments.StatusChecker)
+	if !ok {
+		return badRequestError("Payment provider '%s' can't look up the status of payments", order.PaymentProcessor)
+	}
+	if trans.ProcessorID == "" {
+		return badRequestError("The transaction has no payment provider ID")
+	}
+
+	status, err := checker.PaymentStatus(trans.ProcessorID, trans.Type)
+	if err != nil {
+		return internalServerError("Error looking up the payment status: %v", err).WithInternalError(err)
+	}
+	if status == trans.Status {
+		return nil
+	}
+
+	getLogEntry(r).WithFields(logrus.Fields{
+		"transaction_id": trans.ID,
+		"local_status":   trans.Status,
+		"remote_status":  status,
+	}).Warn("Transaction status differs from the payment provider")
+
+	tx := db.Begin()
+	if trans.Type == models.ChargeTransactionType && status == models.PaidState {
+		if trans.InvoiceNumber == 0 {
+			invoiceNumber, err := models.NextInvoiceNumber(tx, order.InstanceID)
+			if err != nil {
+				tx.Rollback()
+				return internalServerError("We failed to generate a valid invoice ID, please try again later: %v", err)
+			}
+			trans.InvoiceNumber = invoiceNumber
+		}
+		paymentComplete(r, tx, trans, order)
+	} else {
+		trans.Status = status
+		tx.Save(trans)
+		if trans.Type == models.ChargeTransactionType && status == models.FailedState {
+			if err := models.RestoreGiftCardCharges(tx, order.ID, "The payment of the remaining amount failed"); err != nil {
+				tx.Rollback()
+				return internalServerError("Failed to restore the gift card balance").WithInternalError(err)
+			}
+		}
+		if trans.Type == models.ChargeTransactionType && order.PaymentState != status &&
+			models.PaymentStateMachine.Allowed(order.PaymentState, status, models.ActorSystem) {
+			order.PaymentState = status
+			tx.Save(order)
+		}
+	}
+
+	userID := ""
+	if claims != nil {
+		userID = claims.Subject
+	}
+	models.LogEvent(tx, r.RemoteAddr, userID, order.ID, models.EventUpdated, []string{"transaction_status"})
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Saving the payment status failed").WithInternalError(rsp.Error)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	stripe "github.com/stripe/stripe-go"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func stripeStatusBackend(t *testing.T, status stripe.PaymentIntentStatus, calls *int) stripe.Backend {
+	return NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+		if path != "/v1/payment_intents/"+stripePaymentIntentID {
+			t.Fatalf("unknown Stripe API call to %s", path)
+		}
+		*calls++
+		intent := v.(*stripe.PaymentIntent)
+		intent.ID = stripePaymentIntentID
+		intent.Status = status
+		return nil
+	})
+}
+
+func setupPendingTransaction(t *testing.T, test *RouteTest) {
+	test.Data.firstOrder.PaymentState = models.PendingState
+	require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+	require.NoError(t, test.DB.Model(test.Data.firstTransaction).Updates(map[string]interface{}{
+		"status":       models.PendingState,
+		"processor_id": stripePaymentIntentID,
+		"created_at":   time.Now().Add(-time.Hour),
+	}).Error)
+}
+
+func TestPaymentSync(t *testing.T) {
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	t.Run("Paid", func(t *testing.T) {
+		test := NewRouteTest(t)
+		setupPendingTransaction(t, test)
+		calls := 0
+		stripe.SetBackend(stripe.APIBackend, stripeStatusBackend(t, stripe.PaymentIntentStatusSucceeded, &calls))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		recorder := test.TestEndpoint(http.MethodPost, "/payments/"+test.Data.firstTransaction.ID+"/sync", nil, token)
+		trans := &models.Transaction{}
+		extractPayload(t, http.StatusOK, recorder, trans)
+		assert.Equal(t, models.PaidState, trans.Status)
+		assert.NotZero(t, trans.InvoiceNumber)
+		assert.Equal(t, 1, calls)
+
+		require.NoError(t, test.DB.First(trans, "id = ?", test.Data.firstTransaction.ID).Error)
+		assert.Equal(t, models.PaidState, trans.Status)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", "first-order").Error)
+		assert.Equal(t, models.PaidState, order.PaymentState)
+	})
+
+	t.Run("Failed", func(t *testing.T) {
+		test := NewRouteTest(t)
+		setupPendingTransaction(t, test)
+		calls := 0
+		stripe.SetBackend(stripe.APIBackend, stripeStatusBackend(t, stripe.PaymentIntentStatusCanceled, &calls))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		recorder := test.TestEndpoint(http.MethodPost, "/payments/"+test.Data.firstTransaction.ID+"/sync", nil, token)
+		trans := &models.Transaction{}
+		extractPayload(t, http.StatusOK, recorder, trans)
+		assert.Equal(t, models.FailedState, trans.Status)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", "first-order").Error)
+		assert.Equal(t, models.FailedState, order.PaymentState)
+	})
+
+	t.Run("NotAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodPost, "/payments/"+test.Data.firstTransaction.ID+"/sync", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
+
+func TestPaymentSyncPending(t *testing.T) {
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	t.Run("OlderThan", func(t *testing.T) {
+		test := NewRouteTest(t)
+		setupPendingTransaction(t, test)
+		require.NoError(t, test.DB.Model(test.Data.secondTransaction).UpdateColumn("status", models.PendingState).Error)
+		calls := 0
+		stripe.SetBackend(stripe.APIBackend, stripeStatusBackend(t, stripe.PaymentIntentStatusSucceeded, &calls))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		recorder := test.TestEndpoint(http.MethodPost, "/payments/sync", strings.NewReader(`{"older_than": 30}`), token)
+		results := map[string]paymentSyncResult{}
+		extractPayload(t, http.StatusOK, recorder, &results)
+		require.Len(t, results, 1)
+		assert.True(t, results[test.Data.firstTransaction.ID].Success)
+		assert.Equal(t, models.PaidState, results[test.Data.firstTransaction.ID].Status)
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("ProviderNotConfigured", func(t *testing.T) {
+		test := NewRouteTest(t)
+		require.NoError(t, test.DB.Model(test.Data.secondTransaction).UpdateColumn("status", models.PendingState).Error)
+
+		recorder := test.TestEndpoint(http.MethodPost, "/payments/sync", strings.NewReader(`{"older_than": 0}`), token)
+		results := map[string]paymentSyncResult{}
+		extractPayload(t, http.StatusOK, recorder, &results)
+		require.Len(t, results, 1)
+		assert.False(t, results[test.Data.secondTransaction.ID].Success)
+		assert.Contains(t, results[test.Data.secondTransaction.ID].Error, "not configured")
+	})
+}
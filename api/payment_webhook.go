@@ -0,0 +1,194 @@
+package api
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/jinzhu/gorm"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+	"github.com/pborman/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// MaxWebhookPayloadSize limits the size of webhooks sent by payment providers
+const MaxWebhookPayloadSize = 1 << 16
+
+// StripeWebhook receives the webhooks Stripe sends when payments change.
+func (a *API) StripeWebhook(w http.ResponseWriter, r *http.Request) error {
+	config := gcontext.GetConfig(r.Context())
+	return a.paymentWebhook(w, r, payments.StripeProvider, config.Payment.Stripe.WebhookSecret)
+}
+
+// PayPalWebhook receives the webhooks PayPal sends when payments change. They
+// are verified with the ID of the webhook registered with PayPal.
+func (a *API) PayPalWebhook(w http.ResponseWriter, r *http.Request) error {
+	config := gcontext.GetConfig(r.Context())
+	return a.paymentWebhook(w, r, payments.PayPalProvider, config.Payment.PayPal.WebhookID)
+}
+
+// paymentWebhook verifies a webhook from a payment provider and updates the
+// matching transaction and order. Events that don't concern any of our
+// transactions, and events that were processed before, are acknowledged and
+// ignored.
+func (a *API) paymentWebhook(w http.ResponseWriter, r *http.Request, providerName, secret string) error {
+	ctx := r.Context()
+	log := getLogEntry(r).WithField("provider", providerName)
+
+	if secret == "" {
+		return notFoundError("Webhooks are not configured for %s", providerName)
+	}
+	provider := gcontext.GetPaymentProviders(ctx)[providerName]
+	if provider == nil {
+		return notFoundError("Payment provider '%s' not configured", providerName)
+	}
+	receiver, ok := provider.(payments.WebhookReceiver)
+	if !ok {
+		return notFoundError("Payment provider '%s' doesn't send webhooks", providerName)
+	}
+
+	payload, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxWebhookPayloadSize))
+	if err != nil {
+		return badRequestError("Failed to read the webhook payload: %v", err)
+	}
+	event, err := receiver.ParseWebhook(payload, r.Header, secret)
+	if err != nil {
+		return badRequestError("Invalid webhook: %v", err)
+	}
+	if event == nil {
+		return sendJSON(w, http.StatusOK, map[string]bool{"received": true})
+	}
+
+	db := a.DB(r)
+	instanceID := gcontext.GetInstanceID(ctx)
+	if event.ID != "" {
+		log = log.WithField("event_id", event.ID)
+		processed, err := models.EventProcessed(db, instanceID, providerName, event.ID)
+		if err != nil {
+			return internalServerError("Error while querying for processed events").WithInternalError(err)
+		}
+		if processed {
+			log.Info("Ignoring webhook for an event that was already processed")
+			return sendJSON(w, http.StatusOK, map[string]bool{"received": true})
+		}
+	}
+
+	// partial captures share the processor ID of their authorization, events
+	// are about the authorization
+	trans := &models.Transaction{}
+	rsp := db.Where("instance_id = ? AND processor_id IN (?) AND type = ?", instanceID, event.ChargeIDs, models.ChargeTransactionType).
+		Where("authorization_id = ? OR authorization_id IS NULL", "").
+		First(trans)
+	if rsp.RecordNotFound() {
+		log.WithField("charge_ids", event.ChargeIDs).Info("Ignoring webhook for an unknown charge")
+		return sendJSON(w, http.StatusOK, map[string]bool{"received": true})
+	}
+	if rsp.Error != nil {
+		return internalServerError("Error while querying for transactions").WithInternalError(rsp.Error)
+	}
+
+	order := &models.Order{}
+	if rsp := orderQuery(db).First(order, "id = ?", trans.OrderID); rsp.Error != nil {
+		return internalServerError("Error while querying for order").WithInternalError(rsp.Error)
+	}
+	attachTransaction(order, trans)
+
+	log = log.WithFields(logrus.Fields{
+		"event":          event.Type,
+		"transaction_id": trans.ID,
+		"order_id":       order.ID,
+	})
+	tx := db.Begin()
+	if event.ID != "" {
+		processed := &models.ProcessedEvent{InstanceID: instanceID, Provider: providerName, EventID: event.ID}
+		if rsp := tx.Create(processed); rsp.Error != nil {
+			tx.Rollback()
+			// the unique index rejects the event if another delivery of it
+			// was processed in the meantime
+			if processed, err := models.EventProcessed(db, instanceID, providerName, event.ID); err == nil && processed {
+				log.Info("Ignoring webhook for an event that was already processed")
+				return sendJSON(w, http.StatusOK, map[string]bool{"received": true})
+			}
+			return internalServerError("Failed to record the payment event").WithInternalError(rsp.Error)
+		}
+	}
+	var httpErr *HTTPError
+	switch event.Type {
+	case payments.ChargeSucceededEvent:
+		httpErr = chargeSucceeded(r, tx, trans, order)
+	case payments.ChargeRefundedEvent:
+		httpErr = chargeRefunded(r, tx, trans, order, event.Refunds)
+	case payments.DisputeCreatedEvent:
+		httpErr = disputeCreated(r, tx, trans, order, event.Dispute)
+	}
+	if httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Saving the payment event failed").WithInternalError(rsp.Error)
+	}
+
+	log.Info("Processed payment webhook")
+	return sendJSON(w, http.StatusOK, map[string]bool{"received": true})
+}
+
+func chargeSucceeded(r *http.Request, tx *gorm.DB, trans *models.Transaction, order *models.Order) *HTTPError {
+	if trans.Status == models.PaidState {
+		return nil
+	}
+	if trans.Status == models.AuthorizedState {
+		// authorizations are recorded as paid when they are captured
+		return nil
+	}
+	if trans.InvoiceNumber == 0 {
+		invoiceNumber, err := models.NextInvoiceNumber(tx, order.InstanceID)
+		if err != nil {
+			return internalServerError("We failed to generate a valid invoice ID: %v", err)
+		}
+		trans.InvoiceNumber = invoiceNumber
+	}
+	paymentComplete(r, tx, trans, order)
+	return nil
+}
+
+// chargeRefunded updates the refunds of a charge. Refunds made outside of
+// gocommerce, e.g. in the Stripe dashboard, are recorded as new transactions.
+func chargeRefunded(r *http.Request, tx *gorm.DB, trans *models.Transaction, order *models.Order, refunds []*payments.RefundEvent) *HTTPError {
+	for _, ref := range refunds {
+		m := &models.Transaction{}
+		rsp := tx.Where("processor_id = ? AND type = ?", ref.ID, models.RefundTransactionType).First(m)
+		if rsp.Error != nil && !rsp.RecordNotFound() {
+			return internalServerError("Error while querying for refunds").WithInternalError(rsp.Error)
+		}
+		if rsp.RecordNotFound() {
+			m = &models.Transaction{
+				InstanceID:  order.InstanceID,
+				SiteID:      order.SiteID,
+				ID:          uuid.NewRandom().String(),
+				ProcessorID: ref.ID,
+				Amount:      ref.Amount,
+				Currency:    ref.Currency,
+				UserID:      trans.UserID,
+				OrderID:     trans.OrderID,
+				ChargeID:    trans.ID,
+				Type:        models.RefundTransactionType,
+				Status:      models.PendingState,
+			}
+			if rsp := tx.Create(m); rsp.Error != nil {
+				return internalServerError("Failed to save refund").WithInternalError(rsp.Error)
+			}
+		}
+		if m.Status == ref.Status {
+			continue
+		}
+		m.Status = ref.Status
+		tx.Save(m)
+		if ref.Status == models.PaidState {
+			logTimeline(r, tx, order, models.RefundedTimelineEvent, "Refunded %d %s", m.Amount, m.Currency)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,330 @@
+package api
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	stripe "github.com/stripe/stripe-go"
+	"github.com/stripe/stripe-go/webhook"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+const testStripeWebhookSecret = "whsec_test"
+
+func sendStripeWebhook(test *RouteTest, eventType, object string) *httptest.ResponseRecorder {
+	return sendStripeWebhookEvent(test, "evt_1", eventType, object)
+}
+
+func sendStripeWebhookEvent(test *RouteTest, eventID, eventType, object string) *httptest.ResponseRecorder {
+	payload := []byte(fmt.Sprintf(`{"id": %q, "object": "event", "type": %q, "data": {"object": %s}}`, eventID, eventType, object))
+	now := time.Now()
+	signature := fmt.Sprintf("t=%d,v1=%s", now.Unix(), hex.EncodeToString(webhook.ComputeSignature(now, payload, testStripeWebhookSecret)))
+	return test.TestEndpointWithHeaders(http.MethodPost, "/stripe/webhook", bytes.NewReader(payload), nil, map[string]string{"Stripe-Signature": signature})
+}
+
+func setupStripeWebhook(t *testing.T) *RouteTest {
+	test := NewRouteTest(t)
+	test.Config.Payment.Stripe.WebhookSecret = testStripeWebhookSecret
+	require.NoError(t, test.DB.Model(test.Data.firstTransaction).UpdateColumn("processor_id", stripePaymentIntentID).Error)
+	return test
+}
+
+func TestStripeWebhook(t *testing.T) {
+	chargeObject := fmt.Sprintf(`{"id": "ch_1", "object": "charge", "captured": true, "payment_intent": %q}`, stripePaymentIntentID)
+
+	t.Run("ChargeSucceeded", func(t *testing.T) {
+		test := setupStripeWebhook(t)
+		setupPendingTransaction(t, test)
+
+		recorder := sendStripeWebhook(test, "charge.succeeded", chargeObject)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		trans := &models.Transaction{}
+		require.NoError(t, test.DB.First(trans, "id = ?", test.Data.firstTransaction.ID).Error)
+		assert.Equal(t, models.PaidState, trans.Status)
+		assert.NotZero(t, trans.InvoiceNumber)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", "first-order").Error)
+		assert.Equal(t, models.PaidState, order.PaymentState)
+	})
+
+	t.Run("ChargeRefunded", func(t *testing.T) {
+		test := setupStripeWebhook(t)
+		object := fmt.Sprintf(`{"id": "ch_1", "object": "charge", "payment_intent": %q, "refunded": true, "refunds": {"object": "list", "data": [
+			{"id": "re_1", "object": "refund", "amount": 10, "currency": "usd", "status": "succeeded"}
+		]}}`, stripePaymentIntentID)
+
+		for i := 0; i < 2; i++ {
+			recorder := sendStripeWebhook(test, "charge.refunded", object)
+			assert.Equal(t, http.StatusOK, recorder.Code)
+		}
+
+		refunds := []models.Transaction{}
+		require.NoError(t, test.DB.Where("type = ?", models.RefundTransactionType).Find(&refunds).Error)
+		require.Len(t, refunds, 1)
+		assert.Equal(t, "re_1", refunds[0].ProcessorID)
+		assert.Equal(t, models.PaidState, refunds[0].Status)
+		assert.EqualValues(t, 10, refunds[0].Amount)
+		assert.Equal(t, "USD", refunds[0].Currency)
+		assert.Equal(t, "first-order", refunds[0].OrderID)
+	})
+
+	t.Run("DisputeCreated", func(t *testing.T) {
+		test := setupStripeWebhook(t)
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+			require.Equal(t, "/v1/charges/ch_1", path)
+			charge := v.(*stripe.Charge)
+			charge.ID = "ch_1"
+			charge.PaymentIntent = stripePaymentIntentID
+			return nil
+		}))
+		defer stripe.SetBackend(stripe.APIBackend, nil)
+
+		object := `{"id": "dp_1", "object": "dispute", "charge": "ch_1", "amount": 24, "currency": "usd", "reason": "fraudulent", "status": "needs_response",
+			"evidence_details": {"due_by": 1893456000}}`
+		for i := 0; i < 2; i++ {
+			recorder := sendStripeWebhook(test, "charge.dispute.created", object)
+			assert.Equal(t, http.StatusOK, recorder.Code)
+		}
+
+		disputes := []models.Dispute{}
+		require.NoError(t, test.DB.Find(&disputes).Error)
+		require.Len(t, disputes, 1)
+		assert.Equal(t, "dp_1", disputes[0].ProcessorID)
+		assert.Equal(t, test.Data.firstTransaction.ID, disputes[0].TransactionID)
+		assert.Equal(t, "first-order", disputes[0].OrderID)
+		assert.EqualValues(t, 24, disputes[0].Amount)
+		assert.Equal(t, "needs_response", disputes[0].Status)
+		require.NotNil(t, disputes[0].DueBy)
+		assert.EqualValues(t, 1893456000, disputes[0].DueBy.Unix())
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", "first-order").Error)
+		assert.Equal(t, models.DisputedState, order.PaymentState)
+
+		notes := []models.OrderNote{}
+		require.NoError(t, test.DB.Where("order_id = ?", "first-order").Find(&notes).Error)
+		require.Len(t, notes, 1)
+		assert.Equal(t, models.DisputedTimelineEvent, notes[0].Event)
+		assert.Equal(t, "Payment of 24 USD disputed: fraudulent", notes[0].Text)
+	})
+
+	t.Run("Replayed", func(t *testing.T) {
+		test := setupStripeWebhook(t)
+		setupPendingTransaction(t, test)
+		recorder := sendStripeWebhookEvent(test, "evt_1", "charge.succeeded", chargeObject)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		// a replay of the event must not be applied to the reset payment
+		setupPendingTransaction(t, test)
+		recorder = sendStripeWebhookEvent(test, "evt_1", "charge.succeeded", chargeObject)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		trans := &models.Transaction{}
+		require.NoError(t, test.DB.First(trans, "id = ?", test.Data.firstTransaction.ID).Error)
+		assert.Equal(t, models.PendingState, trans.Status)
+
+		events := []models.ProcessedEvent{}
+		require.NoError(t, test.DB.Find(&events).Error)
+		require.Len(t, events, 1)
+		assert.Equal(t, "stripe", events[0].Provider)
+		assert.Equal(t, "evt_1", events[0].EventID)
+
+		recorder = sendStripeWebhookEvent(test, "evt_2", "charge.succeeded", chargeObject)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		require.NoError(t, test.DB.First(trans, "id = ?", test.Data.firstTransaction.ID).Error)
+		assert.Equal(t, models.PaidState, trans.Status)
+	})
+
+	t.Run("InvalidSignature", func(t *testing.T) {
+		test := setupStripeWebhook(t)
+		payload := `{"id": "evt_1", "object": "event", "type": "charge.succeeded", "data": {"object": {}}}`
+		headers := map[string]string{"Stripe-Signature": fmt.Sprintf("t=%d,v1=deadbeef", time.Now().Unix())}
+		recorder := test.TestEndpointWithHeaders(http.MethodPost, "/stripe/webhook", bytes.NewReader([]byte(payload)), nil, headers)
+		validateError(t, http.StatusBadRequest, recorder, "Invalid webhook")
+	})
+
+	t.Run("UnknownEvent", func(t *testing.T) {
+		test := setupStripeWebhook(t)
+		recorder := sendStripeWebhook(test, "customer.created", `{"id": "cus_1", "object": "customer"}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+	})
+
+	t.Run("ChargeAuthorized", func(t *testing.T) {
+		test := setupStripeWebhook(t)
+		require.NoError(t, test.DB.Model(test.Data.firstTransaction).UpdateColumn("status", models.AuthorizedState).Error)
+		require.NoError(t, test.DB.Model(test.Data.firstOrder).UpdateColumn("payment_state", models.AuthorizedState).Error)
+
+		uncaptured := fmt.Sprintf(`{"id": "ch_1", "object": "charge", "captured": false, "payment_intent": %q}`, stripePaymentIntentID)
+		for i, object := range []string{uncaptured, chargeObject} {
+			recorder := sendStripeWebhookEvent(test, fmt.Sprintf("evt_%d", i), "charge.succeeded", object)
+			assert.Equal(t, http.StatusOK, recorder.Code)
+		}
+
+		trans := &models.Transaction{}
+		require.NoError(t, test.DB.First(trans, "id = ?", test.Data.firstTransaction.ID).Error)
+		assert.Equal(t, models.AuthorizedState, trans.Status)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", "first-order").Error)
+		assert.Equal(t, models.AuthorizedState, order.PaymentState)
+	})
+
+	t.Run("PartialCapture", func(t *testing.T) {
+		test := setupStripeWebhook(t)
+		setupPendingTransaction(t, test)
+		// the capture sorts before the authorization, which the event is about
+		capture := &models.Transaction{
+			ID:              "0",
+			InstanceID:      test.Data.firstTransaction.InstanceID,
+			OrderID:         test.Data.firstOrder.ID,
+			ProcessorID:     stripePaymentIntentID,
+			AuthorizationID: test.Data.firstTransaction.ID,
+			Type:            models.ChargeTransactionType,
+			Status:          models.PaidState,
+			Amount:          10,
+			Currency:        "USD",
+		}
+		require.NoError(t, test.DB.Create(capture).Error)
+
+		recorder := sendStripeWebhook(test, "charge.succeeded", chargeObject)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		trans := &models.Transaction{}
+		require.NoError(t, test.DB.First(trans, "id = ?", test.Data.firstTransaction.ID).Error)
+		assert.Equal(t, models.PaidState, trans.Status)
+	})
+
+	t.Run("UnknownCharge", func(t *testing.T) {
+		test := setupStripeWebhook(t)
+		recorder := sendStripeWebhook(test, "charge.succeeded", `{"id": "ch_2", "object": "charge", "payment_intent": "pi_unknown"}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+	})
+
+	t.Run("OtherInstance", func(t *testing.T) {
+		test := setupStripeWebhook(t)
+		setupPendingTransaction(t, test)
+		require.NoError(t, test.DB.Model(test.Data.firstTransaction).UpdateColumn("instance_id", "other-instance").Error)
+
+		recorder := sendStripeWebhook(test, "charge.succeeded", chargeObject)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		trans := &models.Transaction{}
+		require.NoError(t, test.DB.First(trans, "id = ?", test.Data.firstTransaction.ID).Error)
+		assert.Equal(t, models.PendingState, trans.Status)
+	})
+
+	t.Run("NotConfigured", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := sendStripeWebhook(test, "charge.succeeded", chargeObject)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+}
+
+const testPayPalWebhookID = "WH-1"
+const testPayPalPaymentID = "PAY-1"
+
+func setupPayPalWebhook(t *testing.T, verificationStatus string) *RouteTest {
+	test := NewRouteTest(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/oauth2/token":
+			fmt.Fprint(w, `{"access_token":"EEwJ6tF9x5WCIZDYzyZGaz6Khbw7raYRIBV_WxVvgmsG","expires_in":100000}`)
+		case "/v1/notifications/verify-webhook-signature":
+			params := map[string]interface{}{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&params))
+			assert.Equal(t, testPayPalWebhookID, params["webhook_id"])
+			assert.Equal(t, "sig", params["transmission_sig"])
+			fmt.Fprintf(w, `{"verification_status":%q}`, verificationStatus)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			t.Errorf("unknown PayPal API call to %s", r.URL.Path)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	test.Config.Payment.PayPal.Enabled = true
+	test.Config.Payment.PayPal.ClientID = "clientid"
+	test.Config.Payment.PayPal.Secret = "secret"
+	test.Config.Payment.PayPal.Env = server.URL
+	test.Config.Payment.PayPal.WebhookID = testPayPalWebhookID
+	require.NoError(t, test.DB.Model(test.Data.firstTransaction).UpdateColumn("processor_id", testPayPalPaymentID).Error)
+	return test
+}
+
+func sendPayPalWebhook(test *RouteTest, eventType, resource string) *httptest.ResponseRecorder {
+	payload := []byte(fmt.Sprintf(`{"id": "WH-EVT-1", "event_type": %q, "resource": %s}`, eventType, resource))
+	headers := map[string]string{
+		"PAYPAL-AUTH-ALGO":         "SHA256withRSA",
+		"PAYPAL-CERT-URL":          "https://api.paypal.com/v1/notifications/certs/CERT-1",
+		"PAYPAL-TRANSMISSION-ID":   "T-1",
+		"PAYPAL-TRANSMISSION-SIG":  "sig",
+		"PAYPAL-TRANSMISSION-TIME": time.Now().Format(time.RFC3339),
+	}
+	return test.TestEndpointWithHeaders(http.MethodPost, "/paypal/webhook", bytes.NewReader(payload), nil, headers)
+}
+
+func TestPayPalWebhook(t *testing.T) {
+	t.Run("SaleCompleted", func(t *testing.T) {
+		test := setupPayPalWebhook(t, "SUCCESS")
+		setupPendingTransaction(t, test)
+		require.NoError(t, test.DB.Model(test.Data.firstTransaction).UpdateColumn("processor_id", testPayPalPaymentID).Error)
+
+		recorder := sendPayPalWebhook(test, "PAYMENT.SALE.COMPLETED", `{"id": "SALE-1", "parent_payment": "`+testPayPalPaymentID+`", "state": "completed"}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		trans := &models.Transaction{}
+		require.NoError(t, test.DB.First(trans, "id = ?", test.Data.firstTransaction.ID).Error)
+		assert.Equal(t, models.PaidState, trans.Status)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", "first-order").Error)
+		assert.Equal(t, models.PaidState, order.PaymentState)
+	})
+
+	t.Run("SaleRefunded", func(t *testing.T) {
+		test := setupPayPalWebhook(t, "SUCCESS")
+		resource := `{"id": "REF-1", "sale_id": "SALE-1", "parent_payment": "` + testPayPalPaymentID + `", "state": "completed",
+			"amount": {"total": "-0.10", "currency": "USD"}}`
+		for i := 0; i < 2; i++ {
+			recorder := sendPayPalWebhook(test, "PAYMENT.SALE.REFUNDED", resource)
+			assert.Equal(t, http.StatusOK, recorder.Code)
+		}
+
+		refunds := []models.Transaction{}
+		require.NoError(t, test.DB.Where("type = ?", models.RefundTransactionType).Find(&refunds).Error)
+		require.Len(t, refunds, 1)
+		assert.Equal(t, "REF-1", refunds[0].ProcessorID)
+		assert.Equal(t, models.PaidState, refunds[0].Status)
+		assert.EqualValues(t, 10, refunds[0].Amount)
+		assert.Equal(t, "first-order", refunds[0].OrderID)
+	})
+
+	t.Run("InvalidSignature", func(t *testing.T) {
+		test := setupPayPalWebhook(t, "FAILURE")
+		recorder := sendPayPalWebhook(test, "PAYMENT.SALE.COMPLETED", `{"id": "SALE-1", "parent_payment": "`+testPayPalPaymentID+`"}`)
+		validateError(t, http.StatusBadRequest, recorder, "Invalid webhook")
+	})
+
+	t.Run("UnknownEvent", func(t *testing.T) {
+		test := setupPayPalWebhook(t, "SUCCESS")
+		recorder := sendPayPalWebhook(test, "BILLING.PLAN.CREATED", `{"id": "P-1"}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+	})
+
+	t.Run("NotConfigured", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := sendPayPalWebhook(test, "PAYMENT.SALE.COMPLETED", `{"id": "SALE-1"}`)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+}
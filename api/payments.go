@@ -1,13 +1,14 @@
 package api
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"math"
 	"net/http"
 	"strconv"
-
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi"
 
@@ -20,6 +21,7 @@ import (
 	"github.com/netlify/gocommerce/claims"
 	"github.com/netlify/gocommerce/conf"
 	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/fraud"
 	"github.com/netlify/gocommerce/models"
 	"github.com/netlify/gocommerce/payments"
 	"github.com/netlify/gocommerce/payments/paypal"
@@ -32,10 +34,70 @@ type PaymentParams struct {
 	Currency     string `json:"currency"`
 	ProviderType string `json:"provider"`
 	Description  string `json:"description"`
+
+	// PaymentMethodID charges a payment method the user saved before
+	// instead of the payment details sent to the provider.
+	PaymentMethodID string `json:"payment_method_id"`
+
+	// GiftCardCode pays as much as possible with a gift card. The provider
+	// is charged the rest and can be left out if the gift card covers it all.
+	GiftCardCode string `json:"gift_card_code"`
+	// StoreCredit refunds to a gift card instead of the payment provider
+	StoreCredit bool `json:"store_credit"`
+	// Capture can be set to false to only authorize the payment and
+	// capture it later, e.g. when a pre-order ships.
+	Capture *bool `json:"capture"`
+
+	// Component limits a refund to a part of the order, either
+	// "shipping" or "line_item" together with LineItemID.
+	Component  string `json:"component"`
+	LineItemID int64  `json:"line_item_id"`
+}
+
+// expandedTransaction is a transaction listed together with a summary of its order
+type expandedTransaction struct {
+	models.Transaction
+	Order *paymentOrderSummary `json:"order"`
+}
+
+type paymentOrderSummary struct {
+	ID               string              `json:"id"`
+	Total            uint64              `json:"total"`
+	Currency         string              `json:"currency"`
+	PaymentState     string              `json:"payment_state"`
+	FulfillmentState string              `json:"fulfillment_state"`
+	CreatedAt        time.Time           `json:"created_at"`
+	LineItems        []*paymentOrderItem `json:"line_items"`
+}
+
+type paymentOrderItem struct {
+	Sku      string `json:"sku"`
+	Title    string `json:"title"`
+	Quantity uint64 `json:"quantity"`
+}
+
+func summarizeOrder(order *models.Order) *paymentOrderSummary {
+	if order == nil {
+		return nil
+	}
+	summary := &paymentOrderSummary{
+		ID:               order.ID,
+		Total:            order.Total,
+		Currency:         order.Currency,
+		PaymentState:     order.PaymentState,
+		FulfillmentState: order.FulfillmentState,
+		CreatedAt:        order.CreatedAt,
+		LineItems:        make([]*paymentOrderItem, len(order.LineItems)),
+	}
+	for i, item := range order.LineItems {
+		summary.LineItems[i] = &paymentOrderItem{Sku: item.Sku, Title: item.Title, Quantity: item.Quantity}
+	}
+	return summary
 }
 
 // PaymentListForUser is the endpoint for listing transactions for a user.
 // The ID in the claim and the ID in the path must match (or have admin override)
+// With ?expand=order a summary of the order is included with each transaction.
 func (a *API) PaymentListForUser(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	log := getLogEntry(r)
@@ -45,11 +107,29 @@ func (a *API) PaymentListForUser(w http.ResponseWriter, r *http.Request) error {
 		return notFoundError("Couldn't find a record for " + userID)
 	}
 
-	trans, httpErr := queryForTransactions(a.DB(r), log, "user_id = ?", userID)
+	db := a.ReadDB(r)
+	expand := r.URL.Query().Get("expand")
+	switch expand {
+	case "":
+	case "order":
+		db = db.Preload("Order").Preload("Order.LineItems")
+	default:
+		return badRequestError("Can't expand '%s', only 'order' is supported", expand)
+	}
+
+	trans, httpErr := queryForTransactions(db, log, "user_id = ?", userID)
 	if httpErr != nil {
 		return httpErr
 	}
-	return sendJSON(w, http.StatusOK, trans)
+	if expand == "" {
+		return sendJSON(w, http.StatusOK, trans)
+	}
+
+	expanded := make([]expandedTransaction, len(trans))
+	for i, t := range trans {
+		expanded[i] = expandedTransaction{Transaction: t, Order: summarizeOrder(t.Order)}
+	}
+	return sendJSON(w, http.StatusOK, expanded)
 }
 
 // PaymentListForOrder is the endpoint for listing transactions for an order. You must be the owner
@@ -60,18 +140,18 @@ func (a *API) PaymentListForOrder(w http.ResponseWriter, r *http.Request) error
 	orderID := gcontext.GetOrderID(ctx)
 	claims := gcontext.GetClaims(ctx)
 
-	order, httpErr := queryForOrder(a.DB(r), orderID, log)
+	order, httpErr := queryForOrder(siteScope(ctx, a.ReadDB(r), ""), orderID, log)
 	if httpErr != nil {
 		return httpErr
 	}
 
-	if !hasOrderAccess(ctx, order) {
+	canRead := canReadPayments(ctx)
+	if !hasOrderAccess(ctx, order) && !canRead {
 		return unauthorizedError("You don't have access to this order").WithInternalMessage("Attempt to access order as %s, but order.UserID is %s", claims.Subject, order.UserID)
 	}
 
 	// additional check for anonymous orders: only allow admins
-	isAdmin := gcontext.IsAdmin(ctx)
-	if order.UserID == "" && !isAdmin {
+	if order.UserID == "" && !canRead {
 		// anon order ~ only accessible by an admin
 		return unauthorizedError("Anonymous orders must be accessed by admins")
 	}
@@ -91,27 +171,252 @@ func paymentComplete(r *http.Request, tx *gorm.DB, tr *models.Transaction, order
 	} else {
 		tx.Save(tr)
 	}
+	if err := models.CompleteGiftCardCharges(tx, order.ID); err != nil {
+		log.WithError(err).Error("Failed to complete the gift card charges of the order")
+	}
+	if order.PaymentState == models.AbandonedState {
+		// an admin has to reopen the order before it can be fulfilled
+		log.WithField("transaction_id", tr.ID).Warn("Received payment for an abandoned order")
+		logTimeline(r, tx, order, models.PaidTimelineEvent, "Payment of %d %s received for an abandoned order", tr.Amount, tr.Currency)
+		return
+	}
+	if order.PaymentState == models.CancelledState {
+		// the payment has to be refunded since the order won't be fulfilled
+		log.WithField("transaction_id", tr.ID).Warn("Received payment for a cancelled order")
+		logTimeline(r, tx, order, models.PaidTimelineEvent, "Payment of %d %s received for a cancelled order", tr.Amount, tr.Currency)
+		return
+	}
+	if order.PaymentState != models.PartiallyCapturedState {
+		// the items were taken from the stock with the first partial capture
+		decrementStock(r, tx, order)
+	}
 	order.PaymentState = models.PaidState
 	tx.Save(order)
+	logTimeline(r, tx, order, models.PaidTimelineEvent, "Payment of %d %s received", tr.Amount, tr.Currency)
 
-	if config.Webhooks.Payment != "" {
-		hook, err := models.NewHook("payment", config.SiteURL, config.Webhooks.Payment, order.UserID, config.Webhooks.Secret, order)
-		if err != nil {
-			log.WithError(err).Error("Failed to process webhook")
+	if err := models.RunHooks(tx, config, order.InstanceID, "payment", config.Webhooks.Payment, order.UserID, order); err != nil {
+		log.WithError(err).Error("Failed to process webhook")
+	}
+}
+
+// paymentAuthorized records a payment that was authorized but not captured
+// yet. The stock is only taken once the payment is captured.
+func paymentAuthorized(r *http.Request, tx *gorm.DB, tr *models.Transaction, order *models.Order, authorizer payments.Authorizer) {
+	tr.Status = models.AuthorizedState
+	if ttl := authorizer.AuthorizationTTL(); ttl > 0 {
+		expiresAt := time.Now().Add(ttl)
+		tr.AuthorizationExpiresAt = &expiresAt
+	}
+	tr.AuthorizedAmount = tr.Amount
+	if tx.NewRecord(tr) {
+		tx.Create(tr)
+	} else {
+		tx.Save(tr)
+	}
+	order.PaymentState = models.AuthorizedState
+	tx.Save(order)
+	logTimeline(r, tx, order, models.AuthorizedTimelineEvent, "Payment of %d %s authorized", tr.Amount, tr.Currency)
+}
+
+// authorizedPayment returns the authorized payment of an order that hasn't
+// been captured in full yet.
+func authorizedPayment(order *models.Order) *models.Transaction {
+	for _, t := range order.Transactions {
+		if t.Type == models.ChargeTransactionType && t.Status == models.AuthorizedState {
+			return t
 		}
-		tx.Save(hook)
 	}
+	return nil
+}
+
+// captureShipment captures the authorized payment of an order for the value
+// of a shipment, given in the order currency. Final captures release what's
+// left of the authorization, other captures leave it open for the next
+// shipments.
+func captureShipment(r *http.Request, tx *gorm.DB, order *models.Order, amount uint64, final bool) *HTTPError {
+	log := getLogEntry(r)
+
+	trans := authorizedPayment(order)
+	if trans == nil {
+		return badRequestError("Order %s has no authorized payment to capture", order.ID)
+	}
+
+	captureAmount := order.SettlementAmount(amount)
+	if remaining := trans.Authorized() - order.CapturedAmount(trans); captureAmount > remaining {
+		captureAmount = remaining
+	}
+	log.WithField("transaction_id", trans.ID).Debugf("Capturing %d %s for shipment", captureAmount, trans.Currency)
+	_, httpErr := capturePayment(r, tx, order, trans, captureAmount, final)
+	return httpErr
+}
+
+// capturePayment captures an authorized payment. The amount is given in the
+// currency of the payment and can be less than what was authorized. A final
+// capture completes the authorized payment and releases the rest of the
+// authorization. Other captures are recorded as transactions of their own and
+// leave the rest of the authorization open. It returns the transaction of the
+// capture.
+func capturePayment(r *http.Request, tx *gorm.DB, order *models.Order, trans *models.Transaction, captureAmount uint64, final bool) (*models.Transaction, *HTTPError) {
+	ctx := r.Context()
+	log := getLogEntry(r)
+
+	if trans.AuthorizationExpired(time.Now()) {
+		return nil, badRequestError("The authorization of payment %s expired at %s", trans.ID, trans.AuthorizationExpiresAt.Format(time.RFC3339))
+	}
+	remaining := trans.Authorized() - order.CapturedAmount(trans)
+	if captureAmount == 0 || captureAmount > remaining {
+		return nil, badRequestError("The captured amount must be between 0 and the remaining authorized amount of %d", remaining)
+	}
+
+	provider := gcontext.GetPaymentProviders(ctx)[order.PaymentProcessor]
+	if provider == nil {
+		return nil, badRequestError("Payment provider '%s' not configured", order.PaymentProcessor)
+	}
+	var capture payments.Capturer
+	var err error
+	if final {
+		capture, err = provider.NewCapturer(ctx, r, log.WithField("component", "payment_provider"))
+	} else {
+		partial, ok := provider.(payments.PartialCapturer)
+		if !ok {
+			return nil, badRequestError("Payment provider '%s' can't capture payments in parts", order.PaymentProcessor)
+		}
+		capture, err = partial.NewPartialCapturer(ctx, r, log.WithField("component", "payment_provider"))
+	}
+	if err != nil {
+		return nil, badRequestError("Error creating payment provider: %v", err)
+	}
+
+	processorID, err := capture(trans.ProcessorID, captureAmount, trans.Currency)
+	if err != nil {
+		return nil, internalServerError("There was an error capturing the payment: %v", err).WithInternalError(err)
+	}
+	if processorID == "" {
+		processorID = trans.ProcessorID
+	}
+
+	if final {
+		trans.ProcessorID = processorID
+		trans.Amount = captureAmount
+		paymentComplete(r, tx, trans, order)
+		return trans, nil
+	}
+
+	invoiceNumber, err := models.NextInvoiceNumber(tx, order.InstanceID)
+	if err != nil {
+		return nil, internalServerError("We failed to generate a valid invoice ID: %v", err).WithInternalError(err)
+	}
+	captureTr := &models.Transaction{
+		InstanceID:      order.InstanceID,
+		SiteID:          order.SiteID,
+		ID:              uuid.NewRandom().String(),
+		OrderID:         order.ID,
+		InvoiceNumber:   invoiceNumber,
+		ProcessorID:     processorID,
+		UserID:          trans.UserID,
+		Amount:          captureAmount,
+		Currency:        trans.Currency,
+		Type:            models.ChargeTransactionType,
+		AuthorizationID: trans.ID,
+	}
+	partialCaptureComplete(r, tx, captureTr, order)
+	return captureTr, nil
+}
+
+// partialCaptureComplete records a partial capture of an authorized payment.
+// The items of the order are taken from the stock with the first capture, the
+// order is paid once the payment is captured in full.
+func partialCaptureComplete(r *http.Request, tx *gorm.DB, tr *models.Transaction, order *models.Order) {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	config := gcontext.GetConfig(ctx)
+
+	tr.Status = models.PaidState
+	tx.Create(tr)
+	order.Transactions = append(order.Transactions, tr)
+
+	if order.PaymentState != models.PartiallyCapturedState {
+		decrementStock(r, tx, order)
+		order.PaymentState = models.PartiallyCapturedState
+	}
+	tx.Save(order)
+	logTimeline(r, tx, order, models.CapturedTimelineEvent, "Captured %d %s of the authorized payment", tr.Amount, tr.Currency)
+
+	if err := models.RunHooks(tx, config, order.InstanceID, "payment", config.Webhooks.Payment, order.UserID, order); err != nil {
+		log.WithError(err).Error("Failed to process webhook")
+	}
+}
+
+type captureParams struct {
+	// Amount defaults to what's left of the authorized amount
+	Amount *uint64 `json:"amount"`
+	// Final defaults to true, a final capture releases the rest of the
+	// authorization. Payments can be captured in parts until the final
+	// capture.
+	Final *bool `json:"final"`
 }
 
-func sendOrderConfirmation(ctx context.Context, log logrus.FieldLogger, tr *models.Transaction) {
-	mailer := gcontext.GetMailer(ctx)
+// PaymentCapture captures an authorized payment of an order in full or in
+// parts. It requires admin access.
+func (a *API) PaymentCapture(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+
+	params := &captureParams{}
+	if err := decodeJSON(r, params); err != nil && err != io.EOF {
+		return badRequestError("Could not read params: %v", err)
+	}
+
+	tx := a.DB(r).Begin()
+	order := &models.Order{}
+	if result := siteScope(ctx, orderQuery(tx), "").First(order, "id = ?", gcontext.GetOrderID(ctx)); result.Error != nil {
+		tx.Rollback()
+		if result.RecordNotFound() {
+			return notFoundError("Order not found")
+		}
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+
+	payID := chi.URLParam(r, "payment_id")
+	var trans *models.Transaction
+	for _, t := range order.Transactions {
+		if t.ID == payID {
+			trans = t
+		}
+	}
+	if trans == nil {
+		tx.Rollback()
+		return notFoundError("Transaction not found")
+	}
+	if trans.Type != models.ChargeTransactionType || trans.Status != models.AuthorizedState {
+		tx.Rollback()
+		return badRequestError("Only authorized payments can be captured")
+	}
+	final := params.Final == nil || *params.Final
+	state := models.PaidState
+	if !final {
+		state = models.PartiallyCapturedState
+	}
+	if !models.PaymentStateMachine.Allowed(order.PaymentState, state, models.ActorAdmin) {
+		tx.Rollback()
+		return badRequestError("Can't capture a payment of an order in the '%s' payment state", order.PaymentState)
+	}
 
-	err1 := mailer.OrderConfirmationMail(tr)
-	err2 := mailer.OrderReceivedMail(tr)
+	amount := trans.Authorized() - order.CapturedAmount(trans)
+	if params.Amount != nil {
+		amount = *params.Amount
+	}
 
-	if err1 != nil || err2 != nil {
-		log.Errorf("Error sending order confirmation mails: %v %v", err1, err2)
+	log.WithField("transaction_id", trans.ID).Debugf("Capturing %d %s", amount, trans.Currency)
+	captured, httpErr := capturePayment(r, tx, order, trans, amount, final)
+	if httpErr != nil {
+		tx.Rollback()
+		return httpErr
 	}
+	if err := tx.Commit().Error; err != nil {
+		return internalServerError("Saving payment failed").WithInternalError(err)
+	}
+	return sendJSON(w, http.StatusOK, captured)
 }
 
 // PaymentCreate is the endpoint for creating a payment for an order
@@ -119,28 +424,61 @@ func (a *API) PaymentCreate(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	log := getLogEntry(r)
 
-	params := PaymentParams{Currency: "USD"}
+	params := PaymentParams{}
+	// the body also carries the parameters of the payment provider
 	err := json.NewDecoder(r.Body).Decode(&params)
 	if err != nil {
 		return badRequestError("Could not read params: %v", err)
 	}
-	if params.ProviderType == "" {
+	currency, httpErr := normalizeCurrency(gcontext.GetConfig(ctx), params.Currency)
+	if httpErr != nil {
+		return httpErr
+	}
+	params.Currency = currency
+	if params.ProviderType == "" && params.GiftCardCode == "" {
 		return badRequestError("Creating a payment requires specifying a 'provider'")
 	}
 
-	provider := gcontext.GetPaymentProviders(ctx)[strings.ToLower(params.ProviderType)]
-	if provider == nil {
-		return badRequestError("Payment provider '%s' not configured", params.ProviderType)
+	authorizeOnly := params.Capture != nil && !*params.Capture
+	if authorizeOnly && (params.ProviderType == "" || params.PaymentMethodID != "" || params.GiftCardCode != "") {
+		return badRequestError("Only payments with new payment details can be authorized without capturing them")
 	}
-	charge, err := provider.NewCharger(ctx, r, log.WithField("component", "payment_provider"))
-	if err != nil {
-		return badRequestError("Error creating payment provider: %v", err)
+
+	var provider payments.Provider
+	var charge payments.Charger
+	var authorizer payments.Authorizer
+	if params.ProviderType != "" {
+		provider = gcontext.GetPaymentProviders(ctx)[strings.ToLower(params.ProviderType)]
+		if provider == nil {
+			return badRequestError("Payment provider '%s' not configured", params.ProviderType)
+		}
+		if authorizeOnly {
+			var ok bool
+			if authorizer, ok = provider.(payments.Authorizer); !ok {
+				return badRequestError("Payment provider '%s' can't authorize payments without capturing them", params.ProviderType)
+			}
+			charge, err = authorizer.NewAuthorizer(ctx, r, log.WithField("component", "payment_provider"))
+			if err != nil {
+				return badRequestError("Error creating payment provider: %v", err)
+			}
+		} else if params.PaymentMethodID != "" {
+			var httpErr *HTTPError
+			charge, httpErr = a.savedMethodCharger(r, provider, params.PaymentMethodID)
+			if httpErr != nil {
+				return httpErr
+			}
+		} else {
+			charge, err = provider.NewCharger(ctx, r, log.WithField("component", "payment_provider"))
+			if err != nil {
+				return badRequestError("Error creating payment provider: %v", err)
+			}
+		}
 	}
 
 	orderID := gcontext.GetOrderID(ctx)
 	tx := a.DB(r).Begin()
 	order := &models.Order{}
-	loader := tx.
+	loader := siteScope(ctx, tx, "").
 		Preload("LineItems").
 		Preload("Downloads").
 		Preload("BillingAddress").
@@ -157,8 +495,20 @@ func (a *API) PaymentCreate(w http.ResponseWriter, r *http.Request) error {
 		tx.Rollback()
 		return badRequestError("This order has already been paid")
 	}
+	if order.PaymentState == models.AbandonedState {
+		tx.Rollback()
+		return badRequestError("This order has been abandoned")
+	}
+	if order.PaymentState == models.CancelledState {
+		tx.Rollback()
+		return badRequestError("This order has been cancelled")
+	}
+	if !models.PaymentStateMachine.Allowed(order.PaymentState, models.PaidState, models.ActorCustomer) {
+		tx.Rollback()
+		return badRequestError("Can't pay for an order in the '%s' payment state", order.PaymentState)
+	}
 
-	if order.Currency != params.Currency {
+	if !strings.EqualFold(order.Currency, params.Currency) {
 		tx.Rollback()
 		return badRequestError("Currencies doesn't match - %v vs %v", order.Currency, params.Currency)
 	}
@@ -182,10 +532,13 @@ func (a *API) PaymentCreate(w http.ResponseWriter, r *http.Request) error {
 		}
 	}
 
-	err = a.verifyAmount(ctx, order, params.Amount)
-	if err != nil {
+	if httpErr := a.verifyAmount(r, order, params.Amount); httpErr != nil {
 		tx.Rollback()
-		return internalServerError("We failed to authorize the amount for this order: %v", err)
+		return httpErr
+	}
+	if httpErr := checkOrderLimits(gcontext.GetConfig(ctx), order); httpErr != nil {
+		tx.Rollback()
+		return httpErr
 	}
 
 	invoiceNumber := order.InvoiceNumber
@@ -199,8 +552,95 @@ func (a *API) PaymentCreate(w http.ResponseWriter, r *http.Request) error {
 		order.InvoiceNumber = invoiceNumber
 	}
 
+	amount, currency := order.ChargeAmount()
+	providerName := ""
+	if provider != nil {
+		providerName = provider.Name()
+		if httpErr := checkProcessorCurrency(gcontext.GetConfig(ctx), providerName, currency); httpErr != nil {
+			tx.Rollback()
+			return httpErr
+		}
+	}
+
+	risk := checkFraud(r, order, providerName, amount, currency)
+	if risk != nil && risk.Decision != fraud.Allow {
+		tr := models.NewTransaction(order)
+		tr.Amount = amount
+		tr.Currency = currency
+		tr.InvoiceNumber = invoiceNumber
+		tr.IP = clientIP(r)
+		tr.UserAgent = r.UserAgent()
+		setRisk(tr, risk)
+		if risk.Decision == fraud.Block {
+			tr.Status = models.FailedState
+			tr.FailureCode = strconv.FormatInt(http.StatusPaymentRequired, 10)
+			tr.FailureDescription = "Declined by the fraud check"
+			tx.Create(tr)
+			tx.Commit()
+			return paymentRequiredError("The payment was declined").WithErrorCode("payment_declined")
+		}
+
+		// flagged payments aren't charged until an admin approves them
+		tr.Status = models.ReviewState
+		tx.Create(tr)
+		order.PaymentState = models.ReviewState
+		order.PaymentProcessor = providerName
+		tx.Save(order)
+		logTimeline(r, tx, order, models.ReviewTimelineEvent, "Payment of %d %s held for review", amount, currency)
+		if err := tx.Commit().Error; err != nil {
+			return internalServerError("Saving payment failed").WithInternalError(err)
+		}
+		return sendJSON(w, http.StatusOK, tr)
+	}
+
+	var creditTr *models.Transaction
+	if params.GiftCardCode != "" {
+		var httpErr *HTTPError
+		_, creditTr, httpErr = redeemGiftCard(tx, order, params.GiftCardCode, amount, currency)
+		if httpErr != nil {
+			tx.Rollback()
+			return httpErr
+		}
+		creditTr.IP = clientIP(r)
+		creditTr.UserAgent = r.UserAgent()
+		amount -= creditTr.Amount
+
+		if amount == 0 {
+			order.PaymentProcessor = models.GiftCardProcessor
+			paymentComplete(r, tx, creditTr, order)
+			enqueueOrderConfirmation(tx, log, creditTr)
+			if err := tx.Commit().Error; err != nil {
+				return internalServerError("Saving payment failed").WithInternalError(err)
+			}
+			return sendJSON(w, http.StatusOK, creditTr)
+		}
+		if charge == nil {
+			tx.Rollback()
+			return badRequestError("The gift card doesn't cover the order, a 'provider' is required for the remaining %d %s", amount, currency)
+		}
+		// the redeemed balance is held until the rest of the payment goes
+		// through, it's paid along with it or restored if it fails
+		creditTr.Status = models.PendingState
+		tx.Create(creditTr)
+	}
+
+	splits, err := marketplaceSplits(gcontext.GetConfig(ctx), order, amount)
+	if err != nil {
+		tx.Rollback()
+		return internalServerError("Error splitting the payment between sellers").WithInternalError(err)
+	}
+	if len(splits) > 0 && provider.Name() != payments.StripeProvider {
+		tx.Rollback()
+		return badRequestError("Orders from marketplace sellers can only be paid with Stripe")
+	}
+
 	tr := models.NewTransaction(order)
-	processorID, err := charge(params.Amount, params.Currency, order, invoiceNumber)
+	tr.Amount = amount
+	tr.Currency = currency
+	tr.IP = clientIP(r)
+	tr.UserAgent = r.UserAgent()
+	setRisk(tr, risk)
+	processorID, err := charge(amount, currency, order, invoiceNumber, splits)
 	tr.ProcessorID = processorID
 	tr.InvoiceNumber = invoiceNumber
 	order.PaymentProcessor = provider.Name()
@@ -215,24 +655,86 @@ func (a *API) PaymentCreate(w http.ResponseWriter, r *http.Request) error {
 			return sendJSON(w, 200, tr)
 		}
 
+		if creditTr != nil {
+			// return the redeemed balance since the order stays unpaid
+			if err := models.RestoreGiftCardCharges(tx, order.ID, "The payment of the remaining amount failed"); err != nil {
+				tx.Rollback()
+				return internalServerError("Failed to restore the gift card balance").WithInternalError(err)
+			}
+		}
+
+		_, unavailable := err.(*payments.ProviderUnavailableError)
 		tr.FailureCode = strconv.FormatInt(http.StatusInternalServerError, 10)
+		if unavailable {
+			tr.FailureCode = strconv.FormatInt(http.StatusServiceUnavailable, 10)
+		}
 		tr.FailureDescription = err.Error()
 		tr.Status = models.FailedState
 		tx.Create(tr)
 		tx.Commit()
+		if unavailable {
+			return serviceUnavailableError("The payment provider is unavailable, please try again later").WithInternalError(err)
+		}
 		return internalServerError("There was an error charging your card: %v", err).WithInternalError(err)
 	}
 
-	paymentComplete(r, tx, tr, order)
+	if authorizeOnly {
+		paymentAuthorized(r, tx, tr, order, authorizer)
+	} else {
+		paymentComplete(r, tx, tr, order)
+	}
+	enqueueOrderConfirmation(tx, log, tr)
 	if err := tx.Commit().Error; err != nil {
 		return internalServerError("Saving payment failed").WithInternalError(err)
 	}
 
-	go sendOrderConfirmation(ctx, log, tr)
-
 	return sendJSON(w, http.StatusOK, tr)
 }
 
+// paymentFailed records that a pending payment failed and returns the gift
+// card balance held for the rest of the order to its gift cards.
+func paymentFailed(db *gorm.DB, trans *models.Transaction, reason string) *HTTPError {
+	tx := db.Begin()
+	trans.Status = models.FailedState
+	trans.FailureDescription = reason
+	if rsp := tx.Save(trans); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Saving the failed payment failed").WithInternalError(rsp.Error)
+	}
+	if err := models.RestoreGiftCardCharges(tx, trans.OrderID, "The payment of the remaining amount failed"); err != nil {
+		tx.Rollback()
+		return internalServerError("Failed to restore the gift card balance").WithInternalError(err)
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Saving the failed payment failed").WithInternalError(rsp.Error)
+	}
+	return nil
+}
+
+// savedMethodCharger charges a payment method saved by the user making the
+// request. The customer is taken from the user record so nobody can charge
+// payment methods saved by someone else.
+func (a *API) savedMethodCharger(r *http.Request, provider payments.Provider, paymentMethodID string) (payments.Charger, *HTTPError) {
+	store, ok := provider.(payments.PaymentMethodStore)
+	if !ok {
+		return nil, badRequestError("Payment provider '%s' can't charge saved payment methods", provider.Name())
+	}
+
+	claims := gcontext.GetClaims(r.Context())
+	if claims == nil || claims.Subject == "" {
+		return nil, unauthorizedError("You must be logged in to pay with a saved payment method")
+	}
+	user, err := models.GetUser(a.DB(r), claims.Subject)
+	if err != nil {
+		return nil, internalServerError("problem while querying for userID: %s", claims.Subject).WithInternalError(err)
+	}
+	if user == nil || user.StripeCustomerID == "" {
+		return nil, badRequestError("You don't have any saved payment methods")
+	}
+
+	return store.NewSavedMethodCharger(user.StripeCustomerID, paymentMethodID), nil
+}
+
 // PaymentConfirm allows client to confirm if a pending transaction has been completed. Updates transaction and order
 func (a *API) PaymentConfirm(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
@@ -240,7 +742,7 @@ func (a *API) PaymentConfirm(w http.ResponseWriter, r *http.Request) error {
 	db := a.DB(r)
 
 	payID := chi.URLParam(r, "payment_id")
-	trans, httpErr := getTransaction(db, payID)
+	trans, httpErr := getTransaction(siteScope(ctx, db, ""), payID)
 	if httpErr != nil {
 		return httpErr
 	}
@@ -256,12 +758,12 @@ func (a *API) PaymentConfirm(w http.ResponseWriter, r *http.Request) error {
 		}
 	}
 
-	if trans.Status == models.PaidState {
+	if trans.Status == models.PaidState || trans.Status == models.AuthorizedState {
 		return sendJSON(w, http.StatusOK, trans)
 	}
 
 	order := &models.Order{}
-	if rsp := db.Find(order, "id = ?", trans.OrderID); rsp.Error != nil {
+	if rsp := siteScope(ctx, db, "").Find(order, "id = ?", trans.OrderID); rsp.Error != nil {
 		if rsp.RecordNotFound() {
 			return notFoundError("Order not found")
 		}
@@ -280,12 +782,31 @@ func (a *API) PaymentConfirm(w http.ResponseWriter, r *http.Request) error {
 		return badRequestError("Error creating payment provider: %v", err)
 	}
 
-	if err := confirm(trans.ProcessorID); err != nil {
+	state, err := confirm(trans.ProcessorID)
+	if err != nil {
 		if confirmFail, ok := err.(*payments.PaymentConfirmFailError); ok {
 			return badRequestError("Error confirming payment: %s", confirmFail.Error())
 		}
 		return internalServerError("Error on provider while trying to confirm: %v. Try again later.", err)
 	}
+	var authorizer payments.Authorizer
+	switch state {
+	case models.PaidState:
+	case models.AuthorizedState:
+		var ok bool
+		if authorizer, ok = provider.(payments.Authorizer); !ok {
+			return internalServerError("Payment provider '%s' returned an authorization it doesn't support", provider.Name())
+		}
+	case models.FailedState:
+		if trans.Status == models.PendingState {
+			if httpErr := paymentFailed(db, trans, "The payment failed to confirm"); httpErr != nil {
+				return httpErr
+			}
+		}
+		return badRequestError("Error confirming payment: the payment is %s", state)
+	default:
+		return badRequestError("Error confirming payment: the payment is %s", state)
+	}
 
 	tx := db.Begin()
 
@@ -298,13 +819,16 @@ func (a *API) PaymentConfirm(w http.ResponseWriter, r *http.Request) error {
 		trans.InvoiceNumber = invoiceNumber
 	}
 
-	paymentComplete(r, tx, trans, order)
+	if authorizer != nil {
+		paymentAuthorized(r, tx, trans, order, authorizer)
+	} else {
+		paymentComplete(r, tx, trans, order)
+	}
+	enqueueOrderConfirmation(tx, log, trans)
 	if err := tx.Commit().Error; err != nil {
 		return internalServerError("Saving payment failed").WithInternalError(err)
 	}
 
-	go sendOrderConfirmation(ctx, log, trans)
-
 	return sendJSON(w, http.StatusOK, trans)
 }
 
@@ -312,7 +836,10 @@ func (a *API) PaymentConfirm(w http.ResponseWriter, r *http.Request) error {
 func (a *API) PaymentList(w http.ResponseWriter, r *http.Request) error {
 	log := getLogEntry(r)
 	instanceID := gcontext.GetInstanceID(r.Context())
-	query := a.DB(r).Where("instance_id = ?", instanceID)
+	query := a.ReadDB(r)
+	transactionTable := query.NewScope(models.Transaction{}).QuotedTableName()
+	query = query.Where(transactionTable+".instance_id = ?", instanceID)
+	query = siteScope(r.Context(), query, transactionTable)
 
 	query, err := parsePaymentQueryParams(query, r.URL.Query())
 	if err != nil {
@@ -329,7 +856,7 @@ func (a *API) PaymentList(w http.ResponseWriter, r *http.Request) error {
 // PaymentView returns information about a single payment. It is only available to admins.
 func (a *API) PaymentView(w http.ResponseWriter, r *http.Request) error {
 	payID := chi.URLParam(r, "payment_id")
-	trans, httpErr := getTransaction(a.DB(r), payID)
+	trans, httpErr := getTransaction(siteScope(r.Context(), a.ReadDB(r), ""), payID)
 	if httpErr != nil {
 		return httpErr
 	}
@@ -342,22 +869,42 @@ func (a *API) PaymentRefund(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	db := a.DB(r)
 	config := gcontext.GetConfig(ctx)
-	params := PaymentParams{Currency: "USD"}
+	params := PaymentParams{}
+	// the body also carries the parameters of the payment provider
 	err := json.NewDecoder(r.Body).Decode(&params)
 	if err != nil {
 		return badRequestError("Could not read params: %v", err)
 	}
+	currency, httpErr := normalizeCurrency(config, params.Currency)
+	if httpErr != nil {
+		return httpErr
+	}
+	params.Currency = currency
 
 	payID := chi.URLParam(r, "payment_id")
-	trans, httpErr := getTransaction(db, payID)
+	trans, httpErr := getTransaction(siteScope(ctx, db, ""), payID)
 	if httpErr != nil {
 		return httpErr
 	}
 
-	if trans.Currency != params.Currency {
+	if !strings.EqualFold(trans.Currency, params.Currency) {
 		return badRequestError("Currencies do not match - %v vs %v", trans.Currency, params.Currency)
 	}
 
+	log := getLogEntry(r)
+	order, httpErr := queryForOrder(siteScope(ctx, db, ""), trans.OrderID, log)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	if params.Component != "" {
+		amount, httpErr := refundComponentAmount(db, order, &params)
+		if httpErr != nil {
+			return httpErr
+		}
+		params.Amount = amount
+	}
+
 	if params.Amount <= 0 || params.Amount > trans.Amount {
 		return badRequestError("The balance of the refund must be between 0 and the total amount")
 	}
@@ -370,24 +917,6 @@ func (a *API) PaymentRefund(w http.ResponseWriter, r *http.Request) error {
 		return badRequestError("Can't refund a transaction that hasn't been paid")
 	}
 
-	log := getLogEntry(r)
-	order, httpErr := queryForOrder(db, trans.OrderID, log)
-	if httpErr != nil {
-		return httpErr
-	}
-	if order.PaymentProcessor == "" {
-		return badRequestError("Order does not specify a payment provider")
-	}
-
-	provider := gcontext.GetPaymentProviders(ctx)[order.PaymentProcessor]
-	if provider == nil {
-		return badRequestError("Payment provider '%s' not configured", order.PaymentProcessor)
-	}
-	refund, err := provider.NewRefunder(ctx, r, log.WithField("component", "payment_provider"))
-	if err != nil {
-		return badRequestError("Error creating payment provider: %v", err)
-	}
-
 	// ok make the refund
 	m := &models.Transaction{
 		InstanceID: order.InstanceID,
@@ -398,34 +927,93 @@ func (a *API) PaymentRefund(w http.ResponseWriter, r *http.Request) error {
 		OrderID:    trans.OrderID,
 		Type:       models.RefundTransactionType,
 		Status:     models.PendingState,
+
+		RefundComponent: params.Component,
+		LineItemID:      params.LineItemID,
 	}
 
 	tx := db.Begin()
+	if httpErr := makeRefund(r, tx, order, trans, m, params.StoreCredit); httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	tx.Commit()
+	a.audit(r, models.AuditPaymentRefund, trans.ID, nil, m)
+	return sendJSON(w, http.StatusOK, m)
+}
+
+// makeRefund refunds a charge with its payment provider, or as store credit,
+// and records the outcome in the refund transaction m. Together the refunds of
+// a charge can't exceed its amount. Refunds the provider declines are recorded
+// as failed transactions.
+func makeRefund(r *http.Request, tx *gorm.DB, order *models.Order, trans *models.Transaction, m *models.Transaction, storeCredit bool) *HTTPError {
+	ctx := r.Context()
+	config := gcontext.GetConfig(ctx)
+	log := getLogEntry(r)
+
+	if refunded := order.RefundedAmount(trans); refunded+m.Amount > trans.Amount {
+		var left uint64
+		if refunded < trans.Amount {
+			left = trans.Amount - refunded
+		}
+		return badRequestError("The refund exceeds the %d %s of the charge that haven't been refunded yet", left, trans.Currency)
+	}
+	m.ChargeID = trans.ID
+
+	// gift card payments are always refunded to the gift card
+	storeCredit = storeCredit || trans.GiftCardID != ""
+	var refund payments.Refunder
+	provID := "store credit"
+	if !storeCredit {
+		if order.PaymentProcessor == "" {
+			return badRequestError("Order does not specify a payment provider")
+		}
+
+		provider := gcontext.GetPaymentProviders(ctx)[order.PaymentProcessor]
+		if provider == nil {
+			return badRequestError("Payment provider '%s' not configured", order.PaymentProcessor)
+		}
+		var err error
+		refund, err = provider.NewRefunder(ctx, r, log.WithField("component", "payment_provider"))
+		if err != nil {
+			return badRequestError("Error creating payment provider: %v", err)
+		}
+		provID = provider.Name()
+	}
+
 	tx.Create(m)
-	provID := provider.Name()
 	log.Debugf("Starting refund to %s", provID)
-	refundID, err := refund(trans.ProcessorID, params.Amount, params.Currency)
-	if err != nil {
-		log.WithError(err).Info("Failed to refund value")
-		m.FailureCode = strconv.FormatInt(http.StatusInternalServerError, 10)
-		m.FailureDescription = err.Error()
-		m.Status = models.FailedState
-	} else {
-		m.ProcessorID = refundID
+	if storeCredit {
+		card, err := refundToStoreCredit(tx, order, trans, m.Amount, m.Currency)
+		if err != nil {
+			return internalServerError("Failed to refund to store credit").WithInternalError(err)
+		}
+		m.GiftCardID = card.ID
 		m.Status = models.PaidState
+		logTimeline(r, tx, order, models.RefundedTimelineEvent, "Refunded %d %s as store credit", m.Amount, m.Currency)
+	} else {
+		refundID, err := refund(trans.ProcessorID, m.Amount, m.Currency)
+		if _, ok := err.(*payments.ProviderUnavailableError); ok {
+			return serviceUnavailableError("The payment provider is unavailable, please try again later").WithInternalError(err)
+		}
+		if err != nil {
+			log.WithError(err).Info("Failed to refund value")
+			m.FailureCode = strconv.FormatInt(http.StatusInternalServerError, 10)
+			m.FailureDescription = err.Error()
+			m.Status = models.FailedState
+		} else {
+			m.ProcessorID = refundID
+			m.Status = models.PaidState
+			logTimeline(r, tx, order, models.RefundedTimelineEvent, "Refunded %d %s", m.Amount, m.Currency)
+		}
 	}
 
 	log.Infof("Finished transaction with %s: %s", provID, m.ProcessorID)
 	tx.Save(m)
-	if config.Webhooks.Refund != "" {
-		hook, err := models.NewHook("refund", config.SiteURL, config.Webhooks.Refund, m.UserID, config.Webhooks.Secret, m)
-		if err != nil {
-			log.WithError(err).Error("Failed to process webhook")
-		}
-		tx.Save(hook)
+	if err := models.RunHooks(tx, config, m.InstanceID, "refund", config.Webhooks.Refund, m.UserID, m); err != nil {
+		log.WithError(err).Error("Failed to process webhook")
 	}
-	tx.Commit()
-	return sendJSON(w, http.StatusOK, m)
+	return nil
 }
 
 // PreauthorizePayment creates a new payment that can be authorized in the browser
@@ -461,11 +1049,19 @@ func (a *API) PreauthorizePayment(w http.ResponseWriter, r *http.Request) error
 	if providerType == "" {
 		return badRequestError("Preauthorizing a payment requires specifying a 'provider'")
 	}
+	currency, httpErr := normalizeCurrency(gcontext.GetConfig(ctx), params.Currency)
+	if httpErr != nil {
+		return httpErr
+	}
+	params.Currency = currency
 
 	provider := gcontext.GetPaymentProviders(ctx)[providerType]
 	if provider == nil {
 		return badRequestError("Payment provider '%s' not configured", providerType)
 	}
+	if httpErr := checkProcessorCurrency(gcontext.GetConfig(ctx), provider.Name(), params.Currency); httpErr != nil {
+		return httpErr
+	}
 	preauthorize, err := provider.NewPreauthorizer(ctx, r, log.WithField("component", "payment_provider"))
 	if err != nil {
 		return badRequestError("Error creating payment provider: %v", err)
@@ -493,14 +1089,175 @@ func getTransaction(db *gorm.DB, payID string) (*models.Transaction, *HTTPError)
 	return trans, nil
 }
 
-func (a *API) verifyAmount(ctx context.Context, order *models.Order, amount uint64) error {
+// attachTransaction replaces the order's preloaded copy of a transaction, so
+// that saving the order doesn't overwrite changes made to the transaction.
+func attachTransaction(order *models.Order, trans *models.Transaction) {
+	for i, t := range order.Transactions {
+		if t.ID == trans.ID {
+			order.Transactions[i] = trans
+		}
+	}
+}
+
+// verifyAmount checks that the amount to charge is the total of the order and
+// that the total is still what the order costs with the current settings. An
+// out of date total is a conflict the client resolves by reloading the order.
+func (a *API) verifyAmount(r *http.Request, order *models.Order, amount uint64) *HTTPError {
+	ctx := r.Context()
 	if order.Total != amount {
-		return fmt.Errorf("Amount calculated for order didn't match amount to charge. %v vs %v", order.Total, amount)
+		return internalServerError("We failed to authorize the amount for this order: Amount calculated for order didn't match amount to charge. %v vs %v", order.Total, amount)
+	}
+	settings, err := a.loadSettings(ctx)
+	if err != nil {
+		return internalServerError("We failed to authorize the amount for this order: %v", err).WithInternalError(err)
+	}
+	if expected := order.ExpectedTotal(settings, pricingClaims(ctx, order), getLogEntry(r)); expected != order.Total {
+		return conflictError("The order total is out of date, it should be %v instead of %v. Reload the order to get the current total", expected, order.Total).WithErrorCode("stale_total")
+	}
+	if order.NetTotal+order.Taxes+order.Shipping+order.Tip != order.Total {
+		return internalServerError("We failed to authorize the amount for this order: Order total doesn't match its items, taxes, shipping and tip. %v vs %v", order.Total, order.NetTotal+order.Taxes+order.Shipping+order.Tip)
+	}
+	if len(order.TaxLines) > 0 {
+		var taxes uint64
+		for _, line := range order.TaxLines {
+			taxes += line.Amount
+		}
+		if taxes != order.Taxes {
+			return internalServerError("We failed to authorize the amount for this order: Order taxes don't match its tax lines. %v vs %v", order.Taxes, taxes)
+		}
 	}
 
 	return nil
 }
 
+// refundComponentAmount calculates the amount to refund for a single component
+// of an order, in the currency the order was charged in.
+func refundComponentAmount(db *gorm.DB, order *models.Order, params *PaymentParams) (uint64, *HTTPError) {
+	if params.Component != models.LineItemRefundComponent {
+		params.LineItemID = 0
+	}
+	for _, t := range order.Transactions {
+		if t.Type == models.RefundTransactionType && t.Status == models.PaidState &&
+			t.RefundComponent == params.Component && t.LineItemID == params.LineItemID {
+			return 0, badRequestError("This %v has already been refunded", strings.Replace(params.Component, "_", " ", -1))
+		}
+	}
+
+	var amount uint64
+	switch params.Component {
+	case models.ShippingRefundComponent:
+		amount = order.Shipping
+	case models.LineItemRefundComponent:
+		item := &models.LineItem{}
+		if rsp := db.First(item, "id = ? AND order_id = ?", params.LineItemID, order.ID); rsp.Error != nil {
+			if rsp.RecordNotFound() {
+				return 0, notFoundError("Line item %v not found on this order", params.LineItemID)
+			}
+			return 0, internalServerError("Error while querying for line item").WithInternalError(rsp.Error)
+		}
+		// the calculated total is the price of a single item
+		price := item.Price
+		if item.CalculationDetail != nil && item.Total > 0 {
+			price = uint64(item.Total)
+		}
+		amount = price * item.Quantity
+		amount += tipShare(order, amount)
+	default:
+		return 0, badRequestError("Unknown refund component '%v', choose from shipping or line_item", params.Component)
+	}
+
+	if amount == 0 {
+		return 0, badRequestError("There is nothing to refund for the %v", strings.Replace(params.Component, "_", " ", -1))
+	}
+	return order.SettlementAmount(amount), nil
+}
+
+// tipShare is the part of the order tip that goes with an amount of its items,
+// so that refunding all items refunds the tip as well.
+func tipShare(order *models.Order, amount uint64) uint64 {
+	itemsTotal := order.NetTotal + order.Taxes
+	if order.Tip == 0 || itemsTotal == 0 {
+		return 0
+	}
+	return uint64(math.Round(float64(order.Tip) * float64(amount) / float64(itemsTotal)))
+}
+
+// processorCurrencies returns the currencies payments with a processor can
+// be made in. Any currency can be used if there are none.
+func processorCurrencies(config *conf.Configuration, processor string) []string {
+	switch processor {
+	case payments.StripeProvider:
+		return config.Payment.Stripe.Currencies
+	case payments.PayPalProvider:
+		return config.Payment.PayPal.Currencies
+	}
+	return nil
+}
+
+// checkProcessorCurrency rejects payments in a currency the processor isn't
+// configured for, before the processor is asked to make them.
+func checkProcessorCurrency(config *conf.Configuration, processor, currency string) *HTTPError {
+	currencies := processorCurrencies(config, processor)
+	if len(currencies) == 0 {
+		return nil
+	}
+	for _, c := range currencies {
+		if strings.EqualFold(c, currency) {
+			return nil
+		}
+	}
+	return badRequestError("Payments in %s can't be made with %s, it only supports %s", strings.ToUpper(currency), processor, strings.ToUpper(strings.Join(currencies, ", ")))
+}
+
+// marketplaceSplits returns the shares of the sellers of the order's line
+// items in a payment of amount, less the application fee. The platform keeps
+// the rest, like shipping and tips. Shares are reduced in proportion when
+// part of the order is paid otherwise, e.g. with a gift card. There are no
+// splits unless Stripe Connect accounts are configured.
+func marketplaceSplits(config *conf.Configuration, order *models.Order, amount uint64) ([]payments.Split, error) {
+	connect := config.Payment.Stripe.Connect
+	if len(connect.Accounts) == 0 {
+		return nil, nil
+	}
+
+	accounts := []string{}
+	shares := map[string]uint64{}
+	for _, item := range order.LineItems {
+		if item.Seller == "" {
+			continue
+		}
+		account, ok := connect.Accounts[item.Seller]
+		if !ok {
+			return nil, fmt.Errorf("Seller '%s' has no connected Stripe account", item.Seller)
+		}
+		if _, ok := shares[account]; !ok {
+			accounts = append(accounts, account)
+		}
+		// the calculated total of line items is the total of a single item
+		if item.CalculationDetail != nil && item.Total > 0 {
+			shares[account] += uint64(item.Total) * item.Quantity
+		} else {
+			shares[account] += item.Price * item.Quantity
+		}
+	}
+
+	total, _ := order.ChargeAmount()
+	splits := []payments.Split{}
+	for _, account := range accounts {
+		share := order.SettlementAmount(shares[account])
+		if amount < total {
+			share = uint64(math.Round(float64(share) * float64(amount) / float64(total)))
+		}
+		fee := uint64(math.Round(float64(share) * float64(connect.ApplicationFee) / 100))
+		if fee > share {
+			fee = share
+		}
+		share -= fee
+		splits = append(splits, payments.Split{Account: account, Amount: share})
+	}
+	return splits, nil
+}
+
 func queryForOrder(db *gorm.DB, orderID string, log logrus.FieldLogger) (*models.Order, *HTTPError) {
 	order := &models.Order{}
 	if rsp := db.Preload("Transactions").Find(order, "id = ?", orderID); rsp.Error != nil {
@@ -535,7 +1292,11 @@ func createPaymentProviders(c *conf.Configuration) (map[string]payments.Provider
 	provs := map[string]payments.Provider{}
 	if c.Payment.Stripe.Enabled {
 		p, err := stripe.NewPaymentProvider(stripe.Config{
-			SecretKey: c.Payment.Stripe.SecretKey,
+			SecretKey:        c.Payment.Stripe.SecretKey,
+			MaxRetries:       c.Payment.Stripe.MaxRetries,
+			RetryBackoff:     time.Duration(c.Payment.Stripe.RetryBackoff) * time.Millisecond,
+			BreakerThreshold: c.Payment.Stripe.BreakerThreshold,
+			BreakerCooldown:  time.Duration(c.Payment.Stripe.BreakerCooldown) * time.Second,
 		})
 		if err != nil {
 			return nil, err
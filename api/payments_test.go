@@ -3,13 +3,17 @@ package api
 import (
 	"bytes"
 	"context"
+	"encoding/csv"
 	"encoding/json"
+	"io"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 
+	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/mitchellh/mapstructure"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
@@ -119,6 +123,36 @@ func TestUserPaymentsList(t *testing.T) {
 		recorder := test.TestEndpoint(http.MethodGet, url, nil, token)
 		validateError(t, http.StatusUnauthorized, recorder)
 	})
+
+	t.Run("ExpandOrder", func(t *testing.T) {
+		test := NewRouteTest(t)
+		url := "/users/" + test.Data.testUser.ID + "/payments?expand=order"
+		token := testToken(test.Data.testUser.ID, "")
+		recorder := test.TestEndpoint(http.MethodGet, url, nil, token)
+
+		actual := []expandedTransaction{}
+		extractPayload(t, http.StatusOK, recorder, &actual)
+		require.Len(t, actual, 2)
+		for _, trans := range actual {
+			require.NotNil(t, trans.Order)
+			assert.Equal(t, trans.OrderID, trans.Order.ID)
+			if trans.ID == test.Data.firstTransaction.ID {
+				assert.Equal(t, test.Data.firstOrder.Total, trans.Order.Total)
+				assert.Equal(t, models.PaidState, trans.Order.PaymentState)
+				require.Len(t, trans.Order.LineItems, 1)
+				assert.Equal(t, "123-i-can-fly-456", trans.Order.LineItems[0].Sku)
+				assert.EqualValues(t, 2, trans.Order.LineItems[0].Quantity)
+			}
+		}
+	})
+
+	t.Run("ExpandUnknown", func(t *testing.T) {
+		test := NewRouteTest(t)
+		url := "/users/" + test.Data.testUser.ID + "/payments?expand=user"
+		token := testToken(test.Data.testUser.ID, "")
+		recorder := test.TestEndpoint(http.MethodGet, url, nil, token)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
 }
 
 // ------------------------------------------------------------------------------------------------
@@ -189,10 +223,28 @@ func TestPaymentsRefund(t *testing.T) {
 		url := "/payments/" + test.Data.firstTransaction.ID + "/refund"
 		w := runPaymentRefund(test, url, &PaymentParams{
 			Amount:   1,
-			Currency: "monopoly-money",
+			Currency: "EUR",
 		})
 		validateError(t, http.StatusBadRequest, w, "Currencies do not match")
 	})
+	t.Run("UnknownCurrency", func(t *testing.T) {
+		test := NewRouteTest(t)
+		url := "/payments/" + test.Data.firstTransaction.ID + "/refund"
+		w := runPaymentRefund(test, url, &PaymentParams{
+			Amount:   1,
+			Currency: "monopoly-money",
+		})
+		validateError(t, http.StatusBadRequest, w, "Unknown currency")
+	})
+	t.Run("LowercaseCurrency", func(t *testing.T) {
+		test := NewRouteTest(t)
+		url := "/payments/" + test.Data.firstTransaction.ID + "/refund"
+		w := runPaymentRefund(test, url, &PaymentParams{
+			Amount:   1000,
+			Currency: "usd",
+		})
+		validateError(t, http.StatusBadRequest, w, "must be between 0 and the total amount")
+	})
 	t.Run("AmountTooHighOrLow", func(t *testing.T) {
 		test := NewRouteTest(t)
 		url := "/payments/" + test.Data.firstTransaction.ID + "/refund"
@@ -273,6 +325,117 @@ func TestPaymentsRefund(t *testing.T) {
 		}
 	})
 
+	t.Run("RunningTotal", func(t *testing.T) {
+		test := NewRouteTest(t)
+		provider := &memProvider{name: payments.StripeProvider}
+		params := &PaymentParams{Amount: 60, Currency: "USD"}
+
+		refund := &models.Transaction{}
+		extractPayload(t, http.StatusOK, runProviderRefund(test, provider, test.Data.firstTransaction.ID, params), refund)
+		assert.Equal(t, test.Data.firstTransaction.ID, refund.ChargeID)
+
+		recorder := runProviderRefund(test, provider, test.Data.firstTransaction.ID, params)
+		validateError(t, http.StatusBadRequest, recorder, "40 USD of the charge")
+		assert.Len(t, provider.refundCalls, 1)
+
+		params.Amount = 40
+		extractPayload(t, http.StatusOK, runProviderRefund(test, provider, test.Data.firstTransaction.ID, params), refund)
+		assert.Len(t, provider.refundCalls, 2)
+	})
+
+	t.Run("Shipping", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.firstOrder.Shipping = 5
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+		provider := &memProvider{name: payments.StripeProvider}
+		w := runProviderRefund(test, provider, test.Data.firstTransaction.ID, &PaymentParams{
+			Currency:  "USD",
+			Component: models.ShippingRefundComponent,
+		})
+
+		rsp := new(models.Transaction)
+		extractPayload(t, http.StatusOK, w, rsp)
+		assert.EqualValues(t, 5, rsp.Amount)
+		assert.Equal(t, models.ShippingRefundComponent, rsp.RefundComponent)
+		assert.Zero(t, rsp.LineItemID)
+		require.Len(t, provider.refundCalls, 1)
+		assert.EqualValues(t, 5, provider.refundCalls[0].amount)
+
+		stored := &models.Transaction{ID: rsp.ID}
+		require.NoError(t, test.DB.First(stored).Error)
+		assert.Equal(t, models.ShippingRefundComponent, stored.RefundComponent)
+
+		w = runProviderRefund(test, provider, test.Data.firstTransaction.ID, &PaymentParams{
+			Currency:  "USD",
+			Component: models.ShippingRefundComponent,
+		})
+		validateError(t, http.StatusBadRequest, w, "already been refunded")
+	})
+
+	t.Run("LineItem", func(t *testing.T) {
+		test := NewRouteTest(t)
+		item := test.Data.firstOrder.LineItems[0]
+
+		provider := &memProvider{name: payments.StripeProvider}
+		w := runProviderRefund(test, provider, test.Data.firstTransaction.ID, &PaymentParams{
+			Currency:   "USD",
+			Component:  models.LineItemRefundComponent,
+			LineItemID: item.ID,
+		})
+
+		// the calculated total is the price of a single item
+		rsp := new(models.Transaction)
+		extractPayload(t, http.StatusOK, w, rsp)
+		assert.EqualValues(t, 24, rsp.Amount)
+		assert.Equal(t, models.LineItemRefundComponent, rsp.RefundComponent)
+		assert.Equal(t, item.ID, rsp.LineItemID)
+		require.Len(t, provider.refundCalls, 1)
+		assert.EqualValues(t, 24, provider.refundCalls[0].amount)
+	})
+
+	t.Run("LineItemWithTip", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.firstOrder.Tip = 6
+		test.Data.firstOrder.Total = 30
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+		item := test.Data.firstOrder.LineItems[0]
+
+		provider := &memProvider{name: payments.StripeProvider}
+		w := runProviderRefund(test, provider, test.Data.firstTransaction.ID, &PaymentParams{
+			Currency:   "USD",
+			Component:  models.LineItemRefundComponent,
+			LineItemID: item.ID,
+		})
+
+		// the item makes up the whole items total of 24, so it gets all of the tip
+		rsp := new(models.Transaction)
+		extractPayload(t, http.StatusOK, w, rsp)
+		assert.EqualValues(t, 24+6, rsp.Amount)
+	})
+
+	t.Run("NoShipping", func(t *testing.T) {
+		test := NewRouteTest(t)
+		provider := &memProvider{name: payments.StripeProvider}
+		w := runProviderRefund(test, provider, test.Data.firstTransaction.ID, &PaymentParams{
+			Currency:  "USD",
+			Component: models.ShippingRefundComponent,
+		})
+		validateError(t, http.StatusBadRequest, w, "nothing to refund")
+		assert.Empty(t, provider.refundCalls)
+	})
+
+	t.Run("UnknownLineItem", func(t *testing.T) {
+		test := NewRouteTest(t)
+		provider := &memProvider{name: payments.StripeProvider}
+		w := runProviderRefund(test, provider, test.Data.firstTransaction.ID, &PaymentParams{
+			Currency:   "USD",
+			Component:  models.LineItemRefundComponent,
+			LineItemID: 12345,
+		})
+		validateError(t, http.StatusNotFound, w)
+	})
+
 	t.Run("PayPal", func(t *testing.T) {
 		test := NewRouteTest(t)
 		var loginCount, refundCount int
@@ -327,9 +490,51 @@ func runPaymentRefund(test *RouteTest, url string, params interface{}) *httptest
 	return test.TestEndpoint(http.MethodPost, url, bytes.NewBuffer(body), token)
 }
 
+func runProviderRefund(test *RouteTest, provider payments.Provider, paymentID string, params interface{}) *httptest.ResponseRecorder {
+	body, err := json.Marshal(params)
+	require.NoError(test.T, err)
+	return testEndpointWithProvider(test, provider, http.MethodPost, "/payments/"+paymentID+"/refund", bytes.NewBuffer(body), testAdminToken("magical-unicorn", ""))
+}
+
+func testEndpointWithProvider(test *RouteTest, provider payments.Provider, method, url string, body io.Reader, token *jwt.Token) *httptest.ResponseRecorder {
+	ctx, err := WithInstanceConfig(context.Background(), test.GlobalConfig.SMTP, test.Config, "")
+	require.NoError(test.T, err)
+	ctx = gcontext.WithPaymentProviders(ctx, map[string]payments.Provider{provider.Name(): provider})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, url, body)
+	require.NoError(test.T, signHTTPRequest(r, token, test.Config.JWT.Secret))
+	NewAPIWithVersion(ctx, test.GlobalConfig, logrus.StandardLogger(), test.DB, defaultVersion).handler.ServeHTTP(w, r)
+	return w
+}
+
 var stripePaymentIntentID = fmt.Sprintf("payment-intent-%d", rand.Int())
 
 func TestPaymentCreate(t *testing.T) {
+	t.Run("ShippingNotInTotal", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.firstOrder.PaymentState = models.PendingState
+		test.Data.firstOrder.Shipping = 500
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+		provider := &memProvider{name: payments.StripeProvider}
+		body := strings.NewReader(`{"provider": "stripe", "amount": 24, "currency": "USD"}`)
+		recorder := testEndpointWithProvider(test, provider, http.MethodPost, "/orders/first-order/payments", body, test.Data.testUserToken)
+		validateError(t, http.StatusInternalServerError, recorder, "shipping")
+	})
+
+	t.Run("OutdatedTotal", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.firstOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+		require.NoError(t, test.DB.Model(test.Data.firstLineItem).UpdateColumn("price", 20).Error)
+
+		provider := &memProvider{name: payments.StripeProvider}
+		body := strings.NewReader(`{"provider": "stripe", "amount": 24, "currency": "USD"}`)
+		recorder := testEndpointWithProvider(test, provider, http.MethodPost, "/orders/first-order/payments", body, test.Data.testUserToken)
+		validateError(t, http.StatusConflict, recorder, "should be 40 instead of 24")
+	})
+
 	t.Run("PayPal", func(t *testing.T) {
 		t.Run("Simple", func(t *testing.T) {
 			test := NewRouteTest(t)
@@ -516,19 +721,653 @@ func TestPaymentCreate(t *testing.T) {
 				})
 			}
 		})
+
+		t.Run("SettlementCurrency", func(t *testing.T) {
+			test := NewRouteTest(t)
+			callCount := 0
+			stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+				switch path {
+				case "/v1/payment_intents":
+					intentParams, ok := params.(*stripe.PaymentIntentParams)
+					require.True(t, ok, "unknown params object: %T", params)
+					assert.Equal(t, int64(30), *intentParams.Amount)
+					assert.Equal(t, "USD", *intentParams.Currency)
+
+					intent := v.(*stripe.PaymentIntent)
+					intent.ID = stripePaymentIntentID
+					intent.Status = stripe.PaymentIntentStatusSucceeded
+					callCount++
+					return nil
+				default:
+					t.Fatalf("unknown Stripe API call to %s", path)
+					return &stripe.Error{Code: stripe.ErrorCodeURLInvalid}
+				}
+			}))
+			defer stripe.SetBackend(stripe.APIBackend, nil)
+
+			test.Data.firstOrder.PaymentState = models.PendingState
+			test.Data.firstOrder.Currency = "EUR"
+			test.Data.firstOrder.SetSettlement("USD", 1.25)
+			rsp := test.DB.Save(test.Data.firstOrder)
+			require.NoError(t, rsp.Error, "Failed to update order")
+
+			params := &stripePaymentParams{
+				Amount:                test.Data.firstOrder.Total,
+				Currency:              "EUR",
+				StripePaymentMethodID: "payment-method-simple",
+				Provider:              payments.StripeProvider,
+			}
+			body, err := json.Marshal(params)
+			require.NoError(t, err)
+
+			recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+
+			trans := models.Transaction{}
+			extractPayload(t, http.StatusOK, recorder, &trans)
+			assert.Equal(t, 1, callCount)
+			assert.Equal(t, uint64(30), trans.Amount)
+			assert.Equal(t, "USD", trans.Currency)
+
+			order := &models.Order{}
+			require.NoError(t, test.DB.Find(order, "id = ?", trans.OrderID).Error)
+			assert.Equal(t, uint64(24), order.Total)
+			assert.Equal(t, "EUR", order.Currency)
+			assert.Equal(t, uint64(30), order.SettlementTotal)
+			assert.Equal(t, "USD", order.SettlementCurrency)
+			assert.Equal(t, 1.25, order.ExchangeRate)
+		})
+
+		t.Run("SettlementCurrencyExponent", func(t *testing.T) {
+			test := NewRouteTest(t)
+			stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+				switch path {
+				case "/v1/payment_intents":
+					intentParams, ok := params.(*stripe.PaymentIntentParams)
+					require.True(t, ok, "unknown params object: %T", params)
+					assert.Equal(t, int64(18), *intentParams.Amount)
+					assert.Equal(t, "USD", *intentParams.Currency)
+
+					intent := v.(*stripe.PaymentIntent)
+					intent.ID = stripePaymentIntentID
+					intent.Status = stripe.PaymentIntentStatusSucceeded
+					return nil
+				default:
+					t.Fatalf("unknown Stripe API call to %s", path)
+					return &stripe.Error{Code: stripe.ErrorCodeURLInvalid}
+				}
+			}))
+			defer stripe.SetBackend(stripe.APIBackend, nil)
+
+			// 24 JPY at 0.0075 USD per yen is 0.18 USD, or 18 cents
+			test.Data.firstOrder.PaymentState = models.PendingState
+			test.Data.firstOrder.Currency = "JPY"
+			test.Data.firstOrder.SetSettlement("USD", 0.0075)
+			rsp := test.DB.Save(test.Data.firstOrder)
+			require.NoError(t, rsp.Error, "Failed to update order")
+
+			params := &stripePaymentParams{
+				Amount:                test.Data.firstOrder.Total,
+				Currency:              "JPY",
+				StripePaymentMethodID: "payment-method-simple",
+				Provider:              payments.StripeProvider,
+			}
+			body, err := json.Marshal(params)
+			require.NoError(t, err)
+
+			recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+
+			trans := models.Transaction{}
+			extractPayload(t, http.StatusOK, recorder, &trans)
+			assert.Equal(t, uint64(18), trans.Amount)
+			assert.Equal(t, "USD", trans.Currency)
+
+			order := &models.Order{}
+			require.NoError(t, test.DB.Find(order, "id = ?", trans.OrderID).Error)
+			assert.Equal(t, uint64(18), order.SettlementTotal)
+		})
+	})
+}
+
+func TestPaymentCreateRetries(t *testing.T) {
+	body := `{"provider": "stripe", "amount": 24, "currency": "USD", "stripe_payment_method_id": "pm_card"}`
+	setup := func(t *testing.T, secretKey string, fn func(call int) error) (*RouteTest, *[]string) {
+		test := NewRouteTest(t)
+		test.Config.Payment.Stripe.SecretKey = secretKey
+		test.Config.Payment.Stripe.RetryBackoff = 1
+		test.Data.firstOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+		keys := []string{}
+		stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+			keys = append(keys, *params.GetParams().IdempotencyKey)
+			if err := fn(len(keys)); err != nil {
+				return err
+			}
+			intent := v.(*stripe.PaymentIntent)
+			intent.ID = stripePaymentIntentID
+			intent.Status = stripe.PaymentIntentStatusSucceeded
+			return nil
+		}))
+		return test, &keys
+	}
+	defer stripe.SetBackend(stripe.APIBackend, nil)
+
+	t.Run("Transient", func(t *testing.T) {
+		test, keys := setup(t, "secret_transient", func(call int) error {
+			if call == 1 {
+				return &stripe.Error{Type: stripe.ErrorTypeAPI, HTTPStatusCode: http.StatusBadGateway}
+			}
+			return nil
+		})
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", strings.NewReader(body), test.Data.testUserToken)
+		extractPayload(t, http.StatusOK, recorder, &models.Transaction{})
+		require.Len(t, *keys, 2)
+		assert.Equal(t, (*keys)[0], (*keys)[1])
+	})
+
+	t.Run("Declined", func(t *testing.T) {
+		test, keys := setup(t, "secret_declined", func(call int) error {
+			return &stripe.Error{Type: stripe.ErrorTypeCard, Code: stripe.ErrorCodeCardDeclined, HTTPStatusCode: http.StatusPaymentRequired}
+		})
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", strings.NewReader(body), test.Data.testUserToken)
+		validateError(t, http.StatusInternalServerError, recorder)
+		assert.Len(t, *keys, 1)
+	})
+
+	t.Run("CircuitBreaker", func(t *testing.T) {
+		test, keys := setup(t, "secret_breaker", func(call int) error {
+			return &stripe.Error{Type: stripe.ErrorTypeAPI, HTTPStatusCode: http.StatusInternalServerError}
+		})
+		test.Config.Payment.Stripe.BreakerThreshold = 1
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", strings.NewReader(body), test.Data.testUserToken)
+		validateError(t, http.StatusServiceUnavailable, recorder)
+		assert.Len(t, *keys, 3)
+
+		recorder = test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", strings.NewReader(body), test.Data.testUserToken)
+		validateError(t, http.StatusServiceUnavailable, recorder)
+		assert.Len(t, *keys, 3)
+	})
+}
+
+func TestPaymentCreateProcessorCurrency(t *testing.T) {
+	calls := 0
+	stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+		calls++
+		intent := v.(*stripe.PaymentIntent)
+		intent.ID = stripePaymentIntentID
+		intent.Status = stripe.PaymentIntentStatusSucceeded
+		return nil
+	}))
+	defer stripe.SetBackend(stripe.APIBackend, nil)
+
+	test := NewRouteTest(t)
+	test.Config.Payment.Stripe.Currencies = []string{"eur", "GBP"}
+	test.Data.firstOrder.PaymentState = models.PendingState
+	require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+	body := `{"provider": "stripe", "amount": 24, "currency": "USD", "stripe_payment_method_id": "pm_card"}`
+	recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", strings.NewReader(body), test.Data.testUserToken)
+	validateError(t, http.StatusBadRequest, recorder, "Payments in USD can't be made with stripe")
+	assert.Zero(t, calls)
+
+	test.Config.Payment.Stripe.Currencies = append(test.Config.Payment.Stripe.Currencies, "usd")
+	recorder = test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", strings.NewReader(body), test.Data.testUserToken)
+	extractPayload(t, http.StatusOK, recorder, &models.Transaction{})
+	assert.Equal(t, 1, calls)
+}
+
+func TestPaymentAuthorizeAndCapture(t *testing.T) {
+	body := `{"provider": "stripe", "amount": 24, "currency": "USD", "stripe_payment_method_id": "pm_card", "capture": false}`
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+	authorize := func(t *testing.T, test *RouteTest) *models.Transaction {
+		test.Data.firstOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", strings.NewReader(body), test.Data.testUserToken)
+		tr := &models.Transaction{}
+		extractPayload(t, http.StatusOK, recorder, tr)
+		return tr
+	}
+
+	var captured int64
+	var finalCapture bool
+	stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+		intent := v.(*stripe.PaymentIntent)
+		intent.ID = stripePaymentIntentID
+		switch p := params.(type) {
+		case *stripe.PaymentIntentParams:
+			require.NotNil(t, p.CaptureMethod)
+			assert.Equal(t, "manual", *p.CaptureMethod)
+			intent.Status = stripe.PaymentIntentStatusRequiresCapture
+		case *stripe.PaymentIntentCaptureParams:
+			captured = *p.AmountToCapture
+			finalCapture = p.Extra == nil || p.Extra.Get("final_capture") != "false"
+			intent.Status = stripe.PaymentIntentStatusSucceeded
+			if !finalCapture {
+				intent.Status = stripe.PaymentIntentStatusRequiresCapture
+			}
+		}
+		return nil
+	}))
+	defer stripe.SetBackend(stripe.APIBackend, nil)
+
+	t.Run("Capture", func(t *testing.T) {
+		test := NewRouteTest(t)
+		tr := authorize(t, test)
+		assert.Equal(t, models.AuthorizedState, tr.Status)
+		require.NotNil(t, tr.AuthorizationExpiresAt)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", "first-order").Error)
+		assert.Equal(t, models.AuthorizedState, order.PaymentState)
+
+		url := "/orders/first-order/payments/" + tr.ID + "/capture"
+		recorder := test.TestEndpoint(http.MethodPost, url, strings.NewReader(`{"amount": 1000}`), token)
+		validateError(t, http.StatusBadRequest, recorder, "authorized amount")
+
+		recorder = test.TestEndpoint(http.MethodPost, url, strings.NewReader(`{"amount": 20}`), test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+
+		recorder = test.TestEndpoint(http.MethodPost, url, strings.NewReader(`{"amount": 20}`), token)
+		tr = &models.Transaction{}
+		extractPayload(t, http.StatusOK, recorder, tr)
+		assert.Equal(t, models.PaidState, tr.Status)
+		assert.EqualValues(t, 20, tr.Amount)
+		assert.EqualValues(t, 20, captured)
+
+		require.NoError(t, test.DB.First(order, "id = ?", "first-order").Error)
+		assert.Equal(t, models.PaidState, order.PaymentState)
+
+		recorder = test.TestEndpoint(http.MethodPost, url, nil, token)
+		validateError(t, http.StatusBadRequest, recorder, "Only authorized payments")
+	})
+
+	t.Run("PartialCapture", func(t *testing.T) {
+		test := NewRouteTest(t)
+		authorization := authorize(t, test)
+		assert.EqualValues(t, 24, authorization.AuthorizedAmount)
+		url := "/orders/first-order/payments/" + authorization.ID + "/capture"
+
+		recorder := test.TestEndpoint(http.MethodPost, url, strings.NewReader(`{"amount": 10, "final": false}`), token)
+		first := &models.Transaction{}
+		extractPayload(t, http.StatusOK, recorder, first)
+		assert.NotEqual(t, authorization.ID, first.ID)
+		assert.Equal(t, authorization.ID, first.AuthorizationID)
+		assert.Equal(t, models.PaidState, first.Status)
+		assert.EqualValues(t, 10, first.Amount)
+		assert.EqualValues(t, 10, captured)
+		assert.False(t, finalCapture)
+
+		order := &models.Order{}
+		require.NoError(t, orderQuery(test.DB).First(order, "id = ?", "first-order").Error)
+		assert.Equal(t, models.PartiallyCapturedState, order.PaymentState)
+		assert.EqualValues(t, 10, order.CapturedAmount(authorization))
+
+		recorder = test.TestEndpoint(http.MethodPost, url, strings.NewReader(`{"amount": 15, "final": false}`), token)
+		validateError(t, http.StatusBadRequest, recorder, "remaining authorized amount of 14")
+
+		recorder = test.TestEndpoint(http.MethodPost, url, strings.NewReader(`{"amount": 4, "final": false}`), token)
+		extractPayload(t, http.StatusOK, recorder, &models.Transaction{})
+
+		// the final capture takes what's left by default
+		recorder = test.TestEndpoint(http.MethodPost, url, nil, token)
+		last := &models.Transaction{}
+		extractPayload(t, http.StatusOK, recorder, last)
+		assert.Equal(t, authorization.ID, last.ID)
+		assert.Equal(t, models.PaidState, last.Status)
+		assert.EqualValues(t, 10, last.Amount)
+		assert.EqualValues(t, 24, last.AuthorizedAmount)
+		assert.EqualValues(t, 10, captured)
+		assert.True(t, finalCapture)
+
+		order = &models.Order{}
+		require.NoError(t, orderQuery(test.DB).First(order, "id = ?", "first-order").Error)
+		assert.Equal(t, models.PaidState, order.PaymentState)
+		var total uint64
+		for _, tr := range order.Transactions {
+			if tr.Type == models.ChargeTransactionType && tr.Status == models.PaidState && (tr.ID == authorization.ID || tr.AuthorizationID == authorization.ID) {
+				total += tr.Amount
+			}
+		}
+		assert.EqualValues(t, 24, total)
+
+		recorder = test.TestEndpoint(http.MethodPost, url, strings.NewReader(`{"amount": 1, "final": false}`), token)
+		validateError(t, http.StatusBadRequest, recorder, "Only authorized payments")
+	})
+
+	t.Run("PartialCaptureUnsupported", func(t *testing.T) {
+		test := NewRouteTest(t)
+		authorizeFirstOrder(t, test)
+		provider := &memProvider{name: payments.StripeProvider}
+		url := "/orders/first-order/payments/" + test.Data.firstTransaction.ID + "/capture"
+
+		recorder := testEndpointWithProvider(test, provider, http.MethodPost, url, strings.NewReader(`{"amount": 1, "final": false}`), token)
+		validateError(t, http.StatusBadRequest, recorder, "can't capture payments in parts")
+		assert.Empty(t, provider.captureCalls)
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		test := NewRouteTest(t)
+		tr := authorize(t, test)
+		expired := time.Now().Add(-time.Hour)
+		tr.AuthorizationExpiresAt = &expired
+		require.NoError(t, test.DB.Model(tr).UpdateColumn("authorization_expires_at", expired).Error)
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments/"+tr.ID+"/capture", nil, token)
+		validateError(t, http.StatusBadRequest, recorder, "expired")
+	})
+}
+
+func TestPaymentMarketplaceSplits(t *testing.T) {
+	body := `{"provider": "stripe", "amount": 34, "currency": "USD", "stripe_payment_method_id": "pm_card"}`
+	setup := func(t *testing.T, sellers ...string) *RouteTest {
+		test := NewRouteTest(t)
+		test.Config.Payment.Stripe.Connect.Accounts = map[string]string{"acme": "acct_acme", "wayne": "acct_wayne"}
+		test.Config.Payment.Stripe.Connect.ApplicationFee = 10
+		test.Data.firstOrder.PaymentState = models.PendingState
+		test.Data.firstOrder.SubTotal = 34
+		test.Data.firstOrder.NetTotal = 34
+		test.Data.firstOrder.Total = 34
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+		require.NoError(t, test.DB.Model(test.Data.firstLineItem).UpdateColumn("seller", sellers[0]).Error)
+		item := &models.LineItem{OrderID: "first-order", Title: "batarang", Sku: "batarang", Price: 10, Quantity: 1, Seller: sellers[1]}
+		require.NoError(t, test.DB.Create(item).Error)
+		return test
+	}
+
+	var intentParams *stripe.PaymentIntentParams
+	transfers := []*stripe.TransferParams{}
+	stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+		switch p := params.(type) {
+		case *stripe.PaymentIntentParams:
+			intentParams = p
+			intent := v.(*stripe.PaymentIntent)
+			intent.ID = stripePaymentIntentID
+			intent.Status = stripe.PaymentIntentStatusSucceeded
+			intent.Amount = *p.Amount
+			intent.AmountReceived = *p.Amount
+			intent.Currency = *p.Currency
+			intent.Metadata = p.Metadata
+			if p.TransferGroup != nil {
+				intent.TransferGroup = *p.TransferGroup
+			}
+			intent.Charges = &stripe.ChargeList{Data: []*stripe.Charge{{ID: "ch_batwing"}}}
+		case *stripe.TransferParams:
+			transfers = append(transfers, p)
+		}
+		return nil
+	}))
+	defer stripe.SetBackend(stripe.APIBackend, nil)
+
+	t.Run("SingleSeller", func(t *testing.T) {
+		transfers = transfers[:0]
+		test := setup(t, "acme", "acme")
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", strings.NewReader(body), test.Data.testUserToken)
+		extractPayload(t, http.StatusOK, recorder, &models.Transaction{})
+
+		require.NotNil(t, intentParams.TransferData)
+		assert.Equal(t, "acct_acme", *intentParams.TransferData.Destination)
+		assert.EqualValues(t, 3, *intentParams.ApplicationFeeAmount)
+		assert.Empty(t, transfers)
+	})
+
+	t.Run("SeveralSellers", func(t *testing.T) {
+		transfers = transfers[:0]
+		test := setup(t, "acme", "wayne")
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", strings.NewReader(body), test.Data.testUserToken)
+		extractPayload(t, http.StatusOK, recorder, &models.Transaction{})
+
+		assert.Nil(t, intentParams.TransferData)
+		assert.Equal(t, "first-order", *intentParams.TransferGroup)
+		require.Len(t, transfers, 2)
+		amounts := map[string]int64{}
+		for _, transfer := range transfers {
+			assert.Equal(t, "ch_batwing", *transfer.SourceTransaction)
+			assert.Equal(t, "first-order", *transfer.TransferGroup)
+			assert.Contains(t, *transfer.IdempotencyKey, "ch_batwing")
+			amounts[*transfer.Destination] = *transfer.Amount
+		}
+		assert.Equal(t, map[string]int64{"acct_acme": 22, "acct_wayne": 9}, amounts)
+	})
+
+	t.Run("UnknownSeller", func(t *testing.T) {
+		test := setup(t, "acme", "joker")
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", strings.NewReader(body), test.Data.testUserToken)
+		validateError(t, http.StatusInternalServerError, recorder)
+	})
+}
+
+func TestPaymentMarketplaceRefund(t *testing.T) {
+	var intent *stripe.PaymentIntent
+	var refundParams *stripe.RefundParams
+	reversals := []*stripe.ReversalParams{}
+	stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+		switch {
+		case strings.HasPrefix(path, "/v1/payment_intents/"):
+			*v.(*stripe.PaymentIntent) = *intent
+		case path == "/v1/refunds":
+			refundParams = params.(*stripe.RefundParams)
+			v.(*stripe.Refund).ID = "re_batwing"
+		case path == "/v1/transfers":
+			v.(*stripe.TransferList).Data = []*stripe.Transfer{
+				{ID: "tr_acme", Amount: 22, SourceTransaction: &stripe.BalanceTransactionSource{ID: "ch_batwing"}},
+				{ID: "tr_wayne", Amount: 9, AmountReversed: 5, SourceTransaction: &stripe.BalanceTransactionSource{ID: "ch_batwing"}},
+				{ID: "tr_other", Amount: 50, SourceTransaction: &stripe.BalanceTransactionSource{ID: "ch_other"}},
+			}
+		case strings.HasSuffix(path, "/reversals"):
+			reversals = append(reversals, params.(*stripe.ReversalParams))
+		}
+		return nil
+	}))
+	defer stripe.SetBackend(stripe.APIBackend, nil)
+
+	refund := func(t *testing.T, amount uint64) {
+		refundParams = nil
+		reversals = reversals[:0]
+		test := NewRouteTest(t)
+		recorder := runPaymentRefund(test, "/payments/"+test.Data.firstTransaction.ID+"/refund", &PaymentParams{Amount: amount, Currency: "USD"})
+		extractPayload(t, http.StatusOK, recorder, &models.Transaction{})
+		require.NotNil(t, refundParams)
+	}
+
+	t.Run("SingleSeller", func(t *testing.T) {
+		intent = &stripe.PaymentIntent{
+			ID:             stripePaymentIntentID,
+			AmountReceived: 34,
+			TransferData:   &stripe.PaymentIntentTransferData{Destination: &stripe.Account{ID: "acct_acme"}},
+		}
+		refund(t, 17)
+
+		require.NotNil(t, refundParams.ReverseTransfer)
+		assert.True(t, *refundParams.ReverseTransfer)
+		require.NotNil(t, refundParams.RefundApplicationFee)
+		assert.True(t, *refundParams.RefundApplicationFee)
+		assert.Empty(t, reversals)
+	})
+
+	t.Run("SeveralSellers", func(t *testing.T) {
+		intent = &stripe.PaymentIntent{
+			ID:             stripePaymentIntentID,
+			AmountReceived: 34,
+			TransferGroup:  "first-order",
+			Charges:        &stripe.ChargeList{Data: []*stripe.Charge{{ID: "ch_batwing"}}},
+		}
+		refund(t, 17)
+
+		assert.Nil(t, refundParams.ReverseTransfer)
+		amounts := map[string]int64{}
+		for _, reversal := range reversals {
+			amounts[*reversal.Transfer] = *reversal.Amount
+		}
+		assert.Equal(t, map[string]int64{"tr_acme": 11, "tr_wayne": 4}, amounts)
+	})
+
+	t.Run("NoSellers", func(t *testing.T) {
+		intent = &stripe.PaymentIntent{ID: stripePaymentIntentID, AmountReceived: 34}
+		refund(t, 17)
+
+		assert.Nil(t, refundParams.ReverseTransfer)
+		assert.Nil(t, refundParams.RefundApplicationFee)
+		assert.Empty(t, reversals)
+	})
+}
+
+func TestPaymentFraudCheck(t *testing.T) {
+	body := `{"provider": "stripe", "amount": 24, "currency": "USD", "stripe_payment_method_id": "pm_card"}`
+	charges := 0
+	stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+		charges++
+		intent := v.(*stripe.PaymentIntent)
+		intent.ID = stripePaymentIntentID
+		intent.Status = stripe.PaymentIntentStatusSucceeded
+		return nil
+	}))
+	defer stripe.SetBackend(stripe.APIBackend, nil)
+
+	score := 0.0
+	events := []map[string]interface{}{}
+	sift := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := map[string]interface{}{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&event))
+		events = append(events, event)
+		if score < 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, `{"status": 0, "score_response": {"scores": {"payment_abuse": {"score": %v, "reasons": [{"name": "Velocity"}]}}}}`, score)
+	}))
+	defer sift.Close()
+
+	setup := func(t *testing.T, riskScore float64) *RouteTest {
+		score = riskScore
+		charges = 0
+		events = events[:0]
+		test := NewRouteTest(t)
+		test.Config.Fraud.Provider = "sift"
+		test.Config.Fraud.APIKey = "sift-key"
+		test.Config.Fraud.APIURL = sift.URL
+		test.Config.Fraud.ReviewScore = 0.6
+		test.Config.Fraud.BlockScore = 0.9
+		test.Data.firstOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+		return test
+	}
+	pay := func(test *RouteTest) *httptest.ResponseRecorder {
+		headers := map[string]string{"User-Agent": "Batcomputer/1.0"}
+		return test.TestEndpointWithHeaders(http.MethodPost, "/orders/first-order/payments", strings.NewReader(body), test.Data.testUserToken, headers)
+	}
+	firstOrder := func(t *testing.T, test *RouteTest) *models.Order {
+		order := &models.Order{}
+		require.NoError(t, orderQuery(test.DB).First(order, "id = ?", "first-order").Error)
+		return order
+	}
+
+	t.Run("Allow", func(t *testing.T) {
+		test := setup(t, 0.2)
+		tr := &models.Transaction{}
+		extractPayload(t, http.StatusOK, pay(test), tr)
+		assert.Equal(t, models.PaidState, tr.Status)
+		require.NotNil(t, tr.RiskScore)
+		assert.Equal(t, 0.2, *tr.RiskScore)
+		assert.Equal(t, "Velocity", tr.RiskReason)
+		assert.Equal(t, 1, charges)
+
+		require.Len(t, events, 1)
+		assert.Equal(t, "$create_order", events[0]["$type"])
+		assert.Equal(t, "sift-key", events[0]["$api_key"])
+		assert.Equal(t, "first-order", events[0]["$order_id"])
+		assert.EqualValues(t, 240000, events[0]["$amount"])
+		assert.Equal(t, "USD", events[0]["$currency_code"])
+		assert.Equal(t, map[string]interface{}{"$user_agent": "Batcomputer/1.0"}, events[0]["$browser"])
+	})
+
+	t.Run("Block", func(t *testing.T) {
+		test := setup(t, 0.95)
+		recorder := pay(test)
+		validateError(t, http.StatusPaymentRequired, recorder, "declined")
+		assert.Zero(t, charges)
+
+		order := firstOrder(t, test)
+		assert.Equal(t, models.PendingState, order.PaymentState)
+		failed := 0
+		for _, tr := range order.Transactions {
+			if tr.Status == models.FailedState {
+				failed++
+				assert.Equal(t, 0.95, *tr.RiskScore)
+			}
+		}
+		assert.Equal(t, 1, failed)
+	})
+
+	t.Run("Review", func(t *testing.T) {
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+		t.Run("Approve", func(t *testing.T) {
+			test := setup(t, 0.7)
+			tr := &models.Transaction{}
+			extractPayload(t, http.StatusOK, pay(test), tr)
+			assert.Equal(t, models.ReviewState, tr.Status)
+			assert.Zero(t, charges)
+			assert.Equal(t, models.ReviewState, firstOrder(t, test).PaymentState)
+
+			validateError(t, http.StatusBadRequest, pay(test), "review")
+
+			recorder := runOrderUpdate(test, test.Data.firstOrder, &orderRequestParams{PaymentState: models.PendingState}, token)
+			order := &models.Order{}
+			extractPayload(t, http.StatusOK, recorder, order)
+			assert.Equal(t, models.PendingState, order.PaymentState)
+			assert.True(t, order.RiskApproved)
+			reviewed := &models.Transaction{}
+			require.NoError(t, test.DB.First(reviewed, "id = ?", tr.ID).Error)
+			assert.Equal(t, models.FailedState, reviewed.Status)
+
+			tr = &models.Transaction{}
+			extractPayload(t, http.StatusOK, pay(test), tr)
+			assert.Equal(t, models.PaidState, tr.Status)
+			assert.Nil(t, tr.RiskScore)
+			assert.Equal(t, 1, charges)
+			assert.Len(t, events, 1)
+		})
+
+		t.Run("Decline", func(t *testing.T) {
+			test := setup(t, 0.7)
+			extractPayload(t, http.StatusOK, pay(test), &models.Transaction{})
+
+			recorder := runOrderUpdate(test, test.Data.firstOrder, &orderRequestParams{PaymentState: models.FailedState}, token)
+			order := &models.Order{}
+			extractPayload(t, http.StatusOK, recorder, order)
+			assert.Equal(t, models.FailedState, order.PaymentState)
+			assert.False(t, order.RiskApproved)
+
+			recorder = runOrderUpdate(test, test.Data.firstOrder, &orderRequestParams{PaymentState: models.PendingState}, token)
+			validateError(t, http.StatusBadRequest, recorder)
+		})
+	})
+
+	t.Run("Unavailable", func(t *testing.T) {
+		test := setup(t, -1)
+		tr := &models.Transaction{}
+		extractPayload(t, http.StatusOK, pay(test), tr)
+		assert.Equal(t, models.PaidState, tr.Status)
+		assert.Nil(t, tr.RiskScore)
+		assert.Equal(t, 1, charges)
 	})
 }
 
 func TestPaymentConfirm(t *testing.T) {
 	tests := map[string]struct {
 		Status           string
+		IntentStatus     stripe.PaymentIntentStatus
 		OK               bool
 		ExpectedStatus   int
+		ExpectedState    string
 		ExpectedAPICalls int
 	}{
-		"default":    {models.PendingState, true, http.StatusOK, 1},
-		"idempotent": {models.PaidState, true, http.StatusOK, 0},
-		"declined":   {models.PendingState, false, http.StatusBadRequest, 1},
+		"default":    {models.PendingState, stripe.PaymentIntentStatusSucceeded, true, http.StatusOK, models.PaidState, 1},
+		"authorized": {models.PendingState, stripe.PaymentIntentStatusRequiresCapture, true, http.StatusOK, models.AuthorizedState, 1},
+		"idempotent": {models.PaidState, stripe.PaymentIntentStatusSucceeded, true, http.StatusOK, models.PaidState, 0},
+		"declined":   {models.PendingState, stripe.PaymentIntentStatusSucceeded, false, http.StatusBadRequest, "", 1},
 	}
 
 	for name, testParams := range tests {
@@ -539,7 +1378,7 @@ func TestPaymentConfirm(t *testing.T) {
 				if path == fmt.Sprintf("/v1/payment_intents/%s/confirm", stripePaymentIntentID) {
 					if intent, ok := v.(*stripe.PaymentIntent); ok {
 						intent.ID = stripePaymentIntentID
-						intent.Status = stripe.PaymentIntentStatusSucceeded
+						intent.Status = testParams.IntentStatus
 					} else {
 						t.Errorf("unknown response receiver: %T", v)
 					}
@@ -568,7 +1407,11 @@ func TestPaymentConfirm(t *testing.T) {
 			trans := models.Transaction{}
 			extractPayload(t, testParams.ExpectedStatus, recorder, &trans)
 			if testParams.OK {
-				assert.Equal(t, models.PaidState, trans.Status)
+				assert.Equal(t, testParams.ExpectedState, trans.Status)
+
+				order := &models.Order{}
+				require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+				assert.Equal(t, testParams.ExpectedState, order.PaymentState)
 			}
 			assert.Equal(t, testParams.ExpectedAPICalls, callCount)
 		})
@@ -761,8 +1604,9 @@ type paypalPaymentCreateParams struct {
 }
 
 type memProvider struct {
-	refundCalls []refundCall
-	name        string
+	refundCalls  []refundCall
+	captureCalls []captureCall
+	name         string
 }
 
 type refundCall struct {
@@ -771,6 +1615,12 @@ type refundCall struct {
 	currency string
 }
 
+type captureCall struct {
+	amount   uint64
+	id       string
+	currency string
+}
+
 func (mp *memProvider) Name() string {
 	return mp.name
 }
@@ -786,8 +1636,11 @@ func (mp *memProvider) NewPreauthorizer(ctx context.Context, r *http.Request, lo
 func (mp *memProvider) NewConfirmer(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Confirmer, error) {
 	return mp.confirm, nil
 }
+func (mp *memProvider) NewCapturer(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Capturer, error) {
+	return mp.capture, nil
+}
 
-func (mp *memProvider) charge(amount uint64, currency string, order *models.Order, invoiceNumber int64) (string, error) {
+func (mp *memProvider) charge(amount uint64, currency string, order *models.Order, invoiceNumber int64, splits []payments.Split) (string, error) {
 	return "", errors.New("Shouldn't have called this")
 }
 
@@ -808,8 +1661,38 @@ func (mp *memProvider) preauthorize(amount uint64, currency string, description
 	return nil, nil
 }
 
-func (mp *memProvider) confirm(paymentID string) error {
-	return nil
+func (mp *memProvider) confirm(paymentID string) (string, error) {
+	return models.PaidState, nil
+}
+
+func (mp *memProvider) capture(transactionID string, amount uint64, currency string) (string, error) {
+	mp.captureCalls = append(mp.captureCalls, captureCall{
+		amount:   amount,
+		id:       transactionID,
+		currency: currency,
+	})
+	return transactionID, nil
+}
+
+// partialMemProvider is a memProvider that can capture payments in parts.
+type partialMemProvider struct {
+	*memProvider
+	partialCaptureCalls []captureCall
+	partialCaptureErr   error
+}
+
+func (mp *partialMemProvider) NewPartialCapturer(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Capturer, error) {
+	return func(transactionID string, amount uint64, currency string) (string, error) {
+		mp.partialCaptureCalls = append(mp.partialCaptureCalls, captureCall{
+			amount:   amount,
+			id:       transactionID,
+			currency: currency,
+		})
+		if mp.partialCaptureErr != nil {
+			return "", mp.partialCaptureErr
+		}
+		return transactionID, nil
+	}, nil
 }
 
 type stripeCallFunc func(method, path, key string, params stripe.ParamsContainer, v interface{}) error
@@ -831,7 +1714,152 @@ func (t trackingStripeBackend) CallMultipart(method, path, key, boundary string,
 }
 
 func (t trackingStripeBackend) CallRaw(method, path, key string, body *form.Values, params *stripe.Params, v interface{}) error {
-	return nil
+	return t.trackingFunc(method, path, key, nil, v)
 }
 
 func (t trackingStripeBackend) SetMaxNetworkRetries(maxNetworkRetries int) {}
+
+func TestPaymentList(t *testing.T) {
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+	listPayments := func(t *testing.T, test *RouteTest, query string) []models.Transaction {
+		recorder := test.TestEndpoint(http.MethodGet, "/payments"+query, nil, token)
+		trans := []models.Transaction{}
+		extractPayload(t, http.StatusOK, recorder, &trans)
+		return trans
+	}
+
+	t.Run("Processor", func(t *testing.T) {
+		test := NewRouteTest(t)
+		trans := listPayments(t, test, "?processor=paypal")
+		require.Len(t, trans, 1)
+		assert.Equal(t, test.Data.secondTransaction.ID, trans[0].ID)
+
+		trans = listPayments(t, test, "?processor=stripe,paypal")
+		assert.Len(t, trans, 2)
+	})
+
+	t.Run("AmountRange", func(t *testing.T) {
+		test := NewRouteTest(t)
+		trans := listPayments(t, test, "?min_amount=60&max_amount=150")
+		require.Len(t, trans, 1)
+		assert.Equal(t, test.Data.firstTransaction.ID, trans[0].ID)
+	})
+
+	t.Run("Sort", func(t *testing.T) {
+		test := NewRouteTest(t)
+		trans := listPayments(t, test, "?sort=amount&order=desc")
+		require.Len(t, trans, 2)
+		assert.Equal(t, test.Data.firstTransaction.ID, trans[0].ID)
+
+		trans = listPayments(t, test, "?sort=amount&order=asc")
+		require.Len(t, trans, 2)
+		assert.Equal(t, test.Data.secondTransaction.ID, trans[0].ID)
+	})
+
+	t.Run("InvalidSort", func(t *testing.T) {
+		test := NewRouteTest(t)
+		for _, query := range []string{"?sort=processor_id", "?sort=amount%3Bdrop%20table", "?sort=amount&order=sideways"} {
+			recorder := test.TestEndpoint(http.MethodGet, "/payments"+query, nil, token)
+			validateError(t, http.StatusBadRequest, recorder)
+		}
+	})
+}
+
+func TestPaymentExport(t *testing.T) {
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+	exportPayments := func(t *testing.T, test *RouteTest, query string) map[string][]string {
+		recorder := test.TestEndpoint(http.MethodGet, "/payments/export"+query, nil, token)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "text/csv", recorder.Header().Get("Content-Type"))
+		assert.Contains(t, recorder.Header().Get("Content-Disposition"), "attachment")
+
+		records, err := csv.NewReader(recorder.Body).ReadAll()
+		require.NoError(t, err)
+		require.NotEmpty(t, records)
+		assert.Equal(t, paymentExportHeader, records[0])
+		rows := map[string][]string{}
+		for _, record := range records[1:] {
+			rows[record[1]] = record
+		}
+		return rows
+	}
+
+	t.Run("WithRefund", func(t *testing.T) {
+		test := NewRouteTest(t)
+		refund := models.NewTransaction(test.Data.firstOrder)
+		refund.Type = models.RefundTransactionType
+		refund.Amount = 30
+		refund.Status = models.PaidState
+		require.NoError(t, test.DB.Create(refund).Error)
+
+		rows := exportPayments(t, test, "")
+		require.Len(t, rows, 2)
+		first := rows[test.Data.firstTransaction.ID]
+		require.NotNil(t, first)
+		assert.Equal(t, []string{test.Data.firstOrder.ID, "stripe", test.Data.firstTransaction.ProcessorID, "100", "30", "70", "USD", models.PaidState}, []string{first[2], first[5], first[6], first[7], first[8], first[9], first[10], first[11]})
+		second := rows[test.Data.secondTransaction.ID]
+		require.NotNil(t, second)
+		assert.Equal(t, "paypal", second[5])
+		assert.Equal(t, "0", second[8])
+	})
+
+	t.Run("RefundsPerCharge", func(t *testing.T) {
+		test := NewRouteTest(t)
+		second := models.NewTransaction(test.Data.firstOrder)
+		second.Amount = 50
+		second.Currency = "USD"
+		second.Status = models.PaidState
+		require.NoError(t, test.DB.Create(second).Error)
+		for chargeID, amount := range map[string]uint64{second.ID: 20, "": 5} {
+			refund := models.NewTransaction(test.Data.firstOrder)
+			refund.Type = models.RefundTransactionType
+			refund.Amount = amount
+			refund.Currency = "USD"
+			refund.Status = models.PaidState
+			refund.ChargeID = chargeID
+			require.NoError(t, test.DB.Create(refund).Error)
+		}
+
+		rows := exportPayments(t, test, "")
+		require.Len(t, rows, 3)
+		// the legacy refund counts against the first charge of the order
+		assert.Equal(t, []string{"100", "5", "95"}, rows[test.Data.firstTransaction.ID][7:10])
+		assert.Equal(t, []string{"50", "20", "30"}, rows[second.ID][7:10])
+	})
+
+	t.Run("RefundOutsidePeriod", func(t *testing.T) {
+		test := NewRouteTest(t)
+		refund := models.NewTransaction(test.Data.firstOrder)
+		refund.Type = models.RefundTransactionType
+		refund.Amount = 30
+		refund.Status = models.PaidState
+		refund.ChargeID = test.Data.firstTransaction.ID
+		require.NoError(t, test.DB.Create(refund).Error)
+		require.NoError(t, test.DB.Model(refund).UpdateColumn("created_at", time.Now().Add(48*time.Hour)).Error)
+
+		to := time.Now().Add(24 * time.Hour).Unix()
+		rows := exportPayments(t, test, fmt.Sprintf("?to=%d", to))
+		first := rows[test.Data.firstTransaction.ID]
+		require.NotNil(t, first)
+		assert.Equal(t, "0", first[8])
+	})
+
+	t.Run("TimeRange", func(t *testing.T) {
+		test := NewRouteTest(t)
+		future := time.Now().Add(time.Hour).Unix()
+		rows := exportPayments(t, test, fmt.Sprintf("?from=%d&format=csv", future))
+		assert.Empty(t, rows)
+	})
+
+	t.Run("UnknownFormat", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/payments/export?format=xlsx", nil, token)
+		validateError(t, http.StatusBadRequest, recorder, "only csv")
+	})
+
+	t.Run("NotAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/payments/export", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
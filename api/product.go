@@ -0,0 +1,134 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+const (
+	// productMaxAge is how long parsed product metadata is served from the
+	// cache before it's fetched from the site again
+	productMaxAge = time.Minute
+	// productCacheSize limits the number of cached products
+	productCacheSize = 1000
+)
+
+var productCache = struct {
+	sync.Mutex
+	products map[string]*cachedProduct
+}{products: make(map[string]*cachedProduct)}
+
+type cachedProduct struct {
+	meta      *models.LineItemMetadata
+	fetchedAt time.Time
+}
+
+// productView is the product metadata an order for the product is created
+// from. Download URLs and webhooks of products aren't included.
+type productView struct {
+	Path        string                 `json:"path"`
+	Sku         string                 `json:"sku"`
+	Title       string                 `json:"title"`
+	Description string                 `json:"description"`
+	Type        string                 `json:"type"`
+	VAT         uint64                 `json:"vat"`
+	Prices      []models.PriceMetadata `json:"prices"`
+	Addons      []models.AddonMetaItem `json:"addons"`
+	Weight      uint64                 `json:"weight,omitempty"`
+	Length      uint64                 `json:"length,omitempty"`
+	Width       uint64                 `json:"width,omitempty"`
+	Height      uint64                 `json:"height,omitempty"`
+	Seller      string                 `json:"seller,omitempty"`
+	Downloads   int                    `json:"downloads"`
+
+	// Price is what the caller is charged for the product in the currency
+	// asked for, before discounts and taxes
+	Price    *uint64 `json:"price,omitempty"`
+	Currency string  `json:"currency,omitempty"`
+}
+
+// ProductView fetches the metadata of the product at a path of the site, like
+// creating an order for it does, so clients can check what the backend sees.
+// Pages with several products are told apart with ?sku=, and ?currency= adds
+// the price the caller would pay. Products are cached for a minute.
+func (a *API) ProductView(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := gcontext.GetConfig(ctx)
+	path := "/" + strings.TrimPrefix(chi.URLParam(r, "*"), "/")
+	sku := r.URL.Query().Get("sku")
+	logEntrySetField(r, "product_path", path)
+
+	meta, err := fetchProduct(config.SiteURL, path, sku)
+	if err != nil {
+		return notFoundError("Product not found: %v", err)
+	}
+
+	view := &productView{
+		Path:        path,
+		Sku:         meta.Sku,
+		Title:       meta.Title,
+		Description: meta.Description,
+		Type:        meta.Type,
+		VAT:         meta.VAT,
+		Prices:      meta.Prices,
+		Addons:      meta.Addons,
+		Weight:      meta.Weight,
+		Length:      meta.Length,
+		Width:       meta.Width,
+		Height:      meta.Height,
+		Seller:      meta.Seller,
+		Downloads:   len(meta.Downloads),
+	}
+	if currency := r.URL.Query().Get("currency"); currency != "" {
+		code, httpErr := normalizeCurrency(config, currency)
+		if httpErr != nil {
+			return httpErr
+		}
+		price, err := meta.LowestPrice(gcontext.GetClaimsAsMap(ctx), code)
+		if err != nil {
+			return badRequestError("The product has no price in %s", code)
+		}
+		view.Price = &price
+		view.Currency = code
+	}
+
+	return sendJSON(w, http.StatusOK, view)
+}
+
+// fetchProduct returns the metadata of the product from the cache, or fetches
+// it from the site once the cached metadata expired.
+func fetchProduct(siteURL, path, sku string) (*models.LineItemMetadata, error) {
+	key := siteURL + path + "#" + sku
+	productCache.Lock()
+	cached, ok := productCache.products[key]
+	productCache.Unlock()
+	if ok && time.Since(cached.fetchedAt) < productMaxAge {
+		return cached.meta, nil
+	}
+
+	item := &models.LineItem{Path: path, Sku: sku}
+	meta, err := item.FetchMeta(siteURL)
+	if err != nil {
+		return nil, err
+	}
+
+	productCache.Lock()
+	defer productCache.Unlock()
+	if len(productCache.products) >= productCacheSize {
+		for k, p := range productCache.products {
+			if time.Since(p.fetchedAt) >= productMaxAge {
+				delete(productCache.products, k)
+			}
+		}
+	}
+	if len(productCache.products) < productCacheSize {
+		productCache.products[key] = &cachedProduct{meta: meta, fetchedAt: time.Now()}
+	}
+	return meta, nil
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProductView(t *testing.T) {
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/shop/batarang" {
+			handleTestProducts(w, r)
+			return
+		}
+		fetches++
+		fmt.Fprintln(w, productMetaFrame(`
+			{"sku": "batarang", "title": "Batarang", "type": "Gadget", "seller": "wayne", "prices": [
+				{"amount": "9.99", "currency": "USD"},
+				{"amount": "8.99", "currency": "EUR"}
+			], "downloads": [{"title": "Manual", "url": "/secret/manual.pdf"}], "webhook": "https://example.com/hook"}`))
+	}))
+	defer server.Close()
+
+	test := NewRouteTest(t)
+	test.Config.SiteURL = server.URL
+
+	recorder := test.TestEndpoint(http.MethodGet, "/products/shop/batarang", nil, nil)
+	product := map[string]interface{}{}
+	extractPayload(t, http.StatusOK, recorder, &product)
+	assert.Equal(t, "/shop/batarang", product["path"])
+	assert.Equal(t, "batarang", product["sku"])
+	assert.Equal(t, "wayne", product["seller"])
+	assert.EqualValues(t, 1, product["downloads"])
+	assert.NotContains(t, recorder.Body.String(), "/secret/manual.pdf")
+	assert.NotContains(t, product, "webhook")
+	assert.NotContains(t, product, "price")
+	require.Len(t, product["prices"], 2)
+
+	view := &productView{}
+	recorder = test.TestEndpoint(http.MethodGet, "/products/shop/batarang?currency=eur", nil, nil)
+	extractPayload(t, http.StatusOK, recorder, view)
+	require.NotNil(t, view.Price)
+	assert.EqualValues(t, 899, *view.Price)
+	assert.Equal(t, "EUR", view.Currency)
+	assert.Equal(t, 1, fetches, "the product should be cached")
+
+	recorder = test.TestEndpoint(http.MethodGet, "/products/shop/batarang?currency=GBP", nil, nil)
+	validateError(t, http.StatusBadRequest, recorder, "no price in GBP")
+
+	recorder = test.TestEndpoint(http.MethodGet, "/products/simple-product?sku=product-1", nil, nil)
+	extractPayload(t, http.StatusOK, recorder, view)
+	assert.Equal(t, "Product 1", view.Title)
+
+	recorder = test.TestEndpoint(http.MethodGet, "/products/simple-product?sku=nope", nil, nil)
+	validateError(t, http.StatusNotFound, recorder)
+	recorder = test.TestEndpoint(http.MethodGet, "/products/nope", nil, nil)
+	validateError(t, http.StatusNotFound, recorder)
+}
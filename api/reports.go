@@ -1,7 +1,11 @@
 package api
 
 import (
+	"fmt"
 	"net/http"
+	"strings"
+
+	"github.com/jinzhu/gorm"
 
 	gcontext "github.com/netlify/gocommerce/context"
 	"github.com/netlify/gocommerce/models"
@@ -13,6 +17,23 @@ type salesRow struct {
 	Taxes    uint64 `json:"taxes"`
 	Currency string `json:"currency"`
 	Orders   uint64 `json:"orders"`
+	Source   string `json:"source,omitempty"`
+}
+
+type salesIntervalRow struct {
+	Period   string `json:"period"`
+	Currency string `json:"currency"`
+	Revenue  uint64 `json:"revenue"`
+	Refunds  uint64 `json:"refunds"`
+	Net      int64  `json:"net"`
+	Orders   uint64 `json:"orders"`
+}
+
+type settlementRow struct {
+	Currency string `json:"currency"`
+	Charges  uint64 `json:"charges"`
+	Refunds  uint64 `json:"refunds"`
+	Net      int64  `json:"net"`
 }
 
 type productsRow struct {
@@ -22,19 +43,46 @@ type productsRow struct {
 	Currency string `json:"currency"`
 }
 
-// SalesReport lists the sales numbers for a period
+// SalesReport lists the sales numbers for a period. With an interval the
+// numbers are grouped by day, week or month, with `group=source` by the
+// channel the orders were placed through. `source` limits the numbers to
+// orders from the given sources.
 func (a *API) SalesReport(w http.ResponseWriter, r *http.Request) error {
 	instanceID := gcontext.GetInstanceID(r.Context())
+	params := r.URL.Query()
+	if interval := params.Get("interval"); interval != "" {
+		return a.salesByInterval(w, r, interval)
+	}
 
+	bySource := false
+	switch group := params.Get("group"); group {
+	case "":
+	case "source":
+		bySource = true
+	default:
+		return badRequestError("Unknown group '%s', must be source", group)
+	}
+
+	columns := "sum(total) as total, sum(sub_total) as subtotal, sum(taxes) as taxes, currency, count(*) as orders"
+	groups := "currency"
+	if bySource {
+		columns += ", source"
+		groups += ", source"
+	}
 	query := a.DB(r).
 		Model(&models.Order{}).
-		Select("sum(total) as total, sum(sub_total) as subtotal, sum(taxes) as taxes, currency, count(*) as orders").
+		Select(columns).
 		Where("payment_state = 'paid' AND instance_id = ?", instanceID).
-		Group("currency")
+		Group(groups).
+		Order(groups)
+	query = siteScope(r.Context(), query, "")
+	if sources := params.Get("source"); sources != "" {
+		query = query.Where("source IN (?)", strings.Split(sources, ","))
+	}
 
-	query, err := parseTimeQueryParams(query, query.NewScope(models.Order{}).QuotedTableName(), r.URL.Query())
+	query, err := parseTimeQueryParams(query, query.NewScope(models.Order{}).QuotedTableName(), params)
 	if err != nil {
-		return badRequestError(err.Error())
+		return badRequestError("%v", err)
 	}
 
 	rows, err := query.Rows()
@@ -45,10 +93,142 @@ func (a *API) SalesReport(w http.ResponseWriter, r *http.Request) error {
 	result := []*salesRow{}
 	for rows.Next() {
 		row := &salesRow{}
-		err = rows.Scan(&row.Total, &row.SubTotal, &row.Taxes, &row.Currency, &row.Orders)
+		dest := []interface{}{&row.Total, &row.SubTotal, &row.Taxes, &row.Currency, &row.Orders}
+		if bySource {
+			dest = append(dest, &row.Source)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return internalServerError("Database error").WithInternalError(err)
+		}
+		result = append(result, row)
+	}
+
+	return sendJSON(w, http.StatusOK, result)
+}
+
+// periodExpression returns the SQL expression that formats the creation
+// date of a row as the start of its day, week or month, e.g. "2020-01-31".
+// Weeks start on Monday.
+func periodExpression(db *gorm.DB, interval string) (string, error) {
+	dialect := db.Dialect().GetName()
+	switch interval {
+	case "day":
+		switch dialect {
+		case "sqlite3":
+			return "strftime('%Y-%m-%d', created_at)", nil
+		case "postgres":
+			return "to_char(created_at, 'YYYY-MM-DD')", nil
+		}
+		return "DATE_FORMAT(created_at, '%Y-%m-%d')", nil
+	case "week":
+		switch dialect {
+		case "sqlite3":
+			return "strftime('%Y-%m-%d', created_at, 'weekday 0', '-6 days')", nil
+		case "postgres":
+			return "to_char(date_trunc('week', created_at), 'YYYY-MM-DD')", nil
+		}
+		return "DATE_FORMAT(DATE_SUB(created_at, INTERVAL WEEKDAY(created_at) DAY), '%Y-%m-%d')", nil
+	case "month":
+		switch dialect {
+		case "sqlite3":
+			return "strftime('%Y-%m', created_at)", nil
+		case "postgres":
+			return "to_char(created_at, 'YYYY-MM')", nil
+		}
+		return "DATE_FORMAT(created_at, '%Y-%m')", nil
+	}
+	return "", fmt.Errorf("Unknown interval '%s', must be one of day, week or month", interval)
+}
+
+// salesByInterval sums up the paid charges and refunds per period and
+// currency. Refunds are counted in the period they were made in.
+func (a *API) salesByInterval(w http.ResponseWriter, r *http.Request, interval string) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+	db := a.DB(r)
+
+	period, err := periodExpression(db, interval)
+	if err != nil {
+		return badRequestError("%v", err)
+	}
+
+	query := db.
+		Model(&models.Transaction{}).
+		Select(period+" as period, currency, "+
+			"sum(CASE WHEN type = ? THEN amount ELSE 0 END) as revenue, "+
+			"sum(CASE WHEN type = ? THEN amount ELSE 0 END) as refunds, "+
+			"count(DISTINCT CASE WHEN type = ? THEN order_id END) as orders",
+			models.ChargeTransactionType, models.RefundTransactionType, models.ChargeTransactionType).
+		Where("status = ? AND instance_id = ?", models.PaidState, instanceID).
+		Group("period, currency").
+		Order("period, currency")
+	query = siteScope(r.Context(), query, "")
+
+	if currency := r.URL.Query().Get("currency"); currency != "" {
+		query = query.Where("currency = ?", strings.ToUpper(currency))
+	}
+	if sources := r.URL.Query().Get("source"); sources != "" {
+		orderTable := db.NewScope(models.Order{}).QuotedTableName()
+		query = query.Where("order_id IN (SELECT id FROM "+orderTable+" WHERE source IN (?))", strings.Split(sources, ","))
+	}
+	query, err = parseTimeQueryParams(query, query.NewScope(models.Transaction{}).QuotedTableName(), r.URL.Query())
+	if err != nil {
+		return badRequestError("%v", err)
+	}
+
+	rows, err := query.Rows()
+	if err != nil {
+		return internalServerError("Database error").WithInternalError(err)
+	}
+	defer rows.Close()
+	result := []*salesIntervalRow{}
+	for rows.Next() {
+		row := &salesIntervalRow{}
+		err = rows.Scan(&row.Period, &row.Currency, &row.Revenue, &row.Refunds, &row.Orders)
+		if err != nil {
+			return internalServerError("Database error").WithInternalError(err)
+		}
+		row.Net = int64(row.Revenue) - int64(row.Refunds)
+		result = append(result, row)
+	}
+
+	return sendJSON(w, http.StatusOK, result)
+}
+
+// SettlementReport lists the money settled with the payment providers per
+// currency for a period. Amounts are in the currency payments were charged in.
+// Provider fees are not tracked and thus not deducted from the net amount.
+func (a *API) SettlementReport(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+
+	query := a.DB(r).
+		Model(&models.Transaction{}).
+		Select("currency, "+
+			"sum(CASE WHEN type = ? THEN amount ELSE 0 END) as charges, "+
+			"sum(CASE WHEN type = ? THEN amount ELSE 0 END) as refunds",
+			models.ChargeTransactionType, models.RefundTransactionType).
+		Where("status = ? AND instance_id = ?", models.PaidState, instanceID).
+		Group("currency").
+		Order("currency")
+	query = siteScope(r.Context(), query, "")
+
+	query, err := parseTimeQueryParams(query, query.NewScope(models.Transaction{}).QuotedTableName(), r.URL.Query())
+	if err != nil {
+		return badRequestError("%v", err)
+	}
+
+	rows, err := query.Rows()
+	if err != nil {
+		return internalServerError("Database error").WithInternalError(err)
+	}
+	defer rows.Close()
+	result := []*settlementRow{}
+	for rows.Next() {
+		row := &settlementRow{}
+		err = rows.Scan(&row.Currency, &row.Charges, &row.Refunds)
 		if err != nil {
 			return internalServerError("Database error").WithInternalError(err)
 		}
+		row.Net = int64(row.Charges) - int64(row.Refunds)
 		result = append(result, row)
 	}
 
@@ -69,9 +249,10 @@ func (a *API) ProductsReport(w http.ResponseWriter, r *http.Request) error {
 		Order("total desc")
 
 	query = query.Where(ordersTable+".instance_id = ?", instanceID)
+	query = siteScope(r.Context(), query, ordersTable)
 	from, to, err := getTimeQueryParams(r.URL.Query())
 	if err != nil {
-		return badRequestError(err.Error())
+		return badRequestError("%v", err)
 	}
 	if from != nil {
 		query = query.Where(ordersTable+".created_at >= ?", from)
@@ -1,10 +1,15 @@
 package api
 
 import (
+	"fmt"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
 )
 
 func TestSalesReport(t *testing.T) {
@@ -23,6 +28,74 @@ func TestSalesReport(t *testing.T) {
 		assert.Equal(t, "USD", row.Currency)
 		assert.Equal(t, uint64(2), row.Orders)
 	})
+
+	t.Run("BySource", func(t *testing.T) {
+		test := NewRouteTest(t)
+		require.NoError(t, test.DB.Model(test.Data.secondOrder).UpdateColumn("source", "pos").Error)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/sales?group=source", nil, token)
+		report := []salesRow{}
+		extractPayload(t, http.StatusOK, recorder, &report)
+		require.Len(t, report, 2)
+		assert.Equal(t, "pos", report[0].Source)
+		assert.Equal(t, uint64(1), report[0].Orders)
+		assert.Equal(t, models.DefaultOrderSource, report[1].Source)
+		assert.Equal(t, uint64(1), report[1].Orders)
+		assert.Equal(t, uint64(79), report[0].Total+report[1].Total)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/reports/sales?source=pos", nil, token)
+		report = []salesRow{}
+		extractPayload(t, http.StatusOK, recorder, &report)
+		require.Len(t, report, 1)
+		assert.Equal(t, report[0].Orders, uint64(1))
+		assert.Empty(t, report[0].Source)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/reports/sales?group=country", nil, token)
+		validateError(t, http.StatusBadRequest, recorder, "Unknown group")
+	})
+
+	t.Run("Interval", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		day := func(month time.Month, day int) time.Time {
+			return time.Date(2020, month, day, 12, 0, 0, 0, time.UTC)
+		}
+		trans := []*models.Transaction{
+			{ID: "monday-charge", OrderID: "first-order", Currency: "USD", Amount: 100, Type: models.ChargeTransactionType, Status: models.PaidState, CreatedAt: day(time.January, 6)},
+			{ID: "failed-charge", OrderID: "first-order", Currency: "USD", Amount: 500, Type: models.ChargeTransactionType, Status: models.FailedState, CreatedAt: day(time.January, 7)},
+			{ID: "wednesday-charge", OrderID: "second-order", Currency: "USD", Amount: 50, Type: models.ChargeTransactionType, Status: models.PaidState, CreatedAt: day(time.January, 8)},
+			{ID: "thursday-refund", OrderID: "first-order", Currency: "USD", Amount: 30, Type: models.RefundTransactionType, Status: models.PaidState, CreatedAt: day(time.January, 9)},
+			{ID: "february-charge", OrderID: "first-order", Currency: "EUR", Amount: 70, Type: models.ChargeTransactionType, Status: models.PaidState, CreatedAt: day(time.February, 3)},
+		}
+		for _, tr := range trans {
+			require.NoError(t, test.DB.Create(tr).Error)
+		}
+		period := fmt.Sprintf("&from=%d&to=%d", day(time.January, 1).Unix(), day(time.March, 1).Unix())
+		report := func(query string) []salesIntervalRow {
+			recorder := test.TestEndpoint(http.MethodGet, "/reports/sales?"+query+period, nil, token)
+			rows := []salesIntervalRow{}
+			extractPayload(t, http.StatusOK, recorder, &rows)
+			return rows
+		}
+
+		rows := report("interval=week")
+		require.Len(t, rows, 2)
+		assert.Equal(t, salesIntervalRow{Period: "2020-01-06", Currency: "USD", Revenue: 150, Refunds: 30, Net: 120, Orders: 2}, rows[0])
+		assert.Equal(t, salesIntervalRow{Period: "2020-02-03", Currency: "EUR", Revenue: 70, Net: 70, Orders: 1}, rows[1])
+
+		rows = report("interval=day&currency=usd")
+		require.Len(t, rows, 3)
+		assert.Equal(t, "2020-01-09", rows[2].Period)
+		assert.EqualValues(t, -30, rows[2].Net)
+
+		rows = report("interval=month")
+		require.Len(t, rows, 2)
+		assert.Equal(t, "2020-01", rows[0].Period)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/sales?interval=year", nil, token)
+		validateError(t, http.StatusBadRequest, recorder, "Unknown interval")
+	})
 }
 
 func TestProductsReport(t *testing.T) {
@@ -43,3 +116,59 @@ func TestProductsReport(t *testing.T) {
 	assert.Equal(t, "456-i-rollover-all-things", prod3.Sku)
 	assert.Equal(t, uint64(10), prod3.Total)
 }
+
+func TestSettlementReport(t *testing.T) {
+	seed := func(test *RouteTest) {
+		trans := []*models.Transaction{
+			{ID: "eur-charge", Currency: "EUR", Amount: 100, Type: models.ChargeTransactionType, Status: models.PaidState},
+			{ID: "eur-refund", Currency: "EUR", Amount: 30, Type: models.RefundTransactionType, Status: models.PaidState},
+			{ID: "eur-failed", Currency: "EUR", Amount: 500, Type: models.ChargeTransactionType, Status: models.FailedState},
+			{ID: "usd-refund", Currency: "USD", Amount: 5, Type: models.RefundTransactionType, Status: models.PaidState},
+		}
+		for _, tr := range trans {
+			tr.OrderID = test.Data.firstOrder.ID
+			require.NoError(t, test.DB.Create(tr).Error)
+		}
+	}
+
+	t.Run("AllTime", func(t *testing.T) {
+		test := NewRouteTest(t)
+		seed(test)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/settlement", nil, token)
+
+		report := []settlementRow{}
+		extractPayload(t, http.StatusOK, recorder, &report)
+		require.Len(t, report, 2)
+
+		eur := report[0]
+		assert.Equal(t, "EUR", eur.Currency)
+		assert.Equal(t, uint64(100), eur.Charges)
+		assert.Equal(t, uint64(30), eur.Refunds)
+		assert.Equal(t, int64(70), eur.Net)
+
+		usd := report[1]
+		assert.Equal(t, "USD", usd.Currency)
+		assert.Equal(t, uint64(155), usd.Charges)
+		assert.Equal(t, uint64(5), usd.Refunds)
+		assert.Equal(t, int64(150), usd.Net)
+	})
+
+	t.Run("Period", func(t *testing.T) {
+		test := NewRouteTest(t)
+		seed(test)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		from := time.Now().Add(time.Hour).Unix()
+		recorder := test.TestEndpoint(http.MethodGet, fmt.Sprintf("/reports/settlement?from=%d", from), nil, token)
+
+		report := []settlementRow{}
+		extractPayload(t, http.StatusOK, recorder, &report)
+		assert.Empty(t, report)
+	})
+
+	t.Run("NonAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/settlement", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
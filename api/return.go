@@ -0,0 +1,278 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+	"github.com/pborman/uuid"
+)
+
+type returnItemParams struct {
+	LineItemID int64  `json:"line_item_id"`
+	Quantity   uint64 `json:"quantity"`
+}
+
+type returnParams struct {
+	Reason string              `json:"reason"`
+	Items  []*returnItemParams `json:"items"`
+}
+
+type returnUpdateParams struct {
+	Status string `json:"status"`
+}
+
+// ReturnList lists the returns of an order, newest first.
+func (a *API) ReturnList(w http.ResponseWriter, r *http.Request) error {
+	db := a.ReadDB(r)
+	order, httpErr := a.returnOrder(w, r, db)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	returns := []*models.Return{}
+	if rsp := db.Preload("Items").Where("order_id = ?", order.ID).Order("created_at desc").Find(&returns); rsp.Error != nil {
+		return internalServerError("Error while querying for returns").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, returns)
+}
+
+// ReturnCreate requests a return of items of a paid order. Without a quantity
+// every item of the line item that wasn't returned yet is sent back.
+func (a *API) ReturnCreate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	params := &returnParams{}
+	if err := decodeJSON(r, params); err != nil {
+		return badRequestError("Could not read return params: %v", err)
+	}
+	if len(params.Items) == 0 {
+		return badRequestError("A return requires at least one item")
+	}
+
+	tx := a.DB(r).Begin()
+	order, httpErr := a.returnOrder(w, r, tx)
+	if httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	if order.PaymentState != models.PaidState {
+		tx.Rollback()
+		return badRequestError("Only paid orders can be returned")
+	}
+
+	returned, httpErr := returnedQuantities(tx, order)
+	if httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+
+	ret := &models.Return{
+		InstanceID: order.InstanceID,
+		SiteID:     order.SiteID,
+		ID:         uuid.NewRandom().String(),
+		OrderID:    order.ID,
+		UserID:     order.UserID,
+		Reason:     params.Reason,
+		Status:     models.ReturnRequestedState,
+	}
+	var quantity uint64
+	for _, p := range params.Items {
+		item := order.LineItem(p.LineItemID)
+		if item == nil {
+			tx.Rollback()
+			return badRequestError("Line item %d not found on this order", p.LineItemID)
+		}
+		left := item.Quantity - returned[item.ID]
+		if p.Quantity == 0 {
+			p.Quantity = left
+		}
+		if p.Quantity == 0 || p.Quantity > left {
+			tx.Rollback()
+			return badRequestError("Only %d of line item %d can be returned", left, item.ID)
+		}
+		returned[item.ID] += p.Quantity
+		quantity += p.Quantity
+		ret.Items = append(ret.Items, &models.ReturnItem{LineItemID: item.ID, Quantity: p.Quantity})
+	}
+
+	if rsp := tx.Create(ret); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Failed to save return").WithInternalError(rsp.Error)
+	}
+	logTimeline(r, tx, order, models.ReturnedTimelineEvent, "Return of %d items requested", quantity)
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Failed to save return").WithInternalError(rsp.Error)
+	}
+
+	getLogEntry(r).WithField("return_id", ret.ID).Infof("Return of order %s requested", gcontext.GetOrderID(ctx))
+	return sendJSON(w, http.StatusCreated, ret)
+}
+
+// ReturnUpdate changes the status of a return. Once the returned items are
+// received they are restocked and refunded to the payment they were paid
+// with. It is only available to admins.
+func (a *API) ReturnUpdate(w http.ResponseWriter, r *http.Request) error {
+	returnID := chi.URLParam(r, "return_id")
+	log := getLogEntry(r).WithField("return_id", returnID)
+
+	params := &returnUpdateParams{}
+	if err := decodeJSON(r, params); err != nil {
+		return badRequestError("Could not read return params: %v", err)
+	}
+
+	tx := a.DB(r).Begin()
+	order, httpErr := a.returnOrder(w, r, tx)
+	if httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+
+	ret := &models.Return{}
+	if rsp := tx.Preload("Items").Where("order_id = ?", order.ID).First(ret, "id = ?", returnID); rsp.Error != nil {
+		tx.Rollback()
+		if rsp.RecordNotFound() {
+			return notFoundError("Return not found")
+		}
+		return internalServerError("Error while querying for return").WithInternalError(rsp.Error)
+	}
+	if ret.Status == params.Status {
+		tx.Rollback()
+		return sendJSON(w, http.StatusOK, ret)
+	}
+	if httpErr := checkTransition(models.ReturnStateMachine, "return status", ret.Status, params.Status, models.ActorAdmin); httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+
+	ret.Status = params.Status
+	logTimeline(r, tx, order, models.ReturnedTimelineEvent, "Return %s", ret.Status)
+	if ret.Status == models.ReturnReceivedState {
+		if httpErr := returnReceived(r, tx, order, ret); httpErr != nil {
+			tx.Rollback()
+			return httpErr
+		}
+	}
+	if rsp := tx.Save(ret); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Failed to update return").WithInternalError(rsp.Error)
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Failed to update return").WithInternalError(rsp.Error)
+	}
+
+	log.Infof("Return is %s", ret.Status)
+	return sendJSON(w, http.StatusOK, ret)
+}
+
+// returnReceived puts the returned items back into stock and refunds them.
+// The return is refunded once the refund went through, failed refunds can be
+// retried by hand before marking the return as refunded.
+func returnReceived(r *http.Request, tx *gorm.DB, order *models.Order, ret *models.Return) *HTTPError {
+	var amount uint64
+	for _, ri := range ret.Items {
+		item := order.LineItem(ri.LineItemID)
+		if item == nil {
+			return internalServerError("Line item %d of return %s not found", ri.LineItemID, ret.ID)
+		}
+		if err := models.IncrementStock(tx, order.InstanceID, item.Sku, ri.Quantity); err != nil {
+			return internalServerError("Failed to restock returned items").WithInternalError(err)
+		}
+
+		// the calculated total is the price of a single item
+		price := item.Price
+		if item.CalculationDetail != nil && item.Total > 0 {
+			price = uint64(item.Total)
+		}
+		amount += price * ri.Quantity
+	}
+	amount += tipShare(order, amount)
+
+	// returns are refunded to the card of split payments, and only to the
+	// gift card if it paid for the whole order
+	var charge *models.Transaction
+	for _, t := range order.Transactions {
+		if t.Type != models.ChargeTransactionType || t.Status != models.PaidState {
+			continue
+		}
+		if charge == nil || (charge.GiftCardID != "" && t.GiftCardID == "") {
+			charge = t
+		}
+	}
+	if charge == nil || amount == 0 {
+		ret.Status = models.ReturnRefundedState
+		return nil
+	}
+	// earlier refunds of the charge, e.g. of other returns, reduce what's left
+	var left uint64
+	if refunded := order.RefundedAmount(charge); refunded < charge.Amount {
+		left = charge.Amount - refunded
+	}
+	amount = order.SettlementAmount(amount)
+	if amount > left {
+		amount = left
+	}
+	if amount == 0 {
+		ret.Status = models.ReturnRefundedState
+		return nil
+	}
+
+	refund := &models.Transaction{
+		InstanceID: order.InstanceID,
+		SiteID:     order.SiteID,
+		ID:         uuid.NewRandom().String(),
+		Amount:     amount,
+		Currency:   charge.Currency,
+		UserID:     charge.UserID,
+		OrderID:    order.ID,
+		Type:       models.RefundTransactionType,
+		Status:     models.PendingState,
+	}
+	if httpErr := makeRefund(r, tx, order, charge, refund, false); httpErr != nil {
+		return httpErr
+	}
+	ret.RefundID = refund.ID
+	if refund.Status == models.PaidState {
+		ret.Status = models.ReturnRefundedState
+	}
+	return nil
+}
+
+// returnOrder loads the order a return belongs to, if the request has access
+// to it.
+func (a *API) returnOrder(w http.ResponseWriter, r *http.Request, db *gorm.DB) (*models.Order, *HTTPError) {
+	ctx := r.Context()
+	order := &models.Order{}
+	if rsp := siteScope(ctx, orderQuery(db), "").First(order, "id = ?", gcontext.GetOrderID(ctx)); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, notFoundError("Order not found")
+		}
+		return nil, internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	if !canWriteOrders(ctx) {
+		if httpErr := a.canAccessOrder(w, r, db, order); httpErr != nil {
+			return nil, httpErr
+		}
+	}
+	return order, nil
+}
+
+// returnedQuantities sums up the quantities of the line items of an order
+// that are part of returns which weren't rejected.
+func returnedQuantities(db *gorm.DB, order *models.Order) (map[int64]uint64, *HTTPError) {
+	returns := []*models.Return{}
+	if rsp := db.Preload("Items").Where("order_id = ?", order.ID).Find(&returns); rsp.Error != nil {
+		return nil, internalServerError("Error while querying for returns").WithInternalError(rsp.Error)
+	}
+	quantities := map[int64]uint64{}
+	for _, ret := range returns {
+		if !ret.Active() {
+			continue
+		}
+		for _, item := range ret.Items {
+			quantities[item.LineItemID] += item.Quantity
+		}
+	}
+	return quantities, nil
+}
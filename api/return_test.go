@@ -0,0 +1,210 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+)
+
+func requestReturn(test *RouteTest, order *models.Order, params *returnParams) *httptest.ResponseRecorder {
+	body, err := json.Marshal(params)
+	require.NoError(test.T, err)
+	return test.TestEndpoint(http.MethodPost, "/orders/"+order.ID+"/returns", bytes.NewReader(body), test.Data.testUserToken)
+}
+
+func createReturn(test *RouteTest, status string) *models.Return {
+	ret := &models.Return{
+		ID:      "first-return",
+		OrderID: test.Data.firstOrder.ID,
+		UserID:  test.Data.testUser.ID,
+		Status:  status,
+		Items:   []*models.ReturnItem{{LineItemID: test.Data.firstLineItem.ID, Quantity: 1}},
+	}
+	require.NoError(test.T, test.DB.Create(ret).Error)
+	return ret
+}
+
+func TestReturnCreate(t *testing.T) {
+	t.Run("AsTheUser", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := requestReturn(test, test.Data.firstOrder, &returnParams{
+			Reason: "too small",
+			Items:  []*returnItemParams{{LineItemID: test.Data.firstLineItem.ID, Quantity: 1}},
+		})
+
+		ret := &models.Return{}
+		extractPayload(t, http.StatusCreated, recorder, ret)
+		assert.Equal(t, models.ReturnRequestedState, ret.Status)
+		assert.Equal(t, "too small", ret.Reason)
+		require.Len(t, ret.Items, 1)
+		assert.EqualValues(t, 1, ret.Items[0].Quantity)
+
+		notes := []models.OrderNote{}
+		require.NoError(t, test.DB.Where("order_id = ? AND event = ?", test.Data.firstOrder.ID, models.ReturnedTimelineEvent).Find(&notes).Error)
+		require.Len(t, notes, 1)
+		assert.Equal(t, "Return of 1 items requested", notes[0].Text)
+	})
+
+	t.Run("RemainingQuantity", func(t *testing.T) {
+		test := NewRouteTest(t)
+		createReturn(test, models.ReturnApprovedState)
+		recorder := requestReturn(test, test.Data.firstOrder, &returnParams{
+			Items: []*returnItemParams{{LineItemID: test.Data.firstLineItem.ID}},
+		})
+
+		ret := &models.Return{}
+		extractPayload(t, http.StatusCreated, recorder, ret)
+		require.Len(t, ret.Items, 1)
+		assert.EqualValues(t, 1, ret.Items[0].Quantity)
+	})
+
+	t.Run("TooMany", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := requestReturn(test, test.Data.firstOrder, &returnParams{
+			Items: []*returnItemParams{{LineItemID: test.Data.firstLineItem.ID, Quantity: 3}},
+		})
+		validateError(t, http.StatusBadRequest, recorder, "Only 2 of line item 11 can be returned")
+	})
+
+	t.Run("RejectedReturnsDontCount", func(t *testing.T) {
+		test := NewRouteTest(t)
+		createReturn(test, models.ReturnRejectedState)
+		recorder := requestReturn(test, test.Data.firstOrder, &returnParams{
+			Items: []*returnItemParams{{LineItemID: test.Data.firstLineItem.ID, Quantity: 2}},
+		})
+		assert.Equal(t, http.StatusCreated, recorder.Code)
+	})
+
+	t.Run("UnknownLineItem", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := requestReturn(test, test.Data.firstOrder, &returnParams{
+			Items: []*returnItemParams{{LineItemID: test.Data.secondLineItem1.ID, Quantity: 1}},
+		})
+		validateError(t, http.StatusBadRequest, recorder, "Line item 21 not found on this order")
+	})
+
+	t.Run("UnpaidOrder", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.firstOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+		recorder := requestReturn(test, test.Data.firstOrder, &returnParams{
+			Items: []*returnItemParams{{LineItemID: test.Data.firstLineItem.ID, Quantity: 1}},
+		})
+		validateError(t, http.StatusBadRequest, recorder, "Only paid orders can be returned")
+	})
+}
+
+func TestReturnUpdate(t *testing.T) {
+	updateReturn := func(test *RouteTest, provider payments.Provider, status string) *httptest.ResponseRecorder {
+		body, err := json.Marshal(&returnUpdateParams{Status: status})
+		require.NoError(test.T, err)
+		url := "/orders/" + test.Data.firstOrder.ID + "/returns/first-return"
+		return testEndpointWithProvider(test, provider, http.MethodPut, url, bytes.NewReader(body), testAdminToken("admin-yo", "admin@wayneindustries.com"))
+	}
+
+	t.Run("Approve", func(t *testing.T) {
+		test := NewRouteTest(t)
+		createReturn(test, models.ReturnRequestedState)
+		recorder := updateReturn(test, &memProvider{name: payments.StripeProvider}, models.ReturnApprovedState)
+
+		ret := &models.Return{}
+		extractPayload(t, http.StatusOK, recorder, ret)
+		assert.Equal(t, models.ReturnApprovedState, ret.Status)
+	})
+
+	t.Run("ReceivedRefundsAndRestocks", func(t *testing.T) {
+		test := NewRouteTest(t)
+		createReturn(test, models.ReturnApprovedState)
+		require.NoError(t, test.DB.Save(&models.Stock{Sku: test.Data.firstLineItem.Sku, Quantity: 4}).Error)
+
+		provider := &memProvider{name: payments.StripeProvider}
+		recorder := updateReturn(test, provider, models.ReturnReceivedState)
+
+		ret := &models.Return{}
+		extractPayload(t, http.StatusOK, recorder, ret)
+		assert.Equal(t, models.ReturnRefundedState, ret.Status)
+		require.NotEmpty(t, ret.RefundID)
+
+		require.Len(t, provider.refundCalls, 1)
+		assert.EqualValues(t, 12, provider.refundCalls[0].amount)
+		assert.Equal(t, test.Data.firstTransaction.ProcessorID, provider.refundCalls[0].id)
+
+		refund := &models.Transaction{}
+		require.NoError(t, test.DB.First(refund, "id = ?", ret.RefundID).Error)
+		assert.Equal(t, models.PaidState, refund.Status)
+		assert.EqualValues(t, 12, refund.Amount)
+
+		stock, err := models.FindStock(test.DB, "", test.Data.firstLineItem.Sku)
+		require.NoError(t, err)
+		assert.EqualValues(t, 5, stock.Quantity)
+	})
+
+	t.Run("ReceivedRefundsWhatsLeftOfTheCard", func(t *testing.T) {
+		test := NewRouteTest(t)
+		createReturn(test, models.ReturnApprovedState)
+		giftCardCharge := models.NewTransaction(test.Data.firstOrder)
+		giftCardCharge.ID = "0"
+		giftCardCharge.Order = nil
+		giftCardCharge.User = nil
+		giftCardCharge.GiftCardID = "gift-card"
+		giftCardCharge.Amount = 50
+		giftCardCharge.Status = models.PaidState
+		require.NoError(t, test.DB.Create(giftCardCharge).Error)
+		earlierRefund := &models.Transaction{
+			ID:       "earlier-refund",
+			OrderID:  test.Data.firstOrder.ID,
+			ChargeID: test.Data.firstTransaction.ID,
+			Type:     models.RefundTransactionType,
+			Status:   models.PaidState,
+			Amount:   95,
+			Currency: "USD",
+		}
+		require.NoError(t, test.DB.Create(earlierRefund).Error)
+
+		provider := &memProvider{name: payments.StripeProvider}
+		recorder := updateReturn(test, provider, models.ReturnReceivedState)
+
+		ret := &models.Return{}
+		extractPayload(t, http.StatusOK, recorder, ret)
+		assert.Equal(t, models.ReturnRefundedState, ret.Status)
+
+		require.Len(t, provider.refundCalls, 1)
+		assert.EqualValues(t, 5, provider.refundCalls[0].amount)
+		assert.Equal(t, test.Data.firstTransaction.ProcessorID, provider.refundCalls[0].id)
+	})
+
+	t.Run("InvalidTransition", func(t *testing.T) {
+		test := NewRouteTest(t)
+		createReturn(test, models.ReturnRequestedState)
+		recorder := updateReturn(test, &memProvider{name: payments.StripeProvider}, models.ReturnReceivedState)
+		validateError(t, http.StatusBadRequest, recorder, "Can't change the return status from 'requested' to 'received'")
+	})
+
+	t.Run("AsTheUser", func(t *testing.T) {
+		test := NewRouteTest(t)
+		createReturn(test, models.ReturnRequestedState)
+		body := bytes.NewReader([]byte(`{"status": "approved"}`))
+		recorder := test.TestEndpoint(http.MethodPut, "/orders/"+test.Data.firstOrder.ID+"/returns/first-return", body, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
+
+func TestReturnList(t *testing.T) {
+	test := NewRouteTest(t)
+	createReturn(test, models.ReturnRequestedState)
+	recorder := test.TestEndpoint(http.MethodGet, "/orders/"+test.Data.firstOrder.ID+"/returns", nil, test.Data.testUserToken)
+
+	returns := []*models.Return{}
+	extractPayload(t, http.StatusOK, recorder, &returns)
+	require.Len(t, returns, 1)
+	assert.Equal(t, "first-return", returns[0].ID)
+	require.Len(t, returns[0].Items, 1)
+}
@@ -30,6 +30,9 @@ func (r *router) Post(pattern string, fn apiHandler) {
 func (r *router) Put(pattern string, fn apiHandler) {
 	r.chi.Put(pattern, handler(fn))
 }
+func (r *router) Patch(pattern string, fn apiHandler) {
+	r.chi.Patch(pattern, handler(fn))
+}
 func (r *router) Delete(pattern string, fn apiHandler) {
 	r.chi.Delete(pattern, handler(fn))
 }
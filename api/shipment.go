@@ -0,0 +1,176 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+)
+
+type shipmentParams struct {
+	FulfillmentState string `json:"fulfillment_state"`
+}
+
+// ShipmentUpdate changes the fulfillment state of a shipment of an order. The
+// order is shipping once any of its shipments is and shipped once all of them
+// are. It is only available to admins.
+func (a *API) ShipmentUpdate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := gcontext.GetConfig(ctx)
+	claims := gcontext.GetClaims(ctx)
+	orderID := gcontext.GetOrderID(ctx)
+	shipmentID := chi.URLParam(r, "shipment_id")
+	log := getLogEntry(r).WithField("shipment_id", shipmentID)
+
+	params := new(shipmentParams)
+	if err := decodeJSON(r, params); err != nil {
+		return badRequestError("Could not read shipment parameters: %v", err)
+	}
+	if !validFulfillmentState(params.FulfillmentState) {
+		return badRequestError("Bad fulfillment state: " + params.FulfillmentState)
+	}
+
+	tx := a.DB(r).Begin()
+	order := &models.Order{}
+	query := siteScope(ctx, orderQuery(tx), "").Where("instance_id = ?", gcontext.GetInstanceID(ctx))
+	if rsp := query.First(order, "id = ?", orderID); rsp.Error != nil {
+		tx.Rollback()
+		if rsp.RecordNotFound() {
+			return notFoundError("Order not found")
+		}
+		return internalServerError("Error while querying for order").WithInternalError(rsp.Error)
+	}
+
+	var shipment *models.Shipment
+	for _, s := range order.Shipments {
+		if s.ID == shipmentID {
+			shipment = s
+		}
+	}
+	if shipment == nil {
+		tx.Rollback()
+		return notFoundError("Shipment not found")
+	}
+
+	if httpErr := checkTransition(models.FulfillmentStateMachine, "fulfillment state", shipment.FulfillmentState, params.FulfillmentState, models.ActorAdmin); httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	if params.FulfillmentState == models.ShippedState && shipment.FulfillmentState != models.ShippedState {
+		logTimeline(r, tx, order, models.ShippedTimelineEvent, "Shipment to %s shipped", shipment.ShippingAddress.Address1)
+	}
+	shipped := params.FulfillmentState == models.ShippedState && shipment.FulfillmentState != models.ShippedState
+	shipment.FulfillmentState = params.FulfillmentState
+
+	changes := []string{"shipments"}
+	state := shipmentsFulfillmentState(order)
+	if shipped && state != models.ShippedState {
+		captured, httpErr := captureShipmentItems(r, tx, order, shipment)
+		if httpErr != nil {
+			tx.Rollback()
+			return httpErr
+		}
+		if captured {
+			changes = append(changes, "payment_state")
+		}
+	}
+	if state != order.FulfillmentState {
+		fulfillmentChanges, httpErr := updateFulfillmentState(r, tx, order, state)
+		if httpErr != nil {
+			tx.Rollback()
+			return httpErr
+		}
+		changes = append(changes, fulfillmentChanges...)
+	}
+
+	rsp := tx.Model(order).Where("version = ?", order.Version).UpdateColumn("version", order.Version+1)
+	if rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error saving order updates").WithInternalError(rsp.Error)
+	}
+	if rsp.RowsAffected == 0 {
+		tx.Rollback()
+		return conflictError("The order has been modified by another request")
+	}
+	if rsp := tx.Save(order); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error saving order updates").WithInternalError(rsp.Error)
+	}
+
+	models.LogEvent(tx, r.RemoteAddr, claims.Subject, order.ID, models.EventUpdated, changes)
+	if err := models.RunHooks(tx, config, order.InstanceID, "update", config.Webhooks.Update, claims.Subject, order); err != nil {
+		log.WithError(err).Error("Failed to process web hook")
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error committing order updates").WithInternalError(rsp.Error)
+	}
+
+	log.Infof("Updated fulfillment state of shipment to %s", shipment.FulfillmentState)
+	return sendJSON(w, http.StatusOK, shipment)
+}
+
+// captureShipmentItems captures the value of the items of a shipment that
+// ships before the rest of the order, if payments are captured on shipment
+// and the payment provider can capture them in parts. The items are captured
+// with their discounts and taxes, shipping is captured with the rest of the
+// payment when the order shipped. Cards that can't be captured in parts are
+// captured in full with the last shipment instead. It reports whether a
+// payment was captured.
+func captureShipmentItems(r *http.Request, tx *gorm.DB, order *models.Order, shipment *models.Shipment) (bool, *HTTPError) {
+	config := gcontext.GetConfig(r.Context())
+	if !config.Payment.CaptureOnShipment || authorizedPayment(order) == nil {
+		return false, nil
+	}
+	provider := gcontext.GetPaymentProviders(r.Context())[order.PaymentProcessor]
+	if _, ok := provider.(payments.PartialCapturer); !ok {
+		return false, nil
+	}
+
+	var amount uint64
+	for _, item := range order.ShipmentItems(shipment) {
+		// the calculated total is the price of a single item
+		price := item.Price
+		if item.CalculationDetail != nil && item.Total > 0 {
+			price = uint64(item.Total)
+		}
+		amount += price * item.Quantity
+	}
+	if amount == 0 {
+		return false, nil
+	}
+	if httpErr := captureShipment(r, tx, order, amount, false); httpErr != nil {
+		// e.g. the card doesn't support multicapture, the whole payment is
+		// still authorized and gets captured when the order shipped
+		getLogEntry(r).WithError(httpErr).Warn("Failed to capture payment for shipment, capturing it with the last shipment")
+		return false, nil
+	}
+	return true, nil
+}
+
+// shipmentsFulfillmentState derives the fulfillment state of an order from
+// its shipments.
+func shipmentsFulfillmentState(order *models.Order) string {
+	shipped := 0
+	started := false
+	for _, shipment := range order.Shipments {
+		switch shipment.FulfillmentState {
+		case models.ShippedState:
+			shipped++
+			started = true
+		case models.ShippingState:
+			started = true
+		}
+	}
+
+	switch {
+	case shipped == len(order.Shipments):
+		return models.ShippedState
+	case started && order.FulfillmentState != models.ShippingState:
+		return models.ShippingState
+	default:
+		return order.FulfillmentState
+	}
+}
@@ -0,0 +1,186 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+)
+
+const splitShipmentPayload = `{
+	"email": "info@example.com",
+	"shipping_address": {
+		"name": "Test User",
+		"address1": "610 22nd Street",
+		"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+	},
+	"line_items": [
+		{"path": "/simple-product", "quantity": 1},
+		{"path": "/multi-currency-product", "quantity": 1, "shipping_address": {
+			"name": "Alfred Pennyworth",
+			"address1": "1007 Mountain Drive",
+			"city": "Gotham", "state": "NJ", "country": "USA", "zip": "07001"
+		}}
+	]
+}`
+
+func TestSplitShipments(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	createSplitOrder := func(test *RouteTest) *models.Order {
+		test.Config.SiteURL = server.URL
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(splitShipmentPayload), test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		return order
+	}
+
+	t.Run("Create", func(t *testing.T) {
+		test := NewRouteTest(t)
+		order := createSplitOrder(test)
+		require.Len(t, order.Shipments, 2)
+		assert.Equal(t, "San Francisco", order.Shipments[0].ShippingAddress.City)
+		assert.Equal(t, "Gotham", order.Shipments[1].ShippingAddress.City)
+		require.Len(t, order.LineItems, 2)
+		assert.Equal(t, order.Shipments[0].ID, order.LineItems[0].ShipmentID)
+		assert.Equal(t, order.Shipments[1].ID, order.LineItems[1].ShipmentID)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/"+order.ID, nil, test.Data.testUserToken)
+		saved := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, saved)
+		assert.Len(t, saved.Shipments, 2)
+	})
+
+	t.Run("SingleAddress", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(defaultPayload), test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Empty(t, order.Shipments)
+	})
+
+	t.Run("Fulfillment", func(t *testing.T) {
+		test := NewRouteTest(t)
+		order := createSplitOrder(test)
+		url := "/orders/" + order.ID + "/shipments/"
+
+		recorder := test.TestEndpoint(http.MethodPut, url+order.Shipments[0].ID, strings.NewReader(`{"fulfillment_state": "shipped"}`), token)
+		shipment := &models.Shipment{}
+		extractPayload(t, http.StatusOK, recorder, shipment)
+		assert.Equal(t, models.ShippedState, shipment.FulfillmentState)
+
+		saved := &models.Order{}
+		require.NoError(t, orderQuery(test.DB).First(saved, "id = ?", order.ID).Error)
+		assert.Equal(t, models.ShippingState, saved.FulfillmentState)
+
+		recorder = test.TestEndpoint(http.MethodPut, url+order.Shipments[1].ID, strings.NewReader(`{"fulfillment_state": "shipped"}`), token)
+		extractPayload(t, http.StatusOK, recorder, shipment)
+
+		saved = &models.Order{}
+		require.NoError(t, orderQuery(test.DB).First(saved, "id = ?", order.ID).Error)
+		assert.Equal(t, models.ShippedState, saved.FulfillmentState)
+
+		recorder = test.TestEndpoint(http.MethodPut, url+order.Shipments[1].ID, strings.NewReader(`{"fulfillment_state": "pending"}`), token)
+		validateError(t, http.StatusBadRequest, recorder, "from 'shipped' to 'pending'")
+	})
+
+	// setupCapture authorizes the payment of a split order and returns the
+	// authorization and the value of the items of the first shipment
+	setupCapture := func(test *RouteTest) (*models.Order, *models.Transaction, uint64) {
+		test.Config.Payment.CaptureOnShipment = true
+		order := createSplitOrder(test)
+		order.PaymentProcessor = payments.StripeProvider
+		order.PaymentState = models.AuthorizedState
+		require.NoError(t, test.DB.Save(order).Error)
+		authorization := models.NewTransaction(order)
+		authorization.ProcessorID = "pi_split"
+		authorization.Status = models.AuthorizedState
+		authorization.AuthorizedAmount = order.Total
+		require.NoError(t, test.DB.Create(authorization).Error)
+
+		item := order.LineItems[0]
+		itemValue := item.Price * item.Quantity
+		if item.CalculationDetail != nil && item.Total > 0 {
+			itemValue = uint64(item.Total) * item.Quantity
+		}
+		return order, authorization, itemValue
+	}
+
+	t.Run("CaptureOnShipment", func(t *testing.T) {
+		test := NewRouteTest(t)
+		order, authorization, itemValue := setupCapture(test)
+
+		provider := &partialMemProvider{memProvider: &memProvider{name: payments.StripeProvider}}
+		url := "/orders/" + order.ID + "/shipments/"
+		recorder := testEndpointWithProvider(test, provider, http.MethodPut, url+order.Shipments[0].ID, strings.NewReader(`{"fulfillment_state": "shipped"}`), token)
+		extractPayload(t, http.StatusOK, recorder, &models.Shipment{})
+		require.Len(t, provider.partialCaptureCalls, 1)
+		assert.Equal(t, itemValue, provider.partialCaptureCalls[0].amount)
+		assert.Empty(t, provider.captureCalls)
+
+		saved := &models.Order{}
+		require.NoError(t, orderQuery(test.DB).First(saved, "id = ?", order.ID).Error)
+		assert.Equal(t, models.PartiallyCapturedState, saved.PaymentState)
+		captures := []models.Transaction{}
+		require.NoError(t, test.DB.Where("authorization_id = ?", authorization.ID).Find(&captures).Error)
+		require.Len(t, captures, 1)
+		assert.Equal(t, models.PaidState, captures[0].Status)
+		assert.Equal(t, itemValue, captures[0].Amount)
+
+		recorder = testEndpointWithProvider(test, provider, http.MethodPut, url+order.Shipments[1].ID, strings.NewReader(`{"fulfillment_state": "shipped"}`), token)
+		extractPayload(t, http.StatusOK, recorder, &models.Shipment{})
+		require.Len(t, provider.captureCalls, 1)
+		assert.Equal(t, order.Total-itemValue, provider.captureCalls[0].amount)
+
+		saved = &models.Order{}
+		require.NoError(t, orderQuery(test.DB).First(saved, "id = ?", order.ID).Error)
+		assert.Equal(t, models.PaidState, saved.PaymentState)
+		assert.Equal(t, models.ShippedState, saved.FulfillmentState)
+	})
+
+	t.Run("CaptureOnShipmentWithoutMulticapture", func(t *testing.T) {
+		test := NewRouteTest(t)
+		order, authorization, _ := setupCapture(test)
+
+		provider := &partialMemProvider{
+			memProvider:       &memProvider{name: payments.StripeProvider},
+			partialCaptureErr: errors.New("This card doesn't support multicapture"),
+		}
+		url := "/orders/" + order.ID + "/shipments/"
+		recorder := testEndpointWithProvider(test, provider, http.MethodPut, url+order.Shipments[0].ID, strings.NewReader(`{"fulfillment_state": "shipped"}`), token)
+		shipment := &models.Shipment{}
+		extractPayload(t, http.StatusOK, recorder, shipment)
+		assert.Equal(t, models.ShippedState, shipment.FulfillmentState)
+		require.Len(t, provider.partialCaptureCalls, 1)
+
+		saved := &models.Order{}
+		require.NoError(t, orderQuery(test.DB).First(saved, "id = ?", order.ID).Error)
+		assert.Equal(t, models.AuthorizedState, saved.PaymentState)
+		assert.Equal(t, models.ShippingState, saved.FulfillmentState)
+
+		recorder = testEndpointWithProvider(test, provider, http.MethodPut, url+order.Shipments[1].ID, strings.NewReader(`{"fulfillment_state": "shipped"}`), token)
+		extractPayload(t, http.StatusOK, recorder, shipment)
+		require.Len(t, provider.captureCalls, 1)
+		assert.Equal(t, authorization.ProcessorID, provider.captureCalls[0].id)
+		assert.Equal(t, order.Total, provider.captureCalls[0].amount)
+
+		saved = &models.Order{}
+		require.NoError(t, orderQuery(test.DB).First(saved, "id = ?", order.ID).Error)
+		assert.Equal(t, models.PaidState, saved.PaymentState)
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodPut, "/orders/first-order/shipments/missing", strings.NewReader(`{"fulfillment_state": "shipped"}`), token)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/netlify/gocommerce/conf"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/shipping"
+)
+
+type shippingEstimate struct {
+	Package shipping.Package `json:"package"`
+	Quotes  []shipping.Quote `json:"quotes"`
+}
+
+// ShippingEstimate quotes the shipping costs of an order with every carrier,
+// using the package its line items fit in and its shipping address. Carriers
+// that fail are left out, unless all of them do.
+func (a *API) ShippingEstimate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	id := gcontext.GetOrderID(ctx)
+	log := getLogEntry(r)
+
+	order := &models.Order{}
+	if result := orderQuery(siteScope(ctx, a.ReadDB(r), "")).First(order, "id = ?", id); result.Error != nil {
+		if result.RecordNotFound() {
+			return notFoundError("Order not found")
+		}
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	if httpErr := a.canAccessOrder(w, r, a.ReadDB(r), order); httpErr != nil {
+		return httpErr
+	}
+
+	settings, err := a.loadSettings(ctx)
+	if err != nil {
+		return internalServerError("%v", err).WithInternalError(err)
+	}
+
+	req := &shipping.QuoteRequest{
+		Package:      shipping.PackageFor(order.LineItems),
+		Destination:  order.ShippingAddress,
+		Currency:     order.Currency,
+		Total:        order.NetTotal + order.Taxes,
+		FreeShipping: order.FreeShipping(),
+		Settings:     settings,
+	}
+	estimate := &shippingEstimate{Package: req.Package, Quotes: []shipping.Quote{}}
+	carriers := gcontext.GetCarriers(ctx)
+	failed := 0
+	for _, carrier := range carriers {
+		quotes, err := carrier.Quote(ctx, req)
+		if err != nil {
+			log.WithError(err).WithField("carrier", carrier.Name()).Warn("Failed to get shipping quotes")
+			failed++
+			continue
+		}
+		estimate.Quotes = append(estimate.Quotes, quotes...)
+	}
+	if failed > 0 && failed == len(carriers) {
+		return serviceUnavailableError("Shipping quotes are currently unavailable, please try again later")
+	}
+
+	return sendJSON(w, http.StatusOK, estimate)
+}
+
+// createCarriers creates the shipping carriers for the configuration. The
+// flat rate carrier quoting the rates of the site settings is always used.
+func createCarriers(c *conf.Configuration) []shipping.Carrier {
+	return []shipping.Carrier{shipping.NewFlatRateCarrier()}
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/shipping"
+)
+
+func TestShippingEstimate(t *testing.T) {
+	settings := calculator.Settings{Shipping: &calculator.ShippingSettings{Rates: []*calculator.ShippingRate{{
+		Type:      calculator.WeightShipping,
+		Countries: []string{"USA"},
+		Tiers: []*calculator.ShippingTier{
+			{MaxWeight: 500, Prices: []*calculator.ShippingPrice{{Amount: "5.00", Currency: "USD"}}},
+			{Prices: []*calculator.ShippingPrice{{Amount: "8.00", Currency: "USD"}}},
+		},
+	}}}}
+	site := startTestSiteWithSettings(settings)
+	defer site.Close()
+
+	createOrder := func(t *testing.T, test *RouteTest) *models.Order {
+		test.Config.SiteURL = site.URL
+		body := strings.Replace(defaultPayload, `"quantity": 1`, `"quantity": 2`, 1)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(body), test.Data.testUserToken)
+
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		require.Len(t, order.LineItems, 1)
+		return order
+	}
+
+	t.Run("Quotes", func(t *testing.T) {
+		test := NewRouteTest(t)
+		order := createOrder(t, test)
+		item := order.LineItems[0]
+		assert.EqualValues(t, 200, item.Length)
+		assert.EqualValues(t, 150, item.Width)
+		assert.EqualValues(t, 30, item.Height)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/"+order.ID+"/shipping_estimate", nil, test.Data.testUserToken)
+		estimate := &shippingEstimate{}
+		extractPayload(t, http.StatusOK, recorder, estimate)
+		assert.Equal(t, shipping.Package{Weight: 1000, Length: 200, Width: 150, Height: 60}, estimate.Package)
+		require.Len(t, estimate.Quotes, 1)
+		assert.Equal(t, shipping.FlatRateCarrier, estimate.Quotes[0].Carrier)
+		assert.EqualValues(t, 800, estimate.Quotes[0].Amount)
+		assert.Equal(t, "USD", estimate.Quotes[0].Currency)
+	})
+
+	t.Run("AsStranger", func(t *testing.T) {
+		test := NewRouteTest(t)
+		order := createOrder(t, test)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/"+order.ID+"/shipping_estimate", nil, testToken("stranger", "stranger@example.com"))
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
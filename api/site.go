@@ -0,0 +1,62 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	gcontext "github.com/netlify/gocommerce/context"
+)
+
+const allSitesParam = "all_sites"
+
+// withSite determines the site a request is made for when multiple sites are
+// served from the same deployment. The site_id in the app metadata of the
+// token takes precedence over the request host.
+func (a *API) withSite(w http.ResponseWriter, r *http.Request) (context.Context, error) {
+	ctx := r.Context()
+	config := gcontext.GetConfig(ctx)
+	if !config.MultiSite {
+		return ctx, nil
+	}
+
+	siteID := ""
+	if claims := gcontext.GetClaims(ctx); claims != nil {
+		siteID, _ = claims.AppMetaData["site_id"].(string)
+	}
+	if siteID == "" {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		siteID = strings.ToLower(host)
+	}
+	if siteID == "" {
+		return nil, badRequestError("Unable to determine the site of the request")
+	}
+	logEntrySetField(r, "site_id", siteID)
+	ctx = gcontext.WithSiteID(ctx, siteID)
+
+	if r.URL.Query().Get(allSitesParam) == "true" {
+		if !gcontext.IsAdmin(ctx) {
+			return nil, unauthorizedError("Admin permissions required to access all sites")
+		}
+		ctx = gcontext.WithAllSites(ctx, true)
+	}
+	return ctx, nil
+}
+
+// siteScope limits a query to the rows of the requesting site, unless an
+// admin explicitly asked for all sites.
+func siteScope(ctx context.Context, query *gorm.DB, table string) *gorm.DB {
+	siteID := gcontext.GetSiteID(ctx)
+	if siteID == "" || gcontext.IsAllSites(ctx) {
+		return query
+	}
+	if table != "" {
+		return query.Where(table+".site_id = ?", siteID)
+	}
+	return query.Where("site_id = ?", siteID)
+}
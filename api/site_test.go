@@ -0,0 +1,227 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/claims"
+	"github.com/netlify/gocommerce/models"
+)
+
+func siteAdminToken(siteID string) *jwt.Token {
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, &claims.JWTClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject: "admin-yo",
+		},
+		Email: "admin@wayneindustries.com",
+		AppMetaData: map[string]interface{}{
+			"roles":   []interface{}{"admin"},
+			"site_id": siteID,
+		},
+	})
+}
+
+func setupSites(t *testing.T) *RouteTest {
+	test := NewRouteTest(t)
+	test.Config.MultiSite = true
+	require.NoError(t, test.DB.Model(test.Data.firstOrder).UpdateColumn("site_id", "example.com").Error)
+	require.NoError(t, test.DB.Model(test.Data.secondOrder).UpdateColumn("site_id", "other.example.com").Error)
+	require.NoError(t, test.DB.Model(test.Data.firstTransaction).UpdateColumn("site_id", "example.com").Error)
+	require.NoError(t, test.DB.Model(test.Data.secondTransaction).UpdateColumn("site_id", "other.example.com").Error)
+	require.NoError(t, test.DB.Model(test.Data.testUser).UpdateColumn("site_id", "example.com").Error)
+	return test
+}
+
+func TestSiteIsolation(t *testing.T) {
+	t.Run("OrderListByHost", func(t *testing.T) {
+		test := setupSites(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodGet, "/users/all/orders", nil, token)
+		orders := []models.Order{}
+		extractPayload(t, http.StatusOK, recorder, &orders)
+		require.Len(t, orders, 1)
+		assert.Equal(t, test.Data.firstOrder.ID, orders[0].ID)
+		assert.Equal(t, "example.com", orders[0].SiteID)
+	})
+
+	t.Run("OrderListByClaim", func(t *testing.T) {
+		test := setupSites(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/users/all/orders", nil, siteAdminToken("other.example.com"))
+		orders := []models.Order{}
+		extractPayload(t, http.StatusOK, recorder, &orders)
+		require.Len(t, orders, 1)
+		assert.Equal(t, test.Data.secondOrder.ID, orders[0].ID)
+	})
+
+	t.Run("AllSites", func(t *testing.T) {
+		test := setupSites(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodGet, "/users/all/orders?all_sites=true", nil, token)
+		orders := []models.Order{}
+		extractPayload(t, http.StatusOK, recorder, &orders)
+		assert.Len(t, orders, 2)
+	})
+
+	t.Run("AllSitesNotAdmin", func(t *testing.T) {
+		test := setupSites(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/orders?all_sites=true", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder, "all sites")
+	})
+
+	t.Run("OrderViewOtherSite", func(t *testing.T) {
+		test := setupSites(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/"+test.Data.secondOrder.ID, nil, token)
+		validateError(t, http.StatusNotFound, recorder)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/orders/"+test.Data.secondOrder.ID+"?all_sites=true", nil, token)
+		extractPayload(t, http.StatusOK, recorder, &models.Order{})
+	})
+
+	t.Run("OrderEndpointsOtherSite", func(t *testing.T) {
+		test := setupSites(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		orderURL := "/orders/" + test.Data.secondOrder.ID
+		requests := []struct {
+			method, url, body string
+		}{
+			{http.MethodPatch, orderURL, `{"email": "joker@example.com"}`},
+			{http.MethodGet, orderURL + "/payments", ""},
+			{http.MethodPost, orderURL + "/payments", `{"provider": "stripe", "stripe_payment_method_id": "pm_1", "amount": 1, "currency": "USD"}`},
+			{http.MethodPost, orderURL + "/payments/" + test.Data.secondTransaction.ID + "/capture", ""},
+			{http.MethodPost, "/payments/" + test.Data.secondTransaction.ID + "/refund", `{"amount": 1, "currency": "USD"}`},
+			{http.MethodGet, orderURL + "/receipt", ""},
+			{http.MethodPost, orderURL + "/receipt", `{"email": "joker@example.com"}`},
+			{http.MethodPost, orderURL + "/resend_confirmation", ""},
+		}
+		for _, req := range requests {
+			recorder := test.TestEndpoint(req.method, req.url, strings.NewReader(req.body), token)
+			validateError(t, http.StatusNotFound, recorder)
+		}
+
+		saved := &models.Order{}
+		require.NoError(t, test.DB.First(saved, "id = ?", test.Data.secondOrder.ID).Error)
+		assert.Equal(t, test.Data.secondOrder.Email, saved.Email)
+	})
+
+	t.Run("UserList", func(t *testing.T) {
+		test := setupSites(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/users", nil, siteAdminToken("other.example.com"))
+		users := []models.User{}
+		extractPayload(t, http.StatusOK, recorder, &users)
+		assert.Empty(t, users)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/users", nil, testAdminToken("admin-yo", "admin@wayneindustries.com"))
+		users = []models.User{}
+		extractPayload(t, http.StatusOK, recorder, &users)
+		require.Len(t, users, 1)
+		assert.Equal(t, test.Data.testUser.ID, users[0].ID)
+	})
+
+	t.Run("UserEndpointsOtherSite", func(t *testing.T) {
+		test := setupSites(t)
+		token := siteAdminToken("other.example.com")
+		userURL := "/users/" + test.Data.testUser.ID
+		requests := []struct {
+			method, url, body string
+		}{
+			{http.MethodGet, userURL, ""},
+			{http.MethodPost, userURL, `{"email": "joker@example.com"}`},
+			{http.MethodGet, userURL + "/export", ""},
+			{http.MethodGet, userURL + "/addresses", ""},
+		}
+		for _, req := range requests {
+			recorder := test.TestEndpoint(req.method, req.url, strings.NewReader(req.body), token)
+			validateError(t, http.StatusNotFound, recorder)
+		}
+
+		// deleting a user that doesn't exist is a no-op
+		recorder := test.TestEndpoint(http.MethodDelete, userURL, nil, token)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		saved := &models.User{}
+		require.NoError(t, test.DB.First(saved, "id = ?", test.Data.testUser.ID).Error)
+		assert.Equal(t, test.Data.testUser.Email, saved.Email)
+
+		recorder = test.TestEndpoint(http.MethodGet, userURL+"?all_sites=true", nil, token)
+		user := &models.User{}
+		extractPayload(t, http.StatusOK, recorder, user)
+		assert.Equal(t, test.Data.testUser.ID, user.ID)
+	})
+
+	t.Run("UserBulkDeleteOtherSite", func(t *testing.T) {
+		test := setupSites(t)
+		recorder := test.TestEndpoint(http.MethodDelete, "/users?id="+test.Data.testUser.ID, nil, siteAdminToken("other.example.com"))
+		results := map[string]*bulkDeleteResult{}
+		extractPayload(t, http.StatusOK, recorder, &results)
+		assert.False(t, results[test.Data.testUser.ID].Success)
+
+		saved := &models.User{}
+		require.NoError(t, test.DB.First(saved, "id = ?", test.Data.testUser.ID).Error)
+	})
+
+	t.Run("OrderNotesOtherSite", func(t *testing.T) {
+		test := setupSites(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		notesURL := "/orders/" + test.Data.secondOrder.ID + "/notes"
+
+		recorder := test.TestEndpoint(http.MethodGet, notesURL, nil, token)
+		validateError(t, http.StatusNotFound, recorder)
+
+		recorder = test.TestEndpoint(http.MethodPost, notesURL, strings.NewReader(`{"text": "Hello"}`), token)
+		validateError(t, http.StatusNotFound, recorder)
+
+		count := 0
+		require.NoError(t, test.DB.Model(&models.OrderNote{}).Where("order_id = ?", test.Data.secondOrder.ID).Count(&count).Error)
+		assert.Equal(t, 0, count)
+
+		recorder = test.TestEndpoint(http.MethodGet, notesURL+"?all_sites=true", nil, token)
+		extractPayload(t, http.StatusOK, recorder, &[]models.OrderNote{})
+	})
+
+	t.Run("GiftCardsOtherSite", func(t *testing.T) {
+		test := setupSites(t)
+		body := strings.NewReader(`{"code": "GOTHAM", "balance": 1000, "currency": "USD"}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/gift_cards", body, siteAdminToken("other.example.com"))
+		card := &models.GiftCard{}
+		extractPayload(t, http.StatusCreated, recorder, card)
+		assert.Equal(t, "other.example.com", card.SiteID)
+
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder = test.TestEndpoint(http.MethodGet, "/gift_cards", nil, token)
+		cards := []models.GiftCard{}
+		extractPayload(t, http.StatusOK, recorder, &cards)
+		assert.Empty(t, cards)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/gift_cards/GOTHAM", nil, token)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+
+	t.Run("PaymentList", func(t *testing.T) {
+		test := setupSites(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodGet, "/payments", nil, token)
+		trans := []models.Transaction{}
+		extractPayload(t, http.StatusOK, recorder, &trans)
+		require.Len(t, trans, 1)
+		assert.Equal(t, test.Data.firstTransaction.ID, trans[0].ID)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/payments/"+test.Data.secondTransaction.ID, nil, token)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		test := setupSites(t)
+		test.Config.MultiSite = false
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodGet, "/users/all/orders", nil, token)
+		orders := []models.Order{}
+		extractPayload(t, http.StatusOK, recorder, &orders)
+		assert.Len(t, orders, 2)
+	})
+}
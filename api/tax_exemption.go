@@ -0,0 +1,105 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+	"github.com/pborman/uuid"
+)
+
+type taxExemptionParams struct {
+	Jurisdiction string     `json:"jurisdiction"`
+	Certificate  string     `json:"certificate"`
+	ValidFrom    *time.Time `json:"valid_from"`
+	ValidUntil   *time.Time `json:"valid_until"`
+}
+
+// TaxExemptionList will return the tax exemption certificates for a given user
+func (a *API) TaxExemptionList(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	userID := gcontext.GetUserID(ctx)
+	user := gcontext.GetUser(ctx)
+	if user == nil {
+		return notFoundError("Couldn't find a record for " + userID)
+	}
+
+	exemptions := []models.TaxExemption{}
+	results := a.ReadDB(r).Where("user_id = ?", userID).Order("created_at asc").Find(&exemptions)
+	if results.Error != nil {
+		return internalServerError("problem while querying for userID: %s", userID).WithInternalError(results.Error)
+	}
+
+	return sendJSON(w, http.StatusOK, &exemptions)
+}
+
+// TaxExemptionCreate will add a tax exemption certificate for a user. It requires admin access
+func (a *API) TaxExemptionCreate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	userID := gcontext.GetUserID(ctx)
+	user := gcontext.GetUser(ctx)
+	if user == nil {
+		return notFoundError("Couldn't find a record for " + userID)
+	}
+
+	params := new(taxExemptionParams)
+	if err := decodeJSON(r, params); err != nil {
+		return badRequestError("Failed to parse json body: %v", err)
+	}
+	if params.Jurisdiction == "" {
+		return badRequestError("A tax exemption requires a jurisdiction")
+	}
+	if params.Certificate == "" {
+		return badRequestError("A tax exemption requires a certificate reference")
+	}
+	if params.ValidFrom != nil && params.ValidUntil != nil && !params.ValidUntil.After(*params.ValidFrom) {
+		return badRequestError("A tax exemption must be valid until after it becomes valid")
+	}
+
+	exemption := &models.TaxExemption{
+		InstanceID:   gcontext.GetInstanceID(ctx),
+		ID:           uuid.NewRandom().String(),
+		UserID:       userID,
+		Jurisdiction: params.Jurisdiction,
+		Certificate:  params.Certificate,
+		ValidFrom:    params.ValidFrom,
+		ValidUntil:   params.ValidUntil,
+	}
+	if rsp := a.DB(r).Create(exemption); rsp.Error != nil {
+		return internalServerError("failed to save tax exemption").WithInternalError(rsp.Error)
+	}
+
+	getLogEntry(r).WithField("exemption_id", exemption.ID).Info("created tax exemption")
+	return sendJSON(w, http.StatusCreated, exemption)
+}
+
+// TaxExemptionRevoke will revoke a tax exemption certificate of a user. It requires admin access.
+// Revoked exemptions are kept for reference but no longer apply to new orders.
+func (a *API) TaxExemptionRevoke(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	userID := gcontext.GetUserID(ctx)
+	exemptionID := chi.URLParam(r, "exemption_id")
+	log := getLogEntry(r).WithField("exemption_id", exemptionID)
+
+	db := a.DB(r)
+	exemption := &models.TaxExemption{}
+	if rsp := db.First(exemption, "id = ? AND user_id = ?", exemptionID, userID); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return notFoundError("Tax exemption not found")
+		}
+		return internalServerError("problem while querying for tax exemption").WithInternalError(rsp.Error)
+	}
+
+	if exemption.RevokedAt == nil {
+		now := time.Now()
+		exemption.RevokedAt = &now
+		if rsp := db.Save(exemption); rsp.Error != nil {
+			return internalServerError("failed to revoke tax exemption").WithInternalError(rsp.Error)
+		}
+		log.Info("revoked tax exemption")
+	}
+
+	return sendJSON(w, http.StatusOK, exemption)
+}
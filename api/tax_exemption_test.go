@@ -0,0 +1,133 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+const germanOrderPayload = `{
+	"email": "info@example.com",
+	"shipping_address": {
+		"name": "Test User",
+		"address1": "Branengebranen",
+		"city": "Berlin", "country": "Germany", "zip": "94107"
+	},
+	"line_items": [{"path": "/simple-product", "quantity": 1}]
+}`
+
+func createTaxExemption(test *RouteTest, jurisdiction string) *models.TaxExemption {
+	exemption := &models.TaxExemption{
+		ID:           "exemption-" + strings.ToLower(jurisdiction),
+		UserID:       test.Data.testUser.ID,
+		Jurisdiction: jurisdiction,
+		Certificate:  "resale-123",
+	}
+	require.NoError(test.T, test.DB.Create(exemption).Error)
+	return exemption
+}
+
+func TestTaxExemptionCreate(t *testing.T) {
+	t.Run("AsAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		url := "/users/" + test.Data.testUser.ID + "/tax_exemptions"
+		body := strings.NewReader(`{"jurisdiction": "Germany", "certificate": "resale-123", "valid_until": "2099-01-01T00:00:00Z"}`)
+		recorder := test.TestEndpoint(http.MethodPost, url, body, testAdminToken("magical-unicorn", ""))
+
+		exemption := &models.TaxExemption{}
+		extractPayload(t, http.StatusCreated, recorder, exemption)
+		assert.NotEmpty(t, exemption.ID)
+		assert.Equal(t, test.Data.testUser.ID, exemption.UserID)
+		assert.Equal(t, "Germany", exemption.Jurisdiction)
+		assert.Equal(t, "resale-123", exemption.Certificate)
+		require.NotNil(t, exemption.ValidUntil)
+
+		stored := &models.TaxExemption{}
+		require.NoError(t, test.DB.First(stored, "id = ?", exemption.ID).Error)
+		assert.True(t, stored.Active(time.Now()))
+	})
+	t.Run("AsUser", func(t *testing.T) {
+		test := NewRouteTest(t)
+		url := "/users/" + test.Data.testUser.ID + "/tax_exemptions"
+		body := strings.NewReader(`{"jurisdiction": "Germany", "certificate": "resale-123"}`)
+		recorder := test.TestEndpoint(http.MethodPost, url, body, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+	t.Run("MissingCertificate", func(t *testing.T) {
+		test := NewRouteTest(t)
+		url := "/users/" + test.Data.testUser.ID + "/tax_exemptions"
+		body := strings.NewReader(`{"jurisdiction": "Germany"}`)
+		recorder := test.TestEndpoint(http.MethodPost, url, body, testAdminToken("magical-unicorn", ""))
+		validateError(t, http.StatusBadRequest, recorder, "certificate")
+	})
+}
+
+func TestTaxExemptionRevoke(t *testing.T) {
+	test := NewRouteTest(t)
+	exemption := createTaxExemption(test, "Germany")
+	url := "/users/" + test.Data.testUser.ID + "/tax_exemptions/" + exemption.ID
+	recorder := test.TestEndpoint(http.MethodDelete, url, nil, testAdminToken("magical-unicorn", ""))
+
+	rsp := &models.TaxExemption{}
+	extractPayload(t, http.StatusOK, recorder, rsp)
+	require.NotNil(t, rsp.RevokedAt)
+
+	recorder = test.TestEndpoint(http.MethodGet, "/users/"+test.Data.testUser.ID+"/tax_exemptions", nil, test.Data.testUserToken)
+	list := []models.TaxExemption{}
+	extractPayload(t, http.StatusOK, recorder, &list)
+	require.Len(t, list, 1)
+	assert.False(t, list[0].Active(time.Now()))
+}
+
+func TestTaxExemptOrder(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+
+	t.Run("Exempt", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		exemption := createTaxExemption(test, "Germany")
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(germanOrderPayload), test.Data.testUserToken)
+
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Equal(t, exemption.ID, order.TaxExemptionID)
+		assert.Equal(t, uint64(0), order.Taxes)
+		assert.Equal(t, uint64(999), order.Total)
+	})
+
+	t.Run("OtherJurisdiction", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		createTaxExemption(test, "USA")
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(germanOrderPayload), test.Data.testUserToken)
+
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Empty(t, order.TaxExemptionID)
+		assert.Equal(t, uint64(70), order.Taxes)
+		assert.Equal(t, uint64(1069), order.Total)
+	})
+
+	t.Run("NotExempt", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		createTaxExemption(test, "Germany")
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(germanOrderPayload), testToken("someone-else", "else@example.com"))
+
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Empty(t, order.TaxExemptionID)
+		assert.Equal(t, uint64(70), order.Taxes)
+		assert.Equal(t, uint64(1069), order.Total)
+	})
+}
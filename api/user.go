@@ -3,15 +3,21 @@ package api
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
 
+	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/go-chi/chi"
 	"github.com/jinzhu/gorm"
 	"github.com/pborman/uuid"
 
 	"github.com/netlify/gocommerce/claims"
 	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/mailer"
 	"github.com/netlify/gocommerce/models"
 )
 
@@ -20,7 +26,7 @@ func (a *API) withUser(w http.ResponseWriter, r *http.Request) (context.Context,
 	logEntrySetField(r, "user_id", userID)
 	ctx := r.Context()
 
-	if u, err := models.GetUser(a.DB(r), userID); err != nil {
+	if u, err := models.GetUser(siteScope(ctx, a.DB(r), ""), userID); err != nil {
 		return nil, internalServerError("problem while querying for userID: %s", userID).WithInternalError(err)
 	} else if u != nil {
 		ctx = gcontext.WithUser(ctx, u)
@@ -81,7 +87,7 @@ func persistUserName(tx *gorm.DB, order *models.Order, claims *claims.JWTClaims)
 // limit     # of records to return (max)
 func (a *API) UserList(w http.ResponseWriter, r *http.Request) error {
 	log := getLogEntry(r)
-	db := a.DB(r)
+	db := a.ReadDB(r)
 
 	query, err := parseUserQueryParams(db, r.URL.Query())
 	if err != nil {
@@ -97,6 +103,7 @@ func (a *API) UserList(w http.ResponseWriter, r *http.Request) error {
 
 	instanceID := gcontext.GetInstanceID(r.Context())
 	query = query.Where(userTable+".instance_id = ?", instanceID)
+	query = siteScope(r.Context(), query, userTable)
 
 	offset, limit, err := paginate(w, r, query.Model(&models.User{}))
 	if err != nil {
@@ -112,6 +119,7 @@ func (a *API) UserList(w http.ResponseWriter, r *http.Request) error {
 		userTable + ".*")
 
 	users := []models.User{}
+	query = query.Order(userTable + ".created_at desc").Order(userTable + ".id")
 	if err := query.Offset(offset).Limit(limit).Find(&users).Error; err != nil {
 		return internalServerError("Failed to execute request").WithInternalError(err)
 	}
@@ -132,8 +140,123 @@ func (a *API) UserView(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	orders := []models.Order{}
-	a.DB(r).Where("user_id = ?", user.ID).Find(&orders).Count(&user.OrderCount)
+	a.ReadDB(r).Where("user_id = ?", user.ID).Find(&orders).Count(&user.OrderCount)
 
+	// the order count changes without updating the user
+	etag := fmt.Sprintf(`"%s-%d"`, strconv.FormatInt(user.UpdatedAt.UnixNano(), 36), user.OrderCount)
+	if notModified(w, r, etag) {
+		return sendNotModified(w)
+	}
+	return sendJSON(w, http.StatusOK, user)
+}
+
+type userUpdateParams struct {
+	Email  *string `json:"email"`
+	Name   *string `json:"name"`
+	Locale *string `json:"locale"`
+
+	DefaultBillingAddressID  *string `json:"default_billing_address_id"`
+	DefaultShippingAddressID *string `json:"default_shipping_address_id"`
+}
+
+// UserUpdate updates the profile of a user. Users can update themselves and
+// admins can update anyone. Emails must be valid and can't be used by another
+// user, and default addresses must belong to the user.
+func (a *API) UserUpdate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	userID := gcontext.GetUserID(ctx)
+	user := gcontext.GetUser(ctx)
+	if user == nil {
+		return notFoundError("Couldn't find a record for " + userID)
+	}
+	log := getLogEntry(r)
+	config := gcontext.GetConfig(ctx)
+
+	params := &userUpdateParams{}
+	if err := decodeJSON(r, params); err != nil {
+		return badRequestError("Could not read User params: %v", err)
+	}
+
+	db := a.DB(r)
+	before := *user
+	if params.Email != nil {
+		email := strings.TrimSpace(*params.Email)
+		if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+			return badRequestError("Invalid email: %v", *params.Email)
+		}
+		if !strings.EqualFold(email, user.Email) {
+			if c := gcontext.GetClaims(ctx); c != nil && c.Impersonated() {
+				return unauthorizedError("The email can't be changed while impersonating the user")
+			}
+			var count int64
+			query := db.Model(&models.User{}).Where("instance_id = ? AND id != ? AND LOWER(email) = ?", user.InstanceID, user.ID, strings.ToLower(email))
+			if rsp := query.Count(&count); rsp.Error != nil {
+				return internalServerError("Error checking the email").WithInternalError(rsp.Error)
+			}
+			if count > 0 {
+				return conflictError("The email %v is already used by another user", email)
+			}
+		}
+		user.Email = email
+	}
+	if params.Name != nil {
+		user.Name = strings.TrimSpace(*params.Name)
+	}
+	if params.Locale != nil {
+		user.Locale = ""
+		if *params.Locale != "" {
+			locale, err := mailer.NormalizeLocale(*params.Locale)
+			if err != nil {
+				return badRequestError("%v", err)
+			}
+			user.Locale = locale
+		}
+	}
+
+	defaults := []struct {
+		name   string
+		param  *string
+		target *string
+	}{
+		{"billing", params.DefaultBillingAddressID, &user.DefaultBillingAddressID},
+		{"shipping", params.DefaultShippingAddressID, &user.DefaultShippingAddressID},
+	}
+	for _, d := range defaults {
+		if d.param == nil {
+			continue
+		}
+		if *d.param != *d.target {
+			if c := gcontext.GetClaims(ctx); c != nil && c.Impersonated() {
+				return unauthorizedError("The default addresses can't be changed while impersonating the user")
+			}
+		}
+		if *d.param != "" {
+			addr := &models.Address{}
+			if rsp := db.First(addr, "id = ? AND user_id = ?", *d.param, user.ID); rsp.RecordNotFound() {
+				return badRequestError("The default %v address %v doesn't belong to the user", d.name, *d.param)
+			} else if rsp.Error != nil {
+				return internalServerError("Error loading the default %v address", d.name).WithInternalError(rsp.Error)
+			}
+		}
+		*d.target = *d.param
+	}
+
+	tx := db.Begin()
+	if rsp := tx.Save(user); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error saving user").WithInternalError(rsp.Error)
+	}
+	if err := models.RunHooks(tx, config, user.InstanceID, "user_updated", config.Webhooks.UserUpdated, user.ID, user); err != nil {
+		log.WithError(err).Error("Failed to process web hook")
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error saving user").WithInternalError(rsp.Error)
+	}
+	if gcontext.HasPermission(ctx, claims.UsersWrite) {
+		a.audit(r, models.AuditUserUpdate, user.ID, &before, user)
+	}
+
+	log.Infof("Updated user")
 	return sendJSON(w, http.StatusOK, user)
 }
 
@@ -179,6 +302,10 @@ func (a *API) AddressView(w http.ResponseWriter, r *http.Request) error {
 
 // UserDelete will soft delete the user. It requires admin access
 // return errors or 200 and no body
+//
+// Users with paid orders that haven't shipped yet are only deleted with
+// ?force=true. With ?anonymize=true the personal data of the user is removed
+// instead, but their orders and transactions are kept.
 func (a *API) UserDelete(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	userID := gcontext.GetUserID(ctx)
@@ -191,16 +318,130 @@ func (a *API) UserDelete(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
-	rsp := a.DB(r).Delete(user)
-	if rsp.Error != nil {
+	if httpErr := a.deleteUser(r, a.DB(r), user); httpErr != nil {
+		return httpErr
+	}
+	return nil
+}
+
+// deleteUser soft deletes a user, or only removes their personal data with
+// ?anonymize=true. Users with paid orders that haven't shipped yet are only
+// deleted with ?force=true, otherwise a conflict error is returned.
+func (a *API) deleteUser(r *http.Request, db *gorm.DB, user *models.User) *HTTPError {
+	log := getLogEntry(r).WithField("user_id", user.ID)
+	query := r.URL.Query()
+	if query.Get("force") != "true" {
+		open, err := user.OpenOrderCount(db)
+		if err != nil {
+			return internalServerError("error while counting open orders").WithInternalError(err)
+		}
+		if open > 0 {
+			return conflictError("User has %d paid orders that haven't shipped yet, use ?force=true to delete the user anyway", open)
+		}
+	}
+
+	if query.Get("anonymize") == "true" {
+		tx := db.Begin()
+		payload := &userDeletedPayload{UserID: user.ID, Anonymized: true}
+		if err := user.Anonymize(tx); err != nil {
+			tx.Rollback()
+			return internalServerError("error while anonymizing user").WithInternalError(err)
+		}
+		if err := runUserDeletedHooks(r, tx, user, payload); err != nil {
+			tx.Rollback()
+			return internalServerError("Failed to process webhook").WithInternalError(err)
+		}
+		if rsp := tx.Commit(); rsp.Error != nil {
+			return internalServerError("error while anonymizing user").WithInternalError(rsp.Error)
+		}
+		a.audit(r, models.AuditUserAnonymize, user.ID, nil, nil)
+
+		log.Infof("Anonymized user")
+		return nil
+	}
+
+	tx := db.Begin()
+	if rsp := tx.Delete(user); rsp.Error != nil {
+		tx.Rollback()
 		return internalServerError("error while deleting user").WithInternalError(rsp.Error)
 	}
+	if err := runUserDeletedHooks(r, tx, user, &userDeletedPayload{UserID: user.ID}); err != nil {
+		tx.Rollback()
+		return internalServerError("Failed to process webhook").WithInternalError(err)
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("error while deleting user").WithInternalError(rsp.Error)
+	}
+	a.audit(r, models.AuditUserDelete, user.ID, user, nil)
 
 	log.Infof("Deleted user")
 	return nil
 }
 
+// userDeletedPayload tells downstream systems to erase a user. Anonymized
+// users are kept without their personal data, others are soft deleted. It
+// only identifies the user, so the webhook doesn't spread their personal data.
+type userDeletedPayload struct {
+	UserID     string `json:"user_id"`
+	Anonymized bool   `json:"anonymized"`
+}
+
+// runUserDeletedHooks queues the user deleted webhook within the transaction
+// of the deletion, so it's only sent if the user is deleted.
+func runUserDeletedHooks(r *http.Request, tx *gorm.DB, user *models.User, payload *userDeletedPayload) error {
+	config := gcontext.GetConfig(r.Context())
+	return models.RunHooks(tx, config, user.InstanceID, "user_deleted", config.Webhooks.UserDeleted, user.ID, payload)
+}
+
+// impersonationTTL is how long an impersonation token is valid.
+const impersonationTTL = 15 * time.Minute
+
+type impersonationResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// UserImpersonate mints a short-lived token for a user, so support agents can
+// see the store as the user sees it. It requires admin access. The token
+// doesn't carry the roles of the admin and is marked as impersonation.
+func (a *API) UserImpersonate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	userID := gcontext.GetUserID(ctx)
+	user := gcontext.GetUser(ctx)
+	if user == nil {
+		return notFoundError("Couldn't find a record for " + userID)
+	}
+	config := gcontext.GetConfig(ctx)
+	if config.JWT.Method == jwt.SigningMethodRS256.Name {
+		return badRequestError("Impersonation tokens can't be signed with %s", config.JWT.Method)
+	}
+
+	admin := gcontext.GetClaims(ctx)
+	expiresAt := time.Now().Add(impersonationTTL)
+	token, err := claims.NewImpersonationToken(user.ID, user.Email, admin.Subject, config.JWT.Issuer, config.JWT.Audience, config.JWT.Secret, impersonationTTL)
+	if err != nil {
+		return internalServerError("Error signing the impersonation token").WithInternalError(err)
+	}
+	a.audit(r, models.AuditUserImpersonate, user.ID, nil, map[string]interface{}{"expires_at": expiresAt})
+
+	getLogEntry(r).Infof("Impersonating user")
+	return sendJSON(w, http.StatusOK, &impersonationResponse{
+		Token:     token,
+		ExpiresAt: expiresAt,
+	})
+}
+
+type bulkDeleteResult struct {
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// UserBulkDelete deletes the users with the IDs given as "?id=". It takes the
+// same ?force=true and ?anonymize=true parameters as UserDelete. Each user is
+// deleted in its own transaction, and the users that are skipped are reported
+// with the reason. It requires admin access.
 func (a *API) UserBulkDelete(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
 	log := getLogEntry(r)
 	db := a.DB(r)
 
@@ -208,31 +449,27 @@ func (a *API) UserBulkDelete(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return badRequestError("Bad parameters in query: %v", err)
 	}
+	query = siteScope(ctx, query.Where("instance_id = ?", gcontext.GetInstanceID(ctx)), "")
 
 	users := []models.User{}
 	if result := query.Find(&users); result.Error != nil {
 		return internalServerError("error while deleting user").WithInternalError(result.Error)
 	}
 
-	tx := db.Begin()
-	defer func() {
-		if r := recover(); r != nil {
-			tx.Rollback()
-		}
-	}()
-
-	for _, user := range users {
-		if result := tx.Delete(&user); result.Error != nil {
-			if result.RecordNotFound() {
-				continue
-			}
-			tx.Rollback()
-			return internalServerError("error while deleting user").WithInternalError(result.Error)
+	results := make(map[string]*bulkDeleteResult, len(users))
+	for _, id := range r.URL.Query()["id"] {
+		results[id] = &bulkDeleteResult{Error: "User not found"}
+	}
+	for i := range users {
+		result := &bulkDeleteResult{Success: true}
+		if httpErr := a.deleteUser(r, db, &users[i]); httpErr != nil {
+			result = &bulkDeleteResult{Error: httpErr.Message}
 		}
+		results[users[i].ID] = result
 	}
 
 	log.Infof("Deleted users")
-	return tx.Commit().Error
+	return sendJSON(w, http.StatusOK, results)
 }
 
 // AddressDelete will soft delete the address associated with that user. It requires admin access
@@ -248,11 +485,24 @@ func (a *API) AddressDelete(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
-	rsp := a.DB(r).Delete(&models.Address{ID: addrID})
+	tx := a.DB(r).Begin()
+	rsp := tx.Delete(&models.Address{ID: addrID})
 	if rsp.RecordNotFound() {
+		tx.Rollback()
 		log.Warn("Attempted to delete an address that doesn't exist")
 		return nil
 	} else if rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("error while deleting address").WithInternalError(rsp.Error)
+	}
+	for _, column := range []string{"default_billing_address_id", "default_shipping_address_id"} {
+		rsp := tx.Model(&models.User{}).Where("id = ? AND "+column+" = ?", user.ID, addrID).UpdateColumn(column, "")
+		if rsp.Error != nil {
+			tx.Rollback()
+			return internalServerError("error while clearing default address").WithInternalError(rsp.Error)
+		}
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
 		return internalServerError("error while deleting address").WithInternalError(rsp.Error)
 	}
 
@@ -260,7 +510,9 @@ func (a *API) AddressDelete(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
-// CreateNewAddress will create an address associated with that user
+// CreateNewAddress will create an address associated with that user. With
+// ?default=true it becomes the default billing and shipping address of the
+// user, ?default=billing or ?default=shipping only set one of them.
 func (a *API) CreateNewAddress(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	userID := gcontext.GetUserID(ctx)
@@ -269,8 +521,21 @@ func (a *API) CreateNewAddress(w http.ResponseWriter, r *http.Request) error {
 		return notFoundError("Couldn't find a record for " + userID)
 	}
 
+	defaultBilling, defaultShipping := false, false
+	switch def := r.URL.Query().Get("default"); def {
+	case "", "false":
+	case "true":
+		defaultBilling, defaultShipping = true, true
+	case "billing":
+		defaultBilling = true
+	case "shipping":
+		defaultShipping = true
+	default:
+		return badRequestError("Invalid value for default: %v", def)
+	}
+
 	addrReq := new(models.AddressRequest)
-	err := json.NewDecoder(r.Body).Decode(addrReq)
+	err := decodeJSON(r, addrReq)
 	if err != nil {
 		return badRequestError("Failed to parse json body: %v", err)
 	}
@@ -284,8 +549,28 @@ func (a *API) CreateNewAddress(w http.ResponseWriter, r *http.Request) error {
 		ID:             uuid.NewRandom().String(),
 		UserID:         userID,
 	}
-	rsp := a.DB(r).Create(&addr)
-	if rsp.Error != nil {
+	tx := a.DB(r).Begin()
+	if rsp := tx.Create(&addr); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("failed to save address").WithInternalError(rsp.Error)
+	}
+	if defaultBilling {
+		user.DefaultBillingAddressID = addr.ID
+	}
+	if defaultShipping {
+		user.DefaultShippingAddressID = addr.ID
+	}
+	if defaultBilling || defaultShipping {
+		rsp := tx.Model(user).UpdateColumns(map[string]interface{}{
+			"default_billing_address_id":  user.DefaultBillingAddressID,
+			"default_shipping_address_id": user.DefaultShippingAddressID,
+		})
+		if rsp.Error != nil {
+			tx.Rollback()
+			return internalServerError("failed to set default address").WithInternalError(rsp.Error)
+		}
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
 		return internalServerError("failed to save address").WithInternalError(rsp.Error)
 	}
 
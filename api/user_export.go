@@ -0,0 +1,154 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+const exportBatchSize = 100
+
+// UserExport sends everything stored about a user as one JSON document: the
+// profile, addresses, orders with their line items and the transactions.
+// Orders and transactions are loaded and written in batches, so exporting a
+// long order history doesn't hold it in memory.
+func (a *API) UserExport(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	userID := gcontext.GetUserID(ctx)
+	user := gcontext.GetUser(ctx)
+	if user == nil {
+		return notFoundError("Couldn't find a record for " + userID)
+	}
+	log := getLogEntry(r)
+	db := a.ReadDB(r)
+
+	addrs := []models.Address{}
+	if result := db.Where("user_id = ?", user.ID).Find(&addrs); result.Error != nil {
+		return internalServerError("problem while querying for userID: %s", userID).WithInternalError(result.Error)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="user-%s.json"`, user.ID))
+	w.WriteHeader(http.StatusOK)
+
+	s := &exportStream{w: w}
+	s.field("exported_at", time.Now())
+	s.field("user", user)
+	s.field("addresses", addrs)
+	s.list("orders", func(offset int) ([]interface{}, error) {
+		orders := []*models.Order{}
+		query := orderQuery(db).Where("user_id = ?", user.ID).Order("created_at asc, id asc")
+		if result := query.Offset(offset).Limit(exportBatchSize).Find(&orders); result.Error != nil {
+			return nil, result.Error
+		}
+		items := make([]interface{}, len(orders))
+		for i, order := range orders {
+			items[i] = order
+		}
+		return items, nil
+	})
+	s.list("transactions", func(offset int) ([]interface{}, error) {
+		transactions := []*models.Transaction{}
+		query := db.Where("user_id = ?", user.ID).Order("created_at asc, id asc")
+		if result := query.Offset(offset).Limit(exportBatchSize).Find(&transactions); result.Error != nil {
+			return nil, result.Error
+		}
+		items := make([]interface{}, len(transactions))
+		for i, transaction := range transactions {
+			items[i] = transaction
+		}
+		return items, nil
+	})
+	s.end()
+
+	// The response has already started, so errors can only be logged. The
+	// document is left incomplete, which makes it invalid JSON.
+	if s.err != nil {
+		log.WithError(s.err).Error("Failed to export user")
+		return nil
+	}
+	log.Infof("Exported user")
+	return nil
+}
+
+// exportStream writes a JSON object field by field.
+type exportStream struct {
+	w      io.Writer
+	fields int
+	err    error
+}
+
+func (s *exportStream) write(b []byte) {
+	if s.err == nil {
+		_, s.err = s.w.Write(b)
+	}
+}
+
+func (s *exportStream) value(v interface{}) {
+	if s.err != nil {
+		return
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		s.err = err
+		return
+	}
+	s.write(b)
+}
+
+func (s *exportStream) key(name string) {
+	if s.fields == 0 {
+		s.write([]byte("{"))
+	} else {
+		s.write([]byte(","))
+	}
+	s.fields++
+	s.value(name)
+	s.write([]byte(":"))
+}
+
+func (s *exportStream) field(name string, v interface{}) {
+	s.key(name)
+	s.value(v)
+}
+
+// list writes a list field batch by batch. next loads the batch starting at
+// the offset, and the list ends with the first batch that isn't full. Every
+// batch is flushed to the client right away.
+func (s *exportStream) list(name string, next func(offset int) ([]interface{}, error)) {
+	s.key(name)
+	s.write([]byte("["))
+	for offset := 0; s.err == nil; {
+		items, err := next(offset)
+		if err != nil {
+			s.err = err
+			return
+		}
+		for i, item := range items {
+			if offset+i > 0 {
+				s.write([]byte(","))
+			}
+			s.value(item)
+		}
+		if flusher, ok := s.w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		if len(items) < exportBatchSize {
+			break
+		}
+		offset += len(items)
+	}
+	s.write([]byte("]"))
+}
+
+func (s *exportStream) end() {
+	if s.fields == 0 {
+		s.write([]byte("{"))
+	}
+	s.write([]byte("}"))
+}
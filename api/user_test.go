@@ -5,11 +5,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 	"testing"
+	"time"
 
+	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/netlify/gocommerce/claims"
 	"github.com/netlify/gocommerce/models"
 )
 
@@ -84,6 +88,51 @@ func TestUsersList(t *testing.T) {
 		require.Len(t, users, 1)
 		validatePagination(t, recorder, reqUrl, 2, 1, 1, 2)
 	})
+	t.Run("WithLimitAndOffset", func(t *testing.T) {
+		test := NewRouteTest(t)
+		createUser(test, "villian", "twoface@dc.com", "Harvey Dent")
+		createUser(test, "cop", "james.gordon@dc.com", "James Gordon")
+
+		token := testAdminToken("magical-unicorn", "")
+		seen := map[string]bool{}
+		for offset := 0; offset < 3; offset++ {
+			recorder := test.TestEndpoint(http.MethodGet, fmt.Sprintf("/users?limit=1&offset=%d", offset), nil, token)
+
+			users := []models.User{}
+			extractPayload(t, http.StatusOK, recorder, &users)
+			require.Len(t, users, 1)
+			assert.Equal(t, "3", recorder.Header().Get("X-Total-Count"))
+			seen[users[0].ID] = true
+		}
+		assert.Len(t, seen, 3)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/users?limit=-1", nil, token)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+	t.Run("WithCreatedRange", func(t *testing.T) {
+		test := NewRouteTest(t)
+		villian := createUser(test, "villian", "twoface@dc.com", "Harvey Dent")
+		created := time.Now().Add(24 * time.Hour)
+		require.NoError(t, test.DB.Model(villian).UpdateColumn("created_at", created).Error)
+
+		token := testAdminToken("magical-unicorn", "")
+		url := fmt.Sprintf("/users?created_from=%d", created.Add(-time.Minute).Unix())
+		recorder := test.TestEndpoint(http.MethodGet, url, nil, token)
+
+		users := []models.User{}
+		extractPayload(t, http.StatusOK, recorder, &users)
+		require.Len(t, users, 1)
+		assert.Equal(t, "villian", users[0].ID)
+
+		url = fmt.Sprintf("/users?created_to=%d", created.Add(-time.Minute).Unix())
+		recorder = test.TestEndpoint(http.MethodGet, url, nil, token)
+		extractPayload(t, http.StatusOK, recorder, &users)
+		require.Len(t, users, 1)
+		assert.Equal(t, test.Data.testUser.ID, users[0].ID)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/users?created_from=yesterday", nil, token)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
 	t.Run("MultipleIDs", func(t *testing.T) {
 		test := NewRouteTest(t)
 		createUser(test, "villan", "twoface@dc.com", "Harvey Dent")
@@ -151,6 +200,28 @@ func TestUsersView(t *testing.T) {
 		recorder := test.TestEndpoint(http.MethodGet, "/users/"+toDie.ID, nil, token)
 		validateError(t, http.StatusNotFound, recorder)
 	})
+	t.Run("NotModified", func(t *testing.T) {
+		test := NewRouteTest(t)
+		url := "/users/" + test.Data.testUser.ID
+		token := test.Data.testUserToken
+		recorder := test.TestEndpoint(http.MethodGet, url, nil, token)
+		extractPayload(t, http.StatusOK, recorder, new(models.User))
+		etag := recorder.Header().Get("ETag")
+		require.NotEmpty(t, etag)
+
+		recorder = test.TestEndpointWithHeaders(http.MethodGet, url, nil, token, map[string]string{"If-None-Match": `"other", ` + etag})
+		assert.Equal(t, http.StatusNotModified, recorder.Code)
+		assert.Empty(t, recorder.Body.String())
+
+		// a new order changes the order count of the user
+		order := models.NewOrder("", "session3", test.Data.testUser.Email, "USD")
+		order.UserID = test.Data.testUser.ID
+		require.NoError(t, test.DB.Create(order).Error)
+		recorder = test.TestEndpointWithHeaders(http.MethodGet, url, nil, token, map[string]string{"If-None-Match": etag})
+		user := new(models.User)
+		extractPayload(t, http.StatusOK, recorder, user)
+		assert.NotEqual(t, etag, recorder.Header().Get("ETag"))
+	})
 }
 
 func TestUserAddressesList(t *testing.T) {
@@ -233,6 +304,111 @@ func TestUserAddressView(t *testing.T) {
 	})
 }
 
+func TestUserUpdate(t *testing.T) {
+	t.Run("AsUser", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Webhooks.UserUpdated = "https://example.com/user"
+		url := "/users/" + test.Data.testUser.ID
+		body := strings.NewReader(`{"email": "bruce@wayneindustries.com", "name": "The Batman", "locale": "fr_ca"}`)
+		recorder := test.TestEndpoint(http.MethodPost, url, body, test.Data.testUserToken)
+
+		user := &models.User{}
+		extractPayload(t, http.StatusOK, recorder, user)
+		assert.Equal(t, "bruce@wayneindustries.com", user.Email)
+		assert.Equal(t, "The Batman", user.Name)
+		assert.Equal(t, "fr-CA", user.Locale)
+
+		saved := &models.User{}
+		require.NoError(t, test.DB.First(saved, "id = ?", test.Data.testUser.ID).Error)
+		assert.Equal(t, "bruce@wayneindustries.com", saved.Email)
+
+		hooks := []models.Hook{}
+		require.NoError(t, test.DB.Where("type = ?", "user_updated").Find(&hooks).Error)
+		assert.Len(t, hooks, 1)
+	})
+	t.Run("AsStranger", func(t *testing.T) {
+		test := NewRouteTest(t)
+		url := "/users/" + test.Data.testUser.ID
+		body := strings.NewReader(`{"name": "Joker"}`)
+		recorder := test.TestEndpoint(http.MethodPost, url, body, testToken("magical-unicorn", ""))
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+	t.Run("AsAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		url := "/users/" + test.Data.testUser.ID
+		body := strings.NewReader(`{"name": "Bruce"}`)
+		recorder := test.TestEndpoint(http.MethodPost, url, body, testAdminToken("admin-yo", "admin@wayneindustries.com"))
+
+		user := &models.User{}
+		extractPayload(t, http.StatusOK, recorder, user)
+		assert.Equal(t, "Bruce", user.Name)
+		assert.Equal(t, test.Data.testUser.Email, user.Email)
+
+		entries := []models.AuditLog{}
+		require.NoError(t, test.DB.Where("action = ?", models.AuditUserUpdate).Find(&entries).Error)
+		assert.Len(t, entries, 1)
+	})
+	t.Run("InvalidEmail", func(t *testing.T) {
+		test := NewRouteTest(t)
+		url := "/users/" + test.Data.testUser.ID
+		body := strings.NewReader(`{"email": "Bruce Wayne <bruce@wayneindustries.com>"}`)
+		recorder := test.TestEndpoint(http.MethodPost, url, body, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "Invalid email")
+	})
+	t.Run("EmailTaken", func(t *testing.T) {
+		test := NewRouteTest(t)
+		createUser(test, "villian", "twoface@dc.com", "Harvey Dent")
+		url := "/users/" + test.Data.testUser.ID
+		body := strings.NewReader(`{"email": "TwoFace@dc.com"}`)
+		recorder := test.TestEndpoint(http.MethodPost, url, body, test.Data.testUserToken)
+		validateError(t, http.StatusConflict, recorder, "already used")
+	})
+}
+
+func TestUserExport(t *testing.T) {
+	t.Run("AsUser", func(t *testing.T) {
+		test := NewRouteTest(t)
+		url := "/users/" + test.Data.testUser.ID + "/export"
+		recorder := test.TestEndpoint(http.MethodGet, url, nil, test.Data.testUserToken)
+		assert.Contains(t, recorder.Header().Get("Content-Disposition"), "attachment")
+
+		export := struct {
+			User         models.User          `json:"user"`
+			Addresses    []models.Address     `json:"addresses"`
+			Orders       []models.Order       `json:"orders"`
+			Transactions []models.Transaction `json:"transactions"`
+		}{}
+		extractPayload(t, http.StatusOK, recorder, &export)
+		validateUser(t, test.Data.testUser, &export.User)
+		assert.NotEmpty(t, export.Addresses)
+
+		ids := []string{}
+		for _, order := range export.Orders {
+			assert.Equal(t, test.Data.testUser.ID, order.UserID)
+			ids = append(ids, order.ID)
+		}
+		require.Contains(t, ids, test.Data.firstOrder.ID)
+		for _, order := range export.Orders {
+			if order.ID == test.Data.firstOrder.ID {
+				require.Len(t, order.LineItems, 1)
+				assert.Equal(t, test.Data.firstLineItem.Sku, order.LineItems[0].Sku)
+			}
+		}
+
+		transactionIDs := []string{}
+		for _, transaction := range export.Transactions {
+			transactionIDs = append(transactionIDs, transaction.ID)
+		}
+		assert.Contains(t, transactionIDs, test.Data.firstTransaction.ID)
+	})
+	t.Run("AsStranger", func(t *testing.T) {
+		test := NewRouteTest(t)
+		url := "/users/" + test.Data.testUser.ID + "/export"
+		recorder := test.TestEndpoint(http.MethodGet, url, nil, testToken("magical-unicorn", ""))
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
+
 func TestUserDelete(t *testing.T) {
 	t.Run("NonExistentUser", func(t *testing.T) {
 		test := NewRouteTest(t)
@@ -244,6 +420,7 @@ func TestUserDelete(t *testing.T) {
 	})
 	t.Run("SingleUser", func(t *testing.T) {
 		test := NewRouteTest(t)
+		test.Config.Webhooks.UserDeleted = "https://example.com/user_deleted"
 		dyingUser := models.User{ID: "going-to-die", Email: "nobody@nowhere.com"}
 		dyingAddr := getTestAddress()
 		dyingAddr.UserID = dyingUser.ID
@@ -285,6 +462,205 @@ func TestUserDelete(t *testing.T) {
 		assert.NotNil(t, dyingTransaction.DeletedAt, "transaction wasn't deleted")
 		assert.False(t, test.DB.Unscoped().First(&dyingLineItem).RecordNotFound())
 		assert.NotNil(t, dyingLineItem.DeletedAt, "line item wasn't deleted")
+
+		hooks := []models.Hook{}
+		require.NoError(t, test.DB.Where("type = ?", "user_deleted").Find(&hooks).Error)
+		require.Len(t, hooks, 1)
+		assert.Equal(t, "https://example.com/user_deleted", hooks[0].URL)
+		assert.Contains(t, hooks[0].Payload, `"user_id":"going-to-die"`)
+		assert.NotContains(t, hooks[0].Payload, "nobody@nowhere.com")
+		assert.Contains(t, hooks[0].Payload, `"anonymized":false`)
+	})
+	t.Run("OpenOrders", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Webhooks.UserDeleted = "https://example.com/user_deleted"
+		dyingUser := models.User{ID: "going-to-die", Email: "nobody@nowhere.com"}
+		dyingOrder := models.NewOrder("", "session2", dyingUser.Email, "USD")
+		dyingOrder.UserID = dyingUser.ID
+		dyingOrder.PaymentState = models.PaidState
+		test.DB.Create(&dyingUser)
+		test.DB.Create(dyingOrder)
+
+		token := testAdminToken("magical-unicorn", "")
+		recorder := test.TestEndpoint(http.MethodDelete, "/users/"+dyingUser.ID, nil, token)
+		validateError(t, http.StatusConflict, recorder, "1 paid orders")
+		assert.Nil(t, test.DB.First(&dyingUser).Error, "user was deleted")
+		var hooks int
+		require.NoError(t, test.DB.Model(&models.Hook{}).Where("type = ?", "user_deleted").Count(&hooks).Error)
+		assert.Equal(t, 0, hooks, "webhook queued for a refused deletion")
+
+		recorder = test.TestEndpoint(http.MethodDelete, "/users/"+dyingUser.ID+"?force=true", nil, token)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.False(t, test.DB.Unscoped().First(dyingOrder).RecordNotFound())
+		assert.NotNil(t, dyingOrder.DeletedAt, "order wasn't deleted")
+	})
+	t.Run("Anonymize", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Webhooks.UserDeleted = "https://example.com/user_deleted"
+		dyingUser := models.User{ID: "going-to-die", Email: "nobody@nowhere.com", Name: "No Body"}
+		dyingAddr := getTestAddress()
+		dyingAddr.UserID = dyingUser.ID
+		dyingOrder := models.NewOrder("", "session2", dyingUser.Email, "USD")
+		dyingOrder.UserID = dyingUser.ID
+		dyingOrder.IP = "127.0.0.1"
+		dyingOrder.UserAgent = "Batcomputer/1.0"
+		dyingOrder.ShippingAddressID = dyingAddr.ID
+		dyingOrder.VATNumber = "DE123456789"
+		dyingOrder.MetaData = map[string]interface{}{"gift_message": "Happy birthday, No Body"}
+		dyingTransaction := models.NewTransaction(dyingOrder)
+		dyingTransaction.UserID = dyingUser.ID
+		dyingTransaction.IP = "127.0.0.1"
+		dyingTransaction.UserAgent = "Batcomputer/1.0"
+		dyingNote := &models.OrderNote{OrderID: dyingOrder.ID, UserID: dyingUser.ID, Author: "No Body", Text: "Please ring twice"}
+		dyingData := &models.Data{OrderID: dyingOrder.ID, Key: "gift_message", Type: models.StringDataType, StringValue: "Happy birthday, No Body"}
+		dyingLog := &models.AuditLog{ActorID: "magical-unicorn", Action: models.AuditOrderUpdate, TargetID: dyingOrder.ID, Before: map[string]interface{}{"email": dyingUser.Email}}
+		items := []interface{}{&dyingUser, dyingAddr, dyingOrder, dyingTransaction, dyingNote, dyingData, dyingLog}
+		for _, i := range items {
+			test.DB.Create(i)
+		}
+
+		token := testAdminToken("magical-unicorn", "")
+		recorder := test.TestEndpoint(http.MethodDelete, "/users/"+dyingUser.ID+"?anonymize=true", nil, token)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		user := &models.User{}
+		require.False(t, test.DB.Unscoped().First(user, "id = ?", dyingUser.ID).RecordNotFound())
+		assert.NotNil(t, user.DeletedAt, "user wasn't deleted")
+		assert.Empty(t, user.Email)
+		assert.Empty(t, user.Name)
+
+		order := &models.Order{}
+		require.False(t, test.DB.First(order, "id = ?", dyingOrder.ID).RecordNotFound(), "order was deleted")
+		assert.Empty(t, order.Email)
+		assert.Empty(t, order.IP)
+		assert.Empty(t, order.UserAgent)
+		assert.Empty(t, order.VATNumber)
+		assert.Empty(t, order.MetaData)
+		transaction := &models.Transaction{}
+		require.False(t, test.DB.First(transaction, "id = ?", dyingTransaction.ID).RecordNotFound(), "transaction was deleted")
+		assert.Empty(t, transaction.IP)
+		assert.Empty(t, transaction.UserAgent)
+
+		addr := &models.Address{}
+		require.False(t, test.DB.First(addr, "id = ?", dyingAddr.ID).RecordNotFound(), "address was deleted")
+		assert.Empty(t, addr.Name)
+		assert.Empty(t, addr.Address1)
+		assert.Empty(t, addr.Zip)
+		assert.Equal(t, dyingAddr.Country, addr.Country)
+
+		note := &models.OrderNote{}
+		require.NoError(t, test.DB.First(note, "id = ?", dyingNote.ID).Error)
+		assert.Empty(t, note.Text)
+		assert.Empty(t, note.Author)
+		assert.True(t, test.DB.First(&models.Data{}, "order_id = ?", dyingOrder.ID).RecordNotFound())
+		log := &models.AuditLog{}
+		require.NoError(t, test.DB.First(log, "id = ?", dyingLog.ID).Error)
+		assert.Equal(t, models.AuditOrderUpdate, log.Action)
+		assert.Empty(t, log.Before)
+
+		hook := &models.Hook{}
+		require.NoError(t, test.DB.First(hook, "type = ?", "user_deleted").Error)
+		assert.Contains(t, hook.Payload, `"user_id":"going-to-die"`)
+		assert.NotContains(t, hook.Payload, "nobody@nowhere.com")
+		assert.Contains(t, hook.Payload, `"anonymized":true`)
+	})
+}
+
+func TestUserImpersonate(t *testing.T) {
+	impersonate := func(test *RouteTest) string {
+		url := "/users/" + test.Data.testUser.ID + "/impersonate"
+		recorder := test.TestEndpoint(http.MethodPost, url, nil, testAdminToken("admin-yo", "admin@wayneindustries.com"))
+		rsp := &impersonationResponse{}
+		extractPayload(t, http.StatusOK, recorder, rsp)
+		assert.True(t, rsp.ExpiresAt.After(time.Now()))
+		return rsp.Token
+	}
+	withToken := func(token string) map[string]string {
+		return map[string]string{"Authorization": "Bearer " + token}
+	}
+
+	t.Run("AsAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := impersonate(test)
+
+		c := &claims.JWTClaims{}
+		_, err := jwt.ParseWithClaims(token, c, func(*jwt.Token) (interface{}, error) {
+			return []byte(test.Config.JWT.Secret), nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, test.Data.testUser.ID, c.Subject)
+		assert.Equal(t, test.Data.testUser.Email, c.Email)
+		assert.Equal(t, "admin-yo", c.ImpersonatorID)
+
+		entries := []models.AuditLog{}
+		require.NoError(t, test.DB.Where("action = ?", models.AuditUserImpersonate).Find(&entries).Error)
+		require.Len(t, entries, 1)
+		assert.Equal(t, "admin-yo", entries[0].ActorID)
+		assert.Equal(t, test.Data.testUser.ID, entries[0].TargetID)
+
+		// the token acts as the user, without the roles of the admin
+		recorder := test.TestEndpointWithHeaders(http.MethodGet, "/users/"+test.Data.testUser.ID, nil, nil, withToken(token))
+		user := &models.User{}
+		extractPayload(t, http.StatusOK, recorder, user)
+		assert.Equal(t, test.Data.testUser.ID, user.ID)
+
+		recorder = test.TestEndpointWithHeaders(http.MethodGet, "/users", nil, nil, withToken(token))
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+
+	t.Run("EmailChange", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := impersonate(test)
+		url := "/users/" + test.Data.testUser.ID
+
+		body := strings.NewReader(`{"email": "joker@example.com"}`)
+		recorder := test.TestEndpointWithHeaders(http.MethodPost, url, body, nil, withToken(token))
+		validateError(t, http.StatusUnauthorized, recorder, "impersonating")
+
+		body = strings.NewReader(`{"name": "Bruce"}`)
+		recorder = test.TestEndpointWithHeaders(http.MethodPost, url, body, nil, withToken(token))
+		user := &models.User{}
+		extractPayload(t, http.StatusOK, recorder, user)
+		assert.Equal(t, "Bruce", user.Name)
+		assert.Equal(t, test.Data.testUser.Email, user.Email)
+	})
+
+	t.Run("SensitiveActions", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := impersonate(test)
+		userURL := "/users/" + test.Data.testUser.ID
+
+		requests := []struct {
+			method, url, body string
+		}{
+			{http.MethodGet, userURL + "/export", ""},
+			{http.MethodGet, userURL + "/payment_methods", ""},
+			{http.MethodPost, userURL + "/payment_methods", `{"provider": "stripe", "stripe_payment_method_id": "pm_1"}`},
+			{http.MethodPost, userURL, `{"default_billing_address_id": "` + test.Data.testAddress.ID + `"}`},
+			{http.MethodPost, "/orders/" + test.Data.firstOrder.ID + "/payments", `{"provider": "stripe", "amount": 1}`},
+			{http.MethodPost, "/payments/" + test.Data.firstTransaction.ID + "/confirm", ""},
+		}
+		for _, req := range requests {
+			recorder := test.TestEndpointWithHeaders(req.method, req.url, strings.NewReader(req.body), nil, withToken(token))
+			validateError(t, http.StatusUnauthorized, recorder, "impersonating")
+		}
+
+		// the user can still do all of it
+		recorder := test.TestEndpoint(http.MethodGet, userURL+"/export", nil, test.Data.testUserToken)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+	})
+
+	t.Run("AsUser", func(t *testing.T) {
+		test := NewRouteTest(t)
+		url := "/users/" + test.Data.testUser.ID + "/impersonate"
+		recorder := test.TestEndpoint(http.MethodPost, url, nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+
+	t.Run("UnknownUser", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodPost, "/users/nope/impersonate", nil, testAdminToken("admin-yo", "admin@wayneindustries.com"))
+		validateError(t, http.StatusNotFound, recorder)
 	})
 }
 
@@ -317,8 +693,9 @@ func TestUserBulkDelete(t *testing.T) {
 		token := testAdminToken("magical-unicorn", "")
 		recorder := test.TestEndpoint(http.MethodDelete, "/users?id="+dyingUser.ID, nil, token)
 
-		assert.Equal(t, http.StatusOK, recorder.Code)
-		assert.Equal(t, "", recorder.Body.String())
+		results := map[string]*bulkDeleteResult{}
+		extractPayload(t, http.StatusOK, recorder, &results)
+		assert.Equal(t, map[string]*bulkDeleteResult{dyingUser.ID: {Success: true}}, results)
 
 		// now load it back and it should be soft deleted
 		//found := &models.User{ID: dyingUser.ID}
@@ -341,8 +718,10 @@ func TestUserBulkDelete(t *testing.T) {
 		token := testAdminToken("magical-unicorn", "")
 		recorder := test.TestEndpoint(http.MethodDelete, fmt.Sprintf("/users?id=%s&id=%s", "villan", "cop"), nil, token)
 
-		assert.Equal(t, http.StatusOK, recorder.Code)
-		assert.Equal(t, "", recorder.Body.String())
+		results := map[string]*bulkDeleteResult{}
+		extractPayload(t, http.StatusOK, recorder, &results)
+		assert.True(t, results["villan"].Success)
+		assert.True(t, results["cop"].Success)
 
 		user1 := models.User{}
 		test.DB.Unscoped().Find(&user1, "id = ?", "villan")
@@ -358,13 +737,73 @@ func TestUserBulkDelete(t *testing.T) {
 		token := testAdminToken("magical-unicorn", "")
 		recorder := test.TestEndpoint(http.MethodDelete, fmt.Sprintf("/users?id=%s&id=%s", "villan", "superman"), nil, token)
 
-		assert.Equal(t, http.StatusOK, recorder.Code)
-		assert.Equal(t, "", recorder.Body.String())
+		results := map[string]*bulkDeleteResult{}
+		extractPayload(t, http.StatusOK, recorder, &results)
+		assert.True(t, results["villan"].Success)
+		assert.False(t, results["superman"].Success)
+		assert.Equal(t, "User not found", results["superman"].Error)
 
 		user := models.User{}
 		test.DB.Unscoped().Find(&user, "id = ?", "villan")
 		assert.NotNil(t, user.DeletedAt, "villan wasn't deleted")
 	})
+	t.Run("OpenOrders", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Webhooks.UserDeleted = "https://example.com/user_deleted"
+		createUser(test, "villan", "twoface@dc.com", "Harvey Dent")
+		dyingUser := models.User{ID: "going-to-die", Email: "nobody@nowhere.com"}
+		dyingOrder := models.NewOrder("", "session2", dyingUser.Email, "USD")
+		dyingOrder.UserID = dyingUser.ID
+		dyingOrder.PaymentState = models.PaidState
+		test.DB.Create(&dyingUser)
+		test.DB.Create(dyingOrder)
+
+		token := testAdminToken("magical-unicorn", "")
+		recorder := test.TestEndpoint(http.MethodDelete, fmt.Sprintf("/users?id=%s&id=%s", "villan", dyingUser.ID), nil, token)
+		results := map[string]*bulkDeleteResult{}
+		extractPayload(t, http.StatusOK, recorder, &results)
+		assert.True(t, results["villan"].Success)
+		assert.False(t, results[dyingUser.ID].Success)
+		assert.Contains(t, results[dyingUser.ID].Error, "1 paid orders")
+		assert.Nil(t, test.DB.First(&dyingUser).Error, "user was deleted")
+
+		hooks := []models.Hook{}
+		require.NoError(t, test.DB.Where("type = ?", "user_deleted").Find(&hooks).Error)
+		require.Len(t, hooks, 1)
+		assert.Contains(t, hooks[0].Payload, `"user_id":"villan"`)
+
+		recorder = test.TestEndpoint(http.MethodDelete, "/users?force=true&id="+dyingUser.ID, nil, token)
+		results = map[string]*bulkDeleteResult{}
+		extractPayload(t, http.StatusOK, recorder, &results)
+		assert.True(t, results[dyingUser.ID].Success)
+		assert.True(t, test.DB.First(&models.User{}, "id = ?", dyingUser.ID).RecordNotFound(), "user wasn't deleted")
+	})
+	t.Run("Anonymize", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Webhooks.UserDeleted = "https://example.com/user_deleted"
+		createUser(test, "villan", "twoface@dc.com", "Harvey Dent")
+		dyingOrder := models.NewOrder("", "session2", "twoface@dc.com", "USD")
+		dyingOrder.UserID = "villan"
+		test.DB.Create(dyingOrder)
+
+		token := testAdminToken("magical-unicorn", "")
+		recorder := test.TestEndpoint(http.MethodDelete, "/users?anonymize=true&id=villan", nil, token)
+		results := map[string]*bulkDeleteResult{}
+		extractPayload(t, http.StatusOK, recorder, &results)
+		assert.True(t, results["villan"].Success)
+
+		user := &models.User{}
+		require.False(t, test.DB.Unscoped().First(user, "id = ?", "villan").RecordNotFound())
+		assert.Empty(t, user.Email)
+		order := &models.Order{}
+		require.False(t, test.DB.First(order, "id = ?", dyingOrder.ID).RecordNotFound(), "order was deleted")
+		assert.Empty(t, order.Email)
+
+		hooks := []models.Hook{}
+		require.NoError(t, test.DB.Where("type = ?", "user_deleted").Find(&hooks).Error)
+		require.Len(t, hooks, 1)
+		assert.Contains(t, hooks[0].Payload, `"anonymized":true`)
+	})
 	t.Run("MissingParameters", func(t *testing.T) {
 		test := NewRouteTest(t)
 		token := testAdminToken("magical-unicorn", "")
@@ -427,3 +866,84 @@ func TestUserAddressCreate(t *testing.T) {
 		validateError(t, http.StatusBadRequest, recorder)
 	})
 }
+
+func TestUserDefaultAddresses(t *testing.T) {
+	createAddress := func(t *testing.T, test *RouteTest, def string) string {
+		b, err := json.Marshal(&getTestAddress().AddressRequest)
+		require.NoError(t, err)
+		url := "/users/" + test.Data.testUser.ID + "/addresses?default=" + def
+		recorder := test.TestEndpoint(http.MethodPost, url, bytes.NewBuffer(b), testAdminToken("magical-unicorn", ""))
+
+		results := struct {
+			ID string
+		}{}
+		extractPayload(t, http.StatusOK, recorder, &results)
+		return results.ID
+	}
+	loadUser := func(t *testing.T, test *RouteTest) *models.User {
+		user := &models.User{}
+		require.NoError(t, test.DB.First(user, "id = ?", test.Data.testUser.ID).Error)
+		return user
+	}
+
+	t.Run("Create", func(t *testing.T) {
+		test := NewRouteTest(t)
+		shippingID := createAddress(t, test, "shipping")
+		billingID := createAddress(t, test, "billing")
+
+		user := loadUser(t, test)
+		assert.Equal(t, shippingID, user.DefaultShippingAddressID)
+		assert.Equal(t, billingID, user.DefaultBillingAddressID)
+
+		bothID := createAddress(t, test, "true")
+		user = loadUser(t, test)
+		assert.Equal(t, bothID, user.DefaultShippingAddressID)
+		assert.Equal(t, bothID, user.DefaultBillingAddressID)
+	})
+	t.Run("Delete", func(t *testing.T) {
+		test := NewRouteTest(t)
+		addrID := createAddress(t, test, "true")
+
+		url := "/users/" + test.Data.testUser.ID + "/addresses/" + addrID
+		recorder := test.TestEndpoint(http.MethodDelete, url, nil, testAdminToken("magical-unicorn", ""))
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		user := loadUser(t, test)
+		assert.Empty(t, user.DefaultShippingAddressID)
+		assert.Empty(t, user.DefaultBillingAddressID)
+	})
+	t.Run("Update", func(t *testing.T) {
+		test := NewRouteTest(t)
+		addrID := createAddress(t, test, "false")
+
+		url := "/users/" + test.Data.testUser.ID
+		body := strings.NewReader(`{"default_shipping_address_id": "` + addrID + `"}`)
+		recorder := test.TestEndpoint(http.MethodPost, url, body, test.Data.testUserToken)
+		user := &models.User{}
+		extractPayload(t, http.StatusOK, recorder, user)
+		assert.Equal(t, addrID, user.DefaultShippingAddressID)
+
+		other := getTestAddress()
+		other.ID = "someone-elses-house"
+		other.UserID = "villian"
+		require.NoError(t, test.DB.Create(other).Error)
+		body = strings.NewReader(`{"default_billing_address_id": "someone-elses-house"}`)
+		recorder = test.TestEndpoint(http.MethodPost, url, body, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "doesn't belong to the user")
+	})
+	t.Run("Order", func(t *testing.T) {
+		server := startTestSite()
+		defer server.Close()
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		shippingID := createAddress(t, test, "shipping")
+		billingID := createAddress(t, test, "billing")
+
+		body := strings.NewReader(`{"email": "info@example.com", "line_items": [{"path": "/simple-product", "quantity": 1}]}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Equal(t, shippingID, order.ShippingAddressID)
+		assert.Equal(t, billingID, order.BillingAddressID)
+	})
+}
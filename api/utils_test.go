@@ -32,7 +32,13 @@ const baseURL = "https://example.com"
 var dbFiles []string
 var testLogger = logrus.NewEntry(logrus.StandardLogger())
 
+// emptySite is the default site of the tests. It has no settings or products,
+// so orders are priced without taxes or shipping.
+var emptySite *httptest.Server
+
 func TestMain(m *testing.M) {
+	emptySite = httptest.NewServer(http.NotFoundHandler())
+	defer emptySite.Close()
 	dbFiles = []string{}
 	defer func() {
 		fmt.Printf("removing lingering %d db files\n", len(dbFiles))
@@ -44,16 +50,22 @@ func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
 
-func db(t *testing.T) (*gorm.DB, *conf.GlobalConfiguration, *conf.Configuration, *TestData) {
+// testDBFile creates a file for a sqlite test database, which is removed
+// once the tests ran.
+func testDBFile() string {
 	f, err := ioutil.TempFile("", "test-db")
 	if err != nil {
 		panic(err)
 	}
+	f.Close()
 	dbFiles = append(dbFiles, f.Name())
+	return f.Name()
+}
 
+func db(t testing.TB) (*gorm.DB, *conf.GlobalConfiguration, *conf.Configuration, *TestData) {
 	globalConfig, config := testConfig()
 	globalConfig.DB.Driver = "sqlite3"
-	globalConfig.DB.URL = f.Name()
+	globalConfig.DB.URL = testDBFile()
 
 	db, err := models.Connect(globalConfig, logrus.StandardLogger())
 	if err != nil {
@@ -72,6 +84,7 @@ func testConfig() (*conf.GlobalConfiguration, *conf.Configuration) {
 	globalConfig.DB.Namespace = "test"
 
 	config := new(conf.Configuration)
+	config.SiteURL = emptySite.URL
 	config.JWT.Secret = "testsecret"
 	config.JWT.AdminGroupName = "admin"
 	config.Payment.Stripe.Enabled = true
@@ -194,7 +207,7 @@ func setupTestData() *TestData {
 	firstOrder.ID = "first-order"
 	firstOrder.LineItems = []*models.LineItem{firstLineItem}
 	firstOrder.Downloads = []models.Download{firstDownload}
-	firstOrder.CalculateTotal(&calculator.Settings{}, nil, testLogger)
+	firstOrder.Recalculate(&calculator.Settings{}, nil, testLogger)
 	firstOrder.BillingAddress = testAddress
 	firstOrder.ShippingAddress = testAddress
 	firstOrder.User = testUser
@@ -232,7 +245,7 @@ func setupTestData() *TestData {
 
 	secondOrder.ID = "second-order"
 	secondOrder.LineItems = []*models.LineItem{secondLineItem1, secondLineItem2}
-	secondOrder.CalculateTotal(&calculator.Settings{}, nil, testLogger)
+	secondOrder.Recalculate(&calculator.Settings{}, nil, testLogger)
 	secondOrder.BillingAddress = testAddress
 	secondOrder.ShippingAddress = testAddress
 	secondOrder.User = testUser
@@ -259,7 +272,7 @@ func setupTestData() *TestData {
 	}
 }
 
-func loadTestData(t *testing.T, db *gorm.DB) *TestData {
+func loadTestData(t testing.TB, db *gorm.DB) *TestData {
 	testData := setupTestData()
 
 	require.NoError(t, db.Create(testData.testUser).Error)
@@ -377,8 +390,15 @@ func NewRouteTest(t *testing.T) *RouteTest {
 }
 
 func (r *RouteTest) TestEndpoint(method string, url string, body io.Reader, token *jwt.Token) *httptest.ResponseRecorder {
+	return r.TestEndpointWithHeaders(method, url, body, token, nil)
+}
+
+func (r *RouteTest) TestEndpointWithHeaders(method string, url string, body io.Reader, token *jwt.Token, headers map[string]string) *httptest.ResponseRecorder {
 	recorder := httptest.NewRecorder()
 	req := httptest.NewRequest(method, baseURL+url, body)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
 
 	if token != nil {
 		require.NoError(r.T, signHTTPRequest(req, token, r.Config.JWT.Secret))
@@ -435,9 +455,15 @@ func handleTestProducts(w http.ResponseWriter, r *http.Request) {
 	switch r.URL.Path {
 	case "/simple-product":
 		fmt.Fprintln(w, productMetaFrame(`
-			{"sku": "product-1", "title": "Product 1", "type": "Book", "prices": [
+			{"sku": "product-1", "title": "Product 1", "type": "Book", "weight": 500, "length": 200, "width": 150, "height": 30, "prices": [
 				{"amount": "9.99", "currency": "USD"}
 			]}`))
+	case "/multi-currency-product":
+		fmt.Fprintln(w, productMetaFrame(`
+			{"sku": "product-2", "title": "Product 2", "type": "Book", "prices": [
+				{"amount": "9.99", "currency": "USD"},
+				{"amount": "8.99", "currency": "EUR"}
+			]}`))
 	case "/bundle-product":
 		fmt.Fprintln(w, productMetaFrame(`
 			{"sku": "product-1", "title": "Product 1", "type": "Book", "prices": [
@@ -0,0 +1,143 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+type webhookSubscriptionParams struct {
+	EventType string  `json:"event_type"`
+	URL       string  `json:"url"`
+	Secret    *string `json:"secret"`
+	Enabled   *bool   `json:"enabled"`
+}
+
+func validateWebhookURL(hookURL string) *HTTPError {
+	u, err := url.Parse(hookURL)
+	if err != nil || !u.IsAbs() || (u.Scheme != "http" && u.Scheme != "https") {
+		return badRequestError("A webhook subscription requires an absolute http or https URL")
+	}
+	return nil
+}
+
+func loadWebhookSubscription(r *http.Request, db *gorm.DB) (*models.WebhookSubscription, *HTTPError) {
+	instanceID := gcontext.GetInstanceID(r.Context())
+	subscriptionID := chi.URLParam(r, "subscription_id")
+
+	subscription := &models.WebhookSubscription{}
+	if rsp := db.First(subscription, "id = ? AND instance_id = ?", subscriptionID, instanceID); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, notFoundError("Webhook subscription not found")
+		}
+		return nil, internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	return subscription, nil
+}
+
+// WebhookSubscriptionList lists the webhook subscriptions, optionally only
+// the ones for an event type with "?event_type=". It is only available to admins.
+func (a *API) WebhookSubscriptionList(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+
+	query := a.ReadDB(r).Where("instance_id = ?", instanceID)
+	if eventType := r.URL.Query().Get("event_type"); eventType != "" {
+		query = query.Where("event_type = ?", eventType)
+	}
+
+	subscriptions := []models.WebhookSubscription{}
+	if rsp := query.Order("created_at asc").Find(&subscriptions); rsp.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, subscriptions)
+}
+
+// WebhookSubscriptionCreate registers a URL to receive the webhooks of an
+// event type. Subscriptions are enabled unless created with "enabled": false.
+// It is only available to admins.
+func (a *API) WebhookSubscriptionCreate(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+
+	params := new(webhookSubscriptionParams)
+	if err := decodeJSON(r, params); err != nil {
+		return badRequestError("Failed to parse json body: %v", err)
+	}
+	if !models.IsHookType(params.EventType) {
+		return badRequestError("Unknown webhook event type '%v'", params.EventType)
+	}
+	if httpErr := validateWebhookURL(params.URL); httpErr != nil {
+		return httpErr
+	}
+
+	secret := ""
+	if params.Secret != nil {
+		secret = *params.Secret
+	}
+	subscription := models.NewWebhookSubscription(instanceID, params.EventType, params.URL, secret)
+	if params.Enabled != nil {
+		subscription.Enabled = *params.Enabled
+	}
+	if rsp := a.DB(r).Create(subscription); rsp.Error != nil {
+		return internalServerError("Failed to save webhook subscription").WithInternalError(rsp.Error)
+	}
+
+	getLogEntry(r).WithField("subscription_id", subscription.ID).Infof("Subscribed %s to %s webhooks", subscription.URL, subscription.EventType)
+	return sendJSON(w, http.StatusCreated, subscription)
+}
+
+// WebhookSubscriptionUpdate changes the URL or secret of a webhook
+// subscription, or enables or disables it. It is only available to admins.
+func (a *API) WebhookSubscriptionUpdate(w http.ResponseWriter, r *http.Request) error {
+	db := a.DB(r)
+	subscription, httpErr := loadWebhookSubscription(r, db)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	params := new(webhookSubscriptionParams)
+	if err := decodeJSON(r, params); err != nil {
+		return badRequestError("Failed to parse json body: %v", err)
+	}
+	if params.EventType != "" && params.EventType != subscription.EventType {
+		return badRequestError("The event type of a webhook subscription can't be changed")
+	}
+	if params.URL != "" {
+		if httpErr := validateWebhookURL(params.URL); httpErr != nil {
+			return httpErr
+		}
+		subscription.URL = params.URL
+	}
+	if params.Secret != nil {
+		subscription.Secret = *params.Secret
+	}
+	if params.Enabled != nil {
+		subscription.Enabled = *params.Enabled
+	}
+	if rsp := db.Save(subscription); rsp.Error != nil {
+		return internalServerError("Failed to save webhook subscription").WithInternalError(rsp.Error)
+	}
+
+	return sendJSON(w, http.StatusOK, subscription)
+}
+
+// WebhookSubscriptionDelete removes a webhook subscription. Hooks already
+// queued for it are still delivered. It is only available to admins.
+func (a *API) WebhookSubscriptionDelete(w http.ResponseWriter, r *http.Request) error {
+	db := a.DB(r)
+	subscription, httpErr := loadWebhookSubscription(r, db)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	if rsp := db.Delete(subscription); rsp.Error != nil {
+		return internalServerError("Failed to delete webhook subscription").WithInternalError(rsp.Error)
+	}
+
+	getLogEntry(r).WithField("subscription_id", subscription.ID).Info("Deleted webhook subscription")
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestWebhookSubscriptionCreate(t *testing.T) {
+	t.Run("AsAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		body := strings.NewReader(`{"event_type": "payment", "url": "https://example.com/payment", "secret": "shh"}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/webhooks", body, testAdminToken("magical-unicorn", ""))
+
+		subscription := &models.WebhookSubscription{}
+		extractPayload(t, http.StatusCreated, recorder, subscription)
+		assert.NotEmpty(t, subscription.ID)
+		assert.Equal(t, "payment", subscription.EventType)
+		assert.Equal(t, "https://example.com/payment", subscription.URL)
+		assert.True(t, subscription.Enabled)
+		assert.NotContains(t, recorder.Body.String(), "shh")
+
+		stored := &models.WebhookSubscription{}
+		require.NoError(t, test.DB.First(stored, "id = ?", subscription.ID).Error)
+		assert.Equal(t, "shh", stored.Secret)
+	})
+	t.Run("AsUser", func(t *testing.T) {
+		test := NewRouteTest(t)
+		body := strings.NewReader(`{"event_type": "payment", "url": "https://example.com/payment"}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/webhooks", body, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+	t.Run("UnknownEventType", func(t *testing.T) {
+		test := NewRouteTest(t)
+		body := strings.NewReader(`{"event_type": "everything", "url": "https://example.com/payment"}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/webhooks", body, testAdminToken("magical-unicorn", ""))
+		validateError(t, http.StatusBadRequest, recorder, "Unknown webhook event type 'everything'")
+	})
+	t.Run("RelativeURL", func(t *testing.T) {
+		test := NewRouteTest(t)
+		body := strings.NewReader(`{"event_type": "payment", "url": "/payment"}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/webhooks", body, testAdminToken("magical-unicorn", ""))
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+}
+
+func TestWebhookSubscriptionUpdateAndDelete(t *testing.T) {
+	test := NewRouteTest(t)
+	token := testAdminToken("magical-unicorn", "")
+	subscription := models.NewWebhookSubscription("", "order", "https://example.com/order", "")
+	require.NoError(t, test.DB.Create(subscription).Error)
+
+	recorder := test.TestEndpoint(http.MethodPut, "/webhooks/"+subscription.ID, strings.NewReader(`{"enabled": false}`), token)
+	updated := &models.WebhookSubscription{}
+	extractPayload(t, http.StatusOK, recorder, updated)
+	assert.False(t, updated.Enabled)
+	assert.Equal(t, "https://example.com/order", updated.URL)
+
+	recorder = test.TestEndpoint(http.MethodPut, "/webhooks/"+subscription.ID, strings.NewReader(`{"event_type": "payment"}`), token)
+	validateError(t, http.StatusBadRequest, recorder)
+
+	recorder = test.TestEndpoint(http.MethodDelete, "/webhooks/"+subscription.ID, nil, token)
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+
+	recorder = test.TestEndpoint(http.MethodGet, "/webhooks", nil, token)
+	subscriptions := []models.WebhookSubscription{}
+	extractPayload(t, http.StatusOK, recorder, &subscriptions)
+	assert.Empty(t, subscriptions)
+
+	recorder = test.TestEndpoint(http.MethodDelete, "/webhooks/"+subscription.ID, nil, token)
+	validateError(t, http.StatusNotFound, recorder)
+}
+
+func TestWebhookSubscriptionDispatch(t *testing.T) {
+	test := NewRouteTest(t)
+	test.Config.Webhooks.Payment = "https://example.com/default"
+	test.Config.Webhooks.Secret = "config-secret"
+
+	subscribed := models.NewWebhookSubscription("", "payment", "https://example.com/subscribed", "own-secret")
+	disabled := models.NewWebhookSubscription("", "payment", "https://example.com/disabled", "")
+	disabled.Enabled = false
+	other := models.NewWebhookSubscription("", "refund", "https://example.com/refund", "")
+	for _, s := range []*models.WebhookSubscription{subscribed, disabled, other} {
+		require.NoError(t, test.DB.Create(s).Error)
+	}
+
+	payFirstOrder(t, test)
+
+	hooks := []models.Hook{}
+	require.NoError(t, test.DB.Where("type = ?", "payment").Order("id asc").Find(&hooks).Error)
+	require.Len(t, hooks, 2)
+	assert.Equal(t, "https://example.com/default", hooks[0].URL)
+	assert.Equal(t, "config-secret", hooks[0].Secret)
+	assert.Equal(t, "https://example.com/subscribed", hooks[1].URL)
+	assert.Equal(t, "own-secret", hooks[1].Secret)
+}
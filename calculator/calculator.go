@@ -2,7 +2,6 @@ package calculator
 
 import (
 	"math"
-	"strconv"
 
 	"github.com/netlify/gocommerce/claims"
 	"github.com/sirupsen/logrus"
@@ -15,6 +14,14 @@ type DiscountItem struct {
 	Fixed      uint64       `json:"fixed"`
 }
 
+// TaxLine is the amount charged for one of the taxes on an order, like a
+// state or a city tax.
+type TaxLine struct {
+	Name       string `json:"name"`
+	Percentage uint64 `json:"percentage"`
+	Amount     uint64 `json:"amount"`
+}
+
 // Price represents the total price of all line items.
 type Price struct {
 	Items []ItemPrice
@@ -23,6 +30,8 @@ type Price struct {
 	Discount uint64
 	NetTotal uint64
 	Taxes    uint64
+	TaxLines []TaxLine
+	Shipping uint64
 	Total    int64
 }
 
@@ -34,8 +43,17 @@ type ItemPrice struct {
 	Discount uint64
 	NetTotal uint64
 	Taxes    uint64
+	TaxLines []TaxLine
 	Total    int64
 
+	// LineTaxes and LineTaxLines are the taxes of the whole quantity of the
+	// item, which add up to the taxes of the order.
+	LineTaxes    uint64
+	LineTaxLines []TaxLine
+	// LineDiscount is the discount of the whole quantity of the item, which
+	// adds up to the discount of the order.
+	LineDiscount uint64
+
 	DiscountItems []DiscountItem
 }
 
@@ -58,18 +76,30 @@ type Settings struct {
 	Taxes              []*Tax            `json:"taxes,omitempty"`
 	MemberDiscounts    []*MemberDiscount `json:"member_discounts,omitempty"`
 	PaymentMethods     *PaymentMethods   `json:"payment_methods,omitempty"`
+	Shipping           *ShippingSettings `json:"shipping,omitempty"`
+	// Rounding is how fractions of the smallest currency unit in taxes and
+	// discounts are rounded, half up unless set
+	Rounding Rounding `json:"rounding,omitempty"`
 }
 
 // Tax represents a tax, potentially specific to countries and product types.
+//
+// Taxes with different names are stacked, e.g. a state and a city tax are
+// both charged. Of the taxes with the same name, only the first one that
+// applies to an item is charged.
 type Tax struct {
+	Name         string   `json:"name,omitempty"`
 	Percentage   uint64   `json:"percentage"`
 	ProductTypes []string `json:"product_types"`
 	Countries    []string `json:"countries"`
 }
 
+// fixedVATName is the name of the tax line for items with a fixed VAT.
+const fixedVATName = "VAT"
+
 type taxAmount struct {
-	price      uint64
-	percentage uint64
+	price uint64
+	taxes []*Tax
 }
 
 // FixedMemberDiscount represents a fixed discount given to members.
@@ -90,10 +120,11 @@ type MemberDiscount struct {
 
 // PriceParameters represents the order information to calculate prices.
 type PriceParameters struct {
-	Country  string
-	Currency string
-	Coupon   Coupon
-	Items    []Item
+	Country   string
+	Currency  string
+	Coupons   []Coupon
+	Items     []Item
+	TaxExempt bool
 }
 
 // ValidForType returns whether a member discount is valid for a product type.
@@ -132,6 +163,12 @@ type Item interface {
 	GetQuantity() uint64
 }
 
+// ManuallyDiscountedItem is implemented by items an admin gave a discount.
+// The discount is taken off the price of all of the item's quantity together.
+type ManuallyDiscountedItem interface {
+	GetManualDiscount() uint64
+}
+
 // Coupon is the interface for a coupon needed to do price calculation.
 type Coupon interface {
 	ValidForType(string) bool
@@ -141,13 +178,18 @@ type Coupon interface {
 	FixedDiscount(string) uint64
 }
 
+// FreeShippingCoupon is implemented by coupons that can waive shipping costs.
+type FreeShippingCoupon interface {
+	FreeShipping() bool
+}
+
 // FixedDiscount returns what the fixed discount amount is for a particular currency.
 func (d *MemberDiscount) FixedDiscount(currency string) uint64 {
 	if d.FixedAmount != nil {
 		for _, discount := range d.FixedAmount {
 			if discount.Currency == currency {
-				amount, _ := strconv.ParseFloat(discount.Amount, 64)
-				return rint(amount * 100)
+				amount, _ := ParseAmount(discount.Amount, currency)
+				return amount
 			}
 		}
 	}
@@ -186,18 +228,19 @@ func calculateAmountsForSingleItem(settings *Settings, lineLogger logrus.FieldLo
 	itemPrice := ItemPrice{Quantity: item.GetQuantity()}
 
 	singlePrice := item.PriceInLowestUnit() * multiplier
-	_, itemPrice.Subtotal = calculateTaxes(singlePrice, item, params, settings)
-
-	// apply discount to original price
-	coupon := params.Coupon
-	if coupon != nil && coupon.ValidForType(item.ProductType()) && coupon.ValidForProduct(item.ProductSku()) {
-		discountItem := DiscountItem{
-			Type:       DiscountTypeCoupon,
-			Percentage: coupon.PercentageDiscount(),
-			Fixed:      coupon.FixedDiscount(params.Currency) * multiplier,
+	_, itemPrice.Subtotal, _ = calculateTaxes(singlePrice, item, params, settings)
+
+	// apply discount to original price, stacked coupons are each applied to the original price
+	for _, coupon := range params.Coupons {
+		if coupon != nil && coupon.ValidForType(item.ProductType()) && coupon.ValidForProduct(item.ProductSku()) {
+			discountItem := DiscountItem{
+				Type:       DiscountTypeCoupon,
+				Percentage: coupon.PercentageDiscount(),
+				Fixed:      coupon.FixedDiscount(params.Currency) * multiplier,
+			}
+			itemPrice.Discount += calculateDiscount(settings.rounding(), singlePrice, discountItem.Percentage, discountItem.Fixed)
+			itemPrice.DiscountItems = append(itemPrice.DiscountItems, discountItem)
 		}
-		itemPrice.Discount = calculateDiscount(singlePrice, discountItem.Percentage, discountItem.Fixed)
-		itemPrice.DiscountItems = append(itemPrice.DiscountItems, discountItem)
 	}
 	if settings != nil && settings.MemberDiscounts != nil {
 		for _, discount := range settings.MemberDiscounts {
@@ -209,18 +252,29 @@ func calculateAmountsForSingleItem(settings *Settings, lineLogger logrus.FieldLo
 					Percentage: discount.Percentage,
 					Fixed:      discount.FixedDiscount(params.Currency) * multiplier,
 				}
-				itemPrice.Discount += calculateDiscount(singlePrice, discountItem.Percentage, discountItem.Fixed)
+				itemPrice.Discount += calculateDiscount(settings.rounding(), singlePrice, discountItem.Percentage, discountItem.Fixed)
 				itemPrice.DiscountItems = append(itemPrice.DiscountItems, discountItem)
 			}
 		}
 	}
 
+	if d, ok := item.(ManuallyDiscountedItem); ok && d.GetManualDiscount() > 0 && item.GetQuantity() > 0 {
+		discountItem := DiscountItem{
+			Type:  DiscountTypeManual,
+			Fixed: d.GetManualDiscount() * multiplier / item.GetQuantity(),
+		}
+		itemPrice.Discount += calculateDiscount(settings.rounding(), singlePrice, 0, discountItem.Fixed)
+		itemPrice.DiscountItems = append(itemPrice.DiscountItems, discountItem)
+	}
+
 	discountedPrice := uint64(0)
 	if itemPrice.Discount < singlePrice {
 		discountedPrice = singlePrice - itemPrice.Discount
+	} else {
+		itemPrice.Discount = singlePrice
 	}
 
-	itemPrice.Taxes, itemPrice.NetTotal = calculateTaxes(discountedPrice, item, params, settings)
+	itemPrice.Taxes, itemPrice.NetTotal, itemPrice.TaxLines = calculateTaxes(discountedPrice, item, params, settings)
 	itemPrice.Total = int64(itemPrice.NetTotal + itemPrice.Taxes)
 
 	return itemPrice
@@ -257,33 +311,67 @@ func CalculatePrice(settings *Settings, jwtClaims map[string]interface{}, params
 				"item_taxes":    itemPrice.Taxes,
 			}).Info("calculated item price")
 
-		price.Items = append(price.Items, itemPrice)
-
 		// avoid issues with rounding when multiplying by quantity before taxation
 		itemPriceMultiple := calculateAmountsForSingleItem(settings, lineLogger, jwtClaims, params, item, item.GetQuantity())
+		itemPrice.LineTaxes = itemPriceMultiple.Taxes
+		itemPrice.LineTaxLines = itemPriceMultiple.TaxLines
+		itemPrice.LineDiscount = itemPriceMultiple.Discount
+		price.Items = append(price.Items, itemPrice)
+
 		price.Subtotal += itemPriceMultiple.Subtotal
 		price.Discount += itemPriceMultiple.Discount
 		price.NetTotal += itemPriceMultiple.NetTotal
 		price.Taxes += itemPriceMultiple.Taxes
+		price.TaxLines = addTaxLines(price.TaxLines, itemPriceMultiple.TaxLines)
 		price.Total += itemPriceMultiple.Total
 	}
 
 	price.Total = int64(price.NetTotal + price.Taxes)
+	if !freeShipping(params.Coupons) {
+		price.Shipping = CalculateShipping(settings, ShippingParameters{
+			Country:  params.Country,
+			Currency: params.Currency,
+			Total:    uint64(price.Total),
+			Weight:   totalWeight(params.Items),
+		})
+		price.Total += int64(price.Shipping)
+	}
+
 	priceLogger.WithFields(
 		logrus.Fields{
 			"total_price":    price.Total,
 			"total_discount": price.Discount,
 			"total_net":      price.NetTotal,
 			"total_taxes":    price.Taxes,
+			"total_shipping": price.Shipping,
 		}).Info("calculated total price")
 
 	return price
 }
 
-func calculateDiscount(amountToDiscount, percentage, fixed uint64) uint64 {
+func freeShipping(coupons []Coupon) bool {
+	for _, coupon := range coupons {
+		if c, ok := coupon.(FreeShippingCoupon); ok && c.FreeShipping() {
+			return true
+		}
+	}
+	return false
+}
+
+func totalWeight(items []Item) uint64 {
+	var weight uint64
+	for _, item := range items {
+		if w, ok := item.(WeightedItem); ok {
+			weight += w.GetWeight() * item.GetQuantity()
+		}
+	}
+	return weight
+}
+
+func calculateDiscount(rounding Rounding, amountToDiscount, percentage, fixed uint64) uint64 {
 	var discount uint64
 	if percentage > 0 {
-		discount = rint(float64(amountToDiscount) * float64(percentage) / 100)
+		discount = rounding.divide(amountToDiscount*percentage, 100)
 	}
 	discount += fixed
 
@@ -293,33 +381,23 @@ func calculateDiscount(amountToDiscount, percentage, fixed uint64) uint64 {
 	return discount
 }
 
-func calculateTaxes(amountToTax uint64, item Item, params PriceParameters, settings *Settings) (taxes uint64, subtotal uint64) {
+func calculateTaxes(amountToTax uint64, item Item, params PriceParameters, settings *Settings) (taxes uint64, subtotal uint64, lines []TaxLine) {
 	includeTaxes := settings != nil && settings.PricesIncludeTaxes
+	rounding := settings.rounding()
 	originalPrice := item.PriceInLowestUnit()
 
 	taxAmounts := []taxAmount{}
 	if item.FixedVAT() != 0 {
-		taxAmounts = append(taxAmounts, taxAmount{price: amountToTax, percentage: item.FixedVAT()})
+		taxAmounts = append(taxAmounts, taxAmount{price: amountToTax, taxes: []*Tax{{Name: fixedVATName, Percentage: item.FixedVAT()}}})
 	} else if settings != nil && item.TaxableItems() != nil && len(item.TaxableItems()) > 0 {
 		for _, item := range item.TaxableItems() {
 			// because a discount may have been applied we need to determine the real price of this sub-item
-			priceShare := float64(item.PriceInLowestUnit()) / float64(originalPrice)
-			itemPrice := rint(float64(amountToTax) * priceShare)
-			amount := taxAmount{price: itemPrice}
-			for _, t := range settings.Taxes {
-				if t.AppliesTo(params.Country, item.ProductType()) {
-					amount.percentage = t.Percentage
-					break
-				}
-			}
-			taxAmounts = append(taxAmounts, amount)
+			itemPrice := rounding.divide(amountToTax*item.PriceInLowestUnit(), originalPrice)
+			taxAmounts = append(taxAmounts, taxAmount{price: itemPrice, taxes: applicableTaxes(settings.Taxes, params.Country, item.ProductType())})
 		}
 	} else if settings != nil {
-		for _, t := range settings.Taxes {
-			if t.AppliesTo(params.Country, item.ProductType()) {
-				taxAmounts = append(taxAmounts, taxAmount{price: amountToTax, percentage: t.Percentage})
-				break
-			}
+		if applicable := applicableTaxes(settings.Taxes, params.Country, item.ProductType()); len(applicable) > 0 {
+			taxAmounts = append(taxAmounts, taxAmount{price: amountToTax, taxes: applicable})
 		}
 	}
 
@@ -330,20 +408,76 @@ func calculateTaxes(amountToTax uint64, item Item, params PriceParameters, setti
 	}
 
 	subtotal = 0
-	for _, tax := range taxAmounts {
+	for _, amount := range taxAmounts {
+		var percentage uint64
+		for _, t := range amount.taxes {
+			percentage += t.Percentage
+		}
+
+		itemLines := []TaxLine{}
+		for _, t := range amount.taxes {
+			line := TaxLine{Name: t.Name, Percentage: t.Percentage}
+			if includeTaxes {
+				// each tax is its share of the taxes included in the price
+				line.Amount = rounding.divide(amount.price*t.Percentage, 100+percentage)
+			} else {
+				line.Amount = rounding.divide(amount.price*t.Percentage, 100)
+			}
+			taxes += line.Amount
+			itemLines = append(itemLines, line)
+		}
+		lines = addTaxLines(lines, itemLines)
+
 		if includeTaxes {
-			taxAmount := rint(float64(tax.price) / float64(100+tax.percentage) * 100 * (float64(tax.percentage) / 100))
-			tax.price -= taxAmount
-			taxes += taxAmount
-		} else {
-			taxes += rint(float64(tax.price) * float64(tax.percentage) / 100)
+			for _, line := range itemLines {
+				amount.price -= line.Amount
+			}
 		}
-		subtotal += tax.price
+		subtotal += amount.price
+	}
+
+	// exempt orders are charged the price without taxes
+	if params.TaxExempt {
+		taxes = 0
+		lines = nil
 	}
 
 	return
 }
 
+// applicableTaxes returns the taxes charged for a product type in a country,
+// the first applicable tax of each name.
+func applicableTaxes(taxes []*Tax, country, productType string) []*Tax {
+	applicable := []*Tax{}
+	names := map[string]bool{}
+	for _, t := range taxes {
+		if !names[t.Name] && t.AppliesTo(country, productType) {
+			names[t.Name] = true
+			applicable = append(applicable, t)
+		}
+	}
+	return applicable
+}
+
+// addTaxLines adds the amounts of the tax lines to the lines with the same
+// name and percentage, and appends the others.
+func addTaxLines(lines []TaxLine, add []TaxLine) []TaxLine {
+	for _, line := range add {
+		found := false
+		for i := range lines {
+			if lines[i].Name == line.Name && lines[i].Percentage == line.Percentage {
+				lines[i].Amount += line.Amount
+				found = true
+				break
+			}
+		}
+		if !found {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
 // Nopes - no `round` method in go
 // See https://github.com/golang/go/blob/master/src/math/floor.go#L58
 
@@ -20,6 +20,7 @@ type TestItem struct {
 	vat      uint64
 	items    []Item
 	quantity uint64
+	weight   uint64
 }
 
 func (t *TestItem) ProductSku() string {
@@ -49,12 +50,17 @@ func (t *TestItem) GetQuantity() uint64 {
 	return 1
 }
 
+func (t *TestItem) GetWeight() uint64 {
+	return t.weight
+}
+
 type TestCoupon struct {
-	itemSku    string
-	itemType   string
-	moreThan   uint64
-	percentage uint64
-	fixed      uint64
+	itemSku      string
+	itemType     string
+	moreThan     uint64
+	percentage   uint64
+	fixed        uint64
+	freeShipping bool
 }
 
 func (c *TestCoupon) ValidForType(productType string) bool {
@@ -77,6 +83,10 @@ func (c *TestCoupon) FixedDiscount(currency string) uint64 {
 	return c.fixed
 }
 
+func (c *TestCoupon) FreeShipping() bool {
+	return c.freeShipping
+}
+
 func validatePrice(t *testing.T, actual Price, expected Price) {
 	assert.Equal(t, expected.Subtotal, actual.Subtotal, fmt.Sprintf("Expected subtotal to be %d, got %d", expected.Subtotal, actual.Subtotal))
 	assert.Equal(t, expected.Taxes, actual.Taxes, fmt.Sprintf("Expected taxes to be %d, got %d", expected.Taxes, actual.Taxes))
@@ -88,7 +98,7 @@ func validatePrice(t *testing.T, actual Price, expected Price) {
 }
 
 func TestNoItems(t *testing.T) {
-	params := PriceParameters{"USA", "USD", nil, nil}
+	params := PriceParameters{"USA", "USD", nil, nil, false}
 	price := CalculatePrice(nil, nil, params, testLogger)
 	validatePrice(t, price, Price{
 		Subtotal: 0,
@@ -100,7 +110,7 @@ func TestNoItems(t *testing.T) {
 }
 
 func TestNoTaxes(t *testing.T) {
-	params := PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test"}}}
+	params := PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test"}}, false}
 	price := CalculatePrice(nil, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -113,7 +123,7 @@ func TestNoTaxes(t *testing.T) {
 }
 
 func TestFixedVAT(t *testing.T) {
-	params := PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test", vat: 9}}}
+	params := PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test", vat: 9}}, false}
 	price := CalculatePrice(nil, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -126,7 +136,7 @@ func TestFixedVAT(t *testing.T) {
 }
 
 func TestFixedVATWhenPricesIncludeTaxes(t *testing.T) {
-	params := PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test", vat: 9}}}
+	params := PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test", vat: 9}}, false}
 	price := CalculatePrice(&Settings{PricesIncludeTaxes: true}, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -147,7 +157,7 @@ func TestCountryBasedVAT(t *testing.T) {
 		}},
 	}
 
-	params := PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test"}}}
+	params := PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test"}}, false}
 	price := CalculatePrice(settings, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -159,9 +169,103 @@ func TestCountryBasedVAT(t *testing.T) {
 	})
 }
 
+func TestStackedTaxes(t *testing.T) {
+	settings := &Settings{
+		Taxes: []*Tax{
+			{Name: "State", Percentage: 6, Countries: []string{"USA"}},
+			{Name: "State", Percentage: 4},
+			{Name: "City", Percentage: 2, ProductTypes: []string{"test"}},
+		},
+	}
+
+	t.Run("Exclusive", func(t *testing.T) {
+		params := PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 999, itemType: "test"}}, false}
+		price := CalculatePrice(settings, nil, params, testLogger)
+
+		validatePrice(t, price, Price{
+			Subtotal: 999,
+			NetTotal: 999,
+			Taxes:    80,
+			Total:    1079,
+		})
+		assert.Equal(t, []TaxLine{
+			{Name: "State", Percentage: 6, Amount: 60},
+			{Name: "City", Percentage: 2, Amount: 20},
+		}, price.TaxLines)
+	})
+
+	t.Run("Inclusive", func(t *testing.T) {
+		settings := *settings
+		settings.PricesIncludeTaxes = true
+		params := PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 1080, itemType: "test", quantity: 2}}, false}
+		price := CalculatePrice(&settings, nil, params, testLogger)
+
+		validatePrice(t, price, Price{
+			Subtotal: 2000,
+			NetTotal: 2000,
+			Taxes:    160,
+			Total:    2160,
+		})
+		assert.Equal(t, []TaxLine{
+			{Name: "State", Percentage: 6, Amount: 120},
+			{Name: "City", Percentage: 2, Amount: 40},
+		}, price.TaxLines)
+	})
+
+	t.Run("FirstApplicable", func(t *testing.T) {
+		params := PriceParameters{"Canada", "USD", nil, []Item{&TestItem{price: 100, itemType: "other"}}, false}
+		price := CalculatePrice(settings, nil, params, testLogger)
+
+		assert.EqualValues(t, 4, price.Taxes)
+		assert.Equal(t, []TaxLine{{Name: "State", Percentage: 4, Amount: 4}}, price.TaxLines)
+	})
+
+	t.Run("Exempt", func(t *testing.T) {
+		params := PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 999, itemType: "test"}}, true}
+		price := CalculatePrice(settings, nil, params, testLogger)
+
+		assert.Zero(t, price.Taxes)
+		assert.Empty(t, price.TaxLines)
+	})
+}
+
+func TestTaxExempt(t *testing.T) {
+	settings := &Settings{
+		Taxes: []*Tax{&Tax{
+			Percentage:   21,
+			ProductTypes: []string{"test"},
+			Countries:    []string{"USA"},
+		}},
+	}
+
+	params := PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test"}}, true}
+	price := CalculatePrice(settings, nil, params, testLogger)
+
+	validatePrice(t, price, Price{
+		Subtotal: 100,
+		Discount: 0,
+		NetTotal: 100,
+		Taxes:    0,
+		Total:    100,
+	})
+}
+
+func TestTaxExemptWhenPricesIncludeTaxes(t *testing.T) {
+	params := PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 109, itemType: "test", vat: 9}}, true}
+	price := CalculatePrice(&Settings{PricesIncludeTaxes: true}, nil, params, testLogger)
+
+	validatePrice(t, price, Price{
+		Subtotal: 100,
+		Discount: 0,
+		NetTotal: 100,
+		Taxes:    0,
+		Total:    100,
+	})
+}
+
 func TestCouponWithNoTaxes(t *testing.T) {
 	coupon := &TestCoupon{itemType: "test", percentage: 10}
-	params := PriceParameters{"USA", "USD", coupon, []Item{&TestItem{price: 100, itemType: "test"}}}
+	params := PriceParameters{"USA", "USD", []Coupon{coupon}, []Item{&TestItem{price: 100, itemType: "test"}}, false}
 	price := CalculatePrice(nil, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -173,9 +277,39 @@ func TestCouponWithNoTaxes(t *testing.T) {
 	})
 }
 
+func TestStackedCoupons(t *testing.T) {
+	percentage := &TestCoupon{itemType: "test", percentage: 10}
+	fixed := &TestCoupon{itemType: "test", fixed: 5}
+	params := PriceParameters{"USA", "USD", []Coupon{percentage, fixed}, []Item{&TestItem{price: 100, itemType: "test"}}, false}
+	price := CalculatePrice(nil, nil, params, testLogger)
+
+	validatePrice(t, price, Price{
+		Subtotal: 100,
+		Discount: 15,
+		NetTotal: 85,
+		Taxes:    0,
+		Total:    85,
+	})
+}
+
+func TestStackedCouponsExceedingPrice(t *testing.T) {
+	first := &TestCoupon{itemType: "test", percentage: 60}
+	second := &TestCoupon{itemType: "test", percentage: 60}
+	params := PriceParameters{"USA", "USD", []Coupon{first, second}, []Item{&TestItem{price: 100, itemType: "test"}}, false}
+	price := CalculatePrice(nil, nil, params, testLogger)
+
+	validatePrice(t, price, Price{
+		Subtotal: 100,
+		Discount: 100,
+		NetTotal: 0,
+		Taxes:    0,
+		Total:    0,
+	})
+}
+
 func TestCouponWithVAT(t *testing.T) {
 	coupon := &TestCoupon{itemType: "test", percentage: 10}
-	params := PriceParameters{"USA", "USD", coupon, []Item{&TestItem{price: 100, itemType: "test", vat: 10}}}
+	params := PriceParameters{"USA", "USD", []Coupon{coupon}, []Item{&TestItem{price: 100, itemType: "test", vat: 10}}, false}
 	price := CalculatePrice(nil, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -187,10 +321,40 @@ func TestCouponWithVAT(t *testing.T) {
 	})
 }
 
+type TestDiscountedItem struct {
+	TestItem
+	discount uint64
+}
+
+func (t *TestDiscountedItem) GetManualDiscount() uint64 {
+	return t.discount
+}
+
+func TestManualDiscountWithVAT(t *testing.T) {
+	coupon := &TestCoupon{itemType: "test", percentage: 10}
+	item := &TestDiscountedItem{TestItem: TestItem{price: 100, itemType: "test", vat: 10, quantity: 2}, discount: 30}
+	params := PriceParameters{"USA", "USD", []Coupon{coupon}, []Item{item}, false}
+	price := CalculatePrice(nil, nil, params, testLogger)
+
+	validatePrice(t, price, Price{
+		Subtotal: 200,
+		Discount: 50,
+		NetTotal: 150,
+		Taxes:    15,
+		Total:    165,
+	})
+	require.Len(t, price.Items, 1)
+	assert.EqualValues(t, 25, price.Items[0].Discount)
+	assert.EqualValues(t, 50, price.Items[0].LineDiscount)
+	require.Len(t, price.Items[0].DiscountItems, 2)
+	assert.Equal(t, DiscountTypeManual, price.Items[0].DiscountItems[1].Type)
+	assert.EqualValues(t, 15, price.Items[0].DiscountItems[1].Fixed)
+}
+
 func TestCouponWithVATWhenPRiceIncludeTaxes(t *testing.T) {
 	coupon := &TestCoupon{itemType: "test", percentage: 10}
 	settings := &Settings{PricesIncludeTaxes: true}
-	params := PriceParameters{"USA", "USD", coupon, []Item{&TestItem{price: 100, itemType: "test", vat: 9}}}
+	params := PriceParameters{"USA", "USD", []Coupon{coupon}, []Item{&TestItem{price: 100, itemType: "test", vat: 9}}, false}
 	price := CalculatePrice(settings, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -205,7 +369,7 @@ func TestCouponWithVATWhenPRiceIncludeTaxes(t *testing.T) {
 func TestCouponWithVATWhenPRiceIncludeTaxesWithQuantity(t *testing.T) {
 	coupon := &TestCoupon{itemType: "test", percentage: 10}
 	settings := &Settings{PricesIncludeTaxes: true}
-	params := PriceParameters{"USA", "USD", coupon, []Item{&TestItem{quantity: 2, price: 100, itemType: "test", vat: 9}}}
+	params := PriceParameters{"USA", "USD", []Coupon{coupon}, []Item{&TestItem{quantity: 2, price: 100, itemType: "test", vat: 9}}, false}
 	price := CalculatePrice(settings, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -238,7 +402,7 @@ func TestPricingItems(t *testing.T) {
 			itemType: "ebook",
 		}},
 	}
-	params := PriceParameters{"DE", "USD", nil, []Item{item}}
+	params := PriceParameters{"DE", "USD", nil, []Item{item}, false}
 	price := CalculatePrice(settings, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -255,7 +419,7 @@ func TestMemberDiscounts(t *testing.T) {
 		Claims:     map[string]string{"app_metadata.plan": "member"},
 		Percentage: 10,
 	}}}
-	params := PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test", vat: 9}}}
+	params := PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test", vat: 9}}, false}
 	price := CalculatePrice(settings, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -269,7 +433,7 @@ func TestMemberDiscounts(t *testing.T) {
 	claims := map[string]interface{}{}
 	require.NoError(t, json.Unmarshal([]byte(`{"app_metadata": {"plan": "member"}}`), &claims))
 
-	params = PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test", vat: 9}}}
+	params = PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test", vat: 9}}, false}
 	price = CalculatePrice(settings, claims, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -290,7 +454,7 @@ func TestFixedMemberDiscounts(t *testing.T) {
 		}},
 	}}}
 
-	params := PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test", vat: 9}}}
+	params := PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test", vat: 9}}, false}
 	price := CalculatePrice(settings, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -304,7 +468,7 @@ func TestFixedMemberDiscounts(t *testing.T) {
 	claims := map[string]interface{}{}
 	require.NoError(t, json.Unmarshal([]byte(`{"app_metadata": {"plan": "member"}}`), &claims))
 
-	params = PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test", vat: 9}}}
+	params = PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 100, itemType: "test", vat: 9}}, false}
 	price = CalculatePrice(settings, claims, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -331,7 +495,7 @@ func TestMixedDiscounts(t *testing.T) {
 		price:    3490,
 	}
 
-	params := PriceParameters{"USA", "USD", nil, []Item{item}}
+	params := PriceParameters{"USA", "USD", nil, []Item{item}, false}
 	price := CalculatePrice(&settings, nil, params, testLogger)
 	assert.Equal(t, 3490, int(price.Total))
 
@@ -374,7 +538,7 @@ func TestRealWorldTaxCalculations(t *testing.T) {
 			Countries:    []string{"USA"},
 		}}
 
-		params := PriceParameters{"USA", "USD", nil, []Item{item1}}
+		params := PriceParameters{"USA", "USD", nil, []Item{item1}, false}
 		price := CalculatePrice(settings, nil, params, testLogger)
 
 		validatePrice(t, price, Price{
@@ -409,7 +573,7 @@ func TestRealWorldTaxCalculations(t *testing.T) {
 			}},
 		}
 
-		params := PriceParameters{"USA", "USD", nil, []Item{item1, item2}}
+		params := PriceParameters{"USA", "USD", nil, []Item{item1, item2}, false}
 		price := CalculatePrice(settings, nil, params, testLogger)
 
 		validatePrice(t, price, Price{
@@ -449,7 +613,7 @@ func TestRealWorldRelativeDiscountWithTaxes(t *testing.T) {
 	}
 
 	coupon := &TestCoupon{itemType: "book", percentage: 25}
-	params := PriceParameters{"Germany", "EUR", coupon, []Item{item}}
+	params := PriceParameters{"Germany", "EUR", []Coupon{coupon}, []Item{item}, false}
 	price := CalculatePrice(settings, nil, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -504,7 +668,7 @@ func TestRealWorldFixedDiscountWithTaxes(t *testing.T) {
 			},
 		},
 	}
-	params := PriceParameters{"Germany", "EUR", nil, []Item{item}}
+	params := PriceParameters{"Germany", "EUR", nil, []Item{item}, false}
 	price := CalculatePrice(settings, claims, params, testLogger)
 
 	validatePrice(t, price, Price{
@@ -515,3 +679,223 @@ func TestRealWorldFixedDiscountWithTaxes(t *testing.T) {
 		Total:    2900,
 	})
 }
+
+func testShippingSettings() *Settings {
+	return &Settings{Shipping: &ShippingSettings{Rates: []*ShippingRate{
+		{
+			Type:      FreeOverShipping,
+			Countries: []string{"USA"},
+			Threshold: []*ShippingPrice{{Amount: "50.00", Currency: "USD"}},
+			Prices:    []*ShippingPrice{{Amount: "4.99", Currency: "USD"}},
+		},
+		{
+			Type:      WeightShipping,
+			Countries: []string{"Germany"},
+			Tiers: []*ShippingTier{
+				{MaxWeight: 1000, Prices: []*ShippingPrice{{Amount: "5.00", Currency: "EUR"}}},
+				{MaxWeight: 0, Prices: []*ShippingPrice{{Amount: "12.00", Currency: "EUR"}}},
+			},
+		},
+		{
+			Type:   FlatShipping,
+			Prices: []*ShippingPrice{{Amount: "20.00", Currency: "USD"}},
+		},
+	}}}
+}
+
+func TestShippingFlatRate(t *testing.T) {
+	params := PriceParameters{"Canada", "USD", nil, []Item{&TestItem{price: 100, itemType: "test"}}, false}
+	price := CalculatePrice(testShippingSettings(), nil, params, testLogger)
+
+	assert.Equal(t, uint64(2000), price.Shipping)
+	assert.Equal(t, int64(2100), price.Total)
+}
+
+func TestShippingFreeOverThreshold(t *testing.T) {
+	settings := testShippingSettings()
+
+	params := PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 4999, itemType: "test"}}, false}
+	price := CalculatePrice(settings, nil, params, testLogger)
+	assert.Equal(t, uint64(499), price.Shipping)
+	assert.Equal(t, int64(5498), price.Total)
+
+	params = PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: 2500, quantity: 2, itemType: "test"}}, false}
+	price = CalculatePrice(settings, nil, params, testLogger)
+	assert.Equal(t, uint64(0), price.Shipping)
+	assert.Equal(t, int64(5000), price.Total)
+}
+
+func TestShippingWeightTiers(t *testing.T) {
+	settings := testShippingSettings()
+
+	params := PriceParameters{"Germany", "EUR", nil, []Item{&TestItem{price: 100, quantity: 2, weight: 500, itemType: "test"}}, false}
+	price := CalculatePrice(settings, nil, params, testLogger)
+	assert.Equal(t, uint64(500), price.Shipping)
+	assert.Equal(t, int64(700), price.Total)
+
+	params = PriceParameters{"Germany", "EUR", nil, []Item{&TestItem{price: 100, quantity: 3, weight: 500, itemType: "test"}}, false}
+	price = CalculatePrice(settings, nil, params, testLogger)
+	assert.Equal(t, uint64(1200), price.Shipping)
+	assert.Equal(t, int64(1500), price.Total)
+}
+
+func TestShippingWithoutPriceInCurrency(t *testing.T) {
+	params := PriceParameters{"Canada", "EUR", nil, []Item{&TestItem{price: 100, itemType: "test"}}, false}
+	price := CalculatePrice(testShippingSettings(), nil, params, testLogger)
+
+	assert.Equal(t, uint64(0), price.Shipping)
+	assert.Equal(t, int64(100), price.Total)
+}
+
+func TestShippingWithFreeShippingCoupon(t *testing.T) {
+	coupon := &TestCoupon{itemType: "test", freeShipping: true}
+	params := PriceParameters{"Canada", "USD", []Coupon{coupon}, []Item{&TestItem{price: 100, itemType: "test"}}, false}
+	price := CalculatePrice(testShippingSettings(), nil, params, testLogger)
+
+	assert.Equal(t, uint64(0), price.Shipping)
+	validatePrice(t, price, Price{
+		Subtotal: 100,
+		Discount: 0,
+		NetTotal: 100,
+		Taxes:    0,
+		Total:    100,
+	})
+}
+
+func TestCurrencyAmounts(t *testing.T) {
+	cases := []struct {
+		currency string
+		amount   string
+		minor    uint64
+		format   string
+	}{
+		{"USD", "19.99", 1999, "19.99"},
+		{"EUR", "0.29", 29, "0.29"},
+		{"JPY", "500", 500, "500"},
+		{"jpy", "500", 500, "500"},
+		{"BHD", "1.250", 1250, "1.250"},
+	}
+	for _, c := range cases {
+		minor, err := ParseAmount(c.amount, c.currency)
+		require.NoError(t, err)
+		assert.Equal(t, c.minor, minor, c.currency)
+		assert.Equal(t, c.format, FormatAmount(c.minor, c.currency), c.currency)
+	}
+
+	_, err := ParseAmount("nope", "USD")
+	assert.Error(t, err)
+}
+
+func TestShippingWithZeroDecimalCurrency(t *testing.T) {
+	settings := &Settings{Shipping: &ShippingSettings{Rates: []*ShippingRate{
+		{Type: FlatShipping, Prices: []*ShippingPrice{{Amount: "700", Currency: "JPY"}}},
+	}}}
+	params := PriceParameters{"Japan", "JPY", nil, []Item{&TestItem{price: 1000, itemType: "test"}}, false}
+	price := CalculatePrice(settings, nil, params, testLogger)
+
+	assert.Equal(t, uint64(700), price.Shipping)
+	assert.Equal(t, int64(1700), price.Total)
+}
+
+func TestNormalizeCurrency(t *testing.T) {
+	for _, currency := range []string{"usd", "USD", " Usd "} {
+		code, err := NormalizeCurrency(currency)
+		require.NoError(t, err)
+		assert.Equal(t, "USD", code)
+	}
+
+	_, err := NormalizeCurrency("monopoly-dollars")
+	assert.Error(t, err)
+	_, err = NormalizeCurrency("")
+	assert.Error(t, err)
+}
+
+func TestRoundingStrategies(t *testing.T) {
+	tests := []struct {
+		name         string
+		price        uint64
+		vat          uint64
+		includeTaxes bool
+		halfUp       uint64
+		halfEven     uint64
+		floor        uint64
+	}{
+		// 2% of 25 cents is 0.5 cents, i.e. $0.005
+		{name: "HalfCentDown", price: 25, vat: 2, halfUp: 1, halfEven: 0, floor: 0},
+		{name: "HalfCentUp", price: 75, vat: 2, halfUp: 2, halfEven: 2, floor: 1},
+		{name: "BelowHalf", price: 24, vat: 2, halfUp: 0, halfEven: 0, floor: 0},
+		{name: "AboveHalf", price: 26, vat: 2, halfUp: 1, halfEven: 1, floor: 0},
+		// 20% included in 9 cents is 1.5 cents
+		{name: "IncludedHalfUp", price: 9, vat: 20, includeTaxes: true, halfUp: 2, halfEven: 2, floor: 1},
+		{name: "IncludedHalfDown", price: 15, vat: 20, includeTaxes: true, halfUp: 3, halfEven: 2, floor: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expected := map[Rounding]uint64{
+				"":            test.halfUp,
+				RoundHalfUp:   test.halfUp,
+				RoundHalfEven: test.halfEven,
+				RoundFloor:    test.floor,
+			}
+			for rounding, taxes := range expected {
+				params := PriceParameters{"USA", "USD", nil, []Item{&TestItem{price: test.price, itemType: "test", vat: test.vat}}, false}
+				price := CalculatePrice(&Settings{PricesIncludeTaxes: test.includeTaxes, Rounding: rounding}, nil, params, testLogger)
+				assert.Equal(t, taxes, price.Taxes, "taxes rounded %s", rounding)
+				assert.Equal(t, int64(price.NetTotal+price.Taxes), price.Total)
+			}
+		})
+	}
+}
+
+func TestRoundingDiscounts(t *testing.T) {
+	// 15% off 10 cents is 1.5 cents
+	coupon := &TestCoupon{itemType: "test", percentage: 15}
+	params := PriceParameters{"USA", "USD", []Coupon{coupon}, []Item{&TestItem{price: 10, itemType: "test"}}, false}
+
+	assert.EqualValues(t, 2, CalculatePrice(&Settings{Rounding: RoundHalfUp}, nil, params, testLogger).Discount)
+	assert.EqualValues(t, 2, CalculatePrice(&Settings{Rounding: RoundHalfEven}, nil, params, testLogger).Discount)
+	assert.EqualValues(t, 1, CalculatePrice(&Settings{Rounding: RoundFloor}, nil, params, testLogger).Discount)
+}
+
+func TestRoundingValid(t *testing.T) {
+	assert.True(t, Rounding("").Valid())
+	assert.True(t, RoundHalfEven.Valid())
+	assert.False(t, Rounding("ceil").Valid())
+}
+
+func TestLineTaxes(t *testing.T) {
+	settings := &Settings{
+		Taxes: []*Tax{
+			{Percentage: 7, ProductTypes: []string{"food"}},
+			{Percentage: 19, ProductTypes: []string{"electronics"}},
+		},
+	}
+	params := PriceParameters{"Germany", "EUR", nil, []Item{
+		&TestItem{price: 333, itemType: "food", quantity: 3},
+		&TestItem{price: 1000, itemType: "electronics"},
+		&TestItem{price: 500, itemType: "gift_card"},
+	}, false}
+	price := CalculatePrice(settings, nil, params, testLogger)
+
+	validatePrice(t, price, Price{
+		Subtotal: 2499,
+		NetTotal: 2499,
+		Taxes:    260,
+		Total:    2759,
+	})
+	require.Len(t, price.Items, 3)
+	assert.EqualValues(t, 23, price.Items[0].Taxes)
+	assert.EqualValues(t, 70, price.Items[0].LineTaxes)
+	assert.Equal(t, []TaxLine{{Percentage: 7, Amount: 70}}, price.Items[0].LineTaxLines)
+	assert.EqualValues(t, 190, price.Items[1].LineTaxes)
+	assert.Equal(t, []TaxLine{{Percentage: 19, Amount: 190}}, price.Items[1].LineTaxLines)
+	assert.Zero(t, price.Items[2].LineTaxes)
+	assert.Empty(t, price.Items[2].LineTaxLines)
+
+	var lineTaxes uint64
+	for _, item := range price.Items {
+		lineTaxes += item.LineTaxes
+	}
+	assert.Equal(t, price.Taxes, lineTaxes)
+}
@@ -0,0 +1,102 @@
+package calculator
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// currencyCodes holds the active ISO 4217 currency codes.
+var currencyCodes = map[string]bool{
+	"AED": true, "AFN": true, "ALL": true, "AMD": true, "ANG": true, "AOA": true, "ARS": true, "AUD": true,
+	"AWG": true, "AZN": true, "BAM": true, "BBD": true, "BDT": true, "BGN": true, "BHD": true, "BIF": true,
+	"BMD": true, "BND": true, "BOB": true, "BOV": true, "BRL": true, "BSD": true, "BTN": true, "BWP": true,
+	"BYN": true, "BZD": true, "CAD": true, "CDF": true, "CHE": true, "CHF": true, "CHW": true, "CLF": true,
+	"CLP": true, "CNY": true, "COP": true, "COU": true, "CRC": true, "CUC": true, "CUP": true, "CVE": true,
+	"CZK": true, "DJF": true, "DKK": true, "DOP": true, "DZD": true, "EGP": true, "ERN": true, "ETB": true,
+	"EUR": true, "FJD": true, "FKP": true, "GBP": true, "GEL": true, "GHS": true, "GIP": true, "GMD": true,
+	"GNF": true, "GTQ": true, "GYD": true, "HKD": true, "HNL": true, "HRK": true, "HTG": true, "HUF": true,
+	"IDR": true, "ILS": true, "INR": true, "IQD": true, "IRR": true, "ISK": true, "JMD": true, "JOD": true,
+	"JPY": true, "KES": true, "KGS": true, "KHR": true, "KMF": true, "KPW": true, "KRW": true, "KWD": true,
+	"KYD": true, "KZT": true, "LAK": true, "LBP": true, "LKR": true, "LRD": true, "LSL": true, "LYD": true,
+	"MAD": true, "MDL": true, "MGA": true, "MKD": true, "MMK": true, "MNT": true, "MOP": true, "MRU": true,
+	"MUR": true, "MVR": true, "MWK": true, "MXN": true, "MXV": true, "MYR": true, "MZN": true, "NAD": true,
+	"NGN": true, "NIO": true, "NOK": true, "NPR": true, "NZD": true, "OMR": true, "PAB": true, "PEN": true,
+	"PGK": true, "PHP": true, "PKR": true, "PLN": true, "PYG": true, "QAR": true, "RON": true, "RSD": true,
+	"RUB": true, "RWF": true, "SAR": true, "SBD": true, "SCR": true, "SDG": true, "SEK": true, "SGD": true,
+	"SHP": true, "SLE": true, "SLL": true, "SOS": true, "SRD": true, "SSP": true, "STN": true, "SVC": true,
+	"SYP": true, "SZL": true, "THB": true, "TJS": true, "TMT": true, "TND": true, "TOP": true, "TRY": true,
+	"TTD": true, "TWD": true, "TZS": true, "UAH": true, "UGX": true, "USD": true, "USN": true, "UYI": true,
+	"UYU": true, "UYW": true, "UZS": true, "VED": true, "VES": true, "VND": true, "VUV": true, "WST": true,
+	"XAF": true, "XAG": true, "XAU": true, "XBA": true, "XBB": true, "XBC": true, "XBD": true, "XCD": true,
+	"XDR": true, "XOF": true, "XPD": true, "XPF": true, "XPT": true, "XSU": true, "XUA": true, "YER": true,
+	"ZAR": true, "ZMW": true, "ZWL": true,
+}
+
+// currencyExponents holds the ISO 4217 currencies whose minor unit isn't a
+// hundredth of the major unit. All other currencies have two decimals.
+var currencyExponents = map[string]int{
+	"BIF": 0,
+	"CLP": 0,
+	"DJF": 0,
+	"GNF": 0,
+	"ISK": 0,
+	"JPY": 0,
+	"KMF": 0,
+	"KRW": 0,
+	"PYG": 0,
+	"RWF": 0,
+	"UGX": 0,
+	"UYI": 0,
+	"VND": 0,
+	"VUV": 0,
+	"XAF": 0,
+	"XOF": 0,
+	"XPF": 0,
+	"BHD": 3,
+	"IQD": 3,
+	"JOD": 3,
+	"KWD": 3,
+	"LYD": 3,
+	"OMR": 3,
+	"TND": 3,
+	"CLF": 4,
+	"UYW": 4,
+}
+
+// CurrencyExponent returns the number of decimals of the minor unit of a
+// currency, e.g. 2 for USD and 0 for JPY.
+func CurrencyExponent(currency string) int {
+	if exp, ok := currencyExponents[strings.ToUpper(currency)]; ok {
+		return exp
+	}
+	return 2
+}
+
+// ParseAmount converts an amount in the major unit of a currency, as used in
+// product metadata and settings, to its minor unit.
+func ParseAmount(amount string, currency string) (uint64, error) {
+	value, err := strconv.ParseFloat(amount, 64)
+	if err != nil {
+		return 0, err
+	}
+	return rint(value * math.Pow10(CurrencyExponent(currency))), nil
+}
+
+// FormatAmount formats an amount in the minor unit of a currency as a
+// decimal, e.g. 1999 USD as "19.99" and 500 JPY as "500".
+func FormatAmount(amount uint64, currency string) string {
+	exp := CurrencyExponent(currency)
+	return strconv.FormatFloat(float64(amount)/math.Pow10(exp), 'f', exp, 64)
+}
+
+// NormalizeCurrency uppercases a currency code so "usd" and "USD" are the
+// same currency. It returns an error for codes that aren't in ISO 4217.
+func NormalizeCurrency(currency string) (string, error) {
+	code := strings.ToUpper(strings.TrimSpace(currency))
+	if !currencyCodes[code] {
+		return "", fmt.Errorf("Unknown currency: %v", currency)
+	}
+	return code, nil
+}
@@ -12,6 +12,7 @@ type DiscountType int
 const (
 	DiscountTypeCoupon DiscountType = iota + 1
 	DiscountTypeMember
+	DiscountTypeManual
 )
 
 func (t DiscountType) String() string {
@@ -20,6 +21,8 @@ func (t DiscountType) String() string {
 		return "coupon"
 	case DiscountTypeMember:
 		return "member"
+	case DiscountTypeManual:
+		return "manual"
 	}
 	return "unknown"
 }
@@ -45,6 +48,8 @@ func (t *DiscountType) UnmarshalJSON(b []byte) error {
 		*t = DiscountTypeCoupon
 	case "member":
 		*t = DiscountTypeMember
+	case "manual":
+		*t = DiscountTypeManual
 	default:
 		*t = 0
 	}
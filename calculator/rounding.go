@@ -0,0 +1,58 @@
+package calculator
+
+// Rounding is the strategy used to round fractions of the smallest currency
+// unit, which come up when taxes and discounts are calculated as percentages.
+//
+// Stripe and PayPal charge amounts in the smallest currency unit as they are
+// given and never round them, so they accept totals rounded with any strategy.
+// The strategy should match the one the shop reconciles its books with.
+type Rounding string
+
+// Rounding strategies
+const (
+	// RoundHalfUp rounds halves away from zero, e.g. 12.5 cents to 13 cents.
+	RoundHalfUp Rounding = "half_up"
+	// RoundHalfEven rounds halves to the even neighbour, e.g. 12.5 cents to
+	// 12 cents and 13.5 cents to 14 cents. It's also known as bankers' rounding.
+	RoundHalfEven Rounding = "half_even"
+	// RoundFloor drops fractions, e.g. 12.9 cents to 12 cents.
+	RoundFloor Rounding = "floor"
+)
+
+// Valid returns whether the rounding is a known strategy. The empty rounding
+// is valid and rounds half up.
+func (r Rounding) Valid() bool {
+	switch r {
+	case "", RoundHalfUp, RoundHalfEven, RoundFloor:
+		return true
+	}
+	return false
+}
+
+// divide returns num / den rounded with the strategy. It only uses integers,
+// so boundaries like half a cent are rounded exactly.
+func (r Rounding) divide(num, den uint64) uint64 {
+	if den == 0 {
+		return 0
+	}
+	quotient, remainder := num/den, num%den
+	switch r {
+	case RoundFloor:
+	case RoundHalfEven:
+		if 2*remainder > den || (2*remainder == den && quotient%2 == 1) {
+			quotient++
+		}
+	default:
+		if 2*remainder >= den {
+			quotient++
+		}
+	}
+	return quotient
+}
+
+func (s *Settings) rounding() Rounding {
+	if s == nil {
+		return RoundHalfUp
+	}
+	return s.Rounding
+}
@@ -0,0 +1,137 @@
+package calculator
+
+// Shipping rate types
+const (
+	FlatShipping     = "flat"
+	WeightShipping   = "weight"
+	FreeOverShipping = "free_over"
+)
+
+// ShippingSettings configures how shipping costs are calculated.
+// The first rate matching the shipping country is used.
+type ShippingSettings struct {
+	Rates []*ShippingRate `json:"rates"`
+}
+
+// ShippingPrice is a shipping amount in a currency.
+type ShippingPrice struct {
+	Amount   string `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// ShippingTier is a price for orders up to a maximum weight. A MaxWeight of 0
+// matches any weight.
+type ShippingTier struct {
+	MaxWeight uint64           `json:"max_weight"`
+	Prices    []*ShippingPrice `json:"prices"`
+}
+
+// ShippingRate represents a way to calculate shipping costs, potentially
+// specific to countries.
+type ShippingRate struct {
+	Type      string   `json:"type"`
+	Countries []string `json:"countries"`
+
+	// Prices are used by flat rates and by free-over rates below the threshold
+	Prices []*ShippingPrice `json:"prices"`
+	// Tiers are used by weight based rates, ordered by increasing MaxWeight
+	Tiers []*ShippingTier `json:"tiers"`
+	// Threshold is the order total from which free-over rates ship for free
+	Threshold []*ShippingPrice `json:"threshold"`
+}
+
+// ShippingParameters is the order information needed to calculate shipping.
+type ShippingParameters struct {
+	Country  string
+	Currency string
+	// Total is the price of the items including taxes and discounts
+	Total  uint64
+	Weight uint64
+}
+
+// WeightedItem is implemented by items that have a shipping weight.
+type WeightedItem interface {
+	GetWeight() uint64
+}
+
+// ShippingCalculator calculates the shipping costs for a rate. It returns
+// false if the rate has no price for the parameters.
+type ShippingCalculator func(rate *ShippingRate, params ShippingParameters) (uint64, bool)
+
+// ShippingCalculators maps shipping rate types to their calculator.
+var ShippingCalculators = map[string]ShippingCalculator{
+	FlatShipping:     flatShipping,
+	WeightShipping:   weightShipping,
+	FreeOverShipping: freeOverShipping,
+}
+
+// AppliesTo determines if the shipping rate applies to the country provided.
+func (r *ShippingRate) AppliesTo(country string) bool {
+	if len(r.Countries) == 0 {
+		return true
+	}
+	for _, c := range r.Countries {
+		if c == country {
+			return true
+		}
+	}
+	return false
+}
+
+// CalculateShipping returns the shipping costs using the first rate that
+// applies to the shipping country.
+func CalculateShipping(settings *Settings, params ShippingParameters) uint64 {
+	if settings == nil || settings.Shipping == nil {
+		return 0
+	}
+	for _, rate := range settings.Shipping.Rates {
+		if !rate.AppliesTo(params.Country) {
+			continue
+		}
+		calc, ok := ShippingCalculators[rate.Type]
+		if !ok {
+			continue
+		}
+		if amount, ok := calc(rate, params); ok {
+			return amount
+		}
+	}
+	return 0
+}
+
+func shippingAmount(prices []*ShippingPrice, currency string) (uint64, bool) {
+	for _, price := range prices {
+		if price.Currency == currency {
+			amount, err := ParseAmount(price.Amount, currency)
+			if err != nil {
+				return 0, false
+			}
+			return amount, true
+		}
+	}
+	return 0, false
+}
+
+func flatShipping(rate *ShippingRate, params ShippingParameters) (uint64, bool) {
+	return shippingAmount(rate.Prices, params.Currency)
+}
+
+func weightShipping(rate *ShippingRate, params ShippingParameters) (uint64, bool) {
+	for _, tier := range rate.Tiers {
+		if tier.MaxWeight == 0 || params.Weight <= tier.MaxWeight {
+			return shippingAmount(tier.Prices, params.Currency)
+		}
+	}
+	return 0, false
+}
+
+func freeOverShipping(rate *ShippingRate, params ShippingParameters) (uint64, bool) {
+	threshold, ok := shippingAmount(rate.Threshold, params.Currency)
+	if !ok {
+		return 0, false
+	}
+	if params.Total >= threshold {
+		return 0, true
+	}
+	return shippingAmount(rate.Prices, params.Currency)
+}
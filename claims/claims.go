@@ -11,9 +11,16 @@ type JWTClaims struct {
 	Email        string                 `json:"email"`
 	AppMetaData  map[string]interface{} `json:"app_metadata"`
 	UserMetaData map[string]interface{} `json:"user_metadata"`
+	// ImpersonatorID is the admin that acts as the user with the token
+	ImpersonatorID string `json:"impersonator_id,omitempty"`
 	jwt.StandardClaims
 }
 
+// Impersonated reports whether an admin acts as the user with the token.
+func (c *JWTClaims) Impersonated() bool {
+	return c.ImpersonatorID != ""
+}
+
 // HasClaims is used to determine if a set of userClaims matches the requiredClaims
 func HasClaims(userClaims map[string]interface{}, requiredClaims map[string]string) bool {
 	if requiredClaims == nil {
@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"testing"
+	"time"
 
+	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -29,3 +31,46 @@ func TestClaims(t *testing.T) {
 	matches = HasClaims(claims, required)
 	assert.False(t, matches)
 }
+
+func TestOrderToken(t *testing.T) {
+	token, err := NewOrderToken("first-order", "secret", time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, VerifyOrderToken(token, "first-order", "secret"))
+	assert.False(t, VerifyOrderToken(token, "second-order", "secret"))
+	assert.False(t, VerifyOrderToken(token, "first-order", "other-secret"))
+	assert.False(t, VerifyOrderToken("", "first-order", "secret"))
+
+	id, ok := ParseOrderToken(token, "first-order", "secret")
+	assert.True(t, ok)
+	assert.NotEmpty(t, id)
+	other, err := NewOrderToken("first-order", "secret", time.Hour)
+	assert.NoError(t, err)
+	otherID, _ := ParseOrderToken(other, "first-order", "secret")
+	assert.NotEqual(t, id, otherID)
+
+	expired, err := NewOrderToken("first-order", "secret", -time.Hour)
+	assert.NoError(t, err)
+	assert.False(t, VerifyOrderToken(expired, "first-order", "secret"))
+
+	_, err = NewOrderToken("first-order", "", time.Hour)
+	assert.Error(t, err)
+}
+
+func TestImpersonationToken(t *testing.T) {
+	token, err := NewImpersonationToken("user-1", "user@example.com", "admin-1", "", "", "secret", time.Hour)
+	assert.NoError(t, err)
+
+	c := &JWTClaims{}
+	_, err = jwt.ParseWithClaims(token, c, func(token *jwt.Token) (interface{}, error) {
+		return []byte("secret"), nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "user-1", c.Subject)
+	assert.Equal(t, "user@example.com", c.Email)
+	assert.Equal(t, "admin-1", c.ImpersonatorID)
+	assert.True(t, c.Impersonated())
+	assert.Nil(t, c.AppMetaData)
+
+	_, err = NewImpersonationToken("user-1", "user@example.com", "admin-1", "", "", "", time.Hour)
+	assert.Error(t, err)
+}
@@ -0,0 +1,57 @@
+package claims
+
+import (
+	"errors"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pborman/uuid"
+)
+
+// OrderTokenAudience is the audience of tokens granting access to a single order.
+const OrderTokenAudience = "gocommerce-order"
+
+// NewOrderToken signs a short-lived token that grants access to an order
+// without logging in. Every token has a unique ID, so it can be marked as
+// used.
+func NewOrderToken(orderID, secret string, ttl time.Duration) (string, error) {
+	if secret == "" {
+		return "", errors.New("A secret is required to sign order tokens")
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &jwt.StandardClaims{
+		Id:        uuid.NewRandom().String(),
+		Subject:   orderID,
+		Audience:  OrderTokenAudience,
+		ExpiresAt: time.Now().Add(ttl).Unix(),
+	})
+	return token.SignedString([]byte(secret))
+}
+
+// VerifyOrderToken checks that a token signed with NewOrderToken is valid
+// and grants access to the order.
+func VerifyOrderToken(tokenString, orderID, secret string) bool {
+	_, ok := ParseOrderToken(tokenString, orderID, secret)
+	return ok
+}
+
+// ParseOrderToken checks a token like VerifyOrderToken and returns its ID,
+// which is empty for tokens signed before tokens had IDs.
+func ParseOrderToken(tokenString, orderID, secret string) (string, bool) {
+	if tokenString == "" || secret == "" {
+		return "", false
+	}
+	c := &jwt.StandardClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, c, func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, errors.New("Invalid signing method")
+		}
+		return []byte(secret), nil
+	})
+	if err != nil || !token.Valid {
+		return "", false
+	}
+	if !c.VerifyAudience(OrderTokenAudience, true) || c.Subject != orderID {
+		return "", false
+	}
+	return c.Id, true
+}
@@ -0,0 +1,55 @@
+package claims
+
+// Permissions granted to the roles of tokens. Admins have all of them.
+const (
+	OrdersRead       = "orders:read"
+	OrdersWrite      = "orders:write"
+	PaymentsRead     = "payments:read"
+	PaymentsWrite    = "payments:write"
+	RefundsWrite     = "refunds:write"
+	UsersRead        = "users:read"
+	UsersWrite       = "users:write"
+	UsersDelete      = "users:delete"
+	UsersImpersonate = "users:impersonate"
+	ReportsRead      = "reports:read"
+	InventoryRead    = "inventory:read"
+	InventoryWrite   = "inventory:write"
+	CouponsRead      = "coupons:read"
+	GiftCardsRead    = "gift_cards:read"
+	GiftCardsWrite   = "gift_cards:write"
+	WebhooksRead     = "webhooks:read"
+	WebhooksWrite    = "webhooks:write"
+	AuditRead        = "audit:read"
+	JobsRead         = "jobs:read"
+)
+
+// AllPermissions lists every permission.
+var AllPermissions = []string{
+	OrdersRead, OrdersWrite,
+	PaymentsRead, PaymentsWrite, RefundsWrite,
+	UsersRead, UsersWrite, UsersDelete, UsersImpersonate,
+	ReportsRead,
+	InventoryRead, InventoryWrite,
+	CouponsRead,
+	GiftCardsRead, GiftCardsWrite,
+	WebhooksRead, WebhooksWrite,
+	AuditRead,
+	JobsRead,
+}
+
+// StaffPermissions are granted to staff groups, who can look at the orders,
+// users and payments of the shop but not change them.
+var StaffPermissions = []string{
+	OrdersRead, PaymentsRead, UsersRead, ReportsRead,
+	InventoryRead, CouponsRead, GiftCardsRead,
+}
+
+// IsPermission reports whether name is a known permission.
+func IsPermission(name string) bool {
+	for _, p := range AllPermissions {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
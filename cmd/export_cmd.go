@@ -0,0 +1,231 @@
+package cmd
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const exportDateFormat = "2006-01-02"
+
+var exportFrom string
+var exportTo string
+var exportOut string
+var exportFormat string
+
+var exportCmd = cobra.Command{
+	Use:  "export",
+	Long: "Export data from the database",
+}
+
+var exportOrdersCmd = cobra.Command{
+	Use:  "orders",
+	Long: "Export the orders created in a date range as CSV or JSON. Dates are inclusive and formatted as YYYY-MM-DD.",
+	Run: func(cmd *cobra.Command, args []string) {
+		execWithConfig(cmd, exportOrders)
+	},
+}
+
+var orderCSVHeader = []string{
+	"order_id", "invoice_number", "created_at", "email", "user_id", "currency",
+	"payment_state", "fulfillment_state", "subtotal", "discount", "taxes", "shipping", "total",
+	"billing_name", "billing_company", "billing_address1", "billing_address2", "billing_city", "billing_state", "billing_zip", "billing_country",
+	"shipping_name", "shipping_company", "shipping_address1", "shipping_address2", "shipping_city", "shipping_state", "shipping_zip", "shipping_country",
+	"item_sku", "item_title", "item_type", "item_quantity", "item_price", "item_total",
+}
+
+func exportOrders(globalConfig *conf.GlobalConfiguration, log logrus.FieldLogger, config *conf.Configuration) {
+	from, to, err := exportRange(exportFrom, exportTo)
+	if err != nil {
+		log.Fatalf("Invalid date range: %+v", err)
+	}
+
+	var write func(out io.Writer, rows rowScanner) error
+	switch exportFormat {
+	case "csv":
+		write = writeOrdersCSV
+	case "json":
+		write = writeOrdersJSON
+	default:
+		log.Fatalf("Unknown export format '%s', choose from csv or json", exportFormat)
+	}
+
+	db, err := models.Connect(globalConfig, log.WithField("component", "db"))
+	if err != nil {
+		log.Fatalf("Error opening database: %+v", err)
+	}
+	defer db.Close()
+	db.LogMode(false)
+
+	out := io.Writer(os.Stdout)
+	if exportOut != "" && exportOut != "-" {
+		f, err := os.Create(exportOut)
+		if err != nil {
+			log.Fatalf("Error creating output file: %+v", err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	query := db.Model(&models.Order{})
+	if !from.IsZero() {
+		query = query.Where("created_at >= ?", from)
+	}
+	if !to.IsZero() {
+		query = query.Where("created_at < ?", to)
+	}
+	rows, err := query.Order("created_at asc").Rows()
+	if err != nil {
+		log.Fatalf("Error querying orders: %+v", err)
+	}
+	defer rows.Close()
+
+	if err := write(out, rowScanner{db, rows}); err != nil {
+		log.Fatalf("Error exporting orders: %+v", err)
+	}
+}
+
+// exportRange parses the inclusive date range given on the command line
+// into a half open time range.
+func exportRange(from, to string) (time.Time, time.Time, error) {
+	var start, end time.Time
+	var err error
+	if from != "" {
+		start, err = time.Parse(exportDateFormat, from)
+		if err != nil {
+			return start, end, errors.Wrap(err, "parsing --from")
+		}
+	}
+	if to != "" {
+		end, err = time.Parse(exportDateFormat, to)
+		if err != nil {
+			return start, end, errors.Wrap(err, "parsing --to")
+		}
+		end = end.AddDate(0, 0, 1)
+	}
+	return start, end, nil
+}
+
+// rowScanner loads one order at a time so exports never hold the full
+// result set in memory.
+type rowScanner struct {
+	db   *gorm.DB
+	rows *sql.Rows
+}
+
+func (s rowScanner) next() (*models.Order, error) {
+	if !s.rows.Next() {
+		return nil, s.rows.Err()
+	}
+	order := &models.Order{}
+	if err := s.db.ScanRows(s.rows, order); err != nil {
+		return nil, err
+	}
+	if err := order.AfterFind(); err != nil {
+		return nil, err
+	}
+	if rsp := s.db.Where("order_id = ?", order.ID).Order("id asc").Find(&order.LineItems); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	if rsp := s.db.Unscoped().Where("id = ?", order.ShippingAddressID).Find(&order.ShippingAddress); rsp.Error != nil && !rsp.RecordNotFound() {
+		return nil, rsp.Error
+	}
+	if rsp := s.db.Unscoped().Where("id = ?", order.BillingAddressID).Find(&order.BillingAddress); rsp.Error != nil && !rsp.RecordNotFound() {
+		return nil, rsp.Error
+	}
+	return order, nil
+}
+
+func writeOrdersCSV(out io.Writer, rows rowScanner) error {
+	w := csv.NewWriter(out)
+	if err := w.Write(orderCSVHeader); err != nil {
+		return err
+	}
+
+	for {
+		order, err := rows.next()
+		if err != nil {
+			return err
+		}
+		if order == nil {
+			break
+		}
+
+		record := []string{
+			order.ID, strconv.FormatInt(order.InvoiceNumber, 10), order.CreatedAt.Format(time.RFC3339), order.Email, order.UserID, order.Currency,
+			order.PaymentState, order.FulfillmentState, formatUint(order.SubTotal), formatUint(order.Discount), formatUint(order.Taxes), formatUint(order.Shipping), formatUint(order.Total),
+		}
+		record = append(record, addressColumns(order.BillingAddress)...)
+		record = append(record, addressColumns(order.ShippingAddress)...)
+
+		if len(order.LineItems) == 0 {
+			if err := w.Write(append(record, "", "", "", "", "", "")); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, item := range order.LineItems {
+			var total int64
+			if item.CalculationDetail != nil {
+				total = item.Total
+			}
+			itemRecord := append(record[:len(record):len(record)],
+				item.Sku, item.Title, item.Type, formatUint(item.Quantity), formatUint(item.Price), strconv.FormatInt(total, 10),
+			)
+			if err := w.Write(itemRecord); err != nil {
+				return err
+			}
+		}
+		w.Flush()
+	}
+
+	w.Flush()
+	return w.Error()
+}
+
+func writeOrdersJSON(out io.Writer, rows rowScanner) error {
+	if _, err := io.WriteString(out, "["); err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(out)
+	for i := 0; ; i++ {
+		order, err := rows.next()
+		if err != nil {
+			return err
+		}
+		if order == nil {
+			break
+		}
+		if i > 0 {
+			if _, err := io.WriteString(out, ","); err != nil {
+				return err
+			}
+		}
+		if err := enc.Encode(order); err != nil {
+			return err
+		}
+	}
+
+	_, err := io.WriteString(out, "]\n")
+	return err
+}
+
+func addressColumns(a models.Address) []string {
+	return []string{a.Name, a.Company, a.Address1, a.Address2, a.City, a.State, a.Zip, a.Country}
+}
+
+func formatUint(v uint64) string {
+	return strconv.FormatUint(v, 10)
+}
@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var resendOrderID string
+var resendHookType string
+
+var hooksCmd = cobra.Command{
+	Use:  "hooks",
+	Long: "Manage webhooks",
+}
+
+var hooksResendCmd = cobra.Command{
+	Use:  "resend",
+	Long: "Queue the webhooks for an order again, for the configured URL and the subscriptions. Useful when the receiving system was unavailable.",
+	Run: func(cmd *cobra.Command, args []string) {
+		execWithConfig(cmd, resendHooks)
+	},
+}
+
+func resendHooks(globalConfig *conf.GlobalConfiguration, log logrus.FieldLogger, config *conf.Configuration) {
+	if resendOrderID == "" {
+		log.Fatal("An order ID is required, use --order")
+	}
+
+	db, err := models.Connect(globalConfig, log.WithField("component", "db"))
+	if err != nil {
+		log.Fatalf("Error opening database: %+v", err)
+	}
+	defer db.Close()
+
+	order := &models.Order{}
+	rsp := db.
+		Preload("LineItems").
+		Preload("Downloads").
+		Preload("ShippingAddress").
+		Preload("BillingAddress").
+		First(order, "id = ?", resendOrderID)
+	if rsp.RecordNotFound() {
+		log.Fatalf("No order with ID %s found", resendOrderID)
+	}
+	if rsp.Error != nil {
+		log.Fatalf("Error loading order: %+v", rsp.Error)
+	}
+
+	if order.InstanceID != "" {
+		instance, err := models.GetInstance(db, order.InstanceID)
+		if err != nil {
+			log.Fatalf("Error loading instance: %+v", err)
+		}
+		if config, err = instance.Config(); err != nil {
+			log.Fatalf("Error loading instance configuration: %+v", err)
+		}
+	}
+
+	type hookPayload struct {
+		userID  string
+		payload interface{}
+	}
+	var hookURL string
+	payloads := []hookPayload{}
+	switch resendHookType {
+	case "order", "payment":
+		hookURL = config.Webhooks.Order
+		if resendHookType == "payment" {
+			hookURL = config.Webhooks.Payment
+		}
+		payloads = append(payloads, hookPayload{order.UserID, order})
+	case "refund":
+		hookURL = config.Webhooks.Refund
+		refunds := []*models.Transaction{}
+		if rsp := db.Where("order_id = ? AND type = ?", order.ID, models.RefundTransactionType).Find(&refunds); rsp.Error != nil {
+			log.Fatalf("Error loading refunds: %+v", rsp.Error)
+		}
+		if len(refunds) == 0 {
+			log.Fatalf("Order %s has no refunds", order.ID)
+		}
+		for _, refund := range refunds {
+			payloads = append(payloads, hookPayload{refund.UserID, refund})
+		}
+	default:
+		log.Fatalf("Unknown webhook type '%s', choose from payment, refund or order", resendHookType)
+	}
+
+	var subscriptions int
+	rsp = db.Model(&models.WebhookSubscription{}).
+		Where("instance_id = ? AND event_type = ? AND enabled = ?", order.InstanceID, resendHookType, true).
+		Count(&subscriptions)
+	if rsp.Error != nil {
+		log.Fatalf("Error loading webhook subscriptions: %+v", rsp.Error)
+	}
+	targets := subscriptions
+	if hookURL != "" {
+		targets++
+	}
+	if targets == 0 {
+		log.Fatalf("No %s webhook configured", resendHookType)
+	}
+
+	// the hooks are delivered by the job queue of the server, like any other hook
+	tx := db.Begin()
+	for _, p := range payloads {
+		if err := models.RunHooks(tx, config, order.InstanceID, resendHookType, hookURL, p.userID, p.payload); err != nil {
+			tx.Rollback()
+			log.Fatalf("Error queueing webhook: %+v", err)
+		}
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		log.Fatalf("Error queueing webhook: %+v", rsp.Error)
+	}
+	fmt.Printf("Queued %d %s hooks for order %s, they are delivered by the server\n", targets*len(payloads), resendHookType, order.ID)
+}
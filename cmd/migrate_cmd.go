@@ -1,6 +1,8 @@
 package cmd
 
 import (
+	"fmt"
+
 	"github.com/netlify/gocommerce/conf"
 	"github.com/netlify/gocommerce/models"
 	"github.com/sirupsen/logrus"
@@ -9,16 +11,49 @@ import (
 
 var migrateCmd = cobra.Command{
 	Use:  "migrate",
-	Long: "Migrate database strucutures. This will create new tables and add missing collumns and indexes.",
+	Long: "Migrate database strucutures. This will create new tables, add missing collumns and indexes and apply pending migrations.",
 	Run: func(cmd *cobra.Command, args []string) {
 		execWithConfig(cmd, migrate)
 	},
 }
 
+var migrateStatusCmd = cobra.Command{
+	Use:  "status",
+	Long: "List the migrations and whether they have been applied.",
+	Run: func(cmd *cobra.Command, args []string) {
+		execWithConfig(cmd, migrateStatus)
+	},
+}
+
 func migrate(globalConfig *conf.GlobalConfiguration, log logrus.FieldLogger, config *conf.Configuration) {
 	db, err := models.Connect(globalConfig, log)
 	if err != nil {
 		logrus.Fatalf("Error opening database: %+v", err)
 	}
 	defer db.Close()
+
+	if err := models.Migrate(db, log.WithField("task", "migration")); err != nil {
+		log.Fatalf("Error migrating database: %+v", err)
+	}
+}
+
+func migrateStatus(globalConfig *conf.GlobalConfiguration, log logrus.FieldLogger, config *conf.Configuration) {
+	globalConfig.DB.Automigrate = false
+	db, err := models.Connect(globalConfig, log)
+	if err != nil {
+		logrus.Fatalf("Error opening database: %+v", err)
+	}
+	defer db.Close()
+
+	statuses, err := models.MigrationStatuses(db)
+	if err != nil {
+		log.Fatalf("Error loading migrations: %+v", err)
+	}
+	for _, status := range statuses {
+		state := "pending"
+		if status.AppliedAt != nil {
+			state = "applied " + status.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%4d  %-28s  %s\n", status.Version, state, status.Name)
+	}
 }
@@ -38,13 +38,22 @@ func multi(cmd *cobra.Command, args []string) {
 	}
 	defer bgDB.Close()
 
+	readDB, err := models.ConnectRead(globalConfig, log.WithField("component", "db").WithField("replica", true))
+	if err != nil {
+		logrus.Fatalf("Error opening read replica: %+v", err)
+	}
+	if readDB != nil {
+		defer readDB.Close()
+	}
+
 	globalConfig.MultiInstanceMode = true
-	api := api.NewAPIWithVersion(context.Background(), globalConfig, log, db.Debug(), Version)
+	api := api.NewAPIWithReadDB(context.Background(), globalConfig, log, db.Debug(), readDB, Version)
 
 	l := fmt.Sprintf("%v:%v", globalConfig.API.Host, globalConfig.API.Port)
 	logrus.Infof("GoCommerce API started on: %s", l)
 
-	models.RunHooks(bgDB, logrus.WithField("component", "hooks"))
+	models.RunJobs(bgDB, api.JobHandlers(nil), logrus.WithField("component", "jobs"))
+	models.RunOrderExpiry(bgDB, nil, logrus.WithField("component", "expiry"))
 
 	api.ListenAndServe(l)
 }
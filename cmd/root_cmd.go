@@ -21,7 +21,21 @@ var rootCmd = cobra.Command{
 // RootCmd will add flags and subcommands to the different commands
 func RootCmd() *cobra.Command {
 	rootCmd.PersistentFlags().StringVarP(&configFile, "config", "c", "", "The configuration file")
-	rootCmd.AddCommand(&serveCmd, &migrateCmd, &multiCmd, &versionCmd)
+	hooksResendCmd.Flags().StringVar(&resendOrderID, "order", "", "The ID of the order to resend webhooks for")
+	hooksResendCmd.Flags().StringVar(&resendHookType, "type", "payment", "The webhook to resend: payment, refund or order")
+	hooksCmd.AddCommand(&hooksResendCmd)
+
+	exportOrdersCmd.Flags().StringVar(&exportFrom, "from", "", "Export orders created on or after this date (YYYY-MM-DD)")
+	exportOrdersCmd.Flags().StringVar(&exportTo, "to", "", "Export orders created on or before this date (YYYY-MM-DD)")
+	exportOrdersCmd.Flags().StringVar(&exportOut, "out", "", "The file to write to, defaults to stdout")
+	exportOrdersCmd.Flags().StringVar(&exportFormat, "format", "csv", "The output format: csv or json")
+	exportCmd.AddCommand(&exportOrdersCmd)
+
+	migrateCmd.AddCommand(&migrateStatusCmd)
+
+	seedCmd.Flags().BoolVar(&seedForce, "force", false, "Seed the database even if it already contains data")
+
+	rootCmd.AddCommand(&serveCmd, &migrateCmd, &multiCmd, &versionCmd, &hooksCmd, &exportCmd, &seedCmd)
 	return &rootCmd
 }
 
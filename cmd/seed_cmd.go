@@ -0,0 +1,168 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+	"github.com/pborman/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var seedForce bool
+
+var seedCmd = cobra.Command{
+	Use:  "seed",
+	Long: "Fill the database with demo users, orders and transactions. Refuses to run on a database with existing orders or users unless --force is passed.",
+	Run: func(cmd *cobra.Command, args []string) {
+		execWithConfig(cmd, seed)
+	},
+}
+
+type seedUser struct {
+	id, email, name string
+	address         models.AddressRequest
+}
+
+type seedOrder struct {
+	user             int
+	processor        string
+	paymentState     string
+	fulfillmentState string
+	items            []*models.LineItem
+}
+
+var seedUsers = []seedUser{
+	{"demo-user-1", "bruce@example.com", "Bruce Wayne", models.AddressRequest{
+		Name: "Bruce Wayne", Address1: "1007 Mountain Drive", City: "Gotham", State: "NJ", Country: "USA", Zip: "07001",
+	}},
+	{"demo-user-2", "diana@example.com", "Diana Prince", models.AddressRequest{
+		Name: "Diana Prince", Company: "Themyscira Imports", Address1: "Unter den Linden 1", City: "Berlin", Country: "Germany", Zip: "10117",
+	}},
+	{"demo-user-3", "clark@example.com", "Clark Kent", models.AddressRequest{
+		Name: "Clark Kent", Address1: "344 Clinton Street", City: "Metropolis", State: "NY", Country: "USA", Zip: "10001",
+	}},
+}
+
+var seedOrders = []seedOrder{
+	{0, "stripe", models.PaidState, models.ShippedState, []*models.LineItem{
+		{Title: "batwing", Sku: "123-i-can-fly-456", Type: "plane", Description: "it's the batwing.", Price: 1200, Quantity: 2, Path: "/i/believe/i/can/fly"},
+	}},
+	{0, "paypal", models.PaidState, models.PendingState, []*models.LineItem{
+		{Title: "tumbler", Sku: "456-i-rollover-all-things", Type: "tank", Description: "OMG yes", Price: 500, Quantity: 2, Path: "/i/crush/villians/dreams"},
+		{Title: "utility belt", Sku: "234-fancy-belts", Type: "clothes", Description: "stylish but still useful", Price: 4500, Quantity: 1, Path: "/i/hold/the/universe/on/my/waist"},
+	}},
+	{1, "stripe", models.PaidState, models.ShippingState, []*models.LineItem{
+		{Title: "lasso of truth", Sku: "789-honest-rope", Type: "accessory", Description: "no lies allowed", Price: 2999, Quantity: 1, Path: "/lasso"},
+	}},
+	{1, "", models.PendingState, models.PendingState, []*models.LineItem{
+		{Title: "invisible jet", Sku: "101-now-you-see-me", Type: "plane", Description: "hard to find in the hangar", Price: 99900, Quantity: 1, Path: "/jet"},
+	}},
+	{2, "stripe", models.FailedState, models.PendingState, []*models.LineItem{
+		{Title: "cape", Sku: "202-red-cape", Type: "clothes", Description: "machine washable", Price: 1500, Quantity: 3, Path: "/cape"},
+	}},
+}
+
+func seed(globalConfig *conf.GlobalConfiguration, log logrus.FieldLogger, config *conf.Configuration) {
+	db, err := models.Connect(globalConfig, log.WithField("component", "db"))
+	if err != nil {
+		log.Fatalf("Error opening database: %+v", err)
+	}
+	defer db.Close()
+
+	if !seedForce {
+		var orders, users int
+		db.Model(&models.Order{}).Count(&orders)
+		db.Model(&models.User{}).Count(&users)
+		if orders > 0 || users > 0 {
+			log.Fatalf("The database already contains %d orders and %d users, use --force to seed it anyway", orders, users)
+		}
+	}
+
+	tx := db.Begin()
+	if err := seedData(tx, log, config); err != nil {
+		tx.Rollback()
+		log.Fatalf("Error seeding database: %+v", err)
+	}
+	if err := tx.Commit().Error; err != nil {
+		log.Fatalf("Error seeding database: %+v", err)
+	}
+
+	fmt.Printf("Seeded %d users and %d orders\n", len(seedUsers), len(seedOrders))
+}
+
+func seedData(tx *gorm.DB, log logrus.FieldLogger, config *conf.Configuration) error {
+	users := make([]*models.User, len(seedUsers))
+	addresses := make([]*models.Address, len(seedUsers))
+	for i, u := range seedUsers {
+		users[i] = &models.User{ID: u.id, Email: u.email, Name: u.name}
+		if err := tx.Save(users[i]).Error; err != nil {
+			return err
+		}
+
+		addresses[i] = &models.Address{
+			AddressRequest: u.address,
+			ID:             uuid.NewRandom().String(),
+			UserID:         u.id,
+		}
+		if err := tx.Create(addresses[i]).Error; err != nil {
+			return err
+		}
+	}
+
+	for _, o := range seedOrders {
+		user := users[o.user]
+		address := addresses[o.user]
+
+		order := models.NewOrder("", "", user.Email, "USD")
+		order.UserID = user.ID
+		order.ShippingAddress = *address
+		order.ShippingAddressID = address.ID
+		order.BillingAddress = *address
+		order.BillingAddressID = address.ID
+		order.PaymentProcessor = o.processor
+		order.PaymentState = o.paymentState
+		order.FulfillmentState = o.fulfillmentState
+
+		for _, item := range o.items {
+			// copy so the seed data can be reused with --force
+			lineItem := *item
+			lineItem.OrderID = order.ID
+			order.LineItems = append(order.LineItems, &lineItem)
+		}
+		order.Recalculate(&calculator.Settings{}, nil, log)
+
+		if o.paymentState != models.PendingState {
+			invoiceNumber, err := models.NextInvoiceNumber(tx, order.InstanceID)
+			if err != nil {
+				return err
+			}
+			order.InvoiceNumber = invoiceNumber
+		}
+		if err := order.AssignNumber(tx, config); err != nil {
+			return err
+		}
+		if err := tx.Create(order).Error; err != nil {
+			return err
+		}
+
+		if o.processor == "" {
+			continue
+		}
+		trans := models.NewTransaction(order)
+		trans.InvoiceNumber = order.InvoiceNumber
+		trans.ProcessorID = "demo-" + uuid.NewRandom().String()
+		trans.Status = o.paymentState
+		if o.paymentState == models.FailedState {
+			trans.FailureCode = "500"
+			trans.FailureDescription = "Your card was declined"
+		}
+		if err := tx.Create(trans).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
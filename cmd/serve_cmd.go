@@ -32,16 +32,25 @@ func serve(globalConfig *conf.GlobalConfiguration, log logrus.FieldLogger, confi
 	}
 	defer bgDB.Close()
 
+	readDB, err := models.ConnectRead(globalConfig, log.WithField("component", "db").WithField("replica", true))
+	if err != nil {
+		log.Fatalf("Error opening read replica: %+v", err)
+	}
+	if readDB != nil {
+		defer readDB.Close()
+	}
+
 	ctx, err := api.WithInstanceConfig(context.Background(), globalConfig.SMTP, config, "")
 	if err != nil {
 		log.Fatalf("Error loading instance config: %+v", err)
 	}
-	api := api.NewAPIWithVersion(ctx, globalConfig, log, db, Version)
+	api := api.NewAPIWithReadDB(ctx, globalConfig, log, db, readDB, Version)
 
 	l := fmt.Sprintf("%v:%v", globalConfig.API.Host, globalConfig.API.Port)
 	log.Infof("GoCommerce API started on: %s", l)
 
-	models.RunHooks(bgDB, log.WithField("component", "hooks"))
+	models.RunJobs(bgDB, api.JobHandlers(config), log.WithField("component", "jobs"))
+	models.RunOrderExpiry(bgDB, config, log.WithField("component", "expiry"))
 
 	api.ListenAndServe(l)
 }
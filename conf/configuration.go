@@ -1,7 +1,11 @@
 package conf
 
 import (
+	"fmt"
+	"net"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/kelseyhightower/envconfig"
@@ -13,14 +17,82 @@ type DBConfiguration struct {
 	Dialect     string
 	Driver      string `required:"true"`
 	URL         string `envconfig:"DATABASE_URL" required:"true"`
+	ReadURL     string `envconfig:"DATABASE_READ_URL"`
 	Namespace   string
 	Automigrate bool
+
+	MaxOpenConns    int           `split_words:"true" default:"25"`
+	MaxIdleConns    int           `split_words:"true" default:"5"`
+	ConnMaxLifetime time.Duration `split_words:"true" default:"5m"`
 }
 
 // JWTConfiguration holds all the JWT related configuration.
 type JWTConfiguration struct {
 	Secret         string `json:"secret"`
 	AdminGroupName string `json:"admin_group_name" split_words:"true"`
+	// AdminGroups are more roles that make the user an admin, while
+	// StaffGroups only grant read access to what admins see
+	AdminGroups []string `json:"admin_groups" split_words:"true"`
+	StaffGroups []string `json:"staff_groups" split_words:"true"`
+	// Permissions grants roles of the token single permissions, e.g.
+	// {"support": ["orders:read", "refunds:write"]}
+	Permissions RolePermissions `json:"permissions"`
+	// Issuer and Audience are checked against the iss and aud claims if set
+	Issuer   string `json:"issuer"`
+	Audience string `json:"audience"`
+
+	// Method is the signing method of tokens, either HS256 or RS256. RS256
+	// tokens are verified with PublicKey, or with the keys at JWKSURL.
+	Method    string `json:"method"`
+	PublicKey string `json:"public_key" split_words:"true"`
+	JWKSURL   string `json:"jwks_url" envconfig:"JWKS_URL"`
+
+	// GracePeriod is the clock skew in seconds tolerated when checking exp and nbf
+	GracePeriod int64 `json:"grace_period" split_words:"true"`
+}
+
+// IsAdminGroup reports whether a role of the token makes the user an admin.
+func (c *JWTConfiguration) IsAdminGroup(role string) bool {
+	if role != "" && role == c.AdminGroupName {
+		return true
+	}
+	return hasString(c.AdminGroups, role)
+}
+
+// IsStaffGroup reports whether a role of the token makes the user staff.
+func (c *JWTConfiguration) IsStaffGroup(role string) bool {
+	return hasString(c.StaffGroups, role)
+}
+
+// RolePermissions maps roles of tokens to the permissions they grant. In the
+// environment it's given as "support=orders:read refunds:write;ops=jobs:read".
+type RolePermissions map[string][]string
+
+// Decode implements envconfig.Decoder.
+func (p *RolePermissions) Decode(value string) error {
+	permissions := RolePermissions{}
+	for _, entry := range strings.Split(value, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		role := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || role == "" {
+			return fmt.Errorf("invalid role permissions: %q", entry)
+		}
+		permissions[role] = append(permissions[role], strings.Fields(parts[1])...)
+	}
+	*p = permissions
+	return nil
+}
+
+func hasString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
 }
 
 type SMTPConfiguration struct {
@@ -37,6 +109,16 @@ type GlobalConfiguration struct {
 		Host     string
 		Port     int `envconfig:"PORT" default:"8080"`
 		Endpoint string
+		// MaxBodySize is the maximum size of request bodies in bytes
+		MaxBodySize int64 `split_words:"true" default:"1048576"`
+		// TrustedProxies are the CIDRs of the proxies whose X-Forwarded-For
+		// header tells the client address. No proxies are trusted if empty.
+		TrustedProxies []string `split_words:"true"`
+		// RequestTimeout is how long handlers have to answer a request.
+		// PaymentTimeout replaces it for the requests charging or refunding
+		// payments. Requests taking longer fail with 504 Gateway Timeout.
+		RequestTimeout time.Duration `split_words:"true" default:"30s"`
+		PaymentTimeout time.Duration `split_words:"true" default:"2m"`
 	}
 	DB                DBConfiguration
 	Logging           LoggingConfig `envconfig:"LOG"`
@@ -56,11 +138,46 @@ type Configuration struct {
 	SiteURL string           `json:"site_url" split_words:"true" required:"true"`
 	JWT     JWTConfiguration `json:"jwt"`
 
+	// MultiSite scopes orders, users and transactions to the site making the request
+	MultiSite bool `json:"multi_site" split_words:"true"`
+
+	// DefaultCurrency is used for orders and payments that don't specify a currency
+	DefaultCurrency string `json:"default_currency" split_words:"true"`
+
+	CORS struct {
+		// AllowedOrigins may make credentialed cross-origin requests. Defaults to the SiteURL.
+		AllowedOrigins []string `json:"allowed_origins" split_words:"true"`
+	} `json:"cors"`
+
 	SMTP SMTPConfiguration `json:"smtp"`
 
 	Mailer struct {
+		// Provider sends the mails: "smtp" (the default), "sendgrid" or
+		// "mailgun". SendGrid and Mailgun are used through their HTTP APIs.
+		Provider string `json:"provider"`
+		// APIKey authenticates with the API of SendGrid or Mailgun
+		APIKey string `json:"api_key" split_words:"true"`
+		// Domain is the Mailgun domain mails are sent from
+		Domain string `json:"domain"`
+		// APIURL overrides the base URL of the provider's API, e.g. to
+		// use the EU region of Mailgun
+		APIURL string `json:"api_url" split_words:"true"`
+
 		Subjects  EmailContentConfiguration `json:"subjects"`
 		Templates EmailContentConfiguration `json:"templates"`
+
+		// LocalizedSubjects overrides the subjects of mails sent to
+		// customers with the given locale, e.g. "fr" or "fr-CA"
+		LocalizedSubjects map[string]EmailContentConfiguration `json:"localized_subjects" ignored:"true"`
+
+		// MagicLink adds a link to confirmation mails of guest orders that
+		// lets the customer view and claim the order without logging in
+		MagicLink struct {
+			Enabled bool   `json:"enabled"`
+			URL     string `json:"url"`
+			// TTL is the number of minutes the link is valid for
+			TTL int64 `json:"ttl"`
+		} `json:"magic_link" split_words:"true"`
 	} `json:"mailer"`
 
 	Payment struct {
@@ -68,15 +185,60 @@ type Configuration struct {
 			Enabled   bool   `json:"enabled"`
 			PublicKey string `json:"public_key" split_words:"true"`
 			SecretKey string `json:"secret_key" split_words:"true"`
+			// WebhookSecret verifies the signature of webhooks sent by Stripe
+			WebhookSecret string `json:"webhook_secret" split_words:"true"`
+			// MaxRetries is how often charges and refunds are retried after
+			// transient errors, waiting RetryBackoff milliseconds before the
+			// first retry
+			MaxRetries   *int  `json:"max_retries" split_words:"true"`
+			RetryBackoff int64 `json:"retry_backoff" split_words:"true"`
+			// BreakerThreshold is the number of failed calls in a row after
+			// which calls to Stripe fail right away for BreakerCooldown seconds
+			BreakerThreshold int   `json:"breaker_threshold" split_words:"true"`
+			BreakerCooldown  int64 `json:"breaker_cooldown" split_words:"true"`
+			// Currencies payments with Stripe can be made in, any currency
+			// if empty
+			Currencies []string `json:"currencies"`
+			// Connect pays the line items of marketplace orders out to the
+			// connected Stripe accounts of their sellers
+			Connect struct {
+				// Accounts maps sellers to their connected accounts, e.g.
+				// {"acme": "acct_1032D82eZvKYlo2C"}
+				Accounts map[string]string `json:"accounts"`
+				// ApplicationFee is the percentage of each seller's share of
+				// a payment the platform keeps
+				ApplicationFee uint64 `json:"application_fee" split_words:"true"`
+			} `json:"connect"`
 		} `json:"stripe"`
 		PayPal struct {
-			Enabled  bool   `json:"enabled"`
-			ClientID string `json:"client_id" split_words:"true"`
-			Secret   string `json:"secret"`
-			Env      string `json:"env"`
+			Enabled   bool   `json:"enabled"`
+			ClientID  string `json:"client_id" split_words:"true"`
+			Secret    string `json:"secret"`
+			Env       string `json:"env"`
+			WebhookID string `json:"webhook_id" split_words:"true"`
+			// Currencies payments with PayPal can be made in, any currency
+			// if empty
+			Currencies []string `json:"currencies"`
 		} `json:"paypal"`
+
+		CaptureOnShipment bool `json:"capture_on_shipment" split_words:"true"`
 	} `json:"payment"`
 
+	// Fraud checks payments with a risk scoring service before they're charged
+	Fraud struct {
+		// Provider is the risk scoring service, "sift" or empty to charge
+		// payments without checks
+		Provider string `json:"provider"`
+		APIKey   string `json:"api_key" split_words:"true"`
+		// APIURL overrides the base URL of the provider's API
+		APIURL string `json:"api_url" split_words:"true"`
+		// ReviewScore and BlockScore are the risk scores from 0 to 1 at
+		// which payments are held for manual review or declined, 0 never
+		// holds or declines payments
+		ReviewScore float64 `json:"review_score" split_words:"true"`
+		BlockScore  float64 `json:"block_score" split_words:"true"`
+	} `json:"fraud"`
+
 	Downloads struct {
 		Provider     string `json:"provider"`
 		NetlifyToken string `json:"netlify_token" split_words:"true"`
@@ -86,16 +248,88 @@ type Configuration struct {
 		URL      string `json:"url"`
 		User     string `json:"user"`
 		Password string `json:"password"`
+		Stacking bool   `json:"stacking"`
 	} `json:"coupons"`
 
+	Settlement struct {
+		Currency string             `json:"currency"`
+		Rates    map[string]float64 `json:"rates"`
+	} `json:"settlement"`
+
 	Webhooks struct {
 		Order   string `json:"order"`
 		Payment string `json:"payment"`
 		Update  string `json:"update"`
 		Refund  string `json:"refund"`
+		// LowStock is called when the stock of a SKU drops to the low stock threshold
+		LowStock string `json:"low_stock" split_words:"true"`
+		// Abandoned is called when an unpaid order expires
+		Abandoned string `json:"abandoned"`
+		// Cancelled is called when the customer or an admin cancels an unpaid order
+		Cancelled string `json:"cancelled"`
+		// Restocked is called when a preorder SKU is back in stock
+		Restocked string `json:"restocked"`
+		// UserUpdated is called when the profile of a user is updated
+		UserUpdated string `json:"user_updated" split_words:"true"`
+		// UserDeleted is called when a user is deleted or anonymized
+		UserDeleted string `json:"user_deleted" split_words:"true"`
 
 		Secret string `json:"secret"`
+		// Timeout is the number of seconds to wait for a webhook response. Defaults to 10.
+		Timeout int64 `json:"timeout"`
+		// MaxPayloadSize is the maximum size of webhook payloads in bytes. Defaults to 1MB.
+		MaxPayloadSize int64 `json:"max_payload_size" split_words:"true"`
+		// Versions pins the payload schema version sent to each webhook by
+		// type, e.g. {"order": 2}. Webhooks default to version 1.
+		Versions map[string]int `json:"versions"`
 	} `json:"webhooks"`
+
+	Orders struct {
+		// MinTotal and MaxTotal limit the total of orders by currency, in
+		// the smallest unit of the currency, e.g. {"USD": 500}
+		MinTotal map[string]uint64 `json:"min_total" split_words:"true"`
+		MaxTotal map[string]uint64 `json:"max_total" split_words:"true"`
+
+		// GiftWrapFee is added to the total of gift wrapped orders by
+		// currency, e.g. {"USD": 500}. Gift wrapping is free without a fee.
+		GiftWrapFee map[string]uint64 `json:"gift_wrap_fee" split_words:"true"`
+
+		// NumberPrefix, NumberYear and NumberDigits format the numbers
+		// orders get on creation, e.g. ORD-2024-000123
+		NumberPrefix string `json:"number_prefix" split_words:"true"`
+		NumberYear   bool   `json:"number_year" split_words:"true"`
+		NumberDigits int    `json:"number_digits" split_words:"true"`
+
+		// MergeSessions claims the unpaid anonymous orders of the same
+		// session for the user when a signed in user creates an order
+		MergeSessions bool `json:"merge_sessions" split_words:"true"`
+	} `json:"orders"`
+
+	// PricesIncludeTax treats the prices of line items as gross prices the
+	// taxes are included in, like the prices_include_taxes site setting
+	PricesIncludeTax bool `json:"prices_include_tax" split_words:"true"`
+
+	// Rounding is how fractions of a cent in taxes and discounts are
+	// rounded: half_up, half_even or floor, like the rounding site setting
+	Rounding string `json:"rounding"`
+
+	// SearchableMeta are the metadata keys orders can be searched by, e.g.
+	// with GET /orders?data.gift=true
+	SearchableMeta []string `json:"searchable_meta" split_words:"true"`
+
+	Inventory struct {
+		LowStockThreshold int64 `json:"low_stock_threshold" split_words:"true"`
+		// ReservationTTL is the number of minutes the stock of a new order is
+		// reserved for. Stock is only taken on payment when it is 0.
+		ReservationTTL int64 `json:"reservation_ttl" split_words:"true"`
+	} `json:"inventory"`
+
+	Expiry struct {
+		// TTL is the number of minutes after which unpaid orders are abandoned.
+		// Orders never expire when it is 0.
+		TTL     int64 `json:"ttl"`
+		Restock bool  `json:"restock"`
+	} `json:"expiry"`
 }
 
 func (c *Configuration) SettingsURL() string {
@@ -126,6 +360,9 @@ func LoadGlobal(filename string) (*GlobalConfiguration, *logrus.Entry, error) {
 	if err := envconfig.Process("gocommerce", config); err != nil {
 		return nil, nil, err
 	}
+	if _, err := config.TrustedProxyNetworks(); err != nil {
+		return nil, nil, err
+	}
 	log, err := ConfigureLogging(&config.Logging)
 	if err != nil {
 		return nil, nil, err
@@ -133,6 +370,19 @@ func LoadGlobal(filename string) (*GlobalConfiguration, *logrus.Entry, error) {
 	return config, log, nil
 }
 
+// TrustedProxyNetworks parses the CIDRs of the trusted proxies.
+func (config *GlobalConfiguration) TrustedProxyNetworks() ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, cidr := range config.API.TrustedProxies {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted proxy '%s': %v", cidr, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
 // LoadConfig loads the per-instance configuration from a file
 func LoadConfig(filename string) (*Configuration, error) {
 	if err := loadEnvironment(filename); err != nil {
@@ -149,7 +399,19 @@ func LoadConfig(filename string) (*Configuration, error) {
 
 // ApplyDefaults sets defaults for a Configuration
 func (config *Configuration) ApplyDefaults() {
-	if config.JWT.AdminGroupName == "" {
+	if config.JWT.AdminGroupName == "" && len(config.JWT.AdminGroups) == 0 {
 		config.JWT.AdminGroupName = "admin"
 	}
+	if config.JWT.Method == "" {
+		config.JWT.Method = "HS256"
+	}
+	if config.JWT.GracePeriod == 0 {
+		config.JWT.GracePeriod = 30
+	}
+	if config.DefaultCurrency == "" {
+		config.DefaultCurrency = "USD"
+	}
+	if config.Mailer.MagicLink.TTL == 0 {
+		config.Mailer.MagicLink.TTL = 24 * 60
+	}
 }
@@ -12,9 +12,11 @@ import (
 	"github.com/netlify/gocommerce/claims"
 	"github.com/netlify/gocommerce/conf"
 	"github.com/netlify/gocommerce/coupons"
+	"github.com/netlify/gocommerce/fraud"
 	"github.com/netlify/gocommerce/mailer"
 	"github.com/netlify/gocommerce/models"
 	"github.com/netlify/gocommerce/payments"
+	"github.com/netlify/gocommerce/shipping"
 )
 
 type contextKey string
@@ -29,15 +31,21 @@ const (
 	couponsKey         = contextKey("coupons")
 	requestIDKey       = contextKey("request_id")
 	adminFlagKey       = contextKey("is_admin")
+	permissionsKey     = contextKey("permissions")
 	mailerKey          = contextKey("mailer")
 	assetStoreKey      = contextKey("asset_store")
 	paymentProviderKey = contextKey("payment-provider")
+	carriersKey        = contextKey("carriers")
+	fraudCheckerKey    = contextKey("fraud_checker")
 	userIDKey          = contextKey("user_id")
 	userKey            = contextKey("user")
 	orderIDKey         = contextKey("order_id")
 	instanceIDKey      = contextKey("instance_id")
 	instanceKey        = contextKey("instance")
 	dbKey              = contextKey("db")
+	readDBKey          = contextKey("read_db")
+	siteIDKey          = contextKey("site_id")
+	allSitesKey        = contextKey("all_sites")
 )
 
 // WithConfig adds the tenant configuration to the context.
@@ -143,6 +151,28 @@ func GetPaymentProviders(ctx context.Context) map[string]payments.Provider {
 	return provs
 }
 
+// WithCarriers adds the shipping carriers to the context.
+func WithCarriers(ctx context.Context, carriers []shipping.Carrier) context.Context {
+	return context.WithValue(ctx, carriersKey, carriers)
+}
+
+// GetCarriers reads the shipping carriers from the context.
+func GetCarriers(ctx context.Context) []shipping.Carrier {
+	carriers, _ := ctx.Value(carriersKey).([]shipping.Carrier)
+	return carriers
+}
+
+// WithFraudChecker adds the fraud checker to the context.
+func WithFraudChecker(ctx context.Context, checker fraud.Checker) context.Context {
+	return context.WithValue(ctx, fraudCheckerKey, checker)
+}
+
+// GetFraudChecker reads the fraud checker from the context.
+func GetFraudChecker(ctx context.Context) fraud.Checker {
+	checker, _ := ctx.Value(fraudCheckerKey).(fraud.Checker)
+	return checker
+}
+
 // GetClaims reads the claims contained within the JWT token stored in the context.
 func GetClaims(ctx context.Context) *claims.JWTClaims {
 	token := GetToken(ctx)
@@ -191,6 +221,25 @@ func IsAdmin(ctx context.Context) bool {
 	return obj.(bool)
 }
 
+// WithPermissions adds the permissions the token grants to the context.
+func WithPermissions(ctx context.Context, permissions []string) context.Context {
+	set := make(map[string]bool, len(permissions))
+	for _, p := range permissions {
+		set[p] = true
+	}
+	return context.WithValue(ctx, permissionsKey, set)
+}
+
+// HasPermission reports whether the token grants a permission. Admins have
+// all permissions.
+func HasPermission(ctx context.Context, permission string) bool {
+	if IsAdmin(ctx) {
+		return true
+	}
+	set, _ := ctx.Value(permissionsKey).(map[string]bool)
+	return set[permission]
+}
+
 // GetUserID reads the user ID from the context.
 func GetUserID(ctx context.Context) string {
 	id, _ := ctx.Value(userIDKey).(string)
@@ -268,3 +317,45 @@ func GetDB(ctx context.Context) *gorm.DB {
 func WithDB(ctx context.Context, db *gorm.DB) context.Context {
 	return context.WithValue(ctx, dbKey, db)
 }
+
+// GetReadDB reads the read replica database from the context.
+func GetReadDB(ctx context.Context) *gorm.DB {
+	obj := ctx.Value(readDBKey)
+	if obj == nil {
+		return nil
+	}
+	return obj.(*gorm.DB)
+}
+
+// WithReadDB adds the read replica database to the context.
+func WithReadDB(ctx context.Context, db *gorm.DB) context.Context {
+	return context.WithValue(ctx, readDBKey, db)
+}
+
+// WithSiteID adds the ID of the requesting site to the context.
+func WithSiteID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, siteIDKey, id)
+}
+
+// GetSiteID reads the ID of the requesting site from the context.
+func GetSiteID(ctx context.Context) string {
+	obj := ctx.Value(siteIDKey)
+	if obj == nil {
+		return ""
+	}
+	return obj.(string)
+}
+
+// WithAllSites marks the request as accessing the data of all sites.
+func WithAllSites(ctx context.Context, allSites bool) context.Context {
+	return context.WithValue(ctx, allSitesKey, allSites)
+}
+
+// IsAllSites checks if the request accesses the data of all sites.
+func IsAllSites(ctx context.Context) bool {
+	obj := ctx.Value(allSitesKey)
+	if obj == nil {
+		return false
+	}
+	return obj.(bool)
+}
@@ -0,0 +1,77 @@
+package fraud
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+)
+
+// SiftProvider is the string identifier of the Sift risk service.
+const SiftProvider = "sift"
+
+// Decisions of a fraud check
+const (
+	// Allow charges the payment.
+	Allow = "allow"
+	// Review holds the payment for manual review by an admin.
+	Review = "review"
+	// Block declines the payment.
+	Block = "block"
+)
+
+// Request holds what a fraud check knows about a payment before it's charged.
+type Request struct {
+	Order          *models.Order
+	BillingAddress *models.Address
+	Amount         uint64
+	Currency       string
+	// Provider is the payment provider the payment is charged with, empty
+	// for payments with gift cards only
+	Provider string
+
+	// IP and UserAgent of the client making the payment
+	IP        string
+	UserAgent string
+}
+
+// Result is the outcome of a fraud check.
+type Result struct {
+	Decision string `json:"decision"`
+	// Score is the risk of the payment from 0 to 1
+	Score  float64 `json:"score"`
+	Reason string  `json:"reason,omitempty"`
+}
+
+// Checker assesses the risk of payments before they're charged.
+type Checker interface {
+	Name() string
+	Check(ctx context.Context, req *Request) (*Result, error)
+}
+
+// NewChecker creates a fraud checker based on the provided configuration.
+// Payments aren't checked if no provider is configured.
+func NewChecker(config *conf.Configuration) (Checker, error) {
+	switch config.Fraud.Provider {
+	case SiftProvider:
+		return newSiftChecker(config)
+	case "":
+		return &noopChecker{}, nil
+	default:
+		return nil, fmt.Errorf("Unknown fraud provider '%v'", config.Fraud.Provider)
+	}
+}
+
+// decide turns a risk score into a decision using the configured thresholds.
+// A threshold of 0 disables the decision.
+func decide(score, reviewScore, blockScore float64) string {
+	switch {
+	case blockScore > 0 && score >= blockScore:
+		return Block
+	case reviewScore > 0 && score >= reviewScore:
+		return Review
+	default:
+		return Allow
+	}
+}
@@ -0,0 +1,13 @@
+package fraud
+
+import "context"
+
+type noopChecker struct{}
+
+func (c *noopChecker) Name() string {
+	return ""
+}
+
+func (c *noopChecker) Check(ctx context.Context, req *Request) (*Result, error) {
+	return &Result{Decision: Allow}, nil
+}
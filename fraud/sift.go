@@ -0,0 +1,189 @@
+package fraud
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/conf"
+)
+
+const defaultSiftURL = "https://api.sift.com"
+
+// siftGateways maps payment providers to the gateways known to Sift.
+var siftGateways = map[string]string{
+	"stripe": "$stripe",
+	"paypal": "$paypal",
+}
+
+// siftChecker scores payments with the payment abuse score Sift returns for
+// $create_order events.
+type siftChecker struct {
+	client      *http.Client
+	apiKey      string
+	apiURL      string
+	reviewScore float64
+	blockScore  float64
+}
+
+func newSiftChecker(config *conf.Configuration) (*siftChecker, error) {
+	if config.Fraud.APIKey == "" {
+		return nil, errors.New("No API key configured for Sift")
+	}
+	apiURL := config.Fraud.APIURL
+	if apiURL == "" {
+		apiURL = defaultSiftURL
+	}
+	return &siftChecker{
+		client:      &http.Client{Timeout: 10 * time.Second},
+		apiKey:      config.Fraud.APIKey,
+		apiURL:      strings.TrimSuffix(apiURL, "/"),
+		reviewScore: config.Fraud.ReviewScore,
+		blockScore:  config.Fraud.BlockScore,
+	}, nil
+}
+
+type siftAddress struct {
+	Name     string `json:"$name,omitempty"`
+	Address1 string `json:"$address_1,omitempty"`
+	Address2 string `json:"$address_2,omitempty"`
+	City     string `json:"$city,omitempty"`
+	Region   string `json:"$region,omitempty"`
+	Country  string `json:"$country,omitempty"`
+	Zipcode  string `json:"$zipcode,omitempty"`
+}
+
+type siftPaymentMethod struct {
+	Gateway string `json:"$payment_gateway,omitempty"`
+}
+
+type siftBrowser struct {
+	UserAgent string `json:"$user_agent,omitempty"`
+}
+
+type siftOrderEvent struct {
+	Type           string              `json:"$type"`
+	APIKey         string              `json:"$api_key"`
+	UserID         string              `json:"$user_id,omitempty"`
+	SessionID      string              `json:"$session_id,omitempty"`
+	OrderID        string              `json:"$order_id"`
+	UserEmail      string              `json:"$user_email,omitempty"`
+	Amount         int64               `json:"$amount"`
+	CurrencyCode   string              `json:"$currency_code"`
+	IP             string              `json:"$ip,omitempty"`
+	Browser        *siftBrowser        `json:"$browser,omitempty"`
+	BillingAddress *siftAddress        `json:"$billing_address,omitempty"`
+	PaymentMethods []siftPaymentMethod `json:"$payment_methods,omitempty"`
+}
+
+type siftReason struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type siftResponse struct {
+	Status        int    `json:"status"`
+	ErrorMessage  string `json:"error_message"`
+	ScoreResponse struct {
+		Scores map[string]struct {
+			Score   float64      `json:"score"`
+			Reasons []siftReason `json:"reasons"`
+		} `json:"scores"`
+	} `json:"score_response"`
+}
+
+func (c *siftChecker) Name() string {
+	return SiftProvider
+}
+
+func (c *siftChecker) Check(ctx context.Context, req *Request) (*Result, error) {
+	event := &siftOrderEvent{
+		Type:         "$create_order",
+		APIKey:       c.apiKey,
+		UserID:       req.Order.UserID,
+		SessionID:    req.Order.SessionID,
+		OrderID:      req.Order.ID,
+		UserEmail:    req.Order.Email,
+		Amount:       siftAmount(req.Amount, req.Currency),
+		CurrencyCode: strings.ToUpper(req.Currency),
+		IP:           req.IP,
+	}
+	if req.UserAgent != "" {
+		event.Browser = &siftBrowser{UserAgent: req.UserAgent}
+	}
+	if addr := req.BillingAddress; addr != nil && addr.Address1 != "" {
+		event.BillingAddress = &siftAddress{
+			Name:     addr.Name,
+			Address1: addr.Address1,
+			Address2: addr.Address2,
+			City:     addr.City,
+			Region:   addr.State,
+			Country:  addr.Country,
+			Zipcode:  addr.Zip,
+		}
+	}
+	if gateway, ok := siftGateways[req.Provider]; ok {
+		event.PaymentMethods = []siftPaymentMethod{{Gateway: gateway}}
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, c.apiURL+"/v205/events?return_score=true", bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(httpReq.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Sift responded with %v: %s", resp.Status, body)
+	}
+
+	rsp := &siftResponse{}
+	if err := json.Unmarshal(body, rsp); err != nil {
+		return nil, errors.Wrap(err, "Error parsing the Sift response")
+	}
+	if rsp.Status != 0 {
+		return nil, fmt.Errorf("Sift returned status %d: %s", rsp.Status, rsp.ErrorMessage)
+	}
+	score, ok := rsp.ScoreResponse.Scores["payment_abuse"]
+	if !ok {
+		return nil, errors.New("Sift didn't return a payment abuse score")
+	}
+
+	reasons := []string{}
+	for _, reason := range score.Reasons {
+		reasons = append(reasons, reason.Name)
+	}
+	return &Result{
+		Decision: decide(score.Score, c.reviewScore, c.blockScore),
+		Score:    score.Score,
+		Reason:   strings.Join(reasons, ", "),
+	}, nil
+}
+
+// siftAmount converts an amount in the minor unit of a currency to the
+// micros of its major unit Sift expects, e.g. 1 USD is 1000000.
+func siftAmount(amount uint64, currency string) int64 {
+	exp := calculator.CurrencyExponent(currency)
+	return int64(amount) * int64(math.Pow10(6-exp))
+}
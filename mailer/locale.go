@@ -0,0 +1,189 @@
+package mailer
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/mailme"
+)
+
+var localePattern = regexp.MustCompile(`^([a-zA-Z]{2,3})(?:[-_]([a-zA-Z0-9]{2,8}))?$`)
+
+// NormalizeLocale turns a locale like "fr_ca" into "fr-CA". It returns an
+// error for values that aren't a language code with an optional region.
+func NormalizeLocale(locale string) (string, error) {
+	match := localePattern.FindStringSubmatch(strings.TrimSpace(locale))
+	if match == nil {
+		return "", fmt.Errorf("Invalid locale: %v", locale)
+	}
+	if match[2] == "" {
+		return strings.ToLower(match[1]), nil
+	}
+	return strings.ToLower(match[1]) + "-" + strings.ToUpper(match[2]), nil
+}
+
+// localeCandidates returns the locale followed by its language, e.g.
+// "fr-CA" and "fr", which are tried in order when looking up variants.
+func localeCandidates(locale string) []string {
+	if locale == "" {
+		return nil
+	}
+	candidates := []string{locale}
+	if i := strings.Index(locale, "-"); i > 0 {
+		candidates = append(candidates, locale[:i])
+	}
+	return candidates
+}
+
+type localeFormat struct {
+	decimal     string
+	thousands   string
+	symbolAfter bool
+	date        string
+}
+
+var defaultLocaleFormat = localeFormat{".", ",", false, "January 2, 2006"}
+
+var localeFormats = map[string]localeFormat{
+	"en":    defaultLocaleFormat,
+	"en-GB": {".", ",", false, "2 January 2006"},
+	"de":    {",", ".", true, "02.01.2006"},
+	"es":    {",", ".", true, "02/01/2006"},
+	"fr":    {",", " ", true, "02/01/2006"},
+	"it":    {",", ".", true, "02/01/2006"},
+	"nl":    {",", ".", false, "02-01-2006"},
+	"pt":    {",", ".", true, "02/01/2006"},
+	"sv":    {",", " ", true, "2006-01-02"},
+}
+
+var currencySymbols = map[string]string{
+	"USD": "$",
+	"EUR": "€",
+	"GBP": "£",
+	"JPY": "¥",
+}
+
+func formatFor(locale string) localeFormat {
+	for _, candidate := range localeCandidates(locale) {
+		if format, ok := localeFormats[candidate]; ok {
+			return format
+		}
+	}
+	return defaultLocaleFormat
+}
+
+// localePrice formats an amount in the currency the way it's written in the
+// locale, e.g. "$1,234.50" in English and "1.234,50 €" in German.
+func localePrice(locale string, amount uint64, currency string) string {
+	format := formatFor(locale)
+	number := calculator.FormatAmount(amount, currency)
+	fraction := ""
+	if i := strings.Index(number, "."); i >= 0 {
+		number, fraction = number[:i], number[i+1:]
+	}
+	for i := len(number) - 3; i > 0; i -= 3 {
+		number = number[:i] + format.thousands + number[i:]
+	}
+	if fraction != "" {
+		number += format.decimal + fraction
+	}
+
+	symbol, ok := currencySymbols[currency]
+	switch {
+	case !ok:
+		return number + " " + currency
+	case format.symbolAfter:
+		return number + " " + symbol
+	default:
+		return symbol + number
+	}
+}
+
+// localeDate formats a date the way it's written in the locale.
+func localeDate(locale string, date time.Time) string {
+	return date.Format(formatFor(locale).date)
+}
+
+// localizedSubject returns the subject configured for the locale, or the
+// default subject if there is none.
+func localizedSubject(config *conf.Configuration, locale string, subject func(conf.EmailContentConfiguration) string) string {
+	for _, candidate := range localeCandidates(locale) {
+		if localized, ok := config.Mailer.LocalizedSubjects[candidate]; ok && subject(localized) != "" {
+			return subject(localized)
+		}
+	}
+	return subject(config.Mailer.Subjects)
+}
+
+// templateVariants caches whether localized template variants exist, so
+// sending a mail doesn't look them up every time.
+var templateVariants = struct {
+	sync.Mutex
+	byURL map[string]templateVariantLookup
+}{byURL: map[string]templateVariantLookup{}}
+
+type templateVariantLookup struct {
+	exists    bool
+	expiresAt time.Time
+}
+
+var variantClient = &http.Client{Timeout: 5 * time.Second}
+
+// localizedTemplate returns the URL of the variant of the template for the
+// locale, e.g. "/mail/confirmation.fr.html" for "/mail/confirmation.html",
+// falling back to the template itself if the site has no such variant.
+func localizedTemplate(baseURL, templateURL, locale string) string {
+	if templateURL == "" {
+		return ""
+	}
+	for _, candidate := range localeCandidates(locale) {
+		variant := templateVariant(templateURL, candidate)
+		if templateExists(baseURL, variant) {
+			return variant
+		}
+	}
+	return templateURL
+}
+
+func templateVariant(templateURL, locale string) string {
+	query := ""
+	if i := strings.Index(templateURL, "?"); i >= 0 {
+		templateURL, query = templateURL[:i], templateURL[i:]
+	}
+	ext := ""
+	if i := strings.LastIndex(templateURL, "."); i > strings.LastIndex(templateURL, "/") {
+		templateURL, ext = templateURL[:i], templateURL[i:]
+	}
+	return templateURL + "." + locale + ext + query
+}
+
+func templateExists(baseURL, templateURL string) bool {
+	absoluteURL := templateURL
+	if !strings.HasPrefix(templateURL, "http") {
+		absoluteURL = baseURL + templateURL
+	}
+
+	templateVariants.Lock()
+	lookup, ok := templateVariants.byURL[absoluteURL]
+	templateVariants.Unlock()
+	if ok && time.Now().Before(lookup.expiresAt) {
+		return lookup.exists
+	}
+
+	exists := false
+	if resp, err := variantClient.Get(absoluteURL); err == nil {
+		resp.Body.Close()
+		exists = resp.StatusCode == http.StatusOK
+	}
+
+	templateVariants.Lock()
+	templateVariants.byURL[absoluteURL] = templateVariantLookup{exists, time.Now().Add(mailme.TemplateExpiration)}
+	templateVariants.Unlock()
+	return exists
+}
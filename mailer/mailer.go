@@ -1,10 +1,16 @@
 package mailer
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"html/template"
 	"log"
+	"net/url"
 	"time"
 
+	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/claims"
 	"github.com/netlify/gocommerce/conf"
 	"github.com/netlify/gocommerce/models"
 	"github.com/netlify/mailme"
@@ -20,6 +26,7 @@ type Mailer interface {
 
 type mailer struct {
 	Config         *conf.Configuration
+	Transport      Transport
 	TemplateMailer *mailme.Mailer
 }
 
@@ -28,50 +35,92 @@ type MailSubjects struct {
 	OrderConfirmationMail string
 }
 
-// NewMailer returns a new authlify mailer
-func NewMailer(smtp conf.SMTPConfiguration, instanceConfig *conf.Configuration) Mailer {
-	if smtp.Host == "" && instanceConfig.SMTP.Host == "" {
-		return newNoopMailer()
-	}
-
-	smtpHost := instanceConfig.SMTP.Host
-	if smtpHost == "" {
-		smtpHost = smtp.Host
-	}
-	smtpPort := instanceConfig.SMTP.Port
-	if smtpPort == 0 {
-		smtpPort = smtp.Port
-	}
-	smtpUser := instanceConfig.SMTP.User
-	if smtpUser == "" {
-		smtpUser = smtp.User
-	}
-	smtpPass := instanceConfig.SMTP.Pass
-	if smtpPass == "" {
-		smtpPass = smtp.Pass
-	}
+// NewMailer returns a new authlify mailer. Mails are sent with the provider
+// of the instance configuration, SMTP by default. Without an SMTP host, the
+// mailer doesn't send any mails.
+func NewMailer(smtp conf.SMTPConfiguration, instanceConfig *conf.Configuration) (Mailer, error) {
 	smtpAdminEmail := instanceConfig.SMTP.AdminEmail
 	if smtpAdminEmail == "" {
 		smtpAdminEmail = smtp.AdminEmail
 	}
 
+	var transport Transport
+	switch provider := instanceConfig.Mailer.Provider; provider {
+	case "", SMTPProvider:
+		if smtp.Host == "" && instanceConfig.SMTP.Host == "" {
+			return newNoopMailer(), nil
+		}
+		t := &smtpTransport{
+			host: instanceConfig.SMTP.Host,
+			port: instanceConfig.SMTP.Port,
+			user: instanceConfig.SMTP.User,
+			pass: instanceConfig.SMTP.Pass,
+		}
+		if t.host == "" {
+			t.host = smtp.Host
+		}
+		if t.port == 0 {
+			t.port = smtp.Port
+		}
+		if t.user == "" {
+			t.user = smtp.User
+		}
+		if t.pass == "" {
+			t.pass = smtp.Pass
+		}
+		transport = t
+	case SendGridProvider:
+		transport = &sendGridTransport{
+			apiKey: instanceConfig.Mailer.APIKey,
+			apiURL: instanceConfig.Mailer.APIURL,
+		}
+	case MailgunProvider:
+		if instanceConfig.Mailer.Domain == "" {
+			return nil, errors.New("A domain is required to send mails with Mailgun")
+		}
+		transport = &mailgunTransport{
+			apiKey: instanceConfig.Mailer.APIKey,
+			domain: instanceConfig.Mailer.Domain,
+			apiURL: instanceConfig.Mailer.APIURL,
+		}
+	default:
+		return nil, fmt.Errorf("Unknown mail provider '%v'", provider)
+	}
+
 	return &mailer{
-		Config: instanceConfig,
+		Config:    instanceConfig,
+		Transport: transport,
 		TemplateMailer: &mailme.Mailer{
-			Host:    smtpHost,
-			Port:    smtpPort,
-			User:    smtpUser,
-			Pass:    smtpPass,
 			From:    smtpAdminEmail,
 			BaseURL: instanceConfig.SiteURL,
 			FuncMap: map[string]interface{}{
 				"dateFormat":     dateFormat,
 				"price":          price,
+				"localeDate":     localeDate,
+				"localePrice":    localePrice,
 				"hasProductType": hasProductType,
 			},
 			Logger: logrus.New(),
 		},
+	}, nil
+}
+
+// mail renders the subject and the body of a mail and sends it with the
+// transport of the mailer.
+func (m *mailer) mail(to, subjectTemplate, templateURL, defaultTemplate string, data map[string]interface{}) error {
+	tmpl, err := template.New("Subject").Funcs(template.FuncMap(m.TemplateMailer.FuncMap)).Parse(subjectTemplate)
+	if err != nil {
+		return err
+	}
+	subject := &bytes.Buffer{}
+	if err := tmpl.Execute(subject, data); err != nil {
+		return err
 	}
+	body, err := m.TemplateMailer.MailBody(templateURL, defaultTemplate, data)
+	if err != nil {
+		return err
+	}
+	return m.Transport.Send(m.TemplateMailer.From, to, subject.String(), body)
 }
 
 func dateFormat(layout string, date time.Time) string {
@@ -81,11 +130,11 @@ func dateFormat(layout string, date time.Time) string {
 func price(amount uint64, currency string) string {
 	switch currency {
 	case "USD":
-		return fmt.Sprintf("$%.2f", float64(amount)/100)
+		return "$" + calculator.FormatAmount(amount, currency)
 	case "EUR":
-		return fmt.Sprintf("%.2f€", float64(amount)/100)
+		return calculator.FormatAmount(amount, currency) + "€"
 	default:
-		return fmt.Sprintf("%.2f %v", float64(amount)/100, currency)
+		return fmt.Sprintf("%s %v", calculator.FormatAmount(amount, currency), currency)
 	}
 }
 
@@ -99,46 +148,142 @@ func hasProductType(order *models.Order, productType string) bool {
 }
 
 const defaultConfirmationTemplate = `<h2>Thank you for your order!</h2>
+{{ with .Order.Number }}<p>Order number: <strong>{{ . }}</strong></p>{{ end }}
 
 <ul>
 {{ range .Order.LineItems }}
-<li>{{ .Title }} <strong>{{ .Quantity }} x {{ .Price }}</strong></li>
+<li>{{ .Title }} <strong>{{ .Quantity }} x {{ .Price }}</strong>
+{{ if .ManualDiscount }}<em>Discount{{ with .ManualDiscountReason }} ({{ . }}){{ end }}: -{{ .ManualDiscount }}</em>{{ end }}
+{{ if .LineTaxes }}<em>{{ if $.Order.PricesIncludeTaxes }}Including taxes{{ else }}Taxes{{ end }}{{ range $i, $l := .TaxLines }}{{ if $i }}, {{ else }} ({{ end }}{{ with $l.Name }}{{ . }} {{ end }}{{ $l.Percentage }}%{{ end }}{{ if .TaxLines }}){{ end }}: {{ .LineTaxes }}</em>{{ end }}
+{{ if .Backordered }}<em>Pre-order{{ if .AvailableAt }}, expected to ship {{ .AvailableAt.Format "January 2, 2006" }}{{ end }}</em>{{ end }}</li>
 {{ end }}
 </ul>
-
+{{ if .Order.CouponDiscount }}
+<p>Coupon discount: <strong>-{{ .Order.CouponDiscount }}</strong></p>
+{{ end }}
+{{ if .Order.ManualDiscount }}
+<p>Discount{{ with .Order.ManualDiscountReason }} ({{ . }}){{ end }}: <strong>-{{ .Order.ManualDiscount }}</strong></p>
+{{ end }}
+{{ if .Order.Tip }}
+<p>Tip: <strong>{{ .Order.Tip }}</strong></p>
+{{ end }}
+{{ if .Order.GiftWrapFee }}
+<p>Gift wrapping: <strong>{{ .Order.GiftWrapFee }}</strong></p>
+{{ end }}
+{{ if .Order.IsTaxExempt }}
+<p>Tax exempt{{ if .Order.TaxExemptReason }}: {{ .Order.TaxExemptReason }}{{ end }}</p>
+{{ end }}
+{{ if and .Order.Taxes (not .Order.PricesIncludeTaxes) }}
+{{ range .Order.TaxLines }}
+<p>{{ with .Name }}{{ . }}{{ else }}Tax{{ end }} ({{ .Percentage }}%): <strong>{{ .Amount }}</strong></p>
+{{ end }}
+<p>Taxes: <strong>{{ .Order.Taxes }}</strong></p>
+{{ end }}
 <p>Total amount: <strong>{{ .Order.Total }}</strong></p>
+{{ if and .Order.Taxes .Order.PricesIncludeTaxes }}
+{{ range .Order.TaxLines }}
+<p>Including {{ with .Name }}{{ . }}{{ else }}tax{{ end }} ({{ .Percentage }}%): <strong>{{ .Amount }}</strong></p>
+{{ end }}
+<p>Including taxes: <strong>{{ .Order.Taxes }}</strong></p>
+{{ end }}
+{{ if .MagicLink }}
+<p><a href="{{ .MagicLink }}">View your order</a></p>
+{{ end }}
 `
 
-// OrderConfirmationMail sends an order confirmation to the user
+// OrderConfirmationMail sends an order confirmation to the user, in the
+// language of the order's locale if the site has a template for it
 func (m *mailer) OrderConfirmationMail(transaction *models.Transaction) error {
-	log.Printf("Sending order confirmation to %v with template %v", transaction.Order.Email, m.Config.Mailer.Templates.OrderConfirmation)
-	return m.TemplateMailer.Mail(
+	locale := transaction.Order.Locale
+	templateURL := localizedTemplate(m.Config.SiteURL, m.Config.Mailer.Templates.OrderConfirmation, locale)
+	log.Printf("Sending order confirmation to %v with template %v", transaction.Order.Email, templateURL)
+	subject := localizedSubject(m.Config, locale, func(subjects conf.EmailContentConfiguration) string {
+		return subjects.OrderConfirmation
+	})
+	return m.mail(
 		transaction.Order.Email,
-		withDefault(m.Config.Mailer.Subjects.OrderConfirmation, "Order Confirmation"),
-		m.Config.Mailer.Templates.OrderConfirmation,
+		withDefault(subject, "Order Confirmation"),
+		templateURL,
 		defaultConfirmationTemplate,
 		map[string]interface{}{
 			"SiteURL":     m.Config.SiteURL,
 			"Order":       transaction.Order,
 			"Transaction": transaction,
+			"MagicLink":   m.magicLink(transaction.Order),
+			"Locale":      locale,
 		},
 	)
 }
 
+// magicLink returns a link with a short-lived token that lets a guest view and
+// claim their order. It is empty unless magic links are enabled and the order
+// doesn't belong to a user yet.
+func (m *mailer) magicLink(order *models.Order) string {
+	config := m.Config.Mailer.MagicLink
+	if !config.Enabled || order.UserID != "" {
+		return ""
+	}
+
+	token, err := claims.NewOrderToken(order.ID, m.Config.JWT.Secret, time.Duration(config.TTL)*time.Minute)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to create magic link token")
+		return ""
+	}
+	site, err := url.Parse(m.Config.SiteURL)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to parse the site URL")
+		return ""
+	}
+	link, err := site.Parse(withDefault(config.URL, "/order"))
+	if err != nil {
+		logrus.WithError(err).Error("Failed to parse the magic link URL")
+		return ""
+	}
+	query := link.Query()
+	query.Set("order_id", order.ID)
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+	return link.String()
+}
+
 const defaultReceivedTemplate = `<h2>Order Received From {{ .Order.Email }}</h2>
+{{ with .Order.Number }}<p>Order number: <strong>{{ . }}</strong></p>{{ end }}
 
 <ul>
 {{ range .Order.LineItems }}
-<li>{{ .Title }} <strong>{{ .Quantity }} x {{ .Price }}</strong></li>
+<li>{{ .Title }} <strong>{{ .Quantity }} x {{ .Price }}</strong>
+{{ if .ManualDiscount }}<em>Discount{{ with .ManualDiscountReason }} ({{ . }}){{ end }}: -{{ .ManualDiscount }}</em>{{ end }}
+{{ if .LineTaxes }}<em>{{ if $.Order.PricesIncludeTaxes }}Including taxes{{ else }}Taxes{{ end }}{{ range $i, $l := .TaxLines }}{{ if $i }}, {{ else }} ({{ end }}{{ with $l.Name }}{{ . }} {{ end }}{{ $l.Percentage }}%{{ end }}{{ if .TaxLines }}){{ end }}: {{ .LineTaxes }}</em>{{ end }}</li>
 {{ end }}
 </ul>
+{{ if .Order.CouponDiscount }}
+<p>Coupon discount: <strong>-{{ .Order.CouponDiscount }}</strong></p>
+{{ end }}
+{{ if .Order.ManualDiscount }}
+<p>Discount{{ with .Order.ManualDiscountReason }} ({{ . }}){{ end }}: <strong>-{{ .Order.ManualDiscount }}</strong></p>
+{{ end }}
 
+{{ if .Order.IsTaxExempt }}
+<p>Tax exempt{{ if .Order.TaxExemptReason }}: {{ .Order.TaxExemptReason }}{{ end }}</p>
+{{ end }}
+{{ if and .Order.Taxes (not .Order.PricesIncludeTaxes) }}
+{{ range .Order.TaxLines }}
+<p>{{ with .Name }}{{ . }}{{ else }}Tax{{ end }} ({{ .Percentage }}%): <strong>{{ .Amount }}</strong></p>
+{{ end }}
+<p>Taxes: <strong>{{ .Order.Taxes }}</strong></p>
+{{ end }}
 <p>Total amount: <strong>{{ .Order.Total }}</strong></p>
+{{ if and .Order.Taxes .Order.PricesIncludeTaxes }}
+{{ range .Order.TaxLines }}
+<p>Including {{ with .Name }}{{ . }}{{ else }}tax{{ end }} ({{ .Percentage }}%): <strong>{{ .Amount }}</strong></p>
+{{ end }}
+<p>Including taxes: <strong>{{ .Order.Taxes }}</strong></p>
+{{ end }}
 `
 
 // OrderReceivedMail sends a notification to the shop admin
 func (m *mailer) OrderReceivedMail(transaction *models.Transaction) error {
-	return m.TemplateMailer.Mail(
+	return m.mail(
 		m.TemplateMailer.From,
 		withDefault(m.Config.Mailer.Subjects.OrderReceived, "Order Received From {{ .Order.Email }}"),
 		m.Config.Mailer.Templates.OrderReceived,
@@ -152,14 +297,17 @@ func (m *mailer) OrderReceivedMail(transaction *models.Transaction) error {
 }
 
 func (m *mailer) OrderConfirmationMailBody(transaction *models.Transaction, templateURL string) (string, error) {
+	locale := transaction.Order.Locale
 	if templateURL == "" {
-		templateURL = m.Config.Mailer.Templates.OrderConfirmation
+		templateURL = localizedTemplate(m.Config.SiteURL, m.Config.Mailer.Templates.OrderConfirmation, locale)
 	}
 
 	return m.TemplateMailer.MailBody(templateURL, defaultReceivedTemplate, map[string]interface{}{
 		"SiteURL":     m.Config.SiteURL,
 		"Order":       transaction.Order,
 		"Transaction": transaction,
+		"MagicLink":   m.magicLink(transaction.Order),
+		"Locale":      locale,
 	})
 }
 
@@ -1,16 +1,30 @@
 package mailer
 
 import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/claims"
 	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestNoopMailer(t *testing.T) {
 	smtp := conf.SMTPConfiguration{}
 	conf := &conf.Configuration{}
-	m := NewMailer(smtp, conf)
+	m, err := NewMailer(smtp, conf)
+	require.NoError(t, err)
 	assert.IsType(t, &noopMailer{}, m)
 }
 
@@ -21,6 +35,274 @@ func TestTemplateMailer(t *testing.T) {
 	}
 	conf := &conf.Configuration{}
 	conf.SMTP.AdminEmail = "test@example.com"
-	m := NewMailer(smtp, conf)
+	m, err := NewMailer(smtp, conf)
+	require.NoError(t, err)
 	assert.IsType(t, &mailer{}, m)
 }
+
+func TestProviders(t *testing.T) {
+	var req *http.Request
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	tr := &models.Transaction{Order: &models.Order{Email: "bruce@wayneindustries.com", Currency: "USD", Total: 1000}}
+	newConfig := func(provider string) *conf.Configuration {
+		config := &conf.Configuration{}
+		config.SMTP.AdminEmail = "shop@example.com"
+		config.Mailer.Provider = provider
+		config.Mailer.APIKey = "key"
+		config.Mailer.APIURL = server.URL
+		return config
+	}
+
+	t.Run("SendGrid", func(t *testing.T) {
+		m, err := NewMailer(conf.SMTPConfiguration{}, newConfig(SendGridProvider))
+		require.NoError(t, err)
+		require.NoError(t, m.OrderConfirmationMail(tr))
+
+		assert.Equal(t, "/mail/send", req.URL.Path)
+		assert.Equal(t, "Bearer key", req.Header.Get("Authorization"))
+		mail := &sendGridMail{}
+		require.NoError(t, json.Unmarshal(body, mail))
+		assert.Equal(t, "shop@example.com", mail.From.Email)
+		assert.Equal(t, "bruce@wayneindustries.com", mail.Personalizations[0].To[0].Email)
+		assert.Equal(t, "Order Confirmation", mail.Subject)
+		assert.Contains(t, mail.Content[0].Value, "Thank you for your order!")
+	})
+
+	t.Run("Mailgun", func(t *testing.T) {
+		config := newConfig(MailgunProvider)
+		config.Mailer.Domain = "mg.example.com"
+		m, err := NewMailer(conf.SMTPConfiguration{}, config)
+		require.NoError(t, err)
+		require.NoError(t, m.OrderReceivedMail(tr))
+
+		assert.Equal(t, "/mg.example.com/messages", req.URL.Path)
+		user, pass, _ := req.BasicAuth()
+		assert.Equal(t, "api", user)
+		assert.Equal(t, "key", pass)
+		form, err := url.ParseQuery(string(body))
+		require.NoError(t, err)
+		assert.Equal(t, "shop@example.com", form.Get("to"))
+		assert.Equal(t, "Order Received From bruce@wayneindustries.com", form.Get("subject"))
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}))
+		defer server.Close()
+		config := newConfig(SendGridProvider)
+		config.Mailer.APIURL = server.URL
+		m, err := NewMailer(conf.SMTPConfiguration{}, config)
+		require.NoError(t, err)
+		assert.Error(t, m.OrderConfirmationMail(tr))
+
+		_, err = NewMailer(conf.SMTPConfiguration{}, newConfig(MailgunProvider))
+		assert.Error(t, err)
+		_, err = NewMailer(conf.SMTPConfiguration{}, newConfig("carrier-pigeon"))
+		assert.Error(t, err)
+	})
+}
+
+func TestMagicLink(t *testing.T) {
+	config := &conf.Configuration{SiteURL: "https://example.com"}
+	config.JWT.Secret = "secret"
+	config.Mailer.MagicLink.TTL = 60
+	m := &mailer{Config: config}
+	order := &models.Order{ID: "first-order"}
+
+	assert.Empty(t, m.magicLink(order))
+
+	config.Mailer.MagicLink.Enabled = true
+	link, err := url.Parse(m.magicLink(order))
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", link.Host)
+	assert.Equal(t, "/order", link.Path)
+	assert.Equal(t, "first-order", link.Query().Get("order_id"))
+	assert.True(t, claims.VerifyOrderToken(link.Query().Get("token"), "first-order", "secret"))
+
+	order.UserID = "i-am-batman"
+	assert.Empty(t, m.magicLink(order))
+}
+
+func TestConfirmationTemplateBackordered(t *testing.T) {
+	tmpl, err := template.New("confirmation").Parse(defaultConfirmationTemplate)
+	require.NoError(t, err)
+
+	availableAt := time.Date(2030, time.January, 2, 0, 0, 0, 0, time.UTC)
+	order := &models.Order{LineItems: []*models.LineItem{
+		{Title: "Batwing", Quantity: 1, Price: 100},
+		{Title: "Batmobile", Quantity: 1, Price: 200, Backordered: true, AvailableAt: &availableAt},
+	}}
+	var out bytes.Buffer
+	require.NoError(t, tmpl.Execute(&out, map[string]interface{}{"Order": order}))
+	assert.Equal(t, 1, strings.Count(out.String(), "Pre-order"))
+	assert.Contains(t, out.String(), "expected to ship January 2, 2030")
+}
+
+func TestTemplatesTaxExempt(t *testing.T) {
+	for name, source := range map[string]string{"confirmation": defaultConfirmationTemplate, "received": defaultReceivedTemplate} {
+		tmpl, err := template.New(name).Parse(source)
+		require.NoError(t, err)
+
+		var out bytes.Buffer
+		require.NoError(t, tmpl.Execute(&out, map[string]interface{}{"Order": &models.Order{}}))
+		assert.NotContains(t, out.String(), "Tax exempt", name)
+
+		out.Reset()
+		order := &models.Order{TaxExempt: true, TaxExemptReason: "Non-profit"}
+		require.NoError(t, tmpl.Execute(&out, map[string]interface{}{"Order": order}))
+		assert.Contains(t, out.String(), "Tax exempt: Non-profit", name)
+	}
+}
+
+func TestTemplatesManualDiscount(t *testing.T) {
+	for name, source := range map[string]string{"confirmation": defaultConfirmationTemplate, "received": defaultReceivedTemplate} {
+		tmpl, err := template.New(name).Parse(source)
+		require.NoError(t, err)
+
+		order := &models.Order{
+			Discount:             30,
+			ManualDiscount:       10,
+			ManualDiscountReason: "Loyal customer",
+			LineItems: []*models.LineItem{
+				{Title: "Batarang", Quantity: 2, Price: 100, ManualDiscount: 5},
+			},
+		}
+		var out bytes.Buffer
+		require.NoError(t, tmpl.Execute(&out, map[string]interface{}{"Order": order}))
+		assert.Contains(t, out.String(), "Coupon discount: <strong>-15</strong>", name)
+		assert.Contains(t, out.String(), "Discount (Loyal customer): <strong>-10</strong>", name)
+		assert.Contains(t, out.String(), "Discount: -5", name)
+	}
+}
+
+func TestTemplatesOrderNumber(t *testing.T) {
+	for name, source := range map[string]string{"confirmation": defaultConfirmationTemplate, "received": defaultReceivedTemplate} {
+		tmpl, err := template.New(name).Parse(source)
+		require.NoError(t, err)
+
+		var out bytes.Buffer
+		require.NoError(t, tmpl.Execute(&out, map[string]interface{}{"Order": &models.Order{}}))
+		assert.NotContains(t, out.String(), "Order number", name)
+
+		number := "ORD-2024-000123"
+		out.Reset()
+		require.NoError(t, tmpl.Execute(&out, map[string]interface{}{"Order": &models.Order{Number: &number}}))
+		assert.Contains(t, out.String(), "Order number: <strong>ORD-2024-000123</strong>", name)
+	}
+}
+
+func TestTemplatesTaxes(t *testing.T) {
+	for name, source := range map[string]string{"confirmation": defaultConfirmationTemplate, "received": defaultReceivedTemplate} {
+		tmpl, err := template.New(name).Parse(source)
+		require.NoError(t, err)
+
+		var out bytes.Buffer
+		require.NoError(t, tmpl.Execute(&out, map[string]interface{}{"Order": &models.Order{Taxes: 70, Total: 1069}}))
+		assert.Contains(t, out.String(), "Taxes: <strong>70</strong>", name)
+		assert.NotContains(t, out.String(), "Including taxes", name)
+
+		out.Reset()
+		require.NoError(t, tmpl.Execute(&out, map[string]interface{}{"Order": &models.Order{Taxes: 65, Total: 999, PricesIncludeTaxes: true}}))
+		assert.Contains(t, out.String(), "Total amount: <strong>999</strong>", name)
+		assert.Contains(t, out.String(), "Including taxes: <strong>65</strong>", name)
+		assert.NotContains(t, out.String(), "<p>Taxes:", name)
+	}
+}
+
+func TestLocalization(t *testing.T) {
+	locale, err := NormalizeLocale("fr_ca")
+	require.NoError(t, err)
+	assert.Equal(t, "fr-CA", locale)
+	_, err = NormalizeLocale("not a locale")
+	assert.Error(t, err)
+
+	assert.Equal(t, "$1,234.50", localePrice("", 123450, "USD"))
+	assert.Equal(t, "1.234,50 €", localePrice("de", 123450, "EUR"))
+	assert.Equal(t, "1 234,50 €", localePrice("fr-CA", 123450, "EUR"))
+	assert.Equal(t, "¥1,234", localePrice("en", 1234, "JPY"))
+	assert.Equal(t, "1,234.50 CHF", localePrice("en", 123450, "CHF"))
+	assert.Equal(t, "02.01.2030", localeDate("de", time.Date(2030, time.January, 2, 0, 0, 0, 0, time.UTC)))
+
+	config := &conf.Configuration{}
+	config.Mailer.Subjects.OrderConfirmation = "Order Confirmation"
+	config.Mailer.LocalizedSubjects = map[string]conf.EmailContentConfiguration{
+		"fr": {OrderConfirmation: "Confirmation de commande"},
+	}
+	confirmation := func(subjects conf.EmailContentConfiguration) string { return subjects.OrderConfirmation }
+	assert.Equal(t, "Confirmation de commande", localizedSubject(config, "fr-CA", confirmation))
+	assert.Equal(t, "Order Confirmation", localizedSubject(config, "de", confirmation))
+	assert.Equal(t, "Order Confirmation", localizedSubject(config, "", confirmation))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/mail/confirmation.fr.html" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	assert.Equal(t, "/mail/confirmation.fr.html", localizedTemplate(server.URL, "/mail/confirmation.html", "fr-CA"))
+	assert.Equal(t, "/mail/confirmation.html", localizedTemplate(server.URL, "/mail/confirmation.html", "de"))
+	assert.Equal(t, "/mail/confirmation.html", localizedTemplate(server.URL, "/mail/confirmation.html", ""))
+}
+
+func TestTemplatesTaxLines(t *testing.T) {
+	for name, source := range map[string]string{"confirmation": defaultConfirmationTemplate, "received": defaultReceivedTemplate} {
+		tmpl, err := template.New(name).Parse(source)
+		require.NoError(t, err)
+
+		order := &models.Order{
+			Taxes: 80,
+			TaxLines: []calculator.TaxLine{
+				{Name: "State", Percentage: 6, Amount: 60},
+				{Name: "City", Percentage: 2, Amount: 20},
+			},
+		}
+		var out bytes.Buffer
+		require.NoError(t, tmpl.Execute(&out, map[string]interface{}{"Order": order}))
+		assert.Contains(t, out.String(), "State (6%): <strong>60</strong>", name)
+		assert.Contains(t, out.String(), "City (2%): <strong>20</strong>", name)
+		assert.Contains(t, out.String(), "Taxes: <strong>80</strong>", name)
+
+		order.PricesIncludeTaxes = true
+		out.Reset()
+		require.NoError(t, tmpl.Execute(&out, map[string]interface{}{"Order": order}))
+		assert.Contains(t, out.String(), "Including State (6%): <strong>60</strong>", name)
+		assert.Contains(t, out.String(), "Including taxes: <strong>80</strong>", name)
+	}
+}
+
+func TestTemplatesLineTaxes(t *testing.T) {
+	for name, source := range map[string]string{"confirmation": defaultConfirmationTemplate, "received": defaultReceivedTemplate} {
+		tmpl, err := template.New(name).Parse(source)
+		require.NoError(t, err)
+
+		order := &models.Order{
+			Taxes: 27,
+			LineItems: []*models.LineItem{
+				{Title: "Coffee beans", Quantity: 2, Price: 500, LineTaxes: 70, TaxLines: []calculator.TaxLine{{Percentage: 7, Amount: 70}}},
+				{Title: "Grinder", Quantity: 1, Price: 1000, LineTaxes: 200, TaxLines: []calculator.TaxLine{
+					{Name: "State", Percentage: 6, Amount: 60},
+					{Name: "City", Percentage: 14, Amount: 140},
+				}},
+				{Title: "Gift card", Quantity: 1, Price: 2500},
+			},
+		}
+		var out bytes.Buffer
+		require.NoError(t, tmpl.Execute(&out, map[string]interface{}{"Order": order}))
+		assert.Contains(t, out.String(), "<em>Taxes (7%): 70</em>", name)
+		assert.Contains(t, out.String(), "<em>Taxes (State 6%, City 14%): 200</em>", name)
+		assert.Equal(t, 2, strings.Count(out.String(), "<em>Taxes"), name)
+
+		order.PricesIncludeTaxes = true
+		out.Reset()
+		require.NoError(t, tmpl.Execute(&out, map[string]interface{}{"Order": order}))
+		assert.Contains(t, out.String(), "<em>Including taxes (7%): 70</em>", name)
+	}
+}
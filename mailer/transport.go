@@ -0,0 +1,133 @@
+package mailer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/gomail.v2"
+)
+
+// Mail providers
+const (
+	SMTPProvider     = "smtp"
+	SendGridProvider = "sendgrid"
+	MailgunProvider  = "mailgun"
+)
+
+const defaultSendGridURL = "https://api.sendgrid.com/v3"
+const defaultMailgunURL = "https://api.mailgun.net/v3"
+
+var transportClient = &http.Client{Timeout: 30 * time.Second}
+
+// Transport delivers rendered mails.
+type Transport interface {
+	Send(from, to, subject, body string) error
+}
+
+type smtpTransport struct {
+	host string
+	port int
+	user string
+	pass string
+}
+
+func (t *smtpTransport) Send(from, to, subject, body string) error {
+	mail := gomail.NewMessage()
+	mail.SetHeader("From", from)
+	mail.SetHeader("To", to)
+	mail.SetHeader("Subject", subject)
+	mail.SetBody("text/html", body)
+
+	dial := gomail.NewPlainDialer(t.host, t.port, t.user, t.pass)
+	return dial.DialAndSend(mail)
+}
+
+type sendGridAddress struct {
+	Email string `json:"email"`
+}
+
+type sendGridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sendGridPersonalization struct {
+	To []sendGridAddress `json:"to"`
+}
+
+type sendGridMail struct {
+	Personalizations []sendGridPersonalization `json:"personalizations"`
+	From             sendGridAddress           `json:"from"`
+	Subject          string                    `json:"subject"`
+	Content          []sendGridContent         `json:"content"`
+}
+
+// sendGridTransport sends mails with the v3 mail send API of SendGrid.
+type sendGridTransport struct {
+	apiKey string
+	apiURL string
+}
+
+func (t *sendGridTransport) Send(from, to, subject, body string) error {
+	mail := &sendGridMail{
+		Personalizations: []sendGridPersonalization{{To: []sendGridAddress{{Email: to}}}},
+		From:             sendGridAddress{Email: from},
+		Subject:          subject,
+		Content:          []sendGridContent{{Type: "text/html", Value: body}},
+	}
+
+	payload, err := json.Marshal(mail)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, withDefault(t.apiURL, defaultSendGridURL)+"/mail/send", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+t.apiKey)
+	return sendRequest("SendGrid", req)
+}
+
+// mailgunTransport sends mails with the messages API of Mailgun.
+type mailgunTransport struct {
+	apiKey string
+	domain string
+	apiURL string
+}
+
+func (t *mailgunTransport) Send(from, to, subject, body string) error {
+	form := url.Values{}
+	form.Set("from", from)
+	form.Set("to", to)
+	form.Set("subject", subject)
+	form.Set("html", body)
+
+	endpoint := fmt.Sprintf("%s/%s/messages", withDefault(t.apiURL, defaultMailgunURL), t.domain)
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("api", t.apiKey)
+	return sendRequest("Mailgun", req)
+}
+
+func sendRequest(provider string, req *http.Request) error {
+	resp, err := transportClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s responded with %v: %s", provider, resp.Status, body)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package models
+
+import (
+	"encoding/json"
+	"reflect"
+	"time"
+)
+
+// Audited admin actions.
+const (
+	AuditOrderCancel     = "order.cancel"
+	AuditOrderUpdate     = "order.update"
+	AuditPaymentRefund   = "payment.refund"
+	AuditUserDelete      = "user.delete"
+	AuditUserAnonymize   = "user.anonymize"
+	AuditUserImpersonate = "user.impersonate"
+	AuditUserUpdate      = "user.update"
+)
+
+// AuditLog records a change made by an admin. Before and After only hold the
+// fields that changed, or the whole record if it was created or deleted.
+type AuditLog struct {
+	InstanceID string `json:"-" sql:"index"`
+	ID         uint64 `json:"id"`
+
+	ActorID    string `json:"actor_id" sql:"index"`
+	ActorEmail string `json:"actor_email"`
+	IP         string `json:"ip"`
+
+	Action   string `json:"action"`
+	TargetID string `json:"target_id" sql:"index"`
+
+	Before    map[string]interface{} `json:"before,omitempty" sql:"-"`
+	RawBefore string                 `json:"-" sql:"type:text"`
+	After     map[string]interface{} `json:"after,omitempty" sql:"-"`
+	RawAfter  string                 `json:"-" sql:"type:text"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName returns the database table name for the AuditLog model.
+func (AuditLog) TableName() string {
+	return tableName("audit_logs")
+}
+
+// NewAuditLog creates an AuditLog model with the difference between the
+// before and after state of the target. Either of them may be nil.
+func NewAuditLog(instanceID, actorID, actorEmail, ip, action, targetID string, before, after interface{}) (*AuditLog, error) {
+	beforeFields, err := AuditSnapshot(before)
+	if err != nil {
+		return nil, err
+	}
+	afterFields, err := AuditSnapshot(after)
+	if err != nil {
+		return nil, err
+	}
+
+	if beforeFields != nil && afterFields != nil {
+		for key, value := range beforeFields {
+			if afterValue, ok := afterFields[key]; ok && reflect.DeepEqual(value, afterValue) {
+				delete(beforeFields, key)
+				delete(afterFields, key)
+			}
+		}
+	}
+
+	return &AuditLog{
+		InstanceID: instanceID,
+		ActorID:    actorID,
+		ActorEmail: actorEmail,
+		IP:         ip,
+		Action:     action,
+		TargetID:   targetID,
+		Before:     beforeFields,
+		After:      afterFields,
+	}, nil
+}
+
+// AuditSnapshot turns a record into the map of its JSON fields, so its state
+// can be compared after the record was changed.
+func AuditSnapshot(record interface{}) (map[string]interface{}, error) {
+	if record == nil {
+		return nil, nil
+	}
+	if value := reflect.ValueOf(record); (value.Kind() == reflect.Ptr || value.Kind() == reflect.Map) && value.IsNil() {
+		return nil, nil
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// AfterFind database callback.
+func (l *AuditLog) AfterFind() error {
+	if l.RawBefore != "" {
+		if err := json.Unmarshal([]byte(l.RawBefore), &l.Before); err != nil {
+			return err
+		}
+	}
+	if l.RawAfter != "" {
+		if err := json.Unmarshal([]byte(l.RawAfter), &l.After); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BeforeSave database callback.
+func (l *AuditLog) BeforeSave() error {
+	if l.Before != nil {
+		data, err := json.Marshal(l.Before)
+		if err != nil {
+			return err
+		}
+		l.RawBefore = string(data)
+	}
+	if l.After != nil {
+		data, err := json.Marshal(l.After)
+		if err != nil {
+			return err
+		}
+		l.RawAfter = string(data)
+	}
+	return nil
+}
@@ -25,14 +25,45 @@ func Connect(config *conf.GlobalConfiguration, log logrus.FieldLogger) (*gorm.DB
 		Namespace = config.DB.Namespace
 	}
 
+	db, err := open(config, config.DB.URL, log)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.DB.Automigrate {
+		migDB := db.New()
+		migDB.SetLogger(NewDBLogger(log.WithField("task", "migration")))
+		if err := Migrate(migDB, log.WithField("task", "migration")); err != nil {
+			return nil, errors.Wrap(err, "migrating tables")
+		}
+	}
+
+	return db, nil
+}
+
+// ConnectRead will connect to the read replica if one is configured.
+// It returns nil when no replica is configured, in which case callers
+// should fall back to the primary connection.
+func ConnectRead(config *conf.GlobalConfiguration, log logrus.FieldLogger) (*gorm.DB, error) {
+	if config.DB.ReadURL == "" {
+		return nil, nil
+	}
+	return open(config, config.DB.ReadURL, log)
+}
+
+func open(config *conf.GlobalConfiguration, url string, log logrus.FieldLogger) (*gorm.DB, error) {
 	if config.DB.Dialect == "" {
 		config.DB.Dialect = config.DB.Driver
 	}
-	db, err := gorm.Open(config.DB.Dialect, config.DB.Driver, config.DB.URL)
+	db, err := gorm.Open(config.DB.Dialect, config.DB.Driver, url)
 	if err != nil {
 		return nil, errors.Wrap(err, "opening database connection")
 	}
 
+	db.DB().SetMaxOpenConns(config.DB.MaxOpenConns)
+	db.DB().SetMaxIdleConns(config.DB.MaxIdleConns)
+	db.DB().SetConnMaxLifetime(config.DB.ConnMaxLifetime)
+
 	db.SetLogger(NewDBLogger(log))
 	db.LogMode(true)
 
@@ -40,15 +71,6 @@ func Connect(config *conf.GlobalConfiguration, log logrus.FieldLogger) (*gorm.DB
 	if err != nil {
 		return nil, errors.Wrap(err, "checking database connection")
 	}
-
-	if config.DB.Automigrate {
-		migDB := db.New()
-		migDB.SetLogger(NewDBLogger(log.WithField("task", "migration")))
-		if err := AutoMigrate(migDB); err != nil {
-			return nil, errors.Wrap(err, "migrating tables")
-		}
-	}
-
 	return db, nil
 }
 
@@ -66,14 +88,29 @@ func AutoMigrate(db *gorm.DB) error {
 		AddonItem{},
 		PriceItem{},
 		Hook{},
+		Job{},
 		Download{},
 		Order{},
+		Data{},
 		OrderNote{},
+		Shipment{},
 		Transaction{},
+		Dispute{},
+		Return{},
+		ReturnItem{},
+		GiftCard{},
+		AuditLog{},
 		User{},
 		Event{},
 		Instance{},
 		InvoiceNumber{},
+		OrderNumber{},
+		TaxExemption{},
+		Stock{},
+		Reservation{},
+		WebhookSubscription{},
+		ProcessedEvent{},
+		UsedOrderToken{},
 	)
 	return db.Error
 }
@@ -0,0 +1,41 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jinzhu/gorm"
+)
+
+// contextSetting is the gorm setting holding the context of a connection.
+const contextSetting = "gocommerce:context"
+
+func init() {
+	gorm.DefaultCallback.Query().Before("gorm:query").Register("gocommerce:check_context", checkContextCallback)
+	gorm.DefaultCallback.Create().Before("gorm:begin_transaction").Register("gocommerce:check_context", checkContextCallback)
+	gorm.DefaultCallback.Update().Before("gorm:begin_transaction").Register("gocommerce:check_context", checkContextCallback)
+	gorm.DefaultCallback.Delete().Before("gorm:begin_transaction").Register("gocommerce:check_context", checkContextCallback)
+}
+
+// WithContext returns a connection to the database of db whose queries fail
+// once ctx is done. It keeps the settings of db. Queries in transactions
+// aren't affected, so a transaction that started, e.g. to record a payment
+// that went through, is always committed.
+func WithContext(ctx context.Context, db *gorm.DB) *gorm.DB {
+	return db.New().Set(contextSetting, ctx)
+}
+
+// checkContextCallback stops queries outside of transactions once the context
+// of their connection is done.
+func checkContextCallback(scope *gorm.Scope) {
+	value, ok := scope.Get(contextSetting)
+	if !ok {
+		return
+	}
+	if _, ok := scope.SQLDB().(*sql.Tx); ok {
+		return
+	}
+	if ctx, ok := value.(context.Context); ok && ctx.Err() != nil {
+		scope.Err(ctx.Err())
+	}
+}
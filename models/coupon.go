@@ -1,9 +1,9 @@
 package models
 
 import (
-	"math"
-	"strconv"
 	"time"
+
+	"github.com/netlify/gocommerce/calculator"
 )
 
 // FixedAmount represents an amount and currency pair
@@ -12,9 +12,22 @@ type FixedAmount struct {
 	Currency string `json:"currency"`
 }
 
+// Coupon types. Coupons without a type are percentage or fixed coupons
+// depending on which discount they define.
+const (
+	PercentageCouponType   = "percentage"
+	FixedCouponType        = "fixed"
+	FreeShippingCouponType = "free_shipping"
+)
+
 // Coupon represents a discount redeemable with a code.
 type Coupon struct {
 	Code string `json:"code"`
+	Type string `json:"type,omitempty"`
+
+	// Exclusive coupons can't be combined with other coupons, even when
+	// coupon stacking is enabled.
+	Exclusive bool `json:"exclusive,omitempty"`
 
 	StartDate *time.Time `json:"start_date,omitempty"`
 	EndDate   *time.Time `json:"end_date,omitempty"`
@@ -82,38 +95,32 @@ func (c *Coupon) ValidForPrice(currency string, price uint64) bool {
 	return true
 }
 
+// FreeShipping returns whether a coupon waives the shipping costs.
+func (c *Coupon) FreeShipping() bool {
+	return c.Type == FreeShippingCouponType
+}
+
 // PercentageDiscount returns the percentage discount of a Coupon.
 func (c *Coupon) PercentageDiscount() uint64 {
+	if c.FreeShipping() {
+		return 0
+	}
 	return c.Percentage
 }
 
 // FixedDiscount returns the amount of fixed discount for a Coupon.
 func (c *Coupon) FixedDiscount(currency string) uint64 {
+	if c.FreeShipping() {
+		return 0
+	}
 	if c.FixedAmount != nil {
 		for _, discount := range c.FixedAmount {
 			if discount.Currency == currency {
-				amount, _ := strconv.ParseFloat(discount.Amount, 64)
-				return rint(amount * 100)
+				amount, _ := calculator.ParseAmount(discount.Amount, currency)
+				return amount
 			}
 		}
 	}
 
 	return 0
 }
-
-// Nopes - no `round` method in go
-// See https://gist.github.com/siddontang/1806573b9a8574989ccb
-func rint(x float64) uint64 {
-	v, frac := math.Modf(x)
-	if x > 0.0 {
-		if frac > 0.5 || (frac == 0.5 && uint64(v)%2 != 0) {
-			v += 1.0
-		}
-	} else {
-		if frac < -0.5 || (frac == -0.5 && uint64(v)%2 != 0) {
-			v -= 1.0
-		}
-	}
-
-	return uint64(v)
-}
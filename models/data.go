@@ -0,0 +1,103 @@
+package models
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Data types of indexed metadata values
+const (
+	StringDataType = "string"
+	NumberDataType = "number"
+	BoolDataType   = "bool"
+)
+
+// Data is an indexed copy of a value in the metadata of an order, so orders
+// can be searched by it.
+type Data struct {
+	ID      uint64 `json:"-"`
+	OrderID string `json:"-" sql:"index"`
+
+	Key  string `json:"key" gorm:"column:data_key" sql:"index"`
+	Type string `json:"type"`
+
+	StringValue  string  `json:"string_value,omitempty" sql:"index"`
+	NumericValue float64 `json:"numeric_value,omitempty"`
+	BoolValue    bool    `json:"bool_value,omitempty"`
+}
+
+// TableName returns the database table name for the Data model.
+func (Data) TableName() string {
+	return tableName("data")
+}
+
+// SyncData indexes the metadata values of the order for the given keys,
+// replacing the values indexed before. Values that are objects or lists
+// aren't indexed.
+func (o *Order) SyncData(tx *gorm.DB, keys []string) error {
+	if err := tx.Delete(Data{}, "order_id = ?", o.ID).Error; err != nil {
+		return err
+	}
+	for _, key := range keys {
+		data := &Data{OrderID: o.ID, Key: key}
+		switch value := o.MetaData[key].(type) {
+		case string:
+			data.Type = StringDataType
+			data.StringValue = value
+		case float64:
+			data.Type = NumberDataType
+			data.NumericValue = value
+			data.StringValue = strconv.FormatFloat(value, 'f', -1, 64)
+		case bool:
+			data.Type = BoolDataType
+			data.BoolValue = value
+			data.StringValue = strconv.FormatBool(value)
+		default:
+			continue
+		}
+		if err := tx.Create(data).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dataBackfillBatchSize is the number of orders indexed at once by
+// backfillData.
+const dataBackfillBatchSize = 100
+
+// backfillData indexes the metadata of orders that have none indexed yet.
+// The searchable keys are configured per instance, so all values that can be
+// indexed are. Only configured keys can be searched by and the index is
+// trimmed to them when the metadata of an order is updated.
+func backfillData(tx *gorm.DB) error {
+	orderTable := tx.NewScope(Order{}).QuotedTableName()
+	dataTable := tx.NewScope(Data{}).QuotedTableName()
+	lastID := ""
+	for {
+		orders := []*Order{}
+		err := tx.Select("id, raw_meta_data").
+			Where(orderTable+".id > ? AND raw_meta_data IS NOT NULL AND raw_meta_data <> ?", lastID, "").
+			Where(orderTable + ".id NOT IN (SELECT order_id FROM " + dataTable + ")").
+			Order("id").Limit(dataBackfillBatchSize).Find(&orders).Error
+		if err != nil {
+			return err
+		}
+		for _, order := range orders {
+			keys := make([]string, 0, len(order.MetaData))
+			for key := range order.MetaData {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			if err := order.SyncData(tx, keys); err != nil {
+				return err
+			}
+		}
+		if len(orders) < dataBackfillBatchSize {
+			return nil
+		}
+		lastID = orders[len(orders)-1].ID
+	}
+}
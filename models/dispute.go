@@ -0,0 +1,35 @@
+package models
+
+import (
+	"time"
+)
+
+// DisputedState is the state of an Order whose payment is disputed by the customer
+const DisputedState = "disputed"
+
+// Dispute is a chargeback opened by a customer with their bank against a
+// charge transaction.
+type Dispute struct {
+	InstanceID    string `json:"-"`
+	SiteID        string `json:"site_id,omitempty" sql:"index"`
+	ID            string `json:"id"`
+	ProcessorID   string `json:"processor_id" sql:"index"`
+	TransactionID string `json:"transaction_id" sql:"index"`
+	OrderID       string `json:"order_id" sql:"index"`
+
+	Reason   string `json:"reason"`
+	Amount   uint64 `json:"amount"`
+	Currency string `json:"currency"`
+	Status   string `json:"status"`
+
+	DueBy *time.Time `json:"due_by,omitempty"`
+
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"-"`
+}
+
+// TableName returns the database table name for the Dispute model.
+func (Dispute) TableName() string {
+	return tableName("disputes")
+}
@@ -40,6 +40,11 @@ const (
 	EventUpdated EventType = "updated"
 	// EventDeleted is the EventType when an order is deleted.
 	EventDeleted EventType = "deleted"
+	// EventConfirmationResent is the EventType when the order confirmation is sent again.
+	EventConfirmationResent EventType = "confirmation_resent"
+	// EventEmailLookupFailed is the EventType when a guest looks up an order
+	// with an email that doesn't match it.
+	EventEmailLookupFailed EventType = "email_lookup_failed"
 )
 
 // LogEvent logs a new event
@@ -0,0 +1,138 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/conf"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const expiryInterval = time.Minute
+
+// ExpireOrders marks the pending orders of an instance that are older than
+// the configured TTL as abandoned. It returns the number of abandoned orders.
+func ExpireOrders(db *gorm.DB, instanceID string, config *conf.Configuration, log logrus.FieldLogger) (int, error) {
+	if config.Expiry.TTL <= 0 {
+		return 0, nil
+	}
+
+	cutoff := time.Now().Add(-time.Duration(config.Expiry.TTL) * time.Minute)
+	orders := []*Order{}
+	rsp := db.Preload("LineItems").
+		Where("instance_id = ? AND payment_state = ? AND created_at < ?", instanceID, PendingState, cutoff).
+		Find(&orders)
+	if rsp.Error != nil {
+		return 0, rsp.Error
+	}
+
+	expired := 0
+	for _, order := range orders {
+		ok, err := expireOrder(db, order, config)
+		if err != nil {
+			log.WithError(err).WithField("order_id", order.ID).Error("Failed to expire order")
+			continue
+		}
+		if ok {
+			expired++
+		}
+	}
+	return expired, nil
+}
+
+func expireOrder(db *gorm.DB, order *Order, config *conf.Configuration) (bool, error) {
+	tx := db.Begin()
+
+	// only abandon the order if it wasn't paid in the meantime
+	rsp := tx.Model(&Order{}).Where("id = ? AND payment_state = ?", order.ID, PendingState).
+		UpdateColumns(map[string]interface{}{
+			"payment_state": AbandonedState,
+			"version":       gorm.Expr("version + 1"),
+		})
+	if rsp.Error != nil {
+		tx.Rollback()
+		return false, rsp.Error
+	}
+	if rsp.RowsAffected == 0 {
+		tx.Rollback()
+		return false, nil
+	}
+	order.PaymentState = AbandonedState
+	order.Version++
+
+	if err := ReleaseReservations(tx, order.ID); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if err := RestoreGiftCardCharges(tx, order.ID, "The order was abandoned before it was paid"); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if config.Expiry.Restock {
+		if err := ReleaseStock(tx, order); err != nil {
+			tx.Rollback()
+			return false, err
+		}
+	}
+
+	text := fmt.Sprintf("Order abandoned after %d minutes without payment", config.Expiry.TTL)
+	if err := LogTimeline(tx, order.ID, order.UserID, "", AbandonedTimelineEvent, text); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	err := RunHooks(tx, config, order.InstanceID, "abandoned", config.Webhooks.Abandoned, order.UserID, order)
+	if err != nil && errors.Cause(err) != ErrHookPayloadTooLarge {
+		// the order is still abandoned if only the webhook is too large
+		tx.Rollback()
+		return false, err
+	}
+
+	return true, tx.Commit().Error
+}
+
+// RunOrderExpiry creates a goroutine that abandons expired orders and releases
+// expired stock reservations every minute. Without a config the orders of every instance are expired using
+// the configuration of their instance.
+func RunOrderExpiry(db *gorm.DB, config *conf.Configuration, log *logrus.Entry) {
+	go func() {
+		for {
+			if config != nil {
+				expireInstanceOrders(db, "", config, log)
+			} else {
+				instances := []*Instance{}
+				if rsp := db.Find(&instances); rsp.Error != nil {
+					log.WithError(rsp.Error).Error("Error querying for instances")
+				}
+				for _, instance := range instances {
+					instanceConfig, err := instance.Config()
+					if err != nil {
+						continue
+					}
+					expireInstanceOrders(db, instance.ID, instanceConfig, log.WithField("instance_id", instance.ID))
+				}
+			}
+			time.Sleep(expiryInterval)
+		}
+	}()
+}
+
+func expireInstanceOrders(db *gorm.DB, instanceID string, config *conf.Configuration, log *logrus.Entry) {
+	released, err := ExpireReservations(db, instanceID, log)
+	if err != nil {
+		log.WithError(err).Error("Error expiring stock reservations")
+	} else if released > 0 {
+		log.Infof("Released %d expired stock reservations", released)
+	}
+
+	expired, err := ExpireOrders(db, instanceID, config, log)
+	if err != nil {
+		log.WithError(err).Error("Error expiring orders")
+		return
+	}
+	if expired > 0 {
+		log.Infof("Abandoned %d unpaid orders", expired)
+	}
+}
@@ -0,0 +1,131 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+)
+
+// GiftCardProcessor is the payment processor of orders paid entirely with gift cards
+const GiftCardProcessor = "gift_card"
+
+// ErrInsufficientBalance is returned when a gift card doesn't have the balance to redeem
+var ErrInsufficientBalance = errors.New("The gift card balance is insufficient")
+
+// GiftCard is store credit that can be redeemed with its code when paying
+// for an order. Gift cards with an owner can only be redeemed by that user.
+type GiftCard struct {
+	InstanceID string `json:"-" sql:"unique_index:idx_gift_card_code"`
+	ID         string `json:"id"`
+	Code       string `json:"code" sql:"unique_index:idx_gift_card_code"`
+	SiteID     string `json:"site_id,omitempty" sql:"index"`
+
+	Balance  uint64 `json:"balance"`
+	Currency string `json:"currency"`
+	UserID   string `json:"user_id,omitempty" sql:"index"`
+
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"-"`
+}
+
+// TableName returns the database table name for the GiftCard model.
+func (GiftCard) TableName() string {
+	return tableName("gift_cards")
+}
+
+// NewGiftCard creates a gift card with a random code if none is given.
+func NewGiftCard(instanceID, code string, balance uint64, currency, userID string) *GiftCard {
+	if code == "" {
+		code = strings.ToUpper(strings.Replace(uuid.NewRandom().String(), "-", "", -1)[:16])
+	}
+	return &GiftCard{
+		InstanceID: instanceID,
+		ID:         uuid.NewRandom().String(),
+		Code:       code,
+		Balance:    balance,
+		Currency:   currency,
+		UserID:     userID,
+	}
+}
+
+// FindGiftCard looks up the gift card with a code, or returns nil if there is none.
+func FindGiftCard(db *gorm.DB, instanceID, code string) (*GiftCard, error) {
+	card := &GiftCard{}
+	rsp := db.Where("instance_id = ? AND code = ?", instanceID, code).First(card)
+	if rsp.RecordNotFound() {
+		return nil, nil
+	}
+	if rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	return card, nil
+}
+
+// RedeemGiftCard deducts an amount from the balance of a gift card. The
+// balance is checked in the database so concurrent payments can't overdraw it.
+func RedeemGiftCard(tx *gorm.DB, card *GiftCard, amount uint64) error {
+	rsp := tx.Model(&GiftCard{}).Where("id = ? AND balance >= ?", card.ID, amount).
+		UpdateColumn("balance", gorm.Expr("balance - ?", amount))
+	if rsp.Error != nil {
+		return rsp.Error
+	}
+	if rsp.RowsAffected == 0 {
+		return ErrInsufficientBalance
+	}
+	card.Balance -= amount
+	return nil
+}
+
+// CreditGiftCard adds an amount to the balance of a gift card.
+func CreditGiftCard(tx *gorm.DB, card *GiftCard, amount uint64) error {
+	rsp := tx.Model(&GiftCard{}).Where("id = ?", card.ID).
+		UpdateColumn("balance", gorm.Expr("balance + ?", amount))
+	if rsp.Error != nil {
+		return rsp.Error
+	}
+	card.Balance += amount
+	return nil
+}
+
+// CompleteGiftCardCharges marks the pending gift card charges of an order as
+// paid once the rest of its payment went through.
+func CompleteGiftCardCharges(tx *gorm.DB, orderID string) error {
+	return tx.Model(&Transaction{}).
+		Where("order_id = ? AND type = ? AND status = ? AND gift_card_id <> ?", orderID, ChargeTransactionType, PendingState, "").
+		UpdateColumn("status", PaidState).Error
+}
+
+// RestoreGiftCardCharges returns the balance redeemed by the pending gift card
+// charges of an order to their gift cards and marks the charges as failed. The
+// balance is held while the rest of the payment is pending, e.g. waiting for
+// 3D Secure, and restored if that payment fails or the order expires.
+func RestoreGiftCardCharges(tx *gorm.DB, orderID, reason string) error {
+	charges := []*Transaction{}
+	rsp := tx.Where("order_id = ? AND type = ? AND status = ? AND gift_card_id <> ?", orderID, ChargeTransactionType, PendingState, "").
+		Find(&charges)
+	if rsp.Error != nil {
+		return rsp.Error
+	}
+	for _, charge := range charges {
+		// only the update that fails the charge restores its balance
+		rsp := tx.Model(&Transaction{}).Where("id = ? AND status = ?", charge.ID, PendingState).
+			UpdateColumns(map[string]interface{}{
+				"status":              FailedState,
+				"failure_description": reason,
+			})
+		if rsp.Error != nil {
+			return rsp.Error
+		}
+		if rsp.RowsAffected == 0 {
+			continue
+		}
+		if err := CreditGiftCard(tx, &GiftCard{ID: charge.GiftCardID}, charge.Amount); err != nil {
+			return err
+		}
+	}
+	return nil
+}
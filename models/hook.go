@@ -6,48 +6,69 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"sync"
 	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/jinzhu/gorm"
-	"github.com/pborman/uuid"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+
+	"github.com/netlify/gocommerce/conf"
 )
 
-const maxConcurrentHooks = 5
 const maxRetries = 5
 const retryPeriod = 30 * time.Second
 const signatureExpiration = 5 * time.Minute
+const defaultHookTimeout = 10 * time.Second
+const defaultMaxHookPayloadSize = 1 << 20
+
+// Webhook payload schema versions. Version 1 sends the payload as it is,
+// version 2 wraps it in an envelope with the schema version and event type.
+const (
+	HookSchemaV1 = 1
+	HookSchemaV2 = 2
+
+	LatestHookSchemaVersion = HookSchemaV2
+)
+
+// ErrHookPayloadTooLarge is returned when a webhook payload exceeds the
+// configured maximum size.
+var ErrHookPayloadTooLarge = errors.New("Webhook payload is too large")
 
 // Hook represents a webhook.
 type Hook struct {
-	ID uint64
+	ID         uint64 `json:"id"`
+	InstanceID string `json:"-" sql:"index"`
+
+	UserID string `json:"user_id,omitempty"`
 
-	UserID string
+	Type string `json:"type"`
 
-	Type string
+	// SchemaVersion is the version of the payload schema the hook is sent
+	// with, hooks stored before versioning have 0 and are sent as version 1.
+	SchemaVersion int `json:"schema_version"`
 
-	Done   bool
-	Failed bool
+	Done   bool `json:"done"`
+	Failed bool `json:"failed"`
 
-	URL     string
-	Payload string `sql:"type:text"`
-	Secret  string
+	URL     string `json:"url"`
+	Payload string `json:"payload" sql:"type:text"`
+	Secret  string `json:"-"`
+	// Timeout is the number of seconds to wait for a response
+	Timeout int64 `json:"timeout"`
 
-	ResponseStatus  string
-	ResponseHeaders string  `sql:"type:text"`
-	ResponseBody    string  `sql:"type:text"`
-	ErrorMessage    *string `sql:"type:text"`
+	ResponseStatus  string  `json:"response_status,omitempty"`
+	ResponseHeaders string  `json:"response_headers,omitempty" sql:"type:text"`
+	ResponseBody    string  `json:"response_body,omitempty" sql:"type:text"`
+	ErrorMessage    *string `json:"error_message,omitempty" sql:"type:text"`
 
-	Tries int
+	Tries int `json:"tries"`
 
-	CreatedAt   time.Time
-	RunAfter    *time.Time
-	LockedAt    *time.Time
-	LockedBy    *string
-	CompletedAt *time.Time
+	CreatedAt   time.Time  `json:"created_at"`
+	RunAfter    *time.Time `json:"run_after,omitempty"`
+	LockedAt    *time.Time `json:"-"`
+	LockedBy    *string    `json:"-"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
 }
 
 // TableName returns the database table name for the Hook model.
@@ -55,15 +76,32 @@ func (Hook) TableName() string {
 	return tableName("hooks")
 }
 
-// NewHook creates a Hook model.
-func NewHook(hookType, siteURL, hookURL, userID, secret string, payload interface{}) (*Hook, error) {
+// hookEnvelope is the body of webhooks sent with schema version 2 or later.
+type hookEnvelope struct {
+	SchemaVersion int             `json:"schema_version"`
+	EventType     string          `json:"event_type"`
+	Data          json.RawMessage `json:"data"`
+}
+
+// NewHook creates a Hook model. The payload schema version is pinned by the
+// configuration of the webhook type. Payloads larger than the configured
+// maximum are rejected with ErrHookPayloadTooLarge.
+func NewHook(hookType string, config *conf.Configuration, hookURL, userID string, payload interface{}) (*Hook, error) {
+	version := config.Webhooks.Versions[hookType]
+	if version == 0 {
+		version = HookSchemaV1
+	}
+	if version < HookSchemaV1 || version > LatestHookSchemaVersion {
+		return nil, errors.Errorf("Unsupported schema version %d for %s webhooks", version, hookType)
+	}
+
 	fullHookURL, err := url.Parse(hookURL)
 	if err != nil {
 		return nil, errors.Wrapf(err, "Failed to parse Webhook URL")
 	}
 
 	if !fullHookURL.IsAbs() {
-		fullSiteURL, err := url.Parse(siteURL)
+		fullSiteURL, err := url.Parse(config.SiteURL)
 		if err != nil {
 			return nil, errors.Wrapf(err, "Failed to parse Site URL")
 		}
@@ -73,29 +111,71 @@ func NewHook(hookType, siteURL, hookURL, userID, secret string, payload interfac
 	}
 
 	json, _ := json.Marshal(payload)
+	maxSize := config.Webhooks.MaxPayloadSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxHookPayloadSize
+	}
+	if int64(len(json)) > maxSize {
+		return nil, errors.Wrapf(ErrHookPayloadTooLarge, "%s payload of %d bytes exceeds %d bytes", hookType, len(json), maxSize)
+	}
+
 	return &Hook{
-		Type:    hookType,
-		UserID:  userID,
-		URL:     fullHookURL.String(),
-		Secret:  secret,
-		Payload: string(json),
+		Type:          hookType,
+		SchemaVersion: version,
+		UserID:        userID,
+		URL:           fullHookURL.String(),
+		Secret:        config.Webhooks.Secret,
+		Timeout:       config.Webhooks.Timeout,
+		Payload:       string(json),
 	}, nil
 }
 
-// Trigger creates and executes the HTTP request for a Hook.
+func (h *Hook) schemaVersion() int {
+	if h.SchemaVersion == 0 {
+		return HookSchemaV1
+	}
+	return h.SchemaVersion
+}
+
+// Body serializes the payload with the schema version of the hook.
+func (h *Hook) Body() ([]byte, error) {
+	if h.schemaVersion() == HookSchemaV1 {
+		return []byte(h.Payload), nil
+	}
+	return json.Marshal(hookEnvelope{
+		SchemaVersion: h.schemaVersion(),
+		EventType:     h.Type,
+		Data:          json.RawMessage(h.Payload),
+	})
+}
+
+func (h *Hook) timeout() time.Duration {
+	if h.Timeout <= 0 {
+		return defaultHookTimeout
+	}
+	return time.Duration(h.Timeout) * time.Second
+}
+
+// Trigger creates and executes the HTTP request for a Hook. Requests that
+// don't complete within the timeout of the hook fail.
 func (h *Hook) Trigger(client *http.Client, log *logrus.Entry) (*http.Response, error) {
 	log.Infof("Triggering hook %v: %v", h.ID, h.URL)
 	h.Tries++
-	body := bytes.NewBufferString(h.Payload)
-	req, err := http.NewRequest("POST", h.URL, body)
-	req.Header.Set("Content-Type", "application/json")
+	payload, err := h.Body()
 	if err != nil {
 		return nil, err
 	}
+	req, err := http.NewRequest("POST", h.URL, bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
 	if h.Secret != "" {
 		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-			"sub": h.UserID,
-			"exp": time.Now().Add(signatureExpiration).Unix(),
+			"sub":            h.UserID,
+			"exp":            time.Now().Add(signatureExpiration).Unix(),
+			"event_type":     h.Type,
+			"schema_version": h.schemaVersion(),
 		})
 		tokenString, err := token.SignedString([]byte(h.Secret))
 		if err != nil {
@@ -103,7 +183,9 @@ func (h *Hook) Trigger(client *http.Client, log *logrus.Entry) (*http.Response,
 		}
 		req.Header.Set("X-Commerce-Signature", tokenString)
 	}
-	return client.Do(req)
+	timeoutClient := *client
+	timeoutClient.Timeout = h.timeout()
+	return timeoutClient.Do(req)
 }
 
 func (h *Hook) handleError(db *gorm.DB, log *logrus.Entry, resp *http.Response, err error) {
@@ -150,49 +232,35 @@ func (h *Hook) handleSuccess(db *gorm.DB, log *logrus.Entry, resp *http.Response
 	db.Save(h)
 }
 
-// RunHooks creates a goroutine that triggers stored webhooks every 5 seconds.
-func RunHooks(db *gorm.DB, log *logrus.Entry) {
-	go func() {
-		id := uuid.NewRandom().String()
-		sem := make(chan bool, maxConcurrentHooks)
-		table := Hook{}.TableName()
-		client := &http.Client{}
-		for {
-			hooks := []*Hook{}
-			tx := db.Begin()
-			now := time.Now()
-
-			tx.Table(table).
-				Where("done = ? AND (locked_at IS NULL OR locked_at < ?) AND (run_after IS NULL OR run_after < ?)", false, now.Add(-5*time.Minute), now).
-				Updates(map[string]interface{}{"locked_at": now, "locked_by": id})
-
-			tx.Where("locked_by = ?", id).Find(&hooks)
-			if rsp := tx.Commit(); rsp.Error != nil {
-				log.WithError(rsp.Error).Error("Error querying for hooks")
-			}
-
-			var wg sync.WaitGroup
-			for _, hook := range hooks {
-				sem <- true
-				wg.Add(1)
-				go func(hook *Hook) {
-					defer wg.Done()
-					resp, err := hook.Trigger(client, log)
-					hook.LockedAt = nil
-					hook.LockedBy = nil
-					tx := db.Begin()
-					if err != nil || !(resp.StatusCode >= 200 && resp.StatusCode < 300) {
-						hook.handleError(tx, log, resp, err)
-					} else {
-						hook.handleSuccess(tx, log, resp)
-					}
-					tx.Commit()
-					<-sem
-				}(hook)
-			}
-
-			wg.Wait()
-			time.Sleep(5 * time.Second)
+// Deliver triggers the hook once and stores the outcome. Failed deliveries
+// are scheduled for a retry and reported as an error.
+func (h *Hook) Deliver(db *gorm.DB, client *http.Client, log *logrus.Entry) error {
+	resp, err := h.Trigger(client, log)
+	h.LockedAt = nil
+	h.LockedBy = nil
+	tx := db.Begin()
+	defer tx.Commit()
+	if err != nil || !(resp.StatusCode >= 200 && resp.StatusCode < 300) {
+		h.handleError(tx, log, resp, err)
+		if err == nil {
+			err = errors.Errorf("Hook %v responded with %v", h.ID, resp.Status)
 		}
-	}()
+		return err
+	}
+	h.handleSuccess(tx, log, resp)
+	return nil
+}
+
+// Retry requeues a hook that failed permanently with a fresh set of tries.
+// The error of the last try is kept until the hook is triggered again.
+func (h *Hook) Retry(tx *gorm.DB) error {
+	h.Done = false
+	h.Failed = false
+	h.Tries = 0
+	h.RunAfter = nil
+	h.CompletedAt = nil
+	if rsp := tx.Save(h); rsp.Error != nil {
+		return rsp.Error
+	}
+	return Queue.Enqueue(tx, hookJob(h))
 }
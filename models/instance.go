@@ -120,7 +120,11 @@ func (i *Instance) BeforeDelete(tx *gorm.DB) error {
 
 	delModels := map[string]interface{}{
 		"transaction":    Transaction{},
+		"dispute":        Dispute{},
+		"gift card":      GiftCard{},
+		"audit log":      AuditLog{},
 		"invoice number": InvoiceNumber{},
+		"stock":          Stock{},
 	}
 
 	for name, dm := range delModels {
@@ -0,0 +1,247 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Job types
+const (
+	WebhookJob               = "webhook"
+	OrderConfirmationMailJob = "mail.order_confirmation"
+	OrderReceivedMailJob     = "mail.order_received"
+)
+
+const maxConcurrentJobs = 5
+const defaultJobAttempts = 5
+const jobRetryPeriod = 30 * time.Second
+const jobLockTimeout = 5 * time.Minute
+const jobPollInterval = 5 * time.Second
+
+// Job is a unit of work that runs in the background, like delivering a
+// webhook or sending a mail. Jobs are stored, so they survive restarts, and
+// failed jobs are retried with an increasing delay until they run out of
+// attempts.
+type Job struct {
+	ID         uint64 `json:"id"`
+	InstanceID string `json:"instance_id,omitempty" sql:"index"`
+	Type       string `json:"type" sql:"index"`
+	Payload    string `json:"payload" sql:"type:text"`
+
+	Attempts    int     `json:"attempts"`
+	MaxAttempts int     `json:"max_attempts"`
+	Done        bool    `json:"done" sql:"index"`
+	Failed      bool    `json:"failed"`
+	LastError   *string `json:"last_error,omitempty" sql:"type:text"`
+
+	CreatedAt   time.Time  `json:"created_at"`
+	RunAfter    *time.Time `json:"run_after,omitempty"`
+	LockedAt    *time.Time `json:"-"`
+	LockedBy    *string    `json:"-"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+// TableName returns the database table name for the Job model.
+func (Job) TableName() string {
+	return tableName("jobs")
+}
+
+// NewJob creates a Job model with the payload serialized as JSON.
+func NewJob(jobType, instanceID string, payload interface{}) (*Job, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to serialize %s job payload", jobType)
+	}
+	return &Job{
+		InstanceID:  instanceID,
+		Type:        jobType,
+		Payload:     string(data),
+		MaxAttempts: defaultJobAttempts,
+	}, nil
+}
+
+// Decode deserializes the payload of the job into v.
+func (j *Job) Decode(v interface{}) error {
+	return json.Unmarshal([]byte(j.Payload), v)
+}
+
+// JobQueue holds jobs until they're run. Jobs are enqueued with the
+// transaction of the change they belong to, so they only run once it's
+// committed.
+type JobQueue interface {
+	Enqueue(tx *gorm.DB, job *Job) error
+}
+
+// DBJobQueue stores jobs in the jobs table, where RunJobs picks them up.
+type DBJobQueue struct{}
+
+// Enqueue stores the job.
+func (DBJobQueue) Enqueue(tx *gorm.DB, job *Job) error {
+	return tx.Create(job).Error
+}
+
+// Queue is the queue jobs are enqueued in. It defaults to the jobs table and
+// can be replaced to run jobs elsewhere.
+var Queue JobQueue = DBJobQueue{}
+
+// JobHandler runs a job. Returning an error retries the job later.
+type JobHandler func(db *gorm.DB, job *Job, log *logrus.Entry) error
+
+// Run runs the job with the handler of its type and stores the outcome.
+// Failed jobs are scheduled for a retry with a delay that doubles with every
+// attempt, jobs out of attempts are marked as failed.
+func (j *Job) Run(db *gorm.DB, handlers map[string]JobHandler, log *logrus.Entry) error {
+	log = log.WithFields(logrus.Fields{"job_id": j.ID, "job_type": j.Type})
+	j.Attempts++
+	j.LockedAt = nil
+	j.LockedBy = nil
+
+	var err error
+	if handler, ok := handlers[j.Type]; ok {
+		err = handler(db, j, log)
+	} else {
+		err = fmt.Errorf("No handler for %s jobs", j.Type)
+	}
+
+	now := time.Now()
+	if err == nil {
+		j.Done = true
+		j.LastError = nil
+		j.CompletedAt = &now
+		log.Infof("Job %v done", j.ID)
+		return db.Save(j).Error
+	}
+
+	errString := err.Error()
+	j.LastError = &errString
+	if j.Attempts >= j.MaxAttempts {
+		j.Done = true
+		j.Failed = true
+		j.CompletedAt = &now
+		log.WithError(err).Errorf("Job %v failed %v times. Giving up.", j.ID, j.Attempts)
+	} else {
+		runAfter := now.Add(jobRetryPeriod << uint(j.Attempts-1))
+		j.RunAfter = &runAfter
+		log.WithError(err).Errorf("Job %v failed - retrying at %v", j.ID, runAfter)
+	}
+	if rsp := db.Save(j); rsp.Error != nil {
+		return rsp.Error
+	}
+	return err
+}
+
+// RunJobs creates a goroutine that runs the stored jobs that are due every 5
+// seconds. Webhooks are delivered without a handler being passed.
+func RunJobs(db *gorm.DB, handlers map[string]JobHandler, log *logrus.Entry) {
+	all := map[string]JobHandler{WebhookJob: DeliverHookJob(&http.Client{})}
+	for jobType, handler := range handlers {
+		all[jobType] = handler
+	}
+	if err := EnqueuePendingHooks(db); err != nil {
+		log.WithError(err).Error("Error enqueueing pending hooks")
+	}
+
+	go func() {
+		id := uuid.NewRandom().String()
+		sem := make(chan bool, maxConcurrentJobs)
+		table := Job{}.TableName()
+		for {
+			jobs := []*Job{}
+			tx := db.Begin()
+			now := time.Now()
+
+			tx.Table(table).
+				Where("done = ? AND (locked_at IS NULL OR locked_at < ?) AND (run_after IS NULL OR run_after < ?)", false, now.Add(-jobLockTimeout), now).
+				Updates(map[string]interface{}{"locked_at": now, "locked_by": id})
+
+			tx.Where("locked_by = ?", id).Find(&jobs)
+			if rsp := tx.Commit(); rsp.Error != nil {
+				log.WithError(rsp.Error).Error("Error querying for jobs")
+			}
+
+			var wg sync.WaitGroup
+			for _, job := range jobs {
+				sem <- true
+				wg.Add(1)
+				go func(job *Job) {
+					defer wg.Done()
+					job.Run(db, all, log)
+					<-sem
+				}(job)
+			}
+
+			wg.Wait()
+			time.Sleep(jobPollInterval)
+		}
+	}()
+}
+
+type hookJobPayload struct {
+	HookID uint64 `json:"hook_id"`
+}
+
+// DeliverHookJob returns the handler of webhook jobs, which delivers the hook
+// unless it's done already.
+func DeliverHookJob(client *http.Client) JobHandler {
+	return func(db *gorm.DB, job *Job, log *logrus.Entry) error {
+		payload := &hookJobPayload{}
+		if err := job.Decode(payload); err != nil {
+			return err
+		}
+		hook := &Hook{}
+		if rsp := db.First(hook, payload.HookID); rsp.Error != nil {
+			if rsp.RecordNotFound() {
+				// the hook was deleted along with its user
+				return nil
+			}
+			return rsp.Error
+		}
+		if hook.Done {
+			return nil
+		}
+		return hook.Deliver(db, client, log)
+	}
+}
+
+// hookJob creates the job delivering a hook. It belongs to the instance of
+// the hook, so it's listed along with the other jobs of the instance.
+func hookJob(hook *Hook) *Job {
+	job, _ := NewJob(WebhookJob, hook.InstanceID, &hookJobPayload{HookID: hook.ID})
+	return job
+}
+
+// AfterCreate enqueues the delivery of the hook.
+func (h *Hook) AfterCreate(tx *gorm.DB) error {
+	return Queue.Enqueue(tx, hookJob(h))
+}
+
+// EnqueuePendingHooks enqueues the delivery of hooks that aren't done and have
+// no pending job, like the hooks stored before they were delivered as jobs.
+func EnqueuePendingHooks(db *gorm.DB) error {
+	hooks := []*Hook{}
+	if rsp := db.Where("done = ?", false).Find(&hooks); rsp.Error != nil {
+		return rsp.Error
+	}
+	for _, hook := range hooks {
+		job := hookJob(hook)
+		var pending int64
+		if rsp := db.Model(&Job{}).Where("type = ? AND payload = ? AND done = ?", WebhookJob, job.Payload, false).Count(&pending); rsp.Error != nil {
+			return rsp.Error
+		}
+		if pending > 0 {
+			continue
+		}
+		if err := Queue.Enqueue(db, job); err != nil {
+			return err
+		}
+	}
+	return nil
+}
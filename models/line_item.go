@@ -5,7 +5,6 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"strconv"
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
@@ -58,12 +57,45 @@ type LineItem struct {
 
 	*CalculationDetail `json:"calculation" gorm:"embedded;embedded_prefix:calculation_"`
 
+	// LineTaxes are the taxes of the whole quantity of the item, itemized
+	// by TaxLines. The taxes of the order are the sum of its lines' taxes.
+	LineTaxes   uint64               `json:"line_taxes"`
+	TaxLines    []calculator.TaxLine `json:"tax_lines,omitempty" sql:"-"`
+	RawTaxLines string               `json:"-" sql:"type:text"`
+
 	PriceItems []*PriceItem `json:"price_items"`
 	AddonItems []*AddonItem `json:"addons"`
 	AddonPrice uint64       `json:"addon_price"`
 
 	Quantity uint64 `json:"quantity"`
 
+	// ManualDiscount is taken off the price of the whole line by an admin,
+	// besides any coupons
+	ManualDiscount       uint64 `json:"manual_discount,omitempty"`
+	ManualDiscountReason string `json:"manual_discount_reason,omitempty"`
+
+	// Weight of a single item in grams, used to calculate shipping costs
+	Weight uint64 `json:"weight,omitempty"`
+	// Length, Width and Height of a single item in millimeters, used to
+	// estimate shipping costs with carriers
+	Length uint64 `json:"length,omitempty"`
+	Width  uint64 `json:"width,omitempty"`
+	Height uint64 `json:"height,omitempty"`
+
+	// Backordered items were preordered while out of stock and ship once
+	// they're available, which is expected at AvailableAt if known
+	Backordered bool       `json:"backordered,omitempty"`
+	AvailableAt *time.Time `json:"available_at,omitempty"`
+
+	// ShippingAddressID overrides the shipping address of the order for this
+	// item, the item is then part of the shipment to that address
+	ShippingAddressID string `json:"shipping_address_id,omitempty"`
+	ShipmentID        string `json:"shipment_id,omitempty"`
+
+	// Seller of the item on a marketplace, who the payment for it is paid
+	// out to
+	Seller string `json:"seller,omitempty"`
+
 	MetaData    map[string]interface{} `sql:"-" json:"meta"`
 	RawMetaData string                 `json:"-" sql:"type:text"`
 
@@ -78,6 +110,15 @@ func (LineItem) TableName() string {
 
 // BeforeSave database callback.
 func (i *LineItem) BeforeSave() error {
+	i.RawTaxLines = ""
+	if len(i.TaxLines) > 0 {
+		data, err := json.Marshal(i.TaxLines)
+		if err != nil {
+			return err
+		}
+		i.RawTaxLines = string(data)
+	}
+
 	if len(i.MetaData) == 0 {
 		i.RawMetaData = ""
 		return nil
@@ -92,6 +133,11 @@ func (i *LineItem) BeforeSave() error {
 
 // AfterFind database callback.
 func (i *LineItem) AfterFind() error {
+	if i.RawTaxLines != "" {
+		if err := json.Unmarshal([]byte(i.RawTaxLines), &i.TaxLines); err != nil {
+			return err
+		}
+	}
 	if i.RawMetaData != "" {
 		return json.Unmarshal([]byte(i.RawMetaData), &i.MetaData)
 	}
@@ -206,6 +252,11 @@ type LineItemMetadata struct {
 	VAT         uint64          `json:"vat"`
 	Prices      []PriceMetadata `json:"prices"`
 	Type        string          `json:"type"`
+	Weight      uint64          `json:"weight"`
+	Length      uint64          `json:"length"`
+	Width       uint64          `json:"width"`
+	Height      uint64          `json:"height"`
+	Seller      string          `json:"seller"`
 
 	Downloads []Download      `json:"downloads"`
 	Addons    []AddonMetaItem `json:"addons"`
@@ -250,6 +301,16 @@ func (i *LineItem) GetQuantity() uint64 {
 	return i.Quantity
 }
 
+// GetWeight implements the calculator.WeightedItem interface.
+func (i *LineItem) GetWeight() uint64 {
+	return i.Weight
+}
+
+// GetManualDiscount returns the manual discount of the line item.
+func (i *LineItem) GetManualDiscount() uint64 {
+	return i.ManualDiscount
+}
+
 // Process calculates the price of a LineItem.
 func (i *LineItem) Process(config *conf.Configuration, userClaims map[string]interface{}, order *Order) error {
 	meta, err := i.FetchMeta(config.SiteURL)
@@ -262,6 +323,11 @@ func (i *LineItem) Process(config *conf.Configuration, userClaims map[string]int
 	i.Description = meta.Description
 	i.VAT = meta.VAT
 	i.Type = meta.Type
+	i.Weight = meta.Weight
+	i.Length = meta.Length
+	i.Width = meta.Width
+	i.Height = meta.Height
+	i.Seller = meta.Seller
 
 	for index, addon := range i.AddonItems {
 		var metaAddon *AddonMetaItem
@@ -369,11 +435,11 @@ func (i *LineItem) calculatePrice(userClaims map[string]interface{}, prices []Pr
 	i.Price = lowestPrice.cents
 	i.PriceItems = make([]*PriceItem, len(lowestPrice.Items))
 	for index, item := range lowestPrice.Items {
-		amount, err := strconv.ParseFloat(item.Amount, 64)
+		amount, err := calculator.ParseAmount(item.Amount, currency)
 		if err != nil {
 			return err
 		}
-		i.PriceItems[index] = &PriceItem{Amount: uint64(amount * 100), Type: item.Type, VAT: item.VAT}
+		i.PriceItems[index] = &PriceItem{Amount: amount, Type: item.Type, VAT: item.VAT}
 	}
 	for _, addon := range i.AddonItems {
 		i.AddonPrice += addon.Price
@@ -382,16 +448,26 @@ func (i *LineItem) calculatePrice(userClaims map[string]interface{}, prices []Pr
 	return nil
 }
 
+// LowestPrice returns the lowest price of the product in the currency, in
+// the lowest unit of the currency, that a user with the claims can buy it for.
+func (m *LineItemMetadata) LowestPrice(userClaims map[string]interface{}, currency string) (uint64, error) {
+	price, err := determineLowestPrice(userClaims, m.Prices, currency)
+	if err != nil {
+		return 0, err
+	}
+	return price.cents, nil
+}
+
 func determineLowestPrice(userClaims map[string]interface{}, prices []PriceMetadata, currency string) (PriceMetadata, error) {
 	lowestPrice := PriceMetadata{}
 	found := false
 	for _, price := range prices {
 		if price.Currency == currency {
-			amount, err := strconv.ParseFloat(price.Amount, 64)
+			cents, err := calculator.ParseAmount(price.Amount, currency)
 			if err != nil {
 				return lowestPrice, err
 			}
-			price.cents = uint64(amount * 100)
+			price.cents = cents
 			if (!found || price.cents < lowestPrice.cents) && claims.HasClaims(userClaims, price.Claims) {
 				lowestPrice = price
 				found = true
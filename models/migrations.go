@@ -0,0 +1,147 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Migration changes the database in a way AutoMigrate can't, like backfilling
+// data, adding composite indexes or dropping columns.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      func(tx *gorm.DB) error
+}
+
+// migrations are applied in order of their version. Applied migrations must
+// never change, add a new one instead.
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "index orders by payment and fulfillment state",
+		Up: func(tx *gorm.DB) error {
+			return tx.Table(Order{}.TableName()).
+				AddIndex("idx_orders_payment_fulfillment_state", "payment_state", "fulfillment_state").Error
+		},
+	},
+	{
+		Version: 2,
+		Name:    "index jobs by due date",
+		Up: func(tx *gorm.DB) error {
+			return tx.Table(Job{}.TableName()).AddIndex("idx_jobs_done_run_after", "done", "run_after").Error
+		},
+	},
+	{
+		Version: 3,
+		Name:    "pin the schema version of hooks stored before versioning",
+		Up: func(tx *gorm.DB) error {
+			return tx.Table(Hook{}.TableName()).
+				Where("schema_version = ? OR schema_version IS NULL", 0).
+				UpdateColumn("schema_version", HookSchemaV1).Error
+		},
+	},
+	{
+		Version: 4,
+		Name:    "make order numbers unique per site",
+		Up: func(tx *gorm.DB) error {
+			return tx.Table(Order{}.TableName()).
+				AddUniqueIndex("idx_orders_site_number", "instance_id", "site_id", "number").Error
+		},
+	},
+	{
+		Version: 5,
+		Name:    "set the source of orders placed before sources",
+		Up: func(tx *gorm.DB) error {
+			return tx.Table(Order{}.TableName()).
+				Where("source = ? OR source IS NULL", "").
+				UpdateColumn("source", DefaultOrderSource).Error
+		},
+	},
+	{
+		Version: 6,
+		Name:    "index the metadata of orders placed before the data index",
+		Up:      backfillData,
+	},
+}
+
+// SchemaMigration records that a migration has been applied.
+type SchemaMigration struct {
+	Version   int64 `gorm:"primary_key;auto_increment:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// TableName returns the database table name for the SchemaMigration model.
+func (SchemaMigration) TableName() string {
+	return tableName("schema_migrations")
+}
+
+// MigrationStatus tells whether a migration has been applied and when.
+type MigrationStatus struct {
+	Version   int64
+	Name      string
+	AppliedAt *time.Time
+}
+
+// Migrate runs AutoMigrate and then applies the migrations that haven't been
+// applied yet. Every migration runs in a transaction together with recording
+// it, so running Migrate again only applies what's left.
+func Migrate(db *gorm.DB, log logrus.FieldLogger) error {
+	if err := AutoMigrate(db); err != nil {
+		return err
+	}
+
+	statuses, err := MigrationStatuses(db)
+	if err != nil {
+		return err
+	}
+	for i, status := range statuses {
+		if status.AppliedAt != nil {
+			continue
+		}
+		migration := migrations[i]
+		tx := db.Begin()
+		if err := migration.Up(tx); err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "applying migration %d: %s", migration.Version, migration.Name)
+		}
+		record := &SchemaMigration{Version: migration.Version, Name: migration.Name, AppliedAt: time.Now()}
+		if err := tx.Create(record).Error; err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "recording migration %d", migration.Version)
+		}
+		if err := tx.Commit().Error; err != nil {
+			return errors.Wrapf(err, "applying migration %d: %s", migration.Version, migration.Name)
+		}
+		log.Infof("Applied migration %d: %s", migration.Version, migration.Name)
+	}
+	return nil
+}
+
+// MigrationStatuses lists all migrations in order with the time they were
+// applied, which is nil for pending migrations.
+func MigrationStatuses(db *gorm.DB) ([]MigrationStatus, error) {
+	if err := db.AutoMigrate(SchemaMigration{}).Error; err != nil {
+		return nil, err
+	}
+	applied := []SchemaMigration{}
+	if err := db.Find(&applied).Error; err != nil {
+		return nil, err
+	}
+	appliedAt := map[int64]time.Time{}
+	for _, migration := range applied {
+		appliedAt[migration.Version] = migration.AppliedAt
+	}
+
+	statuses := make([]MigrationStatus, len(migrations))
+	for i, migration := range migrations {
+		statuses[i] = MigrationStatus{Version: migration.Version, Name: migration.Name}
+		if at, ok := appliedAt[migration.Version]; ok {
+			statuses[i].AppliedAt = &at
+		}
+	}
+	return statuses, nil
+}
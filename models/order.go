@@ -3,6 +3,7 @@ package models
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"time"
 
 	"github.com/jinzhu/gorm"
@@ -28,16 +29,52 @@ const ShippedState = "shipped"
 // FailedState is the failed state of an Order
 const FailedState = "failed"
 
+// AuthorizedState is the state of an Order whose payment has been authorized but not yet captured
+const AuthorizedState = "authorized"
+
+// PartiallyCapturedState is the state of an Order whose authorized payment has
+// been captured in part, e.g. for the shipments that already shipped
+const PartiallyCapturedState = "partially_captured"
+
+// AbandonedState is the state of an Order that expired without being paid
+const AbandonedState = "abandoned"
+
+// CancelledState is the state of an unpaid Order the customer or an admin
+// cancelled on purpose
+const CancelledState = "cancelled"
+
+// ReviewState is the state of an Order whose payment is held for manual review
+// because the fraud check flagged it
+const ReviewState = "review"
+
+// BackorderedState is the fulfillment state of an Order with preordered items
+// that aren't in stock yet
+const BackorderedState = "backordered"
+
+// ReverseChargeReason is the tax exempt reason of orders with a valid EU VAT number
+const ReverseChargeReason = "EU B2B reverse charge"
+
+// DefaultOrderSource is the source of orders that don't tell where they were
+// placed
+const DefaultOrderSource = "web"
+
 // PaymentState are the possible values for the PaymentState field
 var PaymentStates = []string{
 	PendingState,
+	AuthorizedState,
+	PartiallyCapturedState,
+	ReviewState,
 	PaidState,
 	FailedState,
+	DisputedState,
+	AbandonedState,
+	CancelledState,
 }
 
 // FulfillmentStates are the possible values for the FulfillmentState field
 var FulfillmentStates = []string{
 	PendingState,
+	BackorderedState,
 	ShippingState,
 	ShippedState,
 }
@@ -52,10 +89,27 @@ const (
 // Order model
 type Order struct {
 	InstanceID    string `json:"-" sql:"index"`
+	SiteID        string `json:"site_id,omitempty" sql:"index"`
 	ID            string `json:"id"`
 	InvoiceNumber int64  `json:"invoice_number,omitempty"`
 
-	IP string `json:"ip"`
+	// Number is the human friendly number of the order, unique per site
+	Number *string `json:"number,omitempty"`
+
+	// Version is incremented on every update through the API and used to
+	// detect conflicting concurrent updates.
+	Version uint64 `json:"version" sql:"not null;default:0"`
+
+	// StockHeld is set while the line items of the order are taken from the stock
+	StockHeld bool `json:"-"`
+
+	// IP and UserAgent of the client that placed the order
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent,omitempty" sql:"type:text"`
+
+	// Source is the channel the order was placed through, e.g. "web",
+	// "mobile" or "pos"
+	Source string `json:"source" sql:"index"`
 
 	User      *User  `json:"user,omitempty"`
 	UserID    string `json:"user_id,omitempty"`
@@ -70,18 +124,50 @@ type Order struct {
 	Currency string `json:"currency"`
 	Taxes    uint64 `json:"taxes"`
 	Shipping uint64 `json:"shipping"`
+
+	// TaxLines itemize the taxes, e.g. into a state, a county and a city tax.
+	// They add up to Taxes. Orders from before tax lines don't have any.
+	TaxLines    []calculator.TaxLine `json:"tax_lines,omitempty" sql:"-"`
+	RawTaxLines string               `json:"-" sql:"type:text"`
+
+	Tip      uint64 `json:"tip"`
 	SubTotal uint64 `json:"subtotal"`
 	Discount uint64 `json:"discount"`
 	NetTotal uint64 `json:"net_total"`
 
+	// GiftMessage is printed on the packing slip. Gift wrapped orders are
+	// charged the GiftWrapFee configured for their currency, which is added
+	// to the total like the tip.
+	GiftMessage string `json:"gift_message,omitempty" sql:"type:text"`
+	GiftWrap    bool   `json:"gift_wrap,omitempty"`
+	GiftWrapFee uint64 `json:"gift_wrap_fee,omitempty"`
+
+	// ManualDiscount is taken off the order by an admin, besides any coupons.
+	// It's shared by the line items in proportion to their price, so taxes
+	// are calculated on the discounted prices.
+	ManualDiscount       uint64 `json:"manual_discount,omitempty"`
+	ManualDiscountReason string `json:"manual_discount_reason,omitempty"`
+
 	Total uint64 `json:"total"`
 
+	// PricesIncludeTaxes tells that the taxes were taken out of the prices of
+	// the line items rather than added on top
+	PricesIncludeTaxes bool `json:"prices_include_taxes"`
+
+	SettlementCurrency string  `json:"settlement_currency,omitempty"`
+	SettlementTotal    uint64  `json:"settlement_total,omitempty"`
+	ExchangeRate       float64 `json:"exchange_rate,omitempty"`
+
 	PaymentState     string `json:"payment_state"`
 	FulfillmentState string `json:"fulfillment_state"`
 	State            string `json:"state"`
 
 	PaymentProcessor string `json:"payment_processor"`
 
+	// RiskApproved is set when an admin approved a payment held for review,
+	// the next payment for the order skips the fraud check
+	RiskApproved bool `json:"risk_approved,omitempty"`
+
 	Transactions []*Transaction `json:"transactions"`
 	Notes        []*OrderNote   `json:"notes"`
 
@@ -91,16 +177,48 @@ type Order struct {
 	BillingAddress   Address `json:"billing_address" gorm:"ForeignKey:BillingAddressID"`
 	BillingAddressID string  `json:"billing_address_id"`
 
+	// Shipments of orders whose line items ship to several addresses
+	Shipments []*Shipment `json:"shipments,omitempty"`
+
 	VATNumber string `json:"vatnumber"`
 
+	// Manual orders are created by admins and aren't subject to the
+	// configured order limits
+	Manual bool `json:"manual,omitempty"`
+
+	// Locale of the customer, e.g. "fr" or "fr-CA", used for their mails
+	Locale string `json:"locale,omitempty"`
+
+	TaxExemptionID string `json:"tax_exemption_id,omitempty"`
+
+	// TaxExempt orders are never charged taxes, e.g. B2B or non-profit orders
+	TaxExempt       bool   `json:"tax_exempt"`
+	TaxExemptReason string `json:"tax_exempt_reason,omitempty"`
+
 	MetaData    map[string]interface{} `sql:"-" json:"meta"`
 	RawMetaData string                 `json:"-" sql:"type:text"`
 
+	// PricingClaims are the claims of the order user that member prices and
+	// discounts are calculated with, so the order keeps the user's prices
+	// when an admin changes it.
+	PricingClaims    map[string]interface{} `json:"-" sql:"-"`
+	RawPricingClaims string                 `json:"-" sql:"type:text"`
+
 	CouponCode string `json:"coupon_code,omitempty"`
 
 	Coupon    *Coupon `json:"coupon,omitempty" sql:"-"`
 	RawCoupon string  `json:"-" sql:"type:text"`
 
+	// CouponCodes lists all coupons applied to the order. Coupon and
+	// CouponCode hold the first of them.
+	CouponCodes []string  `json:"coupon_codes,omitempty" sql:"-"`
+	Coupons     []*Coupon `json:"coupons,omitempty" sql:"-"`
+	RawCoupons  string    `json:"-" sql:"type:text"`
+
+	// ConfirmationResentAt is when the confirmation of the order was last
+	// sent again on request, which is limited to once in a while.
+	ConfirmationResentAt *time.Time `json:"-"`
+
 	CreatedAt time.Time  `json:"created_at" sql:"index"`
 	UpdatedAt time.Time  `json:"updated_at"`
 	DeletedAt *time.Time `json:"-" sql:"index"`
@@ -119,6 +237,12 @@ func (o *Order) AfterFind() error {
 			return err
 		}
 	}
+	if o.RawPricingClaims != "" {
+		err := json.Unmarshal([]byte(o.RawPricingClaims), &o.PricingClaims)
+		if err != nil {
+			return err
+		}
+	}
 	if o.RawCoupon != "" {
 		o.Coupon = &Coupon{}
 		err := json.Unmarshal([]byte(o.RawCoupon), &o.Coupon)
@@ -126,6 +250,25 @@ func (o *Order) AfterFind() error {
 			return err
 		}
 	}
+	if o.RawCoupons != "" {
+		err := json.Unmarshal([]byte(o.RawCoupons), &o.Coupons)
+		if err != nil {
+			return err
+		}
+	} else if o.Coupon != nil {
+		// orders from before coupon stacking only have a single coupon
+		o.Coupons = []*Coupon{o.Coupon}
+	}
+	o.CouponCodes = nil
+	for _, coupon := range o.Coupons {
+		o.CouponCodes = append(o.CouponCodes, coupon.Code)
+	}
+	if o.RawTaxLines != "" {
+		err := json.Unmarshal([]byte(o.RawTaxLines), &o.TaxLines)
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -139,6 +282,13 @@ func (o *Order) BeforeSave() error {
 		}
 		o.RawMetaData = string(data)
 	}
+	if o.PricingClaims != nil {
+		data, err := json.Marshal(o.PricingClaims)
+		if err != nil {
+			return err
+		}
+		o.RawPricingClaims = string(data)
+	}
 	if o.Coupon != nil {
 		data, err := json.Marshal(o.Coupon)
 		if err != nil {
@@ -146,10 +296,50 @@ func (o *Order) BeforeSave() error {
 		}
 		o.RawCoupon = string(data)
 	}
+	if o.Coupons != nil {
+		data, err := json.Marshal(o.Coupons)
+		if err != nil {
+			return err
+		}
+		o.RawCoupons = string(data)
+	}
+	o.RawTaxLines = ""
+	if len(o.TaxLines) > 0 {
+		data, err := json.Marshal(o.TaxLines)
+		if err != nil {
+			return err
+		}
+		o.RawTaxLines = string(data)
+	}
 
 	return nil
 }
 
+// SetCoupons replaces the coupons applied to the order.
+func (o *Order) SetCoupons(coupons []*Coupon) {
+	o.Coupons = coupons
+	o.CouponCodes = nil
+	o.Coupon = nil
+	o.CouponCode = ""
+	for _, coupon := range coupons {
+		o.CouponCodes = append(o.CouponCodes, coupon.Code)
+	}
+	if len(coupons) > 0 {
+		o.Coupon = coupons[0]
+		o.CouponCode = coupons[0].Code
+	}
+}
+
+// FreeShipping returns whether one of the applied coupons waives shipping.
+func (o *Order) FreeShipping() bool {
+	for _, coupon := range o.Coupons {
+		if coupon.FreeShipping() {
+			return true
+		}
+	}
+	return false
+}
+
 // NewOrder creates a new pending Order.
 func NewOrder(instanceID, sessionID, email, currency string) *Order {
 	order := &Order{
@@ -158,6 +348,7 @@ func NewOrder(instanceID, sessionID, email, currency string) *Order {
 		SessionID:  sessionID,
 		Email:      email,
 		Currency:   currency,
+		Source:     DefaultOrderSource,
 	}
 	order.PaymentState = PendingState
 	order.FulfillmentState = PendingState
@@ -165,20 +356,209 @@ func NewOrder(instanceID, sessionID, email, currency string) *Order {
 	return order
 }
 
-// CalculateTotal calculates the total price of an Order.
-func (o *Order) CalculateTotal(settings *calculator.Settings, claims map[string]interface{}, log logrus.FieldLogger) {
+// SetSettlement records the currency the order is charged in and the exchange
+// rate used to convert the display total into it. An empty currency clears it.
+func (o *Order) SetSettlement(currency string, rate float64) {
+	if currency == "" {
+		o.SettlementCurrency = ""
+		o.SettlementTotal = 0
+		o.ExchangeRate = 0
+		return
+	}
+	o.SettlementCurrency = currency
+	o.ExchangeRate = rate
+	o.SettlementTotal = o.SettlementAmount(o.Total)
+}
+
+// SettlementAmount converts an amount in the order currency into the
+// currency the order was charged in. The exchange rate is between the major
+// units, so the minor units are scaled by the exponents of both currencies.
+func (o *Order) SettlementAmount(amount uint64) uint64 {
+	if o.SettlementCurrency == "" {
+		return amount
+	}
+	exp := calculator.CurrencyExponent(o.SettlementCurrency) - calculator.CurrencyExponent(o.Currency)
+	return uint64(math.Round(float64(amount) * o.ExchangeRate * math.Pow10(exp)))
+}
+
+// CapturedAmount returns how much of an authorized payment has been captured
+// by partial captures, in the currency of the payment.
+func (o *Order) CapturedAmount(authorization *Transaction) uint64 {
+	var captured uint64
+	for _, t := range o.Transactions {
+		if t.AuthorizationID == authorization.ID && t.Type == ChargeTransactionType && t.Status == PaidState {
+			captured += t.Amount
+		}
+	}
+	return captured
+}
+
+// RefundedAmount returns how much of a charge has been refunded or is being
+// refunded, in the currency of the charge. Refunds recorded before refunds
+// were linked to their charge count against every charge of the order.
+func (o *Order) RefundedAmount(charge *Transaction) uint64 {
+	var refunded uint64
+	for _, t := range o.Transactions {
+		if t.Type != RefundTransactionType || (t.ChargeID != charge.ID && t.ChargeID != "") {
+			continue
+		}
+		if t.Status == PaidState || t.Status == PendingState {
+			refunded += t.Amount
+		}
+	}
+	return refunded
+}
+
+// ChargeAmount returns the amount and currency the payment provider should charge.
+func (o *Order) ChargeAmount() (uint64, string) {
+	if o.SettlementCurrency == "" {
+		return o.Total, o.Currency
+	}
+	return o.SettlementTotal, o.SettlementCurrency
+}
+
+// LineItem returns the line item of the order with the ID, or nil if there is none.
+func (o *Order) LineItem(id int64) *LineItem {
+	for _, item := range o.LineItems {
+		if item.ID == id {
+			return item
+		}
+	}
+	return nil
+}
+
+// IsTaxExempt reports whether the order is exempt from taxes, either because
+// it was marked as exempt or because the user has an exemption certificate.
+func (o *Order) IsTaxExempt() bool {
+	return o.TaxExempt || o.TaxExemptionID != ""
+}
+
+// price runs the calculator on the line items, coupons and shipping address
+// of the order.
+func (o *Order) price(settings *calculator.Settings, claims map[string]interface{}, log logrus.FieldLogger) calculator.Price {
 	items := make([]calculator.Item, len(o.LineItems))
 	for i, item := range o.LineItems {
 		items[i] = item
 	}
 
-	params := calculator.PriceParameters{o.ShippingAddress.Country, o.Currency, o.Coupon, items}
+	coupons := make([]calculator.Coupon, len(o.Coupons))
+	for i, coupon := range o.Coupons {
+		coupons[i] = coupon
+	}
+	if len(coupons) == 0 && o.Coupon != nil {
+		coupons = append(coupons, o.Coupon)
+	}
+
+	params := calculator.PriceParameters{
+		Country:   o.ShippingAddress.Country,
+		Currency:  o.Currency,
+		Coupons:   coupons,
+		Items:     items,
+		TaxExempt: o.IsTaxExempt(),
+	}
 	price := calculator.CalculatePrice(settings, claims, params, log)
+	if o.ManualDiscount == 0 || len(o.LineItems) == 0 {
+		return price
+	}
 
+	// share the manual discount of the order by what's left to pay for each
+	// line item and calculate the price again with the shares
+	bases := make([]uint64, len(o.LineItems))
+	var total uint64
+	for i, item := range o.LineItems {
+		base := item.PriceInLowestUnit() * item.Quantity
+		if discount := price.Items[i].LineDiscount; discount < base {
+			base -= discount
+		} else {
+			base = 0
+		}
+		bases[i] = base
+		total += base
+	}
+	if total == 0 {
+		return price
+	}
+	discount := o.ManualDiscount
+	if discount > total {
+		discount = total
+	}
+	shares := make([]uint64, len(o.LineItems))
+	remaining := discount
+	for i := range o.LineItems {
+		shares[i] = uint64(float64(discount) * float64(bases[i]) / float64(total))
+		if shares[i] > remaining {
+			shares[i] = remaining
+		}
+		remaining -= shares[i]
+	}
+	// the shares are rounded down, the remainder goes to the last line items
+	// that have anything left to pay
+	for i := len(o.LineItems) - 1; i >= 0 && remaining > 0; i-- {
+		extra := bases[i] - shares[i]
+		if extra > remaining {
+			extra = remaining
+		}
+		shares[i] += extra
+		remaining -= extra
+	}
+	for i, item := range o.LineItems {
+		params.Items[i] = &orderDiscountedItem{LineItem: item, share: shares[i]}
+	}
+	return calculator.CalculatePrice(settings, claims, params, log)
+}
+
+// orderDiscountedItem is a line item with its share of the manual discount
+// of the order added to its own.
+type orderDiscountedItem struct {
+	*LineItem
+	share uint64
+}
+
+func (i *orderDiscountedItem) GetManualDiscount() uint64 {
+	return i.LineItem.GetManualDiscount() + i.share
+}
+
+// CouponDiscount returns the discount of the order that isn't a manual
+// discount, like coupons and member discounts.
+func (o *Order) CouponDiscount() uint64 {
+	manual := o.ManualDiscount
+	for _, item := range o.LineItems {
+		manual += item.ManualDiscount
+	}
+	if manual >= o.Discount {
+		return 0
+	}
+	return o.Discount - manual
+}
+
+// totalFor adds the tip and the gift wrap fee to the calculated price.
+// Neither is discounted nor taxed.
+func (o *Order) totalFor(price calculator.Price) uint64 {
+	total := o.Tip + o.GiftWrapFee
+	if price.Total > 0 {
+		total += uint64(price.Total)
+	}
+	return total
+}
+
+// Recalculate recomputes the subtotal, discount, taxes, shipping and total of
+// the order and the price details of its line items from the line items,
+// coupons, tax settings and shipping address. All order totals are
+// calculated here.
+func (o *Order) Recalculate(settings *calculator.Settings, claims map[string]interface{}, log logrus.FieldLogger) {
+	price := o.price(settings, claims, log)
+
+	o.PricesIncludeTaxes = settings != nil && settings.PricesIncludeTaxes
 	o.SubTotal = price.Subtotal
 	o.Taxes = price.Taxes
+	o.TaxLines = price.TaxLines
 	o.Discount = price.Discount
 	o.NetTotal = price.NetTotal
+	o.Shipping = price.Shipping
+	o.Total = o.totalFor(price)
+	if o.SettlementCurrency != "" {
+		o.SettlementTotal = o.SettlementAmount(o.Total)
+	}
 
 	// apply price details to line items
 	for i, item := range price.Items {
@@ -189,6 +569,8 @@ func (o *Order) CalculateTotal(settings *calculator.Settings, claims map[string]
 			Taxes:    item.Taxes,
 			Total:    item.Total,
 		}
+		o.LineItems[i].LineTaxes = item.LineTaxes
+		o.LineItems[i].TaxLines = item.LineTaxLines
 
 		for _, discount := range item.DiscountItems {
 			discount := DiscountItem{
@@ -197,10 +579,12 @@ func (o *Order) CalculateTotal(settings *calculator.Settings, claims map[string]
 			o.LineItems[i].CalculationDetail.DiscountItems = append(o.LineItems[i].CalculationDetail.DiscountItems, discount)
 		}
 	}
+}
 
-	if price.Total > 0 {
-		o.Total = uint64(price.Total)
-	}
+// ExpectedTotal calculates the total of the order like Recalculate, without
+// changing the order.
+func (o *Order) ExpectedTotal(settings *calculator.Settings, claims map[string]interface{}, log logrus.FieldLogger) uint64 {
+	return o.totalFor(o.price(settings, claims, log))
 }
 
 // UpdateDownloads will refetch downloads for all line items in the order and
@@ -228,7 +612,11 @@ func (o *Order) BeforeDelete(tx *gorm.DB) error {
 	delModels := map[string]interface{}{
 		"event":       Event{},
 		"transaction": Transaction{},
+		"dispute":     Dispute{},
+		"return":      Return{},
 		"download":    Download{},
+		"shipment":    Shipment{},
+		"data":        Data{},
 	}
 	for name, dm := range delModels {
 		if result := tx.Delete(dm, "order_id = ?", o.ID); result.Error != nil {
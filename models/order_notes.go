@@ -1,14 +1,41 @@
 package models
 
-import "time"
+import (
+	"time"
 
-// OrderNote model which represent notes on a model.
+	"github.com/jinzhu/gorm"
+)
+
+// Timeline events recorded as order notes when an order changes state.
+const (
+	AuthorizedTimelineEvent = "authorized"
+	CapturedTimelineEvent   = "captured"
+	ReviewTimelineEvent     = "review"
+	ReviewedTimelineEvent   = "reviewed"
+	PaidTimelineEvent       = "paid"
+	ShippedTimelineEvent    = "shipped"
+	RefundedTimelineEvent   = "refunded"
+	DisputedTimelineEvent   = "disputed"
+	AbandonedTimelineEvent  = "abandoned"
+	CancelledTimelineEvent  = "cancelled"
+	ReopenedTimelineEvent   = "reopened"
+	ReturnedTimelineEvent   = "returned"
+)
+
+// OrderNote model which represent notes on a model. Notes written by support
+// agents have no event, timeline entries created on state transitions do.
 type OrderNote struct {
-	ID int64 `json:"-"`
+	ID int64 `json:"id"`
+
+	OrderID string `json:"order_id" sql:"index"`
+	UserID  string `json:"user_id"`
+	Author  string `json:"author"`
 
-	UserID string `json:"user_id"`
+	Text  string `json:"text" sql:"type:text"`
+	Event string `json:"event,omitempty"`
 
-	Text string `json:"text" sql:"type:text"`
+	// Internal notes are only visible to admins
+	Internal bool `json:"internal"`
 
 	CreatedAt time.Time  `json:"created_at"`
 	UpdatedAt time.Time  `json:"updated_at"`
@@ -19,3 +46,16 @@ type OrderNote struct {
 func (OrderNote) TableName() string {
 	return tableName("orders_notes")
 }
+
+// LogTimeline records a state transition of an order as a note visible to
+// the customer.
+func LogTimeline(db *gorm.DB, orderID, userID, author, event, text string) error {
+	note := &OrderNote{
+		OrderID: orderID,
+		UserID:  userID,
+		Author:  author,
+		Event:   event,
+		Text:    text,
+	}
+	return db.Create(note).Error
+}
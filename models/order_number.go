@@ -0,0 +1,86 @@
+package models
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/conf"
+)
+
+const defaultOrderNumberDigits = 6
+
+// OrderNumber is the sequence the numbers of the orders of a site are taken from.
+type OrderNumber struct {
+	InstanceID string `gorm:"primary_key"`
+	SiteID     string `gorm:"primary_key"`
+	Number     int64
+}
+
+// TableName returns the database table name for the OrderNumber model.
+func (OrderNumber) TableName() string {
+	return tableName("order_numbers")
+}
+
+// NextOrderNumber updates and returns the next order number for the site of
+// the instance. The sequence is locked until the transaction ends, so
+// concurrent orders get different numbers.
+func NextOrderNumber(tx *gorm.DB, instanceID, siteID string) (int64, error) {
+	number := OrderNumber{}
+	if instanceID == "" {
+		instanceID = "global-instance"
+	}
+	if siteID == "" {
+		// blank primary keys aren't stored
+		siteID = "default-site"
+	}
+
+	if result := tx.Where(OrderNumber{InstanceID: instanceID, SiteID: siteID}).Attrs(OrderNumber{Number: 0}).FirstOrCreate(&number); result.Error != nil {
+		return 0, result.Error
+	}
+
+	numberTable := tx.NewScope(OrderNumber{}).QuotedTableName()
+	if result := tx.Raw("select number from "+numberTable+" where instance_id = ? and site_id = ? for update", instanceID, siteID).Scan(&number); result.Error != nil {
+		if strings.Contains(result.Error.Error(), "syntax error") {
+			log.Println("This DB driver doesn't support select for update, hoping for the best...")
+		} else {
+			return 0, result.Error
+		}
+	}
+	if result := tx.Model(number).Update("number", gorm.Expr("number + 1")); result.Error != nil {
+		return 0, result.Error
+	}
+
+	return number.Number + 1, nil
+}
+
+// FormatOrderNumber formats a number of the order sequence as configured,
+// e.g. ORD-2024-000123.
+func FormatOrderNumber(config *conf.Configuration, number int64, createdAt time.Time) string {
+	digits := config.Orders.NumberDigits
+	if digits <= 0 {
+		digits = defaultOrderNumberDigits
+	}
+	formatted := config.Orders.NumberPrefix
+	if config.Orders.NumberYear {
+		formatted += fmt.Sprintf("%d-", createdAt.Year())
+	}
+	return formatted + fmt.Sprintf("%0*d", digits, number)
+}
+
+// AssignNumber gives the order the next number of its site.
+func (o *Order) AssignNumber(tx *gorm.DB, config *conf.Configuration) error {
+	number, err := NextOrderNumber(tx, o.InstanceID, o.SiteID)
+	if err != nil {
+		return err
+	}
+	createdAt := o.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+	formatted := FormatOrderNumber(config, number, createdAt)
+	o.Number = &formatted
+	return nil
+}
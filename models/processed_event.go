@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ProcessedEvent records a webhook event of a payment provider that has been
+// applied. Providers deliver events at least once, so an event that's sent
+// again is acknowledged without applying it twice.
+type ProcessedEvent struct {
+	ID         int64  `json:"-"`
+	InstanceID string `json:"-" sql:"unique_index:idx_processed_event"`
+	Provider   string `json:"provider" sql:"unique_index:idx_processed_event"`
+	EventID    string `json:"event_id" sql:"unique_index:idx_processed_event"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName returns the database table name for the ProcessedEvent model.
+func (ProcessedEvent) TableName() string {
+	return tableName("processed_events")
+}
+
+// EventProcessed reports whether the event of the payment provider has been
+// applied already.
+func EventProcessed(tx *gorm.DB, instanceID, provider, eventID string) (bool, error) {
+	count := 0
+	rsp := tx.Model(&ProcessedEvent{}).
+		Where("instance_id = ? AND provider = ? AND event_id = ?", instanceID, provider, eventID).
+		Count(&count)
+	if rsp.Error != nil {
+		return false, rsp.Error
+	}
+	return count > 0, nil
+}
@@ -0,0 +1,138 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+)
+
+// Reservation holds a quantity of a SKU for an unpaid order. The quantity is
+// taken from the stock when the order is created, so other orders can't buy
+// it during checkout. It becomes a purchase when the order is paid and goes
+// back to the stock when it expires before the payment started or the order
+// is cancelled.
+type Reservation struct {
+	ID         int64     `json:"id"`
+	InstanceID string    `json:"-" sql:"index"`
+	OrderID    string    `json:"order_id" sql:"index"`
+	Sku        string    `json:"sku"`
+	Quantity   uint64    `json:"quantity"`
+	ExpiresAt  time.Time `json:"expires_at" sql:"index"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// TableName returns the database table name for the Reservation model.
+func (Reservation) TableName() string {
+	return tableName("stock_reservations")
+}
+
+// ReserveStock takes a quantity of a SKU from the stock for an order until
+// expiresAt. It returns false without reserving anything if the SKU isn't
+// tracked or doesn't have enough stock left.
+func ReserveStock(tx *gorm.DB, instanceID, orderID, sku string, quantity uint64, expiresAt time.Time) (bool, error) {
+	// check and take the stock in one statement so concurrent checkouts
+	// can't reserve the same items
+	rsp := tx.Model(&Stock{}).Where("instance_id = ? AND sku = ? AND quantity >= ?", instanceID, sku, quantity).
+		UpdateColumn("quantity", gorm.Expr("quantity - ?", quantity))
+	if rsp.Error != nil {
+		return false, rsp.Error
+	}
+	if rsp.RowsAffected == 0 {
+		return false, nil
+	}
+
+	reservation := &Reservation{
+		InstanceID: instanceID,
+		OrderID:    orderID,
+		Sku:        sku,
+		Quantity:   quantity,
+		ExpiresAt:  expiresAt,
+	}
+	return true, tx.Create(reservation).Error
+}
+
+// ReleaseReservations returns the stock reserved for an order.
+func ReleaseReservations(tx *gorm.DB, orderID string) error {
+	reservations := []*Reservation{}
+	if rsp := tx.Where("order_id = ?", orderID).Find(&reservations); rsp.Error != nil {
+		return rsp.Error
+	}
+	for _, reservation := range reservations {
+		if err := releaseReservation(tx, reservation); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConvertReservations turns the reservations of a paid order into purchases.
+// It returns the reserved quantity of each SKU, which doesn't have to be
+// taken from the stock again.
+func ConvertReservations(tx *gorm.DB, orderID string) (map[string]uint64, error) {
+	reservations := []*Reservation{}
+	if rsp := tx.Where("order_id = ?", orderID).Find(&reservations); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+
+	reserved := map[string]uint64{}
+	for _, reservation := range reservations {
+		ok, err := deleteReservation(tx, reservation)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			reserved[reservation.Sku] += reservation.Quantity
+		}
+	}
+	return reserved, nil
+}
+
+// ExpireReservations returns the stock of the expired reservations of an
+// instance. It returns the number of released reservations. Reservations of
+// orders that are being paid, i.e. with a pending charge or a payment that is
+// authorized or held for review, don't expire until the order is paid or
+// cancelled.
+func ExpireReservations(db *gorm.DB, instanceID string, log logrus.FieldLogger) (int, error) {
+	unpaidStates := []string{PendingState, FailedState, AbandonedState, CancelledState}
+	reservations := []*Reservation{}
+	rsp := db.Where("instance_id = ? AND expires_at < ?", instanceID, time.Now()).
+		Where("order_id NOT IN (SELECT id FROM "+Order{}.TableName()+" WHERE payment_state NOT IN (?))", unpaidStates).
+		Where("order_id NOT IN (SELECT order_id FROM "+Transaction{}.TableName()+" WHERE type = ? AND status = ?)", ChargeTransactionType, PendingState).
+		Find(&reservations)
+	if rsp.Error != nil {
+		return 0, rsp.Error
+	}
+
+	released := 0
+	for _, reservation := range reservations {
+		tx := db.Begin()
+		if err := releaseReservation(tx, reservation); err != nil {
+			tx.Rollback()
+			log.WithError(err).WithField("order_id", reservation.OrderID).Error("Failed to release reservation")
+			continue
+		}
+		if err := tx.Commit().Error; err != nil {
+			log.WithError(err).WithField("order_id", reservation.OrderID).Error("Failed to release reservation")
+			continue
+		}
+		released++
+	}
+	return released, nil
+}
+
+func releaseReservation(tx *gorm.DB, reservation *Reservation) error {
+	ok, err := deleteReservation(tx, reservation)
+	if err != nil || !ok {
+		return err
+	}
+	return IncrementStock(tx, reservation.InstanceID, reservation.Sku, reservation.Quantity)
+}
+
+// deleteReservation reports whether the reservation was deleted by this call,
+// so a reservation that is released and converted at the same time only
+// changes the stock once.
+func deleteReservation(tx *gorm.DB, reservation *Reservation) (bool, error) {
+	rsp := tx.Where("id = ?", reservation.ID).Delete(&Reservation{})
+	return rsp.RowsAffected == 1, rsp.Error
+}
@@ -0,0 +1,69 @@
+package models
+
+import (
+	"time"
+)
+
+// Return states
+const (
+	ReturnRequestedState = "requested"
+	ReturnApprovedState  = "approved"
+	ReturnRejectedState  = "rejected"
+	ReturnReceivedState  = "received"
+	ReturnRefundedState  = "refunded"
+)
+
+// ReturnStateMachine defines how the status of a return changes. Admins
+// approve or reject requested returns and mark approved ones as received,
+// which refunds them.
+var ReturnStateMachine = &StateMachine{transitions: []stateTransition{
+	{ReturnRequestedState, ReturnApprovedState, []StateActor{ActorAdmin}},
+	{ReturnRequestedState, ReturnRejectedState, []StateActor{ActorAdmin}},
+	{ReturnApprovedState, ReturnReceivedState, []StateActor{ActorAdmin}},
+	{ReturnReceivedState, ReturnRefundedState, []StateActor{ActorAdmin, ActorSystem}},
+}}
+
+// Return is a request by a customer to send back some of the items of a
+// paid order.
+type Return struct {
+	InstanceID string `json:"-"`
+	SiteID     string `json:"site_id,omitempty" sql:"index"`
+	ID         string `json:"id"`
+	OrderID    string `json:"order_id" sql:"index"`
+	UserID     string `json:"user_id,omitempty"`
+
+	Reason string        `json:"reason" sql:"type:text"`
+	Status string        `json:"status" sql:"index"`
+	Items  []*ReturnItem `json:"items"`
+
+	// RefundID is the refund transaction made when the items were received
+	RefundID string `json:"refund_id,omitempty"`
+
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"-"`
+}
+
+// TableName returns the database table name for the Return model.
+func (Return) TableName() string {
+	return tableName("returns")
+}
+
+// ReturnItem is a quantity of a line item that is sent back.
+type ReturnItem struct {
+	ID         int64  `json:"-"`
+	ReturnID   string `json:"-" sql:"index"`
+	LineItemID int64  `json:"line_item_id"`
+	Quantity   uint64 `json:"quantity"`
+}
+
+// TableName returns the database table name for the ReturnItem model.
+func (ReturnItem) TableName() string {
+	return tableName("return_items")
+}
+
+// Active reports whether the items of the return are still returned, which
+// is the case unless it was rejected.
+func (r *Return) Active() bool {
+	return r.Status != ReturnRejectedState
+}
@@ -0,0 +1,121 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+)
+
+// Shipment is the part of an Order that ships to one address. Orders only
+// have shipments when their line items ship to more than one address.
+type Shipment struct {
+	ID      string `json:"id"`
+	OrderID string `json:"-" sql:"index"`
+
+	ShippingAddress   Address `json:"shipping_address" gorm:"ForeignKey:ShippingAddressID"`
+	ShippingAddressID string  `json:"shipping_address_id"`
+
+	FulfillmentState string `json:"fulfillment_state"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName returns the database table name for the Shipment model.
+func (Shipment) TableName() string {
+	return tableName("shipments")
+}
+
+// shippingAddressID returns the ID of the address a line item ships to,
+// which is the order's shipping address unless the item overrides it.
+func (o *Order) shippingAddressID(item *LineItem) string {
+	if item.ShippingAddressID != "" {
+		return item.ShippingAddressID
+	}
+	if o.ShippingAddress.ID != "" {
+		return o.ShippingAddress.ID
+	}
+	return o.ShippingAddressID
+}
+
+// ShipmentItems returns the line items of the order that ship with a shipment.
+func (o *Order) ShipmentItems(shipment *Shipment) []*LineItem {
+	items := []*LineItem{}
+	for _, item := range o.LineItems {
+		if o.shippingAddressID(item) == shipment.ShippingAddressID {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// SyncShipments groups the line items of the order into one shipment per
+// shipping address. Shipments to addresses that are still used keep their
+// fulfillment state, the others are removed. Orders that ship to a single
+// address have no shipments.
+func (o *Order) SyncShipments(tx *gorm.DB) error {
+	existing := map[string]*Shipment{}
+	for _, shipment := range o.Shipments {
+		existing[shipment.ShippingAddressID] = shipment
+	}
+
+	addressIDs := []string{}
+	items := map[string][]*LineItem{}
+	for _, item := range o.LineItems {
+		id := o.shippingAddressID(item)
+		if _, ok := items[id]; !ok {
+			addressIDs = append(addressIDs, id)
+		}
+		items[id] = append(items[id], item)
+	}
+	if len(addressIDs) < 2 {
+		addressIDs = nil
+	}
+
+	shipments := []*Shipment{}
+	for _, addressID := range addressIDs {
+		shipment, ok := existing[addressID]
+		if ok {
+			delete(existing, addressID)
+		} else {
+			shipment = &Shipment{
+				ID:                uuid.NewRandom().String(),
+				OrderID:           o.ID,
+				ShippingAddressID: addressID,
+				FulfillmentState:  PendingState,
+			}
+			if err := tx.Create(shipment).Error; err != nil {
+				return err
+			}
+			if err := tx.First(&shipment.ShippingAddress, "id = ?", addressID).Error; err != nil {
+				return err
+			}
+		}
+		shipments = append(shipments, shipment)
+		for _, item := range items[addressID] {
+			item.ShipmentID = shipment.ID
+		}
+	}
+	if len(shipments) == 0 {
+		for _, item := range o.LineItems {
+			item.ShipmentID = ""
+		}
+	}
+
+	for _, shipment := range existing {
+		if err := tx.Delete(shipment).Error; err != nil {
+			return err
+		}
+	}
+	for _, item := range o.LineItems {
+		if item.ID == 0 {
+			continue
+		}
+		if err := tx.Model(item).UpdateColumn("shipment_id", item.ShipmentID).Error; err != nil {
+			return err
+		}
+	}
+	o.Shipments = shipments
+	return nil
+}
@@ -0,0 +1,98 @@
+package models
+
+// StateActor is who changes the state of an order.
+type StateActor string
+
+const (
+	// ActorCustomer is the customer, e.g. when paying for an order.
+	ActorCustomer StateActor = "customer"
+	// ActorAdmin is a shop admin.
+	ActorAdmin StateActor = "admin"
+	// ActorSystem covers payment providers and background jobs.
+	ActorSystem StateActor = "system"
+)
+
+type stateTransition struct {
+	from   string
+	to     string
+	actors []StateActor
+}
+
+// StateMachine defines the allowed transitions between the values of one of
+// the states of an order, and who may make them.
+type StateMachine struct {
+	transitions []stateTransition
+}
+
+// Allowed reports whether the actor may change the state from one value to
+// another. Keeping the current value is always allowed.
+func (m *StateMachine) Allowed(from, to string, actor StateActor) bool {
+	if from == to {
+		return true
+	}
+	for _, t := range m.transitions {
+		if t.from == from && t.to == to && hasActor(t.actors, actor) {
+			return true
+		}
+	}
+	return false
+}
+
+// Next returns the values the actor may change the state to from its current value.
+func (m *StateMachine) Next(from string, actor StateActor) []string {
+	next := []string{}
+	for _, t := range m.transitions {
+		if t.from == from && hasActor(t.actors, actor) {
+			next = append(next, t.to)
+		}
+	}
+	return next
+}
+
+func hasActor(actors []StateActor, actor StateActor) bool {
+	for _, a := range actors {
+		if a == actor {
+			return true
+		}
+	}
+	return false
+}
+
+// PaymentStateMachine defines how the payment state of an order changes.
+// Payments move pending orders forward, admins can only capture authorized
+// payments in full or in parts, approve or decline payments held for review
+// and reopen abandoned orders. Customers and admins cancel unpaid orders.
+var PaymentStateMachine = &StateMachine{transitions: []stateTransition{
+	{PendingState, AuthorizedState, []StateActor{ActorCustomer, ActorSystem}},
+	{PendingState, PaidState, []StateActor{ActorCustomer, ActorSystem}},
+	{PendingState, ReviewState, []StateActor{ActorSystem}},
+	{PendingState, FailedState, []StateActor{ActorSystem}},
+	{PendingState, AbandonedState, []StateActor{ActorSystem}},
+	{FailedState, AuthorizedState, []StateActor{ActorCustomer, ActorSystem}},
+	{FailedState, ReviewState, []StateActor{ActorSystem}},
+	{FailedState, PaidState, []StateActor{ActorCustomer, ActorSystem}},
+	{ReviewState, PendingState, []StateActor{ActorAdmin}},
+	{ReviewState, FailedState, []StateActor{ActorAdmin}},
+	{AuthorizedState, PaidState, []StateActor{ActorAdmin, ActorSystem}},
+	{AuthorizedState, PartiallyCapturedState, []StateActor{ActorAdmin, ActorSystem}},
+	{PartiallyCapturedState, PaidState, []StateActor{ActorAdmin, ActorSystem}},
+	{AuthorizedState, FailedState, []StateActor{ActorSystem}},
+	{PaidState, DisputedState, []StateActor{ActorSystem}},
+	{AbandonedState, PendingState, []StateActor{ActorAdmin}},
+	{PendingState, CancelledState, []StateActor{ActorCustomer, ActorAdmin}},
+	{FailedState, CancelledState, []StateActor{ActorCustomer, ActorAdmin}},
+	{AbandonedState, CancelledState, []StateActor{ActorCustomer, ActorAdmin}},
+}}
+
+// FulfillmentStateMachine defines how the fulfillment state of an order
+// changes. Shipped orders can't be changed anymore.
+var FulfillmentStateMachine = &StateMachine{transitions: []stateTransition{
+	{PendingState, BackorderedState, []StateActor{ActorAdmin, ActorSystem}},
+	{PendingState, ShippingState, []StateActor{ActorAdmin}},
+	{PendingState, ShippedState, []StateActor{ActorAdmin}},
+	{BackorderedState, PendingState, []StateActor{ActorAdmin}},
+	{BackorderedState, ShippingState, []StateActor{ActorAdmin}},
+	{BackorderedState, ShippedState, []StateActor{ActorAdmin}},
+	{ShippingState, PendingState, []StateActor{ActorAdmin}},
+	{ShippingState, ShippedState, []StateActor{ActorAdmin}},
+}}
@@ -0,0 +1,91 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Stock is the remaining quantity of a SKU. Only SKUs with a stock record
+// have their inventory tracked.
+type Stock struct {
+	ID         int64  `json:"-"`
+	InstanceID string `json:"-" sql:"unique_index:idx_stock_sku"`
+	Sku        string `json:"sku" sql:"unique_index:idx_stock_sku"`
+	Quantity   int64  `json:"quantity"`
+
+	// Preorder SKUs can be ordered when they're out of stock and are
+	// backordered until they're expected to be available at AvailableAt.
+	Preorder    bool       `json:"preorder"`
+	AvailableAt *time.Time `json:"available_at,omitempty"`
+
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName returns the database table name for the Stock model.
+func (Stock) TableName() string {
+	return tableName("stock")
+}
+
+// FindStock returns the stock of a SKU, or nil if the SKU isn't tracked.
+func FindStock(tx *gorm.DB, instanceID, sku string) (*Stock, error) {
+	stock := &Stock{}
+	rsp := tx.Where("instance_id = ? AND sku = ?", instanceID, sku).First(stock)
+	if rsp.RecordNotFound() {
+		return nil, nil
+	}
+	if rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	return stock, nil
+}
+
+// IncrementStock returns a quantity to the stock of a SKU. Untracked SKUs are
+// ignored.
+func IncrementStock(tx *gorm.DB, instanceID, sku string, quantity uint64) error {
+	return tx.Model(&Stock{}).Where("instance_id = ? AND sku = ?", instanceID, sku).
+		UpdateColumn("quantity", gorm.Expr("quantity + ?", quantity)).Error
+}
+
+// ReleaseStock returns the line items of an order that holds stock to the
+// stock, e.g. when it's cancelled or abandoned.
+func ReleaseStock(tx *gorm.DB, order *Order) error {
+	if !order.StockHeld {
+		return nil
+	}
+	for _, item := range order.LineItems {
+		if err := IncrementStock(tx, order.InstanceID, item.Sku, item.Quantity); err != nil {
+			return err
+		}
+	}
+	order.StockHeld = false
+	return tx.Model(order).UpdateColumn("stock_held", false).Error
+}
+
+// DecrementStock removes a purchased quantity from the stock of a SKU. It
+// returns the stock before and after the decrement, or nil if the SKU isn't
+// tracked.
+func DecrementStock(tx *gorm.DB, instanceID, sku string, quantity uint64) (before *Stock, after *Stock, err error) {
+	before = &Stock{}
+	rsp := tx.Where("instance_id = ? AND sku = ?", instanceID, sku).First(before)
+	if rsp.RecordNotFound() {
+		return nil, nil, nil
+	}
+	if rsp.Error != nil {
+		return nil, nil, rsp.Error
+	}
+
+	// decrement in the database so concurrent purchases don't overwrite each other
+	rsp = tx.Model(&Stock{}).Where("instance_id = ? AND sku = ?", instanceID, sku).
+		UpdateColumn("quantity", gorm.Expr("quantity - ?", quantity))
+	if rsp.Error != nil {
+		return nil, nil, rsp.Error
+	}
+
+	after = &Stock{}
+	if rsp := tx.Where("instance_id = ? AND sku = ?", instanceID, sku).First(after); rsp.Error != nil {
+		return nil, nil, rsp.Error
+	}
+	before.Quantity = after.Quantity + int64(quantity)
+	return before, after, nil
+}
@@ -0,0 +1,65 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// TaxExemption is a resale or exemption certificate that exempts a user's
+// orders from taxes in a jurisdiction.
+type TaxExemption struct {
+	InstanceID string `json:"-"`
+	ID         string `json:"id"`
+
+	User   *User  `json:"-"`
+	UserID string `json:"user_id"`
+
+	Jurisdiction string `json:"jurisdiction"`
+	Certificate  string `json:"certificate"`
+
+	ValidFrom  *time.Time `json:"valid_from,omitempty"`
+	ValidUntil *time.Time `json:"valid_until,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName returns the database table name for the TaxExemption model.
+func (TaxExemption) TableName() string {
+	return tableName("tax_exemptions")
+}
+
+// Active returns whether the exemption applies at the given time.
+func (e *TaxExemption) Active(at time.Time) bool {
+	if e.RevokedAt != nil {
+		return false
+	}
+	if e.ValidFrom != nil && at.Before(*e.ValidFrom) {
+		return false
+	}
+	if e.ValidUntil != nil && !at.Before(*e.ValidUntil) {
+		return false
+	}
+	return true
+}
+
+// ActiveTaxExemption finds an exemption for the user that applies to the
+// jurisdiction at the given time. It returns nil if there is none.
+func ActiveTaxExemption(db *gorm.DB, userID, jurisdiction string, at time.Time) (*TaxExemption, error) {
+	if userID == "" || jurisdiction == "" {
+		return nil, nil
+	}
+
+	exemptions := []*TaxExemption{}
+	if rsp := db.Where("user_id = ? AND revoked_at IS NULL", userID).Order("created_at asc").Find(&exemptions); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	for _, e := range exemptions {
+		if strings.EqualFold(e.Jurisdiction, jurisdiction) && e.Active(at) {
+			return e, nil
+		}
+	}
+	return nil, nil
+}
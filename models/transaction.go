@@ -13,15 +13,24 @@ const ChargeTransactionType = "charge"
 // RefundTransactionType is the refund transaction type.
 const RefundTransactionType = "refund"
 
+// ShippingRefundComponent refunds the shipping costs of an order.
+const ShippingRefundComponent = "shipping"
+
+// LineItemRefundComponent refunds a single line item of an order.
+const LineItemRefundComponent = "line_item"
+
 // Transaction is an transaction with a payment provider
 type Transaction struct {
 	InstanceID    string `json:"-"`
+	SiteID        string `json:"site_id,omitempty" sql:"index"`
 	ID            string `json:"id"`
 	Order         *Order `json:"-"`
 	OrderID       string `json:"order_id"`
 	InvoiceNumber int64  `json:"invoice_number"`
 
 	ProcessorID string `json:"processor_id"`
+	// GiftCardID is set for payments with and refunds to a gift card
+	GiftCardID string `json:"gift_card_id,omitempty" sql:"index"`
 
 	User   *User  `json:"-"`
 	UserID string `json:"user_id,omitempty"`
@@ -35,6 +44,29 @@ type Transaction struct {
 	Status string `json:"status"`
 	Type   string `json:"type"`
 
+	RefundComponent string `json:"refund_component,omitempty"`
+	LineItemID      int64  `json:"line_item_id,omitempty"`
+	// ChargeID is set on refunds to the charge they refund
+	ChargeID string `json:"charge_id,omitempty" sql:"index"`
+
+	// AuthorizationExpiresAt is when an authorized payment can't be captured anymore
+	AuthorizationExpiresAt *time.Time `json:"authorization_expires_at,omitempty"`
+	// AuthorizedAmount is the amount of an authorized payment, which the sum
+	// of its captures can't exceed.
+	AuthorizedAmount uint64 `json:"authorized_amount,omitempty"`
+	// AuthorizationID is set on partial captures to the authorized payment
+	// they were captured from.
+	AuthorizationID string `json:"authorization_id,omitempty" sql:"index"`
+
+	// RiskScore and RiskReason are the outcome of the fraud check of a
+	// charge, from 0 to 1. Charges that weren't checked have no score.
+	RiskScore  *float64 `json:"risk_score,omitempty"`
+	RiskReason string   `json:"risk_reason,omitempty" sql:"type:text"`
+
+	// IP and UserAgent of the client that made the payment
+	IP        string `json:"ip,omitempty"`
+	UserAgent string `json:"user_agent,omitempty" sql:"type:text"`
+
 	CreatedAt time.Time  `json:"created_at"`
 	DeletedAt *time.Time `json:"-"`
 
@@ -46,10 +78,26 @@ func (Transaction) TableName() string {
 	return tableName("transactions")
 }
 
+// AuthorizationExpired reports whether the transaction is an authorized
+// payment that can't be captured anymore.
+func (t *Transaction) AuthorizationExpired(now time.Time) bool {
+	return t.Status == AuthorizedState && t.AuthorizationExpiresAt != nil && now.After(*t.AuthorizationExpiresAt)
+}
+
+// Authorized returns the amount of an authorized payment. Payments authorized
+// before the amount was recorded were authorized for their amount.
+func (t *Transaction) Authorized() uint64 {
+	if t.AuthorizedAmount > 0 {
+		return t.AuthorizedAmount
+	}
+	return t.Amount
+}
+
 // NewTransaction returns a new transaction for an order
 func NewTransaction(order *Order) *Transaction {
 	return &Transaction{
 		InstanceID: order.InstanceID,
+		SiteID:     order.SiteID,
 		ID:         uuid.NewRandom().String(),
 		Order:      order,
 		OrderID:    order.ID,
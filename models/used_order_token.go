@@ -0,0 +1,31 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// UsedOrderToken records the ID of a magic link token that has been redeemed
+// to claim an order. Used tokens don't grant access to the order anymore.
+type UsedOrderToken struct {
+	ID      string `json:"id"`
+	OrderID string `json:"order_id" sql:"index"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName returns the database table name for the UsedOrderToken model.
+func (UsedOrderToken) TableName() string {
+	return tableName("used_order_tokens")
+}
+
+// OrderTokenUsed reports whether the magic link token with the ID has been
+// redeemed already.
+func OrderTokenUsed(tx *gorm.DB, id string) (bool, error) {
+	count := 0
+	if rsp := tx.Model(&UsedOrderToken{}).Where("id = ?", id).Count(&count); rsp.Error != nil {
+		return false, rsp.Error
+	}
+	return count > 0, nil
+}
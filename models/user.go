@@ -13,10 +13,23 @@ import (
 // User model
 type User struct {
 	InstanceID string `json:"-"`
+	SiteID     string `json:"site_id,omitempty" sql:"index"`
 	ID         string `json:"id"`
 	Email      string `json:"email"`
 	Name       string `json:"name"`
 
+	// Locale the user prefers, it is used for new orders that don't have one
+	Locale string `json:"locale,omitempty"`
+
+	// DefaultBillingAddressID and DefaultShippingAddressID are the addresses
+	// new orders of the user use when they don't specify their own
+	DefaultBillingAddressID  string `json:"default_billing_address_id,omitempty"`
+	DefaultShippingAddressID string `json:"default_shipping_address_id,omitempty"`
+
+	// StripeCustomerID references the Stripe customer holding the saved
+	// payment methods of the user.
+	StripeCustomerID string `json:"stripe_customer_id,omitempty"`
+
 	CreatedAt time.Time  `json:"created_at"`
 	UpdatedAt time.Time  `json:"updated_at"`
 	DeletedAt *time.Time `json:"-"`
@@ -119,3 +132,125 @@ func (u *User) BeforeDelete(tx *gorm.DB) error {
 	}
 	return nil
 }
+
+// OpenOrderCount counts the orders of the user that are paid or authorized
+// but haven't been shipped yet.
+func (u *User) OpenOrderCount(db *gorm.DB) (int64, error) {
+	var count int64
+	err := db.Model(&Order{}).
+		Where("user_id = ? AND payment_state IN (?) AND fulfillment_state != ?", u.ID, []string{PaidState, AuthorizedState, PartiallyCapturedState}, ShippedState).
+		Count(&count).Error
+	return count, err
+}
+
+// Anonymize removes the personal data of the user, their orders and their
+// addresses and deletes the user. Unlike deleting the user it keeps the
+// orders and transactions, so they are still there for accounting. The
+// country and state of addresses are kept since taxes depend on them. Notes
+// and audit logs of the user and their orders keep their events and actions
+// without the text and snapshots, which may quote personal data.
+func (u *User) Anonymize(tx *gorm.DB) error {
+	orderIDs := []string{}
+	if result := tx.Model(&Order{}).Where("user_id = ?", u.ID).Pluck("id", &orderIDs); result.Error != nil {
+		return errors.Wrap(result.Error, "Error finding order records")
+	}
+
+	if result := tx.Model(&Order{}).Where("user_id = ?", u.ID).UpdateColumns(map[string]interface{}{
+		"email":              "",
+		"ip":                 "",
+		"user_agent":         "",
+		"vat_number":         "",
+		"raw_meta_data":      "",
+		"raw_pricing_claims": "",
+	}); result.Error != nil {
+		return errors.Wrap(result.Error, "Error anonymizing order records")
+	}
+
+	transactions := tx.Model(&Transaction{}).Where("user_id = ?", u.ID)
+	if len(orderIDs) > 0 {
+		transactions = tx.Model(&Transaction{}).Where("user_id = ? OR order_id IN (?)", u.ID, orderIDs)
+	}
+	transactionIDs := []string{}
+	if result := transactions.Pluck("id", &transactionIDs); result.Error != nil {
+		return errors.Wrap(result.Error, "Error finding transaction records")
+	}
+	if result := transactions.UpdateColumns(map[string]interface{}{
+		"ip":         "",
+		"user_agent": "",
+	}); result.Error != nil {
+		return errors.Wrap(result.Error, "Error anonymizing transaction records")
+	}
+
+	if len(orderIDs) > 0 {
+		if result := tx.Model(&LineItem{}).Where("order_id IN (?)", orderIDs).UpdateColumn("raw_meta_data", ""); result.Error != nil {
+			return errors.Wrap(result.Error, "Error anonymizing line item records")
+		}
+		if result := tx.Delete(Data{}, "order_id IN (?)", orderIDs); result.Error != nil {
+			return errors.Wrap(result.Error, "Error deleting data records")
+		}
+	}
+
+	notes := tx.Model(&OrderNote{}).Where("user_id = ?", u.ID)
+	if len(orderIDs) > 0 {
+		notes = tx.Model(&OrderNote{}).Where("user_id = ? OR order_id IN (?)", u.ID, orderIDs)
+	}
+	if result := notes.UpdateColumn("text", ""); result.Error != nil {
+		return errors.Wrap(result.Error, "Error anonymizing order note records")
+	}
+	if result := tx.Model(&OrderNote{}).Where("user_id = ?", u.ID).UpdateColumn("author", ""); result.Error != nil {
+		return errors.Wrap(result.Error, "Error anonymizing order note records")
+	}
+
+	targetIDs := append(append([]string{u.ID}, orderIDs...), transactionIDs...)
+	if result := tx.Model(&AuditLog{}).Where("target_id IN (?)", targetIDs).UpdateColumns(map[string]interface{}{
+		"raw_before": "",
+		"raw_after":  "",
+	}); result.Error != nil {
+		return errors.Wrap(result.Error, "Error anonymizing audit log records")
+	}
+	if result := tx.Model(&AuditLog{}).Where("actor_id = ?", u.ID).UpdateColumns(map[string]interface{}{
+		"actor_email": "",
+		"ip":          "",
+	}); result.Error != nil {
+		return errors.Wrap(result.Error, "Error anonymizing audit log records")
+	}
+
+	if result := tx.Model(&Address{}).Where("user_id = ?", u.ID).UpdateColumns(map[string]interface{}{
+		"name":       "",
+		"first_name": "",
+		"last_name":  "",
+		"company":    "",
+		"address1":   "",
+		"address2":   "",
+		"city":       "",
+		"zip":        "",
+	}); result.Error != nil {
+		return errors.Wrap(result.Error, "Error anonymizing address records")
+	}
+
+	events := tx.Model(&Event{}).Where("user_id = ?", u.ID)
+	if len(orderIDs) > 0 {
+		events = tx.Model(&Event{}).Where("user_id = ? OR order_id IN (?)", u.ID, orderIDs)
+	}
+	if result := events.UpdateColumn("ip", ""); result.Error != nil {
+		return errors.Wrap(result.Error, "Error anonymizing event records")
+	}
+
+	if result := tx.Delete(Hook{}, "user_id = ?", u.ID); result.Error != nil {
+		return errors.Wrap(result.Error, "Error deleting hook records")
+	}
+
+	// Updating the columns directly skips BeforeDelete, which would delete
+	// the orders of the user.
+	now := time.Now()
+	if result := tx.Model(u).UpdateColumns(map[string]interface{}{
+		"email":              "",
+		"name":               "",
+		"locale":             "",
+		"stripe_customer_id": "",
+		"deleted_at":         now,
+	}); result.Error != nil {
+		return errors.Wrap(result.Error, "Error anonymizing user")
+	}
+	return nil
+}
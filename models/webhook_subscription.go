@@ -0,0 +1,94 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+
+	"github.com/netlify/gocommerce/conf"
+)
+
+// HookTypes are the event types webhooks are sent for.
+var HookTypes = []string{"order", "payment", "update", "refund", "low_stock", "abandoned", "cancelled", "restocked", "user_updated", "user_deleted"}
+
+// WebhookSubscription registers a URL to receive the webhooks of an event
+// type, in addition to the URL configured for the type.
+type WebhookSubscription struct {
+	InstanceID string `json:"-" sql:"index"`
+	ID         string `json:"id"`
+
+	EventType string `json:"event_type"`
+	URL       string `json:"url"`
+	// Secret signs the hooks sent to the subscription, the configured
+	// webhook secret is used if it is empty.
+	Secret  string `json:"-"`
+	Enabled bool   `json:"enabled"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName returns the database table name for the WebhookSubscription model.
+func (WebhookSubscription) TableName() string {
+	return tableName("webhook_subscriptions")
+}
+
+// NewWebhookSubscription creates an enabled subscription to an event type.
+func NewWebhookSubscription(instanceID, eventType, url, secret string) *WebhookSubscription {
+	return &WebhookSubscription{
+		InstanceID: instanceID,
+		ID:         uuid.NewRandom().String(),
+		EventType:  eventType,
+		URL:        url,
+		Secret:     secret,
+		Enabled:    true,
+	}
+}
+
+// IsHookType returns whether webhooks are sent for the event type.
+func IsHookType(eventType string) bool {
+	for _, t := range HookTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// RunHooks queues a hook of the type for the configured URL, if there is
+// one, and for every enabled subscription to the type in the instance. No
+// hook is queued if any of them can't be created.
+func RunHooks(tx *gorm.DB, config *conf.Configuration, instanceID, hookType, hookURL, userID string, payload interface{}) error {
+	subscriptions := []*WebhookSubscription{}
+	if rsp := tx.Where("instance_id = ? AND event_type = ? AND enabled = ?", instanceID, hookType, true).Order("created_at asc").Find(&subscriptions); rsp.Error != nil {
+		return rsp.Error
+	}
+
+	hooks := []*Hook{}
+	if hookURL != "" {
+		hook, err := NewHook(hookType, config, hookURL, userID, payload)
+		if err != nil {
+			return err
+		}
+		hooks = append(hooks, hook)
+	}
+	for _, s := range subscriptions {
+		hook, err := NewHook(hookType, config, s.URL, userID, payload)
+		if err != nil {
+			return err
+		}
+		if s.Secret != "" {
+			hook.Secret = s.Secret
+		}
+		hooks = append(hooks, hook)
+	}
+
+	for _, hook := range hooks {
+		hook.InstanceID = instanceID
+		if rsp := tx.Create(hook); rsp.Error != nil {
+			return rsp.Error
+		}
+	}
+	return nil
+}
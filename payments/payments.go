@@ -3,6 +3,7 @@ package payments
 import (
 	"context"
 	"net/http"
+	"time"
 
 	"github.com/netlify/gocommerce/models"
 	"github.com/sirupsen/logrus"
@@ -16,21 +17,129 @@ const (
 )
 
 // Provider represents a payment provider that can optionally charge, refund,
-// preauthorize payments.
+// preauthorize and capture payments.
 type Provider interface {
 	Name() string
 	NewCharger(ctx context.Context, r *http.Request, log logrus.FieldLogger) (Charger, error)
 	NewRefunder(ctx context.Context, r *http.Request, log logrus.FieldLogger) (Refunder, error)
 	NewPreauthorizer(ctx context.Context, r *http.Request, log logrus.FieldLogger) (Preauthorizer, error)
 	NewConfirmer(ctx context.Context, r *http.Request, log logrus.FieldLogger) (Confirmer, error)
+	NewCapturer(ctx context.Context, r *http.Request, log logrus.FieldLogger) (Capturer, error)
 }
 
 // Charger wraps the Charge method which creates new payments with the provider.
-type Charger func(amount uint64, currency string, order *models.Order, invoiceNumber int64) (string, error)
+// The splits of marketplace orders are paid out to the sellers.
+type Charger func(amount uint64, currency string, order *models.Order, invoiceNumber int64, splits []Split) (string, error)
+
+// Split is the part of a payment that's paid out to the account of a
+// marketplace seller with the provider. The platform keeps the rest of the
+// payment as its fee.
+type Split struct {
+	Account string
+	Amount  uint64
+}
 
 // Refunder wraps the Refund method which refunds payments with the provider.
 type Refunder func(transactionID string, amount uint64, currency string) (string, error)
 
+// Capturer wraps the Capture method which captures an authorized payment
+// with the provider. The amount may be less than what was authorized.
+type Capturer func(transactionID string, amount uint64, currency string) (string, error)
+
+// PartialCapturer is implemented by providers that can capture an authorized
+// payment in several parts, e.g. when the shipments of an order ship on
+// different days.
+type PartialCapturer interface {
+	// NewPartialCapturer returns a Capturer that keeps the rest of the
+	// authorization open for later captures. The Capturer returned by
+	// NewCapturer makes the final capture, which releases the rest.
+	NewPartialCapturer(ctx context.Context, r *http.Request, log logrus.FieldLogger) (Capturer, error)
+}
+
+// Authorizer is implemented by providers that can authorize a payment
+// without capturing it, so it can be captured later, e.g. when the order ships.
+type Authorizer interface {
+	// NewAuthorizer returns a Charger that only authorizes the amount.
+	NewAuthorizer(ctx context.Context, r *http.Request, log logrus.FieldLogger) (Charger, error)
+	// AuthorizationTTL is how long an authorized payment can be captured.
+	AuthorizationTTL() time.Duration
+}
+
+// PaymentMethod is a payment method saved with the provider so returning
+// customers can pay without entering their details again.
+type PaymentMethod struct {
+	ID       string `json:"id"`
+	Brand    string `json:"brand"`
+	Last4    string `json:"last4"`
+	ExpMonth uint64 `json:"exp_month"`
+	ExpYear  uint64 `json:"exp_year"`
+}
+
+// PaymentMethodStore is implemented by providers that can save payment
+// methods with a customer record and charge them later.
+type PaymentMethodStore interface {
+	// SavePaymentMethod attaches a payment method to a customer, creating
+	// the customer first if customerID is empty. It returns the customer ID.
+	SavePaymentMethod(customerID, email, paymentMethodID string) (string, *PaymentMethod, error)
+	ListPaymentMethods(customerID string) ([]*PaymentMethod, error)
+	NewSavedMethodCharger(customerID, paymentMethodID string) Charger
+}
+
+// StatusChecker is implemented by providers that can look up the current
+// state of a payment, to reconcile transactions that didn't get finalized.
+type StatusChecker interface {
+	// PaymentStatus returns the state of a charge or refund, using the
+	// transaction states of the models package.
+	PaymentStatus(transactionID, transactionType string) (string, error)
+}
+
+// Payment event types sent to webhook receivers
+const (
+	ChargeSucceededEvent = "charge_succeeded"
+	ChargeRefundedEvent  = "charge_refunded"
+	DisputeCreatedEvent  = "dispute_created"
+)
+
+// PaymentEvent is a change to a payment reported by the provider.
+type PaymentEvent struct {
+	// ID is the provider's ID of the event, which stays the same when the
+	// event is delivered more than once
+	ID   string
+	Type string
+	// ChargeIDs are the provider IDs the charge may be stored under
+	ChargeIDs []string
+	Refunds   []*RefundEvent
+	Dispute   *DisputeEvent
+}
+
+// RefundEvent is a refund of a charge reported by the provider.
+type RefundEvent struct {
+	ID       string
+	Amount   uint64
+	Currency string
+	// Status uses the transaction states of the models package
+	Status string
+}
+
+// DisputeEvent is a dispute of a charge reported by the provider.
+type DisputeEvent struct {
+	ID       string
+	Reason   string
+	Amount   uint64
+	Currency string
+	Status   string
+	DueBy    *time.Time
+}
+
+// WebhookReceiver is implemented by providers that send webhooks about
+// changes to payments.
+type WebhookReceiver interface {
+	// ParseWebhook verifies the signature of a webhook, which the provider
+	// sends in the headers, and returns the payment event it contains, or nil
+	// if the event isn't relevant.
+	ParseWebhook(payload []byte, header http.Header, secret string) (*PaymentEvent, error)
+}
+
 // Preauthorizer wraps the Preauthorize method which pre-authorizes a payment
 // with the provider.
 type Preauthorizer func(amount uint64, currency string, description string) (*PreauthorizationResult, error)
@@ -40,8 +149,10 @@ type PreauthorizationResult struct {
 	ID string `json:"id"`
 }
 
-// Confirmer wraps a confirm method used for checking two-step payments in a synchronous flow
-type Confirmer func(paymentID string) error
+// Confirmer wraps a confirm method used for checking two-step payments in a synchronous flow.
+// It returns the state of the payment, using the transaction states of the models package:
+// payments that were only authorized end up in the authorized state.
+type Confirmer func(paymentID string) (string, error)
 
 // PaymentPendingError is returned when the payment provider requests additional action
 // e.g. 2-step authorization through 3D secure
@@ -77,3 +188,18 @@ func NewPaymentConfirmFailError(msg string) error {
 func (p *PaymentConfirmFailError) Error() string {
 	return p.message
 }
+
+// ProviderUnavailableError is returned when the payment provider can't be
+// reached, so the payment wasn't made and can be tried again later.
+type ProviderUnavailableError struct {
+	message string
+}
+
+// NewProviderUnavailableError creates an error to use when the payment provider is down
+func NewProviderUnavailableError(msg string) error {
+	return &ProviderUnavailableError{message: msg}
+}
+
+func (p *ProviderUnavailableError) Error() string {
+	return p.message
+}
@@ -5,15 +5,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/netlify/gocommerce/models"
 	"github.com/pariz/gountries"
 	"github.com/sirupsen/logrus"
 
 	paypalsdk "github.com/netlify/PayPal-Go-SDK"
+	"github.com/netlify/gocommerce/calculator"
 	"github.com/netlify/gocommerce/conf"
 	gcontext "github.com/netlify/gocommerce/context"
 	"github.com/netlify/gocommerce/payments"
@@ -91,7 +92,10 @@ func (p *paypalPaymentProvider) NewCharger(ctx context.Context, r *http.Request,
 		return nil, errors.New("Payments requires a paypal_payment_id and paypal_user_id pair")
 	}
 
-	return func(amount uint64, currency string, order *models.Order, invoiceNumber int64) (string, error) {
+	return func(amount uint64, currency string, order *models.Order, invoiceNumber int64, splits []payments.Split) (string, error) {
+		if len(splits) > 0 {
+			return "", errors.New("PayPal can't split payments between sellers")
+		}
 		return p.charge(log, bp.PaypalID, bp.PaypalUserID, amount, currency, order, invoiceNumber)
 	}, nil
 }
@@ -102,7 +106,7 @@ func prepareItemsFromOrder(order *models.Order) []paypalsdk.Item {
 		item := paypalsdk.Item{
 			Quantity:    int(lineItem.GetQuantity()),
 			Name:        lineItem.Title,
-			Price:       formatAmount(lineItem.PriceInLowestUnit()),
+			Price:       calculator.FormatAmount(lineItem.PriceInLowestUnit(), order.Currency),
 			Currency:    order.Currency,
 			SKU:         lineItem.ProductSku(),
 			Description: lineItem.Description,
@@ -170,7 +174,7 @@ func (p *paypalPaymentProvider) charge(log logrus.FieldLogger, paymentID string,
 		return "", fmt.Errorf("No amount in this transaction %v", payment.Transactions[0])
 	}
 
-	transactionValue := fmt.Sprintf("%.2f", float64(amount)/100)
+	transactionValue := calculator.FormatAmount(amount, currency)
 
 	if transactionValue != payment.Transactions[0].Amount.Total || payment.Transactions[0].Amount.Currency != currency {
 		return "", fmt.Errorf("The Amount in the transaction doesn't match the amount for the order: %v", payment.Transactions[0].Amount)
@@ -199,7 +203,7 @@ func (p *paypalPaymentProvider) NewRefunder(ctx context.Context, r *http.Request
 
 func (p *paypalPaymentProvider) refund(transactionID string, amount uint64, currency string) (string, error) {
 	amt := &paypalsdk.Amount{
-		Total:    formatAmount(amount),
+		Total:    calculator.FormatAmount(amount, currency),
 		Currency: currency,
 	}
 	ref, err := p.client.RefundSale(transactionID, amt)
@@ -232,7 +236,7 @@ func (p *paypalPaymentProvider) preauthorize(config *conf.Configuration, amount
 		ExperienceProfileID: profile.ID,
 		Transactions: []paypalsdk.Transaction{paypalsdk.Transaction{
 			Amount: &paypalsdk.Amount{
-				Total:    formatAmount(amount),
+				Total:    calculator.FormatAmount(amount, currency),
 				Currency: currency,
 			},
 			Description: description,
@@ -275,10 +279,174 @@ func (p *paypalPaymentProvider) getExperience() (*paypalsdk.WebProfile, error) {
 	return profile, nil
 }
 
-func formatAmount(amount uint64) string {
-	return strconv.FormatFloat(float64(amount)/100, 'f', 2, 64)
-}
-
 func (p *paypalPaymentProvider) NewConfirmer(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Confirmer, error) {
 	return nil, errors.New("Paypal does not provide manual 2-step confirmation")
 }
+
+func (p *paypalPaymentProvider) NewCapturer(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Capturer, error) {
+	return nil, errors.New("PayPal payments are captured when they are executed")
+}
+
+type webhookEvent struct {
+	ID           string          `json:"id"`
+	EventType    string          `json:"event_type"`
+	ResourceType string          `json:"resource_type"`
+	Resource     json.RawMessage `json:"resource"`
+}
+
+type verifyWebhookRequest struct {
+	AuthAlgo         string          `json:"auth_algo"`
+	CertURL          string          `json:"cert_url"`
+	TransmissionID   string          `json:"transmission_id"`
+	TransmissionSig  string          `json:"transmission_sig"`
+	TransmissionTime string          `json:"transmission_time"`
+	WebhookID        string          `json:"webhook_id"`
+	WebhookEvent     json.RawMessage `json:"webhook_event"`
+}
+
+type verifyWebhookResponse struct {
+	VerificationStatus string `json:"verification_status"`
+}
+
+type refundResource struct {
+	ID            string            `json:"id"`
+	State         string            `json:"state"`
+	SaleID        string            `json:"sale_id"`
+	ParentPayment string            `json:"parent_payment"`
+	Amount        *paypalsdk.Amount `json:"amount"`
+}
+
+type disputeAmount struct {
+	CurrencyCode string `json:"currency_code"`
+	Value        string `json:"value"`
+}
+
+type disputeResource struct {
+	DisputeID             string         `json:"dispute_id"`
+	Reason                string         `json:"reason"`
+	Status                string         `json:"status"`
+	DisputeAmount         *disputeAmount `json:"dispute_amount"`
+	SellerResponseDueDate *time.Time     `json:"seller_response_due_date"`
+	DisputedTransactions  []struct {
+		SellerTransactionID string `json:"seller_transaction_id"`
+	} `json:"disputed_transactions"`
+}
+
+// ParseWebhook verifies the webhook with PayPal, which checks the signature
+// sent in the PAYPAL-* headers against the ID of the registered webhook.
+func (p *paypalPaymentProvider) ParseWebhook(payload []byte, header http.Header, webhookID string) (*payments.PaymentEvent, error) {
+	event := &webhookEvent{}
+	if err := json.Unmarshal(payload, event); err != nil {
+		return nil, errors.Wrap(err, "Failed to parse webhook event")
+	}
+	if err := p.verifyWebhook(payload, header, webhookID); err != nil {
+		return nil, err
+	}
+
+	switch event.EventType {
+	case "PAYMENT.SALE.COMPLETED":
+		sale := &paypalsdk.Sale{}
+		if err := json.Unmarshal(event.Resource, sale); err != nil {
+			return nil, errors.Wrap(err, "Failed to parse sale")
+		}
+		return &payments.PaymentEvent{
+			ID:        event.ID,
+			Type:      payments.ChargeSucceededEvent,
+			ChargeIDs: chargeIDs(sale.ID, sale.ParentPayment),
+		}, nil
+	case "PAYMENT.SALE.REFUNDED":
+		refund := &refundResource{}
+		if err := json.Unmarshal(event.Resource, refund); err != nil {
+			return nil, errors.Wrap(err, "Failed to parse refund")
+		}
+		ref := &payments.RefundEvent{ID: refund.ID, Status: refundState(refund.State)}
+		if refund.Amount != nil {
+			amount, err := calculator.ParseAmount(strings.TrimPrefix(refund.Amount.Total, "-"), refund.Amount.Currency)
+			if err != nil {
+				return nil, errors.Wrap(err, "Failed to parse refund amount")
+			}
+			ref.Amount = amount
+			ref.Currency = refund.Amount.Currency
+		}
+		return &payments.PaymentEvent{
+			ID:        event.ID,
+			Type:      payments.ChargeRefundedEvent,
+			ChargeIDs: chargeIDs(refund.SaleID, refund.ParentPayment),
+			Refunds:   []*payments.RefundEvent{ref},
+		}, nil
+	case "CUSTOMER.DISPUTE.CREATED":
+		dispute := &disputeResource{}
+		if err := json.Unmarshal(event.Resource, dispute); err != nil {
+			return nil, errors.Wrap(err, "Failed to parse dispute")
+		}
+		pe := &payments.PaymentEvent{
+			ID:   event.ID,
+			Type: payments.DisputeCreatedEvent,
+			Dispute: &payments.DisputeEvent{
+				ID:     dispute.DisputeID,
+				Reason: dispute.Reason,
+				Status: dispute.Status,
+				DueBy:  dispute.SellerResponseDueDate,
+			},
+		}
+		if dispute.DisputeAmount != nil {
+			amount, err := calculator.ParseAmount(dispute.DisputeAmount.Value, dispute.DisputeAmount.CurrencyCode)
+			if err != nil {
+				return nil, errors.Wrap(err, "Failed to parse dispute amount")
+			}
+			pe.Dispute.Amount = amount
+			pe.Dispute.Currency = dispute.DisputeAmount.CurrencyCode
+		}
+		for _, disputed := range dispute.DisputedTransactions {
+			// disputes only reference the sale, but charges are stored under
+			// the ID of the payment the sale belongs to
+			pe.ChargeIDs = append(pe.ChargeIDs, disputed.SellerTransactionID)
+			if sale, err := p.client.GetSale(disputed.SellerTransactionID); err == nil && sale.ParentPayment != "" {
+				pe.ChargeIDs = append(pe.ChargeIDs, sale.ParentPayment)
+			}
+		}
+		return pe, nil
+	}
+	return nil, nil
+}
+
+func (p *paypalPaymentProvider) verifyWebhook(payload []byte, header http.Header, webhookID string) error {
+	req, err := p.client.NewRequest(http.MethodPost, p.client.APIBase+"/v1/notifications/verify-webhook-signature", &verifyWebhookRequest{
+		AuthAlgo:         header.Get("PAYPAL-AUTH-ALGO"),
+		CertURL:          header.Get("PAYPAL-CERT-URL"),
+		TransmissionID:   header.Get("PAYPAL-TRANSMISSION-ID"),
+		TransmissionSig:  header.Get("PAYPAL-TRANSMISSION-SIG"),
+		TransmissionTime: header.Get("PAYPAL-TRANSMISSION-TIME"),
+		WebhookID:        webhookID,
+		WebhookEvent:     json.RawMessage(payload),
+	})
+	if err != nil {
+		return err
+	}
+	rsp := &verifyWebhookResponse{}
+	if err := p.client.SendWithAuth(req, rsp); err != nil {
+		return errors.Wrap(err, "Failed to verify webhook signature")
+	}
+	if rsp.VerificationStatus != "SUCCESS" {
+		return fmt.Errorf("Webhook signature verification failed: %s", rsp.VerificationStatus)
+	}
+	return nil
+}
+
+func chargeIDs(saleID, paymentID string) []string {
+	ids := []string{saleID}
+	if paymentID != "" {
+		ids = append(ids, paymentID)
+	}
+	return ids
+}
+
+func refundState(state string) string {
+	switch state {
+	case "completed":
+		return models.PaidState
+	case "failed", "cancelled":
+		return models.FailedState
+	}
+	return models.PendingState
+}
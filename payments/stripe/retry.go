@@ -0,0 +1,120 @@
+package stripe
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/netlify/gocommerce/payments"
+	stripe "github.com/stripe/stripe-go"
+)
+
+const (
+	defaultMaxRetries       = 2
+	defaultRetryBackoff     = 500 * time.Millisecond
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+// breakers are shared by all providers using the same Stripe account, since
+// providers are created for every request.
+var breakers = struct {
+	sync.Mutex
+	byKey map[string]*circuitBreaker
+}{byKey: map[string]*circuitBreaker{}}
+
+func breakerFor(secretKey string) *circuitBreaker {
+	breakers.Lock()
+	defer breakers.Unlock()
+	b, ok := breakers.byKey[secretKey]
+	if !ok {
+		b = &circuitBreaker{}
+		breakers.byKey[secretKey] = b
+	}
+	return b
+}
+
+// circuitBreaker stops calling Stripe for a while after too many calls in a
+// row failed with transient errors. Once the cooldown passed a single call is
+// let through to check whether Stripe recovered.
+type circuitBreaker struct {
+	sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func (b *circuitBreaker) allow(now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+	if b.openUntil.IsZero() {
+		return true
+	}
+	if now.Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *circuitBreaker) record(failed bool, threshold int, cooldown time.Duration, now time.Time) {
+	b.Lock()
+	defer b.Unlock()
+	b.probing = false
+	if !failed {
+		b.failures = 0
+		b.openUntil = time.Time{}
+		return
+	}
+	b.failures++
+	if b.failures >= threshold {
+		b.openUntil = now.Add(cooldown)
+	}
+}
+
+// isRetryable reports whether a failed Stripe call may succeed when it is
+// retried. Card errors, e.g. declined cards, are never retried.
+func isRetryable(err error) bool {
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	stripeErr, ok := err.(*stripe.Error)
+	if !ok {
+		return false
+	}
+	switch stripeErr.Type {
+	case stripe.ErrorTypeCard, stripe.ErrorTypeInvalidRequest, stripe.ErrorTypeAuthentication, stripe.ErrorTypePermission:
+		return stripeErr.Code == stripe.ErrorCodeIdempotencyKeyInUse
+	case stripe.ErrorTypeAPIConnection, stripe.ErrorTypeRateLimit:
+		return true
+	}
+	return stripeErr.HTTPStatusCode >= http.StatusInternalServerError || stripeErr.HTTPStatusCode == http.StatusTooManyRequests
+}
+
+// call runs a Stripe API call with bounded retries on transient errors. The
+// call must use the same idempotency key for every attempt, so a retried
+// request that reached Stripe the first time isn't executed twice.
+func (s *stripePaymentProvider) call(fn func() error) error {
+	if !s.breaker.allow(time.Now()) {
+		return payments.NewProviderUnavailableError("Stripe is currently unavailable, please try again later")
+	}
+
+	var err error
+	for attempt := 0; attempt <= s.maxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(s.retryBackoff * time.Duration(1<<uint(attempt-1)))
+		}
+		err = fn()
+		if err == nil || !isRetryable(err) {
+			break
+		}
+	}
+
+	transient := err != nil && isRetryable(err)
+	s.breaker.record(transient, s.breakerThreshold, s.breakerCooldown, time.Now())
+	if transient {
+		return payments.NewProviderUnavailableError("Stripe is currently unavailable: " + err.Error())
+	}
+	return err
+}
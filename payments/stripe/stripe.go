@@ -4,6 +4,9 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"encoding/json"
 
@@ -13,10 +16,17 @@ import (
 	"github.com/sirupsen/logrus"
 	stripe "github.com/stripe/stripe-go"
 	"github.com/stripe/stripe-go/client"
+	"github.com/stripe/stripe-go/webhook"
 )
 
 type stripePaymentProvider struct {
 	client *client.API
+
+	breaker          *circuitBreaker
+	maxRetries       int
+	retryBackoff     time.Duration
+	breakerThreshold int
+	breakerCooldown  time.Duration
 }
 
 type stripeBodyParams struct {
@@ -27,6 +37,16 @@ type stripeBodyParams struct {
 // Config contains the Stripe-specific configuration for payment providers.
 type Config struct {
 	SecretKey string `mapstructure:"secret_key" json:"secret_key"`
+
+	// MaxRetries is how often charges and refunds are retried after a
+	// transient error, waiting RetryBackoff before the first retry and
+	// doubling the wait after each one.
+	MaxRetries   *int          `mapstructure:"max_retries" json:"max_retries"`
+	RetryBackoff time.Duration `mapstructure:"retry_backoff" json:"retry_backoff"`
+	// After BreakerThreshold calls in a row failed, calls fail right away
+	// for BreakerCooldown.
+	BreakerThreshold int           `mapstructure:"breaker_threshold" json:"breaker_threshold"`
+	BreakerCooldown  time.Duration `mapstructure:"breaker_cooldown" json:"breaker_cooldown"`
 }
 
 // NewPaymentProvider creates a new Stripe payment provider using the provided configuration.
@@ -36,7 +56,24 @@ func NewPaymentProvider(config Config) (payments.Provider, error) {
 	}
 
 	s := stripePaymentProvider{
-		client: &client.API{},
+		client:           &client.API{},
+		breaker:          breakerFor(config.SecretKey),
+		maxRetries:       defaultMaxRetries,
+		retryBackoff:     defaultRetryBackoff,
+		breakerThreshold: defaultBreakerThreshold,
+		breakerCooldown:  defaultBreakerCooldown,
+	}
+	if config.MaxRetries != nil {
+		s.maxRetries = *config.MaxRetries
+	}
+	if config.RetryBackoff > 0 {
+		s.retryBackoff = config.RetryBackoff
+	}
+	if config.BreakerThreshold > 0 {
+		s.breakerThreshold = config.BreakerThreshold
+	}
+	if config.BreakerCooldown > 0 {
+		s.breakerCooldown = config.BreakerCooldown
 	}
 	s.client.Init(config.SecretKey, nil)
 	return &s, nil
@@ -46,25 +83,98 @@ func (s *stripePaymentProvider) Name() string {
 	return payments.StripeProvider
 }
 
-func (s *stripePaymentProvider) NewCharger(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Charger, error) {
+// paymentMethodParam reads the Stripe payment method from the request body.
+func paymentMethodParam(r *http.Request) (string, error) {
 	var bp stripeBodyParams
 	bod, err := r.GetBody()
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+	if err := json.NewDecoder(bod).Decode(&bp); err != nil {
+		return "", err
 	}
-	err = json.NewDecoder(bod).Decode(&bp)
+	if bp.StripePaymentMethodID == "" {
+		return "", errors.New("Stripe requires a stripe_payment_method_id for creating a payment intent")
+	}
+	return bp.StripePaymentMethodID, nil
+}
+
+func (s *stripePaymentProvider) NewCharger(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Charger, error) {
+	paymentMethodID, err := paymentMethodParam(r)
 	if err != nil {
 		return nil, err
 	}
+	return func(amount uint64, currency string, order *models.Order, invoiceNumber int64, splits []payments.Split) (string, error) {
+		return s.chargePaymentIntent(paymentMethodID, "", amount, currency, order, invoiceNumber, splits, true)
+	}, nil
+}
 
-	if bp.StripePaymentMethodID == "" {
-		return nil, errors.New("Stripe requires a stripe_payment_method_id for creating a payment intent")
+// authorizationTTL is how long Stripe holds an uncaptured payment.
+const authorizationTTL = 7 * 24 * time.Hour
+
+func (s *stripePaymentProvider) NewAuthorizer(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Charger, error) {
+	paymentMethodID, err := paymentMethodParam(r)
+	if err != nil {
+		return nil, err
 	}
-	return func(amount uint64, currency string, order *models.Order, invoiceNumber int64) (string, error) {
-		return s.chargePaymentIntent(bp.StripePaymentMethodID, amount, currency, order, invoiceNumber)
+	return func(amount uint64, currency string, order *models.Order, invoiceNumber int64, splits []payments.Split) (string, error) {
+		return s.chargePaymentIntent(paymentMethodID, "", amount, currency, order, invoiceNumber, splits, false)
 	}, nil
 }
 
+func (s *stripePaymentProvider) AuthorizationTTL() time.Duration {
+	return authorizationTTL
+}
+
+func (s *stripePaymentProvider) NewSavedMethodCharger(customerID, paymentMethodID string) payments.Charger {
+	return func(amount uint64, currency string, order *models.Order, invoiceNumber int64, splits []payments.Split) (string, error) {
+		return s.chargePaymentIntent(paymentMethodID, customerID, amount, currency, order, invoiceNumber, splits, true)
+	}
+}
+
+func (s *stripePaymentProvider) SavePaymentMethod(customerID, email, paymentMethodID string) (string, *payments.PaymentMethod, error) {
+	if customerID == "" {
+		customer, err := s.client.Customers.New(&stripe.CustomerParams{
+			Email: stripe.String(email),
+		})
+		if err != nil {
+			return "", nil, err
+		}
+		customerID = customer.ID
+	}
+
+	pm, err := s.client.PaymentMethods.Attach(paymentMethodID, &stripe.PaymentMethodAttachParams{
+		Customer: stripe.String(customerID),
+	})
+	if err != nil {
+		return customerID, nil, err
+	}
+	return customerID, toPaymentMethod(pm), nil
+}
+
+func (s *stripePaymentProvider) ListPaymentMethods(customerID string) ([]*payments.PaymentMethod, error) {
+	methods := []*payments.PaymentMethod{}
+	i := s.client.PaymentMethods.List(&stripe.PaymentMethodListParams{
+		Customer: stripe.String(customerID),
+		Type:     stripe.String(string(stripe.PaymentMethodTypeCard)),
+	})
+	for i.Next() {
+		methods = append(methods, toPaymentMethod(i.PaymentMethod()))
+	}
+	return methods, i.Err()
+}
+
+func toPaymentMethod(pm *stripe.PaymentMethod) *payments.PaymentMethod {
+	method := &payments.PaymentMethod{ID: pm.ID}
+	if pm.Card != nil {
+		method.Brand = string(pm.Card.Brand)
+		method.Last4 = pm.Card.Last4
+		method.ExpMonth = pm.Card.ExpMonth
+		method.ExpYear = pm.Card.ExpYear
+	}
+	return method
+}
+
 func prepareShippingAddress(addr models.Address) *stripe.ShippingDetailsParams {
 	return &stripe.ShippingDetailsParams{
 		Address: &stripe.AddressParams{
@@ -79,7 +189,14 @@ func prepareShippingAddress(addr models.Address) *stripe.ShippingDetailsParams {
 	}
 }
 
-func (s *stripePaymentProvider) chargePaymentIntent(paymentMethodID string, amount uint64, currency string, order *models.Order, invoiceNumber int64) (string, error) {
+// chargePaymentIntent creates and confirms a payment intent. Unless capture
+// is set the payment is only authorized and has to be captured later.
+//
+// The payment of an order from a single seller is a destination charge, the
+// seller's connected account receives it less the application fee. Payments
+// of orders from several sellers are transferred to their accounts once the
+// payment succeeded, see transferSplits.
+func (s *stripePaymentProvider) chargePaymentIntent(paymentMethodID, customerID string, amount uint64, currency string, order *models.Order, invoiceNumber int64, splits []payments.Split, capture bool) (string, error) {
 	params := &stripe.PaymentIntentParams{
 		PaymentMethod: stripe.String(paymentMethodID),
 		Amount:        stripe.Int64(int64(amount)),
@@ -97,7 +214,31 @@ func (s *stripePaymentProvider) chargePaymentIntent(paymentMethodID string, amou
 		)),
 		Confirm: stripe.Bool(true),
 	}
-	intent, err := s.client.PaymentIntents.New(params)
+	if customerID != "" {
+		params.Customer = stripe.String(customerID)
+	}
+	if !capture {
+		params.CaptureMethod = stripe.String(string(stripe.PaymentIntentCaptureMethodManual))
+		// allows capturing the payment in parts where the card supports it
+		params.AddExtra("payment_method_options[card][request_multicapture]", "if_available")
+	}
+	if len(splits) == 1 {
+		params.TransferData = &stripe.PaymentIntentTransferDataParams{
+			Destination: stripe.String(splits[0].Account),
+		}
+		params.ApplicationFeeAmount = stripe.Int64(int64(amount - splits[0].Amount))
+	} else if len(splits) > 0 {
+		params.TransferGroup = stripe.String(order.ID)
+		for _, split := range splits {
+			params.Metadata[transferMetadataPrefix+split.Account] = fmt.Sprintf("%d", split.Amount)
+		}
+	}
+	params.SetIdempotencyKey(stripe.NewIdempotencyKey())
+	var intent *stripe.PaymentIntent
+	err := s.call(func() (err error) {
+		intent, err = s.client.PaymentIntents.New(params)
+		return err
+	})
 	if err != nil {
 		return "", err
 	}
@@ -109,27 +250,180 @@ func (s *stripePaymentProvider) chargePaymentIntent(paymentMethodID string, amou
 	}
 
 	if intent.Status == stripe.PaymentIntentStatusSucceeded {
+		s.transferSplits(intent)
+		return intent.ID, nil
+	}
+	if !capture && intent.Status == stripe.PaymentIntentStatusRequiresCapture {
 		return intent.ID, nil
 	}
 
 	return "", fmt.Errorf("Invalid PaymentIntent status: %s", intent.Status)
 }
 
+// transferMetadataPrefix prefixes the connected accounts in the metadata of
+// payment intents whose payment is transferred to several sellers, the
+// values are the amounts.
+const transferMetadataPrefix = "transfer_"
+
+// transferSplits transfers the payment of a succeeded payment intent to the
+// connected accounts of the sellers in its metadata. The amounts are reduced
+// in proportion if less than the authorized amount was captured. Transfers
+// are idempotent, so they're only made once for each charge and account.
+// Failed transfers are logged, the payment itself succeeded and transfers
+// can be made from the Stripe dashboard.
+func (s *stripePaymentProvider) transferSplits(intent *stripe.PaymentIntent) {
+	if intent.Charges == nil || len(intent.Charges.Data) == 0 || intent.Amount == 0 {
+		return
+	}
+	chargeID := intent.Charges.Data[0].ID
+	for key, value := range intent.Metadata {
+		if !strings.HasPrefix(key, transferMetadataPrefix) {
+			continue
+		}
+		account := strings.TrimPrefix(key, transferMetadataPrefix)
+		amount, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			logrus.WithError(err).WithField("payment_intent", intent.ID).Errorf("Invalid transfer amount for %s", account)
+			continue
+		}
+		if intent.AmountReceived < intent.Amount {
+			amount = amount * intent.AmountReceived / intent.Amount
+		}
+		if amount <= 0 {
+			continue
+		}
+
+		params := &stripe.TransferParams{
+			Amount:            stripe.Int64(amount),
+			Currency:          stripe.String(string(intent.Currency)),
+			Destination:       stripe.String(account),
+			SourceTransaction: stripe.String(chargeID),
+			TransferGroup:     stripe.String(intent.TransferGroup),
+		}
+		params.SetIdempotencyKey(intent.ID + "-" + chargeID + "-" + account)
+		err = s.call(func() error {
+			_, err := s.client.Transfers.New(params)
+			return err
+		})
+		if err != nil {
+			logrus.WithError(err).WithField("payment_intent", intent.ID).Errorf("Failed to transfer %d to %s", amount, account)
+		}
+	}
+}
+
+func (s *stripePaymentProvider) PaymentStatus(transactionID, transactionType string) (string, error) {
+	if transactionType == models.RefundTransactionType {
+		ref, err := s.client.Refunds.Get(transactionID, nil)
+		if err != nil {
+			return "", err
+		}
+		return refundState(ref.Status), nil
+	}
+
+	intent, err := s.client.PaymentIntents.Get(transactionID, nil)
+	if err != nil {
+		return "", err
+	}
+	switch intent.Status {
+	case stripe.PaymentIntentStatusSucceeded:
+		return models.PaidState, nil
+	case stripe.PaymentIntentStatusRequiresCapture:
+		return models.AuthorizedState, nil
+	case stripe.PaymentIntentStatusCanceled, stripe.PaymentIntentStatusRequiresPaymentMethod:
+		return models.FailedState, nil
+	}
+	return models.PendingState, nil
+}
+
 func (s *stripePaymentProvider) NewRefunder(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Refunder, error) {
 	return s.refund, nil
 }
 
+// refund refunds an amount of a payment intent. Marketplace payments are
+// taken back from the sellers in proportion: destination charges reverse
+// their transfer and refund the application fee, the transfers of payments
+// from several sellers are reversed, see reverseTransfers.
 func (s *stripePaymentProvider) refund(transactionID string, amount uint64, currency string) (string, error) {
+	var intent *stripe.PaymentIntent
+	err := s.call(func() (err error) {
+		intent, err = s.client.PaymentIntents.Get(transactionID, nil)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
 	stripeAmount := int64(amount)
-	ref, err := s.client.Refunds.New(&stripe.RefundParams{
+	params := &stripe.RefundParams{
 		Charge: &transactionID,
 		Amount: &stripeAmount,
+	}
+	if intent.TransferData != nil {
+		params.ReverseTransfer = stripe.Bool(true)
+		params.RefundApplicationFee = stripe.Bool(true)
+	}
+	params.SetIdempotencyKey(stripe.NewIdempotencyKey())
+	var ref *stripe.Refund
+	err = s.call(func() (err error) {
+		ref, err = s.client.Refunds.New(params)
+		return err
 	})
 	if err != nil {
 		return "", err
 	}
 
-	return ref.ID, err
+	if intent.TransferData == nil {
+		s.reverseTransfers(intent, ref.ID, stripeAmount)
+	}
+	return ref.ID, nil
+}
+
+// reverseTransfers takes back the transfers of a refunded payment intent from
+// the connected accounts of the sellers, in proportion to the refunded amount.
+// Reversals are idempotent for each refund and transfer. Failed reversals are
+// logged like failed transfers, the refund itself succeeded and reversals can
+// be made from the Stripe dashboard.
+func (s *stripePaymentProvider) reverseTransfers(intent *stripe.PaymentIntent, refundID string, amount int64) {
+	if intent.TransferGroup == "" || intent.AmountReceived == 0 {
+		return
+	}
+	chargeID := ""
+	if intent.Charges != nil && len(intent.Charges.Data) > 0 {
+		chargeID = intent.Charges.Data[0].ID
+	}
+
+	transfers := s.client.Transfers.List(&stripe.TransferListParams{
+		TransferGroup: stripe.String(intent.TransferGroup),
+	})
+	for transfers.Next() {
+		transfer := transfers.Transfer()
+		if transfer.SourceTransaction == nil || transfer.SourceTransaction.ID != chargeID {
+			continue
+		}
+		reversed := transfer.Amount * amount / intent.AmountReceived
+		if reversed > transfer.Amount-transfer.AmountReversed {
+			reversed = transfer.Amount - transfer.AmountReversed
+		}
+		if reversed <= 0 {
+			continue
+		}
+
+		params := &stripe.ReversalParams{
+			Transfer: stripe.String(transfer.ID),
+			Amount:   stripe.Int64(reversed),
+		}
+		params.SetIdempotencyKey(refundID + "-" + transfer.ID)
+		err := s.call(func() error {
+			_, err := s.client.Reversals.New(params)
+			return err
+		})
+		if err != nil {
+			logrus.WithError(err).WithField("payment_intent", intent.ID).Errorf("Failed to reverse %d of transfer %s", reversed, transfer.ID)
+		}
+	}
+	if err := transfers.Err(); err != nil {
+		logrus.WithError(err).WithField("payment_intent", intent.ID).Error("Failed to list the transfers to reverse")
+	}
 }
 
 func (s *stripePaymentProvider) NewPreauthorizer(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Preauthorizer, error) {
@@ -140,12 +434,156 @@ func (s *stripePaymentProvider) NewConfirmer(ctx context.Context, r *http.Reques
 	return s.confirm, nil
 }
 
-func (s *stripePaymentProvider) confirm(paymentID string) error {
-	_, err := s.client.PaymentIntents.Confirm(paymentID, nil)
+func (s *stripePaymentProvider) confirm(paymentID string) (string, error) {
+	intent, err := s.client.PaymentIntents.Confirm(paymentID, nil)
 
 	if stripeErr, ok := err.(*stripe.Error); ok {
-		return payments.NewPaymentConfirmFailError(stripeErr.Msg)
+		return "", payments.NewPaymentConfirmFailError(stripeErr.Msg)
+	}
+	if err != nil {
+		return "", err
 	}
 
-	return err
+	switch intent.Status {
+	case stripe.PaymentIntentStatusSucceeded:
+		s.transferSplits(intent)
+		return models.PaidState, nil
+	case stripe.PaymentIntentStatusRequiresCapture:
+		// authorize-only intents are captured when the order ships
+		return models.AuthorizedState, nil
+	case stripe.PaymentIntentStatusCanceled, stripe.PaymentIntentStatusRequiresPaymentMethod:
+		return models.FailedState, nil
+	}
+	return models.PendingState, nil
+}
+
+func (s *stripePaymentProvider) NewCapturer(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Capturer, error) {
+	return func(transactionID string, amount uint64, currency string) (string, error) {
+		return s.capture(transactionID, amount, currency, true)
+	}, nil
+}
+
+func (s *stripePaymentProvider) NewPartialCapturer(ctx context.Context, r *http.Request, log logrus.FieldLogger) (payments.Capturer, error) {
+	return func(transactionID string, amount uint64, currency string) (string, error) {
+		return s.capture(transactionID, amount, currency, false)
+	}, nil
+}
+
+// capture captures an amount of an authorized payment intent. Unless the
+// capture is final the rest stays authorized, which requires a card that
+// supports multicapture. Marketplace payments are transferred to the sellers
+// with the final capture, once the captured amount is known.
+func (s *stripePaymentProvider) capture(transactionID string, amount uint64, currency string, final bool) (string, error) {
+	params := &stripe.PaymentIntentCaptureParams{
+		AmountToCapture: stripe.Int64(int64(amount)),
+	}
+	if !final {
+		params.AddExtra("final_capture", "false")
+	}
+	intent, err := s.client.PaymentIntents.Capture(transactionID, params)
+	if err != nil {
+		return "", err
+	}
+	if final {
+		s.transferSplits(intent)
+	}
+
+	return intent.ID, nil
+}
+
+func (s *stripePaymentProvider) ParseWebhook(payload []byte, header http.Header, secret string) (*payments.PaymentEvent, error) {
+	event, err := webhook.ConstructEvent(payload, header.Get("Stripe-Signature"), secret)
+	if err != nil {
+		return nil, err
+	}
+
+	switch event.Type {
+	case "charge.succeeded":
+		charge := &stripe.Charge{}
+		if err := json.Unmarshal(event.Data.Raw, charge); err != nil {
+			return nil, errors.Wrap(err, "Failed to parse charge")
+		}
+		if !charge.Captured {
+			// Stripe also sends this event for authorizations that aren't
+			// captured yet
+			return nil, nil
+		}
+		return &payments.PaymentEvent{
+			ID:        event.ID,
+			Type:      payments.ChargeSucceededEvent,
+			ChargeIDs: chargeIDs(charge),
+		}, nil
+	case "charge.refunded":
+		charge := &stripe.Charge{}
+		if err := json.Unmarshal(event.Data.Raw, charge); err != nil {
+			return nil, errors.Wrap(err, "Failed to parse charge")
+		}
+		pe := &payments.PaymentEvent{
+			ID:        event.ID,
+			Type:      payments.ChargeRefundedEvent,
+			ChargeIDs: chargeIDs(charge),
+		}
+		if charge.Refunds != nil {
+			for _, ref := range charge.Refunds.Data {
+				pe.Refunds = append(pe.Refunds, &payments.RefundEvent{
+					ID:       ref.ID,
+					Amount:   uint64(ref.Amount),
+					Currency: strings.ToUpper(string(ref.Currency)),
+					Status:   refundState(ref.Status),
+				})
+			}
+		}
+		return pe, nil
+	case "charge.dispute.created":
+		dispute := &stripe.Dispute{}
+		if err := json.Unmarshal(event.Data.Raw, dispute); err != nil {
+			return nil, errors.Wrap(err, "Failed to parse dispute")
+		}
+		charge := dispute.Charge
+		if charge != nil && charge.PaymentIntent == "" {
+			// the dispute only references the charge ID, but charges made with
+			// payment intents are stored under the payment intent ID
+			if fetched, err := s.client.Charges.Get(charge.ID, nil); err == nil {
+				charge = fetched
+			}
+		}
+		pe := &payments.PaymentEvent{
+			ID:   event.ID,
+			Type: payments.DisputeCreatedEvent,
+			Dispute: &payments.DisputeEvent{
+				ID:       dispute.ID,
+				Reason:   string(dispute.Reason),
+				Amount:   uint64(dispute.Amount),
+				Currency: strings.ToUpper(string(dispute.Currency)),
+				Status:   string(dispute.Status),
+			},
+		}
+		if charge != nil {
+			pe.ChargeIDs = chargeIDs(charge)
+		}
+		if dispute.EvidenceDetails != nil && dispute.EvidenceDetails.DueBy > 0 {
+			dueBy := time.Unix(dispute.EvidenceDetails.DueBy, 0)
+			pe.Dispute.DueBy = &dueBy
+		}
+		return pe, nil
+	}
+	return nil, nil
+}
+
+func chargeIDs(charge *stripe.Charge) []string {
+	ids := []string{charge.ID}
+	if charge.PaymentIntent != "" {
+		ids = append(ids, charge.PaymentIntent)
+	}
+	return ids
+}
+
+func refundState(status stripe.RefundStatus) string {
+	switch status {
+	case stripe.RefundStatusSucceeded:
+		return models.PaidState
+	case stripe.RefundStatusFailed, stripe.RefundStatusCanceled:
+		return models.FailedState
+	}
+	return models.PendingState
 }
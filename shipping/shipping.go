@@ -0,0 +1,94 @@
+package shipping
+
+import (
+	"context"
+
+	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/models"
+)
+
+// FlatRateCarrier is the string identifier of the default carrier.
+const FlatRateCarrier = "flat_rate"
+
+// Package describes the parcel an order ships in. The weight is in grams and
+// the dimensions are in millimeters.
+type Package struct {
+	Weight uint64 `json:"weight"`
+	Length uint64 `json:"length"`
+	Width  uint64 `json:"width"`
+	Height uint64 `json:"height"`
+}
+
+// PackageFor packs the line items into one package by stacking them, so it's
+// as long and wide as the largest item and as high as all items together.
+func PackageFor(items []*models.LineItem) Package {
+	pkg := Package{}
+	for _, item := range items {
+		pkg.Weight += item.Weight * item.Quantity
+		pkg.Height += item.Height * item.Quantity
+		if item.Length > pkg.Length {
+			pkg.Length = item.Length
+		}
+		if item.Width > pkg.Width {
+			pkg.Width = item.Width
+		}
+	}
+	return pkg
+}
+
+// QuoteRequest holds what carriers need to know to quote shipping rates.
+type QuoteRequest struct {
+	Package     Package
+	Destination models.Address
+	Currency    string
+	// Total is the price of the items including taxes and discounts
+	Total uint64
+	// FreeShipping is set when a coupon waives shipping costs
+	FreeShipping bool
+	// Settings are the site settings with the shipping rates of the shop
+	Settings *calculator.Settings
+}
+
+// Quote is the price of shipping a package with a service of a carrier.
+type Quote struct {
+	Carrier  string `json:"carrier"`
+	Service  string `json:"service"`
+	Amount   uint64 `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// Carrier quotes the price of shipping a package to a destination.
+type Carrier interface {
+	Name() string
+	Quote(ctx context.Context, req *QuoteRequest) ([]Quote, error)
+}
+
+type flatRateCarrier struct{}
+
+// NewFlatRateCarrier creates the default carrier, which quotes the shipping
+// rates of the site settings. These are what orders are charged for shipping.
+func NewFlatRateCarrier() Carrier {
+	return &flatRateCarrier{}
+}
+
+func (c *flatRateCarrier) Name() string {
+	return FlatRateCarrier
+}
+
+func (c *flatRateCarrier) Quote(ctx context.Context, req *QuoteRequest) ([]Quote, error) {
+	amount := uint64(0)
+	if !req.FreeShipping {
+		amount = calculator.CalculateShipping(req.Settings, calculator.ShippingParameters{
+			Country:  req.Destination.Country,
+			Currency: req.Currency,
+			Total:    req.Total,
+			Weight:   req.Package.Weight,
+		})
+	}
+	return []Quote{{
+		Carrier:  FlatRateCarrier,
+		Service:  "standard",
+		Amount:   amount,
+		Currency: req.Currency,
+	}}, nil
+}